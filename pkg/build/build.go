@@ -43,6 +43,16 @@ type Interface interface {
 	Build(context.Context, string) (Result, error)
 }
 
+// PackageLister is implemented by builders that can tell which local
+// packages building an importpath reference compiles.
+type PackageLister interface {
+	// PackageDirs returns, for each local importpath that building the
+	// reference compiles into its image, the directories of the packages
+	// it depends on for any of the platforms it's built for, leaving out
+	// the standard library, with the importpath's own directory last.
+	PackageDirs(context.Context, string) ([][]string, error)
+}
+
 // Result represents the product of a Build. This is usually a v1.Image or v1.ImageIndex.
 type Result interface {
 	MediaType() (types.MediaType, error)
@@ -0,0 +1,431 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"golang.org/x/sync/errgroup"
+)
+
+// cacheLayoutGrace is how long blobs that nothing in a CacheLayout refers to
+// are kept, for other processes that may still be reading them, or that
+// have written them for an image they're about to add.
+const cacheLayoutGrace = time.Hour
+
+// CacheLayout is an OCI image layout that ko caches images in, which several
+// ko processes may use at once, e.g. parallel CI jobs sharing a cache
+// directory. Blobs are written atomically and checked against their digests
+// as they're written, index.json is replaced atomically while holding a
+// lock file, and blobs that nothing refers to any more are removed, so that
+// the layout only grows with what it holds.
+type CacheLayout struct {
+	dir   string
+	grace time.Duration
+
+	// m serializes this process's updates of index.json, and the lock
+	// file those of other processes.
+	m sync.Mutex
+}
+
+// NewCacheLayout returns the CacheLayout in dir, which is created when the
+// first image is added to it.
+func NewCacheLayout(dir string) *CacheLayout {
+	return &CacheLayout{dir: dir, grace: cacheLayoutGrace}
+}
+
+// Dir returns the directory of the layout.
+func (c *CacheLayout) Dir() string {
+	return c.dir
+}
+
+// Get returns the first image or index in index.json that matches, and its
+// descriptor there, or false if there's none. Blobs are checked cheaply, by
+// their sizes, since they were checked as they were written, and an entry
+// whose blobs are missing or damaged isn't returned. The children of an
+// index that weren't cached aren't checked.
+func (c *CacheLayout) Get(matcher match.Matcher) (v1.Descriptor, Result, bool) {
+	idx, err := layout.ImageIndexFromPath(c.dir)
+	if err != nil {
+		return v1.Descriptor{}, nil, false
+	}
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return v1.Descriptor{}, nil, false
+	}
+	for _, desc := range im.Manifests {
+		if !matcher(desc) {
+			continue
+		}
+		if err := c.check(desc, true); err != nil {
+			log.Printf("Not using %s cached in %s: %v", desc.Digest, c.dir, err)
+			return v1.Descriptor{}, nil, false
+		}
+		var res Result
+		if desc.MediaType.IsIndex() {
+			res, err = idx.ImageIndex(desc.Digest)
+		} else {
+			res, err = idx.Image(desc.Digest)
+		}
+		if err != nil {
+			return v1.Descriptor{}, nil, false
+		}
+		return desc, res, true
+	}
+	return v1.Descriptor{}, nil, false
+}
+
+// check checks that the blobs of desc, and of the manifests, configs and
+// layers it refers to, are there, and that manifests and configs have
+// their digests, and layers their sizes. Damaged blobs are removed, so
+// that they're written again. The children of an index whose manifests
+// aren't there weren't cached, unless it's the root.
+func (c *CacheLayout) check(desc v1.Descriptor, root bool) error {
+	raw, err := ioutil.ReadFile(c.blobPath(desc.Digest))
+	if os.IsNotExist(err) && !root {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := c.checkDigest(desc.Digest, raw); err != nil {
+		return err
+	}
+	switch {
+	case desc.MediaType.IsIndex():
+		im, err := v1.ParseIndexManifest(bytes.NewReader(raw))
+		if err != nil {
+			return err
+		}
+		for _, child := range im.Manifests {
+			if err := c.check(child, false); err != nil {
+				return err
+			}
+		}
+	case desc.MediaType.IsImage():
+		m, err := v1.ParseManifest(bytes.NewReader(raw))
+		if err != nil {
+			return err
+		}
+		config, err := ioutil.ReadFile(c.blobPath(m.Config.Digest))
+		if err != nil {
+			return err
+		}
+		if err := c.checkDigest(m.Config.Digest, config); err != nil {
+			return err
+		}
+		for _, l := range m.Layers {
+			// Foreign layers aren't cached.
+			if !l.MediaType.IsDistributable() {
+				continue
+			}
+			path := c.blobPath(l.Digest)
+			fi, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			if fi.Size() != l.Size {
+				os.Remove(path)
+				return fmt.Errorf("blob %s has %d bytes, not %d", l.Digest, fi.Size(), l.Size)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *CacheLayout) checkDigest(want v1.Hash, b []byte) error {
+	got, _, err := v1.SHA256(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	if got != want {
+		os.Remove(c.blobPath(want))
+		return fmt.Errorf("blob %s has digest %s", want, got)
+	}
+	return nil
+}
+
+func (c *CacheLayout) blobPath(h v1.Hash) string {
+	return filepath.Join(c.dir, "blobs", h.Algorithm, h.Hex)
+}
+
+// Replace adds res to the layout, with annotations, replacing the entries
+// that match replaces. Of the children of an index, only those that match
+// children are written, or all of them if it's nil. It then removes the
+// blobs that nothing refers to any more.
+func (c *CacheLayout) Replace(res Result, annotations map[string]string, replaces, children match.Matcher) error {
+	if err := os.MkdirAll(filepath.Join(c.dir, "blobs"), os.ModePerm); err != nil {
+		return WrapNoSpace(err, c.dir)
+	}
+	// Blobs are written without the lock, since they're written
+	// atomically, and blobs written for an image that isn't in index.json
+	// yet are new enough not to be removed.
+	if err := c.writeResult(res, children); err != nil {
+		return WrapNoSpace(err, c.dir)
+	}
+	raw, err := res.RawManifest()
+	if err != nil {
+		return err
+	}
+	digest, err := res.Digest()
+	if err != nil {
+		return err
+	}
+	mt, err := res.MediaType()
+	if err != nil {
+		return err
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	unlock, err := lockFile(filepath.Join(c.dir, "index.json.lock"))
+	if err != nil {
+		return fmt.Errorf("locking %s: %v", c.dir, err)
+	}
+	defer unlock()
+
+	// A missing or unreadable index.json is started afresh, keeping the
+	// blobs until they're old enough to remove.
+	old := &v1.IndexManifest{}
+	if b, err := ioutil.ReadFile(filepath.Join(c.dir, "index.json")); err == nil {
+		if im, err := v1.ParseIndexManifest(bytes.NewReader(b)); err == nil {
+			old = im
+		}
+	}
+	im := v1.IndexManifest{SchemaVersion: 2, MediaType: types.OCIImageIndex}
+	for _, desc := range old.Manifests {
+		if !replaces(desc) {
+			im.Manifests = append(im.Manifests, desc)
+		}
+	}
+	im.Manifests = append(im.Manifests, v1.Descriptor{
+		MediaType:   mt,
+		Size:        int64(len(raw)),
+		Digest:      digest,
+		Annotations: annotations,
+	})
+	if err := ioutil.WriteFile(filepath.Join(c.dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0666); err != nil {
+		return WrapNoSpace(err, c.dir)
+	}
+	if err := WriteFileAtomically(filepath.Join(c.dir, "index.json"), func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(im)
+	}); err != nil {
+		return err
+	}
+	c.prune(c.referenced(old.Manifests), c.referenced(im.Manifests))
+	return nil
+}
+
+// writeResult writes the blobs of res, and of those of its children that
+// match children, or all of them if it's nil. The manifest is written last,
+// so that the manifests that are there have all their blobs.
+func (c *CacheLayout) writeResult(res Result, children match.Matcher) error {
+	switch res := res.(type) {
+	case v1.ImageIndex:
+		im, err := res.IndexManifest()
+		if err != nil {
+			return err
+		}
+		for _, desc := range im.Manifests {
+			if children != nil && !children(desc) {
+				continue
+			}
+			var child Result
+			if desc.MediaType.IsIndex() {
+				child, err = res.ImageIndex(desc.Digest)
+			} else {
+				child, err = res.Image(desc.Digest)
+			}
+			if err != nil {
+				return err
+			}
+			if err := c.writeResult(child, nil); err != nil {
+				return err
+			}
+		}
+	case v1.Image:
+		layers, err := res.Layers()
+		if err != nil {
+			return err
+		}
+		var g errgroup.Group
+		for _, l := range layers {
+			l := l
+			g.Go(func() error {
+				mt, err := l.MediaType()
+				if err != nil {
+					return err
+				}
+				// Foreign layers aren't cached.
+				if !mt.IsDistributable() {
+					return nil
+				}
+				h, err := l.Digest()
+				if err != nil {
+					return err
+				}
+				return c.writeBlob(h, l.Compressed)
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return err
+		}
+		name, err := res.ConfigName()
+		if err != nil {
+			return err
+		}
+		config, err := res.RawConfigFile()
+		if err != nil {
+			return err
+		}
+		if err := c.writeBlob(name, bytesOpener(config)); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unexpected result %T", res)
+	}
+	h, err := res.Digest()
+	if err != nil {
+		return err
+	}
+	raw, err := res.RawManifest()
+	if err != nil {
+		return err
+	}
+	return c.writeBlob(h, bytesOpener(raw))
+}
+
+func bytesOpener(b []byte) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	}
+}
+
+// writeBlob writes the blob h from open, unless it's there already, in which
+// case it's marked as used now, so that it isn't removed before the image
+// it's written for is added.
+func (c *CacheLayout) writeBlob(h v1.Hash, open func() (io.ReadCloser, error)) error {
+	path := c.blobPath(h)
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	rc, err := open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return WriteFileAtomically(path, func(w io.Writer) error {
+		hasher, err := v1.Hasher(h.Algorithm)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(io.MultiWriter(w, hasher), rc); err != nil {
+			return err
+		}
+		if got := fmt.Sprintf("%x", hasher.Sum(nil)); got != h.Hex {
+			return fmt.Errorf("blob %s has digest %s:%s", h, h.Algorithm, got)
+		}
+		return nil
+	})
+}
+
+// referenced returns the blobs that descs refer to, as far as they're in the
+// layout.
+func (c *CacheLayout) referenced(descs []v1.Descriptor) map[v1.Hash]bool {
+	refs := map[v1.Hash]bool{}
+	var walk func(desc v1.Descriptor)
+	walk = func(desc v1.Descriptor) {
+		if refs[desc.Digest] {
+			return
+		}
+		refs[desc.Digest] = true
+		raw, err := ioutil.ReadFile(c.blobPath(desc.Digest))
+		if err != nil {
+			return
+		}
+		switch {
+		case desc.MediaType.IsIndex():
+			if im, err := v1.ParseIndexManifest(bytes.NewReader(raw)); err == nil {
+				for _, child := range im.Manifests {
+					walk(child)
+				}
+			}
+		case desc.MediaType.IsImage():
+			if m, err := v1.ParseManifest(bytes.NewReader(raw)); err == nil {
+				refs[m.Config.Digest] = true
+				for _, l := range m.Layers {
+					refs[l.Digest] = true
+				}
+			}
+		}
+	}
+	for _, desc := range descs {
+		walk(desc)
+	}
+	return refs
+}
+
+// prune removes the blobs that the new index.json doesn't refer to, those
+// not in after, once they're older than c.grace. Those that the old one
+// referred to, in before, are marked as used now, so that processes still
+// reading them have c.grace to finish.
+func (c *CacheLayout) prune(before, after map[v1.Hash]bool) {
+	now := time.Now()
+	for h := range before {
+		if !after[h] {
+			os.Chtimes(c.blobPath(h), now, now)
+		}
+	}
+	algs, err := ioutil.ReadDir(filepath.Join(c.dir, "blobs"))
+	if err != nil {
+		return
+	}
+	for _, alg := range algs {
+		if !alg.IsDir() {
+			continue
+		}
+		dir := filepath.Join(c.dir, "blobs", alg.Name())
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, fi := range fis {
+			// Temporary files of blobs being written have no digest, and
+			// are removed once they're old enough to have been abandoned.
+			if after[v1.Hash{Algorithm: alg.Name(), Hex: fi.Name()}] || now.Sub(fi.ModTime()) < c.grace {
+				continue
+			}
+			if err := os.Remove(filepath.Join(dir, fi.Name())); err != nil && !os.IsNotExist(err) {
+				log.Printf("Removing unused blob %s from %s: %v", fi.Name(), c.dir, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestCacheLayout(t *testing.T) {
+	dir := t.TempDir()
+	c := NewCacheLayout(dir)
+	c.grace = 0
+	named := func(name string) func(v1.Descriptor) bool {
+		return func(desc v1.Descriptor) bool { return desc.Annotations["name"] == name }
+	}
+	put := func(name string, img v1.Image) {
+		t.Helper()
+		if err := c.Replace(img, map[string]string{"name": name}, named(name), nil); err != nil {
+			t.Fatalf("Replace(%s) = %v", name, err)
+		}
+	}
+	blobs := func(img v1.Image) []v1.Hash {
+		t.Helper()
+		m, err := img.Manifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := img.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hs := []v1.Hash{h, m.Config.Digest}
+		for _, l := range m.Layers {
+			hs = append(hs, l.Digest)
+		}
+		return hs
+	}
+	exists := func(h v1.Hash) bool {
+		_, err := os.Stat(c.blobPath(h))
+		return err == nil
+	}
+
+	first, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put("app", first)
+	if _, res, ok := c.Get(named("app")); !ok || digest(t, res) != digest(t, first) {
+		t.Fatalf("Get() = %v, wanted %s", ok, digest(t, first))
+	}
+
+	// Replacing the image removes the blobs only it referred to.
+	second, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put("app", second)
+	for _, h := range blobs(first) {
+		if exists(h) {
+			t.Errorf("blob %s of the replaced image wasn't removed", h)
+		}
+	}
+	for _, h := range blobs(second) {
+		if !exists(h) {
+			t.Errorf("blob %s of the cached image was removed", h)
+		}
+	}
+
+	// Unless they may still be in use.
+	c.grace = cacheLayoutGrace
+	third, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put("app", third)
+	for _, h := range blobs(second) {
+		if !exists(h) {
+			t.Errorf("blob %s of the image just replaced was removed within the grace period", h)
+		}
+	}
+
+	// A damaged layer is found, and removed so that it's written again.
+	layer := blobs(third)[2]
+	if err := ioutil.WriteFile(c.blobPath(layer), []byte("partly written"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := c.Get(named("app")); ok {
+		t.Error("Get() with a damaged layer = true, wanted false")
+	}
+	if exists(layer) {
+		t.Error("Get() didn't remove the damaged layer")
+	}
+}
+
+func TestCacheLayoutConcurrentProcesses(t *testing.T) {
+	dir := t.TempDir()
+	// Each CacheLayout is like one in another process, with a mutex of
+	// its own, so that only the lock file serializes them.
+	const n = 8
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		img, err := random.Image(256, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(i int, img v1.Image) {
+			defer wg.Done()
+			name := fmt.Sprint(i)
+			if err := NewCacheLayout(dir).Replace(img, map[string]string{"name": name}, func(desc v1.Descriptor) bool {
+				return desc.Annotations["name"] == name
+			}, nil); err != nil {
+				t.Errorf("Replace(%s) = %v", name, err)
+			}
+		}(i, img)
+	}
+	wg.Wait()
+
+	c := NewCacheLayout(dir)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprint(i)
+		if _, _, ok := c.Get(func(desc v1.Descriptor) bool { return desc.Annotations["name"] == name }); !ok {
+			t.Errorf("Get(%s) = false, wanted the image each process added", name)
+		}
+	}
+}
@@ -16,7 +16,15 @@ limitations under the License.
 
 package build
 
-import "strings"
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
 
 // Note: The structs, types, and functions are based upon GoReleaser build
 // configuration to have a loosely compatible YAML configuration:
@@ -62,7 +70,7 @@ func (a *FlagArray) UnmarshalYAML(unmarshal func(interface{}) error) error {
 // the original GoReleaser name to match better with the ko naming.
 //
 // TODO: Introduce support for more fields where possible and where it makes
-///      sense for `ko`, for example ModTimestamp, Env, or GoBinary.
+///      sense for `ko`, for example ModTimestamp.
 //
 type Config struct {
 	// ID only serves as an identifier internally
@@ -79,9 +87,37 @@ type Config struct {
 	Ldflags StringArray `yaml:",omitempty"`
 	Flags   FlagArray   `yaml:",omitempty"`
 
+	// Gcflags and Asmflags are each passed as separate -gcflags and
+	// -asmflags arguments, e.g. "all=-N -l" or "example.com/pkg=-m"
+	Gcflags  StringArray `yaml:",omitempty"`
+	Asmflags StringArray `yaml:",omitempty"`
+
 	// Env allows setting environment variables for `go build`
 	Env []string `yaml:",omitempty"`
 
+	// Cgo builds with CGO_ENABLED=1, like WithCgo, for the importpaths this
+	// configures. CGO_ENABLED in Env still wins.
+	Cgo bool `yaml:",omitempty"`
+
+	// GoBinary is the go binary to build with, e.g. go1.21rc2, instead of
+	// the one ko was configured with (see WithGoBinary) or go on PATH.
+	GoBinary string `yaml:",omitempty"`
+
+	// Prebuild is a command and its arguments to run in the module
+	// directory before building, e.g. to generate code. It replaces any
+	// hook set with WithPrebuild.
+	Prebuild []string `yaml:",omitempty"`
+
+	// MaxBinarySize fails builds whose binary is larger than this, e.g.
+	// "20MB". It replaces any limit set with WithMaxBinarySize.
+	MaxBinarySize string `yaml:",omitempty"`
+
+	// Platforms scopes Env, Flags and Ldflags to platforms, keyed by a
+	// platform selector like "linux/arm64", "linux" or "linux/arm/v7".
+	// When building for a platform a selector matches, they're merged over
+	// the settings above, so that the platform's settings win.
+	Platforms map[string]PlatformConfig `yaml:",omitempty"`
+
 	// Other GoReleaser fields that are not supported or do not make sense
 	// in the context of ko, for reference or for future use:
 	// Goos         []string    `yaml:",omitempty"`
@@ -91,8 +127,220 @@ type Config struct {
 	// Targets      []string    `yaml:",omitempty"`
 	// Binary       string      `yaml:",omitempty"`
 	// Lang         string      `yaml:",omitempty"`
-	// Asmflags     StringArray `yaml:",omitempty"`
-	// Gcflags      StringArray `yaml:",omitempty"`
 	// ModTimestamp string      `yaml:"mod_timestamp,omitempty"`
-	// GoBinary     string      `yaml:",omitempty"`
+}
+
+// PlatformConfig is the build configuration for the platforms of a selector
+// in Config.Platforms.
+type PlatformConfig struct {
+	Ldflags StringArray `yaml:",omitempty"`
+	Flags   FlagArray   `yaml:",omitempty"`
+	Env     []string    `yaml:",omitempty"`
+
+	// CC and CXX are the C and C++ (cross) compilers for cgo builds for
+	// these platforms, e.g. aarch64-linux-gnu-gcc. They're set before Env,
+	// so CC or CXX in Env win.
+	CC  string `yaml:"cc,omitempty"`
+	CXX string `yaml:"cxx,omitempty"`
+}
+
+// ParsePlatformSelector parses a key of Config.Platforms: an os, and
+// optionally an architecture and variant, separated by "/".
+func ParsePlatformSelector(selector string) (v1.Platform, error) {
+	parts := strings.Split(selector, "/")
+	for _, part := range parts {
+		if part == "" {
+			return v1.Platform{}, fmt.Errorf("invalid platform selector %q, expected os[/arch[/variant]]", selector)
+		}
+	}
+	if len(parts) > 3 {
+		return v1.Platform{}, fmt.Errorf("too many slashes in platform selector %q", selector)
+	}
+	var p v1.Platform
+	p.OS = parts[0]
+	if len(parts) > 1 {
+		p.Architecture = parts[1]
+	}
+	if len(parts) > 2 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// platformSelectors returns the keys of c.Platforms in the order to merge
+// them in: less specific selectors first, so that e.g. "linux/arm64" wins
+// over "linux", with ties broken lexically.
+func (c Config) platformSelectors() []string {
+	selectors := make([]string, 0, len(c.Platforms))
+	for selector := range c.Platforms {
+		selectors = append(selectors, selector)
+	}
+	sort.Slice(selectors, func(i, j int) bool {
+		ni, nj := strings.Count(selectors[i], "/"), strings.Count(selectors[j], "/")
+		if ni != nj {
+			return ni < nj
+		}
+		return selectors[i] < selectors[j]
+	})
+	return selectors
+}
+
+// forPlatform returns c with the settings of each selector in c.Platforms
+// that matches platform appended to its own. It doesn't modify c.
+func (c Config) forPlatform(platform v1.Platform) Config {
+	c.Env = append([]string(nil), c.Env...)
+	c.Flags = append(FlagArray(nil), c.Flags...)
+	c.Ldflags = append(StringArray(nil), c.Ldflags...)
+	for _, selector := range c.platformSelectors() {
+		p, err := ParsePlatformSelector(selector)
+		if err != nil || !platformMatches(p, &platform) {
+			continue
+		}
+		pc := c.Platforms[selector]
+		if pc.CC != "" {
+			c.Env = append(c.Env, "CC="+pc.CC)
+		}
+		if pc.CXX != "" {
+			c.Env = append(c.Env, "CXX="+pc.CXX)
+		}
+		c.Env = append(c.Env, pc.Env...)
+		c.Flags = append(c.Flags, pc.Flags...)
+		c.Ldflags = append(c.Ldflags, pc.Ldflags...)
+	}
+	return c
+}
+
+// DefaultConfigKey is the key of the build configuration that applies to
+// importpaths without a more specific configuration. Like the go tool's
+// pattern for all packages, it is set as `main: "..."` in .ko.yaml.
+const DefaultConfigKey = "..."
+
+// ConfigResolver returns the build configuration for the given importpath,
+// and whether one was found.
+type ConfigResolver func(importpath string) (Config, bool)
+
+// isConfigPattern reports whether the key is an importpath pattern rather
+// than a literal importpath.
+func isConfigPattern(key string) bool {
+	return strings.ContainsAny(key, "*?[") || key == "..." || strings.HasSuffix(key, "/...")
+}
+
+// matchConfigPattern reports whether the importpath matches the pattern.
+// Patterns use path.Match syntax, and may end in "/..." to match an
+// importpath and everything beneath it, like the go tool.
+func matchConfigPattern(pattern, importpath string) bool {
+	if pattern == "..." {
+		return true
+	}
+	if strings.HasSuffix(pattern, "/...") {
+		prefix := strings.TrimSuffix(pattern, "/...")
+		if ok, _ := path.Match(prefix, importpath); ok {
+			return true
+		}
+		for dir := path.Dir(importpath); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if ok, _ := path.Match(prefix, dir); ok {
+				return true
+			}
+		}
+		return false
+	}
+	ok, _ := path.Match(pattern, importpath)
+	return ok
+}
+
+// NewConfigResolver returns a ConfigResolver for the given configurations,
+// keyed by importpath, importpath pattern, or DefaultConfigKey.
+//
+// An exact importpath match takes precedence over any pattern. When more
+// than one pattern matches, the longest (most specific) pattern wins, with
+// ties broken lexically so that the result is deterministic. The default
+// configuration is used only when nothing else matches.
+func NewConfigResolver(buildConfigs map[string]Config) ConfigResolver {
+	configKey := newConfigKeyResolver(buildConfigs)
+	return func(importpath string) (Config, bool) {
+		key, ok := configKey(importpath)
+		if !ok {
+			return Config{}, false
+		}
+		return buildConfigs[key], true
+	}
+}
+
+// newConfigKeyResolver returns a function that returns the key of the
+// configuration for an importpath, following the precedence rules of
+// NewConfigResolver.
+func newConfigKeyResolver(buildConfigs map[string]Config) func(string) (string, bool) {
+	var patterns []string
+	for key := range buildConfigs {
+		if key != DefaultConfigKey && isConfigPattern(key) {
+			patterns = append(patterns, key)
+		}
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) > len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+
+	return func(importpath string) (string, bool) {
+		if _, ok := buildConfigs[importpath]; ok {
+			return importpath, true
+		}
+		for _, pattern := range patterns {
+			if matchConfigPattern(pattern, importpath) {
+				return pattern, true
+			}
+		}
+		_, ok := buildConfigs[DefaultConfigKey]
+		return DefaultConfigKey, ok
+	}
+}
+
+// ConfigTracker resolves build configurations like NewConfigResolver, and
+// records which of them were used, so that entries that don't apply to
+// anything we build can be reported.
+type ConfigTracker struct {
+	configs   map[string]Config
+	configKey func(string) (string, bool)
+
+	mu   sync.Mutex
+	used map[string]bool
+}
+
+// NewConfigTracker returns a ConfigTracker for the given configurations,
+// keyed like for NewConfigResolver.
+func NewConfigTracker(buildConfigs map[string]Config) *ConfigTracker {
+	return &ConfigTracker{
+		configs:   buildConfigs,
+		configKey: newConfigKeyResolver(buildConfigs),
+		used:      map[string]bool{},
+	}
+}
+
+// Resolve implements ConfigResolver.
+func (t *ConfigTracker) Resolve(importpath string) (Config, bool) {
+	key, ok := t.configKey(importpath)
+	if !ok {
+		return Config{}, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.used[key] = true
+	return t.configs[key], true
+}
+
+// Unused returns the sorted keys of the configurations that haven't been
+// resolved for any importpath so far.
+func (t *ConfigTracker) Unused() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var unused []string
+	for key := range t.configs {
+		if !t.used[key] {
+			unused = append(unused, key)
+		}
+	}
+	sort.Strings(unused)
+	return unused
 }
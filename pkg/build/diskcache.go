@@ -0,0 +1,429 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// The annotations of the images in a DiskCache: the key they were built
+// for, and the importpath and platforms they were built for, of which only
+// the latest build is kept.
+const (
+	diskCacheKeyAnnotation        = "ko.build/cache-key"
+	diskCacheImportPathAnnotation = "ko.build/importpath"
+	diskCachePlatformAnnotation   = "ko.build/platform"
+)
+
+// cacheKeyer is implemented by builders whose builds a DiskCache can reuse.
+type cacheKeyer interface {
+	// cacheKey returns a key that changes whenever building s with ctx
+	// would build something else, and the context to build s with on a
+	// miss. It returns false if builds of s can't be reused.
+	cacheKey(ctx context.Context, s string) (context.Context, string, bool, error)
+}
+
+// DiskCache composes with a builder from NewGo to reuse images built by
+// earlier invocations of ko, which it keeps in a CacheLayout. Images are
+// rebuilt when their Go source or kodata, base image, or build configuration
+// changes. Only the latest build of each importpath and platforms is kept.
+type DiskCache struct {
+	Builder Interface
+	layout  *CacheLayout
+	keys    cacheKeyer
+}
+
+// DiskCache implements Interface
+var _ Interface = (*DiskCache)(nil)
+
+// NewDiskCache returns a builder that reuses the builds of b cached in dir,
+// and caches new ones there. b must be from NewGo.
+func NewDiskCache(b Interface, dir string) (*DiskCache, error) {
+	keys, ok := b.(cacheKeyer)
+	if !ok {
+		return nil, fmt.Errorf("builds of %T can't be cached", b)
+	}
+	return &DiskCache{Builder: b, layout: NewCacheLayout(dir), keys: keys}, nil
+}
+
+// QualifyImport implements Interface
+func (d *DiskCache) QualifyImport(ip string) (string, error) {
+	return d.Builder.QualifyImport(ip)
+}
+
+// IsSupportedReference implements Interface
+func (d *DiskCache) IsSupportedReference(ip string) error {
+	return d.Builder.IsSupportedReference(ip)
+}
+
+// Build implements Interface
+func (d *DiskCache) Build(ctx context.Context, s string) (Result, error) {
+	ctx, key, ok, err := d.keys.cacheKey(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return d.Builder.Build(ctx, s)
+	}
+	if res, ok := d.get(key); ok {
+		log.Printf("Using the build of %s cached in %s", s, d.layout.Dir())
+		return res, nil
+	}
+	res, err := d.Builder.Build(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.put(ctx, s, key, res); err != nil {
+		// The build still succeeded, it just won't be reused.
+		log.Printf("Not caching the build of %s: %v", s, err)
+	}
+	return res, nil
+}
+
+// get returns the image or index cached for key, or false if there's none.
+func (d *DiskCache) get(key string) (Result, bool) {
+	_, res, ok := d.layout.Get(func(desc v1.Descriptor) bool {
+		return desc.Annotations[diskCacheKeyAnnotation] == key
+	})
+	return res, ok
+}
+
+// put caches res as the build of s for key, replacing earlier builds of s
+// for the same platforms.
+func (d *DiskCache) put(ctx context.Context, s, key string, res Result) error {
+	ip := strings.TrimPrefix(s, StrictScheme)
+	var platform string
+	if pm := contextPlatform(ctx); pm != nil {
+		platform = pm.spec
+	}
+	return d.layout.Replace(res, map[string]string{
+		diskCacheKeyAnnotation:        key,
+		diskCacheImportPathAnnotation: ip,
+		diskCachePlatformAnnotation:   platform,
+	}, func(desc v1.Descriptor) bool {
+		return desc.Annotations[diskCacheImportPathAnnotation] == ip &&
+			desc.Annotations[diskCachePlatformAnnotation] == platform
+	}, nil)
+}
+
+// prebuiltKey is the context key for what cacheKey already did for a build:
+// run its prebuild hooks, and fetch its base image.
+type prebuiltKey struct{}
+
+type prebuilt struct {
+	s       string
+	baseRef name.Reference
+	base    Result
+}
+
+// contextPrebuilt returns what cacheKey already did for building s with
+// ctx, if anything.
+func contextPrebuilt(ctx context.Context, s string) (prebuilt, bool) {
+	p, ok := ctx.Value(prebuiltKey{}).(prebuilt)
+	return p, ok && p.s == s
+}
+
+// cacheKey implements cacheKeyer. It runs the prebuild hooks of s, since
+// they may generate its source, and fetches its base, which the build then
+// reuses.
+func (g *gobuild) cacheKey(ctx context.Context, s string) (context.Context, string, bool, error) {
+	// The cache holds images, not the SBOMs generated with them.
+	if g.sbom != "" {
+		return ctx, "", false, nil
+	}
+	ref := newRef(s)
+	ips := []string{ref.Path()}
+	if multi, ok := MultiImportPaths(s); ok {
+		ips = multi
+	}
+	for _, ip := range ips {
+		// Branches and the like can move without anything here changing.
+		if _, version, ok := ExternalImportPath(ip); ok && !isImmutableVersion(version) {
+			return ctx, "", false, nil
+		}
+	}
+
+	if err := g.runPrebuild(ctx, s); err != nil {
+		return ctx, "", false, err
+	}
+	pre := prebuilt{s: s}
+
+	h := sha256.New()
+	field := func(k string, v interface{}) error {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s %s\n", k, b)
+		return nil
+	}
+
+	pm := g.matcher(ctx)
+	version, err := goVersion(ctx, goBinaryOrDefault(g.goBinary))
+	if err != nil {
+		return ctx, "", false, err
+	}
+	labels, err := g.labelsFor(ctx, s)
+	if err != nil {
+		return ctx, "", false, err
+	}
+	if err := field("build", struct {
+		ImportPath, Platform, GoVersion  string
+		CreationTime, KoDataCreationTime v1.Time
+		Labels                           map[string]string
+		ImageEnv                         []string
+		BinaryCollision                  BinaryCollisionPolicy
+		BasePlatformPolicy               BasePlatformPolicy
+		WasmPackaging                    WasmPackaging
+		Env                              []string
+	}{
+		ImportPath:         s,
+		Platform:           pm.spec,
+		GoVersion:          version,
+		CreationTime:       g.creationTime,
+		KoDataCreationTime: g.kodataCreationTime,
+		Labels:             labels,
+		ImageEnv:           g.imageEnv,
+		BinaryCollision:    g.binaryCollision,
+		BasePlatformPolicy: g.basePlatformPolicy,
+		WasmPackaging:      g.wasmPackaging,
+		Env:                goToolEnv(os.Environ()),
+	}); err != nil {
+		return ctx, "", false, err
+	}
+
+	var local []string
+	var tags []string
+	for _, ip := range ips {
+		configKey, _, _ := ExternalImportPath(ip)
+		config := g.configForImportPath(configKey)
+		// Templated flags are hashed as they're expanded.
+		args, err := createBuildArgs(config)
+		if err != nil {
+			return ctx, "", false, err
+		}
+		if err := field("config "+ip, struct {
+			Config Config
+			Args   []string
+		}{config, args}); err != nil {
+			return ctx, "", false, err
+		}
+		if _, _, ok := ExternalImportPath(ip); !ok {
+			local = append(local, ip)
+			if i, ok := tagsFlag(config.Flags); i >= 0 {
+				t := config.Flags[i]
+				if ok {
+					t = t[strings.Index(t, "=")+1:]
+				}
+				tags = append(tags, t)
+			}
+		}
+	}
+	if len(local) > 0 {
+		if err := g.hashSource(ctx, h, local, strings.Join(tags, ","), pm); err != nil {
+			return ctx, "", false, err
+		}
+		// Only the entrypoint's kodata goes in the image.
+		if _, _, ok := ExternalImportPath(ips[0]); !ok {
+			kodata, err := g.kodataPath(newRef(StrictScheme + ips[0]))
+			if err != nil {
+				return ctx, "", false, err
+			}
+			fmt.Fprintln(h, "kodata")
+			if err := hashTree(h, kodata, ""); err != nil {
+				return ctx, "", false, err
+			}
+		}
+	}
+
+	// Modules for wasip1/wasm have no base image.
+	if wasm, err := pm.wasm(); err != nil {
+		return ctx, "", false, err
+	} else if !wasm {
+		pre.baseRef, pre.base, err = g.getBase(ctx, baseImportPath(s))
+		if err != nil {
+			return ctx, "", false, err
+		}
+		digest, err := pre.base.Digest()
+		if err != nil {
+			return ctx, "", false, err
+		}
+		fmt.Fprintf(h, "base %s %s\n", pre.baseRef, digest)
+	}
+
+	return context.WithValue(ctx, prebuiltKey{}, pre), hex.EncodeToString(h.Sum(nil)), true, nil
+}
+
+// goToolEnv returns the variables of env that affect the go tool, sorted.
+func goToolEnv(env []string) []string {
+	var out []string
+	for _, kv := range env {
+		k := envKey(kv)
+		switch {
+		case strings.HasPrefix(k, "GO"), strings.HasPrefix(k, "CGO_"),
+			k == "CC", k == "CXX", k == "AR", k == "PKG_CONFIG":
+			out = append(out, kv)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// hashSource hashes the source of the packages that importpaths depend on,
+// for each os and arch of pm, or for this machine's with "all". Packages in
+// the module cache are hashed by their directory, which includes their
+// module's version, since they can't change.
+func (g *gobuild) hashSource(ctx context.Context, h hash.Hash, importpaths []string, tags string, pm *platformMatcher) error {
+	bin := goBinaryOrDefault(g.goBinary)
+	out, err := exec.CommandContext(ctx, bin, "env", "GOMODCACHE").Output()
+	if err != nil {
+		return fmt.Errorf("go env GOMODCACHE: %v", err)
+	}
+	modCache := strings.TrimSpace(string(out))
+
+	var envs [][]string
+	seen := map[string]bool{}
+	for _, p := range pm.platforms {
+		if p.OS == "" || seen[p.OS+"/"+p.Architecture] {
+			continue
+		}
+		seen[p.OS+"/"+p.Architecture] = true
+		env := []string{"GOOS=" + p.OS}
+		if p.Architecture != "" {
+			env = append(env, "GOARCH="+p.Architecture)
+		}
+		envs = append(envs, env)
+	}
+	if len(envs) == 0 {
+		envs = [][]string{nil}
+	}
+
+	dirs := map[string][]string{}
+	for _, env := range envs {
+		args := []string{"list", "-deps", "-f", "{{if not .Standard}}{{.Dir}}{{range .EmbedFiles}}\t{{.}}{{end}}{{end}}"}
+		if tags != "" {
+			args = append(args, "-tags="+tags)
+		}
+		cmd := exec.CommandContext(ctx, bin, append(args, importpaths...)...)
+		cmd.Dir = g.dir
+		cmd.Env = append(append(os.Environ(), g.env...), env...)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return fmt.Errorf("go list -deps %s: %v\n%s", strings.Join(importpaths, " "), err, stderr.String())
+		}
+		s := bufio.NewScanner(bytes.NewReader(out))
+		for s.Scan() {
+			if fields := strings.Split(s.Text(), "\t"); fields[0] != "" {
+				dirs[fields[0]] = append(dirs[fields[0]], fields[1:]...)
+			}
+		}
+	}
+
+	sorted := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	sort.Strings(sorted)
+	for _, dir := range sorted {
+		fmt.Fprintf(h, "package %s\n", dir)
+		if modCache != "" && strings.HasPrefix(dir, modCache+string(filepath.Separator)) {
+			continue
+		}
+		// Every file, not only those built for this platform, and whatever
+		// the package embeds.
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, fi := range fis {
+			if fi.Mode().IsRegular() {
+				if err := hashFile(h, filepath.Join(dir, fi.Name()), fi.Name()); err != nil {
+					return err
+				}
+			}
+		}
+		embeds := dirs[dir]
+		sort.Strings(embeds)
+		for _, f := range embeds {
+			if err := hashFile(h, filepath.Join(dir, f), f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hashFile hashes the name and content of file.
+func hashFile(h hash.Hash, file, name string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fmt.Fprintf(h, "file %s\n", name)
+	_, err = io.Copy(h, f)
+	return err
+}
+
+// hashTree hashes the names and content of the files under root, following
+// symlinks like the kodata layer does. A missing root hashes nothing.
+func hashTree(h hash.Hash, root, name string) error {
+	fis, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		path, rel := filepath.Join(root, fi.Name()), filepath.Join(name, fi.Name())
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if fi, err = os.Stat(path); err != nil {
+				return err
+			}
+		}
+		if fi.IsDir() {
+			fmt.Fprintf(h, "dir %s\n", rel)
+			if err := hashTree(h, path, rel); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Fprintf(h, "mode %s %s\n", rel, fi.Mode())
+		if err := hashFile(h, path, rel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
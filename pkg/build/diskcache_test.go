@@ -0,0 +1,177 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestDiskCache(t *testing.T) {
+	// A module of its own, so that its source can change.
+	mod, err := ioutil.TempDir("", "ko")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mod)
+	write := func(file, content string) {
+		t.Helper()
+		file = filepath.Join(mod, file)
+		if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("go.mod", "module example.com/cached\n\ngo 1.16\n")
+	write("main.go", "package main\n\nfunc main() {}\n")
+	cacheDir := filepath.Join(mod, "cache")
+
+	base, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image() = %v", err)
+	}
+	var builds int32
+	counting := func(ctx context.Context, ip, dir string, platform v1.Platform, config Config) (string, error) {
+		atomic.AddInt32(&builds, 1)
+		return writeTempFile(ctx, ip, dir, platform, config)
+	}
+	// Each build is like a separate invocation of ko.
+	build := func(opts ...Option) v1.Hash {
+		t.Helper()
+		opts = append([]Option{
+			WithBaseImages(func(context.Context, string) (name.Reference, Result, error) { return baseRef, base, nil }),
+			withBuilder(counting),
+		}, opts...)
+		ng, err := NewGo(context.Background(), mod, opts...)
+		if err != nil {
+			t.Fatalf("NewGo() = %v", err)
+		}
+		dc, err := NewDiskCache(ng, cacheDir)
+		if err != nil {
+			t.Fatalf("NewDiskCache() = %v", err)
+		}
+		res, err := dc.Build(context.Background(), StrictScheme+"example.com/cached")
+		if err != nil {
+			t.Fatalf("Build() = %v", err)
+		}
+		d, err := res.Digest()
+		if err != nil {
+			t.Fatalf("Digest() = %v", err)
+		}
+		return d
+	}
+	check := func(desc string, got v1.Hash, want v1.Hash, wantBuilds int32) {
+		t.Helper()
+		if n := atomic.LoadInt32(&builds); n != wantBuilds {
+			t.Errorf("%s: built %d times, wanted %d", desc, n, wantBuilds)
+		}
+		if got != want {
+			t.Errorf("%s: built %s, wanted %s", desc, got, want)
+		}
+	}
+
+	first := build()
+	check("first build", first, first, 1)
+	check("unchanged", build(), first, 1)
+
+	write("main.go", "package main\n\nfunc main() { println() }\n")
+	d := build()
+	check("changed source", d, d, 2)
+	check("unchanged again", build(), d, 2)
+
+	write("kodata/index.html", "hello")
+	kodata := build()
+	check("changed kodata", kodata, kodata, 3)
+
+	ldflags := build(WithLdflags([]string{"-s"}))
+	check("changed flags", ldflags, ldflags, 4)
+	check("unchanged flags", build(WithLdflags([]string{"-s"})), ldflags, 4)
+	// Only the latest build of each importpath and platform is kept.
+	check("original flags", build(), kodata, 5)
+
+	if base, err = random.Image(1024, 1); err != nil {
+		t.Fatalf("random.Image() = %v", err)
+	}
+	rebased := build()
+	check("changed base", rebased, rebased, 6)
+
+	if err := os.RemoveAll(cacheDir); err != nil {
+		t.Fatal(err)
+	}
+	check("removed cache", build(), rebased, 7)
+}
+
+func TestDiskCacheBasePlatformPolicy(t *testing.T) {
+	mod, err := ioutil.TempDir("", "ko")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mod)
+	for file, content := range map[string]string{
+		"go.mod":  "module example.com/cached\n\ngo 1.16\n",
+		"main.go": "package main\n\nfunc main() {}\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(mod, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cacheDir := filepath.Join(mod, "cache")
+	base := platformIndex(t, v1.Platform{OS: "linux", Architecture: "amd64"})
+
+	build := func(policy BasePlatformPolicy) error {
+		t.Helper()
+		ng, err := NewGo(context.Background(), mod,
+			WithBaseImages(func(context.Context, string) (name.Reference, Result, error) { return baseRef, base, nil }),
+			WithPlatforms("linux/amd64,linux/arm64"),
+			WithBasePlatformPolicy(policy),
+			withBuilder(writeTempFile),
+		)
+		if err != nil {
+			t.Fatalf("NewGo() = %v", err)
+		}
+		dc, err := NewDiskCache(ng, cacheDir)
+		if err != nil {
+			t.Fatalf("NewDiskCache() = %v", err)
+		}
+		_, err = dc.Build(context.Background(), StrictScheme+"example.com/cached")
+		return err
+	}
+
+	// The emulated linux/arm64 image is cached, but strict builds don't
+	// reuse it.
+	if err := build(BasePlatformEmulate); err != nil {
+		t.Fatalf("Build() with emulate = %v", err)
+	}
+	if err := build(BasePlatformStrict); err == nil || !strings.Contains(err.Error(), "does not provide platforms linux/arm64") {
+		t.Errorf("Build() with strict after emulate = %v, wanted error about linux/arm64", err)
+	}
+}
+
+func TestDiskCacheNeedsGo(t *testing.T) {
+	if _, err := NewDiskCache(&sleeper{}, "cache"); err == nil {
+		t.Error("NewDiskCache() = nil, wanted an error for a builder that isn't from NewGo")
+	}
+}
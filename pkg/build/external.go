@@ -0,0 +1,107 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"golang.org/x/mod/semver"
+)
+
+// ExternalImportPath splits a reference to a main package in another module
+// at a pinned version, e.g. "ko://example.com/tools/cmd/gen@v1.4.2", into its
+// importpath and version, and reports whether s is one. External importpaths
+// are downloaded through the module proxy (honoring GOPROXY, GOPRIVATE, etc.),
+// and don't provide kodata.
+func ExternalImportPath(s string) (importpath, version string, ok bool) {
+	s = strings.TrimPrefix(s, StrictScheme)
+	i := strings.Index(s, "@")
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+1:], true
+}
+
+// ExternalName returns a name for the image of importpath at version,
+// suitable for a publish.Namer: the importpath, followed by the version,
+// with any "+" (e.g. in "+incompatible") replaced, since that isn't allowed
+// in repositories.
+func ExternalName(importpath, version string) string {
+	return importpath + "-" + strings.ReplaceAll(version, "+", "-")
+}
+
+var commitHash = regexp.MustCompile("^[0-9a-f]{40}$")
+
+// isImmutableVersion reports whether version always resolves to the same
+// module content: a complete semantic version (including pseudo-versions),
+// or a full commit hash. Branch names, "latest", and version prefixes like
+// "v1" or "v1.4" can move.
+func isImmutableVersion(version string) bool {
+	if commitHash.MatchString(version) {
+		return true
+	}
+	if !semver.IsValid(version) {
+		return false
+	}
+	// Canonical drops "+incompatible" and other build metadata, but also
+	// fills in missing minor and patch versions, which we don't want.
+	return semver.Canonical(version) == strings.SplitN(version, "+", 2)[0]
+}
+
+// externalModule creates a module in dir that requires the module providing
+// importpath at version, so that importpath can be built from dir. It fails
+// if importpath isn't a main package.
+func externalModule(ctx context.Context, goBinary, dir, importpath, version string, env []string) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return WrapNoSpace(err, dir)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("module ko.local/external\n"), 0644); err != nil {
+		return WrapNoSpace(err, dir)
+	}
+	if _, err := goCommand(ctx, goBinary, dir, env, "get", "-d", importpath+"@"+version); err != nil {
+		return fmt.Errorf("downloading %s@%s: %v", importpath, version, err)
+	}
+	name, err := goCommand(ctx, goBinary, dir, env, "list", "-f", "{{.Name}}", importpath)
+	if err != nil {
+		return fmt.Errorf("loading %s@%s: %v", importpath, version, err)
+	}
+	if name != "main" {
+		return fmt.Errorf("%s@%s is not `package main`", importpath, version)
+	}
+	return nil
+}
+
+// goCommand runs the go tool (goBinary, or go on PATH) with args in dir, and
+// returns its trimmed output.
+func goCommand(ctx context.Context, goBinary, dir string, env []string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, goBinaryOrDefault(goBinary), args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("go %s: %v\n%s", args[0], err, stderr.String())
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
@@ -20,6 +20,8 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -31,9 +33,13 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"text/template"
+	"time"
 
 	"github.com/containerd/stargz-snapshotter/estargz"
 	"github.com/google/go-containerregistry/pkg/name"
@@ -42,6 +48,7 @@ import (
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/google/ko/pkg/warnings"
 	specsv1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"golang.org/x/tools/go/packages"
 )
@@ -70,12 +77,43 @@ type gobuild struct {
 	kodataCreationTime   v1.Time
 	build                builder
 	disableOptimizations bool
-	buildConfigs         map[string]Config
+	resolveConfig        ConfigResolver
 	mod                  *modules
 	buildContext         buildContext
 	platformMatcher      *platformMatcher
 	dir                  string
 	labels               map[string]string
+	imageEnv             []string
+	minFreeSpace         uint64
+	ldflags              []string
+	cgo                  bool
+	env                  []string
+	moduleEnv            []string
+	sbom                 SBOMFormat
+	sboms                *SBOMs
+	tags                 []string
+	goFlags              []string
+	gcflags              []string
+	asmflags             []string
+	binaryCollision      BinaryCollisionPolicy
+	wasmPackaging        WasmPackaging
+	basePlatformPolicy   BasePlatformPolicy
+	allowMutableVersions bool
+	disableTrimpath      bool
+	buildVCS             string
+	goBinary             string
+	prebuild             []string
+	maxBinarySize        string
+	progress             Progress
+	buildTimeout         time.Duration
+
+	// ignoredPlatforms records the Config.Platforms selectors that were
+	// logged as ignored, by importpath.
+	ignoredPlatforms sync.Map
+
+	// binaries records the binaries last built for each reference and
+	// platform, to reuse when only kodata changes, see InvalidateData.
+	binaries sync.Map
 }
 
 // Option is a functional option for NewGo.
@@ -87,12 +125,35 @@ type gobuildOpener struct {
 	kodataCreationTime   v1.Time
 	build                builder
 	disableOptimizations bool
-	buildConfigs         map[string]Config
+	resolveConfig        ConfigResolver
 	mod                  *modules
 	buildContext         buildContext
 	platform             string
 	labels               map[string]string
+	imageEnv             []string
 	dir                  string
+	minFreeSpace         uint64
+	ldflags              []string
+	cgo                  bool
+	env                  []string
+	moduleEnv            []string
+	sbom                 SBOMFormat
+	sboms                *SBOMs
+	tags                 []string
+	goFlags              []string
+	gcflags              []string
+	asmflags             []string
+	binaryCollision      BinaryCollisionPolicy
+	wasmPackaging        WasmPackaging
+	basePlatformPolicy   BasePlatformPolicy
+	allowMutableVersions bool
+	disableTrimpath      bool
+	buildVCS             string
+	goBinary             string
+	prebuild             []string
+	maxBinarySize        string
+	progress             Progress
+	buildTimeout         time.Duration
 }
 
 func (gbo *gobuildOpener) Open() (Interface, error) {
@@ -103,18 +164,44 @@ func (gbo *gobuildOpener) Open() (Interface, error) {
 	if err != nil {
 		return nil, err
 	}
+	if _, err := matcher.wasm(); err != nil {
+		return nil, err
+	}
 	return &gobuild{
 		getBase:              gbo.getBase,
 		creationTime:         gbo.creationTime,
 		kodataCreationTime:   gbo.kodataCreationTime,
 		build:                gbo.build,
 		disableOptimizations: gbo.disableOptimizations,
-		buildConfigs:         gbo.buildConfigs,
+		disableTrimpath:      gbo.disableTrimpath,
+		buildVCS:             gbo.buildVCS,
+		goBinary:             gbo.goBinary,
+		prebuild:             gbo.prebuild,
+		maxBinarySize:        gbo.maxBinarySize,
+		progress:             gbo.progress,
+		buildTimeout:         gbo.buildTimeout,
+		resolveConfig:        gbo.resolveConfig,
 		mod:                  gbo.mod,
 		buildContext:         gbo.buildContext,
 		labels:               gbo.labels,
+		imageEnv:             gbo.imageEnv,
 		dir:                  gbo.dir,
 		platformMatcher:      matcher,
+		minFreeSpace:         gbo.minFreeSpace,
+		ldflags:              gbo.ldflags,
+		cgo:                  gbo.cgo,
+		env:                  gbo.env,
+		moduleEnv:            gbo.moduleEnv,
+		sbom:                 gbo.sbom,
+		sboms:                gbo.sboms,
+		tags:                 gbo.tags,
+		goFlags:              gbo.goFlags,
+		gcflags:              gbo.gcflags,
+		asmflags:             gbo.asmflags,
+		binaryCollision:      gbo.binaryCollision,
+		wasmPackaging:        gbo.wasmPackaging,
+		basePlatformPolicy:   gbo.basePlatformPolicy,
+		allowMutableVersions: gbo.allowMutableVersions,
 	}, nil
 }
 
@@ -134,14 +221,14 @@ type modInfo struct {
 // using go modules, otherwise returns nil.
 //
 // Related: https://github.com/golang/go/issues/26504
-func moduleInfo(ctx context.Context, dir string) (*modules, error) {
+func moduleInfo(ctx context.Context, goBinary, dir string) (*modules, error) {
 	modules := modules{
 		deps: make(map[string]*modInfo),
 	}
 
 	// TODO we read all the output as a single byte array - it may
 	// be possible & more efficient to stream it
-	cmd := exec.CommandContext(ctx, "go", "list", "-mod=readonly", "-json", "-m", "all")
+	cmd := exec.CommandContext(ctx, goBinaryOrDefault(goBinary), "list", "-mod=readonly", "-json", "-m", "all")
 	cmd.Dir = dir
 	output, err := cmd.Output()
 	if err != nil {
@@ -185,8 +272,8 @@ func moduleInfo(ctx context.Context, dir string) (*modules, error) {
 // `ko` binary that expects a different GOROOT.
 //
 // See https://github.com/google/ko/issues/106
-func getGoroot(ctx context.Context, dir string) (string, error) {
-	cmd := exec.CommandContext(ctx, "go", "env", "GOROOT")
+func getGoroot(ctx context.Context, goBinary, dir string) (string, error) {
+	cmd := exec.CommandContext(ctx, goBinaryOrDefault(goBinary), "env", "GOROOT")
 	// It's probably not necessary to set the command working directory here,
 	// but it helps keep everything consistent.
 	cmd.Dir = dir
@@ -201,33 +288,8 @@ func getGoroot(ctx context.Context, dir string) (string, error) {
 // The `dir` argument is the working directory for executing the `go` tool.
 // If `dir` is empty, the function uses the current process working directory.
 func NewGo(ctx context.Context, dir string, options ...Option) (Interface, error) {
-	// TODO: We could do moduleInfo() and getGoroot() concurrently.
-	module, err := moduleInfo(ctx, dir)
-	if err != nil {
-		return nil, err
-	}
-
-	goroot, err := getGoroot(ctx, dir)
-	if err != nil {
-		// On error, print the output and set goroot to "" to avoid using it later.
-		log.Printf("Unexpected error running \"go env GOROOT\": %v\n%v", err, goroot)
-		goroot = ""
-	} else if goroot == "" {
-		log.Printf(`Unexpected: $(go env GOROOT) == ""`)
-	}
-
-	// If $(go env GOROOT) successfully returns a non-empty string that differs from
-	// the default build context GOROOT, use $(go env GOROOT) instead.
-	bc := gb.Default
-	bc.Dir = dir
-	if goroot != "" && bc.GOROOT != goroot {
-		bc.GOROOT = goroot
-	}
-
 	gbo := &gobuildOpener{
-		build:        build,
-		mod:          module,
-		buildContext: &bc,
+		build: build,
 		// dir is set on both buildContext and on gbo. Not ideal, but the
 		// build.Context interface doesn't expose
 		dir: dir,
@@ -238,9 +300,76 @@ func NewGo(ctx context.Context, dir string, options ...Option) (Interface, error
 			return nil, err
 		}
 	}
+
+	// Check the go binary before anything runs it, so that a typo fails
+	// with a useful error rather than however `go list` happens to fail.
+	if gbo.goBinary != "" {
+		version, err := goVersion(ctx, gbo.goBinary)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Using %s (%s)", gbo.goBinary, version)
+	}
+
+	// TODO: We could do moduleInfo() and getGoroot() concurrently.
+	if gbo.mod == nil {
+		module, err := moduleInfo(ctx, gbo.goBinary, dir)
+		if err != nil {
+			return nil, err
+		}
+		gbo.mod = module
+	}
+
+	if gbo.buildContext == nil {
+		goroot, err := getGoroot(ctx, gbo.goBinary, dir)
+		if err != nil {
+			// On error, print the output and set goroot to "" to avoid using it later.
+			log.Printf("Unexpected error running \"go env GOROOT\": %v\n%v", err, goroot)
+			goroot = ""
+		} else if goroot == "" {
+			log.Printf(`Unexpected: $(go env GOROOT) == ""`)
+		}
+
+		// If $(go env GOROOT) successfully returns a non-empty string that differs from
+		// the default build context GOROOT, use $(go env GOROOT) instead.
+		bc := gb.Default
+		bc.Dir = dir
+		if goroot != "" && bc.GOROOT != goroot {
+			bc.GOROOT = goroot
+		}
+		gbo.buildContext = &bc
+	}
+
 	return gbo.Open()
 }
 
+// goBinaryOrDefault returns goBinary, or the go binary on PATH if it's
+// empty.
+func goBinaryOrDefault(goBinary string) string {
+	if goBinary == "" {
+		return "go"
+	}
+	return goBinary
+}
+
+// goVersion returns the GOVERSION of goBinary, or an error if it can't be
+// found or run.
+func goVersion(ctx context.Context, goBinary string) (string, error) {
+	path, err := exec.LookPath(goBinary)
+	if err != nil {
+		return "", fmt.Errorf("go binary %q: %v", goBinary, err)
+	}
+	out, err := exec.CommandContext(ctx, path, "env", "GOVERSION").Output()
+	if err != nil {
+		return "", fmt.Errorf("go binary %q: running \"env GOVERSION\": %v", goBinary, err)
+	}
+	version := strings.TrimSpace(string(out))
+	if version == "" {
+		return "", fmt.Errorf("go binary %q doesn't report a GOVERSION, ko needs go 1.16 or later", goBinary)
+	}
+	return version, nil
+}
+
 func (g *gobuild) qualifyLocalImport(importpath string) (string, error) {
 	cfg := &packages.Config{
 		Mode: packages.NeedName,
@@ -258,6 +387,16 @@ func (g *gobuild) qualifyLocalImport(importpath string) (string, error) {
 
 // QualifyImport implements build.Interface
 func (g *gobuild) QualifyImport(importpath string) (string, error) {
+	if ips, ok := MultiImportPaths(importpath); ok {
+		for i, ip := range ips {
+			qualified, err := g.QualifyImport(ip)
+			if err != nil {
+				return "", err
+			}
+			ips[i] = strings.TrimPrefix(qualified, StrictScheme)
+		}
+		return StrictScheme + MultiPrefix + strings.Join(ips, ","), nil
+	}
 	if gb.IsLocalImport(importpath) {
 		var err error
 		importpath, err = g.qualifyLocalImport(importpath)
@@ -280,6 +419,28 @@ func (g *gobuild) IsSupportedReference(s string) error {
 	if !ref.IsStrict() {
 		return errors.New("importpath does not start with ko://")
 	}
+	if ips, ok := MultiImportPaths(s); ok {
+		if len(ips) == 0 {
+			return errors.New("combined image lists no importpaths")
+		}
+		for _, ip := range ips {
+			if err := g.IsSupportedReference(StrictScheme + ip); err != nil {
+				return fmt.Errorf("%s: %v", ip, err)
+			}
+		}
+		return nil
+	}
+	// External importpaths aren't in this module, so whether they're
+	// `package main` is only checked once they're downloaded to build.
+	if _, version, ok := ExternalImportPath(s); ok {
+		if version == "" {
+			return errors.New("importpath has an empty version")
+		}
+		if !g.allowMutableVersions && !isImmutableVersion(version) {
+			return fmt.Errorf("version %q is mutable, use a release, pseudo-version or commit hash, or allow it with --allow-mutable-versions", version)
+		}
+		return nil
+	}
 	p, err := g.importPackage(ref)
 	if err != nil {
 		return err
@@ -333,8 +494,10 @@ func getGoarm(platform v1.Platform) (string, error) {
 	return "", nil
 }
 
+// PlatformString formats p like the --platform flag, i.e. os/arch[/variant].
+//
 // TODO(jonjohnsonjr): Upstream something like this.
-func platformToString(p v1.Platform) string {
+func PlatformString(p v1.Platform) string {
 	if p.Variant != "" {
 		return fmt.Sprintf("%s/%s/%s", p.OS, p.Architecture, p.Variant)
 	}
@@ -344,7 +507,7 @@ func platformToString(p v1.Platform) string {
 func build(ctx context.Context, ip string, dir string, platform v1.Platform, config Config) (string, error) {
 	tmpDir, err := ioutil.TempDir("", "ko")
 	if err != nil {
-		return "", err
+		return "", WrapNoSpace(err, os.TempDir())
 	}
 	file := filepath.Join(tmpDir, "out")
 
@@ -353,33 +516,82 @@ func build(ctx context.Context, ip string, dir string, platform v1.Platform, con
 		return "", err
 	}
 
+	env, err := buildEnv(platform, os.Environ(), config.Env)
+	if err != nil {
+		return "", fmt.Errorf("could not create env for %s: %v", ip, err)
+	}
+	if err := checkCgoToolchain(platform, env); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", fmt.Errorf("cannot build %s: %v", ip, err)
+	}
+
+	pkg := ip
+	if importpath, version, ok := ExternalImportPath(ip); ok {
+		// Build external importpaths from a module of their own, next to
+		// the output, which requires them at their version. This replaces
+		// any GOFLAGS, since e.g. -mod=vendor can't work there.
+		env = append(env, "GOFLAGS=-mod=mod")
+		dir = filepath.Join(tmpDir, "module")
+		if err := externalModule(ctx, config.GoBinary, dir, importpath, version, env); err != nil {
+			os.RemoveAll(tmpDir)
+			return "", err
+		}
+		pkg = importpath
+	} else if vendored(config.Flags, env) {
+		env = append(env, offlineEnv...)
+	}
+
 	args := make([]string, 0, 4+len(buildArgs))
 	args = append(args, "build")
 	args = append(args, buildArgs...)
 	args = append(args, "-o", file)
-	args = append(args, ip)
-	cmd := exec.CommandContext(ctx, "go", args...)
+	args = append(args, pkg)
+	cmd := exec.CommandContext(ctx, goBinaryOrDefault(config.GoBinary), args...)
 	cmd.Dir = dir
-
-	env, err := buildEnv(platform, os.Environ(), config.Env)
-	if err != nil {
-		return "", fmt.Errorf("could not create env for %s: %v", ip, err)
-	}
 	cmd.Env = env
 
 	var output bytes.Buffer
 	cmd.Stderr = &output
 	cmd.Stdout = &output
 
-	log.Printf("Building %s for %s", ip, platformToString(platform))
+	log.Printf("Building %s for %s", ip, PlatformString(platform))
 	if err := cmd.Run(); err != nil {
 		os.RemoveAll(tmpDir)
 		log.Printf("Unexpected error running \"go build\": %v\n%v", err, output.String())
+		// The go tool doesn't give us a typed error, so look for the
+		// tell-tale message in its output.
+		if strings.Contains(output.String(), syscall.ENOSPC.Error()) {
+			return "", WrapNoSpace(fmt.Errorf("go build: %w", syscall.ENOSPC), file)
+		}
+		if strings.Contains(output.String(), "error obtaining VCS status") {
+			return "", fmt.Errorf("go build %s: %v: stamping VCS information failed (e.g. in a shallow clone, or without git), "+
+				"set --buildvcs=false to build without it", ip, err)
+		}
 		return "", err
 	}
 	return file, nil
 }
 
+// DevelVersion is the version the go tool gives main modules that aren't
+// built at a version, e.g. those in the current directory.
+const DevelVersion = "(devel)"
+
+// moduleVersion returns the version of the module providing the main package
+// of the binary file, from the build info the go tool embeds in it, or "" if
+// it can't be read.
+func moduleVersion(ctx context.Context, goBinary, file string) string {
+	out, err := goCommand(ctx, goBinary, "", nil, "version", "-m", file)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if fields := strings.Fields(line); len(fields) >= 3 && fields[0] == "mod" {
+			return fields[2]
+		}
+	}
+	return ""
+}
+
 // buildEnv creates the environment variables used by the `go build` command.
 // From `os/exec.Cmd`: If Env contains duplicate environment keys, only the last
 // value in the slice for each duplicate key is used.
@@ -406,7 +618,151 @@ func buildEnv(platform v1.Platform, userEnv, configEnv []string) ([]string, erro
 	return env, nil
 }
 
+// tagsFlag returns the index of the value of the -tags flag in flags, and
+// whether it's given as -tags=value rather than as a separate argument. It
+// returns -1 if there is no -tags flag.
+func tagsFlag(flags FlagArray) (int, bool) {
+	for i, f := range flags {
+		switch {
+		case (f == "-tags" || f == "--tags") && i+1 < len(flags):
+			return i + 1, false
+		case strings.HasPrefix(f, "-tags=") || strings.HasPrefix(f, "--tags="):
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+// withoutTrimpath returns flags without any -trimpath flag.
+func withoutTrimpath(flags FlagArray) FlagArray {
+	out := make(FlagArray, 0, len(flags))
+	for _, f := range flags {
+		if strings.TrimLeft(strings.SplitN(f, "=", 2)[0], "-") == "trimpath" {
+			continue
+		}
+		out = append(out, f)
+	}
+	return out
+}
+
+// mergeTags adds tags to the -tags flag in flags, or appends one.
+func mergeTags(flags FlagArray, tags []string) FlagArray {
+	i, inline := tagsFlag(flags)
+	if i < 0 {
+		return append(flags, "-tags", strings.Join(tags, ","))
+	}
+	prefix, existing := "", flags[i]
+	if inline {
+		parts := strings.SplitN(flags[i], "=", 2)
+		prefix, existing = parts[0]+"=", parts[1]
+	}
+	// The go tool also accepts space-separated tags, though that's deprecated.
+	all := strings.FieldsFunc(existing, func(r rune) bool { return r == ',' || r == ' ' })
+	flags[i] = prefix + strings.Join(append(all, tags...), ",")
+	return flags
+}
+
+// lookupEnv returns the effective value of key in env, where later entries
+// win, as with os/exec.Cmd.
+func lookupEnv(env []string, key string) (string, bool) {
+	for i := len(env) - 1; i >= 0; i-- {
+		if strings.HasPrefix(env[i], key+"=") {
+			return strings.TrimPrefix(env[i], key+"="), true
+		}
+	}
+	return "", false
+}
+
+// checkCgoToolchain returns an error if env enables cgo for a platform other
+// than the one we're running on, without configuring a C cross compiler.
+// Without this, the go tool would try to use the host's C compiler, which
+// fails with confusing linker errors much later.
+func checkCgoToolchain(platform v1.Platform, env []string) error {
+	if cgo, _ := lookupEnv(env, "CGO_ENABLED"); cgo != "1" {
+		return nil
+	}
+	if platform.OS == runtime.GOOS && platform.Architecture == runtime.GOARCH {
+		return nil
+	}
+	if cc, _ := lookupEnv(env, "CC"); cc != "" {
+		return nil
+	}
+	return fmt.Errorf("CGO_ENABLED=1 when cross-compiling for %s requires CC (and CXX for C++) to be set to a cross compiler for that platform", PlatformString(platform))
+}
+
+// isStaticBase reports whether ref is a distroless/static image, which has
+// no C library for cgo binaries to link against.
+func isStaticBase(ref name.Reference) bool {
+	return ref != nil && strings.HasSuffix(ref.Context().RepositoryStr(), "distroless/static")
+}
+
+// usesCgo reports whether the importpaths of the reference s are built with
+// cgo, for any platform.
+func (g *gobuild) usesCgo(s string) bool {
+	ips, ok := MultiImportPaths(s)
+	if !ok {
+		ips = []string{strings.TrimPrefix(s, StrictScheme)}
+	}
+	for _, ip := range ips {
+		configKey, _, _ := ExternalImportPath(ip)
+		config := g.configForImportPath(configKey)
+		// Like buildEnv, the config wins over the environment.
+		env := append(os.Environ(), config.Env...)
+		if cgo, _ := lookupEnv(env, "CGO_ENABLED"); cgo == "1" {
+			return true
+		}
+		for _, pc := range config.Platforms {
+			if cgo, _ := lookupEnv(append(env, pc.Env...), "CGO_ENABLED"); cgo == "1" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// BinaryCollisionPolicy determines what happens when two importpaths in the
+// same image (see MultiPrefix) would use the same binary name (e.g.
+// ./cmd/foo/app and ./cmd/bar/app).
+type BinaryCollisionPolicy string
+
+const (
+	// BinaryCollisionError fails the build of the image, and is the default.
+	BinaryCollisionError BinaryCollisionPolicy = "error"
+	// BinaryCollisionSuffix disambiguates the binary names of all of the
+	// colliding importpaths by appending a short hash of each importpath.
+	BinaryCollisionSuffix BinaryCollisionPolicy = "suffix"
+)
+
+// binaryNames returns the names of the binaries for importpaths, which are
+// installed into the same image, applying policy to importpaths that would
+// use the same name. The names only depend on importpaths, not on what else
+// has been built.
+func binaryNames(importpaths []string, policy BinaryCollisionPolicy) ([]string, error) {
+	users := map[string][]string{}
+	for _, ip := range importpaths {
+		name := appFilename(ip)
+		users[name] = append(users[name], ip)
+	}
+
+	names := make([]string, 0, len(importpaths))
+	installed := map[string]string{}
+	for _, ip := range importpaths {
+		name := appFilename(ip)
+		if len(users[name]) > 1 && policy == BinaryCollisionSuffix {
+			h := sha256.Sum256([]byte(ip))
+			name = name + "-" + hex.EncodeToString(h[:])[:8]
+		}
+		if other, ok := installed[name]; ok {
+			return nil, fmt.Errorf("%s and %s would both be installed as %q", other, ip, name)
+		}
+		installed[name] = ip
+		names = append(names, name)
+	}
+	return names, nil
+}
+
 func appFilename(importpath string) string {
+	importpath, _, _ = ExternalImportPath(importpath)
 	base := filepath.Base(importpath)
 
 	// If we fail to determine a good name from the importpath then use a
@@ -585,9 +941,14 @@ func (g *gobuild) tarKoData(ref reference, platform *v1.Platform) (*bytes.Buffer
 	tw := tar.NewWriter(buf)
 	defer tw.Close()
 
-	root, err := g.kodataPath(ref)
-	if err != nil {
-		return nil, err
+	// External importpaths aren't in this module, so they have no kodata.
+	root := ""
+	if _, _, ok := ExternalImportPath(ref.String()); !ok {
+		var err error
+		root, err = g.kodataPath(ref)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	creationTime := g.kodataCreationTime
@@ -626,6 +987,9 @@ func (g *gobuild) tarKoData(ref reference, platform *v1.Platform) (*bytes.Buffer
 		}
 	}
 
+	if root == "" {
+		return buf, nil
+	}
 	return buf, walkRecursive(tw, root, chroot, creationTime, platform)
 }
 
@@ -680,24 +1044,211 @@ func createBuildArgs(buildCfg Config) ([]string, error) {
 		args = append(args, fmt.Sprintf("-ldflags=%s", strings.Join(buildCfg.Ldflags, " ")))
 	}
 
+	// Unlike ldflags, each of these is a separate [pattern=]args value,
+	// since joining them would apply later patterns' args to the first.
+	if len(buildCfg.Gcflags) > 0 {
+		if err := applyTemplating(buildCfg.Gcflags, data); err != nil {
+			return nil, err
+		}
+
+		for _, f := range buildCfg.Gcflags {
+			args = append(args, fmt.Sprintf("-gcflags=%s", f))
+		}
+	}
+
+	if len(buildCfg.Asmflags) > 0 {
+		if err := applyTemplating(buildCfg.Asmflags, data); err != nil {
+			return nil, err
+		}
+
+		for _, f := range buildCfg.Asmflags {
+			args = append(args, fmt.Sprintf("-asmflags=%s", f))
+		}
+	}
+
 	return args, nil
 }
 
+// PackageDirs implements PackageLister. It lists each importpath's
+// dependencies with `go list -deps`, configured like its build for each
+// platform: GOOS, GOARCH and GOARM, the importpath's env, and its flags,
+// including -tags.
+func (g *gobuild) PackageDirs(ctx context.Context, s string) ([][]string, error) {
+	ips := []string{newRef(s).Path()}
+	if multi, ok := MultiImportPaths(s); ok {
+		ips = multi
+	}
+	platforms, err := g.targetPlatforms(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	var pkgs [][]string
+	for _, ip := range ips {
+		if _, _, ok := ExternalImportPath(ip); ok {
+			continue
+		}
+		var dirs []string
+		seen := map[string]bool{}
+		self := ""
+		for _, platform := range platforms {
+			platform := platform
+			config := g.configForPlatform(ip, &platform)
+			args, err := createBuildArgs(config)
+			if err != nil {
+				return nil, err
+			}
+			env, err := buildEnv(platform, os.Environ(), config.Env)
+			if err != nil {
+				return nil, fmt.Errorf("could not create env for %s: %v", ip, err)
+			}
+			args = append([]string{"list", "-deps", "-f", "{{if not .Standard}}{{.Dir}}{{end}}"}, args...)
+			out, err := goCommand(ctx, config.GoBinary, g.dir, env, append(args, ip)...)
+			if err != nil {
+				return nil, fmt.Errorf("%s for %s: %v", ip, PlatformString(platform), err)
+			}
+			lines := strings.Split(out, "\n")
+			// -deps lists the importpath itself last.
+			self = lines[len(lines)-1]
+			for _, d := range lines[:len(lines)-1] {
+				if d != "" && !seen[d] {
+					seen[d] = true
+					dirs = append(dirs, d)
+				}
+			}
+		}
+		pkgs = append(pkgs, append(dirs, self))
+	}
+	return pkgs, nil
+}
+
+// targetPlatforms returns the platforms that s is built for: those that were
+// asked for, or with "all", those of its base.
+func (g *gobuild) targetPlatforms(ctx context.Context, s string) ([]v1.Platform, error) {
+	if pm := g.matcher(ctx); pm != nil && len(pm.platforms) > 0 {
+		return pm.platforms, nil
+	}
+	_, base, err := g.getBase(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	var platforms []v1.Platform
+	switch base := base.(type) {
+	case v1.ImageIndex:
+		im, err := base.IndexManifest()
+		if err != nil {
+			return nil, err
+		}
+		for _, desc := range im.Manifests {
+			// Attestations and the like have an unknown platform.
+			if desc.Platform != nil && desc.Platform.OS != "unknown" {
+				platforms = append(platforms, *desc.Platform)
+			}
+		}
+	case v1.Image:
+		cf, err := base.ConfigFile()
+		if err != nil {
+			return nil, err
+		}
+		platforms = append(platforms, v1.Platform{OS: cf.OS, Architecture: cf.Architecture})
+	}
+	if len(platforms) == 0 {
+		return nil, fmt.Errorf("base image for %s has no platforms to list its packages for", s)
+	}
+	return platforms, nil
+}
+
 func (g *gobuild) configForImportPath(ip string) Config {
-	config, ok := g.buildConfigs[ip]
-	if !ok {
+	return g.configForPlatform(ip, nil)
+}
+
+// configForPlatform is configForImportPath, with the settings that the
+// importpath's config scopes to platform merged in, if platform is set.
+func (g *gobuild) configForPlatform(ip string, platform *v1.Platform) Config {
+	var config Config
+	var ok bool
+	if g.resolveConfig != nil {
+		config, ok = g.resolveConfig(ip)
+	}
+	if platform != nil {
+		g.logIgnoredPlatforms(ip, config)
+		config = config.forPlatform(*platform)
+	}
+	// Configs may be shared between importpaths, so copy the slices we
+	// may append to below.
+	config.Flags = append(FlagArray(nil), config.Flags...)
+	config.Ldflags = append(StringArray(nil), config.Ldflags...)
+	// Ldflags for every importpath come after any configured for this
+	// importpath, so that the linker lets them win on conflicts.
+	config.Ldflags = append(config.Ldflags, g.ldflags...)
+	// The same goes for gcflags and asmflags, where the go tool uses the
+	// last value matching each package.
+	config.Gcflags = append(append(StringArray(nil), config.Gcflags...), g.gcflags...)
+	config.Asmflags = append(append(StringArray(nil), config.Asmflags...), g.asmflags...)
+	if g.disableTrimpath {
+		// Keep the real source paths in the binary, even if the config
+		// asked for -trimpath.
+		config.Flags = withoutTrimpath(config.Flags)
+	} else if !ok {
 		// Apply default build flags in case none were supplied
 		config.Flags = append(config.Flags, "-trimpath")
 	}
 
-	if g.disableOptimizations {
-		// Disable optimizations (-N) and inlining (-l).
+	if config.GoBinary == "" {
+		config.GoBinary = g.goBinary
+	}
+	if len(config.Prebuild) == 0 {
+		config.Prebuild = g.prebuild
+	}
+	if config.MaxBinarySize == "" {
+		config.MaxBinarySize = g.maxBinarySize
+	}
+
+	// Prepend env for every importpath, so that Env configured for this
+	// importpath still wins.
+	var env []string
+	if g.cgo || config.Cgo {
+		env = append(env, "CGO_ENABLED=1")
+	}
+	env = append(env, g.env...)
+	env = append(env, g.moduleEnv...)
+	config.Env = append(env, config.Env...)
+
+	if len(g.tags) > 0 {
+		config.Flags = mergeTags(config.Flags, g.tags)
+	}
+	if g.buildVCS != "" {
+		config.Flags = append(config.Flags, "-buildvcs="+g.buildVCS)
+	}
+	// Flags for every importpath come after any configured for this
+	// importpath, as with ldflags.
+	config.Flags = append(config.Flags, g.goFlags...)
+
+	if g.disableOptimizations && len(config.Gcflags) == 0 {
+		// Disable optimizations (-N) and inlining (-l), unless gcflags
+		// were given explicitly, which then win.
 		config.Flags = append(config.Flags, "-gcflags", "all=-N -l")
 	}
 
 	return config
 }
 
+// logIgnoredPlatforms logs, once each, the selectors in config.Platforms
+// that don't match any platform in --platform, whose settings are ignored.
+func (g *gobuild) logIgnoredPlatforms(ip string, config Config) {
+	if g.platformMatcher == nil || len(g.platformMatcher.platforms) == 0 {
+		// Building for "all" or the base's platforms could use any.
+		return
+	}
+	for _, selector := range config.platformSelectors() {
+		if p, err := ParsePlatformSelector(selector); err == nil && g.platformMatcher.overlaps(p) {
+			continue
+		}
+		if _, logged := g.ignoredPlatforms.LoadOrStore(ip+" "+selector, true); !logged {
+			log.Printf("Ignoring 'builds' settings of %s for %s, which isn't in --platform=%s", ip, selector, g.platformMatcher.spec)
+		}
+	}
+}
+
 func (g *gobuild) buildOne(ctx context.Context, refStr string, base v1.Image, platform *v1.Platform) (v1.Image, error) {
 	ref := newRef(refStr)
 
@@ -711,22 +1262,166 @@ func (g *gobuild) buildOne(ctx context.Context, refStr string, base v1.Image, pl
 			Architecture: cf.Architecture,
 			OSVersion:    cf.OSVersion,
 		}
+		// Config files don't record a variant, so build for the one that
+		// was asked for, e.g. GOARM=6 for linux/arm/v6.
+		if pm := g.matcher(ctx); pm != nil {
+			platform.Variant = pm.variant(*platform)
+		}
+	}
+
+	// A combined image gets a binary for each importpath, and takes its
+	// kodata and entrypoint from the first.
+	entry, importpaths := ref, []string{ref.Path()}
+	if ips, ok := MultiImportPaths(refStr); ok {
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("%s: combined image lists no importpaths", ref)
+		}
+		entry, importpaths = newRef(StrictScheme+ips[0]), ips
+	}
+
+	binaryNames, err := binaryNames(importpaths, g.binaryCollision)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", ref, err)
+	}
+	if platform.OS == "windows" {
+		// Windows only runs executables with a known extension.
+		for i := range binaryNames {
+			binaryNames[i] += ".exe"
+		}
+	} else if isWasm(*platform) {
+		for i := range binaryNames {
+			binaryNames[i] += ".wasm"
+		}
+	}
+
+	// Fail early, rather than somewhere deep in the go tool or while
+	// writing layers, if we're already low on disk space.
+	if err := checkFreeSpace(os.TempDir(), g.minFreeSpace); err != nil {
+		return nil, err
 	}
 
-	// Do the build into a temporary file.
-	file, err := g.build(ctx, ref.Path(), g.dir, *platform, g.configForImportPath(ref.Path()))
+	// Only kodata changed since the last build, so reuse its binaries: the
+	// same layer objects, whose blobs the publisher has already uploaded.
+	binariesKey := refStr + " " + PlatformString(*platform) + " " + platform.OSVersion
+	if isDataOnly(ctx) {
+		if v, ok := g.binaries.Load(binariesKey); ok {
+			log.Printf("Reusing the binaries of %s for %s, only its kodata changed", ref, PlatformString(*platform))
+			return g.assembleImage(ctx, ref, entry, base, platform, binaryNames, v.(*builtBinaries))
+		}
+	}
+	bins, err := g.buildBinaries(ctx, ref, entry, importpaths, binaryNames, platform)
 	if err != nil {
 		return nil, err
 	}
-	defer os.RemoveAll(filepath.Dir(file))
+	g.binaries.Store(binariesKey, bins)
+	return g.assembleImage(ctx, ref, entry, base, platform, binaryNames, bins)
+}
+
+// builtBinaries are the binary layers of an image, the version of the
+// module providing its entrypoint, and with WithSBOM the modules built into
+// them, which are reused when only its kodata changes.
+type builtBinaries struct {
+	layers  []mutate.Addendum
+	version string
+	modules []*binaryModules
+}
+
+// buildBinaries builds importpaths for platform, and returns their layers,
+// which put them at binaryNames in /ko-app.
+func (g *gobuild) buildBinaries(ctx context.Context, ref, entry reference, importpaths, binaryNames []string, platform *v1.Platform) (*builtBinaries, error) {
+	// Do the builds into temporary files.
+	files := make([]string, 0, len(importpaths))
+	for _, ip := range importpaths {
+		// Builds of external importpaths are configured like those of any
+		// version of them.
+		configKey, _, _ := ExternalImportPath(ip)
+		config := g.configForPlatform(configKey, platform)
+		start := time.Now()
+		file, err := g.build(ctx, ip, g.dir, *platform, config)
+		if err != nil {
+			return nil, err
+		}
+		g.report(ctx, ProgressEvent{Kind: ProgressCompiled, Duration: time.Since(start)})
+		defer os.RemoveAll(filepath.Dir(file))
+		if err := checkBinarySize(ip, file, config.MaxBinarySize); err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+
+	bins := &builtBinaries{}
+	if g.sbom != "" {
+		for _, file := range files {
+			bm, err := readModules(ctx, g.goBinary, file)
+			if err != nil {
+				return nil, err
+			}
+			bins.modules = append(bins.modules, bm)
+		}
+	}
+	appDir := "/ko-app"
+	for i, file := range files {
+		appPath := path.Join(appDir, binaryNames[i])
+
+		// Construct a tarball with the binary and produce a layer.
+		if err := checkFreeSpace(os.TempDir(), g.minFreeSpace); err != nil {
+			return nil, err
+		}
+		binaryLayerBuf, err := tarBinary(appPath, file, g.creationTime, platform)
+		if err != nil {
+			return nil, WrapNoSpace(err, appPath)
+		}
+		binaryLayerBytes := binaryLayerBuf.Bytes()
+		binaryLayer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewBuffer(binaryLayerBytes)), nil
+		}, tarball.WithCompressedCaching, tarball.WithEstargzOptions(estargz.WithPrioritizedFiles([]string{
+			// When using estargz, prioritize downloading the binary entrypoint.
+			appPath,
+		})))
+		if err != nil {
+			return nil, err
+		}
+		if g.reporting(ctx) {
+			digest, err := binaryLayer.Digest()
+			if err != nil {
+				return nil, err
+			}
+			g.report(ctx, ProgressEvent{Kind: ProgressLayer, Digest: digest})
+		}
+		bins.layers = append(bins.layers, mutate.Addendum{
+			Layer: binaryLayer,
+			History: v1.History{
+				Author:    "ko",
+				Created:   g.creationTime,
+				CreatedBy: "ko build " + ref.String(),
+				Comment:   "go build output, at " + appPath,
+			},
+		})
+	}
+
+	// Record the version of the module providing the entrypoint, if it has
+	// one.
+	_, version, ok := ExternalImportPath(entry.String())
+	if !ok {
+		version = moduleVersion(ctx, g.goBinary, files[0])
+	}
+	bins.version = version
+	return bins, nil
+}
 
+// assembleImage adds a kodata layer for entry and the binary layers bins to
+// base, and configures the result to run the first binary.
+func (g *gobuild) assembleImage(ctx context.Context, ref, entry reference, base v1.Image, platform *v1.Platform, binaryNames []string, bins *builtBinaries) (v1.Image, error) {
 	var layers []mutate.Addendum
 
 	// Create a layer from the kodata directory under this import path.
-	dataLayerBuf, err := g.tarKoData(ref, platform)
-	if err != nil {
+	if err := checkFreeSpace(os.TempDir(), g.minFreeSpace); err != nil {
 		return nil, err
 	}
+	dataLayerBuf, err := g.tarKoData(entry, platform)
+	if err != nil {
+		return nil, WrapNoSpace(err, kodataRoot)
+	}
 	dataLayerBytes := dataLayerBuf.Bytes()
 	dataLayer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
 		return ioutil.NopCloser(bytes.NewBuffer(dataLayerBytes)), nil
@@ -738,37 +1433,16 @@ func (g *gobuild) buildOne(ctx context.Context, refStr string, base v1.Image, pl
 		Layer: dataLayer,
 		History: v1.History{
 			Author:    "ko",
+			Created:   g.creationTime,
 			CreatedBy: "ko build " + ref.String(),
 			Comment:   "kodata contents, at $KO_DATA_PATH",
 		},
 	})
 
-	appDir := "/ko-app"
-	appPath := path.Join(appDir, appFilename(ref.Path()))
+	layers = append(layers, bins.layers...)
 
-	// Construct a tarball with the binary and produce a layer.
-	binaryLayerBuf, err := tarBinary(appPath, file, v1.Time{}, platform)
-	if err != nil {
-		return nil, err
-	}
-	binaryLayerBytes := binaryLayerBuf.Bytes()
-	binaryLayer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
-		return ioutil.NopCloser(bytes.NewBuffer(binaryLayerBytes)), nil
-	}, tarball.WithCompressedCaching, tarball.WithEstargzOptions(estargz.WithPrioritizedFiles([]string{
-		// When using estargz, prioritize downloading the binary entrypoint.
-		appPath,
-	})))
-	if err != nil {
-		return nil, err
-	}
-	layers = append(layers, mutate.Addendum{
-		Layer: binaryLayer,
-		History: v1.History{
-			Author:    "ko",
-			CreatedBy: "ko build " + ref.String(),
-			Comment:   "go build output, at " + appPath,
-		},
-	})
+	appDir := "/ko-app"
+	appPath := path.Join(appDir, binaryNames[0])
 
 	// Augment the base image with our application layer.
 	withApp, err := mutate.Append(base, layers...)
@@ -785,23 +1459,41 @@ func (g *gobuild) buildOne(ctx context.Context, refStr string, base v1.Image, pl
 
 	cfg = cfg.DeepCopy()
 	cfg.Config.Entrypoint = []string{appPath}
+	if platform.Architecture != "" && cfg.Architecture != "" && platform.Architecture != cfg.Architecture {
+		// Built on a base for another architecture (see BasePlatformEmulate),
+		// so the image runs as what the binary was built for.
+		cfg.Architecture = platform.Architecture
+	}
 	if platform.OS == "windows" {
-		cfg.Config.Entrypoint = []string{`C:\ko-app\` + appFilename(ref.Path())}
-		updatePath(cfg, `C:\ko-app`)
-		cfg.Config.Env = append(cfg.Config.Env, `KO_DATA_PATH=C:\var\run\ko`)
+		// Windows hosts pick the image for their build from os.version,
+		// which the base's index may have that its config doesn't.
+		cfg.OS = platform.OS
+		if cfg.OSVersion == "" {
+			cfg.OSVersion = platform.OSVersion
+		}
+		cfg.Config.Entrypoint = []string{`C:\ko-app\` + binaryNames[0]}
+		cfg.Config.Env = mergeImageEnv(cfg.Config.Env, `C:\ko-app`, ";", `C:\var\run\ko`, g.imageEnv)
 	} else {
-		updatePath(cfg, appDir)
-		cfg.Config.Env = append(cfg.Config.Env, "KO_DATA_PATH="+kodataRoot)
+		cfg.Config.Env = mergeImageEnv(cfg.Config.Env, appDir, ":", kodataRoot, g.imageEnv)
 	}
 	cfg.Author = "github.com/google/ko"
 
 	if cfg.Config.Labels == nil {
 		cfg.Config.Labels = map[string]string{}
 	}
-	for k, v := range g.labels {
-		cfg.Config.Labels[k] = v
+	// Record the version of the module providing the entrypoint, unless a
+	// label says otherwise.
+	if v := bins.version; v != "" && v != DevelVersion {
+		cfg.Config.Labels[specsv1.AnnotationVersion] = v
 	}
-
+	labels, err := g.labelsFor(ctx, entry.String())
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range labels {
+		cfg.Config.Labels[k] = v
+	}
+
 	image, err := mutate.ConfigFile(withApp, cfg)
 	if err != nil {
 		return nil, err
@@ -809,38 +1501,152 @@ func (g *gobuild) buildOne(ctx context.Context, refStr string, base v1.Image, pl
 
 	empty := v1.Time{}
 	if g.creationTime != empty {
-		return mutate.CreatedAt(image, g.creationTime)
+		if image, err = mutate.CreatedAt(image, g.creationTime); err != nil {
+			return nil, err
+		}
+	}
+	if g.sbom == "" {
+		return image, nil
+	}
+	sbom, err := generateSBOM(g.sbom, ref.String(), g.creationTime, bins.modules)
+	if err != nil {
+		return nil, fmt.Errorf("generating the SBOM of %s: %v", ref, err)
+	}
+	if err := g.sboms.put(image, sbom, g.sbom); err != nil {
+		return nil, err
 	}
 	return image, nil
 }
 
-// Append appPath to the PATH environment variable, if it exists. Otherwise,
-// set the PATH environment variable to appPath.
-func updatePath(cf *v1.ConfigFile, appPath string) {
-	for i, env := range cf.Config.Env {
-		parts := strings.SplitN(env, "=", 2)
-		if len(parts) != 2 {
-			// Expect environment variables to be in the form KEY=VALUE, so this is unexpected.
-			continue
+// checkBinarySize returns an error if the binary built for ip at file is
+// larger than max, e.g. "20MB". An empty max disables the check.
+func checkBinarySize(ip, file, max string) error {
+	if max == "" {
+		return nil
+	}
+	limit, err := ParseByteSize(max)
+	if err != nil {
+		return fmt.Errorf("invalid maxBinarySize for %s: %v", ip, err)
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if size := uint64(fi.Size()); size > limit {
+		return fmt.Errorf("binary for %s is %d bytes, larger than maxBinarySize %s (%d bytes)", ip, size, max, limit)
+	}
+	return nil
+}
+
+// mergeImageEnv returns the env of an image built on a base with baseEnv:
+//
+//   - the base's variables are kept, in order,
+//   - appDir is appended to the base's PATH, unless it's already in it, or
+//     PATH is set to appDir. A PATH set more than once is collapsed into
+//     the last value, which is the one that applies,
+//   - KO_DATA_PATH, which ko owns, is set to kodataPath, after the rest,
+//   - userEnv (KEY=VALUE, see WithImageEnv) is set last, replacing any
+//     variables above, including PATH and KO_DATA_PATH.
+func mergeImageEnv(baseEnv []string, appDir, pathSep, kodataPath string, userEnv []string) []string {
+	user := make(map[string]bool, len(userEnv))
+	for _, kv := range userEnv {
+		user[envKey(kv)] = true
+	}
+
+	path, hasPath := "", false
+	for _, kv := range baseEnv {
+		if envKey(kv) == "PATH" {
+			path, hasPath = strings.TrimPrefix(kv, "PATH="), true
 		}
-		key, value := parts[0], parts[1]
-		if key == "PATH" {
-			value = fmt.Sprintf("%s:%s", value, appPath)
-			cf.Config.Env[i] = "PATH=" + value
-			return
+	}
+	if !hasPath || path == "" {
+		path = appDir
+	} else {
+		found := false
+		for _, dir := range strings.Split(path, pathSep) {
+			found = found || dir == appDir
+		}
+		if !found {
+			path += pathSep + appDir
 		}
 	}
 
-	// If we get here, we never saw PATH.
-	cf.Config.Env = append(cf.Config.Env, "PATH="+appPath)
+	env := make([]string, 0, len(baseEnv)+2+len(userEnv))
+	setPath := user["PATH"]
+	for _, kv := range baseEnv {
+		switch k := envKey(kv); {
+		case user[k], k == "KO_DATA_PATH":
+			continue
+		case k == "PATH":
+			if !setPath {
+				env = append(env, "PATH="+path)
+				setPath = true
+			}
+			continue
+		}
+		env = append(env, kv)
+	}
+	if !setPath {
+		env = append(env, "PATH="+path)
+	}
+	if !user["KO_DATA_PATH"] {
+		env = append(env, "KO_DATA_PATH="+kodataPath)
+	}
+	return append(env, userEnv...)
+}
+
+// envKey returns the name of the environment variable kv, of the form
+// KEY=VALUE.
+func envKey(kv string) string {
+	return strings.SplitN(kv, "=", 2)[0]
 }
 
 // Build implements build.Interface
 func (g *gobuild) Build(ctx context.Context, s string) (Result, error) {
-	// Determine the appropriate base image for this import path.
-	baseRef, base, err := g.getBase(ctx, s)
-	if err != nil {
+	if g.buildTimeout <= 0 {
+		return g.buildResult(ctx, s)
+	}
+	start := time.Now()
+	timeoutCtx, cancel := context.WithTimeout(ctx, g.buildTimeout)
+	defer cancel()
+	res, err := g.buildResult(timeoutCtx, s)
+	// Only report our own deadline, not the caller's.
+	if err != nil && timeoutCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return nil, fmt.Errorf("building %s timed out after %s (--build-timeout %s): %v", s, time.Since(start).Round(time.Millisecond), g.buildTimeout, err)
+	}
+	return res, err
+}
+
+// buildResult builds s, as an image, or an index of images for several
+// platforms.
+func (g *gobuild) buildResult(ctx context.Context, s string) (Result, error) {
+	pre, prebuilt := contextPrebuilt(ctx, s)
+	if !prebuilt {
+		if err := g.runPrebuild(ctx, s); err != nil {
+			return nil, err
+		}
+	}
+
+	pm := g.matcher(ctx)
+
+	// Modules for wasip1/wasm have no base image.
+	if wasm, err := pm.wasm(); err != nil {
 		return nil, err
+	} else if wasm {
+		return g.buildWasm(ctx, s)
+	}
+
+	// Determine the appropriate base image for this import path, unless
+	// it was fetched to compute its cache key.
+	baseRef, base := pre.baseRef, pre.base
+	if base == nil {
+		var err error
+		if baseRef, base, err = g.getBase(ctx, baseImportPath(s)); err != nil {
+			return nil, err
+		}
+	}
+	if isStaticBase(baseRef) && g.usesCgo(s) {
+		warnings.Warnf(warnings.CgoBase, "%s is built with cgo, but its base image %s has no C library, so the binary may fail to start; it may need glibc, e.g. from gcr.io/distroless/base", s, baseRef)
 	}
 
 	// Determine what kind of base we have and if we should publish an image or an index.
@@ -868,7 +1674,25 @@ func (g *gobuild) Build(ctx context.Context, s string) (Result, error) {
 		if !ok {
 			return nil, fmt.Errorf("failed to interpret base as image: %v", base)
 		}
-		res, err = g.buildOne(ctx, s, baseImage, nil)
+		var cf *v1.ConfigFile
+		if cf, err = baseImage.ConfigFile(); err != nil {
+			return nil, err
+		}
+		basePlatform := v1.Platform{OS: cf.OS, Architecture: cf.Architecture}
+		if pm.multiplatform() {
+			return nil, fmt.Errorf("cannot build %s for platforms %q: base image %s is not a multi-platform index, it only provides %s", s, pm.spec, baseRef, PlatformString(basePlatform))
+		}
+		var platform *v1.Platform
+		if err := pm.checkImage(s, basePlatform); err != nil {
+			if g.basePlatformPolicy != BasePlatformEmulate || len(pm.platforms) != 1 || pm.platforms[0].OS != basePlatform.OS {
+				return nil, err
+			}
+			p := pm.platforms[0]
+			warnings.Warnf(warnings.PlatformFallback, "base image for %q does not provide %s, building it on the base's %s image, which needs emulation to run",
+				s, PlatformString(p), PlatformString(basePlatform))
+			platform = &p
+		}
+		res, err = g.buildOne(ctx, s, baseImage, platform)
 	default:
 		return nil, fmt.Errorf("base image media type: %s", mt)
 	}
@@ -878,19 +1702,219 @@ func (g *gobuild) Build(ctx context.Context, s string) (Result, error) {
 
 	// Annotate the image or index with base image information.
 	// (Docker manifest lists don't support annotations)
-	if mt != types.DockerManifestList {
+	if mt != types.DockerManifestList && !basePerPlatform(base) {
 		anns := map[string]string{
 			specsv1.AnnotationBaseImageDigest: baseDigest.String(),
 		}
 		if _, ok := baseRef.(name.Tag); ok {
 			anns[specsv1.AnnotationBaseImageName] = baseRef.Name()
 		}
-		res = mutate.Annotations(res, anns).(Result)
+		annotated := mutate.Annotations(res, anns).(Result)
+		if g.sbom != "" {
+			if err := g.sboms.keep(res, annotated); err != nil {
+				return nil, err
+			}
+		}
+		res = annotated
+	}
+	if idx, ok := res.(v1.ImageIndex); ok && g.progress != nil {
+		if err := g.reportIndex(s, idx); err != nil {
+			return nil, err
+		}
 	}
 
 	return res, nil
 }
 
+// progressKey is the context key for the importpath and platform whose
+// build is reported to the builder's Progress.
+type progressKey struct{}
+
+type progressTarget struct {
+	importpath, platform string
+}
+
+// withProgress returns a context whose steps of building importpath for
+// platform, as part of an index, are reported.
+func withProgress(ctx context.Context, importpath, platform string) context.Context {
+	return context.WithValue(ctx, progressKey{}, progressTarget{importpath, platform})
+}
+
+// reporting reports whether the steps of the build with ctx are reported.
+func (g *gobuild) reporting(ctx context.Context) bool {
+	_, ok := ctx.Value(progressKey{}).(progressTarget)
+	return ok && g.progress != nil
+}
+
+// report reports e, for the importpath and platform being built with ctx, if
+// its steps are reported.
+func (g *gobuild) report(ctx context.Context, e ProgressEvent) {
+	t, ok := ctx.Value(progressKey{}).(progressTarget)
+	if !ok || g.progress == nil {
+		return
+	}
+	e.ImportPath, e.Platform = t.importpath, t.platform
+	g.progress.Report(e)
+}
+
+// reportIndex reports the digest and total size of idx, built for s.
+func (g *gobuild) reportIndex(s string, idx v1.ImageIndex) error {
+	digest, err := idx.Digest()
+	if err != nil {
+		return err
+	}
+	raw, err := idx.RawManifest()
+	if err != nil {
+		return err
+	}
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return err
+	}
+	sizes := map[v1.Hash]int64{digest: int64(len(raw))}
+	for _, desc := range im.Manifests {
+		img, err := idx.Image(desc.Digest)
+		if err != nil {
+			return err
+		}
+		if err := blobSizes(img, sizes); err != nil {
+			return err
+		}
+	}
+	g.progress.Report(ProgressEvent{Kind: ProgressIndexBuilt, ImportPath: s, Digest: digest, Size: totalSize(sizes)})
+	return nil
+}
+
+// baseImportPath returns the importpath whose base image s is built on:
+// combined images use the base of their entrypoint, and external importpaths
+// that of any version of them.
+func baseImportPath(s string) string {
+	baseFor := s
+	if ips, ok := MultiImportPaths(s); ok && len(ips) > 0 {
+		baseFor = StrictScheme + ips[0]
+	}
+	if ip, _, ok := ExternalImportPath(baseFor); ok {
+		baseFor = StrictScheme + ip
+	}
+	return baseFor
+}
+
+// moduleDir returns the directory of the main module, or else the directory
+// ko builds in.
+func (g *gobuild) moduleDir() string {
+	if g.mod != nil && g.mod.main != nil {
+		return g.mod.main.Dir
+	}
+	return g.dir
+}
+
+// labelsFor returns the labels for the image of s, with their values
+// expanded as templates (see WithLabels).
+func (g *gobuild) labelsFor(ctx context.Context, s string) (map[string]string, error) {
+	if len(g.labels) == 0 {
+		return nil, nil
+	}
+	ip, _, _ := ExternalImportPath(s)
+	data := createTemplateData()
+	data["ImportPath"] = ip
+
+	labels := make(map[string]string, len(g.labels))
+	for k, v := range g.labels {
+		if _, ok := data["GitCommit"]; !ok && strings.Contains(v, ".GitCommit") {
+			commit, err := gitCommit(ctx, g.moduleDir())
+			if err != nil {
+				return nil, fmt.Errorf("label %s uses {{.GitCommit}}: %v", k, err)
+			}
+			data["GitCommit"] = commit
+		}
+		tmpl, err := template.New(k).Option("missingkey=error").Parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("label %s: %v", k, err)
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("label %s: %v", k, err)
+		}
+		labels[k] = buf.String()
+	}
+	return labels, nil
+}
+
+// gitCommit returns the commit checked out in the git repository containing
+// dir.
+func gitCommit(ctx context.Context, dir string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", "rev-parse", "HEAD")
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git rev-parse HEAD: %v\n%s", err, stderr.String())
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// runPrebuild runs the prebuild hook configured for each importpath in s in
+// the module directory, with the importpath in KO_IMPORTPATH. Since Build
+// calls it, it runs again whenever a cached build is invalidated, e.g. in
+// watch mode. External importpaths aren't in the module, so they have no
+// hooks.
+func (g *gobuild) runPrebuild(ctx context.Context, s string) error {
+	ips, ok := MultiImportPaths(s)
+	if !ok {
+		ips = []string{newRef(s).Path()}
+	}
+	dir := g.moduleDir()
+	for _, ip := range ips {
+		if _, _, ok := ExternalImportPath(StrictScheme + ip); ok {
+			continue
+		}
+		config := g.configForImportPath(ip)
+		if len(config.Prebuild) == 0 {
+			continue
+		}
+		log.Printf("Running prebuild hook for %s: %s", ip, strings.Join(config.Prebuild, " "))
+		cmd := exec.CommandContext(ctx, config.Prebuild[0], config.Prebuild[1:]...)
+		cmd.Dir = dir
+		cmd.Env = append(append(os.Environ(), config.Env...), "KO_IMPORTPATH="+ip)
+		var stderr bytes.Buffer
+		// The hook's stdout would corrupt resolved YAML, so both go to
+		// stderr.
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("prebuild hook for %s failed: %v\n%s", ip, err, stderr.String())
+		}
+	}
+	return nil
+}
+
+// basePerPlatform reports whether base is an index assembled from several
+// base images, whose manifests are each annotated with the base they came
+// from. Those annotations are kept in the index we build, in place of the
+// index's own.
+func basePerPlatform(base Result) bool {
+	idx, ok := base.(v1.ImageIndex)
+	if !ok {
+		return false
+	}
+	im, err := idx.IndexManifest()
+	if err != nil || len(im.Manifests) == 0 {
+		return false
+	}
+	for _, desc := range im.Manifests {
+		if _, ok := desc.Annotations[specsv1.AnnotationBaseImageDigest]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// buildAll builds an image for each platform in baseIndex that matches the
+// requested platforms, and returns an index of them. If any of those builds
+// fails, or any requested platform isn't provided by the base, it returns an
+// error instead of a partial index.
+//
 // TODO(#192): Do these in parallel?
 func (g *gobuild) buildAll(ctx context.Context, ref string, baseIndex v1.ImageIndex) (v1.ImageIndex, error) {
 	im, err := baseIndex.IndexManifest()
@@ -898,25 +1922,54 @@ func (g *gobuild) buildAll(ctx context.Context, ref string, baseIndex v1.ImageIn
 		return nil, err
 	}
 
-	// Build an image for each child from the base and append it to a new index to produce the result.
-	adds := []mutate.IndexAddendum{}
 	for _, desc := range im.Manifests {
 		// Nested index is pretty rare. We could support this in theory, but return an error for now.
 		if desc.MediaType != types.OCIManifestSchema1 && desc.MediaType != types.DockerManifestSchema2 {
 			return nil, fmt.Errorf("%q has unexpected mediaType %q in base for %q", desc.Digest, desc.MediaType, ref)
 		}
+	}
 
-		if !g.platformMatcher.matches(desc.Platform) {
-			continue
-		}
+	// Check that the base provides every platform we were asked for before
+	// building anything, so we don't spend time compiling the rest.
+	pm := g.matcher(ctx)
+	targets, err := pm.targets(ref, im.Manifests, g.basePlatformPolicy)
+	if err != nil {
+		return nil, err
+	}
 
+	// Build an image for each child from the base and append it to a new index to produce the result.
+	adds := []mutate.IndexAddendum{}
+	for _, target := range targets {
+		desc := target.desc
 		baseImage, err := baseIndex.Image(desc.Digest)
 		if err != nil {
 			return nil, err
 		}
-		img, err := g.buildOne(ctx, ref, baseImage, desc.Platform)
+		platform := desc.Digest.String()
+		if target.platform != nil {
+			platform = PlatformString(*target.platform)
+		} else if desc.Platform != nil {
+			platform = PlatformString(*desc.Platform)
+		}
+		ctx := withProgress(ctx, ref, platform)
+		g.report(ctx, ProgressEvent{Kind: ProgressStarted})
+		img, err := g.buildOne(ctx, ref, baseImage, target.platform)
 		if err != nil {
-			return nil, err
+			if target.platform == nil {
+				return nil, fmt.Errorf("building %s for %s: %v", ref, desc.Digest, err)
+			}
+			return nil, fmt.Errorf("building %s for %s: %v", ref, PlatformString(*target.platform), err)
+		}
+		if g.reporting(ctx) {
+			digest, err := img.Digest()
+			if err != nil {
+				return nil, err
+			}
+			sizes := map[v1.Hash]int64{}
+			if err := blobSizes(img, sizes); err != nil {
+				return nil, err
+			}
+			g.report(ctx, ProgressEvent{Kind: ProgressBuilt, Digest: digest, Size: totalSize(sizes)})
 		}
 		adds = append(adds, mutate.IndexAddendum{
 			Add: img,
@@ -924,11 +1977,15 @@ func (g *gobuild) buildAll(ctx context.Context, ref string, baseIndex v1.ImageIn
 				URLs:        desc.URLs,
 				MediaType:   desc.MediaType,
 				Annotations: desc.Annotations,
-				Platform:    desc.Platform,
+				Platform:    target.platform,
 			},
 		})
 	}
 
+	if len(adds) == 0 {
+		return nil, fmt.Errorf("base image for %q has no platforms matching %q", ref, pm.spec)
+	}
+
 	baseType, err := baseIndex.MediaType()
 	if err != nil {
 		return nil, err
@@ -966,29 +2023,346 @@ func parseSpec(spec string) (*platformMatcher, error) {
 	return &platformMatcher{spec: spec, platforms: platforms}, nil
 }
 
+type platformKey struct{}
+
+// WithPlatform returns a context for builds for the platforms in spec, in
+// the format of --platform, instead of those the builder was created with.
+// Caching keeps the results of builds for different platforms apart.
+func WithPlatform(ctx context.Context, spec string) (context.Context, error) {
+	pm, err := parseSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pm.wasm(); err != nil {
+		return nil, err
+	}
+	return context.WithValue(ctx, platformKey{}, pm), nil
+}
+
+// contextPlatform returns the platforms that builds with ctx are for, if
+// set with WithPlatform.
+func contextPlatform(ctx context.Context) *platformMatcher {
+	pm, _ := ctx.Value(platformKey{}).(*platformMatcher)
+	return pm
+}
+
+// matcher returns the platforms to build for with ctx.
+func (g *gobuild) matcher(ctx context.Context) *platformMatcher {
+	if pm := contextPlatform(ctx); pm != nil {
+		return pm
+	}
+	return g.platformMatcher
+}
+
 func (pm *platformMatcher) matches(base *v1.Platform) bool {
 	if pm.spec == "all" {
 		return true
 	}
 
-	// Don't build anything without a platform field unless "all". Unclear what we should do here.
-	if base == nil {
-		return false
+	for _, p := range pm.platforms {
+		if platformMatches(p, base) {
+			return true
+		}
 	}
 
+	return false
+}
+
+// overlaps reports whether any platform in the spec could be p, where
+// either leaves a field unset, e.g. linux/arm and linux/arm/v7.
+func (pm *platformMatcher) overlaps(p v1.Platform) bool {
+	for _, q := range pm.platforms {
+		if fieldsOverlap(p.OS, q.OS) && fieldsOverlap(p.Architecture, q.Architecture) && fieldsOverlap(p.Variant, q.Variant) {
+			return true
+		}
+	}
+	return false
+}
+
+func fieldsOverlap(a, b string) bool {
+	return a == "" || b == "" || a == b
+}
+
+// multiplatform reports whether the spec asks for more than one platform.
+func (pm *platformMatcher) multiplatform() bool {
+	return len(pm.platforms) > 1
+}
+
+// checkImage returns an error unless base, the platform of a base image that
+// isn't an index, is one that was asked for, so that e.g. an arm64 binary
+// isn't put on an amd64 base. Only the OS and architecture are compared,
+// since config files don't record a variant. With "all", or a base that
+// doesn't record its platform, anything goes.
+func (pm *platformMatcher) checkImage(ref string, base v1.Platform) error {
+	if pm.spec == "all" || len(pm.platforms) == 0 || (base.OS == "" && base.Architecture == "") {
+		return nil
+	}
 	for _, p := range pm.platforms {
-		if p.OS != "" && base.OS != p.OS {
+		if (p.OS == "" || p.OS == base.OS) && (p.Architecture == "" || p.Architecture == base.Architecture) {
+			return nil
+		}
+	}
+	return fmt.Errorf("base image for %q does not provide platforms %s; it only provides %s, pass --platform=%s or use a multi-platform base image",
+		ref, pm.spec, PlatformString(base), PlatformString(base))
+}
+
+// platformTarget is a child of a base index to build on, and the platform to
+// build for on it.
+type platformTarget struct {
+	desc     v1.Descriptor
+	platform *v1.Platform
+}
+
+// targets returns the children of a base index to build on, in the order of
+// manifests, or an error listing the requested platforms that the base
+// doesn't provide.
+//
+// A requested platform without a variant (e.g. linux/arm) matches every
+// variant in the base, and each is built for its own variant. A requested
+// variant (e.g. linux/arm/v7) that the base doesn't provide falls back, with
+// a warning, to the newest older variant of the same OS and architecture (e.g.
+// linux/arm/v6, since ARMv7 CPUs also run ARMv6 code), or else to a child
+// without a variant. The binary is still built for, and the index entry
+// labelled with, the requested variant. With BasePlatformEmulate, a platform
+// that's still missing is built on the EmulationBase, with a warning.
+func (pm *platformMatcher) targets(ref string, manifests []v1.Descriptor, policy BasePlatformPolicy) ([]platformTarget, error) {
+	fallbacks := map[int][]v1.Platform{}
+	emulated := map[int][]v1.Platform{}
+	var missing []string
+	for _, s := range pm.substitutes(manifests, policy) {
+		switch {
+		case s.base < 0:
+			missing = append(missing, PlatformString(s.platform)+availableVariants(s.platform, manifests))
+		case s.emulated:
+			warnings.Warnf(warnings.PlatformFallback, "base image for %q does not provide %s, building it on the base's %s image, which needs emulation to run",
+				ref, PlatformString(s.platform), PlatformString(*manifests[s.base].Platform))
+			emulated[s.base] = append(emulated[s.base], s.platform)
+		default:
+			warnings.Warnf(warnings.PlatformFallback, "base image for %q does not provide %s, building it on the base's %s image",
+				ref, PlatformString(s.platform), PlatformString(*manifests[s.base].Platform))
+			fallbacks[s.base] = append(fallbacks[s.base], s.platform)
+		}
+	}
+	if len(missing) > 0 {
+		var available []string
+		for _, desc := range manifests {
+			if desc.Platform != nil {
+				available = append(available, PlatformString(*desc.Platform))
+			}
+		}
+		return nil, fmt.Errorf("base image for %q does not provide platforms %s; it provides %s", ref, strings.Join(missing, ", "), strings.Join(available, ", "))
+	}
+
+	var targets []platformTarget
+	for i, desc := range manifests {
+		if pm.matches(desc.Platform) {
+			targets = append(targets, platformTarget{desc: desc, platform: desc.Platform})
+		}
+		for _, p := range fallbacks[i] {
+			platform := *desc.Platform
+			platform.Variant = p.Variant
+			targets = append(targets, platformTarget{desc: desc, platform: &platform})
+		}
+		for _, p := range emulated[i] {
+			p := p
+			targets = append(targets, platformTarget{desc: desc, platform: &p})
+		}
+	}
+	return targets, nil
+}
+
+// substitute is a requested platform that a base index doesn't provide, and
+// the index in its manifests of the child to build it on instead, or -1 if
+// there's none.
+type substitute struct {
+	platform v1.Platform
+	base     int
+	emulated bool
+}
+
+// substitutes returns the requested platforms that manifests don't provide,
+// in the order they were requested, with the children they're built on
+// instead. See targets.
+func (pm *platformMatcher) substitutes(manifests []v1.Descriptor, policy BasePlatformPolicy) []substitute {
+	var subs []substitute
+	for _, p := range pm.platforms {
+		found := false
+		for _, desc := range manifests {
+			if platformMatches(p, desc.Platform) {
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		s := substitute{platform: p, base: fallbackVariant(p, manifests)}
+		if s.base < 0 && policy == BasePlatformEmulate {
+			s.base = emulationBase(p, manifests)
+			s.emulated = s.base >= 0
+		}
+		subs = append(subs, s)
+	}
+	return subs
+}
+
+// BaseChildren returns the children of a base index, from its manifests,
+// that building the platforms of spec on it may use, or false if that's all
+// of them, for "all". That includes the children that BasePlatformEmulate
+// builds missing platforms on, so that it's the same for either policy.
+func BaseChildren(spec string, manifests []v1.Descriptor) ([]v1.Descriptor, bool, error) {
+	pm, err := parseSpec(spec)
+	if err != nil {
+		return nil, false, err
+	}
+	if pm.spec == "all" || pm.spec == "" {
+		return nil, false, nil
+	}
+	used := map[int]bool{}
+	for i, desc := range manifests {
+		if pm.matches(desc.Platform) {
+			used[i] = true
+		}
+	}
+	for _, s := range pm.substitutes(manifests, BasePlatformEmulate) {
+		if s.base >= 0 {
+			used[s.base] = true
+		}
+	}
+	var children []v1.Descriptor
+	for i, desc := range manifests {
+		if used[i] {
+			children = append(children, desc)
+		}
+	}
+	return children, true, nil
+}
+
+// BasePlatformPolicy determines what happens when a base image doesn't
+// provide a platform that's built for, e.g. --platform=linux/arm64 on a base
+// that only provides linux/amd64.
+type BasePlatformPolicy string
+
+const (
+	// BasePlatformStrict fails the build, and is the default.
+	BasePlatformStrict BasePlatformPolicy = "strict"
+	// BasePlatformEmulate builds the platform on the base's image for
+	// another architecture of the same OS, preferring amd64, with a warning.
+	// The binary is built for, and the image labelled with, the requested
+	// platform, but anything else from the base needs emulation to run.
+	BasePlatformEmulate BasePlatformPolicy = "emulate"
+)
+
+// EmulationBase returns the child of a base index, from its manifests, to
+// build p on with BasePlatformEmulate when the base doesn't provide p: the
+// one for amd64, or else the first, of p's OS. It returns false if the base
+// provides nothing for p's OS.
+func EmulationBase(p v1.Platform, manifests []v1.Descriptor) (v1.Descriptor, bool) {
+	i := emulationBase(p, manifests)
+	if i < 0 {
+		return v1.Descriptor{}, false
+	}
+	return manifests[i], true
+}
+
+func emulationBase(p v1.Platform, manifests []v1.Descriptor) int {
+	best := -1
+	for i, desc := range manifests {
+		base := desc.Platform
+		if base == nil || base.OS != p.OS || !desc.MediaType.IsImage() {
 			continue
 		}
-		if p.Architecture != "" && base.Architecture != p.Architecture {
+		if base.Architecture == "amd64" {
+			return i
+		}
+		if best < 0 {
+			best = i
+		}
+	}
+	return best
+}
+
+// fallbackVariant returns the index of the child of manifests to build p on
+// when the base doesn't provide p's variant, or -1 if there's none. See
+// platformMatcher.targets.
+func fallbackVariant(p v1.Platform, manifests []v1.Descriptor) int {
+	want, ok := variantNumber(p.Variant)
+	if !ok {
+		return -1
+	}
+	best, bestVariant := -1, -1
+	for i, desc := range manifests {
+		base := desc.Platform
+		if base == nil || base.OS != p.OS || base.Architecture != p.Architecture {
 			continue
 		}
-		if p.Variant != "" && base.Variant != p.Variant {
+		if base.Variant == "" {
+			// Only use a child without a variant if there's no older one.
+			if best < 0 {
+				best = i
+			}
 			continue
 		}
+		if v, ok := variantNumber(base.Variant); ok && v < want && v > bestVariant {
+			best, bestVariant = i, v
+		}
+	}
+	return best
+}
 
-		return true
+// availableVariants describes the variants of p's OS and architecture in
+// manifests, for errors, or returns "" if there are none.
+func availableVariants(p v1.Platform, manifests []v1.Descriptor) string {
+	var variants []string
+	for _, desc := range manifests {
+		base := desc.Platform
+		if base != nil && base.OS == p.OS && base.Architecture == p.Architecture && base.Variant != "" {
+			variants = append(variants, base.Variant)
+		}
+	}
+	if len(variants) == 0 {
+		return ""
 	}
+	return " (available variants: " + strings.Join(variants, ", ") + ")"
+}
 
-	return false
+// variantNumber parses a variant like v7, and reports whether it could.
+func variantNumber(variant string) (int, bool) {
+	if !strings.HasPrefix(variant, "v") {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(variant, "v"))
+	return n, err == nil
+}
+
+// variant returns the variant requested for base's OS and architecture, or ""
+// if none, or several, were.
+func (pm *platformMatcher) variant(base v1.Platform) string {
+	variant := ""
+	for _, p := range pm.platforms {
+		if p.OS == base.OS && p.Architecture == base.Architecture && p.Variant != "" {
+			if variant != "" && variant != p.Variant {
+				return ""
+			}
+			variant = p.Variant
+		}
+	}
+	return variant
+}
+
+func platformMatches(p v1.Platform, base *v1.Platform) bool {
+	// Don't build anything without a platform field unless "all". Unclear what we should do here.
+	if base == nil {
+		return false
+	}
+	if p.OS != "" && base.OS != p.OS {
+		return false
+	}
+	if p.Architecture != "" && base.Architecture != p.Architecture {
+		return false
+	}
+	if p.Variant != "" && base.Variant != p.Variant {
+		return false
+	}
+	return true
 }
@@ -18,24 +18,42 @@ package build
 
 import (
 	"archive/tar"
+	"archive/zip"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	gb "go/build"
 	"io"
 	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 	specsv1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -561,6 +579,36 @@ func validateImage(t *testing.T, img v1.Image, baseLayers int64, creationTime v1
 		}
 	})
 
+	t.Run("check layer times", func(t *testing.T) {
+		r, err := ls[baseLayers+1].Uncompressed()
+		if err != nil {
+			t.Fatalf("Uncompressed() = %v", err)
+		}
+		defer r.Close()
+		tr := tar.NewReader(r)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("Next() = %v", err)
+			}
+			if !header.ModTime.Equal(creationTime.Time) {
+				t.Errorf("%s modtime = %v, want %v", header.Name, header.ModTime, creationTime)
+			}
+		}
+
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			t.Fatalf("ConfigFile() = %v", err)
+		}
+		for _, h := range cfg.History[len(cfg.History)-2:] {
+			if !h.Created.Time.Equal(creationTime.Time) {
+				t.Errorf("history %q created = %v, want %v", h.Comment, h.Created, creationTime)
+			}
+		}
+	})
+
 	t.Run("check annotations", func(t *testing.T) {
 		if !checkAnnotations {
 			t.Skip("skipping annotations check")
@@ -662,6 +710,254 @@ func TestGoBuild(t *testing.T) {
 	})
 }
 
+func TestLabelTemplates(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("skipping without git")
+	}
+	const importpath = "github.com/google/ko/test"
+	moduleDir, err := filepath.Abs(filepath.Join("..", ".."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("git", "-C", moduleDir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		t.Skipf("skipping outside a git checkout: %v", err)
+	}
+	commit := strings.TrimSpace(string(out))
+
+	build := func(dir string, labels map[string]string) (map[string]string, error) {
+		t.Helper()
+		base := mustRandomImage(t)
+		ng, err := NewGo(context.Background(), "",
+			WithBaseImages(func(context.Context, string) (name.Reference, Result, error) { return baseRef, base, nil }),
+			withBuilder(writeTempFile),
+			withModuleInfo(&modules{main: &modInfo{Path: "github.com/google/ko", Dir: dir, Main: true}, deps: map[string]*modInfo{}}),
+			WithLabels(labels),
+			WithLabel("static", "{{.ImportPath}}"),
+		)
+		if err != nil {
+			t.Fatalf("NewGo() = %v", err)
+		}
+		result, err := ng.Build(context.Background(), StrictScheme+importpath)
+		if err != nil {
+			return nil, err
+		}
+		cfg, err := result.(v1.Image).ConfigFile()
+		if err != nil {
+			t.Fatalf("ConfigFile() = %v", err)
+		}
+		return cfg.Config.Labels, nil
+	}
+
+	got, err := build(moduleDir, map[string]string{
+		"org.opencontainers.image.source":   "https://github.com/google/ko",
+		"org.opencontainers.image.revision": "{{.GitCommit}}",
+		"org.opencontainers.image.title":    "{{.ImportPath}}",
+	})
+	if err != nil {
+		t.Fatalf("Build() = %v", err)
+	}
+	want := map[string]string{
+		"org.opencontainers.image.source":   "https://github.com/google/ko",
+		"org.opencontainers.image.revision": commit,
+		"org.opencontainers.image.title":    importpath,
+		"static":                            importpath,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("labels (-want +got): %s", diff)
+	}
+
+	// Outside a git repository, {{.GitCommit}} fails the build.
+	notGit, err := ioutil.TempDir("", "ko-not-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(notGit)
+	if _, err := build(notGit, map[string]string{"revision": "{{.GitCommit}}"}); err == nil || !strings.Contains(err.Error(), "label revision uses {{.GitCommit}}") {
+		t.Errorf("Build() outside git = %v, wanted a GitCommit error", err)
+	}
+
+	// As does an unknown field, and an invalid template fails earlier.
+	if _, err := build(moduleDir, map[string]string{"branch": "{{.GitBranch}}"}); err == nil {
+		t.Error("Build() with {{.GitBranch}} succeeded, wanted error")
+	}
+	if _, err := NewGo(context.Background(), "", WithLabels(map[string]string{"bad": "{{.GitCommit"})); err == nil {
+		t.Error("NewGo() with an invalid template succeeded, wanted error")
+	}
+}
+
+func TestGoBuildIndexBasePerPlatform(t *testing.T) {
+	// An index assembled from a different base image for each platform,
+	// whose manifests record the base they came from.
+	base := mutate.IndexMediaType(empty.Index, types.OCIImageIndex)
+	want := map[string]string{}
+	for _, arch := range []string{"amd64", "arm64"} {
+		img, err := random.Image(1024, 1)
+		if err != nil {
+			t.Fatalf("random.Image() = %v", err)
+		}
+		digest := "sha256:" + strings.Repeat(arch[len(arch)-1:], 64)
+		want[arch] = digest
+		base = mutate.AppendManifests(base, mutate.IndexAddendum{
+			Add: img,
+			Descriptor: v1.Descriptor{
+				Platform:    &v1.Platform{OS: "linux", Architecture: arch},
+				Annotations: map[string]string{specsv1.AnnotationBaseImageDigest: digest},
+			},
+		})
+	}
+
+	ng, err := NewGo(
+		context.Background(),
+		"",
+		WithBaseImages(func(context.Context, string) (name.Reference, Result, error) { return baseRef, base, nil }),
+		WithPlatforms("linux/amd64,linux/arm64"),
+		withBuilder(writeTempFile),
+	)
+	if err != nil {
+		t.Fatalf("NewGo() = %v", err)
+	}
+	result, err := ng.Build(context.Background(), StrictScheme+filepath.Join("github.com/google/ko", "test"))
+	if err != nil {
+		t.Fatalf("Build() = %v", err)
+	}
+	im, err := result.(v1.ImageIndex).IndexManifest()
+	if err != nil {
+		t.Fatalf("IndexManifest() = %v", err)
+	}
+	if got, ok := im.Annotations[specsv1.AnnotationBaseImageDigest]; ok {
+		t.Errorf("index annotated with base %s, wanted only its manifests", got)
+	}
+	got := map[string]string{}
+	for _, desc := range im.Manifests {
+		got[desc.Platform.Architecture] = desc.Annotations[specsv1.AnnotationBaseImageDigest]
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("manifest bases (-want +got) = %s", diff)
+	}
+}
+
+func TestGoBuildTimeout(t *testing.T) {
+	base, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image() = %v", err)
+	}
+	// A go build that hangs until it's cancelled.
+	hang := func(ctx context.Context, _ string, _ string, _ v1.Platform, _ Config) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+	ng, err := NewGo(
+		context.Background(),
+		"",
+		WithBaseImages(func(context.Context, string) (name.Reference, Result, error) { return baseRef, base, nil }),
+		WithBuildTimeout(50*time.Millisecond),
+		withBuilder(hang),
+	)
+	if err != nil {
+		t.Fatalf("NewGo() = %v", err)
+	}
+	ip := StrictScheme + filepath.Join("github.com/google/ko", "test")
+	_, err = ng.Build(context.Background(), ip)
+	if err == nil || !strings.Contains(err.Error(), ip) || !strings.Contains(err.Error(), "timed out after") {
+		t.Fatalf("Build() = %v, wanted a timeout naming %s", err, ip)
+	}
+
+	// Cancelling the build isn't reported as a timeout.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ng.Build(ctx, ip); err == nil || strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Build() = %v, wanted the cancellation", err)
+	}
+
+	if _, err := NewGo(context.Background(), "", WithBuildTimeout(-time.Second)); err == nil {
+		t.Error("NewGo() with a negative timeout succeeded, wanted an error")
+	}
+}
+
+// progressRecorder records the events reported to it.
+type progressRecorder struct {
+	m      sync.Mutex
+	events []ProgressEvent
+}
+
+func (r *progressRecorder) Report(e ProgressEvent) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.events = append(r.events, e)
+}
+
+func TestGoBuildIndexProgress(t *testing.T) {
+	base := mutate.IndexMediaType(empty.Index, types.OCIImageIndex)
+	for _, arch := range []string{"amd64", "arm64"} {
+		img, err := random.Image(1024, 1)
+		if err != nil {
+			t.Fatalf("random.Image() = %v", err)
+		}
+		base = mutate.AppendManifests(base, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: arch}},
+		})
+	}
+	rec := &progressRecorder{}
+	ng, err := NewGo(
+		context.Background(),
+		"",
+		WithBaseImages(func(context.Context, string) (name.Reference, Result, error) { return baseRef, base, nil }),
+		WithPlatforms("linux/amd64,linux/arm64"),
+		WithProgress(rec),
+		withBuilder(writeTempFile),
+	)
+	if err != nil {
+		t.Fatalf("NewGo() = %v", err)
+	}
+	ip := StrictScheme + filepath.Join("github.com/google/ko", "test")
+	result, err := ng.Build(context.Background(), ip)
+	if err != nil {
+		t.Fatalf("Build() = %v", err)
+	}
+	idx := result.(v1.ImageIndex)
+	im, err := idx.IndexManifest()
+	if err != nil {
+		t.Fatalf("IndexManifest() = %v", err)
+	}
+
+	var want []ProgressKind
+	for range im.Manifests {
+		want = append(want, ProgressStarted, ProgressCompiled, ProgressLayer, ProgressBuilt)
+	}
+	want = append(want, ProgressIndexBuilt)
+	var got []ProgressKind
+	for _, e := range rec.events {
+		got = append(got, e.Kind)
+		if e.ImportPath != ip {
+			t.Errorf("%s event for %s, wanted %s", e.Kind, e.ImportPath, ip)
+		}
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("reported (-want +got) = %s", diff)
+	}
+
+	// Each image is reported with its platform and digest, and the index
+	// with its own.
+	for i, desc := range im.Manifests {
+		built := rec.events[4*i+3]
+		if wantPlatform := PlatformString(*desc.Platform); built.Platform != wantPlatform {
+			t.Errorf("built %s, wanted %s", built.Platform, wantPlatform)
+		}
+		if built.Digest != desc.Digest {
+			t.Errorf("built %s for %s, wanted %s", built.Digest, built.Platform, desc.Digest)
+		}
+		if built.Size <= desc.Size {
+			t.Errorf("built %d bytes for %s, wanted more than the manifest's %d", built.Size, built.Platform, desc.Size)
+		}
+	}
+	last := rec.events[len(rec.events)-1]
+	if d, err := idx.Digest(); err != nil || last.Digest != d {
+		t.Errorf("index %s, wanted %s", last.Digest, d)
+	}
+}
+
 func TestGoBuildIndex(t *testing.T) {
 	baseLayers := int64(3)
 	images := int64(2)
@@ -909,3 +1205,2451 @@ func TestMatchesPlatformSpec(t *testing.T) {
 		}
 	}
 }
+
+func TestConfigResolverPrecedence(t *testing.T) {
+	resolve := NewConfigResolver(map[string]Config{
+		DefaultConfigKey:                {ID: "default"},
+		"github.com/foo/bar/cmd/...":    {ID: "cmd-recursive"},
+		"github.com/foo/bar/cmd/*":      {ID: "cmd-glob"},
+		"github.com/foo/bar/cmd/[a-z]*": {ID: "cmd-class"},
+		"github.com/foo/bar/cmd/exact":  {ID: "exact"},
+	})
+
+	for ip, want := range map[string]string{
+		"github.com/foo/bar/cmd/exact":    "exact",
+		"github.com/foo/bar/cmd/other":    "cmd-class",
+		"github.com/foo/bar/cmd/Upper":    "cmd-recursive",
+		"github.com/foo/bar/cmd/sub/deep": "cmd-recursive",
+		"github.com/foo/bar/cmd":          "cmd-recursive",
+		"github.com/foo/baz":              "default",
+	} {
+		got, ok := resolve(ip)
+		if !ok {
+			t.Errorf("resolve(%q) found nothing, wanted %q", ip, want)
+			continue
+		}
+		if got.ID != want {
+			t.Errorf("resolve(%q) = %q, wanted %q", ip, got.ID, want)
+		}
+	}
+
+	if _, ok := NewConfigResolver(map[string]Config{})("github.com/foo/baz"); ok {
+		t.Error("resolve() with no configs found a config")
+	}
+}
+
+func TestConfigTracker(t *testing.T) {
+	tracker := NewConfigTracker(map[string]Config{
+		DefaultConfigKey:             {ID: "default"},
+		"github.com/foo/bar/cmd/...": {ID: "cmd"},
+		"github.com/foo/bar/exact":   {ID: "exact"},
+		"github.com/foo/bar/unused":  {ID: "unused"},
+	})
+	if got, ok := tracker.Resolve("github.com/foo/bar/cmd/app"); !ok || got.ID != "cmd" {
+		t.Errorf("Resolve() = %v, %v, wanted cmd", got, ok)
+	}
+	if got, ok := tracker.Resolve("github.com/foo/bar/exact"); !ok || got.ID != "exact" {
+		t.Errorf("Resolve() = %v, %v, wanted exact", got, ok)
+	}
+	want := []string{DefaultConfigKey, "github.com/foo/bar/unused"}
+	if diff := cmp.Diff(want, tracker.Unused()); diff != "" {
+		t.Errorf("Unused() (-want +got): %s", diff)
+	}
+
+	if _, ok := NewConfigTracker(map[string]Config{}).Resolve("github.com/foo/baz"); ok {
+		t.Error("Resolve() with no configs found a config")
+	}
+}
+
+func TestConfigForImportPathLdflags(t *testing.T) {
+	shared := Config{Ldflags: []string{"-X main.version=v1.2.3"}, Flags: []string{"-v"}}
+	g := &gobuild{
+		disableOptimizations: true,
+		resolveConfig: NewConfigResolver(map[string]Config{
+			"github.com/foo/bar/cmd/...": shared,
+		}),
+	}
+	for _, ip := range []string{"github.com/foo/bar/cmd/a", "github.com/foo/bar/cmd/b"} {
+		cfg := g.configForImportPath(ip)
+		if got, want := len(cfg.Flags), 3; got != want {
+			t.Errorf("configForImportPath(%q).Flags = %v, wanted %d flags", ip, cfg.Flags, want)
+		}
+		if diff := cmp.Diff(shared.Ldflags, cfg.Ldflags); diff != "" {
+			t.Errorf("configForImportPath(%q).Ldflags (-want +got) = %s", ip, diff)
+		}
+	}
+	if got, want := len(shared.Flags), 1; got != want {
+		t.Errorf("shared config was mutated: %v", shared.Flags)
+	}
+}
+
+func TestConfigForPlatform(t *testing.T) {
+	shared := Config{
+		Env:     []string{"CGO_ENABLED=0"},
+		Flags:   []string{"-v"},
+		Ldflags: []string{"-s"},
+		Platforms: map[string]PlatformConfig{
+			"linux/arm64": {Env: []string{"CGO_ENABLED=1", "CC=aarch64-linux-gnu-gcc"}, Ldflags: []string{"-X main.arch=arm64"}},
+			"linux":       {Flags: []string{"-tags=linux"}, Ldflags: []string{"-X main.arch=linux"}},
+			"windows":     {Env: []string{"CGO_ENABLED=1"}},
+		},
+	}
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	matcher, err := parseSpec("linux/amd64,linux/arm64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &gobuild{
+		disableTrimpath: true,
+		platformMatcher: matcher,
+		resolveConfig:   NewConfigResolver(map[string]Config{"github.com/foo/bar": shared}),
+	}
+	for _, test := range []struct {
+		platform v1.Platform
+		want     Config
+		wantCgo  string
+	}{{
+		platform: v1.Platform{OS: "linux", Architecture: "amd64"},
+		wantCgo:  "0",
+		want: Config{
+			Env:     []string{"CGO_ENABLED=0"},
+			Flags:   []string{"-v", "-tags=linux"},
+			Ldflags: []string{"-s", "-X main.arch=linux"},
+		},
+	}, {
+		// The more specific selector comes last, so that it wins.
+		platform: v1.Platform{OS: "linux", Architecture: "arm64"},
+		wantCgo:  "1",
+		want: Config{
+			Env:     []string{"CGO_ENABLED=0", "CGO_ENABLED=1", "CC=aarch64-linux-gnu-gcc"},
+			Flags:   []string{"-v", "-tags=linux"},
+			Ldflags: []string{"-s", "-X main.arch=linux", "-X main.arch=arm64"},
+		},
+	}} {
+		cfg := g.configForPlatform("github.com/foo/bar", &test.platform)
+		if diff := cmp.Diff(test.want, cfg, cmpopts.IgnoreFields(Config{}, "Platforms")); diff != "" {
+			t.Errorf("configForPlatform(%s) (-want +got) = %s", PlatformString(test.platform), diff)
+		}
+		env, err := buildEnv(test.platform, nil, cfg.Env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := lookupEnv(env, "CGO_ENABLED"); got != test.wantCgo {
+			t.Errorf("CGO_ENABLED for %s = %s, wanted %s", PlatformString(test.platform), got, test.wantCgo)
+		}
+	}
+	if diff := cmp.Diff([]string{"CGO_ENABLED=0"}, shared.Env); diff != "" {
+		t.Errorf("shared config was mutated (-want +got) = %s", diff)
+	}
+
+	// Without a platform, none of them apply.
+	if cfg := g.configForImportPath("github.com/foo/bar"); len(cfg.Env) != 1 {
+		t.Errorf("configForImportPath().Env = %v, wanted only the shared env", cfg.Env)
+	}
+
+	// windows isn't being built, which is logged once rather than failing.
+	if got, want := strings.Count(logs.String(), "Ignoring 'builds' settings of github.com/foo/bar for windows"), 1; got != want {
+		t.Errorf("logs = %q, wanted the windows settings to be ignored once", logs.String())
+	}
+	if strings.Contains(logs.String(), "for linux") {
+		t.Errorf("logs = %q, wanted linux settings to be used", logs.String())
+	}
+}
+
+func TestParsePlatformSelector(t *testing.T) {
+	for selector, want := range map[string]*v1.Platform{
+		"linux":          {OS: "linux"},
+		"linux/arm64":    {OS: "linux", Architecture: "arm64"},
+		"linux/arm/v7":   {OS: "linux", Architecture: "arm", Variant: "v7"},
+		"linux/arm/v7/x": nil,
+		"linux//v7":      nil,
+		"":               nil,
+		"windows/amd64/": nil,
+	} {
+		got, err := ParsePlatformSelector(selector)
+		if want == nil {
+			if err == nil {
+				t.Errorf("ParsePlatformSelector(%q) = %v, wanted error", selector, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParsePlatformSelector(%q) = %v", selector, err)
+		} else if diff := cmp.Diff(*want, got); diff != "" {
+			t.Errorf("ParsePlatformSelector(%q) (-want +got) = %s", selector, diff)
+		}
+	}
+}
+
+func TestConfigForImportPathGcflags(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		config      Config
+		gcflags     []string
+		asmflags    []string
+		want        []string
+	}{{
+		description: "implicit gcflags",
+		want:        []string{"-trimpath", "-gcflags", "all=-N -l"},
+	}, {
+		description: "configured gcflags win",
+		config:      Config{Gcflags: StringArray{"example.com/foo=-m"}},
+		want:        []string{"-gcflags=example.com/foo=-m"},
+	}, {
+		description: "gcflags for every importpath win",
+		gcflags:     []string{"all=-N -l", "example.com/foo=-m"},
+		want:        []string{"-trimpath", "-gcflags=all=-N -l", "-gcflags=example.com/foo=-m"},
+	}, {
+		description: "after configured gcflags",
+		config:      Config{Gcflags: StringArray{"all=-l"}, Asmflags: StringArray{"all=-trimpath=/src"}},
+		gcflags:     []string{"all=-N -l"},
+		asmflags:    []string{"all=-D=FOO"},
+		want:        []string{"-gcflags=all=-l", "-gcflags=all=-N -l", "-asmflags=all=-trimpath=/src", "-asmflags=all=-D=FOO"},
+	}} {
+		t.Run(test.description, func(t *testing.T) {
+			configs := map[string]Config{}
+			if test.config.Gcflags != nil {
+				configs["example.com/foo"] = test.config
+			}
+			gbo := &gobuildOpener{}
+			for _, opt := range []Option{WithGcflags(test.gcflags), WithAsmflags(test.asmflags), WithDisabledOptimizations()} {
+				if err := opt(gbo); err != nil {
+					t.Fatal(err)
+				}
+			}
+			g := &gobuild{
+				disableOptimizations: gbo.disableOptimizations,
+				gcflags:              gbo.gcflags,
+				asmflags:             gbo.asmflags,
+				resolveConfig:        NewConfigResolver(configs),
+			}
+			args, err := createBuildArgs(g.configForImportPath("example.com/foo"))
+			if err != nil {
+				t.Fatalf("createBuildArgs() = %v", err)
+			}
+			if diff := cmp.Diff(test.want, args); diff != "" {
+				t.Errorf("createBuildArgs() (-want +got): %s", diff)
+			}
+		})
+	}
+}
+
+func TestWithTrimpath(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		trimpath    *bool
+		config      *Config
+		want        FlagArray
+	}{{
+		description: "default",
+		want:        FlagArray{"-trimpath"},
+	}, {
+		description: "enabled",
+		trimpath:    boolPtr(true),
+		want:        FlagArray{"-trimpath"},
+	}, {
+		description: "disabled",
+		trimpath:    boolPtr(false),
+		want:        FlagArray{},
+	}, {
+		description: "configured flags are kept",
+		trimpath:    boolPtr(true),
+		config:      &Config{Flags: FlagArray{"-trimpath", "-v"}},
+		want:        FlagArray{"-trimpath", "-v"},
+	}, {
+		description: "disabled drops configured -trimpath",
+		trimpath:    boolPtr(false),
+		config:      &Config{Flags: FlagArray{"-trimpath", "-v", "--trimpath=true"}},
+		want:        FlagArray{"-v"},
+	}} {
+		t.Run(test.description, func(t *testing.T) {
+			gbo := &gobuildOpener{}
+			if test.trimpath != nil {
+				if err := WithTrimpath(*test.trimpath)(gbo); err != nil {
+					t.Fatal(err)
+				}
+			}
+			configs := map[string]Config{}
+			if test.config != nil {
+				configs["example.com/foo"] = *test.config
+			}
+			g := &gobuild{disableTrimpath: gbo.disableTrimpath, resolveConfig: NewConfigResolver(configs)}
+			got := g.configForImportPath("example.com/foo").Flags
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Flags (-want +got): %s", diff)
+			}
+		})
+	}
+}
+
+func boolPtr(b bool) *bool { return &b }
+
+func TestBuildWithLdflags(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping go build in short mode")
+	}
+	os.Setenv("KO_TEST_VERSION", "v1.2.3-from-env")
+	defer os.Unsetenv("KO_TEST_VERSION")
+	g := &gobuild{ldflags: []string{"-X main.version={{.Env.KO_TEST_VERSION}}"}}
+
+	file, err := build(context.Background(), "./testdata/ldflags", "", v1.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}, g.configForImportPath("./testdata/ldflags"))
+	if err != nil {
+		t.Fatalf("build() = %v", err)
+	}
+	defer os.RemoveAll(filepath.Dir(file))
+
+	bin, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(bin, []byte("v1.2.3-from-env")) {
+		t.Error("binary does not contain the version stamped with -ldflags")
+	}
+}
+
+func TestBuildVCS(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping go build in short mode")
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("skipping without git")
+	}
+
+	dir, err := ioutil.TempDir("", "ko-buildvcs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for file, content := range map[string]string{
+		"go.mod":  "module example.com/vcs\n\ngo 1.16\n",
+		"main.go": "package main\n\nfunc main() {}\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "."},
+		{"-c", "user.name=ko", "-c", "user.email=ko@example.com", "commit", "-q", "-m", "initial"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_DATE=2021-01-01T00:00:00Z", "GIT_COMMITTER_DATE=2021-01-01T00:00:00Z")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v = %v\n%s", args, err, out)
+		}
+	}
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("git rev-parse = %v", err)
+	}
+	revision := "vcs.revision=" + strings.TrimSpace(string(out))
+
+	platform := v1.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	buildWith := func(mode string, env ...string) (string, error) {
+		gbo := &gobuildOpener{}
+		if err := WithBuildVCS(mode)(gbo); err != nil {
+			t.Fatalf("WithBuildVCS(%q) = %v", mode, err)
+		}
+		g := &gobuild{buildVCS: gbo.buildVCS, env: append([]string{"GOFLAGS="}, env...)}
+		return build(context.Background(), "example.com/vcs", dir, platform, g.configForImportPath("example.com/vcs"))
+	}
+	buildInfo := func(file string) string {
+		out, err := exec.Command("go", "version", "-m", file).Output()
+		if err != nil {
+			t.Fatalf("go version -m = %v", err)
+		}
+		return string(out)
+	}
+
+	t.Run("true", func(t *testing.T) {
+		first, err := buildWith("true")
+		if err != nil {
+			t.Fatalf("build() = %v", err)
+		}
+		defer os.RemoveAll(filepath.Dir(first))
+		if info := buildInfo(first); !strings.Contains(info, revision) {
+			t.Errorf("build info = %s, wanted %s", info, revision)
+		}
+
+		// Stamping only depends on the commit, so the binary is the same.
+		second, err := buildWith("true")
+		if err != nil {
+			t.Fatalf("build() = %v", err)
+		}
+		defer os.RemoveAll(filepath.Dir(second))
+		a, err := ioutil.ReadFile(first)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile(second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(a, b) {
+			t.Error("binaries built from the same commit differ")
+		}
+	})
+
+	t.Run("false", func(t *testing.T) {
+		file, err := buildWith("false")
+		if err != nil {
+			t.Fatalf("build() = %v", err)
+		}
+		defer os.RemoveAll(filepath.Dir(file))
+		if info := buildInfo(file); strings.Contains(info, "vcs.revision") {
+			t.Errorf("build info = %s, wanted no vcs.revision", info)
+		}
+	})
+
+	t.Run("stamping fails", func(t *testing.T) {
+		// Without git, stamping fails like it does in some shallow clones.
+		_, err := buildWith("true", "PATH="+dir)
+		if err == nil || !strings.Contains(err.Error(), "--buildvcs=false") {
+			t.Errorf("build() = %v, wanted error mentioning --buildvcs=false", err)
+		}
+	})
+
+	gbo := &gobuildOpener{}
+	if err := WithBuildVCS("yes")(gbo); err == nil {
+		t.Error("WithBuildVCS(yes) succeeded, wanted error")
+	}
+}
+
+func TestGoBinary(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping go build in short mode")
+	}
+	if runtime.GOOS == "windows" {
+		t.Skip("skipping shell script go binary on windows")
+	}
+	goPath, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("skipping without go")
+	}
+
+	dir, err := ioutil.TempDir("", "ko-gobinary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for file, content := range map[string]string{
+		"go.mod":  "module example.com/gobinary\n\ngo 1.16\n",
+		"main.go": "package main\n\nfunc main() {}\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A go binary that records how it's run, and then runs the real one.
+	calls := filepath.Join(dir, "calls")
+	goBinary := filepath.Join(dir, "go-wrapper")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$1\" >> %q\nexec %q \"$@\"\n", calls, goPath)
+	if err := ioutil.WriteFile(goBinary, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	base, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getBase := WithBaseImages(func(context.Context, string) (name.Reference, Result, error) { return nil, base, nil })
+	ng, err := NewGo(context.Background(), dir, getBase, WithGoBinary(goBinary))
+	if err != nil {
+		t.Fatalf("NewGo() = %v", err)
+	}
+	if want := fmt.Sprintf("Using %s (%s)", goBinary, runtime.Version()); !strings.Contains(logs.String(), want) {
+		t.Errorf("logs = %q, wanted %q", logs.String(), want)
+	}
+
+	g := ng.(*gobuild)
+	platform := v1.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	file, err := build(context.Background(), "example.com/gobinary", dir, platform, g.configForImportPath("example.com/gobinary"))
+	if err != nil {
+		t.Fatalf("build() = %v", err)
+	}
+	defer os.RemoveAll(filepath.Dir(file))
+
+	out, err := ioutil.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The version check, module info and GOROOT, then the build.
+	if got, want := strings.Fields(string(out)), []string{"env", "list", "env", "build"}; !cmp.Equal(got, want) {
+		t.Errorf("%s ran %v, wanted %v", goBinary, got, want)
+	}
+
+	t.Run("config wins", func(t *testing.T) {
+		g := &gobuild{
+			goBinary: goBinary,
+			resolveConfig: func(string) (Config, bool) {
+				return Config{GoBinary: "go1.21rc2"}, true
+			},
+		}
+		if got := g.configForImportPath("example.com/gobinary").GoBinary; got != "go1.21rc2" {
+			t.Errorf("GoBinary = %q, wanted go1.21rc2", got)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		missing := filepath.Join(dir, "go-missing")
+		_, err := NewGo(context.Background(), dir, getBase, WithGoBinary(missing))
+		if err == nil || !strings.Contains(err.Error(), missing) {
+			t.Errorf("NewGo() = %v, wanted error mentioning %s", err, missing)
+		}
+	})
+
+	t.Run("not executable", func(t *testing.T) {
+		if err := os.Chmod(goBinary, 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := NewGo(context.Background(), dir, getBase, WithGoBinary(goBinary))
+		if err == nil || !strings.Contains(err.Error(), goBinary) {
+			t.Errorf("NewGo() = %v, wanted error mentioning %s", err, goBinary)
+		}
+	})
+}
+
+func TestCheckCgoToolchain(t *testing.T) {
+	host := v1.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	other := v1.Platform{OS: "linux", Architecture: "s390x"}
+	if runtime.GOARCH == "s390x" {
+		other.Architecture = "ppc64le"
+	}
+
+	for _, test := range []struct {
+		description string
+		platform    v1.Platform
+		env         []string
+		wantErr     bool
+	}{{
+		description: "cgo disabled cross-compile",
+		platform:    other,
+		env:         []string{"CGO_ENABLED=0"},
+	}, {
+		description: "cgo enabled native",
+		platform:    host,
+		env:         []string{"CGO_ENABLED=1"},
+	}, {
+		description: "cgo enabled cross-compile with CC",
+		platform:    other,
+		env:         []string{"CGO_ENABLED=1", "CC=s390x-linux-gnu-gcc"},
+	}, {
+		description: "cgo enabled cross-compile without CC",
+		platform:    other,
+		env:         []string{"CGO_ENABLED=1"},
+		wantErr:     true,
+	}, {
+		description: "cgo disabled by later entry",
+		platform:    other,
+		env:         []string{"CGO_ENABLED=1", "CGO_ENABLED=0"},
+	}} {
+		t.Run(test.description, func(t *testing.T) {
+			err := checkCgoToolchain(test.platform, test.env)
+			if (err != nil) != test.wantErr {
+				t.Errorf("checkCgoToolchain() = %v, wantErr %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigForImportPathCgo(t *testing.T) {
+	g := &gobuild{cgo: true, resolveConfig: NewConfigResolver(map[string]Config{
+		"github.com/foo/bar": {Env: []string{"CGO_ENABLED=0"}},
+	})}
+
+	env, err := buildEnv(v1.Platform{OS: "linux", Architecture: "amd64"}, nil, g.configForImportPath("github.com/foo/baz").Env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := lookupEnv(env, "CGO_ENABLED"); got != "1" {
+		t.Errorf("CGO_ENABLED = %q, wanted 1", got)
+	}
+
+	// Configuration for the importpath still wins.
+	env, err = buildEnv(v1.Platform{OS: "linux", Architecture: "amd64"}, nil, g.configForImportPath("github.com/foo/bar").Env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := lookupEnv(env, "CGO_ENABLED"); got != "0" {
+		t.Errorf("CGO_ENABLED = %q, wanted 0", got)
+	}
+}
+
+func TestConfigCgo(t *testing.T) {
+	g := &gobuild{resolveConfig: NewConfigResolver(map[string]Config{
+		"github.com/foo/bar": {
+			Cgo: true,
+			Platforms: map[string]PlatformConfig{
+				"linux/arm64": {CC: "aarch64-linux-gnu-gcc", CXX: "aarch64-linux-gnu-g++"},
+				"linux/arm":   {CC: "arm-linux-gnueabihf-gcc", Env: []string{"CC=clang"}},
+			},
+		},
+	})}
+
+	for _, test := range []struct {
+		platform v1.Platform
+		want     map[string]string
+	}{{
+		platform: v1.Platform{OS: "linux", Architecture: "arm64"},
+		want:     map[string]string{"CGO_ENABLED": "1", "CC": "aarch64-linux-gnu-gcc", "CXX": "aarch64-linux-gnu-g++"},
+	}, {
+		// Env wins over CC.
+		platform: v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"},
+		want:     map[string]string{"CGO_ENABLED": "1", "CC": "clang", "CXX": ""},
+	}, {
+		platform: v1.Platform{OS: "linux", Architecture: "amd64"},
+		want:     map[string]string{"CGO_ENABLED": "1", "CC": "", "CXX": ""},
+	}} {
+		t.Run(PlatformString(test.platform), func(t *testing.T) {
+			env, err := buildEnv(test.platform, nil, g.configForPlatform("github.com/foo/bar", &test.platform).Env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, want := range test.want {
+				if got, _ := lookupEnv(env, k); got != want {
+					t.Errorf("%s = %q, wanted %q", k, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCgoStaticBaseWarning(t *testing.T) {
+	const importpath = "github.com/google/ko/test"
+	base := mustRandomImage(t)
+	for _, test := range []struct {
+		description string
+		base        string
+		config      Config
+		wantWarning bool
+	}{{
+		description: "cgo on static",
+		base:        "gcr.io/distroless/static:nonroot",
+		config:      Config{Cgo: true},
+		wantWarning: true,
+	}, {
+		description: "cgo for some platforms on static",
+		base:        "gcr.io/distroless/static:nonroot",
+		config: Config{Platforms: map[string]PlatformConfig{
+			"linux/arm64": {Env: []string{"CGO_ENABLED=1"}},
+		}},
+		wantWarning: true,
+	}, {
+		description: "cgo on base",
+		base:        "gcr.io/distroless/base:nonroot",
+		config:      Config{Cgo: true},
+	}, {
+		description: "no cgo on static",
+		base:        "gcr.io/distroless/static:nonroot",
+		config:      Config{Env: []string{"CGO_ENABLED=0"}},
+	}} {
+		t.Run(test.description, func(t *testing.T) {
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			ref, err := name.ParseReference(test.base)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ng, err := NewGo(context.Background(), "",
+				WithBaseImages(func(context.Context, string) (name.Reference, Result, error) { return ref, base, nil }),
+				withBuilder(writeTempFile),
+				WithConfig(map[string]Config{importpath: test.config}),
+			)
+			if err != nil {
+				t.Fatalf("NewGo() = %v", err)
+			}
+			if _, err := ng.Build(context.Background(), StrictScheme+importpath); err != nil {
+				t.Fatalf("Build() = %v", err)
+			}
+			if got := strings.Contains(logs.String(), "has no C library"); got != test.wantWarning {
+				t.Errorf("warned = %t, wanted %t: %s", got, test.wantWarning, logs.String())
+			}
+		})
+	}
+}
+
+func platformIndex(t *testing.T, platforms ...v1.Platform) v1.ImageIndex {
+	t.Helper()
+	adds := []mutate.IndexAddendum{}
+	for i := range platforms {
+		img, err := random.Image(1024, 1)
+		if err != nil {
+			t.Fatalf("random.Image() = %v", err)
+		}
+		adds = append(adds, mutate.IndexAddendum{
+			Add: img,
+			Descriptor: v1.Descriptor{
+				MediaType: types.DockerManifestSchema2,
+				Platform:  &platforms[i],
+			},
+		})
+	}
+	return mutate.IndexMediaType(mutate.AppendManifests(empty.Index, adds...), types.OCIImageIndex)
+}
+
+func platformImage(t *testing.T, platform v1.Platform) v1.Image {
+	t.Helper()
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image() = %v", err)
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		t.Fatalf("ConfigFile() = %v", err)
+	}
+	cf = cf.DeepCopy()
+	cf.OS, cf.Architecture = platform.OS, platform.Architecture
+	img, err = mutate.ConfigFile(img, cf)
+	if err != nil {
+		t.Fatalf("mutate.ConfigFile() = %v", err)
+	}
+	return img
+}
+
+func TestGoBuildImagePlatform(t *testing.T) {
+	importpath := StrictScheme + "github.com/google/ko/test"
+	base := platformImage(t, v1.Platform{OS: "linux", Architecture: "amd64"})
+
+	for _, test := range []struct {
+		spec    string
+		wantErr string
+	}{
+		{spec: "linux/amd64"},
+		{spec: "linux"},
+		{spec: "all"},
+		{spec: "linux/arm64", wantErr: `base image for "ko://github.com/google/ko/test" does not provide platforms linux/arm64; it only provides linux/amd64`},
+		{spec: "windows/amd64", wantErr: "it only provides linux/amd64"},
+	} {
+		t.Run(test.spec, func(t *testing.T) {
+			var built []string
+			record := func(ctx context.Context, ip, dir string, platform v1.Platform, config Config) (string, error) {
+				built = append(built, PlatformString(platform))
+				return writeTempFile(ctx, ip, dir, platform, config)
+			}
+			ng, err := NewGo(
+				context.Background(),
+				"",
+				WithBaseImages(func(context.Context, string) (name.Reference, Result, error) { return baseRef, base, nil }),
+				WithPlatforms(test.spec),
+				withBuilder(record),
+			)
+			if err != nil {
+				t.Fatalf("NewGo() = %v", err)
+			}
+			_, err = ng.Build(context.Background(), importpath)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("Build() = %v, wanted error containing %q", err, test.wantErr)
+				}
+				if len(built) != 0 {
+					t.Errorf("built for %v, wanted nothing built", built)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Build() = %v", err)
+			}
+			if diff := cmp.Diff([]string{"linux/amd64"}, built); diff != "" {
+				t.Errorf("built (-want +got): %s", diff)
+			}
+		})
+	}
+}
+
+func TestPrebuild(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skipping sh hooks on windows")
+	}
+	dir, err := ioutil.TempDir("", "ko-prebuild")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ran := filepath.Join(dir, "ran")
+	record := func(name string) []string {
+		return []string{"sh", "-c", fmt.Sprintf(`echo %s "$KO_IMPORTPATH" "$(pwd)" >> %q`, name, ran)}
+	}
+
+	const importpath = "github.com/google/ko/test"
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	moduleDir, err := filepath.Abs(filepath.Join("..", ".."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mods := &modules{
+		main: &modInfo{Path: "github.com/google/ko", Dir: moduleDir, Main: true},
+		deps: map[string]*modInfo{},
+	}
+	newBuilder := func(opts ...Option) *Caching {
+		t.Helper()
+		base := mustRandomImage(t)
+		ng, err := NewGo(context.Background(), "",
+			append([]Option{
+				WithBaseImages(func(context.Context, string) (name.Reference, Result, error) { return baseRef, base, nil }),
+				withBuilder(writeTempFile),
+				withModuleInfo(mods),
+			}, opts...)...)
+		if err != nil {
+			t.Fatalf("NewGo() = %v", err)
+		}
+		cb, err := NewCaching(ng)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cb
+	}
+	ranHooks := func() []string {
+		t.Helper()
+		b, err := ioutil.ReadFile(ran)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(ran)
+		return strings.Split(strings.TrimSpace(string(b)), "\n")
+	}
+	t.Run("global", func(t *testing.T) {
+		cb := newBuilder(WithPrebuild(record("global")))
+		if _, err := cb.Build(context.Background(), StrictScheme+importpath); err != nil {
+			t.Fatalf("Build() = %v", err)
+		}
+		want := []string{"global " + importpath + " " + moduleDir}
+		if diff := cmp.Diff(want, ranHooks()); diff != "" {
+			t.Errorf("hooks (-want +got): %s", diff)
+		}
+
+		// Cached builds don't run the hook again, until they're
+		// invalidated, like in watch mode.
+		if _, err := cb.Build(context.Background(), StrictScheme+importpath); err != nil {
+			t.Fatalf("Build() = %v", err)
+		}
+		if got := ranHooks(); len(got) != 0 {
+			t.Errorf("cached build ran hooks: %v", got)
+		}
+		cb.Invalidate(StrictScheme + importpath)
+		if _, err := cb.Build(context.Background(), StrictScheme+importpath); err != nil {
+			t.Fatalf("Build() = %v", err)
+		}
+		if diff := cmp.Diff(want, ranHooks()); diff != "" {
+			t.Errorf("hooks after invalidation (-want +got): %s", diff)
+		}
+	})
+
+	t.Run("per importpath wins", func(t *testing.T) {
+		cb := newBuilder(
+			WithPrebuild(record("global")),
+			WithConfig(map[string]Config{importpath: {Prebuild: record("local")}}),
+		)
+		if _, err := cb.Build(context.Background(), StrictScheme+importpath); err != nil {
+			t.Fatalf("Build() = %v", err)
+		}
+		want := []string{"local " + importpath + " " + moduleDir}
+		if diff := cmp.Diff(want, ranHooks()); diff != "" {
+			t.Errorf("hooks (-want +got): %s", diff)
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		cb := newBuilder(WithPrebuild([]string{"sh", "-c", "echo protoc exploded >&2; exit 3"}))
+		_, err := cb.Build(context.Background(), StrictScheme+importpath)
+		if err == nil || !strings.Contains(err.Error(), "protoc exploded") || !strings.Contains(err.Error(), importpath) {
+			t.Errorf("Build() = %v, wanted error with the hook's stderr", err)
+		}
+	})
+}
+
+func TestMaxBinarySize(t *testing.T) {
+	// writeTempFile writes the importpath as the binary, 25 bytes.
+	const importpath = "github.com/google/ko/test"
+	for _, test := range []struct {
+		description string
+		global      string
+		config      string
+		wantErr     string
+	}{{
+		description: "no limit",
+	}, {
+		description: "under the global limit",
+		global:      "1KB",
+	}, {
+		description: "over the global limit",
+		global:      "20B",
+		wantErr:     "binary for github.com/google/ko/test is 25 bytes, larger than maxBinarySize 20B (20 bytes)",
+	}, {
+		description: "config raises the limit",
+		global:      "20B",
+		config:      "1KiB",
+	}, {
+		description: "config lowers the limit",
+		global:      "1MB",
+		config:      "10",
+		wantErr:     "is 25 bytes, larger than maxBinarySize 10 (10 bytes)",
+	}, {
+		description: "invalid config",
+		config:      "lots",
+		wantErr:     "invalid maxBinarySize for github.com/google/ko/test",
+	}} {
+		t.Run(test.description, func(t *testing.T) {
+			base := mustRandomImage(t)
+			opts := []Option{
+				WithBaseImages(func(context.Context, string) (name.Reference, Result, error) { return baseRef, base, nil }),
+				withBuilder(writeTempFile),
+				WithConfig(map[string]Config{importpath: {MaxBinarySize: test.config}}),
+			}
+			if test.global != "" {
+				opts = append(opts, WithMaxBinarySize(test.global))
+			}
+			ng, err := NewGo(context.Background(), "", opts...)
+			if err != nil {
+				t.Fatalf("NewGo() = %v", err)
+			}
+			_, err = ng.Build(context.Background(), StrictScheme+importpath)
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Errorf("Build() = %v", err)
+			case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+				t.Errorf("Build() = %v, wanted error containing %q", err, test.wantErr)
+			}
+		})
+	}
+
+	if _, err := NewGo(context.Background(), "", WithMaxBinarySize("lots")); err == nil {
+		t.Error("NewGo(WithMaxBinarySize(lots)) succeeded, wanted error")
+	}
+}
+
+func TestGoBuildIndexPlatforms(t *testing.T) {
+	amd64 := v1.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := v1.Platform{OS: "linux", Architecture: "arm64"}
+	s390x := v1.Platform{OS: "linux", Architecture: "s390x"}
+	importpath := StrictScheme + "github.com/google/ko/test"
+
+	failArm64 := func(ctx context.Context, ip, dir string, platform v1.Platform, config Config) (string, error) {
+		if platform.Architecture == "arm64" {
+			return "", errors.New("arm64 compile failed")
+		}
+		return writeTempFile(ctx, ip, dir, platform, config)
+	}
+
+	for _, test := range []struct {
+		description string
+		base        Result
+		spec        string
+		override    string
+		builder     builder
+		want        []string
+		wantErr     string
+	}{{
+		description: "subset of base",
+		base:        platformIndex(t, amd64, arm64, s390x),
+		spec:        "linux/amd64,linux/arm64",
+		builder:     writeTempFile,
+		want:        []string{"linux/amd64", "linux/arm64"},
+	}, {
+		description: "platform of the context",
+		base:        platformIndex(t, amd64, arm64, s390x),
+		spec:        "all",
+		override:    "linux/arm64",
+		builder:     writeTempFile,
+		want:        []string{"linux/arm64"},
+	}, {
+		description: "platform of the context missing from base",
+		base:        platformIndex(t, amd64, s390x),
+		spec:        "all",
+		override:    "linux/arm64",
+		builder:     writeTempFile,
+		wantErr:     "does not provide platforms linux/arm64",
+	}, {
+		description: "platform missing from base",
+		base:        platformIndex(t, amd64, s390x),
+		spec:        "linux/amd64,linux/arm64",
+		builder:     writeTempFile,
+		wantErr:     "does not provide platforms linux/arm64; it provides linux/amd64, linux/s390x",
+	}, {
+		description: "no matching platforms",
+		base:        platformIndex(t, s390x),
+		spec:        "linux/amd64",
+		builder:     writeTempFile,
+		wantErr:     "does not provide platforms linux/amd64",
+	}, {
+		description: "one platform fails to compile",
+		base:        platformIndex(t, amd64, arm64),
+		spec:        "linux/amd64,linux/arm64",
+		builder:     failArm64,
+		wantErr:     "arm64 compile failed",
+	}, {
+		description: "single-platform base",
+		base:        mustRandomImage(t),
+		spec:        "linux/amd64,linux/arm64",
+		builder:     writeTempFile,
+		wantErr:     "not a multi-platform index",
+	}, {
+		description: "single-platform base of another platform",
+		base:        platformImage(t, amd64),
+		spec:        "linux/arm64",
+		builder:     writeTempFile,
+		wantErr:     "does not provide platforms linux/arm64; it only provides linux/amd64",
+	}, {
+		description: "several platforms on a single-platform base",
+		base:        platformImage(t, amd64),
+		spec:        "linux/amd64,linux/arm64",
+		builder:     writeTempFile,
+		wantErr:     "not a multi-platform index, it only provides linux/amd64",
+	}} {
+		t.Run(test.description, func(t *testing.T) {
+			ng, err := NewGo(
+				context.Background(),
+				"",
+				WithBaseImages(func(context.Context, string) (name.Reference, Result, error) { return baseRef, test.base, nil }),
+				WithPlatforms(test.spec),
+				withBuilder(test.builder),
+			)
+			if err != nil {
+				t.Fatalf("NewGo() = %v", err)
+			}
+
+			ctx := context.Background()
+			if test.override != "" {
+				if ctx, err = WithPlatform(ctx, test.override); err != nil {
+					t.Fatalf("WithPlatform() = %v", err)
+				}
+			}
+			result, err := ng.Build(ctx, importpath)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("Build() = %v, wanted error containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Build() = %v", err)
+			}
+
+			idx, ok := result.(v1.ImageIndex)
+			if !ok {
+				t.Fatalf("Build() not an index: %T", result)
+			}
+			im, err := idx.IndexManifest()
+			if err != nil {
+				t.Fatalf("IndexManifest() = %v", err)
+			}
+			got := []string{}
+			for _, desc := range im.Manifests {
+				got = append(got, PlatformString(*desc.Platform))
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("platforms (-want +got): %s", diff)
+			}
+		})
+	}
+}
+
+func TestGoBuildArmVariants(t *testing.T) {
+	armv6 := v1.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}
+	armv7 := v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+	arm := v1.Platform{OS: "linux", Architecture: "arm"}
+	amd64 := v1.Platform{OS: "linux", Architecture: "amd64"}
+	importpath := StrictScheme + "github.com/google/ko/test"
+
+	armImage := mustRandomImage(t)
+	cf, err := armImage.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf = cf.DeepCopy()
+	cf.OS, cf.Architecture = "linux", "arm"
+	armImage, err = mutate.ConfigFile(armImage, cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		description string
+		base        Result
+		spec        string
+		want        []string
+		wantGoarm   []string
+		wantLog     string
+		wantErr     string
+	}{{
+		description: "v6",
+		base:        platformIndex(t, amd64, armv6, armv7),
+		spec:        "linux/arm/v6",
+		want:        []string{"linux/arm/v6"},
+		wantGoarm:   []string{"6"},
+	}, {
+		description: "v7",
+		base:        platformIndex(t, amd64, armv6, armv7),
+		spec:        "linux/arm/v7",
+		want:        []string{"linux/arm/v7"},
+		wantGoarm:   []string{"7"},
+	}, {
+		description: "unspecified variant builds every variant",
+		base:        platformIndex(t, amd64, armv6, armv7),
+		spec:        "linux/arm",
+		want:        []string{"linux/arm/v6", "linux/arm/v7"},
+		wantGoarm:   []string{"6", "7"},
+	}, {
+		description: "v7 falls back to a v6 base",
+		base:        platformIndex(t, amd64, armv6),
+		spec:        "linux/amd64,linux/arm/v7",
+		want:        []string{"linux/amd64", "linux/arm/v7"},
+		wantGoarm:   []string{"", "7"},
+		wantLog:     "does not provide linux/arm/v7, building it on the base's linux/arm/v6 image",
+	}, {
+		description: "v6 falls back to a base without a variant",
+		base:        platformIndex(t, arm),
+		spec:        "linux/arm/v6",
+		want:        []string{"linux/arm/v6"},
+		wantGoarm:   []string{"6"},
+		wantLog:     "does not provide linux/arm/v6, building it on the base's linux/arm image",
+	}, {
+		description: "v6 doesn't fall back to a v7 base",
+		base:        platformIndex(t, amd64, armv7),
+		spec:        "linux/arm/v6",
+		wantErr:     "does not provide platforms linux/arm/v6 (available variants: v7)",
+	}, {
+		description: "single-platform base",
+		base:        armImage,
+		spec:        "linux/arm/v6",
+		wantGoarm:   []string{"6"},
+	}} {
+		t.Run(test.description, func(t *testing.T) {
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			var goarm []string
+			recordGoarm := func(ctx context.Context, ip, dir string, platform v1.Platform, config Config) (string, error) {
+				env, err := buildEnv(platform, nil, config.Env)
+				if err != nil {
+					return "", err
+				}
+				v, _ := lookupEnv(env, "GOARM")
+				goarm = append(goarm, v)
+				return writeTempFile(ctx, ip, dir, platform, config)
+			}
+			ng, err := NewGo(
+				context.Background(),
+				"",
+				WithBaseImages(func(context.Context, string) (name.Reference, Result, error) { return baseRef, test.base, nil }),
+				WithPlatforms(test.spec),
+				withBuilder(recordGoarm),
+			)
+			if err != nil {
+				t.Fatalf("NewGo() = %v", err)
+			}
+
+			result, err := ng.Build(context.Background(), importpath)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("Build() = %v, wanted error containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Build() = %v", err)
+			}
+			if diff := cmp.Diff(test.wantGoarm, goarm); diff != "" {
+				t.Errorf("GOARM (-want +got): %s", diff)
+			}
+			if !strings.Contains(logs.String(), test.wantLog) {
+				t.Errorf("logs = %q, wanted %q", logs.String(), test.wantLog)
+			}
+
+			idx, ok := result.(v1.ImageIndex)
+			if !ok {
+				return
+			}
+			im, err := idx.IndexManifest()
+			if err != nil {
+				t.Fatalf("IndexManifest() = %v", err)
+			}
+			got := []string{}
+			for _, desc := range im.Manifests {
+				got = append(got, PlatformString(*desc.Platform))
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("platforms (-want +got): %s", diff)
+			}
+		})
+	}
+}
+
+func TestGoBuildBasePlatformPolicy(t *testing.T) {
+	amd64 := v1.Platform{OS: "linux", Architecture: "amd64"}
+	s390x := v1.Platform{OS: "linux", Architecture: "s390x"}
+	windows := v1.Platform{OS: "windows", Architecture: "amd64"}
+	importpath := StrictScheme + "github.com/google/ko/test"
+
+	for _, test := range []struct {
+		description string
+		base        Result
+		spec        string
+		policy      BasePlatformPolicy
+		want        []string
+		wantLog     string
+		wantErr     string
+	}{{
+		description: "image, strict",
+		base:        platformImage(t, amd64),
+		spec:        "linux/arm64",
+		policy:      BasePlatformStrict,
+		wantErr:     "does not provide platforms linux/arm64; it only provides linux/amd64",
+	}, {
+		description: "image, default",
+		base:        platformImage(t, amd64),
+		spec:        "linux/arm64",
+		wantErr:     "does not provide platforms linux/arm64; it only provides linux/amd64",
+	}, {
+		description: "image, emulate",
+		base:        platformImage(t, amd64),
+		spec:        "linux/arm64",
+		policy:      BasePlatformEmulate,
+		want:        []string{"linux/arm64"},
+		wantLog:     "does not provide linux/arm64, building it on the base's linux/amd64 image, which needs emulation to run",
+	}, {
+		description: "image of another OS, emulate",
+		base:        platformImage(t, windows),
+		spec:        "linux/arm64",
+		policy:      BasePlatformEmulate,
+		wantErr:     "does not provide platforms linux/arm64; it only provides windows/amd64",
+	}, {
+		description: "index, strict",
+		base:        platformIndex(t, s390x, amd64),
+		spec:        "linux/amd64,linux/arm64",
+		policy:      BasePlatformStrict,
+		wantErr:     "does not provide platforms linux/arm64; it provides linux/s390x, linux/amd64",
+	}, {
+		description: "index, emulate",
+		base:        platformIndex(t, s390x, amd64),
+		spec:        "linux/amd64,linux/arm64",
+		policy:      BasePlatformEmulate,
+		want:        []string{"linux/amd64", "linux/arm64"},
+		wantLog:     "does not provide linux/arm64, building it on the base's linux/amd64 image, which needs emulation to run",
+	}, {
+		description: "index without amd64, emulate",
+		base:        platformIndex(t, s390x),
+		spec:        "linux/arm64",
+		policy:      BasePlatformEmulate,
+		want:        []string{"linux/arm64"},
+		wantLog:     "building it on the base's linux/s390x image",
+	}, {
+		description: "index of another OS, emulate",
+		base:        platformIndex(t, windows),
+		spec:        "linux/arm64",
+		policy:      BasePlatformEmulate,
+		wantErr:     "does not provide platforms linux/arm64; it provides windows/amd64",
+	}} {
+		t.Run(test.description, func(t *testing.T) {
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			var built []string
+			record := func(ctx context.Context, ip, dir string, platform v1.Platform, config Config) (string, error) {
+				built = append(built, PlatformString(platform))
+				return writeTempFile(ctx, ip, dir, platform, config)
+			}
+			ng, err := NewGo(
+				context.Background(),
+				"",
+				WithBaseImages(func(context.Context, string) (name.Reference, Result, error) { return baseRef, test.base, nil }),
+				WithPlatforms(test.spec),
+				WithBasePlatformPolicy(test.policy),
+				withBuilder(record),
+			)
+			if err != nil {
+				t.Fatalf("NewGo() = %v", err)
+			}
+
+			result, err := ng.Build(context.Background(), importpath)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("Build() = %v, wanted error containing %q", err, test.wantErr)
+				}
+				if len(built) != 0 {
+					t.Errorf("built for %v, wanted nothing built", built)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Build() = %v", err)
+			}
+			if diff := cmp.Diff(test.want, built); diff != "" {
+				t.Errorf("built (-want +got): %s", diff)
+			}
+			if !strings.Contains(logs.String(), test.wantLog) {
+				t.Errorf("logs = %q, wanted %q", logs.String(), test.wantLog)
+			}
+
+			switch r := result.(type) {
+			case v1.Image:
+				// The image runs as the platform it was built for.
+				cf, err := r.ConfigFile()
+				if err != nil {
+					t.Fatalf("ConfigFile() = %v", err)
+				}
+				if got := PlatformString(v1.Platform{OS: cf.OS, Architecture: cf.Architecture}); got != test.want[0] {
+					t.Errorf("config platform = %s, wanted %s", got, test.want[0])
+				}
+			case v1.ImageIndex:
+				im, err := r.IndexManifest()
+				if err != nil {
+					t.Fatalf("IndexManifest() = %v", err)
+				}
+				got := []string{}
+				for _, desc := range im.Manifests {
+					got = append(got, PlatformString(*desc.Platform))
+				}
+				if diff := cmp.Diff(test.want, got); diff != "" {
+					t.Errorf("platforms (-want +got): %s", diff)
+				}
+			}
+		})
+	}
+
+	if _, err := NewGo(context.Background(), "", WithBasePlatformPolicy("lenient")); err == nil {
+		t.Error("NewGo() with an unknown base platform policy succeeded, wanted error")
+	}
+}
+
+func TestGoBuildWindows(t *testing.T) {
+	amd64 := v1.Platform{OS: "linux", Architecture: "amd64"}
+	windows := v1.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.1879"}
+	importpath := StrictScheme + "github.com/google/ko/test"
+
+	var goos []string
+	recordGoos := func(ctx context.Context, ip, dir string, platform v1.Platform, config Config) (string, error) {
+		env, err := buildEnv(platform, nil, config.Env)
+		if err != nil {
+			return "", err
+		}
+		v, _ := lookupEnv(env, "GOOS")
+		goos = append(goos, v)
+		return writeTempFile(ctx, ip, dir, platform, config)
+	}
+	ng, err := NewGo(
+		context.Background(),
+		"",
+		WithBaseImages(func(context.Context, string) (name.Reference, Result, error) {
+			return baseRef, platformIndex(t, amd64, windows), nil
+		}),
+		WithPlatforms("all"),
+		withBuilder(recordGoos),
+	)
+	if err != nil {
+		t.Fatalf("NewGo() = %v", err)
+	}
+	result, err := ng.Build(context.Background(), importpath)
+	if err != nil {
+		t.Fatalf("Build() = %v", err)
+	}
+	if diff := cmp.Diff([]string{"linux", "windows"}, goos); diff != "" {
+		t.Errorf("GOOS (-want +got): %s", diff)
+	}
+
+	idx := result.(v1.ImageIndex)
+	im, err := idx.IndexManifest()
+	if err != nil {
+		t.Fatalf("IndexManifest() = %v", err)
+	}
+	if len(im.Manifests) != 2 {
+		t.Fatalf("len(Manifests) = %d, wanted 2", len(im.Manifests))
+	}
+	for _, desc := range im.Manifests {
+		img, err := idx.Image(desc.Digest)
+		if err != nil {
+			t.Fatalf("idx.Image(%s) = %v", desc.Digest, err)
+		}
+		cf, err := img.ConfigFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		layers, err := img.Layers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers := map[string]*tar.Header{}
+		rc, err := layers[len(layers)-1].Uncompressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := tar.NewReader(rc)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			headers[hdr.Name] = hdr
+		}
+		rc.Close()
+
+		if desc.Platform.OS != "windows" {
+			if got, want := cf.Config.Entrypoint, []string{"/ko-app/test"}; !cmp.Equal(got, want) {
+				t.Errorf("linux entrypoint = %v, wanted %v", got, want)
+			}
+			if _, ok := headers["/ko-app/test"]; !ok {
+				t.Errorf("linux binary layer has %v, wanted /ko-app/test", headers)
+			}
+			continue
+		}
+
+		if diff := cmp.Diff(windows, *desc.Platform); diff != "" {
+			t.Errorf("windows descriptor platform (-want +got): %s", diff)
+		}
+		if cf.OS != "windows" || cf.OSVersion != windows.OSVersion {
+			t.Errorf("windows config os = %q, os.version = %q, wanted windows, %s", cf.OS, cf.OSVersion, windows.OSVersion)
+		}
+		if got, want := cf.Config.Entrypoint, []string{`C:\ko-app\test.exe`}; !cmp.Equal(got, want) {
+			t.Errorf("windows entrypoint = %v, wanted %v", got, want)
+		}
+		for _, dir := range []string{"Hives", "Files", "Files/ko-app"} {
+			if hdr, ok := headers[dir]; !ok || hdr.Typeflag != tar.TypeDir {
+				t.Errorf("windows binary layer has no directory %s", dir)
+			}
+		}
+		hdr, ok := headers["Files/ko-app/test.exe"]
+		if !ok {
+			t.Fatalf("windows binary layer has %v, wanted Files/ko-app/test.exe", headers)
+		}
+		if got := hdr.PAXRecords["MSWINDOWS.rawsd"]; got != userOwnerAndGroupSID {
+			t.Errorf("windows binary MSWINDOWS.rawsd = %q, wanted %q", got, userOwnerAndGroupSID)
+		}
+	}
+}
+
+func mustRandomImage(t *testing.T) v1.Image {
+	t.Helper()
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image() = %v", err)
+	}
+	return img
+}
+
+func TestWithEnv(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		env         []string
+		config      Config
+		want        map[string]string
+		wantErr     bool
+	}{{
+		description: "later values win",
+		env:         []string{"GOFLAGS=-mod=mod", "GOPRIVATE=example.com", "GOFLAGS=-mod=vendor"},
+		want:        map[string]string{"GOFLAGS": "-mod=vendor", "GOPRIVATE": "example.com"},
+	}, {
+		// What ko passes for GOPRIVATE in .ko.yaml, and then --set-env.
+		description: "flag after config file",
+		env:         []string{"GOFLAGS=-mod=vendor -tags=netgo", "GOPRIVATE=example.com", "GOPRIVATE=example.org"},
+		want:        map[string]string{"GOFLAGS": "-mod=vendor -tags=netgo", "GOPRIVATE": "example.org"},
+	}, {
+		description: "importpath config wins",
+		env:         []string{"GOFLAGS=-mod=vendor"},
+		config:      Config{Env: []string{"GOFLAGS=-mod=readonly"}},
+		want:        map[string]string{"GOFLAGS": "-mod=readonly"},
+	}, {
+		description: "CGO_ENABLED overrides default",
+		env:         []string{"CGO_ENABLED=1"},
+		want:        map[string]string{"CGO_ENABLED": "1"},
+	}, {
+		description: "GOOS rejected",
+		env:         []string{"GOOS=windows"},
+		wantErr:     true,
+	}, {
+		description: "GOARCH rejected",
+		env:         []string{"GOARCH=arm64"},
+		wantErr:     true,
+	}, {
+		description: "missing value",
+		env:         []string{"GOFLAGS"},
+		wantErr:     true,
+	}} {
+		t.Run(test.description, func(t *testing.T) {
+			ng, err := NewGo(context.Background(), "",
+				WithEnv(test.env),
+				WithBaseImages(func(context.Context, string) (name.Reference, Result, error) { return baseRef, nil, nil }),
+				WithConfig(map[string]Config{"example.com/foo": test.config}),
+				WithPlatforms("linux/amd64"))
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("NewGo() succeeded, wanted error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewGo() = %v", err)
+			}
+			config := ng.(*gobuild).configForImportPath("example.com/foo")
+			env, err := buildEnv(v1.Platform{OS: "linux", Architecture: "amd64"}, []string{"GOFLAGS=-mod=mod"}, config.Env)
+			if err != nil {
+				t.Fatalf("buildEnv() = %v", err)
+			}
+			for k, want := range test.want {
+				if got, _ := lookupEnv(env, k); got != want {
+					t.Errorf("%s = %q, wanted %q", k, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWithModuleConfig(t *testing.T) {
+	ng, err := NewGo(context.Background(), "",
+		WithEnv([]string{"GOPROXY=https://proxy.golang.org", "GONOSUMDB=example.com"}),
+		WithModuleConfig(ModuleConfig{Proxy: "https://proxy.example.com", SumDB: "off"}),
+		WithBaseImages(func(context.Context, string) (name.Reference, Result, error) { return baseRef, nil, nil }),
+		WithConfig(map[string]Config{"example.com/foo": {Env: []string{"GOSUMDB=sum.golang.org"}}}),
+		WithPlatforms("linux/amd64"))
+	if err != nil {
+		t.Fatalf("NewGo() = %v", err)
+	}
+	config := ng.(*gobuild).configForImportPath("example.com/foo")
+	// Ambient values aren't inherited, even those the module config
+	// leaves empty.
+	ambient := []string{"GOPRIVATE=example.org", "GONOPROXY=example.org"}
+	env, err := buildEnv(v1.Platform{OS: "linux", Architecture: "amd64"}, ambient, config.Env)
+	if err != nil {
+		t.Fatalf("buildEnv() = %v", err)
+	}
+	for k, want := range map[string]string{
+		"GOPROXY":   "https://proxy.example.com",
+		"GONOPROXY": "",
+		"GOPRIVATE": "",
+		"GONOSUMDB": "",
+		// Env configured for the importpath still wins.
+		"GOSUMDB": "sum.golang.org",
+	} {
+		if got, _ := lookupEnv(env, k); got != want {
+			t.Errorf("%s = %q, wanted %q", k, got, want)
+		}
+	}
+}
+
+func TestVendored(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		flags       FlagArray
+		env         []string
+		want        bool
+	}{{
+		description: "neither",
+		flags:       FlagArray{"-trimpath"},
+	}, {
+		description: "GOFLAGS",
+		env:         []string{"GOFLAGS=-trimpath -mod=vendor"},
+		want:        true,
+	}, {
+		description: "later GOFLAGS win",
+		env:         []string{"GOFLAGS=-mod=vendor", "GOFLAGS=-mod=mod"},
+	}, {
+		description: "flag",
+		flags:       FlagArray{"--mod=vendor"},
+		want:        true,
+	}, {
+		description: "separate flag value",
+		flags:       FlagArray{"-mod", "vendor"},
+		want:        true,
+	}, {
+		description: "flag overrides GOFLAGS",
+		flags:       FlagArray{"-mod=readonly"},
+		env:         []string{"GOFLAGS=-mod=vendor"},
+	}} {
+		t.Run(test.description, func(t *testing.T) {
+			if got := vendored(test.flags, test.env); got != test.want {
+				t.Errorf("vendored() = %v, wanted %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestImageEnv(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		baseEnv     []string
+		imageEnv    []string
+		want        []string
+		wantErr     bool
+	}{{
+		description: "no base env",
+		want:        []string{"PATH=/ko-app", "KO_DATA_PATH=" + kodataRoot},
+	}, {
+		description: "base PATH is appended to",
+		baseEnv:     []string{"PATH=/usr/bin:/bin", "LANG=C.UTF-8"},
+		want:        []string{"PATH=/usr/bin:/bin:/ko-app", "LANG=C.UTF-8", "KO_DATA_PATH=" + kodataRoot},
+	}, {
+		description: "base PATH already has the app dir",
+		baseEnv:     []string{"PATH=/ko-app:/usr/bin"},
+		want:        []string{"PATH=/ko-app:/usr/bin", "KO_DATA_PATH=" + kodataRoot},
+	}, {
+		description: "duplicate base PATH is collapsed into the last",
+		baseEnv:     []string{"PATH=/bin", "HOME=/root", "PATH=/usr/local/bin:/usr/bin"},
+		want:        []string{"PATH=/usr/local/bin:/usr/bin:/ko-app", "HOME=/root", "KO_DATA_PATH=" + kodataRoot},
+	}, {
+		description: "ko's KO_DATA_PATH wins over the base's",
+		baseEnv:     []string{"KO_DATA_PATH=/data", "PATH=/bin", "FOO=bar"},
+		want:        []string{"PATH=/bin:/ko-app", "FOO=bar", "KO_DATA_PATH=" + kodataRoot},
+	}, {
+		description: "image env wins over everything",
+		baseEnv:     []string{"KO_DATA_PATH=/data", "PATH=/bin", "FOO=bar", "LANG=C"},
+		imageEnv:    []string{"FOO=baz", "PATH=/opt/bin", "KO_DATA_PATH=/srv"},
+		want:        []string{"LANG=C", "FOO=baz", "PATH=/opt/bin", "KO_DATA_PATH=/srv"},
+	}, {
+		description: "duplicate image env is rejected",
+		imageEnv:    []string{"FOO=bar", "FOO=baz"},
+		wantErr:     true,
+	}, {
+		description: "invalid image env is rejected",
+		imageEnv:    []string{"FOO"},
+		wantErr:     true,
+	}} {
+		t.Run(test.description, func(t *testing.T) {
+			base, err := random.Image(1024, 1)
+			if err != nil {
+				t.Fatalf("random.Image() = %v", err)
+			}
+			cf, err := base.ConfigFile()
+			if err != nil {
+				t.Fatalf("ConfigFile() = %v", err)
+			}
+			cfg := cf.Config
+			cfg.Env = test.baseEnv
+			if base, err = mutate.Config(base, cfg); err != nil {
+				t.Fatalf("mutate.Config() = %v", err)
+			}
+
+			ng, err := NewGo(context.Background(), "",
+				WithBaseImages(func(context.Context, string) (name.Reference, Result, error) { return baseRef, base, nil }),
+				withBuilder(writeTempFile),
+				WithImageEnv(test.imageEnv))
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("NewGo() succeeded, wanted error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewGo() = %v", err)
+			}
+			result, err := ng.Build(context.Background(), StrictScheme+"github.com/google/ko/test")
+			if err != nil {
+				t.Fatalf("Build() = %v", err)
+			}
+			got, err := result.(v1.Image).ConfigFile()
+			if err != nil {
+				t.Fatalf("ConfigFile() = %v", err)
+			}
+			if diff := cmp.Diff(test.want, got.Config.Env); diff != "" {
+				t.Errorf("env (-want +got): %s", diff)
+			}
+		})
+	}
+}
+
+func TestGoBuildBinaryCollision(t *testing.T) {
+	base, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image() = %v", err)
+	}
+	first := "github.com/google/ko/pkg/build/testdata/collision/foo/app"
+	second := "github.com/google/ko/pkg/build/testdata/collision/bar/app"
+	suffixed := func(ip string) string {
+		h := sha256.Sum256([]byte(ip))
+		return "/ko-app/app-" + hex.EncodeToString(h[:])[:8]
+	}
+
+	buildImage := func(t *testing.T, ng Interface, ref string) (v1.Image, error) {
+		t.Helper()
+		res, err := ng.Build(context.Background(), ref)
+		if err != nil {
+			return nil, err
+		}
+		img, ok := res.(v1.Image)
+		if !ok {
+			t.Fatalf("Build() not an image: %T", res)
+		}
+		return img, nil
+	}
+
+	for _, test := range []struct {
+		policy  BinaryCollisionPolicy
+		want    map[string]string
+		wantErr bool
+	}{{
+		policy:  "",
+		wantErr: true,
+	}, {
+		policy:  BinaryCollisionError,
+		wantErr: true,
+	}, {
+		policy: BinaryCollisionSuffix,
+		want:   map[string]string{suffixed(first): first, suffixed(second): second},
+	}} {
+		t.Run(string(test.policy), func(t *testing.T) {
+			ng, err := NewGo(
+				context.Background(),
+				"",
+				WithBaseImages(func(context.Context, string) (name.Reference, Result, error) { return baseRef, base, nil }),
+				WithBinaryCollision(test.policy),
+				withBuilder(writeTempFile),
+			)
+			if err != nil {
+				t.Fatalf("NewGo() = %v", err)
+			}
+
+			// Separate images never collide.
+			for _, ip := range []string{first, second} {
+				img, err := buildImage(t, ng, StrictScheme+ip)
+				if err != nil {
+					t.Fatalf("Build(%s) = %v", ip, err)
+				}
+				if diff := cmp.Diff(map[string]string{"/ko-app/app": ip}, imageBinaries(t, img)); diff != "" {
+					t.Errorf("binaries for %s (-want +got): %s", ip, diff)
+				}
+			}
+
+			// In a combined image, the names don't depend on the order.
+			for _, ips := range [][]string{{first, second}, {second, first}} {
+				ref := StrictScheme + MultiPrefix + strings.Join(ips, ",")
+				img, err := buildImage(t, ng, ref)
+				if test.wantErr {
+					if err == nil {
+						t.Errorf("Build(%s) succeeded, wanted collision error", ref)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("Build(%s) = %v", ref, err)
+				}
+				if diff := cmp.Diff(test.want, imageBinaries(t, img)); diff != "" {
+					t.Errorf("binaries for %s (-want +got): %s", ref, diff)
+				}
+				cfg, err := img.ConfigFile()
+				if err != nil {
+					t.Fatalf("ConfigFile() = %v", err)
+				}
+				if diff := cmp.Diff([]string{suffixed(ips[0])}, cfg.Config.Entrypoint); diff != "" {
+					t.Errorf("Entrypoint for %s (-want +got): %s", ref, diff)
+				}
+			}
+		})
+	}
+
+	if _, err := NewGo(context.Background(), "", WithBinaryCollision("overwrite")); err == nil {
+		t.Error("NewGo() with unknown policy succeeded, wanted error")
+	}
+}
+
+// imageBinaries returns the contents of the files in /ko-app in img.
+func imageBinaries(t *testing.T, img v1.Image) map[string]string {
+	t.Helper()
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatalf("Layers() = %v", err)
+	}
+	got := map[string]string{}
+	for _, l := range layers {
+		rc, err := l.Uncompressed()
+		if err != nil {
+			t.Fatalf("Uncompressed() = %v", err)
+		}
+		tr := tar.NewReader(rc)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("Next() = %v", err)
+			}
+			if strings.HasPrefix(hdr.Name, "/ko-app/") && hdr.Typeflag == tar.TypeReg {
+				b, err := ioutil.ReadAll(tr)
+				if err != nil {
+					t.Fatalf("ReadAll() = %v", err)
+				}
+				got[hdr.Name] = string(b)
+			}
+		}
+		rc.Close()
+	}
+	return got
+}
+
+func TestGoBuildMulti(t *testing.T) {
+	base, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image() = %v", err)
+	}
+	app := "github.com/google/ko/pkg/build/testdata/collision/foo/app"
+	ldflags := "github.com/google/ko/pkg/build/testdata/ldflags"
+
+	ng, err := NewGo(
+		context.Background(),
+		"",
+		WithBaseImages(func(context.Context, string) (name.Reference, Result, error) { return baseRef, base, nil }),
+		withBuilder(writeTempFile),
+	)
+	if err != nil {
+		t.Fatalf("NewGo() = %v", err)
+	}
+
+	for _, test := range []struct {
+		description    string
+		importpaths    []string
+		wantEntrypoint string
+	}{{
+		description:    "app entrypoint",
+		importpaths:    []string{app, ldflags},
+		wantEntrypoint: "/ko-app/app",
+	}, {
+		description:    "ldflags entrypoint",
+		importpaths:    []string{ldflags, app},
+		wantEntrypoint: "/ko-app/ldflags",
+	}} {
+		t.Run(test.description, func(t *testing.T) {
+			ref := StrictScheme + MultiPrefix + strings.Join(test.importpaths, ",")
+			if err := ng.IsSupportedReference(ref); err != nil {
+				t.Fatalf("IsSupportedReference(%s) = %v", ref, err)
+			}
+			res, err := ng.Build(context.Background(), ref)
+			if err != nil {
+				t.Fatalf("Build(%s) = %v", ref, err)
+			}
+			img, ok := res.(v1.Image)
+			if !ok {
+				t.Fatalf("Build() not an image: %T", res)
+			}
+
+			cfg, err := img.ConfigFile()
+			if err != nil {
+				t.Fatalf("ConfigFile() = %v", err)
+			}
+			if diff := cmp.Diff([]string{test.wantEntrypoint}, cfg.Config.Entrypoint); diff != "" {
+				t.Errorf("Entrypoint (-want +got): %s", diff)
+			}
+
+			// Both binaries are in the image, with the contents built for
+			// each importpath.
+			got := imageBinaries(t, img)
+			want := map[string]string{"/ko-app/app": app, "/ko-app/ldflags": ldflags}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("binaries (-want +got): %s", diff)
+			}
+		})
+	}
+
+	t.Run("no importpaths", func(t *testing.T) {
+		ref := StrictScheme + MultiPrefix
+		if _, err := ng.Build(context.Background(), ref); err == nil {
+			t.Errorf("Build(%s) succeeded, wanted error", ref)
+		}
+	})
+
+	t.Run("not a command", func(t *testing.T) {
+		ref := StrictScheme + MultiPrefix + app + ",github.com/google/ko/pkg/build"
+		if err := ng.IsSupportedReference(ref); err == nil {
+			t.Errorf("IsSupportedReference(%s) succeeded, wanted error", ref)
+		}
+	})
+}
+
+func TestMultiName(t *testing.T) {
+	a := MultiName([]string{"example.com/cmd/foo", "example.com/cmd/bar"})
+	b := MultiName([]string{"example.com/cmd/foo", "example.com/cmd/baz"})
+	if !strings.HasPrefix(a, "example.com/cmd/foo-multi-") {
+		t.Errorf("MultiName() = %s, wanted prefix example.com/cmd/foo-multi-", a)
+	}
+	if a == b {
+		t.Errorf("MultiName() = %s for different importpaths", a)
+	}
+}
+
+func TestWithTags(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		tags        []string
+		flags       FlagArray
+		want        FlagArray
+	}{{
+		description: "repeated and comma-separated",
+		tags:        []string{"netgo,osusergo", "containers_image_openpgp"},
+		flags:       FlagArray{"-trimpath"},
+		want:        FlagArray{"-trimpath", "-tags", "netgo,osusergo,containers_image_openpgp"},
+	}, {
+		description: "merged with separate -tags",
+		tags:        []string{"osusergo"},
+		flags:       FlagArray{"-tags", "netgo"},
+		want:        FlagArray{"-tags", "netgo,osusergo"},
+	}, {
+		description: "merged with -tags=",
+		tags:        []string{"osusergo"},
+		flags:       FlagArray{"-tags=netgo foo"},
+		want:        FlagArray{"-tags=netgo,foo,osusergo"},
+	}} {
+		t.Run(test.description, func(t *testing.T) {
+			gbo := &gobuildOpener{}
+			if err := WithTags(test.tags)(gbo); err != nil {
+				t.Fatal(err)
+			}
+			config := Config{Flags: test.flags}
+			g := &gobuild{tags: gbo.tags, resolveConfig: NewConfigResolver(map[string]Config{"example.com/foo": config})}
+			got := g.configForImportPath("example.com/foo").Flags
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Flags (-want +got): %s", diff)
+			}
+			// The configured flags aren't modified.
+			if diff := cmp.Diff(test.flags, config.Flags); diff != "" {
+				t.Errorf("configured Flags changed (-want +got): %s", diff)
+			}
+		})
+	}
+}
+
+func TestWithGoFlags(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		flags       []string
+		config      *Config
+		want        FlagArray
+		wantErr     bool
+	}{{
+		description: "default config",
+		flags:       []string{"-mod=vendor", "-gcflags", "all=-N -l"},
+		want:        FlagArray{"-trimpath", "-mod=vendor", "-gcflags", "all=-N -l"},
+	}, {
+		description: "after configured flags",
+		flags:       []string{"-asmflags=all=-trimpath=/src"},
+		config:      &Config{Flags: FlagArray{"-race"}},
+		want:        FlagArray{"-race", "-asmflags=all=-trimpath=/src"},
+	}, {
+		description: "reject -o",
+		flags:       []string{"-o", "/tmp/foo"},
+		wantErr:     true,
+	}, {
+		description: "reject --o=",
+		flags:       []string{"--o=/tmp/foo"},
+		wantErr:     true,
+	}, {
+		description: "reject -C",
+		flags:       []string{"-C=/src"},
+		wantErr:     true,
+	}, {
+		description: "reject -tags",
+		flags:       []string{"-tags", "netgo"},
+		wantErr:     true,
+	}, {
+		description: "reject --tags=",
+		flags:       []string{"--tags=netgo"},
+		wantErr:     true,
+	}, {
+		description: "values aren't flags",
+		flags:       []string{"-gcflags", "o"},
+		want:        FlagArray{"-trimpath", "-gcflags", "o"},
+	}} {
+		t.Run(test.description, func(t *testing.T) {
+			gbo := &gobuildOpener{}
+			err := WithGoFlags(test.flags)(gbo)
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("WithGoFlags() succeeded, wanted error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("WithGoFlags() = %v", err)
+			}
+			configs := map[string]Config{}
+			if test.config != nil {
+				configs["example.com/foo"] = *test.config
+			}
+			g := &gobuild{goFlags: gbo.goFlags, resolveConfig: NewConfigResolver(configs)}
+			if diff := cmp.Diff(test.want, g.configForImportPath("example.com/foo").Flags); diff != "" {
+				t.Errorf("Flags (-want +got): %s", diff)
+			}
+		})
+	}
+}
+
+func TestGoBuildExternal(t *testing.T) {
+	base, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image() = %v", err)
+	}
+	var baseFor, built string
+	var configFor []string
+	ng, err := NewGo(
+		context.Background(),
+		"",
+		WithBaseImages(func(_ context.Context, s string) (name.Reference, Result, error) {
+			baseFor = s
+			return baseRef, base, nil
+		}),
+		WithConfigResolver(func(ip string) (Config, bool) {
+			configFor = append(configFor, ip)
+			return Config{}, false
+		}),
+		withBuilder(func(ctx context.Context, ip, dir string, platform v1.Platform, config Config) (string, error) {
+			built = ip
+			return writeTempFile(ctx, ip, dir, platform, config)
+		}),
+	)
+	if err != nil {
+		t.Fatalf("NewGo() = %v", err)
+	}
+
+	ref := "ko://example.com/tools/cmd/gen@v1.4.2"
+	if err := ng.IsSupportedReference(ref); err != nil {
+		t.Fatalf("IsSupportedReference(%s) = %v", ref, err)
+	}
+	res, err := ng.Build(context.Background(), ref)
+	if err != nil {
+		t.Fatalf("Build(%s) = %v", ref, err)
+	}
+	img, ok := res.(v1.Image)
+	if !ok {
+		t.Fatalf("Build() not an image: %T", res)
+	}
+
+	// The version is only used to build, and everything else is looked up
+	// by importpath.
+	if want := "example.com/tools/cmd/gen@v1.4.2"; built != want {
+		t.Errorf("built %s, wanted %s", built, want)
+	}
+	if want := "ko://example.com/tools/cmd/gen"; baseFor != want {
+		t.Errorf("base image for %s, wanted %s", baseFor, want)
+	}
+	if diff := cmp.Diff([]string{"example.com/tools/cmd/gen"}, configFor); diff != "" {
+		t.Errorf("config resolved for (-want +got): %s", diff)
+	}
+
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		t.Fatalf("ConfigFile() = %v", err)
+	}
+	if diff := cmp.Diff([]string{"/ko-app/gen"}, cfg.Config.Entrypoint); diff != "" {
+		t.Errorf("Entrypoint (-want +got): %s", diff)
+	}
+	if got := cfg.Config.Labels[specsv1.AnnotationVersion]; got != "v1.4.2" {
+		t.Errorf("version label = %q, wanted v1.4.2", got)
+	}
+}
+
+func TestGoBuildExternalVersions(t *testing.T) {
+	base, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image() = %v", err)
+	}
+	for _, test := range []struct {
+		version     string
+		wantMutable bool
+		wantErr     bool
+	}{
+		{version: "v1.4.2"},
+		{version: "v2.0.0+incompatible"},
+		{version: "v0.0.0-20211007125505-59d4e928ea9d"},
+		{version: "v1.5.0-rc.1"},
+		{version: "59d4e928ea9d2b5a2bd6e0b9b1a4b4d7e1f3c0a2"},
+		{version: "latest", wantMutable: true},
+		{version: "main", wantMutable: true},
+		{version: "v1", wantMutable: true},
+		{version: "v1.4", wantMutable: true},
+		{version: "59d4e928", wantMutable: true},
+		{version: "", wantErr: true},
+	} {
+		t.Run(test.version, func(t *testing.T) {
+			ref := "ko://example.com/tools/cmd/gen@" + test.version
+			for _, allow := range []bool{false, true} {
+				ng, err := NewGo(context.Background(), "",
+					WithBaseImages(func(context.Context, string) (name.Reference, Result, error) { return baseRef, base, nil }),
+					WithMutableVersions(allow))
+				if err != nil {
+					t.Fatalf("NewGo() = %v", err)
+				}
+				err = ng.IsSupportedReference(ref)
+				if wantErr := test.wantErr || (test.wantMutable && !allow); (err != nil) != wantErr {
+					t.Errorf("IsSupportedReference(%s) with mutable versions %t = %v, wanted error: %t", ref, allow, err, wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestExternalName(t *testing.T) {
+	ip, version, ok := ExternalImportPath("ko://example.com/tools/cmd/gen@v2.0.0+incompatible")
+	if !ok || ip != "example.com/tools/cmd/gen" || version != "v2.0.0+incompatible" {
+		t.Fatalf("ExternalImportPath() = %s, %s, %t", ip, version, ok)
+	}
+	if got, want := ExternalName(ip, version), "example.com/tools/cmd/gen-v2.0.0-incompatible"; got != want {
+		t.Errorf("ExternalName() = %s, wanted %s", got, want)
+	}
+	if _, _, ok := ExternalImportPath("ko://example.com/tools/cmd/gen"); ok {
+		t.Error("ExternalImportPath() of an unversioned importpath = true")
+	}
+}
+
+// writeModuleProxy writes the files of module at version to a directory that
+// can be used as a GOPROXY, with a file:// URL.
+func writeModuleProxy(t *testing.T, dir, module, version string, files map[string]string) {
+	t.Helper()
+	vdir := filepath.Join(dir, filepath.FromSlash(module), "@v")
+	if err := os.MkdirAll(vdir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	var zb bytes.Buffer
+	zw := zip.NewWriter(&zb)
+	for name, content := range files {
+		w, err := zw.Create(module + "@" + version + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string][]byte{
+		"list":            []byte(version + "\n"),
+		version + ".info": []byte(fmt.Sprintf(`{"Version":%q,"Time":"2021-10-01T00:00:00Z"}`, version)),
+		version + ".mod":  []byte(files["go.mod"]),
+		version + ".zip":  zb.Bytes(),
+	} {
+		if err := ioutil.WriteFile(filepath.Join(vdir, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBuildExternalModule(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping go build of an external module in short mode")
+	}
+	dir, err := ioutil.TempDir("", "ko-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		// The module cache is read-only.
+		filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+			if err == nil && info.IsDir() {
+				os.Chmod(p, 0755)
+			}
+			return nil
+		})
+		os.RemoveAll(dir)
+	}()
+
+	proxy := filepath.Join(dir, "proxy")
+	writeModuleProxy(t, proxy, "example.com/tools", "v1.4.2", map[string]string{
+		"go.mod":          "module example.com/tools\n",
+		"cmd/gen/main.go": "package main\n\nfunc main() {}\n",
+		"lib/lib.go":      "package lib\n",
+	})
+	config := Config{Env: []string{
+		"GOPROXY=file://" + filepath.ToSlash(proxy),
+		"GOSUMDB=off",
+		"GONOPROXY=",
+		"GOPRIVATE=",
+		"GOMODCACHE=" + filepath.Join(dir, "modcache"),
+	}}
+	platform := v1.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+
+	file, err := build(context.Background(), "example.com/tools/cmd/gen@v1.4.2", "", platform, config)
+	if err != nil {
+		t.Fatalf("build() = %v", err)
+	}
+	defer os.RemoveAll(filepath.Dir(file))
+	if fi, err := os.Stat(file); err != nil || fi.Size() == 0 {
+		t.Errorf("build() output %s: %v", file, err)
+	}
+	if got := moduleVersion(context.Background(), "", file); got != "v1.4.2" {
+		t.Errorf("moduleVersion() = %q, wanted v1.4.2", got)
+	}
+
+	if _, err := build(context.Background(), "example.com/tools/lib@v1.4.2", "", platform, config); err == nil || !strings.Contains(err.Error(), "package main") {
+		t.Errorf("build() of a library = %v, wanted not `package main` error", err)
+	}
+	if _, err := build(context.Background(), "example.com/tools/cmd/gen@v1.5.0", "", platform, config); err == nil {
+		t.Error("build() of a missing version succeeded, wanted error")
+	}
+}
+
+func TestGoBuildKoDataOnly(t *testing.T) {
+	const importpath = "example.com/app/cmd/app"
+	dir, err := ioutil.TempDir("", "ko-kodata-only")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kodata := filepath.Join(dir, "kodata")
+	if err := os.Mkdir(kodata, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeKoData := func(s string) {
+		t.Helper()
+		if err := ioutil.WriteFile(filepath.Join(kodata, "index.html"), []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeKoData("<h1>Hello</h1>")
+
+	// A binary that doesn't compress, so that uploading it shows.
+	const binarySize = 1 << 20
+	var builds int
+	buildBinary := func(_ context.Context, ip, _ string, _ v1.Platform, _ Config) (string, error) {
+		builds++
+		tmpDir, err := ioutil.TempDir("", "ko")
+		if err != nil {
+			return "", err
+		}
+		b := make([]byte, binarySize)
+		rand.New(rand.NewSource(int64(builds))).Read(b)
+		file := filepath.Join(tmpDir, "out")
+		return file, ioutil.WriteFile(file, b, 0755)
+	}
+
+	base := mustRandomImage(t)
+	ng, err := NewGo(context.Background(), "",
+		WithBaseImages(func(context.Context, string) (name.Reference, Result, error) { return baseRef, base, nil }),
+		withBuilder(buildBinary),
+		withModuleInfo(&modules{
+			main: &modInfo{Path: "example.com/app", Dir: dir, Main: true},
+			deps: map[string]*modInfo{},
+		}),
+		withBuildContext(stubBuildContext{
+			importpath: &gb.Package{Name: "main", Dir: dir, ImportPath: importpath},
+		}),
+	)
+	if err != nil {
+		t.Fatalf("NewGo() = %v", err)
+	}
+	cb, err := NewCaching(ng)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Count what's uploaded to the registry.
+	var uploaded int64
+	reg := registry.New()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/blobs/uploads/") {
+			b, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Errorf("reading upload: %v", err)
+			}
+			atomic.AddInt64(&uploaded, int64(len(b)))
+			r.Body = ioutil.NopCloser(bytes.NewReader(b))
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, err := name.NewTag(u.Host + "/app:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	push := func() (v1.Image, int64) {
+		t.Helper()
+		result, err := cb.Build(context.Background(), StrictScheme+importpath)
+		if err != nil {
+			t.Fatalf("Build() = %v", err)
+		}
+		img := result.(v1.Image)
+		atomic.StoreInt64(&uploaded, 0)
+		if err := remote.Write(tag, img); err != nil {
+			t.Fatalf("remote.Write() = %v", err)
+		}
+		return img, atomic.LoadInt64(&uploaded)
+	}
+	layerDigests := func(img v1.Image) []v1.Hash {
+		t.Helper()
+		ls, err := img.Layers()
+		if err != nil {
+			t.Fatalf("Layers() = %v", err)
+		}
+		var hs []v1.Hash
+		for _, l := range ls {
+			h, err := l.Digest()
+			if err != nil {
+				t.Fatalf("Digest() = %v", err)
+			}
+			hs = append(hs, h)
+		}
+		return hs
+	}
+
+	first, firstUpload := push()
+	if firstUpload < binarySize {
+		t.Fatalf("first push uploaded %d bytes, wanted at least the %d byte binary", firstUpload, binarySize)
+	}
+
+	// Only kodata changed: the binary isn't built or uploaded again.
+	writeKoData("<h1>Hello, again</h1>")
+	cb.InvalidateData(StrictScheme + importpath)
+	second, secondUpload := push()
+	if builds != 1 {
+		t.Errorf("built the binary %d times, wanted once", builds)
+	}
+	if secondUpload >= binarySize {
+		t.Errorf("kodata-only push uploaded %d bytes, wanted less than the %d byte binary", secondUpload, binarySize)
+	}
+	l1, l2 := layerDigests(first), layerDigests(second)
+	if n := len(l1); l1[n-1] != l2[n-1] {
+		t.Errorf("binary layer = %s, wanted %s", l2[n-1], l1[n-1])
+	}
+	if n := len(l1); l1[n-2] == l2[n-2] {
+		t.Error("kodata layer didn't change")
+	}
+
+	// A code change wins over a later kodata change.
+	cb.Invalidate(StrictScheme + importpath)
+	cb.InvalidateData(StrictScheme + importpath)
+	if _, upload := push(); builds != 2 || upload < binarySize {
+		t.Errorf("after a code change, built %d times and uploaded %d bytes, wanted a new binary", builds, upload)
+	}
+}
+
+func TestGoBuildWasm(t *testing.T) {
+	importpath := "github.com/google/ko/test"
+	noBase := WithBaseImages(func(context.Context, string) (name.Reference, Result, error) {
+		return nil, nil, errors.New("wasip1/wasm modules have no base image")
+	})
+
+	t.Run("artifact", func(t *testing.T) {
+		ng, err := NewGo(context.Background(), "",
+			WithPlatforms("wasip1/wasm"),
+			WithCreationTime(v1.Time{Time: time.Unix(5000, 0)}),
+			noBase,
+			withBuilder(writeTempFile),
+		)
+		if err != nil {
+			t.Fatalf("NewGo() = %v", err)
+		}
+		result, err := ng.Build(context.Background(), StrictScheme+importpath)
+		if err != nil {
+			t.Fatalf("Build() = %v", err)
+		}
+		img := result.(v1.Image)
+
+		// Push it, as publishers do, and check that the registry has the
+		// wasm media types.
+		s := httptest.NewServer(registry.New())
+		defer s.Close()
+		u, err := url.Parse(s.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tag, err := name.NewTag(u.Host + "/app:latest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := remote.Write(tag, img); err != nil {
+			t.Fatalf("remote.Write() = %v", err)
+		}
+		pushed, err := remote.Image(tag)
+		if err != nil {
+			t.Fatalf("remote.Image() = %v", err)
+		}
+		mf, err := pushed.Manifest()
+		if err != nil {
+			t.Fatalf("Manifest() = %v", err)
+		}
+		if got := mf.Config.MediaType; got != WasmConfigMediaType {
+			t.Errorf("config media type = %s, wanted %s", got, WasmConfigMediaType)
+		}
+		if len(mf.Layers) != 1 {
+			t.Fatalf("len(Layers) = %d, wanted 1", len(mf.Layers))
+		}
+		if got := mf.Layers[0].MediaType; got != WasmLayerMediaType {
+			t.Errorf("layer media type = %s, wanted %s", got, WasmLayerMediaType)
+		}
+		if got, want := mf.Layers[0].Annotations[specsv1.AnnotationTitle], "test.wasm"; got != want {
+			t.Errorf("layer title = %q, wanted %q", got, want)
+		}
+
+		// The layer is the module itself.
+		l, err := pushed.LayerByDigest(mf.Layers[0].Digest)
+		if err != nil {
+			t.Fatalf("LayerByDigest() = %v", err)
+		}
+		rc, err := l.Compressed()
+		if err != nil {
+			t.Fatalf("Compressed() = %v", err)
+		}
+		defer rc.Close()
+		module, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(module); got != importpath {
+			t.Errorf("module = %q, wanted %q", got, importpath)
+		}
+
+		cfg, err := pushed.RawConfigFile()
+		if err != nil {
+			t.Fatalf("RawConfigFile() = %v", err)
+		}
+		want := `{"created":"1970-01-01T01:23:20Z","author":"github.com/google/ko","architecture":"wasm","os":"wasip1","layerDigests":["` + mf.Layers[0].Digest.String() + `"]}`
+		if diff := cmp.Diff(want, string(cfg)); diff != "" {
+			t.Errorf("config (-want +got): %s", diff)
+		}
+	})
+
+	t.Run("image", func(t *testing.T) {
+		ng, err := NewGo(context.Background(), "",
+			WithPlatforms("wasip1/wasm"),
+			WithWasmPackaging(WasmImage),
+			noBase,
+			withBuilder(writeTempFile),
+		)
+		if err != nil {
+			t.Fatalf("NewGo() = %v", err)
+		}
+		result, err := ng.Build(context.Background(), StrictScheme+importpath)
+		if err != nil {
+			t.Fatalf("Build() = %v", err)
+		}
+		cfg, err := result.(v1.Image).ConfigFile()
+		if err != nil {
+			t.Fatalf("ConfigFile() = %v", err)
+		}
+		if got, want := cfg.OS+"/"+cfg.Architecture, "wasip1/wasm"; got != want {
+			t.Errorf("platform = %s, wanted %s", got, want)
+		}
+		if diff := cmp.Diff([]string{"/ko-app/test.wasm"}, cfg.Config.Entrypoint); diff != "" {
+			t.Errorf("entrypoint (-want +got): %s", diff)
+		}
+	})
+
+	for _, opts := range [][]Option{
+		{WithPlatforms("wasip1/wasm,linux/amd64")},
+		{WithPlatforms("wasip1/wasm"), WithWasmPackaging("module")},
+	} {
+		if _, err := NewGo(context.Background(), "", append(opts, noBase)...); err == nil {
+			t.Errorf("NewGo() succeeded, wanted error")
+		}
+	}
+}
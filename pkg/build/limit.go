@@ -24,7 +24,10 @@ import (
 
 // Limiter composes with another Interface to limit the number of concurrent builds.
 type Limiter struct {
-	Builder   Interface
+	Builder Interface
+	// Progress, if set, is told about builds that wait for others to
+	// finish.
+	Progress  Progress
 	semaphore *semaphore.Weighted
 }
 
@@ -43,8 +46,13 @@ func (l *Limiter) IsSupportedReference(ip string) error {
 
 // Build implements Interface
 func (l *Limiter) Build(ctx context.Context, ip string) (Result, error) {
-	if err := l.semaphore.Acquire(ctx, 1); err != nil {
-		return nil, err
+	if !l.semaphore.TryAcquire(1) {
+		if l.Progress != nil {
+			l.Progress.Report(ProgressEvent{Kind: ProgressQueued, ImportPath: ip})
+		}
+		if err := l.semaphore.Acquire(ctx, 1); err != nil {
+			return nil, err
+		}
 	}
 	defer l.semaphore.Release(1)
 
@@ -0,0 +1,90 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ModuleConfig configures where `go build` downloads modules from, and how
+// it authenticates them, in place of whatever the inherited environment
+// says. See `go help module-private` and `go help module-auth`.
+type ModuleConfig struct {
+	// Proxy is GOPROXY, e.g. "https://proxy.example.com,direct" or "off".
+	Proxy string
+	// NoProxy is GONOPROXY, the module path patterns to fetch directly.
+	NoProxy string
+	// Private is GOPRIVATE, the module path patterns that are neither
+	// fetched through the proxy nor checked against the checksum database.
+	Private string
+	// SumDB is GOSUMDB, the checksum database, e.g. "sum.golang.org" or
+	// "off".
+	SumDB string
+	// NoSumDB is GONOSUMDB, the module path patterns not to check against
+	// the checksum database.
+	NoSumDB string
+}
+
+// IsZero returns whether c configures nothing, leaving it all to the
+// inherited environment.
+func (c ModuleConfig) IsZero() bool {
+	return c == ModuleConfig{}
+}
+
+// Env returns the environment for c. All of the variables are set, even
+// those that are empty, so that none is inherited.
+func (c ModuleConfig) Env() []string {
+	return []string{
+		"GOPROXY=" + c.Proxy,
+		"GONOPROXY=" + c.NoProxy,
+		"GOPRIVATE=" + c.Private,
+		"GOSUMDB=" + c.SumDB,
+		"GONOSUMDB=" + c.NoSumDB,
+	}
+}
+
+func (c ModuleConfig) validate() error {
+	for _, kv := range c.Env() {
+		if strings.ContainsAny(kv, "\n\x00") {
+			return fmt.Errorf("invalid module config %q", kv)
+		}
+	}
+	return nil
+}
+
+// vendored returns whether a build with flags, and GOFLAGS from env, uses
+// -mod=vendor, so that it needs nothing from the network.
+func vendored(flags FlagArray, env []string) bool {
+	goflags, _ := lookupEnv(env, "GOFLAGS")
+	mod := ""
+	for _, fs := range [][]string{strings.Fields(goflags), flags} {
+		for i, f := range fs {
+			switch name := strings.TrimLeft(f, "-"); {
+			case f == name:
+			case strings.HasPrefix(name, "mod="):
+				mod = strings.TrimPrefix(name, "mod=")
+			case name == "mod" && i+1 < len(fs):
+				mod = fs[i+1]
+			}
+		}
+	}
+	return mod == "vendor"
+}
+
+// offlineEnv is appended to the environment of builds with -mod=vendor, so
+// that the go tool fails rather than reaching a proxy or checksum database,
+// whatever else configures them.
+var offlineEnv = []string{"GOPROXY=off", "GOSUMDB=off"}
@@ -0,0 +1,56 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// MultiPrefix follows StrictScheme in references to a single image combining
+// several importpaths, e.g. "ko://multi:example.com/cmd/foo,example.com/cmd/bar".
+// Each importpath is installed as a separate binary under /ko-app, which is
+// on $PATH. The first importpath is the entrypoint, and provides the kodata
+// and base image for the combined image.
+const MultiPrefix = "multi:"
+
+// MultiImportPaths returns the importpaths listed in a combined image
+// reference, and whether s is one.
+func MultiImportPaths(s string) ([]string, bool) {
+	s = strings.TrimPrefix(s, StrictScheme)
+	if !strings.HasPrefix(s, MultiPrefix) {
+		return nil, false
+	}
+	var importpaths []string
+	for _, ip := range strings.Split(strings.TrimPrefix(s, MultiPrefix), ",") {
+		if ip = strings.TrimSpace(ip); ip != "" {
+			importpaths = append(importpaths, ip)
+		}
+	}
+	return importpaths, true
+}
+
+// MultiName returns a name for the combined image of importpaths, suitable
+// for a publish.Namer: the entrypoint's importpath, followed by a short hash
+// of the whole list, so that it can't collide with the image for the
+// entrypoint alone, or with other combinations.
+func MultiName(importpaths []string) string {
+	if len(importpaths) == 0 {
+		return "multi"
+	}
+	h := sha256.Sum256([]byte(strings.Join(importpaths, ",")))
+	return importpaths[0] + "-multi-" + hex.EncodeToString(h[:])[:8]
+}
@@ -0,0 +1,157 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// NoSpaceError is returned when a build or publish runs out of disk space,
+// either because a write failed with ENOSPC or because the free space on the
+// filesystem dropped below the configured minimum.
+type NoSpaceError struct {
+	// Path is the file or directory that was being written.
+	Path string
+	// Filesystem is the mount point of the filesystem containing Path, if
+	// it could be determined.
+	Filesystem string
+	// Available is the number of free bytes on the filesystem, if known.
+	Available uint64
+	// Required is the configured minimum number of free bytes, if any.
+	Required uint64
+
+	err error
+}
+
+func (e *NoSpaceError) Error() string {
+	fs := e.Filesystem
+	if fs == "" {
+		fs = "unknown filesystem"
+	}
+	if e.Required != 0 {
+		return fmt.Sprintf("not enough free space for %s on %s: %d bytes available, %d required", e.Path, fs, e.Available, e.Required)
+	}
+	return fmt.Sprintf("no space left on device writing %s on %s: %v", e.Path, fs, e.err)
+}
+
+// Unwrap returns the underlying error, if any.
+func (e *NoSpaceError) Unwrap() error {
+	return e.err
+}
+
+// IsNoSpace reports whether err was caused by running out of disk space.
+func IsNoSpace(err error) bool {
+	var nse *NoSpaceError
+	return errors.As(err, &nse) || errors.Is(err, syscall.ENOSPC)
+}
+
+// WrapNoSpace converts ENOSPC errors encountered while writing path into a
+// *NoSpaceError. Other errors, including nil, are returned unchanged.
+func WrapNoSpace(err error, path string) error {
+	if err == nil {
+		return nil
+	}
+	var nse *NoSpaceError
+	if errors.As(err, &nse) {
+		return err
+	}
+	if !errors.Is(err, syscall.ENOSPC) {
+		return err
+	}
+	return &NoSpaceError{
+		Path:       path,
+		Filesystem: mountPoint(path),
+		err:        err,
+	}
+}
+
+// checkFreeSpace returns a *NoSpaceError if the filesystem containing dir has
+// fewer than min bytes available. A min of zero disables the check.
+func checkFreeSpace(dir string, min uint64) error {
+	if min == 0 {
+		return nil
+	}
+	avail, err := freeSpace(dir)
+	if err != nil {
+		// Not being able to determine the free space shouldn't fail the
+		// build, we'll find out soon enough if we run out.
+		return nil
+	}
+	if avail >= min {
+		return nil
+	}
+	return &NoSpaceError{
+		Path:       dir,
+		Filesystem: mountPoint(dir),
+		Available:  avail,
+		Required:   min,
+		err:        syscall.ENOSPC,
+	}
+}
+
+// WriteFileAtomically calls write with a temporary file in the same directory
+// as path, and renames it to path once write succeeds. If anything fails, the
+// temporary file is removed, so path is never left partially written. The
+// file gets the same mode as an existing file at path, or 0666 (before umask)
+// like os.Create otherwise.
+func WriteFileAtomically(path string, write func(io.Writer) error) (err error) {
+	dir := filepath.Dir(path)
+	tmp, err := createTemp(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return WrapNoSpace(err, dir)
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if fi, err := os.Stat(path); err == nil {
+		if err := tmp.Chmod(fi.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	if err := write(tmp); err != nil {
+		return WrapNoSpace(err, path)
+	}
+	if err := tmp.Sync(); err != nil {
+		return WrapNoSpace(err, path)
+	}
+	if err := tmp.Close(); err != nil {
+		return WrapNoSpace(err, path)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// createTemp is like ioutil.TempFile, but creates the file with mode 0666, so
+// that the umask applies as it would for os.Create, rather than 0600.
+func createTemp(dir, prefix string) (*os.File, error) {
+	for i := 0; ; i++ {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) && i < 10000 {
+			continue
+		}
+		return f, err
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// fullDisk is an io.Writer that behaves like a size-limited tmpfs: it accepts
+// up to n bytes and then fails with ENOSPC.
+type fullDisk struct {
+	w io.Writer
+	n int
+}
+
+func (f *fullDisk) Write(p []byte) (int, error) {
+	if len(p) > f.n {
+		n, _ := f.w.Write(p[:f.n])
+		f.n = 0
+		return n, &os.PathError{Op: "write", Path: "/tmp/full", Err: syscall.ENOSPC}
+	}
+	f.n -= len(p)
+	return f.w.Write(p)
+}
+
+func TestNoSpaceWhileTarringLayer(t *testing.T) {
+	root, err := ioutil.TempDir("", "kodata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := ioutil.WriteFile(filepath.Join(root, "big"), make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tw := tar.NewWriter(&fullDisk{w: ioutil.Discard, n: 1024})
+	err = walkRecursive(tw, root, kodataRoot, v1.Time{}, &v1.Platform{OS: "linux"})
+	if err == nil {
+		t.Fatal("walkRecursive() = nil, wanted ENOSPC")
+	}
+
+	err = WrapNoSpace(err, kodataRoot)
+	var nse *NoSpaceError
+	if !errors.As(err, &nse) {
+		t.Fatalf("WrapNoSpace() = %T(%v), wanted *NoSpaceError", err, err)
+	}
+	if nse.Path != kodataRoot {
+		t.Errorf("Path = %q, wanted %q", nse.Path, kodataRoot)
+	}
+	if !IsNoSpace(err) {
+		t.Error("IsNoSpace() = false, wanted true")
+	}
+}
+
+func TestWrapNoSpacePassesThroughOtherErrors(t *testing.T) {
+	if err := WrapNoSpace(nil, "foo"); err != nil {
+		t.Errorf("WrapNoSpace(nil) = %v", err)
+	}
+	want := errors.New("something else")
+	if got := WrapNoSpace(want, "foo"); got != want {
+		t.Errorf("WrapNoSpace() = %v, wanted %v", got, want)
+	}
+}
+
+func TestWriteFileAtomically(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.tar")
+
+	err = WriteFileAtomically(path, func(w io.Writer) error {
+		_, err := (&fullDisk{w: w, n: 10}).Write(make([]byte, 100))
+		return err
+	})
+	if !IsNoSpace(err) {
+		t.Fatalf("WriteFileAtomically() = %v, wanted no space error", err)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("found leftover files after failed write: %v", entries[0].Name())
+	}
+
+	if err := WriteFileAtomically(path, func(w io.Writer) error {
+		_, err := w.Write([]byte("hello"))
+		return err
+	}); err != nil {
+		t.Fatalf("WriteFileAtomically() = %v", err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("got %q, wanted %q", b, "hello")
+	}
+
+	// New files get the same mode as os.Create would give them.
+	f, err := os.Create(filepath.Join(dir, "created"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	assertMode(t, f.Name(), path)
+
+	// Existing files keep their mode.
+	if err := os.Chmod(path, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomically(path, func(w io.Writer) error {
+		_, err := w.Write([]byte("hello again"))
+		return err
+	}); err != nil {
+		t.Fatalf("WriteFileAtomically() = %v", err)
+	}
+	if err := os.Chmod(f.Name(), 0640); err != nil {
+		t.Fatal(err)
+	}
+	assertMode(t, f.Name(), path)
+}
+
+func assertMode(t *testing.T, want, got string) {
+	t.Helper()
+	wfi, err := os.Stat(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gfi, err := os.Stat(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wfi.Mode() != gfi.Mode() {
+		t.Errorf("mode of %s = %v, wanted %v", got, gfi.Mode(), wfi.Mode())
+	}
+}
+
+func TestCheckFreeSpace(t *testing.T) {
+	if err := checkFreeSpace(os.TempDir(), 0); err != nil {
+		t.Errorf("checkFreeSpace(0) = %v", err)
+	}
+	if _, err := freeSpace(os.TempDir()); err != nil {
+		t.Skipf("free space not supported: %v", err)
+	}
+	err := checkFreeSpace(os.TempDir(), 1<<62)
+	var nse *NoSpaceError
+	if !errors.As(err, &nse) {
+		t.Fatalf("checkFreeSpace() = %v, wanted *NoSpaceError", err)
+	}
+	if nse.Required != 1<<62 || nse.Filesystem == "" {
+		t.Errorf("unexpected error details: %+v", nse)
+	}
+}
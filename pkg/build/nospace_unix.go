@@ -0,0 +1,66 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux || darwin
+// +build linux darwin
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// freeSpace returns the number of bytes available to unprivileged users on
+// the filesystem containing path.
+func freeSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil //nolint: unconvert // Types differ across platforms.
+}
+
+// mountPoint walks up from path until the device changes, which gives us
+// the root of the filesystem containing path.
+func mountPoint(path string) string {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return ""
+	}
+	// The path we were writing may not exist (yet), so start from the
+	// closest ancestor that does.
+	fi, err := os.Stat(path)
+	for err != nil {
+		parent := filepath.Dir(path)
+		if parent == path {
+			return ""
+		}
+		path = parent
+		fi, err = os.Stat(path)
+	}
+	dev := fi.Sys().(*syscall.Stat_t).Dev
+	for {
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		pfi, err := os.Stat(parent)
+		if err != nil || pfi.Sys().(*syscall.Stat_t).Dev != dev {
+			return path
+		}
+		path = parent
+	}
+}
@@ -15,6 +15,12 @@
 package build
 
 import (
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 )
 
@@ -28,7 +34,7 @@ func WithBaseImages(gb GetBase) Option {
 }
 
 // WithCreationTime is a functional option for overriding the creation
-// time given to images.
+// time given to images, and to the history and files of the layers ko adds.
 func WithCreationTime(t v1.Time) Option {
 	return func(gbo *gobuildOpener) error {
 		gbo.creationTime = t
@@ -54,14 +60,283 @@ func WithDisabledOptimizations() Option {
 	}
 }
 
+// WithTrimpath is a functional option for choosing whether binaries are
+// built with -trimpath (the default), which removes local file system paths
+// from them. Without it, stack traces and debuggers see the real paths of
+// the source, and any -trimpath configured for an importpath is dropped.
+func WithTrimpath(trimpath bool) Option {
+	return func(gbo *gobuildOpener) error {
+		gbo.disableTrimpath = !trimpath
+		return nil
+	}
+}
+
+// WithBuildVCS is a functional option for passing -buildvcs (Go 1.18+) to
+// every `go build` invocation: "true" stamps the binary with version control
+// information and fails if it can't, "false" never stamps it, and "auto"
+// stamps it when possible. The empty string leaves it to the go tool. The
+// information only depends on the commit (and whether the tree is modified),
+// so images stay reproducible.
+func WithBuildVCS(mode string) Option {
+	return func(gbo *gobuildOpener) error {
+		switch mode {
+		case "", "true", "false", "auto":
+		default:
+			return fmt.Errorf("invalid buildvcs %q, expected true, false or auto", mode)
+		}
+		gbo.buildVCS = mode
+		return nil
+	}
+}
+
+// WithGoBinary is a functional option for running the given go binary, e.g.
+// go1.21rc2 or /usr/local/go1.20/bin/go, instead of go on PATH. NewGo fails
+// if it can't be run. Builds configured with their own GoBinary use that.
+func WithGoBinary(goBinary string) Option {
+	return func(gbo *gobuildOpener) error {
+		gbo.goBinary = goBinary
+		return nil
+	}
+}
+
+// WithPrebuild is a functional option for running a command (the first
+// element of hook, with the rest as its arguments) in the module directory
+// before building each importpath, e.g. to generate code. The importpath is
+// passed in KO_IMPORTPATH, and the build fails if the hook does. Builds
+// configured with their own Prebuild run that instead.
+func WithPrebuild(hook []string) Option {
+	return func(gbo *gobuildOpener) error {
+		gbo.prebuild = hook
+		return nil
+	}
+}
+
+// WithMaxBinarySize is a functional option for failing builds whose binary
+// is larger than size, a human-readable size like "20MB", to catch
+// dependencies bloating binaries. Builds configured with their own
+// MaxBinarySize use that instead.
+func WithMaxBinarySize(size string) Option {
+	return func(gbo *gobuildOpener) error {
+		if _, err := ParseByteSize(size); err != nil {
+			return fmt.Errorf("invalid maxBinarySize: %v", err)
+		}
+		gbo.maxBinarySize = size
+		return nil
+	}
+}
+
+// WithCgo is a functional option for building with CGO_ENABLED=1, for
+// binaries that link against C libraries. CC and CXX are passed through from
+// the environment, and must name a cross compiler when building for another
+// platform. Note that such binaries need a base image with a C library.
+func WithCgo(cgo bool) Option {
+	return func(gbo *gobuildOpener) error {
+		gbo.cgo = cgo
+		return nil
+	}
+}
+
+// WithBinaryCollision is a functional option for choosing what happens when
+// two importpaths would use the same binary name in a combined image.
+func WithBinaryCollision(policy BinaryCollisionPolicy) Option {
+	return func(gbo *gobuildOpener) error {
+		switch policy {
+		case "", BinaryCollisionError, BinaryCollisionSuffix:
+		default:
+			return fmt.Errorf("unknown binary collision policy %q, expected %q or %q",
+				policy, BinaryCollisionError, BinaryCollisionSuffix)
+		}
+		gbo.binaryCollision = policy
+		return nil
+	}
+}
+
+// WithWasmPackaging is a functional option for choosing how modules built
+// for --platform=wasip1/wasm are published.
+func WithWasmPackaging(packaging WasmPackaging) Option {
+	return func(gbo *gobuildOpener) error {
+		switch packaging {
+		case "", WasmArtifact, WasmImage:
+		default:
+			return fmt.Errorf("unknown wasm packaging %q, expected %q or %q",
+				packaging, WasmArtifact, WasmImage)
+		}
+		gbo.wasmPackaging = packaging
+		return nil
+	}
+}
+
+// WithBasePlatformPolicy is a functional option for choosing what happens
+// when a base image doesn't provide a platform that's built for.
+func WithBasePlatformPolicy(policy BasePlatformPolicy) Option {
+	return func(gbo *gobuildOpener) error {
+		switch policy {
+		case "", BasePlatformStrict, BasePlatformEmulate:
+		default:
+			return fmt.Errorf("unknown base platform policy %q, expected %q or %q",
+				policy, BasePlatformStrict, BasePlatformEmulate)
+		}
+		gbo.basePlatformPolicy = policy
+		return nil
+	}
+}
+
+// WithMutableVersions is a functional option for allowing external
+// importpaths (see ExternalImportPath) at versions that can move, like
+// branch names or "latest".
+func WithMutableVersions(allow bool) Option {
+	return func(gbo *gobuildOpener) error {
+		gbo.allowMutableVersions = allow
+		return nil
+	}
+}
+
 // WithConfig is a functional option for providing GoReleaser Build influenced
 // build settings for importpaths.
 //
 // Set a fully qualified importpath (e.g. github.com/my-user/my-repo/cmd/app)
-// as the mapping key for the respective Config.
+// as the mapping key for the respective Config. Keys may also be importpath
+// patterns (e.g. github.com/my-user/my-repo/cmd/...), or DefaultConfigKey,
+// see NewConfigResolver for the precedence rules.
 func WithConfig(buildConfigs map[string]Config) Option {
+	return WithConfigResolver(NewConfigResolver(buildConfigs))
+}
+
+// WithConfigResolver is a functional option for providing a function that
+// determines the build settings (e.g. ldflags) for each importpath at
+// Build time.
+func WithConfigResolver(resolve ConfigResolver) Option {
+	return func(gbo *gobuildOpener) error {
+		gbo.resolveConfig = resolve
+		return nil
+	}
+}
+
+// WithLdflags is a functional option for passing additional linker flags
+// (e.g. "-X main.version=v1.2.3") to every `go build` invocation. Each
+// flag may use Go template syntax to reference environment variables,
+// e.g. "-X main.commit={{.Env.GIT_SHA}}".
+func WithLdflags(ldflags []string) Option {
+	return func(gbo *gobuildOpener) error {
+		gbo.ldflags = append(gbo.ldflags, ldflags...)
+		return nil
+	}
+}
+
+// WithGcflags is a functional option for passing additional -gcflags (e.g.
+// "all=-N -l" or "example.com/pkg=-m") to every `go build` invocation, after
+// any configured for the importpath. Each is passed as a separate -gcflags
+// argument. These take precedence over WithDisabledOptimizations.
+func WithGcflags(gcflags []string) Option {
 	return func(gbo *gobuildOpener) error {
-		gbo.buildConfigs = buildConfigs
+		gbo.gcflags = append(gbo.gcflags, gcflags...)
+		return nil
+	}
+}
+
+// WithAsmflags is a functional option for passing additional -asmflags to
+// every `go build` invocation, like WithGcflags.
+func WithAsmflags(asmflags []string) Option {
+	return func(gbo *gobuildOpener) error {
+		gbo.asmflags = append(gbo.asmflags, asmflags...)
+		return nil
+	}
+}
+
+// WithEnv is a functional option for setting environment variables (e.g.
+// "GOFLAGS=-mod=vendor" or "GOPRIVATE=example.com") for every `go build`
+// invocation. These are layered on top of the inherited environment, and
+// later values override earlier ones. Env configured for an importpath
+// still takes precedence. Since ko sets GOOS, GOARCH and GOARM from the
+// platform being built, those are rejected.
+func WithEnv(env []string) Option {
+	return func(gbo *gobuildOpener) error {
+		for _, kv := range env {
+			k := strings.SplitN(kv, "=", 2)[0]
+			if !strings.Contains(kv, "=") || k == "" {
+				return fmt.Errorf("invalid environment variable %q, expected KEY=VALUE", kv)
+			}
+			switch k {
+			case "GOOS", "GOARCH", "GOARM":
+				return fmt.Errorf("cannot set %s in the build environment, use --platform instead", k)
+			}
+		}
+		gbo.env = append(gbo.env, env...)
+		return nil
+	}
+}
+
+// WithModuleConfig is a functional option for setting where every `go build`
+// downloads modules from, and how it authenticates them, rather than leaving
+// it to the inherited environment. It wins over WithEnv, but not over env
+// configured for an importpath. Builds with -mod=vendor never download
+// anything, whatever the config.
+func WithModuleConfig(mc ModuleConfig) Option {
+	return func(gbo *gobuildOpener) error {
+		if err := mc.validate(); err != nil {
+			return err
+		}
+		gbo.moduleEnv = mc.Env()
+		return nil
+	}
+}
+
+// WithSBOM is a functional option for generating an SBOM in format of each
+// image built, listing the Go modules compiled into its binaries, as `go
+// version -m` reports them, and recording it in sboms by the image's digest.
+// Publishers that push to a registry attach the SBOMs in sboms to the images.
+func WithSBOM(format SBOMFormat, sboms *SBOMs) Option {
+	return func(gbo *gobuildOpener) error {
+		switch format {
+		case SBOMSPDX, SBOMCycloneDX:
+		default:
+			return fmt.Errorf("unknown SBOM format %q, expected %s or %s", format, SBOMSPDX, SBOMCycloneDX)
+		}
+		if sboms == nil {
+			return errors.New("WithSBOM needs SBOMs to record the SBOMs in")
+		}
+		gbo.sbom = format
+		gbo.sboms = sboms
+		return nil
+	}
+}
+
+// WithGoFlags is a functional option for passing additional flags (e.g.
+// "-mod=vendor" or "-gcflags=all=-N -l") to every `go build` invocation,
+// after any configured for the importpath. Since ko controls where the
+// binary is written, and which directory it's built in, -o and -C are
+// rejected. -tags is rejected too, since a second -tags would replace the
+// tags from WithTags and the config, so use WithTags instead.
+func WithGoFlags(flags []string) Option {
+	return func(gbo *gobuildOpener) error {
+		for _, f := range flags {
+			if !strings.HasPrefix(f, "-") {
+				continue
+			}
+			switch name := strings.TrimLeft(strings.SplitN(f, "=", 2)[0], "-"); name {
+			case "o", "C":
+				return fmt.Errorf("go build flag %q is not supported, ko sets -%s itself", f, name)
+			case "tags":
+				return fmt.Errorf("go build flag %q is not supported, use --go-tags instead", f)
+			}
+		}
+		gbo.goFlags = append(gbo.goFlags, flags...)
+		return nil
+	}
+}
+
+// WithTags is a functional option for building with the given build tags
+// (e.g. "netgo"). Each tag may itself be a comma-separated list. These are
+// added to any -tags configured for an importpath.
+func WithTags(tags []string) Option {
+	return func(gbo *gobuildOpener) error {
+		for _, t := range tags {
+			for _, tag := range strings.Split(t, ",") {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					gbo.tags = append(gbo.tags, tag)
+				}
+			}
+		}
 		return nil
 	}
 }
@@ -79,13 +354,63 @@ func WithPlatforms(platforms string) Option {
 	}
 }
 
-// WithLabel is a functional option for adding labels to built images.
+// WithLabel is a functional option for adding labels to built images. See
+// WithLabels for the templates the value may use.
 func WithLabel(k, v string) Option {
+	return WithLabels(map[string]string{k: v})
+}
+
+// WithLabels is a functional option for adding labels to the config of built
+// images, e.g. org.opencontainers.image.source. Values are Go templates,
+// expanded for each image, that may use {{.ImportPath}}, the importpath of
+// its main package, {{.GitCommit}}, the commit checked out in the module's
+// git repository, and {{.Env.NAME}}, environment variables.
+func WithLabels(labels map[string]string) Option {
 	return func(gbo *gobuildOpener) error {
 		if gbo.labels == nil {
 			gbo.labels = map[string]string{}
 		}
-		gbo.labels[k] = v
+		for k, v := range labels {
+			if _, err := template.New(k).Parse(v); err != nil {
+				return fmt.Errorf("label %s: %v", k, err)
+			}
+			gbo.labels[k] = v
+		}
+		return nil
+	}
+}
+
+// WithImageEnv is a functional option for setting environment variables
+// (KEY=VALUE) in the config of built images. They win over the base image's
+// env, and the PATH and KO_DATA_PATH that ko sets. Setting a variable more
+// than once is rejected.
+func WithImageEnv(env []string) Option {
+	return func(gbo *gobuildOpener) error {
+		seen := make(map[string]bool, len(gbo.imageEnv)+len(env))
+		for _, kv := range gbo.imageEnv {
+			seen[envKey(kv)] = true
+		}
+		for _, kv := range env {
+			k := envKey(kv)
+			if !strings.Contains(kv, "=") || k == "" {
+				return fmt.Errorf("invalid image environment variable %q, expected KEY=VALUE", kv)
+			}
+			if seen[k] {
+				return fmt.Errorf("image environment variable %s is set more than once", k)
+			}
+			seen[k] = true
+			gbo.imageEnv = append(gbo.imageEnv, kv)
+		}
+		return nil
+	}
+}
+
+// WithMinFreeSpace is a functional option for requiring at least the given
+// number of free bytes in the temporary directory before each build, and
+// again before tarring each layer. Zero disables the check.
+func WithMinFreeSpace(bytes uint64) Option {
+	return func(gbo *gobuildOpener) error {
+		gbo.minFreeSpace = bytes
 		return nil
 	}
 }
@@ -99,6 +424,27 @@ func withBuilder(b builder) Option {
 	}
 }
 
+// WithBuildTimeout is a functional option for failing each build that takes
+// longer than d. Zero means no timeout.
+func WithBuildTimeout(d time.Duration) Option {
+	return func(gbo *gobuildOpener) error {
+		if d < 0 {
+			return fmt.Errorf("build timeout must not be negative, got %s", d)
+		}
+		gbo.buildTimeout = d
+		return nil
+	}
+}
+
+// WithProgress is a functional option for reporting the steps of building
+// each platform of an index to p.
+func WithProgress(p Progress) Option {
+	return func(gbo *gobuildOpener) error {
+		gbo.progress = p
+		return nil
+	}
+}
+
 // withModulePath is a functional option for overriding the module path for
 // the current ko invocation.
 // This is exposed for testing.
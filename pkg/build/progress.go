@@ -0,0 +1,154 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// ProgressKind is the step of a build that a ProgressEvent reports.
+type ProgressKind string
+
+const (
+	// ProgressQueued is for builds waiting for the Limiter.
+	ProgressQueued ProgressKind = "queued"
+	// ProgressStarted is for the start of building an importpath for a
+	// platform of an index.
+	ProgressStarted ProgressKind = "start"
+	// ProgressCompiled is for a binary compiled for a platform, in
+	// Duration.
+	ProgressCompiled ProgressKind = "compiled"
+	// ProgressLayer is for a binary layer built for a platform, with
+	// Digest.
+	ProgressLayer ProgressKind = "layer"
+	// ProgressBuilt is for the image built for a platform, with Digest and
+	// Size.
+	ProgressBuilt ProgressKind = "built"
+	// ProgressIndexBuilt is for the index of the images built for each
+	// platform, with Digest and Size.
+	ProgressIndexBuilt ProgressKind = "index"
+)
+
+// ProgressEvent is a step of building an importpath, and for steps of
+// building an index, of building it for one of its platforms.
+type ProgressEvent struct {
+	Kind       ProgressKind
+	ImportPath string
+	Platform   string
+
+	Duration time.Duration
+	Digest   v1.Hash
+	// Size is the total size of the image or index's manifests, configs
+	// and layers, counting each blob once.
+	Size int64
+}
+
+// Progress is told about the steps of builds as they happen. Builds run
+// concurrently, so Report must be safe to call from several goroutines.
+type Progress interface {
+	Report(ProgressEvent)
+}
+
+// NewPlainProgress returns a Progress that writes a line to w for each
+// event, and a table of the images in each index once it's built.
+func NewPlainProgress(w io.Writer) Progress {
+	return &plainProgress{w: w, built: map[string][]ProgressEvent{}}
+}
+
+type plainProgress struct {
+	// m serializes writes, so that the lines of concurrent builds don't
+	// interleave.
+	m     sync.Mutex
+	w     io.Writer
+	built map[string][]ProgressEvent
+}
+
+// Report implements Progress
+func (p *plainProgress) Report(e ProgressEvent) {
+	ip := strings.TrimPrefix(e.ImportPath, StrictScheme)
+	var buf bytes.Buffer
+	switch e.Kind {
+	case ProgressQueued:
+		fmt.Fprintf(&buf, "%s: waiting for a build slot\n", ip)
+	case ProgressStarted:
+		fmt.Fprintf(&buf, "%s %s: start\n", ip, e.Platform)
+	case ProgressCompiled:
+		fmt.Fprintf(&buf, "%s %s: compiled in %s\n", ip, e.Platform, e.Duration.Round(time.Millisecond))
+	case ProgressLayer:
+		fmt.Fprintf(&buf, "%s %s: layer %s\n", ip, e.Platform, e.Digest)
+	case ProgressBuilt:
+		fmt.Fprintf(&buf, "%s %s: image %s\n", ip, e.Platform, e.Digest)
+	case ProgressIndexBuilt:
+		fmt.Fprintf(&buf, "%s: index %s, %d bytes\n", ip, e.Digest, e.Size)
+	default:
+		return
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+	if e.Kind == ProgressBuilt {
+		p.built[e.ImportPath] = append(p.built[e.ImportPath], e)
+	}
+	if e.Kind == ProgressIndexBuilt {
+		tw := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "  PLATFORM\tDIGEST\tSIZE")
+		for _, b := range p.built[e.ImportPath] {
+			fmt.Fprintf(tw, "  %s\t%s\t%d\n", b.Platform, b.Digest, b.Size)
+		}
+		tw.Flush()
+		delete(p.built, e.ImportPath)
+	}
+	p.w.Write(buf.Bytes())
+}
+
+// blobSizes adds the sizes of the manifest, config and layers of img to
+// sizes, by digest.
+func blobSizes(img v1.Image, sizes map[v1.Hash]int64) error {
+	raw, err := img.RawManifest()
+	if err != nil {
+		return err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	sizes[digest] = int64(len(raw))
+	m, err := img.Manifest()
+	if err != nil {
+		return err
+	}
+	sizes[m.Config.Digest] = m.Config.Size
+	for _, l := range m.Layers {
+		sizes[l.Digest] = l.Size
+	}
+	return nil
+}
+
+// totalSize returns the sum of sizes.
+func totalSize(sizes map[v1.Hash]int64) int64 {
+	var total int64
+	for _, n := range sizes {
+		total += n
+	}
+	return total
+}
@@ -0,0 +1,55 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestPlainProgress(t *testing.T) {
+	var buf bytes.Buffer
+	p := NewPlainProgress(&buf)
+	ip := StrictScheme + "example.com/cmd/app"
+	amd, arm := v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("a", 64)}, v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("b", 64)}
+	idx := v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("c", 64)}
+	for _, e := range []ProgressEvent{
+		{Kind: ProgressQueued, ImportPath: ip},
+		{Kind: ProgressStarted, ImportPath: ip, Platform: "linux/amd64"},
+		{Kind: ProgressCompiled, ImportPath: ip, Platform: "linux/amd64", Duration: 1234567 * time.Microsecond},
+		{Kind: ProgressBuilt, ImportPath: ip, Platform: "linux/amd64", Digest: amd, Size: 100},
+		{Kind: ProgressBuilt, ImportPath: ip, Platform: "linux/arm64", Digest: arm, Size: 2000},
+		{Kind: ProgressIndexBuilt, ImportPath: ip, Digest: idx, Size: 2500},
+	} {
+		p.Report(e)
+	}
+	want := `example.com/cmd/app: waiting for a build slot
+example.com/cmd/app linux/amd64: start
+example.com/cmd/app linux/amd64: compiled in 1.235s
+example.com/cmd/app linux/amd64: image ` + amd.String() + `
+example.com/cmd/app linux/arm64: image ` + arm.String() + `
+example.com/cmd/app: index ` + idx.String() + `, 2500 bytes
+  PLATFORM     DIGEST                                                                   SIZE
+  linux/amd64  ` + amd.String() + `  100
+  linux/arm64  ` + arm.String() + `  2000
+`
+	if got := buf.String(); got != want {
+		t.Errorf("Report() wrote:\n%s\nwanted:\n%s", got, want)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	gb "go/build"
+	"regexp"
+	"strings"
+)
+
+// Restricted composes with another Interface to only build the import paths
+// that match one of a set of patterns, e.g. so that a CI job can only build
+// its team's import paths, whatever its manifests reference.
+type Restricted struct {
+	Builder  Interface
+	patterns []string
+	res      []*regexp.Regexp
+}
+
+// Restricted implements Interface
+var _ Interface = (*Restricted)(nil)
+
+// NewRestricted returns a new builder that only builds the import paths of
+// b that match one of patterns (see MatchImportPath).
+func NewRestricted(b Interface, patterns []string) (*Restricted, error) {
+	if len(patterns) == 0 {
+		return nil, errors.New("no import paths are allowed")
+	}
+	r := &Restricted{Builder: b, patterns: patterns}
+	for _, p := range patterns {
+		re, err := importPathPattern(p)
+		if err != nil {
+			return nil, err
+		}
+		r.res = append(r.res, re)
+	}
+	return r, nil
+}
+
+// NotAllowedError is the error for a reference to ImportPath, which matches
+// none of the allowed Patterns.
+type NotAllowedError struct {
+	ImportPath string
+	Patterns   []string
+}
+
+func (e *NotAllowedError) Error() string {
+	return fmt.Sprintf("import path %s is not allowed, it matches none of: %s", e.ImportPath, strings.Join(e.Patterns, ", "))
+}
+
+// check returns a NotAllowedError if any import path that s references is
+// not allowed: each of a combined image's, local ones once qualified, and
+// external ones without their version.
+func (r *Restricted) check(s string) error {
+	ips, ok := MultiImportPaths(s)
+	if !ok {
+		ips = []string{strings.TrimPrefix(s, StrictScheme)}
+	}
+	for _, ip := range ips {
+		if gb.IsLocalImport(ip) {
+			qualified, err := r.Builder.QualifyImport(ip)
+			if err != nil {
+				return err
+			}
+			ip = strings.TrimPrefix(qualified, StrictScheme)
+		}
+		if base, _, ok := ExternalImportPath(StrictScheme + ip); ok {
+			ip = base
+		}
+		if !r.allowed(ip) {
+			return &NotAllowedError{ImportPath: ip, Patterns: r.patterns}
+		}
+	}
+	return nil
+}
+
+func (r *Restricted) allowed(ip string) bool {
+	for _, re := range r.res {
+		if re.MatchString(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// QualifyImport implements Interface
+func (r *Restricted) QualifyImport(ip string) (string, error) {
+	return r.Builder.QualifyImport(ip)
+}
+
+// IsSupportedReference implements Interface
+func (r *Restricted) IsSupportedReference(ip string) error {
+	if err := r.check(ip); err != nil {
+		return err
+	}
+	return r.Builder.IsSupportedReference(ip)
+}
+
+// Build implements Interface
+func (r *Restricted) Build(ctx context.Context, ip string) (Result, error) {
+	if err := r.check(ip); err != nil {
+		return nil, err
+	}
+	return r.Builder.Build(ctx, ip)
+}
+
+// MatchImportPath reports whether the import path ip matches pattern, which
+// is an import path in which, like in go tool package patterns, "..."
+// matches any string, including an empty one and slashes, so that
+// "example.com/team/..." matches example.com/team and every import path
+// under it, and "*" matches any string without slashes, and "?" any single
+// character but a slash.
+func MatchImportPath(pattern, ip string) (bool, error) {
+	re, err := importPathPattern(pattern)
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(ip), nil
+}
+
+func importPathPattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" || strings.HasPrefix(pattern, ".") || strings.HasPrefix(pattern, "/") || strings.HasPrefix(pattern, StrictScheme) {
+		return nil, fmt.Errorf("invalid import path pattern %q: must be a fully qualified import path", pattern)
+	}
+	var b strings.Builder
+	b.WriteString("^")
+	rest := pattern
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, "/..."):
+			// Like the go tool, x/... matches x too.
+			b.WriteString("(/.*)?")
+			rest = rest[len("/..."):]
+		case strings.HasPrefix(rest, "..."):
+			b.WriteString(".*")
+			rest = rest[len("..."):]
+		case rest[0] == '*':
+			b.WriteString("[^/]*")
+			rest = rest[1:]
+		case rest[0] == '?':
+			b.WriteString("[^/]")
+			rest = rest[1:]
+		default:
+			i := strings.IndexAny(rest[1:], "*?/.") + 1
+			if i == 0 {
+				i = len(rest)
+			}
+			b.WriteString(regexp.QuoteMeta(rest[:i]))
+			rest = rest[i:]
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
@@ -0,0 +1,149 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMatchImportPath(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		ip      string
+		want    bool
+	}{
+		{"github.com/org/team-a/...", "github.com/org/team-a", true},
+		{"github.com/org/team-a/...", "github.com/org/team-a/cmd/app", true},
+		{"github.com/org/team-a/...", "github.com/org/team-ab/cmd/app", false},
+		{"github.com/org/team-a/...", "github.com/org/team-b/cmd/app", false},
+		{"github.com/org/team-.../cmd/app", "github.com/org/team-b/cmd/app", true},
+		{"github.com/org/*/cmd/app", "github.com/org/team-a/cmd/app", true},
+		{"github.com/org/*/cmd/app", "github.com/org/team-a/x/cmd/app", false},
+		{"github.com/org/team-?/cmd/app", "github.com/org/team-a/cmd/app", true},
+		{"github.com/org/team-?/cmd/app", "github.com/org/team-ab/cmd/app", false},
+		{"github.com/org/team.a/cmd/app", "github.com/org/teamxa/cmd/app", false},
+		{"github.com/org/team-a/cmd/app", "github.com/org/team-a/cmd/app", true},
+		{"github.com/org/team-a/cmd/app", "github.com/org/team-a/cmd/app2", false},
+	} {
+		got, err := MatchImportPath(tc.pattern, tc.ip)
+		if err != nil {
+			t.Fatalf("MatchImportPath(%q, %q) = %v", tc.pattern, tc.ip, err)
+		}
+		if got != tc.want {
+			t.Errorf("MatchImportPath(%q, %q) = %v, want %v", tc.pattern, tc.ip, got, tc.want)
+		}
+	}
+}
+
+func TestNewRestrictedValidation(t *testing.T) {
+	for _, patterns := range [][]string{
+		nil,
+		{""},
+		{"./cmd/..."},
+		{"/abs/path"},
+		{"ko://github.com/org/..."},
+	} {
+		if _, err := NewRestricted(&fake{}, patterns); err == nil {
+			t.Errorf("NewRestricted(%q) = nil, wanted error", patterns)
+		}
+	}
+}
+
+func TestRestricted(t *testing.T) {
+	patterns := []string{"github.com/org/team-a/...", "github.com/org/shared/cmd/*"}
+	for _, tc := range []struct {
+		name    string
+		ref     string
+		allowed bool
+		denied  string
+	}{{
+		name:    "allowed",
+		ref:     "ko://github.com/org/team-a/cmd/app",
+		allowed: true,
+	}, {
+		name:    "allowed by second pattern",
+		ref:     "ko://github.com/org/shared/cmd/tool",
+		allowed: true,
+	}, {
+		name:   "denied",
+		ref:    "ko://github.com/org/team-b/cmd/app",
+		denied: "github.com/org/team-b/cmd/app",
+	}, {
+		name:    "external version allowed",
+		ref:     "ko://github.com/org/team-a/cmd/app@v1.2.3",
+		allowed: true,
+	}, {
+		name:   "external version denied",
+		ref:    "ko://github.com/org/team-b/cmd/app@v1.2.3",
+		denied: "github.com/org/team-b/cmd/app",
+	}, {
+		name:    "combined allowed",
+		ref:     "ko://multi:github.com/org/team-a/cmd/app,github.com/org/shared/cmd/tool",
+		allowed: true,
+	}, {
+		name:   "combined with one denied",
+		ref:    "ko://multi:github.com/org/team-a/cmd/app,github.com/org/team-b/cmd/app@v1.2.3",
+		denied: "github.com/org/team-b/cmd/app",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			var checked, built []string
+			inner := &fake{
+				isr: func(ip string) error {
+					checked = append(checked, ip)
+					return nil
+				},
+				b: func(ip string) (Result, error) {
+					built = append(built, ip)
+					return nil, nil
+				},
+			}
+			r, err := NewRestricted(inner, patterns)
+			if err != nil {
+				t.Fatalf("NewRestricted() = %v", err)
+			}
+
+			isrErr := r.IsSupportedReference(tc.ref)
+			_, buildErr := r.Build(context.Background(), tc.ref)
+			if tc.allowed {
+				if isrErr != nil || buildErr != nil {
+					t.Fatalf("IsSupportedReference() = %v, Build() = %v", isrErr, buildErr)
+				}
+				if diff := cmp.Diff([]string{tc.ref}, built); diff != "" {
+					t.Errorf("built (-want +got): %s", diff)
+				}
+				return
+			}
+			for _, err := range []error{isrErr, buildErr} {
+				var nae *NotAllowedError
+				if !errors.As(err, &nae) {
+					t.Fatalf("got %v, wanted NotAllowedError", err)
+				}
+				if nae.ImportPath != tc.denied {
+					t.Errorf("ImportPath = %s, wanted %s", nae.ImportPath, tc.denied)
+				}
+				if diff := cmp.Diff(patterns, nae.Patterns); diff != "" {
+					t.Errorf("Patterns (-want +got): %s", diff)
+				}
+			}
+			if len(checked) != 0 || len(built) != 0 {
+				t.Errorf("inner builder called with %v and %v, wanted neither", checked, built)
+			}
+		})
+	}
+}
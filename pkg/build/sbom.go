@@ -0,0 +1,375 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// SBOMFormat is the format of the SBOMs generated for images, see WithSBOM.
+type SBOMFormat string
+
+const (
+	// SBOMSPDX is SPDX 2.3, in JSON.
+	SBOMSPDX SBOMFormat = "spdx"
+	// SBOMCycloneDX is CycloneDX 1.4, in JSON.
+	SBOMCycloneDX SBOMFormat = "cyclonedx"
+)
+
+// MediaType returns the media type of SBOMs in f, as `cosign attach sbom`
+// uploads them.
+func (f SBOMFormat) MediaType() types.MediaType {
+	switch f {
+	case SBOMSPDX:
+		return "text/spdx+json"
+	case SBOMCycloneDX:
+		return "application/vnd.cyclonedx+json"
+	}
+	return ""
+}
+
+// goModule is a module compiled into a binary, as `go version -m` reports.
+type goModule struct {
+	Path, Version, Sum string
+}
+
+// binaryModules are the Go toolchain and modules a binary was built with.
+type binaryModules struct {
+	GoVersion string
+	Main      goModule
+	Deps      []goModule
+}
+
+// readModules returns the modules compiled into the binary file, from the
+// build info the go tool embeds in it.
+func readModules(ctx context.Context, goBinary, file string) (*binaryModules, error) {
+	out, err := goCommand(ctx, goBinary, "", nil, "version", "-m", file)
+	if err != nil {
+		return nil, fmt.Errorf("reading the modules of %s: %v", file, err)
+	}
+	return parseModules(out)
+}
+
+// parseModules parses the output of `go version -m` for a single binary.
+func parseModules(out string) (*binaryModules, error) {
+	bm := &binaryModules{}
+	lines := strings.Split(out, "\n")
+	if i := strings.LastIndex(lines[0], ": "); i >= 0 {
+		bm.GoVersion = strings.TrimSpace(lines[0][i+2:])
+	}
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		m := goModule{Path: fields[1]}
+		if len(fields) > 2 {
+			m.Version = fields[2]
+		}
+		if len(fields) > 3 {
+			m.Sum = fields[3]
+		}
+		switch fields[0] {
+		case "mod":
+			bm.Main = m
+		case "dep":
+			bm.Deps = append(bm.Deps, m)
+		case "=>":
+			// The replacement of the preceding module is what's compiled.
+			if n := len(bm.Deps); n > 0 {
+				bm.Deps[n-1] = m
+			} else {
+				bm.Main = m
+			}
+		}
+	}
+	if bm.Main.Path == "" {
+		return nil, fmt.Errorf("no module information in %q", lines[0])
+	}
+	return bm, nil
+}
+
+// purl returns the package URL of m.
+func (m goModule) purl() string {
+	if m.Version == "" {
+		return "pkg:golang/" + m.Path
+	}
+	return "pkg:golang/" + m.Path + "@" + m.Version
+}
+
+// generateSBOM returns the SBOM in format f of the image ref, whose
+// binaries were built with bins. It's created at created, e.g. the
+// --creation-time of the image, so that it's reproducible.
+func generateSBOM(f SBOMFormat, ref string, created v1.Time, bins []*binaryModules) ([]byte, error) {
+	t := created.Time
+	if t.IsZero() {
+		t = time.Unix(0, 0)
+	}
+	timestamp := t.UTC().Format(time.RFC3339)
+	switch f {
+	case SBOMSPDX:
+		return spdxSBOM(ref, timestamp, bins)
+	case SBOMCycloneDX:
+		return cycloneDXSBOM(ref, timestamp, bins)
+	}
+	return nil, fmt.Errorf("unknown SBOM format %q, expected %s or %s", f, SBOMSPDX, SBOMCycloneDX)
+}
+
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	SPDXID           string            `json:"SPDXID"`
+	Name             string            `json:"name"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	LicenseConcluded string            `json:"licenseConcluded"`
+	LicenseDeclared  string            `json:"licenseDeclared"`
+	CopyrightText    string            `json:"copyrightText"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+func spdxSBOM(ref, timestamp string, bins []*binaryModules) ([]byte, error) {
+	doc := spdxDocument{
+		SPDXVersion: "SPDX-2.3",
+		DataLicense: "CC0-1.0",
+		SPDXID:      "SPDXRef-DOCUMENT",
+		Name:        ref,
+		CreationInfo: spdxCreationInfo{
+			Created:  timestamp,
+			Creators: []string{"Tool: ko"},
+		},
+	}
+	// Modules shared by the binaries are listed once.
+	ids := map[goModule]string{}
+	pkg := func(m goModule) string {
+		if id, ok := ids[m]; ok {
+			return id
+		}
+		id := fmt.Sprintf("SPDXRef-Package-%d", len(ids))
+		ids[m] = id
+		doc.Packages = append(doc.Packages, spdxPackage{
+			SPDXID:           id,
+			Name:             m.Path,
+			VersionInfo:      m.Version,
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  "NOASSERTION",
+			CopyrightText:    "NOASSERTION",
+			ExternalRefs: []spdxExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  m.purl(),
+			}},
+		})
+		return id
+	}
+	for _, bm := range bins {
+		main := pkg(bm.Main)
+		doc.Relationships = append(doc.Relationships, spdxRelationship{
+			SPDXElementID: doc.SPDXID, RelationshipType: "DESCRIBES", RelatedSPDXElement: main,
+		})
+		deps := bm.Deps
+		if bm.GoVersion != "" {
+			deps = append([]goModule{{Path: "stdlib", Version: bm.GoVersion}}, deps...)
+		}
+		for _, dep := range deps {
+			doc.Relationships = append(doc.Relationships, spdxRelationship{
+				SPDXElementID: main, RelationshipType: "DEPENDS_ON", RelatedSPDXElement: pkg(dep),
+			})
+		}
+	}
+	// The namespace must be unique to the document, so it's derived from
+	// what's in it.
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(b)
+	doc.DocumentNamespace = "https://ko.build/spdx/" + hex.EncodeToString(h[:])
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+type cycloneDXDocument struct {
+	BOMFormat    string                `json:"bomFormat"`
+	SpecVersion  string                `json:"specVersion"`
+	Version      int                   `json:"version"`
+	Metadata     cycloneDXMetadata     `json:"metadata"`
+	Components   []cycloneDXComponent  `json:"components"`
+	Dependencies []cycloneDXDependency `json:"dependencies"`
+}
+
+type cycloneDXMetadata struct {
+	Timestamp string             `json:"timestamp"`
+	Tools     []cycloneDXTool    `json:"tools"`
+	Component cycloneDXComponent `json:"component"`
+}
+
+type cycloneDXTool struct {
+	Name string `json:"name"`
+}
+
+type cycloneDXComponent struct {
+	Type    string `json:"type"`
+	BOMRef  string `json:"bom-ref"`
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	PURL    string `json:"purl,omitempty"`
+}
+
+type cycloneDXDependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn"`
+}
+
+func cycloneDXSBOM(ref, timestamp string, bins []*binaryModules) ([]byte, error) {
+	doc := cycloneDXDocument{
+		BOMFormat:   "CycloneDX",
+		SpecVersion: "1.4",
+		Version:     1,
+		Metadata: cycloneDXMetadata{
+			Timestamp: timestamp,
+			Tools:     []cycloneDXTool{{Name: "ko"}},
+			Component: cycloneDXComponent{Type: "container", BOMRef: ref, Name: ref},
+		},
+	}
+	seen := map[string]bool{}
+	component := func(typ string, m goModule) string {
+		purl := m.purl()
+		if !seen[purl] {
+			seen[purl] = true
+			doc.Components = append(doc.Components, cycloneDXComponent{
+				Type: typ, BOMRef: purl, Name: m.Path, Version: m.Version, PURL: purl,
+			})
+		}
+		return purl
+	}
+	image := cycloneDXDependency{Ref: ref, DependsOn: []string{}}
+	for _, bm := range bins {
+		main := component("application", bm.Main)
+		image.DependsOn = append(image.DependsOn, main)
+		dep := cycloneDXDependency{Ref: main, DependsOn: []string{}}
+		deps := bm.Deps
+		if bm.GoVersion != "" {
+			deps = append([]goModule{{Path: "stdlib", Version: bm.GoVersion}}, deps...)
+		}
+		for _, m := range deps {
+			dep.DependsOn = append(dep.DependsOn, component("library", m))
+		}
+		doc.Dependencies = append(doc.Dependencies, dep)
+	}
+	doc.Dependencies = append([]cycloneDXDependency{image}, doc.Dependencies...)
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// SBOMs holds the SBOMs generated by builders created WithSBOM, by the
+// digest of the image each was generated for, so that they can be found for
+// the images a publisher pushes however the built results were wrapped on
+// their way to it. It is safe for concurrent use.
+type SBOMs struct {
+	mu sync.Mutex
+	m  map[v1.Hash]generatedSBOM
+}
+
+type generatedSBOM struct {
+	sbom   []byte
+	format SBOMFormat
+}
+
+// NewSBOMs returns an empty SBOMs, to pass to WithSBOM and to the publisher.
+func NewSBOMs() *SBOMs {
+	return &SBOMs{m: map[v1.Hash]generatedSBOM{}}
+}
+
+// SBOM returns the SBOM generated for the image with digest h, and its media
+// type, if one was.
+func (s *SBOMs) SBOM(h v1.Hash) ([]byte, types.MediaType, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gs, ok := s.m[h]
+	if !ok {
+		return nil, "", false
+	}
+	return gs.sbom, gs.format.MediaType(), true
+}
+
+// put records sbom, in format, as the SBOM of img.
+func (s *SBOMs) put(img v1.Image, sbom []byte, format SBOMFormat) error {
+	h, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m[h] = generatedSBOM{sbom: sbom, format: format}
+	return nil
+}
+
+// keep records the SBOM of the built image, if it has one, as that of res,
+// which was derived from it, e.g. by annotating it.
+func (s *SBOMs) keep(built, res Result) error {
+	img, ok := built.(v1.Image)
+	derived, isImage := res.(v1.Image)
+	if !ok || !isImage {
+		return nil
+	}
+	h, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	gs, ok := s.m[h]
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return s.put(derived, gs.sbom, gs.format)
+}
@@ -0,0 +1,119 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+const goVersionM = `/tmp/ko123/out: go1.21.4
+	path	example.com/app/cmd/app
+	mod	example.com/app	(devel)	
+	dep	golang.org/x/sync	v0.1.0	h1:wsuoTGHzEhffawBOhz5CYhcrV4IdKZbEyZjBMuTp12o=
+	dep	gopkg.in/yaml.v3	v3.0.1	h1:fxVm/GzAzEWqLHuvctI91KS9hhNmmWOoWu0XTYJS7CA=
+	=>	example.com/yaml	v3.0.2	h1:abc=
+	build	-compiler=gc
+	build	GOOS=linux
+`
+
+func TestParseModules(t *testing.T) {
+	got, err := parseModules(goVersionM)
+	if err != nil {
+		t.Fatalf("parseModules() = %v", err)
+	}
+	want := &binaryModules{
+		GoVersion: "go1.21.4",
+		Main:      goModule{Path: "example.com/app", Version: "(devel)"},
+		Deps: []goModule{
+			{Path: "golang.org/x/sync", Version: "v0.1.0", Sum: "h1:wsuoTGHzEhffawBOhz5CYhcrV4IdKZbEyZjBMuTp12o="},
+			// The replacement is what's compiled in.
+			{Path: "example.com/yaml", Version: "v3.0.2", Sum: "h1:abc="},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("parseModules() (-want +got) = %s", diff)
+	}
+
+	if _, err := parseModules("/tmp/out: go1.21.4\n"); err == nil {
+		t.Error("parseModules() of a binary without modules succeeded, wanted error")
+	}
+}
+
+func TestGenerateSBOM(t *testing.T) {
+	bm, err := parseModules(goVersionM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both binaries of a combined image depend on x/sync, which is listed
+	// once.
+	other := &binaryModules{
+		GoVersion: "go1.21.4",
+		Main:      goModule{Path: "example.com/tools", Version: "v1.4.2"},
+		Deps:      []goModule{{Path: "golang.org/x/sync", Version: "v0.1.0", Sum: "h1:wsuoTGHzEhffawBOhz5CYhcrV4IdKZbEyZjBMuTp12o="}},
+	}
+	created := v1.Time{Time: time.Unix(1700000000, 0)}
+
+	for _, f := range []SBOMFormat{SBOMSPDX, SBOMCycloneDX} {
+		t.Run(string(f), func(t *testing.T) {
+			b, err := generateSBOM(f, "ko://example.com/app/cmd/app", created, []*binaryModules{bm, other})
+			if err != nil {
+				t.Fatalf("generateSBOM() = %v", err)
+			}
+			// SBOMs are as reproducible as the images.
+			again, err := generateSBOM(f, "ko://example.com/app/cmd/app", created, []*binaryModules{bm, other})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, again) {
+				t.Error("generateSBOM() isn't reproducible")
+			}
+			var doc map[string]interface{}
+			if err := json.Unmarshal(b, &doc); err != nil {
+				t.Fatalf("SBOM isn't JSON: %v", err)
+			}
+			s := string(b)
+			for _, want := range []string{
+				"pkg:golang/example.com/app@(devel)",
+				"pkg:golang/golang.org/x/sync@v0.1.0",
+				"pkg:golang/example.com/yaml@v3.0.2",
+				"pkg:golang/example.com/tools@v1.4.2",
+				"pkg:golang/stdlib@go1.21.4",
+				"2023-11-14T22:13:20Z",
+			} {
+				if !strings.Contains(s, want) {
+					t.Errorf("SBOM doesn't contain %q:\n%s", want, s)
+				}
+			}
+			if n := strings.Count(s, `"pkg:golang/golang.org/x/sync@v0.1.0"`); f == SBOMSPDX && n != 1 {
+				t.Errorf("SBOM lists x/sync %d times, wanted once", n)
+			}
+			if strings.Contains(s, "gopkg.in/yaml.v3") {
+				t.Error("SBOM lists the replaced module")
+			}
+		})
+	}
+
+	if _, err := NewGo(context.Background(), "", WithSBOM("swid", NewSBOMs())); err == nil {
+		t.Error("NewGo(WithSBOM(swid)) succeeded, wanted error")
+	}
+}
@@ -28,7 +28,11 @@ type Caching struct {
 	inner Interface
 
 	m       sync.Mutex
-	results map[string]*future
+	results map[cacheKey]*future
+
+	// dataOnly records whether the next build of an invalidated import path
+	// only needs its kodata rebuilt, see InvalidateData.
+	dataOnly map[string]bool
 }
 
 // Caching implements Interface
@@ -38,28 +42,45 @@ var _ Interface = (*Caching)(nil)
 // shares build results for a given path until the result has been invalidated.
 func NewCaching(inner Interface) (*Caching, error) {
 	return &Caching{
-		inner:   inner,
-		results: make(map[string]*future),
+		inner:    inner,
+		results:  make(map[cacheKey]*future),
+		dataOnly: make(map[string]bool),
 	}, nil
 }
 
+// cacheKey identifies the builds of an import path for the platforms set
+// with WithPlatform, if any.
+type cacheKey struct {
+	ip       string
+	platform string
+}
+
 // Build implements Interface
 func (c *Caching) Build(ctx context.Context, ip string) (Result, error) {
+	key := cacheKey{ip: ip}
+	if pm := contextPlatform(ctx); pm != nil {
+		key.platform = pm.spec
+	}
 	f := func() *future {
 		// Lock the map of futures.
 		c.m.Lock()
 		defer c.m.Unlock()
 
-		// If a future for "ip" exists, then return it.
-		f, ok := c.results[ip]
+		// If a future for "ip" (and its platform) exists, then return it.
+		f, ok := c.results[key]
 		if ok {
 			return f
 		}
 		// Otherwise create and record a future for a Build of "ip".
+		bctx := ctx
+		if c.dataOnly[ip] {
+			bctx = withDataOnly(ctx)
+		}
+		delete(c.dataOnly, ip)
 		f = newFuture(func() (Result, error) {
-			return c.inner.Build(ctx, ip)
+			return c.inner.Build(bctx, ip)
 		})
-		c.results[ip] = f
+		c.results[key] = f
 		return f
 	}()
 
@@ -76,10 +97,47 @@ func (c *Caching) IsSupportedReference(ip string) error {
 	return c.inner.IsSupportedReference(ip)
 }
 
-// Invalidate removes an import path's cached results.
+// Invalidate removes an import path's cached results, for all platforms.
 func (c *Caching) Invalidate(ip string) {
 	c.m.Lock()
 	defer c.m.Unlock()
 
-	delete(c.results, ip)
+	c.deleteResults(ip)
+	c.dataOnly[ip] = false
+}
+
+// deleteResults removes the results of ip for all platforms. c.m must be
+// held.
+func (c *Caching) deleteResults(ip string) {
+	for key := range c.results {
+		if key.ip == ip {
+			delete(c.results, key)
+		}
+	}
+}
+
+// InvalidateData removes an import path's cached results because only its
+// kodata changed, so that its next build may reuse the binaries it was built
+// with before. Invalidate still wins until that build.
+func (c *Caching) InvalidateData(ip string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.deleteResults(ip)
+	if _, ok := c.dataOnly[ip]; !ok {
+		c.dataOnly[ip] = true
+	}
+}
+
+type dataOnlyKey struct{}
+
+// withDataOnly marks builds with ctx as only needing their kodata rebuilt.
+func withDataOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dataOnlyKey{}, true)
+}
+
+// isDataOnly reports whether builds with ctx only need their kodata rebuilt.
+func isDataOnly(ctx context.Context) bool {
+	b, _ := ctx.Value(dataOnlyKey{}).(bool)
+	return b
 }
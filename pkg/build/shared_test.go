@@ -18,9 +18,11 @@ package build
 
 import (
 	"context"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-containerregistry/pkg/v1/random"
 )
 
@@ -94,3 +96,63 @@ func TestCaching(t *testing.T) {
 		cb.Invalidate(ip)
 	}
 }
+
+// countingBuild counts its builds by the platform of their context.
+type countingBuild struct {
+	slowbuild
+	m      sync.Mutex
+	builds map[string]int
+}
+
+func (cb *countingBuild) Build(ctx context.Context, ip string) (Result, error) {
+	platform := ""
+	if pm := contextPlatform(ctx); pm != nil {
+		platform = pm.spec
+	}
+	cb.m.Lock()
+	cb.builds[platform]++
+	cb.m.Unlock()
+	return cb.slowbuild.Build(ctx, ip)
+}
+
+func TestCachingPlatforms(t *testing.T) {
+	ip := "foo"
+	counter := &countingBuild{builds: map[string]int{}}
+	cb, _ := NewCaching(counter)
+
+	arm64, err := WithPlatform(context.Background(), "linux/arm64")
+	if err != nil {
+		t.Fatalf("WithPlatform() = %v", err)
+	}
+	build := func(ctx context.Context) string {
+		res, err := cb.Build(ctx, ip)
+		if err != nil {
+			t.Fatalf("Build() = %v", err)
+		}
+		return digest(t, res)
+	}
+
+	all := build(context.Background())
+	single := build(arm64)
+	if all == single {
+		t.Error("Build() for linux/arm64 returned the result for all platforms")
+	}
+	// Switching back and forth is served from the cache.
+	if got := build(context.Background()); got != all {
+		t.Errorf("Build() = %s, wanted cached %s", got, all)
+	}
+	if got := build(arm64); got != single {
+		t.Errorf("Build() for linux/arm64 = %s, wanted cached %s", got, single)
+	}
+	if diff := cmp.Diff(map[string]int{"": 1, "linux/arm64": 1}, counter.builds); diff != "" {
+		t.Errorf("builds (-want +got): %s", diff)
+	}
+
+	// Invalidating an import path invalidates it for every platform.
+	cb.Invalidate(ip)
+	build(context.Background())
+	build(arm64)
+	if diff := cmp.Diff(map[string]int{"": 2, "linux/arm64": 2}, counter.builds); diff != "" {
+		t.Errorf("builds after Invalidate (-want +got): %s", diff)
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import "testing"
+
+func TestParseByteSize(t *testing.T) {
+	for in, want := range map[string]uint64{
+		"0":      0,
+		"1024":   1024,
+		"2GB":    2000000000,
+		"2gb":    2000000000,
+		"1.5 MB": 1500000,
+		"1GiB":   1 << 30,
+		"10K":    10000,
+	} {
+		got, err := ParseByteSize(in)
+		if err != nil {
+			t.Errorf("ParseByteSize(%q) = %v", in, err)
+		} else if got != want {
+			t.Errorf("ParseByteSize(%q) = %d, wanted %d", in, got, want)
+		}
+	}
+	for _, in := range []string{"", "GB", "2XB", "-1GB"} {
+		if _, err := ParseByteSize(in); err == nil {
+			t.Errorf("ParseByteSize(%q) = nil, wanted error", in)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"strings"
+
+	"github.com/google/ko/pkg/trace"
+)
+
+// Traced composes with another Interface to record a "build" span for each
+// build, when tracing is enabled.
+type Traced struct {
+	Builder Interface
+}
+
+// Traced implements Interface
+var _ Interface = (*Traced)(nil)
+
+// QualifyImport implements Interface
+func (t *Traced) QualifyImport(ip string) (string, error) {
+	return t.Builder.QualifyImport(ip)
+}
+
+// IsSupportedReference implements Interface
+func (t *Traced) IsSupportedReference(ip string) error {
+	return t.Builder.IsSupportedReference(ip)
+}
+
+// Build implements Interface
+func (t *Traced) Build(ctx context.Context, ip string) (Result, error) {
+	ctx, span := trace.Start(ctx, "build", trace.String("ko.importpath", strings.TrimPrefix(ip, StrictScheme)))
+	res, err := t.Builder.Build(ctx, ip)
+	span.End(err)
+	return res, err
+}
+
+// NewTraced returns a new builder that traces the builds of b.
+func NewTraced(b Interface) *Traced {
+	return &Traced{Builder: b}
+}
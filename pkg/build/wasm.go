@@ -0,0 +1,235 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	specsv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Media types of WebAssembly modules packaged as OCI artifacts, see
+// https://tag-runtime.cncf.io/wgs/wasm/deliverables/wasm-oci-artifact/
+const (
+	WasmConfigMediaType types.MediaType = "application/vnd.wasm.config.v0+json"
+	WasmLayerMediaType  types.MediaType = "application/vnd.wasm.content.layer.v1+wasm"
+)
+
+// WasmPackaging determines how modules built for wasip1/wasm are published.
+type WasmPackaging string
+
+const (
+	// WasmArtifact publishes the module on its own, as an OCI artifact with
+	// the wasm media types, as wasmCloud and Spin expect. It's the default.
+	WasmArtifact WasmPackaging = "artifact"
+	// WasmImage publishes the module in an image built on scratch, with
+	// the module as its entrypoint and kodata, as container runtimes with
+	// a wasm shim (e.g. containerd's runwasi) expect.
+	WasmImage WasmPackaging = "image"
+)
+
+// wasmPlatform is the platform that modules are built for.
+var wasmPlatform = v1.Platform{OS: "wasip1", Architecture: "wasm"}
+
+// isWasm reports whether p is wasip1/wasm.
+func isWasm(p v1.Platform) bool {
+	return p.OS == wasmPlatform.OS && p.Architecture == wasmPlatform.Architecture
+}
+
+// wasm reports whether the platform spec asks for wasip1/wasm, which has no
+// base image, and can't be combined with other platforms.
+func (pm *platformMatcher) wasm() (bool, error) {
+	for _, p := range pm.platforms {
+		if isWasm(p) {
+			if len(pm.platforms) > 1 {
+				return false, fmt.Errorf("%s can't be built together with other platforms: %q", PlatformString(wasmPlatform), pm.spec)
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// buildWasm builds s for wasip1/wasm, and packages it as g.wasmPackaging
+// says. Artifacts only hold the module, so kodata is only published with
+// WasmImage.
+func (g *gobuild) buildWasm(ctx context.Context, s string) (Result, error) {
+	if g.wasmPackaging == WasmImage {
+		// There's no base to pick the platform from, so scratch is
+		// configured with it.
+		base, err := mutate.ConfigFile(mutate.MediaType(empty.Image, types.OCIManifestSchema1), &v1.ConfigFile{
+			OS:           wasmPlatform.OS,
+			Architecture: wasmPlatform.Architecture,
+			RootFS:       v1.RootFS{Type: "layers"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		platform := wasmPlatform
+		return g.buildOne(ctx, s, base, &platform)
+	}
+
+	if _, ok := MultiImportPaths(s); ok {
+		return nil, fmt.Errorf("%s: combined images can't be published as wasm artifacts, which hold a single module; use image packaging", s)
+	}
+	ref := newRef(s)
+	configKey, _, _ := ExternalImportPath(ref.String())
+	platform := wasmPlatform
+	config := g.configForPlatform(configKey, &platform)
+	file, err := g.build(ctx, ref.Path(), g.dir, platform, config)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(filepath.Dir(file))
+	if err := checkBinarySize(ref.Path(), file, config.MaxBinarySize); err != nil {
+		return nil, err
+	}
+	module, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	names, err := binaryNames([]string{ref.Path()}, g.binaryCollision)
+	if err != nil {
+		return nil, err
+	}
+	return newWasmArtifact(module, names[0]+".wasm", g.creationTime)
+}
+
+// wasmConfig is the config of a wasm artifact.
+type wasmConfig struct {
+	Created      *time.Time `json:"created,omitempty"`
+	Author       string     `json:"author,omitempty"`
+	Architecture string     `json:"architecture"`
+	OS           string     `json:"os"`
+	LayerDigests []string   `json:"layerDigests"`
+}
+
+// wasmArtifact is an OCI artifact holding a single wasm module. It's built
+// by hand, since mutate can't set the media type of an image's config.
+type wasmArtifact struct {
+	config   []byte
+	manifest []byte
+	module   *wasmLayer
+}
+
+var _ partial.CompressedImageCore = (*wasmArtifact)(nil)
+
+// newWasmArtifact returns a wasm artifact holding module, titled name.
+func newWasmArtifact(module []byte, name string, created v1.Time) (Result, error) {
+	layer := &wasmLayer{module: module}
+	digest, err := layer.Digest()
+	if err != nil {
+		return nil, err
+	}
+	cfg := wasmConfig{
+		Author:       "github.com/google/ko",
+		Architecture: wasmPlatform.Architecture,
+		OS:           wasmPlatform.OS,
+		LayerDigests: []string{digest.String()},
+	}
+	if !created.IsZero() {
+		t := created.Time.UTC()
+		cfg.Created = &t
+	}
+	config, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	configDigest, configSize, err := v1.SHA256(bytes.NewReader(config))
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := json.Marshal(v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIManifestSchema1,
+		Config: v1.Descriptor{
+			MediaType: WasmConfigMediaType,
+			Size:      configSize,
+			Digest:    configDigest,
+		},
+		Layers: []v1.Descriptor{{
+			MediaType: WasmLayerMediaType,
+			Size:      int64(len(module)),
+			Digest:    digest,
+			Annotations: map[string]string{
+				specsv1.AnnotationTitle: name,
+			},
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return partial.CompressedToImage(&wasmArtifact{config: config, manifest: manifest, module: layer})
+}
+
+// RawConfigFile implements partial.CompressedImageCore
+func (a *wasmArtifact) RawConfigFile() ([]byte, error) {
+	return a.config, nil
+}
+
+// MediaType implements partial.CompressedImageCore
+func (a *wasmArtifact) MediaType() (types.MediaType, error) {
+	return types.OCIManifestSchema1, nil
+}
+
+// RawManifest implements partial.CompressedImageCore
+func (a *wasmArtifact) RawManifest() ([]byte, error) {
+	return a.manifest, nil
+}
+
+// LayerByDigest implements partial.CompressedImageCore
+func (a *wasmArtifact) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	if digest, err := a.module.Digest(); err != nil {
+		return nil, err
+	} else if h == digest {
+		return a.module, nil
+	}
+	return nil, fmt.Errorf("wasm artifact has no layer %s", h)
+}
+
+// wasmLayer is a layer whose blob is a wasm module itself, uncompressed.
+type wasmLayer struct {
+	module []byte
+}
+
+func (l *wasmLayer) Digest() (v1.Hash, error) {
+	h, _, err := v1.SHA256(bytes.NewReader(l.module))
+	return h, err
+}
+
+func (l *wasmLayer) Compressed() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(l.module)), nil
+}
+
+func (l *wasmLayer) Size() (int64, error) {
+	return int64(len(l.module)), nil
+}
+
+func (l *wasmLayer) MediaType() (types.MediaType, error) {
+	return WasmLayerMediaType, nil
+}
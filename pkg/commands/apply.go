@@ -24,6 +24,7 @@ import (
 
 	"github.com/google/ko/internal"
 	"github.com/google/ko/pkg/commands/options"
+	"github.com/google/ko/pkg/warnings"
 	"github.com/spf13/cobra"
 	"golang.org/x/sync/errgroup"
 )
@@ -50,6 +51,7 @@ func addApply(topLevel *cobra.Command) {
 	fo := &options.FilenameOptions{}
 	so := &options.SelectorOptions{}
 	bo := &options.BuildOptions{}
+	wo := &options.WarningOptions{}
 	apply := &cobra.Command{
 		Use:   "apply -f FILENAME",
 		Short: "Apply the input files with image references resolved to built/pushed image digests.",
@@ -82,6 +84,9 @@ func addApply(topLevel *cobra.Command) {
   ko apply -f config -- --namespace=foo --kubeconfig=cfg.yaml
 `,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if fo.ExplainWatch != "" {
+				return explainWatch(os.Stdout, fo.ExplainWatch)
+			}
 			if !isKubectlAvailable() {
 				return errors.New("error: kubectl is not available. kubectl must be installed to use ko apply")
 			}
@@ -90,10 +95,17 @@ func addApply(topLevel *cobra.Command) {
 			ctx := createCancellableContext()
 
 			bo.InsecureRegistry = po.InsecureRegistry
+			shareSBOMs(bo, po)
 			builder, err := makeBuilder(ctx, bo)
 			if err != nil {
 				return fmt.Errorf("error creating builder: %v", err)
 			}
+			if ctx, err = watchContext(ctx, bo, fo); err != nil {
+				return err
+			}
+			if fo.BuildPlatform, err = targetPlatform(bo); err != nil {
+				return err
+			}
 			publisher, err := makePublisher(po)
 			if err != nil {
 				return fmt.Errorf("error creating publisher: %v", err)
@@ -109,6 +121,7 @@ func addApply(topLevel *cobra.Command) {
 				log.Printf(kubectlFlagsWarningTemplate,
 					"apply", skflags,
 					"apply", skflags)
+				warnings.Record(warnings.Warning{Code: warnings.DeprecatedFlag, Message: "passing kubectl global flags to ko directly is deprecated, pass them after --"})
 				argv = append(argv, kflags...)
 			}
 			argv = append(argv, args...)
@@ -156,9 +169,19 @@ func addApply(topLevel *cobra.Command) {
 	}
 	options.AddPublishArg(apply, po)
 	options.AddFileArg(apply, fo)
+	options.AddWatchDebugArg(apply, fo)
 	options.AddSelectorArg(apply, so)
+	options.AddNormalizeArg(apply, &fo.Normalize)
+	options.AddStrictArg(apply, &fo.Strict)
+	options.AddCommentDocumentsArg(apply, fo)
+	options.AddMergeArg(apply, fo)
+	options.AddHelmReleaseArg(apply, fo)
+	options.AddImagesChecksumArg(apply, fo)
+	options.AddBuildOutputArg(apply, fo)
 	options.AddBuildOptions(apply, bo)
+	options.AddWarningsArg(apply, wo)
 	internal.AddFlags(&kf, apply.Flags())
 
+	apply.RunE = withGitHubErrors(po, withWarnings(wo, withTracing(apply.RunE)))
 	topLevel.AddCommand(apply)
 }
@@ -0,0 +1,106 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/ko/pkg/commands/options"
+	"gopkg.in/yaml.v3"
+)
+
+// The subset of the Argo CD Application schema that we generate, see:
+// https://argo-cd.readthedocs.io/en/stable/operator-manual/declarative-setup/#applications
+type argoCDApplication struct {
+	APIVersion string                `yaml:"apiVersion"`
+	Kind       string                `yaml:"kind"`
+	Metadata   argoCDMetadata        `yaml:"metadata"`
+	Spec       argoCDApplicationSpec `yaml:"spec"`
+}
+
+type argoCDMetadata struct {
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace"`
+}
+
+type argoCDApplicationSpec struct {
+	Project     string            `yaml:"project"`
+	Source      argoCDSource      `yaml:"source"`
+	Destination argoCDDestination `yaml:"destination"`
+}
+
+type argoCDSource struct {
+	RepoURL   string          `yaml:"repoURL"`
+	Path      string          `yaml:"path"`
+	Kustomize argoCDKustomize `yaml:"kustomize"`
+}
+
+type argoCDKustomize struct {
+	Images []string `yaml:"images"`
+}
+
+type argoCDDestination struct {
+	Server    string `yaml:"server"`
+	Namespace string `yaml:"namespace"`
+}
+
+// argoCDApplicationYAML returns an Argo CD Application skeleton whose
+// kustomize image overrides pin each of the published references.
+func argoCDApplicationYAML(ao *options.ArgoCDOptions, refs map[string]name.Reference) ([]byte, error) {
+	images := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		images = append(images, ref.String())
+	}
+	sort.Strings(images)
+
+	repoURL := ao.RepoURL
+	if repoURL == "" {
+		repoURL = "REPLACE_ME"
+	}
+
+	app := argoCDApplication{
+		APIVersion: "argoproj.io/v1alpha1",
+		Kind:       "Application",
+		Metadata: argoCDMetadata{
+			Name:      ao.Application,
+			Namespace: ao.Namespace,
+		},
+		Spec: argoCDApplicationSpec{
+			Project: "default",
+			Source: argoCDSource{
+				RepoURL:   repoURL,
+				Path:      ao.Path,
+				Kustomize: argoCDKustomize{Images: images},
+			},
+			Destination: argoCDDestination{
+				Server:    "https://kubernetes.default.svc",
+				Namespace: ao.DestinationNamespace,
+			},
+		},
+	}
+
+	buf := &bytes.Buffer{}
+	e := yaml.NewEncoder(buf)
+	e.SetIndent(2)
+	if err := e.Encode(app); err != nil {
+		return nil, err
+	}
+	if err := e.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/commands/options"
+	kotesting "github.com/google/ko/pkg/internal/testing"
+	"github.com/google/ko/pkg/publish"
+	"gopkg.in/yaml.v3"
+)
+
+func TestArgoCDApplication(t *testing.T) {
+	base := mustRepository("gcr.io/argo")
+	rec := &publish.Recorder{Publisher: kotesting.NewFixedPublish(base, testHashes)}
+
+	inputYAML := []byte("image: " + build.StrictScheme + fooRef + "\n---\nimage: " + build.StrictScheme + barRef + "\n")
+	buf := bytes.NewBuffer(nil)
+	fo := &options.FilenameOptions{Filenames: []string{yamlToTmpFile(t, inputYAML)}}
+	builder, err := build.NewCaching(testBuilder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resolveFilesToWriter(context.Background(), builder, rec, fo, &options.SelectorOptions{}, nopWriteCloser{buf}); err != nil {
+		t.Fatalf("resolveFilesToWriter() = %v", err)
+	}
+
+	ao := &options.ArgoCDOptions{
+		Application:          "my-app",
+		Namespace:            "argocd",
+		RepoURL:              "https://example.com/deploy.git",
+		Path:                 "config",
+		DestinationNamespace: "prod",
+	}
+	b, err := argoCDApplicationYAML(ao, rec.References())
+	if err != nil {
+		t.Fatalf("argoCDApplicationYAML() = %v", err)
+	}
+
+	var app argoCDApplication
+	if err := yaml.Unmarshal(b, &app); err != nil {
+		t.Fatalf("yaml.Unmarshal() = %v", err)
+	}
+	if app.Kind != "Application" || app.Metadata.Name != "my-app" || app.Spec.Source.RepoURL != ao.RepoURL {
+		t.Errorf("unexpected Application: %s", b)
+	}
+	want := []string{
+		kotesting.ComputeDigest(base, barRef, barHash),
+		kotesting.ComputeDigest(base, fooRef, fooHash),
+	}
+	if diff := cmp.Diff(want, app.Spec.Source.Kustomize.Images); diff != "" {
+		t.Errorf("Application images (-want +got) = %s", diff)
+	}
+	for _, img := range want {
+		if !bytes.Contains(buf.Bytes(), []byte(img)) {
+			t.Errorf("resolved output does not contain %s", img)
+		}
+	}
+}
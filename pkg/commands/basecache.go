@@ -0,0 +1,250 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	"github.com/google/ko/pkg/build"
+)
+
+// The annotations that key the entries of the base image cache: the base
+// image as configured, the platforms it was fetched for, and the digest the
+// reference pointed at when it was cached.
+const (
+	baseCacheRefAnnotation      = "ko.build/base-ref"
+	baseCachePlatformAnnotation = "ko.build/base-platform"
+	baseCacheDigestAnnotation   = "ko.build/base-digest"
+)
+
+// cacheDir returns the directory ko caches in: KOCACHE, or else
+// $XDG_CACHE_HOME/ko (e.g. ~/.cache/ko). Base images are cached in its base
+// directory, and builds in its builds directory. It's "" if there's no home
+// directory to cache in.
+func cacheDir() string {
+	if dir := os.Getenv("KOCACHE"); dir != "" {
+		return dir
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "ko")
+}
+
+// baseCacheDir returns the directory base images are cached in, or "" if
+// there's none.
+func baseCacheDir() string {
+	dir := cacheDir()
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, "base")
+}
+
+// baseCache is an OCI layout of the base images fetched by earlier runs, and
+// by `ko warm`, which builds read instead of fetching them again.
+type baseCache struct {
+	layout *build.CacheLayout
+}
+
+// newBaseCache returns the cache in dir, which is disabled if dir is "".
+func newBaseCache(dir string) *baseCache {
+	if dir == "" {
+		return &baseCache{}
+	}
+	return &baseCache{layout: build.NewCacheLayout(dir)}
+}
+
+// get returns the cached base for ref and platform, and the digest ref
+// pointed at when it was cached, or false if there's none.
+func (c *baseCache) get(ref name.Reference, platform string) (v1.Hash, build.Result, bool) {
+	if c.layout == nil {
+		return v1.Hash{}, nil, false
+	}
+	desc, res, ok := c.layout.Get(c.matcher(ref, platform))
+	if !ok {
+		return v1.Hash{}, nil, false
+	}
+	digest, err := v1.NewHash(desc.Annotations[baseCacheDigestAnnotation])
+	if err != nil {
+		return v1.Hash{}, nil, false
+	}
+	return digest, res, true
+}
+
+func (c *baseCache) matcher(ref name.Reference, platform string) match.Matcher {
+	return func(desc v1.Descriptor) bool {
+		return desc.Annotations[baseCacheRefAnnotation] == ref.Name() &&
+			desc.Annotations[baseCachePlatformAnnotation] == platform
+	}
+}
+
+// put caches res, with its blobs, as the base for ref and platform, which
+// pointed at digest, replacing what was cached for them before. Of the
+// children of an index, only those that match children are cached, or all
+// of them if it's nil. It returns the size of what it cached.
+func (c *baseCache) put(ref name.Reference, platform string, digest v1.Hash, res build.Result, children match.Matcher) (int64, error) {
+	if c.layout == nil {
+		return 0, fmt.Errorf("the base image cache is disabled")
+	}
+	if err := c.layout.Replace(res, map[string]string{
+		baseCacheRefAnnotation:      ref.Name(),
+		baseCachePlatformAnnotation: platform,
+		baseCacheDigestAnnotation:   digest.String(),
+	}, c.matcher(ref, platform), children); err != nil {
+		return 0, fmt.Errorf("caching base %s: %v", ref, err)
+	}
+	return resultSize(res, children)
+}
+
+// resultSize returns the size of the manifests, configs and layers of res,
+// and of those of its children that match children, or all of them if it's
+// nil.
+func resultSize(res build.Result, children match.Matcher) (int64, error) {
+	raw, err := res.RawManifest()
+	if err != nil {
+		return 0, err
+	}
+	size := int64(len(raw))
+	switch res := res.(type) {
+	case v1.ImageIndex:
+		im, err := res.IndexManifest()
+		if err != nil {
+			return 0, err
+		}
+		for _, desc := range im.Manifests {
+			if children != nil && !children(desc) {
+				continue
+			}
+			var child build.Result
+			if desc.MediaType.IsIndex() {
+				child, err = res.ImageIndex(desc.Digest)
+			} else {
+				child, err = res.Image(desc.Digest)
+			}
+			if err != nil {
+				return 0, err
+			}
+			n, err := resultSize(child, nil)
+			if err != nil {
+				return 0, err
+			}
+			size += n
+		}
+	case v1.Image:
+		m, err := res.Manifest()
+		if err != nil {
+			return 0, err
+		}
+		size += m.Config.Size
+		for _, l := range m.Layers {
+			size += l.Size
+		}
+	}
+	return size, nil
+}
+
+// baseResolutions remembers the bases that fetching each base image
+// reference, for each platform, resolved to, so that tags are resolved at
+// most once per run, however many importpaths are built on them.
+type baseResolutions struct {
+	mu sync.Mutex
+	m  map[string]*baseResolution
+}
+
+type baseResolution struct {
+	mu     sync.Mutex
+	digest v1.Hash
+	res    build.Result
+}
+
+func newBaseResolutions() *baseResolutions {
+	return &baseResolutions{m: map[string]*baseResolution{}}
+}
+
+// get returns what ref resolved to for platform, calling resolve the first
+// time. Concurrent calls for the same base wait for the first, and failures
+// aren't remembered, so that they're retried.
+func (b *baseResolutions) get(ref name.Reference, platform string, resolve func() (v1.Hash, build.Result, error)) (v1.Hash, build.Result, error) {
+	key := ref.Name() + " " + platform
+	b.mu.Lock()
+	r, ok := b.m[key]
+	if !ok {
+		r = &baseResolution{}
+		b.m[key] = r
+	}
+	b.mu.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.res == nil {
+		digest, res, err := resolve()
+		if err != nil {
+			return v1.Hash{}, nil, err
+		}
+		r.digest, r.res = digest, res
+	}
+	return r.digest, r.res, nil
+}
+
+type warmKey struct{}
+
+// warmStats counts what `ko warm` cached.
+type warmStats struct {
+	mu       sync.Mutex
+	bases    map[string]int64 // sizes by base image and platform
+	modules  int
+	zipBytes int64
+}
+
+func (s *warmStats) addBase(ref name.Reference, platform string, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.bases == nil {
+		s.bases = map[string]int64{}
+	}
+	s.bases[ref.Name()+" "+platform] = size
+}
+
+// baseBytes returns the total size of the cached base images.
+func (s *warmStats) baseBytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for _, size := range s.bases {
+		n += size
+	}
+	return n
+}
+
+// withWarming returns a context in which fetching base images caches them,
+// counting them in stats, rather than reading them from the cache.
+func withWarming(ctx context.Context, stats *warmStats) context.Context {
+	return context.WithValue(ctx, warmKey{}, stats)
+}
+
+// warming returns the stats of ctx if it's for `ko warm`, or nil.
+func warming(ctx context.Context) *warmStats {
+	stats, _ := ctx.Value(warmKey{}).(*warmStats)
+	return stats
+}
@@ -0,0 +1,292 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/ko/pkg/commands/options"
+	"github.com/google/ko/pkg/registrytest"
+	"github.com/google/ko/pkg/warnings"
+)
+
+func TestMain(m *testing.M) {
+	// Keep the caches of the tests out of the user's.
+	dir, err := ioutil.TempDir("", "ko-test-cache")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Setenv("XDG_CACHE_HOME", dir)
+	os.Unsetenv("KOCACHE")
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// countRequests returns how many of the registry's requests since the first
+// skip start with prefix, e.g. "GET /v2/base/blobs/".
+func countRequests(reg *registrytest.Registry, skip int, prefix string) int {
+	n := 0
+	for _, req := range reg.Requests()[skip:] {
+		if strings.HasPrefix(req, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestBaseCache(t *testing.T) {
+	defer setKOCACHE(t)()
+	dir := baseCacheDir()
+	reg := registrytest.New()
+	defer reg.Close()
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseImage := reg.Host() + "/base:latest"
+	if err := crane.Push(img, baseImage); err != nil {
+		t.Fatal(err)
+	}
+
+	// run gets the base of several importpaths at once, like a run of ko
+	// building them, and returns how many times the tag was resolved and
+	// how many blobs were fetched.
+	run := func(bo *options.BuildOptions) (manifests, blobs int) {
+		t.Helper()
+		skip := len(reg.Requests())
+		bo.BaseImage = baseImage
+		getBase := getBaseImage("linux/amd64", bo)
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, res, err := getBase(context.Background(), fmt.Sprintf("ko://example.com/app%d", i))
+				if err != nil {
+					t.Errorf("getBaseImage() = %v", err)
+					return
+				}
+				if got, err := res.Digest(); err != nil || got != mustDigest(img) {
+					t.Errorf("getBaseImage() = %s, %v, wanted %s", got, err, mustDigest(img))
+				}
+			}(i)
+		}
+		wg.Wait()
+		return countRequests(reg, skip, "GET /v2/base/manifests/"), countRequests(reg, skip, "GET /v2/base/blobs/")
+	}
+
+	// The tag is resolved once per run, however many importpaths use it,
+	// and the first run caches the base.
+	if manifests, blobs := run(&options.BuildOptions{}); manifests != 1 || blobs == 0 {
+		t.Errorf("first run: %d manifest and %d blob fetches, wanted 1 and some", manifests, blobs)
+	}
+	// Later runs resolve the tag again, but read the base from the cache.
+	if manifests, blobs := run(&options.BuildOptions{}); manifests != 1 || blobs != 0 {
+		t.Errorf("cached run: %d manifest and %d blob fetches, wanted 1 and 0", manifests, blobs)
+	}
+
+	// A corrupt blob is detected, and fetched again.
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := layers[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := filepath.Join(dir, "blobs", digest.Algorithm, digest.Hex)
+	if err := ioutil.WriteFile(blob, []byte("partly written"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, blobs := run(&options.BuildOptions{}); blobs == 0 {
+		t.Error("run with a corrupt cache fetched no blobs, wanted them fetched again")
+	}
+	f, err := os.Open(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if got, _, err := v1.SHA256(f); err != nil || got != digest {
+		t.Errorf("cached layer has digest %s, %v, wanted %s", got, err, digest)
+	}
+
+	// --no-cache-base neither reads nor writes the cache.
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if manifests, _ := run(&options.BuildOptions{NoCacheBase: true}); manifests != 1 {
+		t.Errorf("--no-cache-base run: %d manifest fetches, wanted 1", manifests)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("--no-cache-base run wrote the cache: %v", err)
+	}
+}
+
+func TestBaseCachePlatforms(t *testing.T) {
+	defer setKOCACHE(t)()
+	reg := registrytest.New()
+	defer reg.Close()
+	var adds []mutate.IndexAddendum
+	images := map[string]v1.Image{}
+	for _, arch := range []string{"amd64", "arm64", "s390x"} {
+		img, err := random.Image(1024, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		images[arch] = img
+		adds = append(adds, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: arch}},
+		})
+	}
+	baseImage := reg.Host() + "/base:latest"
+	ref, err := name.ParseReference(baseImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(ref, mutate.AppendManifests(empty.Index, adds...)); err != nil {
+		t.Fatal(err)
+	}
+	cached := func(img v1.Image) bool {
+		t.Helper()
+		layers, err := img.Layers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := layers[0].Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = os.Stat(filepath.Join(baseCacheDir(), "blobs", h.Algorithm, h.Hex))
+		return err == nil
+	}
+
+	// Only the children of the platforms that are built for are cached.
+	bo := &options.BuildOptions{BaseImage: baseImage}
+	if _, _, err := getBaseImage("linux/amd64,linux/arm64", bo)(context.Background(), "ko://example.com/app"); err != nil {
+		t.Fatal(err)
+	}
+	for arch, want := range map[string]bool{"amd64": true, "arm64": true, "s390x": false} {
+		if got := cached(images[arch]); got != want {
+			t.Errorf("%s cached = %t, wanted %t", arch, got, want)
+		}
+	}
+
+	// Emulating a platform the base doesn't provide caches the child it's
+	// built on, which is read from the cache by the next run.
+	bo.BasePlatformPolicy = "emulate"
+	if _, _, err := getBaseImage("linux/s390x,linux/ppc64le", bo)(context.Background(), "ko://example.com/app"); err != nil {
+		t.Fatal(err)
+	}
+	skip := len(reg.Requests())
+	if _, _, err := getBaseImage("linux/s390x,linux/ppc64le", bo)(context.Background(), "ko://example.com/app"); err != nil {
+		t.Fatal(err)
+	}
+	if blobs := countRequests(reg, skip, "GET /v2/base/blobs/"); blobs != 0 {
+		t.Errorf("cached run fetched %d blobs, wanted 0", blobs)
+	}
+	if !cached(images["s390x"]) {
+		t.Error("s390x wasn't cached")
+	}
+}
+
+func TestBaseMoved(t *testing.T) {
+	defer setKOCACHE(t)()
+	reg := registrytest.New()
+	defer reg.Close()
+	baseImage := reg.Host() + "/base:latest"
+	push := func() v1.Image {
+		t.Helper()
+		img, err := random.Image(1024, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := crane.Push(img, baseImage); err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+	const importpath = "ko://example.com/app"
+
+	// run gets the base like a build with bo, and returns the base, and the
+	// codes of the warnings about it.
+	run := func(bo *options.BuildOptions) (v1.Hash, []string, error) {
+		t.Helper()
+		c := &warnings.Collector{}
+		defer warnings.SetDefault(warnings.SetDefault(c))
+		_, res, err := getBaseImage("linux/amd64", bo)(context.Background(), importpath)
+		var codes []string
+		for _, w := range c.Warnings() {
+			codes = append(codes, w.Code)
+		}
+		if err != nil {
+			return v1.Hash{}, codes, err
+		}
+		got, err := res.Digest()
+		return got, codes, err
+	}
+
+	first := push()
+	if got, codes, err := run(&options.BuildOptions{BaseImage: baseImage}); err != nil || got != mustDigest(first) || len(codes) != 0 {
+		t.Fatalf("first run = %s, %v, %v, wanted %s without warnings", got, codes, err, mustDigest(first))
+	}
+
+	// The tag moves, which builds warn about, but follow.
+	second := push()
+	if got, codes, err := run(&options.BuildOptions{BaseImage: baseImage}); err != nil || got != mustDigest(second) || len(codes) != 1 || codes[0] != warnings.BaseMoved {
+		t.Errorf("run after the tag moved = %s, %v, %v, wanted %s with a %s warning", got, codes, err, mustDigest(second), warnings.BaseMoved)
+	}
+
+	// It moves again, which fails builds with --require-pinned-base until
+	// the base is updated.
+	third := push()
+	if _, _, err := run(&options.BuildOptions{BaseImage: baseImage, RequirePinnedBase: true}); err == nil || !strings.Contains(err.Error(), "ko update-base") {
+		t.Errorf("--require-pinned-base run after the tag moved = %v, wanted error suggesting ko update-base", err)
+	}
+	if _, err := warmBases(withWarming(context.Background(), &warmStats{}), getBaseImage("linux/amd64", &options.BuildOptions{BaseImage: baseImage}), []string{importpath}); err != nil {
+		t.Fatalf("warmBases() = %v", err)
+	}
+	if got, codes, err := run(&options.BuildOptions{BaseImage: baseImage, RequirePinnedBase: true}); err != nil || got != mustDigest(third) || len(codes) != 0 {
+		t.Errorf("--require-pinned-base run after updating the base = %s, %v, %v, wanted %s without warnings", got, codes, err, mustDigest(third))
+	}
+
+	// Bases referenced by digest can't move.
+	digestRef := reg.Host() + "/base@" + mustDigest(first).String()
+	if got, codes, err := run(&options.BuildOptions{BaseImage: digestRef, RequirePinnedBase: true}); err != nil || got != mustDigest(first) || len(codes) != 0 {
+		t.Errorf("run with a digest = %s, %v, %v, wanted %s without warnings", got, codes, err, mustDigest(first))
+	}
+
+	// Without the cache, there's nothing to compare to, which fails before
+	// anything is built.
+	if _, err := gobuildOptions(&options.BuildOptions{BaseImage: baseImage, RequirePinnedBase: true, NoCacheBase: true}); err == nil || !strings.Contains(err.Error(), "--no-cache-base") {
+		t.Errorf("gobuildOptions(--require-pinned-base --no-cache-base) = %v, wanted error", err)
+	}
+}
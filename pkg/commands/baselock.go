@@ -0,0 +1,292 @@
+/*
+Copyright 2021 Google LLC All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/google/ko/pkg/build"
+)
+
+// baseLock is the content of a --base-lock file. It records the content of
+// each base image, so that it can be reviewed in-repo and verified against
+// the registry on every build.
+type baseLock struct {
+	// Bases is keyed by the base image reference, as configured.
+	Bases map[string]baseLockEntry `json:"bases"`
+}
+
+// baseLockEntry records a single base image or index.
+type baseLockEntry struct {
+	Digest    string          `json:"digest"`
+	MediaType types.MediaType `json:"mediaType"`
+
+	// Set for images.
+	Platform string   `json:"platform,omitempty"`
+	Config   string   `json:"config,omitempty"`
+	Layers   []string `json:"layers,omitempty"`
+
+	// Set for indexes.
+	Manifests []baseLockManifest `json:"manifests,omitempty"`
+}
+
+// baseLockManifest records a single platform's image in a base index.
+type baseLockManifest struct {
+	Platform string   `json:"platform"`
+	Digest   string   `json:"digest"`
+	Config   string   `json:"config"`
+	Layers   []string `json:"layers"`
+}
+
+// readBaseLock reads the lock file at path. If update is set, a missing file
+// is treated as an empty lock.
+func readBaseLock(path string, update bool) (*baseLock, error) {
+	lock := &baseLock{Bases: map[string]baseLockEntry{}}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && update {
+		return lock, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading base lock: %v", err)
+	}
+	if err := json.Unmarshal(b, lock); err != nil {
+		return nil, fmt.Errorf("parsing base lock %s: %v", path, err)
+	}
+	if lock.Bases == nil {
+		lock.Bases = map[string]baseLockEntry{}
+	}
+	return lock, nil
+}
+
+// lockedBase wraps getBase to verify each base image against the lock file
+// at path, failing on any drift. If update is set, the lock file is
+// (re)written with the current content of each base instead.
+func lockedBase(getBase build.GetBase, path string, update bool) (build.GetBase, error) {
+	lock, err := readBaseLock(path, update)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bases are fetched concurrently for different importpaths.
+	var mu sync.Mutex
+	return func(ctx context.Context, s string) (name.Reference, build.Result, error) {
+		ref, res, err := getBase(ctx, s)
+		if err != nil {
+			return nil, nil, err
+		}
+		got, err := newBaseLockEntry(res)
+		if err != nil {
+			return nil, nil, fmt.Errorf("computing base lock for %s: %v", ref, err)
+		}
+		key := ref.String()
+
+		mu.Lock()
+		defer mu.Unlock()
+		want, ok := lock.Bases[key]
+		if update {
+			if ok && len(diffBaseLockEntry(want, got)) == 0 {
+				return ref, res, nil
+			}
+			lock.Bases[key] = got
+			if err := build.WriteFileAtomically(path, lock.write); err != nil {
+				return nil, nil, fmt.Errorf("writing base lock: %v", err)
+			}
+			return ref, res, nil
+		}
+		if !ok {
+			return nil, nil, fmt.Errorf("base image %s is not in %s, run with --update-base-lock to add it", key, path)
+		}
+		if diff := diffBaseLockEntry(want, got); len(diff) > 0 {
+			return nil, nil, fmt.Errorf("base image %s has changed since %s was written:\n  %s\nrun with --update-base-lock to accept these changes",
+				key, path, strings.Join(diff, "\n  "))
+		}
+		return ref, res, nil
+	}, nil
+}
+
+func (l *baseLock) write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(l)
+}
+
+// newBaseLockEntry records the content of a base image or index.
+func newBaseLockEntry(res build.Result) (baseLockEntry, error) {
+	var entry baseLockEntry
+	digest, err := res.Digest()
+	if err != nil {
+		return entry, err
+	}
+	mt, err := res.MediaType()
+	if err != nil {
+		return entry, err
+	}
+	entry.Digest = digest.String()
+	entry.MediaType = mt
+
+	switch r := res.(type) {
+	case v1.ImageIndex:
+		im, err := r.IndexManifest()
+		if err != nil {
+			return entry, err
+		}
+		for _, desc := range im.Manifests {
+			img, err := r.Image(desc.Digest)
+			if err != nil {
+				return entry, err
+			}
+			platform := ""
+			if desc.Platform != nil {
+				platform = build.PlatformString(*desc.Platform)
+			}
+			config, layers, err := imageDigests(img)
+			if err != nil {
+				return entry, err
+			}
+			entry.Manifests = append(entry.Manifests, baseLockManifest{
+				Platform: platform,
+				Digest:   desc.Digest.String(),
+				Config:   config,
+				Layers:   layers,
+			})
+		}
+	case v1.Image:
+		cf, err := r.ConfigFile()
+		if err != nil {
+			return entry, err
+		}
+		entry.Platform = build.PlatformString(v1.Platform{OS: cf.OS, Architecture: cf.Architecture})
+		entry.Config, entry.Layers, err = imageDigests(r)
+		if err != nil {
+			return entry, err
+		}
+	default:
+		return entry, fmt.Errorf("unexpected base type %T", res)
+	}
+	return entry, nil
+}
+
+func imageDigests(img v1.Image) (string, []string, error) {
+	config, err := img.ConfigName()
+	if err != nil {
+		return "", nil, err
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return "", nil, err
+	}
+	digests := make([]string, 0, len(layers))
+	for _, l := range layers {
+		d, err := l.Digest()
+		if err != nil {
+			return "", nil, err
+		}
+		digests = append(digests, d.String())
+	}
+	return config.String(), digests, nil
+}
+
+// diffBaseLockEntry returns a human-readable line for each difference
+// between want and got, or nil if they match.
+func diffBaseLockEntry(want, got baseLockEntry) []string {
+	var diff []string
+	if want.Digest != got.Digest {
+		diff = append(diff, fmt.Sprintf("digest: %s -> %s", want.Digest, got.Digest))
+	}
+	if want.MediaType != got.MediaType {
+		diff = append(diff, fmt.Sprintf("mediaType: %s -> %s", want.MediaType, got.MediaType))
+	}
+	if want.Platform != got.Platform {
+		diff = append(diff, fmt.Sprintf("platform: %s -> %s", want.Platform, got.Platform))
+	}
+	diff = append(diff, diffImageDigests("", want.Config, got.Config, want.Layers, got.Layers)...)
+
+	wantManifests := keyManifests(want.Manifests)
+	gotManifests := keyManifests(got.Manifests)
+	var platforms []string
+	for p := range wantManifests {
+		platforms = append(platforms, p)
+	}
+	for p := range gotManifests {
+		if _, ok := wantManifests[p]; !ok {
+			platforms = append(platforms, p)
+		}
+	}
+	sort.Strings(platforms)
+	for _, p := range platforms {
+		w, inWant := wantManifests[p]
+		g, inGot := gotManifests[p]
+		switch {
+		case !inGot:
+			diff = append(diff, fmt.Sprintf("%s: removed (was %s)", p, w.Digest))
+		case !inWant:
+			diff = append(diff, fmt.Sprintf("%s: added (%s)", p, g.Digest))
+		default:
+			if w.Digest != g.Digest {
+				diff = append(diff, fmt.Sprintf("%s: digest: %s -> %s", p, w.Digest, g.Digest))
+			}
+			diff = append(diff, diffImageDigests(p+": ", w.Config, g.Config, w.Layers, g.Layers)...)
+		}
+	}
+	return diff
+}
+
+// keyManifests keys the manifests of an index by platform. An index may have
+// several manifests for the same platform, e.g. attestations for
+// unknown/unknown, or Windows images that only differ in os.version, so
+// these are numbered in the order they appear.
+func keyManifests(manifests []baseLockManifest) map[string]baseLockManifest {
+	keyed := map[string]baseLockManifest{}
+	seen := map[string]int{}
+	for _, m := range manifests {
+		key := m.Platform
+		if n := seen[m.Platform]; n > 0 {
+			key = fmt.Sprintf("%s (#%d)", m.Platform, n+1)
+		}
+		seen[m.Platform]++
+		keyed[key] = m
+	}
+	return keyed
+}
+
+func diffImageDigests(prefix, wantConfig, gotConfig string, wantLayers, gotLayers []string) []string {
+	var diff []string
+	if wantConfig != gotConfig {
+		diff = append(diff, fmt.Sprintf("%sconfig: %s -> %s", prefix, wantConfig, gotConfig))
+	}
+	for i := 0; i < len(wantLayers) || i < len(gotLayers); i++ {
+		switch {
+		case i >= len(gotLayers):
+			diff = append(diff, fmt.Sprintf("%slayer %d: removed (was %s)", prefix, i, wantLayers[i]))
+		case i >= len(wantLayers):
+			diff = append(diff, fmt.Sprintf("%slayer %d: added (%s)", prefix, i, gotLayers[i]))
+		case wantLayers[i] != gotLayers[i]:
+			diff = append(diff, fmt.Sprintf("%slayer %d: %s -> %s", prefix, i, wantLayers[i], gotLayers[i]))
+		}
+	}
+	return diff
+}
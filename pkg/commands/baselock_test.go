@@ -0,0 +1,264 @@
+/*
+Copyright 2021 Google LLC All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/google/ko/pkg/build"
+)
+
+func randomPlatformImage(t *testing.T, p v1.Platform) v1.Image {
+	t.Helper()
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatalf("random.Image() = %v", err)
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		t.Fatalf("ConfigFile() = %v", err)
+	}
+	cf = cf.DeepCopy()
+	cf.OS, cf.Architecture = p.OS, p.Architecture
+	img, err = mutate.ConfigFile(img, cf)
+	if err != nil {
+		t.Fatalf("mutate.ConfigFile() = %v", err)
+	}
+	return img
+}
+
+func platformIndex(imgs map[string]v1.Image) v1.ImageIndex {
+	// Sort, so that the index digest is deterministic.
+	platforms := []string{}
+	for p := range imgs {
+		platforms = append(platforms, p)
+	}
+	sort.Strings(platforms)
+
+	adds := []mutate.IndexAddendum{}
+	for _, p := range platforms {
+		parts := strings.Split(p, "/")
+		adds = append(adds, mutate.IndexAddendum{
+			Add: imgs[p],
+			Descriptor: v1.Descriptor{
+				MediaType: types.DockerManifestSchema2,
+				Platform:  &v1.Platform{OS: parts[0], Architecture: parts[1]},
+			},
+		})
+	}
+	return mutate.IndexMediaType(mutate.AppendManifests(empty.Index, adds...), types.OCIImageIndex)
+}
+
+// fixedBase returns a build.GetBase that resolves every importpath to the
+// current value of *res.
+func fixedBase(ref string, res *build.Result) build.GetBase {
+	return func(context.Context, string) (name.Reference, build.Result, error) {
+		r, err := name.ParseReference(ref)
+		if err != nil {
+			return nil, nil, err
+		}
+		return r, *res, nil
+	}
+}
+
+func TestBaseLock(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "baselock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	amd64 := randomPlatformImage(t, v1.Platform{OS: "linux", Architecture: "amd64"})
+	arm64 := randomPlatformImage(t, v1.Platform{OS: "linux", Architecture: "arm64"})
+	arm64v2 := randomPlatformImage(t, v1.Platform{OS: "linux", Architecture: "arm64"})
+
+	for _, test := range []struct {
+		description string
+		locked      build.Result
+		current     build.Result
+		wantErr     []string
+	}{{
+		description: "image unchanged",
+		locked:      amd64,
+		current:     amd64,
+	}, {
+		description: "image changed",
+		locked:      amd64,
+		current:     arm64,
+		wantErr:     []string{"digest: ", "platform: linux/amd64 -> linux/arm64", "config: ", "layer 0: ", "layer 1: ", "--update-base-lock"},
+	}, {
+		description: "index unchanged",
+		locked:      platformIndex(map[string]v1.Image{"linux/amd64": amd64, "linux/arm64": arm64}),
+		current:     platformIndex(map[string]v1.Image{"linux/amd64": amd64, "linux/arm64": arm64}),
+	}, {
+		description: "index platform changed",
+		locked:      platformIndex(map[string]v1.Image{"linux/amd64": amd64, "linux/arm64": arm64}),
+		current:     platformIndex(map[string]v1.Image{"linux/amd64": amd64, "linux/arm64": arm64v2}),
+		wantErr:     []string{"linux/arm64: digest: ", "linux/arm64: layer 0: "},
+	}, {
+		description: "index platform removed",
+		locked:      platformIndex(map[string]v1.Image{"linux/amd64": amd64, "linux/arm64": arm64}),
+		current:     platformIndex(map[string]v1.Image{"linux/amd64": amd64}),
+		wantErr:     []string{"linux/arm64: removed"},
+	}, {
+		description: "index became image",
+		locked:      platformIndex(map[string]v1.Image{"linux/amd64": amd64}),
+		current:     amd64,
+		wantErr:     []string{"mediaType: ", "linux/amd64: removed"},
+	}} {
+		t.Run(test.description, func(t *testing.T) {
+			path := filepath.Join(dir, strings.ReplaceAll(test.description, " ", "-")+".json")
+			res := test.locked
+
+			// Verifying before the lock has been written fails.
+			if _, err := lockedBase(fixedBase("example.com/base:latest", &res), path, false); err == nil {
+				t.Fatal("lockedBase() with missing lock succeeded, wanted error")
+			}
+
+			update, err := lockedBase(fixedBase("example.com/base:latest", &res), path, true)
+			if err != nil {
+				t.Fatalf("lockedBase(update) = %v", err)
+			}
+			if _, _, err := update(ctx, "ko://example.com/app"); err != nil {
+				t.Fatalf("update() = %v", err)
+			}
+
+			lock, err := readBaseLock(path, false)
+			if err != nil {
+				t.Fatalf("readBaseLock() = %v", err)
+			}
+			want, err := newBaseLockEntry(test.locked)
+			if err != nil {
+				t.Fatalf("newBaseLockEntry() = %v", err)
+			}
+			if diff := cmp.Diff(map[string]baseLockEntry{"example.com/base:latest": want}, lock.Bases); diff != "" {
+				t.Errorf("lock (-want +got): %s", diff)
+			}
+
+			res = test.current
+			verify, err := lockedBase(fixedBase("example.com/base:latest", &res), path, false)
+			if err != nil {
+				t.Fatalf("lockedBase() = %v", err)
+			}
+			_, _, err = verify(ctx, "ko://example.com/app")
+			if len(test.wantErr) == 0 {
+				if err != nil {
+					t.Fatalf("verify() = %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("verify() succeeded, wanted drift error")
+			}
+			for _, want := range test.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("verify() = %v, wanted error containing %q", err, want)
+				}
+			}
+
+			// Updating accepts the drift.
+			update, err = lockedBase(fixedBase("example.com/base:latest", &res), path, true)
+			if err != nil {
+				t.Fatalf("lockedBase(update) = %v", err)
+			}
+			if _, _, err := update(ctx, "ko://example.com/app"); err != nil {
+				t.Fatalf("update() = %v", err)
+			}
+			verify, err = lockedBase(fixedBase("example.com/base:latest", &res), path, false)
+			if err != nil {
+				t.Fatalf("lockedBase() = %v", err)
+			}
+			if _, _, err := verify(ctx, "ko://example.com/app"); err != nil {
+				t.Errorf("verify() after update = %v", err)
+			}
+		})
+	}
+}
+
+func TestBaseLockMissingBase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "baselock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "base.lock.json")
+
+	var res build.Result = randomPlatformImage(t, v1.Platform{OS: "linux", Architecture: "amd64"})
+	update, err := lockedBase(fixedBase("example.com/base:v1", &res), path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := update(context.Background(), "ko://example.com/app"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changing the configured base isn't hidden by the lock.
+	verify, err := lockedBase(fixedBase("example.com/base:v2", &res), path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := verify(context.Background(), "ko://example.com/app"); err == nil || !strings.Contains(err.Error(), "is not in") {
+		t.Errorf("verify() = %v, wanted error for base missing from lock", err)
+	}
+}
+
+func TestBaseLockDuplicatePlatforms(t *testing.T) {
+	unknown := v1.Platform{OS: "unknown", Architecture: "unknown"}
+	index := func(imgs ...v1.Image) v1.ImageIndex {
+		adds := []mutate.IndexAddendum{}
+		for _, img := range imgs {
+			adds = append(adds, mutate.IndexAddendum{
+				Add:        img,
+				Descriptor: v1.Descriptor{Platform: &unknown},
+			})
+		}
+		return mutate.AppendManifests(empty.Index, adds...)
+	}
+	first := randomPlatformImage(t, unknown)
+	second := randomPlatformImage(t, unknown)
+	changed := randomPlatformImage(t, unknown)
+
+	want, err := newBaseLockEntry(index(first, second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := newBaseLockEntry(index(first, changed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff := strings.Join(diffBaseLockEntry(want, got), "\n")
+	if !strings.Contains(diff, "unknown/unknown (#2): digest: ") {
+		t.Errorf("diffBaseLockEntry() = %q, wanted a change to the second unknown/unknown manifest", diff)
+	}
+	if strings.Contains(diff, "unknown/unknown: ") {
+		t.Errorf("diffBaseLockEntry() = %q, wanted no change to the first unknown/unknown manifest", diff)
+	}
+}
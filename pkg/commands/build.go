@@ -15,9 +15,20 @@
 package commands
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
 
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/ko/pkg/build"
 	"github.com/google/ko/pkg/commands/options"
+	"github.com/google/ko/pkg/publish"
 	"github.com/spf13/cobra"
 )
 
@@ -25,6 +36,9 @@ import (
 func addBuild(topLevel *cobra.Command) {
 	po := &options.PublishOptions{}
 	bo := &options.BuildOptions{}
+	wo := &options.WarningOptions{}
+	var quiet bool
+	var format string
 
 	build := &cobra.Command{
 		Use:     "build IMPORTPATH...",
@@ -55,11 +69,16 @@ func addBuild(topLevel *cobra.Command) {
   # daemon as:
   #   ko.local/<import path>
   # This always preserves import paths.
-  ko build --local github.com/foo/bar/cmd/baz github.com/foo/bar/cmd/blah`,
+  ko build --local github.com/foo/bar/cmd/baz github.com/foo/bar/cmd/blah
+
+  # Build and publish a single import path, printing only its digest
+  # for use in scripts.
+  DIGEST=$(ko build --quiet --format='{{.Digest}}' ./cmd/blah)`,
 		Args: cobra.MinimumNArgs(1),
 		RunE: func(_ *cobra.Command, args []string) error {
 			ctx := createCancellableContext()
 			bo.InsecureRegistry = po.InsecureRegistry
+			shareSBOMs(bo, po)
 			builder, err := makeBuilder(ctx, bo)
 			if err != nil {
 				return fmt.Errorf("error creating builder: %v", err)
@@ -69,17 +88,129 @@ func addBuild(topLevel *cobra.Command) {
 				return fmt.Errorf("error creating publisher: %v", err)
 			}
 			defer publisher.Close()
-			images, err := publishImages(ctx, args, publisher, builder)
-			if err != nil {
-				return fmt.Errorf("failed to publish images: %v", err)
+			if quiet && len(args) != 1 {
+				return fmt.Errorf("--quiet requires exactly one import path, got %d", len(args))
 			}
-			for _, img := range images {
-				fmt.Println(img)
+			if format != "" && !quiet {
+				return fmt.Errorf("--format requires --quiet")
 			}
-			return nil
+			return publishAndPrint(ctx, os.Stdout, args, publisher, builder, format)
 		},
 	}
+	build.Flags().BoolVarP(&quiet, "quiet", "q", false,
+		"Build exactly one import path, and print only its image reference to stdout. All diagnostics go to stderr.")
+	build.Flags().StringVar(&format, "format", "",
+		"With --quiet, Go template used to print the published image, with fields .ImportPath, .Version, .Reference, .Repository, .Tag and .Digest. "+
+			".Digest is the digest of the built image, even when publishing by tag (e.g. with --local). Defaults to '{{.Reference}}'.")
 	options.AddPublishArg(build, po)
 	options.AddBuildOptions(build, bo)
+	options.AddWarningsArg(build, wo)
+	build.RunE = withGitHubErrors(po, withWarnings(wo, withTracing(build.RunE)))
 	topLevel.AddCommand(build)
 }
+
+// publishedImage is the data available to --format templates.
+type publishedImage struct {
+	ImportPath string
+	// Version is set for external importpaths, e.g.
+	// ko://example.com/cmd/foo@v1.2.3, and ImportPath excludes it.
+	Version    string
+	Reference  string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// newPublishedImage describes the image built from importpath, and published
+// as ref. Publishers that return tags (e.g. to the daemon) don't tell us the
+// digest, so we take it from the build result instead.
+func newPublishedImage(importpath string, ref name.Reference, res build.Result) (publishedImage, error) {
+	img := publishedImage{
+		ImportPath: importpath,
+		Reference:  ref.String(),
+		Repository: ref.Context().String(),
+	}
+	if _, version, ok := build.ExternalImportPath(importpath); ok {
+		img.ImportPath, img.Version = strings.TrimSuffix(importpath, "@"+version), version
+	}
+	switch r := ref.(type) {
+	case name.Digest:
+		img.Digest = r.DigestStr()
+	case *name.Digest:
+		img.Digest = r.DigestStr()
+	case name.Tag:
+		img.Tag = r.TagStr()
+	case *name.Tag:
+		img.Tag = r.TagStr()
+	}
+	if img.Digest == "" && res != nil {
+		digest, err := res.Digest()
+		if err != nil {
+			return img, fmt.Errorf("computing digest of %s: %v", importpath, err)
+		}
+		img.Digest = digest.String()
+	}
+	return img, nil
+}
+
+// resultRecorder composes with another build.Interface to record the
+// result of each build.
+type resultRecorder struct {
+	build.Interface
+
+	m       sync.Mutex
+	results map[string]build.Result
+}
+
+// Build implements build.Interface
+func (r *resultRecorder) Build(ctx context.Context, ip string) (build.Result, error) {
+	res, err := r.Interface.Build(ctx, ip)
+	if err != nil {
+		return nil, err
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.results[ip] = res
+	return res, nil
+}
+
+// publishAndPrint builds and publishes the import paths, and prints the
+// resulting references to w, one per line, sorted by import path.
+// Nothing is written to w unless everything succeeds.
+func publishAndPrint(ctx context.Context, w io.Writer, importpaths []string, pub publish.Interface, b build.Interface, format string) error {
+	if format == "" {
+		format = "{{.Reference}}"
+	}
+	tmpl, err := template.New("format").Option("missingkey=error").Parse(format)
+	if err != nil {
+		return fmt.Errorf("invalid --format: %v", err)
+	}
+
+	rec := &resultRecorder{Interface: b, results: map[string]build.Result{}}
+	images, err := publishImages(ctx, importpaths, pub, rec)
+	if err != nil {
+		return fmt.Errorf("failed to publish images: %v", err)
+	}
+
+	ips := make([]string, 0, len(images))
+	for ip := range images {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+
+	// Render everything before writing anything, so a bad template
+	// doesn't leave partial output behind.
+	var buf bytes.Buffer
+	for _, ip := range ips {
+		img, err := newPublishedImage(ip, images[ip], rec.results[ip])
+		if err != nil {
+			return err
+		}
+		if err := tmpl.Execute(&buf, img); err != nil {
+			return fmt.Errorf("executing --format: %v", err)
+		}
+		buf.WriteByte('\n')
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
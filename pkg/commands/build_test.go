@@ -0,0 +1,127 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/ko/pkg/build"
+	kotesting "github.com/google/ko/pkg/internal/testing"
+	"github.com/google/ko/pkg/publish"
+)
+
+func TestPublishAndPrint(t *testing.T) {
+	base := mustRepository("gcr.io/quiet")
+	builder, err := build.NewCaching(testBuilder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher, err := publish.NewCaching(kotesting.NewFixedPublish(base, testHashes))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description string
+		importpaths []string
+		format      string
+		want        string
+		wantErr     bool
+	}{{
+		description: "success",
+		importpaths: []string{fooRef},
+		want:        kotesting.ComputeDigest(base, fooRef, fooHash) + "\n",
+	}, {
+		description: "cache hit",
+		importpaths: []string{fooRef},
+		want:        kotesting.ComputeDigest(base, fooRef, fooHash) + "\n",
+	}, {
+		description: "digest only",
+		importpaths: []string{fooRef},
+		format:      "{{.Digest}}",
+		want:        fooHash.String() + "\n",
+	}, {
+		description: "sorted by import path",
+		importpaths: []string{fooRef, barRef},
+		format:      "{{.ImportPath}} {{.Repository}}",
+		want:        barRef + " " + base.String() + "/" + barRef + "\n" + fooRef + " " + base.String() + "/" + fooRef + "\n",
+	}, {
+		description: "failure",
+		importpaths: []string{fooRef, "github.com/awesomesauce/nope"},
+		wantErr:     true,
+	}, {
+		description: "bad template",
+		importpaths: []string{fooRef},
+		format:      "{{.Nope}}",
+		wantErr:     true,
+	}}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			var stdout bytes.Buffer
+			err := publishAndPrint(context.Background(), &stdout, test.importpaths, publisher, builder, test.format)
+			if test.wantErr {
+				if err == nil {
+					t.Error("publishAndPrint() = nil, wanted error")
+				}
+				if stdout.Len() != 0 {
+					t.Errorf("stdout = %q, wanted nothing on failure", stdout.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("publishAndPrint() = %v", err)
+			}
+			if got := stdout.String(); got != test.want {
+				t.Errorf("stdout = %q, wanted %q", got, test.want)
+			}
+		})
+	}
+}
+
+// tagPublisher publishes everything by tag, like the daemon publisher.
+type tagPublisher struct{}
+
+func (tagPublisher) Publish(_ context.Context, _ build.Result, ip string) (name.Reference, error) {
+	return name.NewTag("ko.local/" + ip + ":latest")
+}
+
+func (tagPublisher) Close() error { return nil }
+
+func TestPublishAndPrintDigestFromBuild(t *testing.T) {
+	var stdout bytes.Buffer
+	if err := publishAndPrint(context.Background(), &stdout, []string{fooRef}, tagPublisher{}, testBuilder, "{{.Tag}} {{.Digest}}"); err != nil {
+		t.Fatalf("publishAndPrint() = %v", err)
+	}
+	if got, want := stdout.String(), "latest "+fooHash.String()+"\n"; got != want {
+		t.Errorf("stdout = %q, wanted %q", got, want)
+	}
+}
+
+func TestNewPublishedImageExternal(t *testing.T) {
+	ref, err := name.NewDigest("gcr.io/quiet/gen-v1.4.2@" + fooHash.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := newPublishedImage("ko://example.com/tools/cmd/gen@v1.4.2", ref, nil)
+	if err != nil {
+		t.Fatalf("newPublishedImage() = %v", err)
+	}
+	if img.ImportPath != "ko://example.com/tools/cmd/gen" || img.Version != "v1.4.2" {
+		t.Errorf("newPublishedImage() = %+v, wanted ImportPath ko://example.com/tools/cmd/gen and Version v1.4.2", img)
+	}
+}
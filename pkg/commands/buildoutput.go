@@ -0,0 +1,146 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/publish"
+	"github.com/google/ko/pkg/warnings"
+	specsv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// buildOutput is the content of a --build-output file, which records what
+// was published for auditing.
+type buildOutput struct {
+	// Platform is the platforms the images were built for, as with
+	// --platform.
+	Platform string `json:"platform,omitempty"`
+	// Images are sorted by import path.
+	Images []buildOutputImage `json:"images"`
+	// Warnings are those of the run up to when the file was written.
+	Warnings []warnings.Warning `json:"warnings,omitempty"`
+}
+
+// buildOutputImage records a single published image.
+type buildOutputImage struct {
+	ImportPath string `json:"importPath"`
+	Reference  string `json:"reference"`
+	Digest     string `json:"digest"`
+	// BaseDigest is empty for images without a base image annotation,
+	// e.g. Docker manifest lists.
+	BaseDigest string `json:"baseDigest,omitempty"`
+	BuildTime  string `json:"buildTime"`
+}
+
+// buildOutputRecorder composes with another publish.Interface to record
+// each image it publishes for a --build-output file.
+type buildOutputRecorder struct {
+	publish.Interface
+	now      func() time.Time
+	platform string
+
+	m      sync.Mutex
+	images map[string]buildOutputImage
+}
+
+func newBuildOutputRecorder(pub publish.Interface) *buildOutputRecorder {
+	return &buildOutputRecorder{
+		Interface: pub,
+		now:       time.Now,
+		images:    map[string]buildOutputImage{},
+	}
+}
+
+// Publish implements publish.Interface
+func (r *buildOutputRecorder) Publish(ctx context.Context, br build.Result, s string) (name.Reference, error) {
+	ref, err := r.Interface.Publish(ctx, br, s)
+	if err != nil {
+		return nil, err
+	}
+	ip := strings.TrimPrefix(s, build.StrictScheme)
+	img, err := newPublishedImage(ip, ref, br)
+	if err != nil {
+		return nil, err
+	}
+	base, err := baseImageDigest(br)
+	if err != nil {
+		return nil, err
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.images[ip] = buildOutputImage{
+		ImportPath: ip,
+		Reference:  img.Reference,
+		Digest:     img.Digest,
+		BaseDigest: base,
+		BuildTime:  r.now().UTC().Format(time.RFC3339),
+	}
+	return ref, nil
+}
+
+// write writes the recorded images, sorted by import path so that the files
+// of different runs diff well, and the warnings so far to path.
+func (r *buildOutputRecorder) write(path string) error {
+	r.m.Lock()
+	out := buildOutput{
+		Platform: r.platform,
+		Images:   make([]buildOutputImage, 0, len(r.images)),
+		Warnings: warnings.Default().Warnings(),
+	}
+	for _, img := range r.images {
+		out.Images = append(out.Images, img)
+	}
+	r.m.Unlock()
+	sort.Slice(out.Images, func(i, j int) bool {
+		return out.Images[i].ImportPath < out.Images[j].ImportPath
+	})
+	return build.WriteFileAtomically(path, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	})
+}
+
+// baseImageDigest returns the digest of the base image that res was built
+// on, from the annotation the builder adds, or "" if it has none.
+func baseImageDigest(res build.Result) (string, error) {
+	var annotations map[string]string
+	switch r := res.(type) {
+	case v1.ImageIndex:
+		im, err := r.IndexManifest()
+		if err != nil {
+			return "", err
+		}
+		annotations = im.Annotations
+	case v1.Image:
+		m, err := r.Manifest()
+		if err != nil {
+			return "", err
+		}
+		annotations = m.Annotations
+	}
+	return annotations[specsv1.AnnotationBaseImageDigest], nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/commands/options"
+	kotesting "github.com/google/ko/pkg/internal/testing"
+	"github.com/google/ko/pkg/warnings"
+	specsv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestBuildOutput(t *testing.T) {
+	baseDigest := "sha256:" + strings.Repeat("b", 64)
+	annotated := mutate.Annotations(foo, map[string]string{specsv1.AnnotationBaseImageDigest: baseDigest}).(build.Result)
+	annotatedHash, err := annotated.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder, err := build.NewCaching(kotesting.NewFixedBuild(map[string]build.Result{
+		fooRef: annotated,
+		barRef: bar,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := mustRepository("gcr.io/multi-pass")
+	pub := kotesting.NewFixedPublish(base, map[string]v1.Hash{fooRef: annotatedHash, barRef: barHash})
+
+	dir, err := ioutil.TempDir("", "ko-build-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "build.json")
+
+	// foo comes first in the input, and twice, but is listed once, after bar.
+	inputYAML := "image: " + build.StrictScheme + fooRef + "\n---\n" +
+		"images: [" + build.StrictScheme + barRef + ", " + build.StrictScheme + fooRef + "]\n"
+	fo := &options.FilenameOptions{
+		Filenames:     []string{yamlToTmpFile(t, []byte(inputYAML))},
+		BuildOutput:   output,
+		BuildPlatform: "linux/arm64",
+	}
+	// Warnings of the run are included.
+	c := &warnings.Collector{}
+	defer warnings.SetDefault(warnings.SetDefault(c))
+	warning := warnings.Warning{Code: warnings.SkippedFile, Message: "skipped", File: "foo.txt"}
+	c.Record(warning)
+
+	before := time.Now().Add(-time.Second)
+	if err := resolveFilesToWriter(context.Background(), builder, pub, fo, &options.SelectorOptions{}, nopWriteCloser{ioutil.Discard}); err != nil {
+		t.Fatalf("resolveFilesToWriter() = %v", err)
+	}
+
+	b, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got buildOutput
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("json.Unmarshal() = %v\n%s", err, b)
+	}
+	for i, img := range got.Images {
+		built, err := time.Parse(time.RFC3339, img.BuildTime)
+		if err != nil || built.Before(before) {
+			t.Errorf("%s: buildTime = %q, wanted a time after %v", img.ImportPath, img.BuildTime, before)
+		}
+		got.Images[i].BuildTime = ""
+	}
+	want := buildOutput{Platform: "linux/arm64", Images: []buildOutputImage{{
+		ImportPath: barRef,
+		Reference:  kotesting.ComputeDigest(base, barRef, barHash),
+		Digest:     barHash.String(),
+	}, {
+		ImportPath: fooRef,
+		Reference:  kotesting.ComputeDigest(base, fooRef, annotatedHash),
+		Digest:     annotatedHash.String(),
+		BaseDigest: baseDigest,
+	}}, Warnings: []warnings.Warning{warning}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("--build-output (-want +got): %s", diff)
+	}
+
+	// The output can be used as --previous-refs.
+	refs, err := readPreviousRefs(output)
+	if err != nil {
+		t.Fatalf("readPreviousRefs() = %v", err)
+	}
+	if got, want := refs[fooRef], want.Images[1].Reference; got != want {
+		t.Errorf("readPreviousRefs()[%s] = %s, wanted %s", fooRef, got, want)
+	}
+	if got, err := previousPlatform(output); err != nil || got != "linux/arm64" {
+		t.Errorf("previousPlatform() = %q, %v, wanted linux/arm64", got, err)
+	}
+}
@@ -0,0 +1,371 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/publish"
+)
+
+// globalFiles are files that can change how every importpath is built, so
+// that changing any of them rebuilds everything.
+var globalFiles = map[string]bool{
+	"go.mod":      true,
+	"go.sum":      true,
+	"go.work":     true,
+	"modules.txt": true,
+	".ko.yaml":    true,
+}
+
+// changeSet decides which importpaths are affected by the changes since a
+// git ref, and provides the previously published references of the rest.
+type changeSet struct {
+	since    string
+	dir      string
+	changed  map[string]bool // absolute paths of changed files
+	global   string          // a changed file in globalFiles, if any
+	platform string          // the previous platforms, if they differ
+	previous map[string]string
+
+	// affects calls listPackageDirs to find the directories of the
+	// packages an image is built from, so that tests can stub it.
+	listPackageDirs func(ctx context.Context, s string) ([][]string, error)
+
+	mu       sync.Mutex
+	affected map[string]*changeCheck
+	results  map[string]changeResult
+}
+
+// changeCheck is whether an image is affected, once it's known.
+type changeCheck struct {
+	mu       sync.Mutex
+	done     bool
+	affected bool
+}
+
+// changeResult is how an image was resolved, for the report.
+type changeResult struct {
+	reused bool
+	ref    string
+}
+
+// newChangeSet finds the files that changed in the git repository containing
+// dir since the ref since, and reads the references previously published for
+// each importpath from the file previous. If previous is a --build-output
+// file for other platforms than platform, every image is affected. lister
+// lists the packages that each image is built from.
+func newChangeSet(ctx context.Context, dir, since, previous, platform string, lister build.PackageLister) (*changeSet, error) {
+	if previous == "" {
+		return nil, fmt.Errorf("--changed-since requires --previous-refs")
+	}
+	refs, err := readPreviousRefs(previous)
+	if err != nil {
+		return nil, err
+	}
+	files, err := changedFiles(ctx, dir, since)
+	if err != nil {
+		return nil, err
+	}
+	c := newChangeSetFromFiles(dir, since, files, refs, lister)
+	prev, err := previousPlatform(previous)
+	if err != nil {
+		return nil, err
+	}
+	if prev != "" && prev != platform {
+		c.platform = prev
+	}
+	return c, nil
+}
+
+func newChangeSetFromFiles(dir, since string, files []string, previous map[string]string, lister build.PackageLister) *changeSet {
+	c := &changeSet{
+		since:    since,
+		dir:      dir,
+		changed:  map[string]bool{},
+		previous: previous,
+		affected: map[string]*changeCheck{},
+		results:  map[string]changeResult{},
+	}
+	if lister != nil {
+		c.listPackageDirs = func(ctx context.Context, s string) ([][]string, error) {
+			return realPackageDirs(lister.PackageDirs(ctx, s))
+		}
+	}
+	for _, f := range files {
+		c.changed[f] = true
+		if c.global == "" && globalFiles[filepath.Base(f)] {
+			c.global = f
+		}
+	}
+	return c
+}
+
+// readPreviousRefs reads a JSON object mapping importpaths to the references
+// they were published as, or a --build-output file. The importpaths may be
+// given with or without the ko:// prefix.
+func readPreviousRefs(path string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading previous refs: %v", err)
+	}
+	var raw map[string]string
+	if err := json.Unmarshal(b, &raw); err != nil {
+		var out buildOutput
+		if json.Unmarshal(b, &out) != nil || out.Images == nil {
+			return nil, fmt.Errorf("parsing previous refs %s: %v", path, err)
+		}
+		raw = make(map[string]string, len(out.Images))
+		for _, img := range out.Images {
+			raw[img.ImportPath] = img.Reference
+		}
+	}
+	refs := make(map[string]string, len(raw))
+	for ip, ref := range raw {
+		if _, err := name.ParseReference(ref); err != nil {
+			return nil, fmt.Errorf("previous refs %s: %s: %v", path, ip, err)
+		}
+		refs[strings.TrimPrefix(ip, build.StrictScheme)] = ref
+	}
+	return refs, nil
+}
+
+// previousPlatform returns the platforms recorded in the --build-output file
+// path, or "" if it has none.
+func previousPlatform(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading previous refs: %v", err)
+	}
+	var out buildOutput
+	if json.Unmarshal(b, &out) != nil {
+		return "", nil
+	}
+	return out.Platform, nil
+}
+
+// changedFiles returns the absolute paths of the files that differ between
+// since and the working tree of the git repository containing dir, including
+// untracked files.
+func changedFiles(ctx context.Context, dir, since string) ([]string, error) {
+	root, err := git(ctx, dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	diff, err := git(ctx, dir, "diff", "--name-only", "--no-renames", since, "--")
+	if err != nil {
+		return nil, err
+	}
+	untracked, err := git(ctx, dir, "ls-files", "--others", "--exclude-standard", "--full-name")
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, f := range append(strings.Split(diff, "\n"), strings.Split(untracked, "\n")...) {
+		if f != "" {
+			files = append(files, filepath.Join(root, filepath.FromSlash(f)))
+		}
+	}
+	return files, nil
+}
+
+func git(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v\n%s", strings.Join(args, " "), err, stderr.String())
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// realPackageDirs returns pkgs, the directories of PackageLister.PackageDirs,
+// with symlinks resolved, to compare them to the paths git reports.
+func realPackageDirs(pkgs [][]string, err error) ([][]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	for _, dirs := range pkgs {
+		for i, d := range dirs {
+			if real, err := filepath.EvalSymlinks(d); err == nil {
+				dirs[i] = real
+			}
+		}
+	}
+	return pkgs, nil
+}
+
+// affects reports whether the image for s, a ko:// reference, needs to be
+// rebuilt: when any package it imports, directly or not, or its kodata, has
+// changed. Since the go tool also builds from other files in a package's
+// directory (e.g. embedded files or cgo sources), any change there counts.
+// External importpaths are only affected by changes to globalFiles.
+func (c *changeSet) affects(ctx context.Context, s string) (bool, error) {
+	// Listing packages is slow, so images are checked concurrently, and
+	// each only once. Failures aren't remembered, so that they're retried.
+	c.mu.Lock()
+	check, ok := c.affected[s]
+	if !ok {
+		check = &changeCheck{}
+		c.affected[s] = check
+	}
+	c.mu.Unlock()
+
+	check.mu.Lock()
+	defer check.mu.Unlock()
+	if check.done {
+		return check.affected, nil
+	}
+	affected := c.global != "" || c.platform != ""
+	if !affected {
+		pkgs, err := c.listPackageDirs(ctx, s)
+		if err != nil {
+			return false, err
+		}
+		for _, dirs := range pkgs {
+			if c.touches(dirs) {
+				affected = true
+				break
+			}
+		}
+	}
+	check.done, check.affected = true, affected
+	return affected, nil
+}
+
+// touches reports whether any changed file is directly in one of dirs, or
+// in the kodata of the last, the main package.
+func (c *changeSet) touches(dirs []string) bool {
+	pkgs := make(map[string]bool, len(dirs))
+	for _, d := range dirs {
+		pkgs[d] = true
+	}
+	kodata := ""
+	if len(dirs) > 0 {
+		kodata = filepath.Join(dirs[len(dirs)-1], "kodata") + string(filepath.Separator)
+	}
+	for f := range c.changed {
+		if pkgs[filepath.Dir(f)] || (kodata != "" && strings.HasPrefix(f, kodata)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *changeSet) record(s string, reused bool, ref string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.results[s] = changeResult{reused: reused, ref: ref}
+}
+
+// report writes whether each image was built or reused to w, sorted by
+// importpath.
+func (c *changeSet) report(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.global != "" {
+		if _, err := fmt.Fprintf(w, "Rebuilding every image, since %s changed since %s\n", c.global, c.since); err != nil {
+			return err
+		}
+	} else if c.platform != "" {
+		if _, err := fmt.Fprintf(w, "Rebuilding every image, since they were previously built for %s\n", c.platform); err != nil {
+			return err
+		}
+	}
+	keys := make([]string, 0, len(c.results))
+	for s := range c.results {
+		keys = append(keys, s)
+	}
+	sort.Strings(keys)
+	for _, s := range keys {
+		r := c.results[s]
+		label := "built"
+		if r.reused {
+			label = "reused"
+		}
+		if _, err := fmt.Fprintf(w, "%-6s %s %s\n", label, s, r.ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// changedBuilder only builds images affected by a changeSet.
+type changedBuilder struct {
+	build.Interface
+	changes *changeSet
+}
+
+// Build implements build.Interface
+func (b changedBuilder) Build(ctx context.Context, s string) (build.Result, error) {
+	affected, err := b.changes.affects(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if affected {
+		return b.Interface.Build(ctx, s)
+	}
+	if _, ok := b.changes.previous[strings.TrimPrefix(s, build.StrictScheme)]; !ok {
+		return nil, fmt.Errorf("%s hasn't changed since %s, but has no previous reference in --previous-refs", s, b.changes.since)
+	}
+	// The publisher reuses the previous reference, so there's nothing
+	// to build.
+	return empty.Image, nil
+}
+
+// changedPublisher publishes images affected by a changeSet, and returns
+// the previous references of the rest.
+type changedPublisher struct {
+	publish.Interface
+	changes *changeSet
+}
+
+// Publish implements publish.Interface
+func (p changedPublisher) Publish(ctx context.Context, br build.Result, s string) (name.Reference, error) {
+	affected, err := p.changes.affects(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if affected {
+		ref, err := p.Interface.Publish(ctx, br, s)
+		if err != nil {
+			return nil, err
+		}
+		p.changes.record(s, false, ref.String())
+		return ref, nil
+	}
+	prev := p.changes.previous[strings.TrimPrefix(s, build.StrictScheme)]
+	ref, err := name.ParseReference(prev)
+	if err != nil {
+		return nil, err
+	}
+	p.changes.record(s, true, prev)
+	return ref, nil
+}
@@ -0,0 +1,269 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/commands/options"
+	kotesting "github.com/google/ko/pkg/internal/testing"
+	"golang.org/x/sync/errgroup"
+)
+
+// changedFixture creates a git repository with a module where cmd/a
+// imports lib, and also winlib on windows and extralib with the extra tag,
+// and cmd/b imports nothing but has kodata. It is tagged v1, and then lib is
+// changed in a second commit.
+func changedFixture(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("skipping without git")
+	}
+	dir, err := ioutil.TempDir("", "ko-changed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	write := func(files map[string]string) {
+		for file, content := range files {
+			path := filepath.Join(dir, filepath.FromSlash(file))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	run := func(args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v = %v\n%s", args, err, out)
+		}
+	}
+	commit := func(msg string) {
+		run("add", ".")
+		run("-c", "user.name=ko", "-c", "user.email=ko@example.com", "commit", "-q", "-m", msg)
+	}
+
+	write(map[string]string{
+		"go.mod":               "module example.com/mono\n\ngo 1.16\n",
+		"lib/lib.go":           "package lib\n\nconst Name = \"one\"\n",
+		"cmd/a/main.go":        "package main\n\nimport \"example.com/mono/lib\"\n\nfunc main() { println(lib.Name) }\n",
+		"cmd/a/windows.go":     "//go:build windows\n\npackage main\n\nimport _ \"example.com/mono/winlib\"\n",
+		"cmd/a/extra.go":       "//go:build extra\n\npackage main\n\nimport _ \"example.com/mono/extralib\"\n",
+		"winlib/winlib.go":     "package winlib\n",
+		"extralib/extralib.go": "package extralib\n",
+		"cmd/b/main.go":        "package main\n\nfunc main() {}\n",
+		"cmd/b/kodata/message": "hello\n",
+	})
+	run("init", "-q")
+	commit("initial")
+	run("tag", "v1")
+	write(map[string]string{"lib/lib.go": "package lib\n\nconst Name = \"two\"\n"})
+	commit("change lib")
+	return dir
+}
+
+func TestChangedSinceAffected(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping go list in short mode")
+	}
+	dir := changedFixture(t)
+	defer os.RemoveAll(dir)
+	// The fixture has no vendor directory.
+	defer os.Setenv("GOFLAGS", os.Getenv("GOFLAGS"))
+	os.Setenv("GOFLAGS", "-mod=mod")
+
+	a := build.StrictScheme + "example.com/mono/cmd/a"
+	b := build.StrictScheme + "example.com/mono/cmd/b"
+	// affected lists the packages of the images like a build for platform
+	// with tags does.
+	affectedFor := func(since, platform string, tags ...string) map[string]bool {
+		t.Helper()
+		files, err := changedFiles(context.Background(), dir, since)
+		if err != nil {
+			t.Fatalf("changedFiles() = %v", err)
+		}
+		noBase := func(context.Context, string) (name.Reference, build.Result, error) {
+			return nil, nil, errors.New("listing packages for the given platforms doesn't need a base")
+		}
+		builder, err := build.NewGo(context.Background(), dir, build.WithBaseImages(noBase), build.WithPlatforms(platform), build.WithTags(tags))
+		if err != nil {
+			t.Fatalf("NewGo() = %v", err)
+		}
+		c := newChangeSetFromFiles(dir, since, files, nil, builder.(build.PackageLister))
+		got := map[string]bool{}
+		for _, s := range []string{a, b} {
+			if got[s], err = c.affects(context.Background(), s); err != nil {
+				t.Fatalf("affects(%s) = %v", s, err)
+			}
+		}
+		return got
+	}
+	affected := func(since string) map[string]bool {
+		t.Helper()
+		return affectedFor(since, "linux/amd64")
+	}
+
+	// lib changed, which only cmd/a imports.
+	if got := affected("v1"); !got[a] || got[b] {
+		t.Errorf("affected since v1 = %v, wanted only %s", got, a)
+	}
+	// Nothing changed since HEAD.
+	if got := affected("HEAD"); got[a] || got[b] {
+		t.Errorf("affected since HEAD = %v, wanted nothing", got)
+	}
+
+	// Packages are listed for the platforms and tags that are built for.
+	if err := ioutil.WriteFile(filepath.Join(dir, "winlib", "winlib.go"), []byte("package winlib\n\nconst Name = \"win\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := affected("HEAD"); got[a] || got[b] {
+		t.Errorf("affected for linux with a windows change = %v, wanted nothing", got)
+	}
+	if got := affectedFor("HEAD", "linux/amd64,windows/amd64"); !got[a] || got[b] {
+		t.Errorf("affected for windows with a windows change = %v, wanted only %s", got, a)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "extralib", "extralib.go"), []byte("package extralib\n\nconst Name = \"extra\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := affected("HEAD"); got[a] || got[b] {
+		t.Errorf("affected without tags with a tagged change = %v, wanted nothing", got)
+	}
+	if got := affectedFor("HEAD", "linux/amd64", "extra"); !got[a] || got[b] {
+		t.Errorf("affected with tags with a tagged change = %v, wanted only %s", got, a)
+	}
+
+	// Uncommitted changes to kodata count too.
+	if err := ioutil.WriteFile(filepath.Join(dir, "cmd", "b", "kodata", "message"), []byte("bye\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := affected("HEAD"); got[a] || !got[b] {
+		t.Errorf("affected with kodata change = %v, wanted only %s", got, b)
+	}
+
+	// As do untracked files, and go.mod changes affect everything.
+	if err := ioutil.WriteFile(filepath.Join(dir, "go.sum"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := affected("HEAD"); !got[a] || !got[b] {
+		t.Errorf("affected with go.sum change = %v, wanted everything", got)
+	}
+}
+
+func TestResolveChangedSince(t *testing.T) {
+	base := mustRepository("gcr.io/multi-pass")
+	previousBar := "gcr.io/previous/bar@sha256:" + strings.Repeat("a", 64)
+	refs := yamlToTmpFile(t, []byte(fmt.Sprintf(`{%q: %q}`, build.StrictScheme+barRef, previousBar)))
+	previous, err := readPreviousRefs(refs)
+	if err != nil {
+		t.Fatalf("readPreviousRefs() = %v", err)
+	}
+
+	// Only foo's package changed.
+	c := newChangeSetFromFiles("", "v1", []string{"/src/foo/main.go"}, previous, nil)
+	c.listPackageDirs = func(_ context.Context, s string) ([][]string, error) {
+		return [][]string{{"/src/lib", "/src/" + s[strings.LastIndex(s, "/")+1:]}}, nil
+	}
+
+	input := yamlToTmpFile(t, []byte("foo: "+build.StrictScheme+fooRef+"\nbar: "+build.StrictScheme+barRef+"\n"))
+	got, err := resolveFile(context.Background(), input,
+		changedBuilder{testBuilder, c},
+		changedPublisher{kotesting.NewFixedPublish(base, testHashes), c},
+		&options.FilenameOptions{}, &options.SelectorOptions{})
+	if err != nil {
+		t.Fatalf("resolveFile() = %v", err)
+	}
+	foo := kotesting.ComputeDigest(base, fooRef, fooHash)
+	if want := fmt.Sprintf("foo: %s\nbar: %s\n", foo, previousBar); string(got) != want {
+		t.Errorf("resolveFile() = %q, wanted %q", got, want)
+	}
+
+	var report bytes.Buffer
+	if err := c.report(&report); err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("reused %s%s %s\nbuilt  %s%s %s\n", build.StrictScheme, barRef, previousBar, build.StrictScheme, fooRef, foo)
+	if report.String() != want {
+		t.Errorf("report() = %q, wanted %q", report.String(), want)
+	}
+
+	// Nothing is reused when the previous images were built for other
+	// platforms.
+	c = newChangeSetFromFiles("", "v1", nil, previous, nil)
+	c.platform = "linux/arm64"
+	c.listPackageDirs = func(context.Context, string) ([][]string, error) { return [][]string{{"/src/foo"}}, nil }
+	if affected, err := c.affects(context.Background(), build.StrictScheme+barRef); err != nil || !affected {
+		t.Errorf("affects() = %t, %v, wanted true after a platform change", affected, err)
+	}
+
+	// An unchanged importpath without a previous reference is an error.
+	c = newChangeSetFromFiles("", "v1", nil, map[string]string{}, nil)
+	c.listPackageDirs = func(context.Context, string) ([][]string, error) { return [][]string{{"/src/foo"}}, nil }
+	_, err = resolveFile(context.Background(), input,
+		changedBuilder{testBuilder, c},
+		changedPublisher{kotesting.NewFixedPublish(base, testHashes), c},
+		&options.FilenameOptions{}, &options.SelectorOptions{})
+	if err == nil || !strings.Contains(err.Error(), "no previous reference") {
+		t.Errorf("resolveFile() = %v, wanted error about a missing previous reference", err)
+	}
+}
+
+func TestChangeSetListsConcurrently(t *testing.T) {
+	c := newChangeSetFromFiles("", "v1", nil, nil, nil)
+	// Listing a blocks until b is listed, which would deadlock if a held
+	// the change set while it's listed.
+	bListed := make(chan struct{})
+	var calls int32
+	c.listPackageDirs = func(_ context.Context, s string) ([][]string, error) {
+		atomic.AddInt32(&calls, 1)
+		if s == "a" {
+			<-bListed
+		} else {
+			close(bListed)
+		}
+		return [][]string{{"/src/" + s}}, nil
+	}
+	var g errgroup.Group
+	for _, s := range []string{"a", "b", "a"} {
+		s := s
+		g.Go(func() error {
+			_, err := c.affects(context.Background(), s)
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("listed packages %d times, wanted once per image", calls)
+	}
+}
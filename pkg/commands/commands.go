@@ -32,6 +32,8 @@ func AddKubeCommands(topLevel *cobra.Command) {
 	addBuild(topLevel)
 	addRun(topLevel)
 	addDeps(topLevel)
+	addWarm(topLevel)
+	addUpdateBase(topLevel)
 	addCompletion(topLevel)
 }
 
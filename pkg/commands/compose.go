@@ -0,0 +1,155 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/commands/options"
+	"gopkg.in/yaml.v3"
+)
+
+// The subset of the compose file format that we generate, see:
+// https://github.com/compose-spec/compose-spec/blob/master/spec.md
+type composeFile struct {
+	Services map[string]composeService `yaml:"services"`
+}
+
+type composeService struct {
+	Image string `yaml:"image"`
+}
+
+// checkComposeFile returns an error if --compose-file can't be written when
+// resolving fo: it's written once the files have all been resolved into a
+// single output, from the references published for them.
+func checkComposeFile(co *options.ComposeOptions, fo *options.FilenameOptions) error {
+	if co.File == "" {
+		return nil
+	}
+	if fo.OutputDir != "" || fo.InPlace {
+		return errors.New("--compose-file can't be used with --output-dir or --in-place")
+	}
+	if fo.DryRun || fo.Watch {
+		return errors.New("--compose-file can't be used with --dry-run, which publishes nothing, or --watch, which never finishes resolving")
+	}
+	return nil
+}
+
+// composeYAML returns a compose file with a service for each of the
+// published references, named by composeServiceNames.
+func composeYAML(refs map[string]name.Reference) ([]byte, error) {
+	ips := make([]string, 0, len(refs))
+	for ip := range refs {
+		ips = append(ips, ip)
+	}
+	names := composeServiceNames(ips)
+
+	compose := composeFile{Services: make(map[string]composeService, len(refs))}
+	for ip, ref := range refs {
+		compose.Services[names[ip]] = composeService{Image: ref.String()}
+	}
+
+	buf := &bytes.Buffer{}
+	e := yaml.NewEncoder(buf)
+	e.SetIndent(2)
+	if err := e.Encode(compose); err != nil {
+		return nil, err
+	}
+	if err := e.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// composeServiceNames names the service of each import path after its last
+// element, e.g. "server" for example.com/app/cmd/server, or as many of its
+// last elements as it takes to tell it from the others, e.g. "a-server" and
+// "b-server" for example.com/a/server and example.com/b/server.
+func composeServiceNames(ips []string) map[string]string {
+	ips = append([]string(nil), ips...)
+	sort.Strings(ips)
+	elems := make(map[string][]string, len(ips))
+	for _, ip := range ips {
+		// Versions of external import paths aren't part of the name.
+		path, _, _ := build.ExternalImportPath(ip)
+		elems[ip] = strings.Split(path, "/")
+	}
+
+	names := make(map[string]string, len(ips))
+	used := map[string]bool{}
+	for n := 1; len(names) < len(ips); n++ {
+		candidates := map[string][]string{}
+		for _, ip := range ips {
+			if _, ok := names[ip]; ok {
+				continue
+			}
+			e := elems[ip]
+			if n < len(e) {
+				e = e[len(e)-n:]
+			}
+			name := composeServiceName(strings.Join(e, "-"))
+			candidates[name] = append(candidates[name], ip)
+		}
+		sorted := make([]string, 0, len(candidates))
+		for name := range candidates {
+			sorted = append(sorted, name)
+		}
+		sort.Strings(sorted)
+		for _, name := range sorted {
+			clash := candidates[name]
+			if len(clash) > 1 || used[name] {
+				exhausted := true
+				for _, ip := range clash {
+					exhausted = exhausted && n >= len(elems[ip])
+				}
+				if !exhausted {
+					// Try one more element of each.
+					continue
+				}
+			}
+			// Once every element is used, clashes (e.g. of import paths
+			// that only differ in version) are told apart by number.
+			for _, ip := range clash {
+				unique := name
+				for i := 2; used[unique]; i++ {
+					unique = fmt.Sprintf("%s-%d", name, i)
+				}
+				used[unique] = true
+				names[ip] = unique
+			}
+		}
+	}
+	return names
+}
+
+// composeServiceName replaces the characters that aren't allowed in a
+// service name.
+func composeServiceName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '-'
+	}, s)
+}
@@ -0,0 +1,152 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/commands/options"
+	kotesting "github.com/google/ko/pkg/internal/testing"
+	"github.com/google/ko/pkg/publish"
+	"gopkg.in/yaml.v3"
+)
+
+func TestComposeFile(t *testing.T) {
+	base := mustRepository("gcr.io/compose")
+	rec := &publish.Recorder{Publisher: kotesting.NewFixedPublish(base, testHashes)}
+
+	inputYAML := []byte("image: " + build.StrictScheme + fooRef + "\n---\nimage: " + build.StrictScheme + barRef + "\n")
+	buf := bytes.NewBuffer(nil)
+	fo := &options.FilenameOptions{Filenames: []string{yamlToTmpFile(t, inputYAML)}}
+	builder, err := build.NewCaching(testBuilder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resolveFilesToWriter(context.Background(), builder, rec, fo, &options.SelectorOptions{}, nopWriteCloser{buf}); err != nil {
+		t.Fatalf("resolveFilesToWriter() = %v", err)
+	}
+
+	b, err := composeYAML(rec.References())
+	if err != nil {
+		t.Fatalf("composeYAML() = %v", err)
+	}
+	var got composeFile
+	if err := yaml.Unmarshal(b, &got); err != nil {
+		t.Fatalf("yaml.Unmarshal() = %v", err)
+	}
+	// The services run the same images as the resolved documents.
+	want := composeFile{Services: map[string]composeService{
+		"foo": {Image: kotesting.ComputeDigest(base, fooRef, fooHash)},
+		"bar": {Image: kotesting.ComputeDigest(base, barRef, barHash)},
+	}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("compose file (-want +got) = %s\n%s", diff, b)
+	}
+	for _, svc := range want.Services {
+		if !bytes.Contains(buf.Bytes(), []byte(svc.Image)) {
+			t.Errorf("resolved output does not contain %s", svc.Image)
+		}
+	}
+}
+
+func TestComposeServiceNames(t *testing.T) {
+	for _, test := range []struct {
+		desc string
+		ips  []string
+		want map[string]string
+	}{{
+		desc: "last elements",
+		ips:  []string{"example.com/app/cmd/server", "ko://example.com/app/cmd/Worker_2"},
+		want: map[string]string{
+			"example.com/app/cmd/server":        "server",
+			"ko://example.com/app/cmd/Worker_2": "worker_2",
+		},
+	}, {
+		desc: "same last element",
+		ips:  []string{"example.com/a/server", "example.com/b/server", "example.com/b/client"},
+		want: map[string]string{
+			"example.com/a/server": "a-server",
+			"example.com/b/server": "b-server",
+			"example.com/b/client": "client",
+		},
+	}, {
+		desc: "suffix of another",
+		ips:  []string{"example.com/server", "example.com/x/example.com/server"},
+		want: map[string]string{
+			"example.com/server":               "example.com-server",
+			"example.com/x/example.com/server": "x-example.com-server",
+		},
+	}, {
+		desc: "versions",
+		ips:  []string{"example.com/cmd/tool@v1.0.0", "example.com/cmd/tool@v2.0.0"},
+		want: map[string]string{
+			"example.com/cmd/tool@v1.0.0": "example.com-cmd-tool",
+			"example.com/cmd/tool@v2.0.0": "example.com-cmd-tool-2",
+		},
+	}} {
+		t.Run(test.desc, func(t *testing.T) {
+			if diff := cmp.Diff(test.want, composeServiceNames(test.ips)); diff != "" {
+				t.Errorf("composeServiceNames() (-want +got) = %s", diff)
+			}
+		})
+	}
+}
+
+func TestCheckComposeFile(t *testing.T) {
+	for _, test := range []struct {
+		desc    string
+		co      options.ComposeOptions
+		fo      options.FilenameOptions
+		wantErr bool
+	}{{
+		desc: "no compose file",
+		fo:   options.FilenameOptions{OutputDir: "out", DryRun: true},
+	}, {
+		desc: "single output",
+		co:   options.ComposeOptions{File: "compose.yaml"},
+		fo:   options.FilenameOptions{Output: "release.yaml"},
+	}, {
+		desc:    "output dir",
+		co:      options.ComposeOptions{File: "compose.yaml"},
+		fo:      options.FilenameOptions{OutputDir: "out"},
+		wantErr: true,
+	}, {
+		desc:    "in place",
+		co:      options.ComposeOptions{File: "compose.yaml"},
+		fo:      options.FilenameOptions{InPlace: true},
+		wantErr: true,
+	}, {
+		desc:    "dry run",
+		co:      options.ComposeOptions{File: "compose.yaml"},
+		fo:      options.FilenameOptions{DryRun: true},
+		wantErr: true,
+	}, {
+		desc:    "watch",
+		co:      options.ComposeOptions{File: "compose.yaml"},
+		fo:      options.FilenameOptions{Watch: true},
+		wantErr: true,
+	}} {
+		t.Run(test.desc, func(t *testing.T) {
+			err := checkComposeFile(&test.co, &test.fo)
+			if (err != nil) != test.wantErr {
+				t.Errorf("checkComposeFile() = %v, wanted error: %t", err, test.wantErr)
+			}
+		})
+	}
+}
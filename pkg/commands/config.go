@@ -18,11 +18,17 @@ package commands
 
 import (
 	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -32,69 +38,392 @@ import (
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/daemon"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/google/ko/pkg/build"
 	"github.com/google/ko/pkg/commands/options"
 	"github.com/google/ko/pkg/publish"
+	"github.com/google/ko/pkg/warnings"
+	specsv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/spf13/cast"
 	"github.com/spf13/viper"
+	"golang.org/x/sync/semaphore"
 	"golang.org/x/tools/go/packages"
 )
 
 const (
 	// configDefaultBaseImage is the default base image if not specified in .ko.yaml.
 	configDefaultBaseImage = "gcr.io/distroless/static:nonroot"
+
+	// cgoDefaultBaseImage replaces configDefaultBaseImage for cgo builds,
+	// since they need a C library.
+	cgoDefaultBaseImage = "gcr.io/distroless/base:nonroot"
 )
 
 var (
 	defaultBaseImage   string
 	baseImageOverrides map[string]string
 	buildConfigs       map[string]build.Config
+	buildConfigTracker *build.ConfigTracker
+	buildEnvironment   []string
+	goBinary           string
+	prebuildHook       []string
+	maxBinarySize      string
+	dockerRepoMappings []options.DockerRepoMapping
+	allowedImportPaths []string
+
+	// strictPaths and nonStrictPaths are patterns of the files whose
+	// documents must, or needn't, be fully resolved, whatever
+	// --assert-fully-resolved says.
+	strictPaths    []string
+	nonStrictPaths []string
+
+	// defaultPlatformBaseImages and platformBaseImageOverrides are base
+	// images configured per platform, keyed by patterns like linux/* or
+	// windows/amd64, instead of defaultBaseImage and baseImageOverrides.
+	defaultPlatformBaseImages  map[string]string
+	platformBaseImageOverrides map[string]map[string]string
 )
 
-// getBaseImage returns a function that determines the base image for a given import path.
-// If the `bo.BaseImage` parameter is non-empty, it overrides base image configuration from `.ko.yaml`.
-func getBaseImage(platform string, bo *options.BuildOptions) build.GetBase {
-	return func(ctx context.Context, s string) (name.Reference, build.Result, error) {
-		s = strings.TrimPrefix(s, build.StrictScheme)
-		// Viper configuration file keys are case insensitive, and are
-		// returned as all lowercase.  This means that import paths with
-		// uppercase must be normalized for matching here, e.g.
-		//    github.com/GoogleCloudPlatform/foo/cmd/bar
-		// comes through as:
-		//    github.com/googlecloudplatform/foo/cmd/bar
-		baseImage, ok := baseImageOverrides[strings.ToLower(s)]
+// baseImageName returns the name of the base image for the given import path.
+// Cgo builds default to an image with glibc, unless a default base image was
+// configured explicitly.
+func baseImageName(s string, bo *options.BuildOptions) string {
+	if bo.BaseImage != "" {
+		return bo.BaseImage
+	}
+	if key, ok := baseOverrideKey(s); ok {
+		if baseImage, ok := baseImageOverrides[key]; ok {
+			return baseImage
+		}
+	}
+	if bo.Cgo && defaultBaseImage == configDefaultBaseImage {
+		return cgoDefaultBaseImage
+	}
+	return defaultBaseImage
+}
+
+// platformBaseImages returns the base images configured per platform for the
+// given import path, or nil if it has a single base image.
+func platformBaseImages(s string, bo *options.BuildOptions) map[string]string {
+	if bo.BaseImage != "" {
+		return nil
+	}
+	if key, ok := baseOverrideKey(s); ok {
+		// An override with a single base wins over the default's
+		// platforms.
+		return platformBaseImageOverrides[key]
+	}
+	return defaultPlatformBaseImages
+}
+
+// baseOverrideKey returns the key of baseImageOverrides that applies to the
+// given import path: the import path itself, or else the pattern matching it
+// (e.g. github.com/org/repo/cmd/legacy/...) with the longest literal prefix.
+// Ties go to the longer pattern, and then the one that sorts first.
+func baseOverrideKey(s string) (string, bool) {
+	// Viper configuration file keys are case insensitive, and are
+	// returned as all lowercase.  This means that import paths with
+	// uppercase must be normalized for matching here, e.g.
+	//    github.com/GoogleCloudPlatform/foo/cmd/bar
+	// comes through as:
+	//    github.com/googlecloudplatform/foo/cmd/bar
+	s = strings.ToLower(strings.TrimPrefix(s, build.StrictScheme))
+	if _, ok := baseImageOverrides[s]; ok {
+		return s, true
+	}
+	if _, ok := platformBaseImageOverrides[s]; ok {
+		return s, true
+	}
+	best, bestPrefix := "", -1
+	consider := func(key string) {
+		prefix := strings.IndexAny(key, "*?")
+		if i := strings.Index(key, "..."); i >= 0 && (prefix < 0 || i < prefix) {
+			prefix = i
+		}
+		if prefix < 0 {
+			// Import paths only match themselves.
+			return
+		}
+		if ok, err := build.MatchImportPath(key, s); err != nil || !ok {
+			return
+		}
+		if prefix > bestPrefix || prefix == bestPrefix && (len(key) > len(best) || len(key) == len(best) && key < best) {
+			best, bestPrefix = key, prefix
+		}
+	}
+	for key := range baseImageOverrides {
+		consider(key)
+	}
+	for key := range platformBaseImageOverrides {
+		consider(key)
+	}
+	return best, bestPrefix >= 0
+}
+
+// parseBasePlatform parses a key of a per-platform base image configuration:
+// an os, and optionally an architecture and variant, any of which may be "*"
+// to match anything, like the fields left out.
+func parseBasePlatform(pattern string) (v1.Platform, error) {
+	if pattern == "*" {
+		return v1.Platform{}, nil
+	}
+	p, err := build.ParsePlatformSelector(pattern)
+	if err != nil {
+		return v1.Platform{}, err
+	}
+	for _, f := range []*string{&p.OS, &p.Architecture, &p.Variant} {
+		if *f == "*" {
+			*f = ""
+		}
+	}
+	return p, nil
+}
+
+// platformBaseImage returns the base image in bases of the most specific
+// pattern that matches p, with ties broken lexically, and false if none does.
+func platformBaseImage(bases map[string]string, p v1.Platform) (string, bool) {
+	best, bestFields := "", -1
+	for pattern := range bases {
+		bp, err := parseBasePlatform(pattern)
+		if err != nil {
+			continue
+		}
+		if (bp.OS != "" && bp.OS != p.OS) ||
+			(bp.Architecture != "" && bp.Architecture != p.Architecture) ||
+			(bp.Variant != "" && bp.Variant != p.Variant) {
+			continue
+		}
+		fields := 0
+		for _, f := range []string{bp.OS, bp.Architecture, bp.Variant} {
+			if f != "" {
+				fields++
+			}
+		}
+		if fields > bestFields || (fields == bestFields && pattern < best) {
+			best, bestFields = pattern, fields
+		}
+	}
+	if bestFields < 0 {
+		return "", false
+	}
+	return bases[best], true
+}
+
+// getPlatformBase returns the base for the given import path when its base
+// images are configured per platform in bases. For a single platform, that's
+// the base image for it. Otherwise, it's an index of the manifests for each
+// requested platform from its base image, each annotated with the base it
+// came from.
+func getPlatformBase(ctx context.Context, s, platform string, bases map[string]string, fetch func(ctx context.Context, s, baseImage string) (name.Reference, build.Result, error)) (name.Reference, build.Result, error) {
+	var specs []string
+	var requested []v1.Platform
+	if platform != "all" {
+		for _, spec := range strings.Split(platform, ",") {
+			spec = strings.TrimSpace(spec)
+			p, err := build.ParsePlatformSelector(spec)
+			if err != nil {
+				return nil, nil, err
+			}
+			specs, requested = append(specs, spec), append(requested, p)
+		}
+	}
+
+	// Only fetch the base images of the requested platforms.
+	wanted := map[string]bool{}
+	for i, p := range requested {
+		baseImage, ok := platformBaseImage(bases, p)
 		if !ok {
-			baseImage = defaultBaseImage
+			return nil, nil, fmt.Errorf("no base image is configured for %s on %s", strings.TrimPrefix(s, build.StrictScheme), specs[i])
 		}
-		if bo.BaseImage != "" {
-			baseImage = bo.BaseImage
+		if len(requested) == 1 {
+			return fetch(ctx, s, baseImage)
 		}
-		nameOpts := []name.Option{}
-		if bo.InsecureRegistry {
-			nameOpts = append(nameOpts, name.Insecure)
+		wanted[baseImage] = true
+	}
+	if platform == "all" {
+		for _, baseImage := range bases {
+			wanted[baseImage] = true
 		}
-		ref, err := name.ParseReference(baseImage, nameOpts...)
+	}
+	baseImages := make([]string, 0, len(wanted))
+	for baseImage := range wanted {
+		baseImages = append(baseImages, baseImage)
+	}
+	sort.Strings(baseImages)
+
+	var first name.Reference
+	adds := []mutate.IndexAddendum{}
+	for _, baseImage := range baseImages {
+		ref, base, err := fetch(ctx, s, baseImage)
 		if err != nil {
-			return nil, nil, fmt.Errorf("parsing base image (%q): %v", baseImage, err)
+			return nil, nil, err
+		}
+		if first == nil {
+			first = ref
+		}
+		manifests, err := baseManifests(base)
+		if err != nil {
+			return nil, nil, fmt.Errorf("base image %s: %v", ref, err)
 		}
+		for _, m := range manifests {
+			// Leave out the platforms of this base that weren't
+			// requested, or that are another base's.
+			if m.desc.Platform == nil || !platformRequested(requested, *m.desc.Platform) {
+				continue
+			}
+			if chosen, _ := platformBaseImage(bases, *m.desc.Platform); chosen != baseImage {
+				continue
+			}
+			anns := map[string]string{}
+			for k, v := range m.desc.Annotations {
+				anns[k] = v
+			}
+			anns[specsv1.AnnotationBaseImageDigest] = m.desc.Digest.String()
+			if _, ok := ref.(name.Tag); ok {
+				anns[specsv1.AnnotationBaseImageName] = ref.Name()
+			}
+			adds = append(adds, mutate.IndexAddendum{
+				Add: m.img,
+				Descriptor: v1.Descriptor{
+					MediaType:   m.desc.MediaType,
+					Platform:    m.desc.Platform,
+					Annotations: anns,
+				},
+			})
+		}
+	}
+	return first, mutate.IndexMediaType(mutate.AppendManifests(empty.Index, adds...), types.OCIImageIndex), nil
+}
 
-		// For ko.local, look in the daemon.
-		if ref.Context().RegistryStr() == publish.LocalDomain {
-			img, err := daemon.Image(ref)
-			return ref, img, err
+// platformRequested reports whether p is one of the requested platforms,
+// which are all platforms if there are none.
+func platformRequested(requested []v1.Platform, p v1.Platform) bool {
+	if len(requested) == 0 {
+		return true
+	}
+	for _, r := range requested {
+		if (r.OS == "" || r.OS == p.OS) && (r.Architecture == "" || r.Architecture == p.Architecture) && (r.Variant == "" || r.Variant == p.Variant) {
+			return true
 		}
+	}
+	return false
+}
 
-		userAgent := ua()
-		if bo.UserAgent != "" {
-			userAgent = bo.UserAgent
+// emulationImage returns the image of the base index for p, or if it has
+// none, the one that build.BasePlatformEmulate builds p on, which the build
+// warns about.
+func emulationImage(desc *remote.Descriptor, p v1.Platform) (v1.Image, error) {
+	idx, err := desc.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range im.Manifests {
+		if child.Platform != nil && platformRequested([]v1.Platform{p}, *child.Platform) {
+			return desc.Image()
 		}
-		ropt := []remote.Option{
-			remote.WithAuthFromKeychain(authn.DefaultKeychain),
-			remote.WithUserAgent(userAgent),
-			remote.WithContext(ctx),
+	}
+	child, ok := build.EmulationBase(p, im.Manifests)
+	if !ok {
+		return desc.Image()
+	}
+	return idx.Image(child.Digest)
+}
+
+// baseChildren returns a matcher for the children of res, if it's an index,
+// that building for platform uses, so that only those are cached, or nil for
+// all of them.
+func baseChildren(res build.Result, platform string) (match.Matcher, error) {
+	idx, ok := res.(v1.ImageIndex)
+	if !ok {
+		return nil, nil
+	}
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	children, ok, err := build.BaseChildren(platform, im.Manifests)
+	if err != nil || !ok {
+		return nil, err
+	}
+	used := map[v1.Hash]bool{}
+	for _, desc := range children {
+		used[desc.Digest] = true
+	}
+	return func(desc v1.Descriptor) bool { return used[desc.Digest] }, nil
+}
+
+// baseManifest is an image of a base, with its descriptor in the base's
+// index.
+type baseManifest struct {
+	img  v1.Image
+	desc v1.Descriptor
+}
+
+// baseManifests returns the images of base, which is an index, or an image
+// whose platform is taken from its config.
+func baseManifests(base build.Result) ([]baseManifest, error) {
+	if idx, ok := base.(v1.ImageIndex); ok {
+		im, err := idx.IndexManifest()
+		if err != nil {
+			return nil, err
+		}
+		var manifests []baseManifest
+		for _, desc := range im.Manifests {
+			if desc.MediaType != types.OCIManifestSchema1 && desc.MediaType != types.DockerManifestSchema2 {
+				return nil, fmt.Errorf("%q has unexpected mediaType %q", desc.Digest, desc.MediaType)
+			}
+			img, err := idx.Image(desc.Digest)
+			if err != nil {
+				return nil, err
+			}
+			manifests = append(manifests, baseManifest{img: img, desc: desc})
 		}
+		return manifests, nil
+	}
+	img, ok := base.(v1.Image)
+	if !ok {
+		return nil, fmt.Errorf("failed to interpret base as image: %v", base)
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	desc, err := partial.Descriptor(img)
+	if err != nil {
+		return nil, err
+	}
+	desc.Platform = &v1.Platform{OS: cf.OS, Architecture: cf.Architecture}
+	return []baseManifest{{img: img, desc: *desc}}, nil
+}
 
+// getBaseImage returns a function that determines the base image for a given import path.
+// If the `bo.BaseImage` parameter is non-empty, it overrides base image configuration from `.ko.yaml`.
+func getBaseImage(platform string, bo *options.BuildOptions) build.GetBase {
+	// Limit how many bases we fetch from registries at once, separately
+	// from builds and pushes.
+	var pulls *semaphore.Weighted
+	if bo.ConcurrentBasePulls > 0 {
+		pulls = semaphore.NewWeighted(int64(bo.ConcurrentBasePulls))
+	}
+	cacheDir := baseCacheDir()
+	if bo.NoCacheBase {
+		cacheDir = ""
+	}
+	cache := newBaseCache(cacheDir)
+	resolutions := newBaseResolutions()
+	daemonBases := newDaemonBases()
+	verifier, verifierErr := baseVerifier(bo)
+	emulate := bo.BasePlatformPolicy == string(build.BasePlatformEmulate)
+	fetch := func(ctx context.Context, s, baseImage string) (name.Reference, build.Result, error) {
 		// Using --platform=all will use an image index for the base,
 		// otherwise we'll resolve it to the appropriate platform.
 		//
@@ -116,27 +445,272 @@ func getBaseImage(platform string, bo *options.BuildOptions) build.GetBase {
 			if len(parts) > 3 {
 				return nil, nil, fmt.Errorf("too many slashes in platform spec: %s", platform)
 			}
+		}
+
+		// For oci-layout:// and tarball://, read the file.
+		if ref, ok := parseFileBase(baseImage); ok {
+			if verifier != nil {
+				return nil, nil, fmt.Errorf("can't verify the signature of base %s, which isn't in a registry", ref)
+			}
+			log.Printf("Using base %s for %s", ref, s)
+			res, err := ref.load(p, multiplatform, emulate)
+			return ref, res, err
+		}
+
+		nameOpts := []name.Option{}
+		if bo.InsecureRegistry {
+			nameOpts = append(nameOpts, name.Insecure)
+		}
+
+		// For docker-daemon://, read the daemon's image, or else pull it
+		// from its registry.
+		if ref, ok, err := parseDaemonBase(baseImage, nameOpts...); ok {
+			if err != nil {
+				return nil, nil, fmt.Errorf("parsing base image (%q): %v", baseImage, err)
+			}
+			if verifier != nil {
+				return nil, nil, fmt.Errorf("can't verify the signature of base %s in the local daemon", baseImage)
+			}
+			if multiplatform {
+				return nil, nil, fmt.Errorf("base %s can't be used for --platform=%s, the docker daemon only has an image for one platform", baseImage, platform)
+			}
+			if img, ok := daemonBases.get(ctx, ref, s); ok {
+				return ref, img, nil
+			}
+			baseImage = ref.String()
+		}
+
+		ref, err := name.ParseReference(baseImage, nameOpts...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing base image (%q): %v", baseImage, err)
+		}
+
+		// For ko.local, look in the daemon.
+		if ref.Context().RegistryStr() == publish.LocalDomain {
+			if verifier != nil {
+				return nil, nil, fmt.Errorf("can't verify the signature of base %s in the local daemon", ref)
+			}
+			img, err := daemon.Image(ref)
+			return ref, img, err
+		}
+
+		userAgent := ua()
+		if bo.UserAgent != "" {
+			userAgent = bo.UserAgent
+		}
+		ropt := []remote.Option{
+			remote.WithAuthFromKeychain(authn.DefaultKeychain),
+			remote.WithUserAgent(userAgent),
+			remote.WithContext(ctx),
+		}
+		// verify verifies the signature of the base, with digest d,
+		// before it's used.
+		verify := func(d v1.Hash) error {
+			if verifier == nil {
+				return nil
+			}
+			if err := verifier.Verify(ref.Context().Digest(d.String()), ropt...); err != nil {
+				return fmt.Errorf("verifying the signature of base %s: %v", ref, err)
+			}
+			return nil
+		}
+
+		if !multiplatform && platform != "" {
 			ropt = append(ropt, remote.WithPlatform(p))
 		}
 
+		// Cached bases are used when the reference still points at them,
+		// or when the registry can't be reached. Digests always point at
+		// the same base, so they aren't checked. Multi-platform bases are
+		// cached for the platforms they're fetched for, with only the
+		// children that building those uses.
+		cacheKey := platform
+		stats := warming(ctx)
+		_, isTag := ref.(name.Tag)
+		resolve := func() (v1.Hash, build.Result, error) {
+			cachedDigest, cached, hit := cache.get(ref, cacheKey)
+			// The tag was last seen at cachedDigest, even when warming
+			// ignores what's cached.
+			seen := hit && isTag
+			hit = hit && stats == nil
+			if _, ok := ref.(name.Digest); ok && hit {
+				log.Printf("Using cached base %s", ref)
+				return cachedDigest, cached, nil
+			}
+
+			if pulls != nil {
+				if err := pulls.Acquire(ctx, 1); err != nil {
+					return v1.Hash{}, nil, err
+				}
+				defer pulls.Release(1)
+			}
+			desc, err := remote.Get(ref, ropt...)
+			if err != nil {
+				if hit {
+					warnings.Warnf(warnings.BaseCache, "using the cached base %s, since fetching it failed: %v", ref, err)
+					return cachedDigest, cached, nil
+				}
+				return v1.Hash{}, nil, err
+			}
+			if hit && desc.Digest == cachedDigest {
+				return cachedDigest, cached, nil
+			}
+			if seen && desc.Digest != cachedDigest {
+				switch {
+				case stats != nil:
+					log.Printf("Updating base %s from %s to %s", ref, cachedDigest, desc.Digest)
+				case bo.RequirePinnedBase:
+					return v1.Hash{}, nil, fmt.Errorf("base %s has moved from %s to %s since it was cached, run `ko update-base` to accept it", ref, cachedDigest, desc.Digest)
+				default:
+					warnings.Warnf(warnings.BaseMoved, "base %s has moved from %s to %s since it was cached, pin it by digest, or pass --require-pinned-base to fail instead", ref, cachedDigest, desc.Digest)
+				}
+			}
+			var res build.Result
+			switch desc.MediaType {
+			case types.OCIImageIndex, types.DockerManifestList:
+				if multiplatform {
+					res, err = desc.ImageIndex()
+				} else if emulate && platform != "" {
+					res, err = emulationImage(desc, p)
+				} else {
+					res, err = desc.Image()
+				}
+			default:
+				res, err = desc.Image()
+			}
+			if err != nil {
+				return v1.Hash{}, nil, err
+			}
+			if cacheDir == "" {
+				return desc.Digest, res, nil
+			}
+			children, err := baseChildren(res, platform)
+			if err != nil {
+				return v1.Hash{}, nil, err
+			}
+			size, err := cache.put(ref, cacheKey, desc.Digest, res, children)
+			if err != nil {
+				if stats != nil {
+					return v1.Hash{}, nil, err
+				}
+				// The base is still usable, it'll be cached next time.
+				log.Printf("Not caching base %s: %v", ref, err)
+				return desc.Digest, res, nil
+			}
+			if stats != nil {
+				stats.addBase(ref, cacheKey, size)
+			}
+			return desc.Digest, res, nil
+		}
 		log.Printf("Using base %s for %s", ref, s)
-		desc, err := remote.Get(ref, ropt...)
+		digest, res, err := resolutions.get(ref, cacheKey, resolve)
 		if err != nil {
 			return nil, nil, err
 		}
-		switch desc.MediaType {
-		case types.OCIImageIndex, types.DockerManifestList:
-			if multiplatform {
-				idx, err := desc.ImageIndex()
-				return ref, idx, err
-			}
-			img, err := desc.Image()
-			return ref, img, err
-		default:
-			img, err := desc.Image()
-			return ref, img, err
+		if err := verify(digest); err != nil {
+			return nil, nil, err
+		}
+		return ref, res, nil
+	}
+	return func(ctx context.Context, s string) (name.Reference, build.Result, error) {
+		if verifierErr != nil {
+			return nil, nil, verifierErr
+		}
+		if bases := platformBaseImages(s, bo); bases != nil {
+			return getPlatformBase(ctx, s, platform, bases, fetch)
+		}
+		return fetch(ctx, s, baseImageName(s, bo))
+	}
+}
+
+// checkBaseOptions returns an error if the flags of bo that configure how
+// base images are fetched can't be used together, so that they fail before
+// anything is built rather than when the first base is fetched.
+func checkBaseOptions(bo *options.BuildOptions) error {
+	if bo.RequirePinnedBase && (bo.NoCacheBase || baseCacheDir() == "") {
+		return errors.New("--require-pinned-base compares bases to the base image cache, so it can't be used with --no-cache-base")
+	}
+	return checkBaseVerifierFlags(bo)
+}
+
+// checkBaseVerifierFlags returns an error if the --verify-base-signature
+// flags of bo are incomplete.
+func checkBaseVerifierFlags(bo *options.BuildOptions) error {
+	if bo.VerifyBaseSignature == "" {
+		if bo.VerifyBaseSignatureIssuer != "" || bo.VerifyBaseSignatureRoots != "" ||
+			bo.VerifyBaseSignatureRekorKeys != "" || bo.VerifyBaseSignatureCTLogKeys != "" {
+			return errors.New("--verify-base-signature-issuer, --verify-base-signature-roots, --verify-base-signature-rekor-keys " +
+				"and --verify-base-signature-ctlog-keys require --verify-base-signature")
+		}
+		return nil
+	}
+	if bo.VerifyBaseSignatureRoots == "" {
+		return errors.New("--verify-base-signature requires --verify-base-signature-roots, the CAs to trust")
+	}
+	if bo.VerifyBaseSignatureRekorKeys == "" || bo.VerifyBaseSignatureCTLogKeys == "" {
+		return errors.New("--verify-base-signature requires --verify-base-signature-rekor-keys and --verify-base-signature-ctlog-keys, " +
+			"the transparency logs to trust")
+	}
+	return nil
+}
+
+// baseVerifier returns the verifier of base image signatures that bo asks
+// for, or nil if it doesn't.
+func baseVerifier(bo *options.BuildOptions) (*publish.CosignVerifier, error) {
+	if err := checkBaseVerifierFlags(bo); err != nil {
+		return nil, err
+	}
+	if bo.VerifyBaseSignature == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(bo.VerifyBaseSignatureRoots)
+	if err != nil {
+		return nil, fmt.Errorf("reading --verify-base-signature-roots: %v", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("--verify-base-signature-roots %s: no PEM certificates found", bo.VerifyBaseSignatureRoots)
+	}
+	rekorKeys, err := readPublicKeys("--verify-base-signature-rekor-keys", bo.VerifyBaseSignatureRekorKeys)
+	if err != nil {
+		return nil, err
+	}
+	ctLogKeys, err := readPublicKeys("--verify-base-signature-ctlog-keys", bo.VerifyBaseSignatureCTLogKeys)
+	if err != nil {
+		return nil, err
+	}
+	return &publish.CosignVerifier{
+		Identity:  bo.VerifyBaseSignature,
+		Issuer:    bo.VerifyBaseSignatureIssuer,
+		Roots:     roots,
+		RekorKeys: rekorKeys,
+		CTLogKeys: ctLogKeys,
+	}, nil
+}
+
+// readPublicKeys reads the PEM public keys in the file at path, passed
+// with flag.
+func readPublicKeys(flag, path string) ([]crypto.PublicKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", flag, err)
+	}
+	var keys []crypto.PublicKey
+	for {
+		var block *pem.Block
+		if block, b = pem.Decode(b); block == nil {
+			break
 		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %v", flag, path, err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s %s: no PEM public keys found", flag, path)
 	}
+	return keys, nil
 }
 
 func getTimeFromEnv(env string) (*v1.Time, error) {
@@ -156,14 +730,19 @@ func getCreationTime() (*v1.Time, error) {
 	return getTimeFromEnv("SOURCE_DATE_EPOCH")
 }
 
+// getKoDataCreationTime returns the time for files in kodata, which is the
+// creation time of the image unless KO_DATA_DATE_EPOCH is set.
 func getKoDataCreationTime() (*v1.Time, error) {
+	if os.Getenv("KO_DATA_DATE_EPOCH") == "" {
+		return getCreationTime()
+	}
 	return getTimeFromEnv("KO_DATA_DATE_EPOCH")
 }
 
 func createCancellableContext() context.Context {
-	signals := make(chan os.Signal)
+	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(runContext)
 
 	go func() {
 		<-signals
@@ -176,6 +755,31 @@ func createCancellableContext() context.Context {
 func createBuildConfigMap(workingDirectory string, configs []build.Config) (map[string]build.Config, error) {
 	buildConfigsByImportPath := make(map[string]build.Config)
 	for i, config := range configs {
+		if config.MaxBinarySize != "" {
+			if _, err := build.ParseByteSize(config.MaxBinarySize); err != nil {
+				return nil, fmt.Errorf("'builds': entry #%d has an invalid maxBinarySize: %v", i, err)
+			}
+		}
+		for selector := range config.Platforms {
+			if _, err := build.ParsePlatformSelector(selector); err != nil {
+				return nil, fmt.Errorf("'builds': entry #%d has invalid platforms: %v", i, err)
+			}
+		}
+
+		// An entry with `main: "..."` applies to every importpath that
+		// isn't matched by another entry.
+		if config.Main == build.DefaultConfigKey {
+			buildConfigsByImportPath[build.DefaultConfigKey] = config
+			continue
+		}
+
+		// Fully qualified importpath patterns (e.g. example.com/app/cmd/...)
+		// can't be resolved to a single package, so use them as-is.
+		if isImportPathPattern(config.Main) {
+			buildConfigsByImportPath[config.Main] = config
+			continue
+		}
+
 		// Make sure to behave like GoReleaser by defaulting to the current
 		// directory in case the build or main field is not set, check
 		// https://goreleaser.com/customization/build/ for details
@@ -198,24 +802,119 @@ func createBuildConfigMap(workingDirectory string, configs []build.Config) (map[
 
 		// By default, paths configured in the builds section are considered
 		// local import paths, therefore add a "./" equivalent as a prefix to
-		// the constructured import path
-		localImportPath := fmt.Sprint(".", string(filepath.Separator), path)
+		// the constructured import path. If there's no such directory, but
+		// main looks like a fully qualified import path, use it as-is.
+		importPathToLoad := fmt.Sprint(".", string(filepath.Separator), path)
+		if _, err := os.Stat(filepath.Join(baseDir, path)); err != nil && isQualifiedImportPath(config.Main) {
+			importPathToLoad = config.Main
+		}
 
-		pkgs, err := packages.Load(&packages.Config{Mode: packages.NeedName, Dir: baseDir}, localImportPath)
+		pkgs, err := packages.Load(&packages.Config{Mode: packages.NeedName, Dir: baseDir}, importPathToLoad)
 		if err != nil {
-			return nil, fmt.Errorf("'builds': entry #%d does not contain a valid local import path (%s) for directory (%s): %v", i, localImportPath, baseDir, err)
+			return nil, fmt.Errorf("'builds': entry #%d does not contain a valid local import path (%s) for directory (%s): %v", i, importPathToLoad, baseDir, err)
 		}
 
 		if len(pkgs) != 1 {
 			return nil, fmt.Errorf("'builds': entry #%d results in %d local packages, only 1 is expected", i, len(pkgs))
 		}
-		importPath := pkgs[0].PkgPath
+		pkg := pkgs[0]
+		importPath := pkg.PkgPath
+
+		// These entries can never match anything we build, but they may be
+		// typos or leftovers, so let the user know rather than failing.
+		switch {
+		case len(pkg.Errors) > 0:
+			warnings.Warnf(warnings.BuildConfig, "'builds': entry #%d (%s) does not correspond to a buildable package: %v", i, importPathToLoad, pkg.Errors[0])
+		case pkg.Name != "main":
+			warnings.Warnf(warnings.BuildConfig, "'builds': entry #%d (%s) is package %s, not package main, so it will never be built", i, importPath, pkg.Name)
+		}
+		if _, ok := buildConfigsByImportPath[importPath]; ok {
+			warnings.Warnf(warnings.BuildConfig, "'builds': entry #%d (%s) overrides an earlier entry for the same import path", i, importPath)
+		}
 		buildConfigsByImportPath[importPath] = config
 	}
 
 	return buildConfigsByImportPath, nil
 }
 
+// warnUnusedBuildConfigs warns about 'builds' entries in .ko.yaml that didn't
+// apply to any importpath that we built.
+func warnUnusedBuildConfigs() {
+	if buildConfigTracker == nil {
+		return
+	}
+	for _, key := range buildConfigTracker.Unused() {
+		if key == build.DefaultConfigKey {
+			continue
+		}
+		warnings.Warnf(warnings.BuildConfig, "'builds': entry for %s did not match any import path that was built", key)
+	}
+}
+
+// isQualifiedImportPath reports whether main looks like a fully qualified
+// import path, i.e. its first element looks like a domain name.
+func isQualifiedImportPath(main string) bool {
+	if strings.HasPrefix(main, ".") || filepath.IsAbs(main) {
+		return false
+	}
+	first := strings.SplitN(main, "/", 2)[0]
+	return strings.Contains(first, ".")
+}
+
+// isImportPathPattern reports whether main is a fully qualified importpath
+// pattern, rather than a local path to a main package.
+func isImportPathPattern(main string) bool {
+	if main == "" || strings.HasPrefix(main, ".") || filepath.IsAbs(main) {
+		return false
+	}
+	return strings.ContainsAny(main, "*?[") || strings.HasSuffix(main, "/...")
+}
+
+// parseBaseImages parses a base image configuration, which is either an
+// image reference, or a map of platform patterns to image references.
+func parseBaseImages(value interface{}) (string, map[string]string, error) {
+	if ref, ok := value.(string); ok {
+		if err := checkBaseImage(ref); err != nil {
+			return "", nil, err
+		}
+		return ref, nil, nil
+	}
+	bases, err := cast.ToStringMapStringE(value)
+	if err != nil || len(bases) == 0 {
+		return "", nil, fmt.Errorf("expected an image reference, or a map of platforms to image references, got %v", value)
+	}
+	for pattern, ref := range bases {
+		if _, err := parseBasePlatform(pattern); err != nil {
+			return "", nil, err
+		}
+		if err := checkBaseImage(ref); err != nil {
+			return "", nil, fmt.Errorf("%s: %v", pattern, err)
+		}
+	}
+	return "", bases, nil
+}
+
+// checkBaseImage checks that ref is an image reference, possibly in the
+// docker daemon, or the path of an OCI layout or tarball, with its scheme.
+func checkBaseImage(ref string) error {
+	if r, ok := parseFileBase(ref); ok {
+		if r.path == "" {
+			return fmt.Errorf("%q has no path", ref)
+		}
+		return nil
+	}
+	if _, ok, err := parseDaemonBase(ref); ok {
+		if err != nil {
+			return fmt.Errorf("error parsing %q as image reference: %v", ref, err)
+		}
+		return nil
+	}
+	if _, err := name.ParseReference(ref); err != nil {
+		return fmt.Errorf("error parsing %q as image reference: %v", ref, err)
+	}
+	return nil
+}
+
 // loadConfig reads build configuration from defaults, environment variables, and the `.ko.yaml` config file.
 func loadConfig(workingDirectory string) error {
 	v := viper.New()
@@ -227,6 +926,10 @@ func loadConfig(workingDirectory string) error {
 	v.SetConfigName(".ko") // .yaml is implicit
 	v.SetEnvPrefix("KO")
 	v.AutomaticEnv()
+	// goBinary is a path, so its environment variable is KO_GO_PATH.
+	if err := v.BindEnv("goBinary", "KO_GO_PATH"); err != nil {
+		return err
+	}
 
 	if override := os.Getenv("KO_CONFIG_PATH"); override != "" {
 		v.AddConfigPath(override)
@@ -240,26 +943,82 @@ func loadConfig(workingDirectory string) error {
 		}
 	}
 
-	ref := v.GetString("defaultBaseImage")
-	if _, err := name.ParseReference(ref); err != nil {
-		return fmt.Errorf("'defaultBaseImage': error parsing %q as image reference: %v", ref, err)
+	ref, bases, err := parseBaseImages(v.Get("defaultBaseImage"))
+	if err != nil {
+		return fmt.Errorf("'defaultBaseImage': %v", err)
 	}
-	defaultBaseImage = ref
+	defaultBaseImage, defaultPlatformBaseImages = ref, bases
 
 	baseImageOverrides = make(map[string]string)
-	overrides := v.GetStringMapString("baseImageOverrides")
-	for key, value := range overrides {
-		if _, err := name.ParseReference(value); err != nil {
-			return fmt.Errorf("'baseImageOverrides': error parsing %q as image reference: %v", value, err)
+	platformBaseImageOverrides = make(map[string]map[string]string)
+	for key, value := range v.GetStringMap("baseImageOverrides") {
+		if _, err := build.MatchImportPath(key, ""); err != nil {
+			return fmt.Errorf("'baseImageOverrides': %v", err)
+		}
+		ref, bases, err := parseBaseImages(value)
+		if err != nil {
+			return fmt.Errorf("'baseImageOverrides': %s: %v", key, err)
+		}
+		if bases != nil {
+			platformBaseImageOverrides[key] = bases
+		} else {
+			baseImageOverrides[key] = ref
+		}
+	}
+
+	// Not using v.GetStringSlice, since that would split a single value
+	// on whitespace, which is meaningful in e.g. GOFLAGS.
+	buildEnvironment = nil
+	if env := v.Get("env"); env != nil {
+		list, ok := env.([]interface{})
+		if !ok {
+			return fmt.Errorf("configuration section 'env' must be a list of KEY=VALUE strings")
+		}
+		for _, e := range list {
+			kv, ok := e.(string)
+			if !ok {
+				return fmt.Errorf("configuration section 'env' must be a list of KEY=VALUE strings, got %v", e)
+			}
+			buildEnvironment = append(buildEnvironment, kv)
+		}
+	}
+
+	goBinary = v.GetString("goBinary")
+	prebuildHook = v.GetStringSlice("prebuild")
+	maxBinarySize = v.GetString("maxBinarySize")
+
+	allowedImportPaths = v.GetStringSlice("allowedImportPaths")
+	for _, p := range allowedImportPaths {
+		if _, err := build.MatchImportPath(p, ""); err != nil {
+			return fmt.Errorf("'allowedImportPaths': %v", err)
+		}
+	}
+
+	strictPaths = v.GetStringSlice("strictPaths")
+	nonStrictPaths = v.GetStringSlice("nonStrictPaths")
+	if err := checkStrictPaths(strictPaths, nonStrictPaths); err != nil {
+		return err
+	}
+
+	dockerRepoMappings = nil
+	if err := v.UnmarshalKey("dockerRepos", &dockerRepoMappings); err != nil {
+		return fmt.Errorf("configuration section 'dockerRepos' cannot be parsed: %v", err)
+	}
+	for i, m := range dockerRepoMappings {
+		if m.Prefix == "" || m.Repo == "" {
+			return fmt.Errorf("'dockerRepos': entry #%d must set both prefix and repo", i)
+		}
+		if _, err := name.NewRepository(m.Repo); err != nil {
+			if _, err := name.NewRegistry(m.Repo); err != nil {
+				return fmt.Errorf("'dockerRepos': entry #%d: failed to parse %q as repository: %v", i, m.Repo, err)
+			}
 		}
-		baseImageOverrides[key] = value
 	}
 
 	var builds []build.Config
 	if err := v.UnmarshalKey("builds", &builds); err != nil {
 		return fmt.Errorf("configuration section 'builds' cannot be parsed")
 	}
-	var err error
 	buildConfigs, err = createBuildConfigMap(workingDirectory, builds)
 	return err
 }
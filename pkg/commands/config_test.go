@@ -17,13 +17,46 @@ limitations under the License.
 package commands
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/google/ko/pkg/build"
 	"github.com/google/ko/pkg/commands/options"
+	"github.com/google/ko/pkg/publish"
+	"github.com/google/ko/pkg/registrytest"
+	specsv1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 func TestOverrideDefaultBaseImageUsingBuildOption(t *testing.T) {
@@ -33,7 +66,7 @@ func TestOverrideDefaultBaseImageUsingBuildOption(t *testing.T) {
 		t.Fatalf("could not create test registry server: %v", err)
 	}
 	defer s.Close()
-	baseImage := fmt.Sprintf("%s/%s", s.Listener.Addr().String(), namespace)
+	baseImage := fmt.Sprintf("%s/%s", s.Host(), namespace)
 	wantDigest, err := crane.Digest(baseImage)
 	if err != nil {
 		t.Fatalf("crane.Digest(%s): %v", baseImage, err)
@@ -59,6 +92,119 @@ func TestOverrideDefaultBaseImageUsingBuildOption(t *testing.T) {
 	}
 }
 
+func TestConcurrentBasePulls(t *testing.T) {
+	defer func(o map[string]string) { baseImageOverrides = o }(baseImageOverrides)
+
+	for _, test := range []struct {
+		limit   int
+		wantMax int
+	}{
+		{limit: 1, wantMax: 1},
+		{limit: 2, wantMax: 2},
+		// Without a limit, pulls overlap.
+		{limit: 0, wantMax: 8},
+	} {
+		t.Run(fmt.Sprint(test.limit), func(t *testing.T) {
+			// The latency makes unlimited pulls overlap.
+			reg := registrytest.New(registrytest.WithLatency(10 * time.Millisecond))
+			defer reg.Close()
+			img, err := random.Image(1024, 1)
+			if err != nil {
+				t.Fatalf("random.Image() = %v", err)
+			}
+			// Each importpath has its own base, since each base is only
+			// pulled once.
+			baseImageOverrides = map[string]string{}
+			for i := 0; i < 8; i++ {
+				tag, err := name.NewTag(fmt.Sprintf("%s/base:%d", reg.Host(), i))
+				if err != nil {
+					t.Fatalf("NewTag() = %v", err)
+				}
+				if err := remote.Write(tag, img, remote.WithJobs(1)); err != nil {
+					t.Fatalf("Write() = %v", err)
+				}
+				baseImageOverrides[fmt.Sprintf("example.com/app%d", i)] = tag.String()
+			}
+			if got := reg.MaxConcurrentRequests(); got != 1 {
+				t.Fatalf("pushing the base made %d concurrent requests, wanted 1", got)
+			}
+
+			baseFn := getBaseImage("", &options.BuildOptions{ConcurrentBasePulls: test.limit, NoCacheBase: true})
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					if _, _, err := baseFn(context.Background(), fmt.Sprintf("ko://example.com/app%d", i)); err != nil {
+						t.Errorf("getBaseImage() = %v", err)
+					}
+				}(i)
+			}
+			wg.Wait()
+			got := reg.MaxConcurrentRequests()
+			if got > test.wantMax {
+				t.Errorf("pulled with %d concurrent requests, wanted at most %d", got, test.wantMax)
+			}
+			if test.limit == 0 && got < 2 {
+				t.Errorf("pulled with %d concurrent requests without a limit, wanted several", got)
+			}
+		})
+	}
+}
+
+func TestBaseImageNameCgo(t *testing.T) {
+	oldDefault, oldOverrides := defaultBaseImage, baseImageOverrides
+	defer func() { defaultBaseImage, baseImageOverrides = oldDefault, oldOverrides }()
+	baseImageOverrides = map[string]string{
+		"example.com/override": "example.com/base:override",
+	}
+
+	for _, test := range []struct {
+		description string
+		defaultBase string
+		bo          *options.BuildOptions
+		importpath  string
+		want        string
+	}{{
+		description: "static default",
+		defaultBase: configDefaultBaseImage,
+		bo:          &options.BuildOptions{},
+		importpath:  "ko://example.com/helloworld",
+		want:        configDefaultBaseImage,
+	}, {
+		description: "cgo default",
+		defaultBase: configDefaultBaseImage,
+		bo:          &options.BuildOptions{Cgo: true},
+		importpath:  "ko://example.com/helloworld",
+		want:        cgoDefaultBaseImage,
+	}, {
+		description: "cgo with configured default",
+		defaultBase: "example.com/base:configured",
+		bo:          &options.BuildOptions{Cgo: true},
+		importpath:  "ko://example.com/helloworld",
+		want:        "example.com/base:configured",
+	}, {
+		description: "cgo with override",
+		defaultBase: configDefaultBaseImage,
+		bo:          &options.BuildOptions{Cgo: true},
+		importpath:  "ko://example.com/override",
+		want:        "example.com/base:override",
+	}, {
+		description: "cgo with base image flag",
+		defaultBase: configDefaultBaseImage,
+		bo:          &options.BuildOptions{Cgo: true, BaseImage: "example.com/base:flag"},
+		importpath:  "ko://example.com/helloworld",
+		want:        "example.com/base:flag",
+	}} {
+		t.Run(test.description, func(t *testing.T) {
+			defaultBaseImage = test.defaultBase
+			if got := baseImageName(test.importpath, test.bo); got != test.want {
+				t.Errorf("baseImageName() = %s, wanted %s", got, test.want)
+			}
+		})
+	}
+}
+
 // TestDefaultBaseImage is a canary-type test for ensuring that config has been read when creating a builder.
 func TestDefaultBaseImage(t *testing.T) {
 	_, err := NewBuilder(context.Background(), &options.BuildOptions{
@@ -73,6 +219,502 @@ func TestDefaultBaseImage(t *testing.T) {
 	}
 }
 
+func TestGoBinary(t *testing.T) {
+	defer func(b string) { goBinary = b }(goBinary)
+
+	if err := loadConfig("testdata/gobinary"); err != nil {
+		t.Fatal(err)
+	}
+	if goBinary != "go1.21rc2" {
+		t.Errorf("goBinary = %q, wanted go1.21rc2 from .ko.yaml", goBinary)
+	}
+
+	// The environment overrides .ko.yaml.
+	os.Setenv("KO_GO_PATH", "/usr/local/go1.20/bin/go")
+	defer os.Unsetenv("KO_GO_PATH")
+	if err := loadConfig("testdata/gobinary"); err != nil {
+		t.Fatal(err)
+	}
+	if goBinary != "/usr/local/go1.20/bin/go" {
+		t.Errorf("goBinary = %q, wanted KO_GO_PATH", goBinary)
+	}
+
+	os.Unsetenv("KO_GO_PATH")
+	if err := loadConfig("testdata/env"); err != nil {
+		t.Fatal(err)
+	}
+	if goBinary != "" {
+		t.Errorf("goBinary = %q, wanted it unset", goBinary)
+	}
+}
+
+func TestPrebuildHooks(t *testing.T) {
+	defer func(hook []string) { prebuildHook = hook }(prebuildHook)
+
+	if err := loadConfig("testdata/prebuild"); err != nil {
+		t.Fatal(err)
+	}
+	// The global hook may be a string, which is split on spaces.
+	if diff := cmp.Diff([]string{"go", "generate", "./..."}, prebuildHook); diff != "" {
+		t.Errorf("prebuildHook (-want +got): %s", diff)
+	}
+	if diff := cmp.Diff([]string{"make", "assets"}, buildConfigs["example.com/app/cmd/..."].Prebuild); diff != "" {
+		t.Errorf("builds prebuild (-want +got): %s", diff)
+	}
+}
+
+func TestMaxBinarySize(t *testing.T) {
+	defer func(size string) { maxBinarySize = size }(maxBinarySize)
+
+	if err := loadConfig("testdata/maxbinarysize"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := maxBinarySize, "20MB"; got != want {
+		t.Errorf("maxBinarySize = %q, wanted %q", got, want)
+	}
+	if got, want := buildConfigs["example.com/app/cmd/..."].MaxBinarySize, "8MiB"; got != want {
+		t.Errorf("builds maxBinarySize = %q, wanted %q", got, want)
+	}
+
+	_, err := createBuildConfigMap("../..", []build.Config{{Main: "example.com/app/cmd/...", MaxBinarySize: "big"}})
+	if err == nil || !strings.Contains(err.Error(), "invalid maxBinarySize") {
+		t.Errorf("createBuildConfigMap() = %v, wanted an invalid maxBinarySize error", err)
+	}
+}
+
+func TestBuildConfigPlatforms(t *testing.T) {
+	if err := loadConfig("testdata/platforms"); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]build.PlatformConfig{
+		"linux/arm64": {
+			Env:     []string{"CGO_ENABLED=1", "CC=aarch64-linux-gnu-gcc"},
+			Ldflags: build.StringArray{"-X main.arch=arm64"},
+		},
+		"windows": {Flags: build.FlagArray{"-tags=windows"}},
+		"linux/arm/v7": {
+			CC:  "arm-linux-gnueabihf-gcc",
+			CXX: "arm-linux-gnueabihf-g++",
+		},
+	}
+	if diff := cmp.Diff(want, buildConfigs["example.com/app/cmd/..."].Platforms); diff != "" {
+		t.Errorf("builds platforms (-want +got) = %s", diff)
+	}
+	if !buildConfigs["example.com/sqlite/cmd/..."].Cgo {
+		t.Error("builds cgo = false, wanted true")
+	}
+
+	_, err := createBuildConfigMap("../..", []build.Config{{
+		Main:      "example.com/app/cmd/...",
+		Platforms: map[string]build.PlatformConfig{"linux/arm/v7/x": {}},
+	}})
+	if err == nil || !strings.Contains(err.Error(), "invalid platforms") {
+		t.Errorf("createBuildConfigMap() = %v, wanted an invalid platforms error", err)
+	}
+}
+
+func TestBaseImageOverridePatterns(t *testing.T) {
+	defer func(d string, o map[string]string, pd map[string]string, po map[string]map[string]string) {
+		defaultBaseImage, baseImageOverrides, defaultPlatformBaseImages, platformBaseImageOverrides = d, o, pd, po
+	}(defaultBaseImage, baseImageOverrides, defaultPlatformBaseImages, platformBaseImageOverrides)
+
+	if err := loadConfig("testdata/baseoverrides"); err != nil {
+		t.Fatal(err)
+	}
+	bo := &options.BuildOptions{}
+	for _, test := range []struct {
+		importpath string
+		want       string
+		wantBases  map[string]string
+	}{{
+		// The longest prefix wins, and the import path itself over that.
+		importpath: "ko://github.com/org/repo/cmd/legacy/migrate",
+		want:       "gcr.io/distroless/base:debug",
+	}, {
+		importpath: "ko://github.com/org/repo/cmd/legacy",
+		want:       "gcr.io/distroless/base:debug",
+	}, {
+		importpath: "ko://github.com/org/repo/cmd/legacy/tool",
+		want:       "busybox",
+	}, {
+		importpath: "ko://github.com/Org/Repo/cmd/legacy/Migrate",
+		want:       "gcr.io/distroless/base:debug",
+	}, {
+		importpath: "ko://github.com/org/repo/cmd/app",
+		want:       "gcr.io/distroless/static:nonroot",
+		wantBases:  map[string]string{"linux/*": "gcr.io/distroless/static:debug"},
+	}, {
+		importpath: "ko://github.com/org/repository/cmd/app",
+		want:       "gcr.io/distroless/static:nonroot",
+	}, {
+		importpath: "ko://example.com/other",
+		want:       "gcr.io/distroless/static:nonroot",
+	}} {
+		t.Run(test.importpath, func(t *testing.T) {
+			if got := baseImageName(test.importpath, bo); got != test.want {
+				t.Errorf("baseImageName() = %s, wanted %s", got, test.want)
+			}
+			if diff := cmp.Diff(test.wantBases, platformBaseImages(test.importpath, bo)); diff != "" {
+				t.Errorf("platformBaseImages() (-want +got) = %s", diff)
+			}
+		})
+	}
+
+	// Overrides that can't be used fail loading the config, before
+	// anything is built.
+	err := loadConfig("testdata/badbaseoverride")
+	if err == nil || !strings.Contains(err.Error(), "github.com/org/repo/cmd/legacy/...") {
+		t.Errorf("loadConfig() = %v, wanted an error for the override", err)
+	}
+}
+
+func TestPlatformBaseImagesConfig(t *testing.T) {
+	defer func(d string, o map[string]string, pd map[string]string, po map[string]map[string]string) {
+		defaultBaseImage, baseImageOverrides, defaultPlatformBaseImages, platformBaseImageOverrides = d, o, pd, po
+	}(defaultBaseImage, baseImageOverrides, defaultPlatformBaseImages, platformBaseImageOverrides)
+
+	if err := loadConfig("testdata/platformbases"); err != nil {
+		t.Fatal(err)
+	}
+	wantDefault := map[string]string{
+		"linux/*":       "gcr.io/distroless/static:nonroot",
+		"windows/amd64": "mcr.microsoft.com/windows/nanoserver:ltsc2022",
+	}
+	if diff := cmp.Diff(wantDefault, defaultPlatformBaseImages); diff != "" {
+		t.Errorf("defaultBaseImage (-want +got) = %s", diff)
+	}
+	if defaultBaseImage != "" {
+		t.Errorf("defaultBaseImage = %q, wanted none with bases per platform", defaultBaseImage)
+	}
+	wantOverrides := map[string]map[string]string{
+		"example.com/app/cmd/tool": {"*": "gcr.io/distroless/base:nonroot"},
+	}
+	if diff := cmp.Diff(wantOverrides, platformBaseImageOverrides); diff != "" {
+		t.Errorf("baseImageOverrides per platform (-want +got) = %s", diff)
+	}
+	if diff := cmp.Diff(map[string]string{"example.com/app/cmd/plain": "gcr.io/distroless/base:debug"}, baseImageOverrides); diff != "" {
+		t.Errorf("baseImageOverrides (-want +got) = %s", diff)
+	}
+
+	bo := &options.BuildOptions{}
+	for _, test := range []struct {
+		importpath string
+		want       map[string]string
+	}{
+		{importpath: "ko://example.com/app/cmd/other", want: wantDefault},
+		{importpath: "ko://example.com/app/cmd/tool", want: wantOverrides["example.com/app/cmd/tool"]},
+		{importpath: "ko://example.com/app/cmd/plain"},
+	} {
+		if diff := cmp.Diff(test.want, platformBaseImages(test.importpath, bo)); diff != "" {
+			t.Errorf("platformBaseImages(%s) (-want +got) = %s", test.importpath, diff)
+		}
+	}
+	if got := platformBaseImages("ko://example.com/app/cmd/other", &options.BuildOptions{BaseImage: "example.com/base"}); got != nil {
+		t.Errorf("platformBaseImages() with --base-image = %v, wanted nil", got)
+	}
+
+	// The plain string form still works.
+	if err := loadConfig("testdata/config"); err != nil {
+		t.Fatal(err)
+	}
+	if defaultBaseImage != "gcr.io/distroless/base:nonroot" || defaultPlatformBaseImages != nil {
+		t.Errorf("defaultBaseImage = %q, %v, wanted gcr.io/distroless/base:nonroot", defaultBaseImage, defaultPlatformBaseImages)
+	}
+
+	for _, value := range []interface{}{
+		"not a reference!",
+		map[string]interface{}{"linux/arm/v7/x": "example.com/base"},
+		map[string]interface{}{"linux": "not a reference!"},
+		map[string]interface{}{},
+		42,
+	} {
+		if _, _, err := parseBaseImages(value); err == nil {
+			t.Errorf("parseBaseImages(%v) = nil, wanted error", value)
+		}
+	}
+}
+
+func TestPlatformBaseImage(t *testing.T) {
+	bases := map[string]string{
+		"*":             "any",
+		"linux/*":       "linux",
+		"linux/arm":     "arm",
+		"linux/arm/v7":  "armv7",
+		"*/arm64":       "arm64",
+		"windows/amd64": "windows",
+	}
+	for _, test := range []struct {
+		platform string
+		want     string
+	}{
+		{platform: "linux/amd64", want: "linux"},
+		{platform: "linux/arm/v6", want: "arm"},
+		{platform: "linux/arm/v7", want: "armv7"},
+		{platform: "darwin/amd64", want: "any"},
+		{platform: "windows/amd64", want: "windows"},
+		// linux/* and */arm64 are as specific, so the first lexically wins.
+		{platform: "linux/arm64", want: "arm64"},
+	} {
+		p, err := build.ParsePlatformSelector(test.platform)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := platformBaseImage(bases, p); !ok || got != test.want {
+			t.Errorf("platformBaseImage(%s) = %s, %t, wanted %s", test.platform, got, ok, test.want)
+		}
+	}
+
+	p := v1.Platform{OS: "windows", Architecture: "arm64"}
+	if got, ok := platformBaseImage(map[string]string{"linux/*": "linux", "windows/amd64": "windows"}, p); ok {
+		t.Errorf("platformBaseImage(windows/arm64) = %s, wanted no match", got)
+	}
+}
+
+func TestGetPlatformBase(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+
+	// A linux index, of which only amd64 is used, and a windows image.
+	linuxIndex, err := random.Index(1024, 1, 2)
+	if err != nil {
+		t.Fatalf("random.Index() = %v", err)
+	}
+	linuxIndex = mutate.RemoveManifests(linuxIndex, match.MediaTypes(string(types.OCIManifestSchema1), string(types.DockerManifestSchema2)))
+	platforms := map[string]v1.Image{}
+	for _, arch := range []string{"amd64", "arm64"} {
+		img, err := random.Image(1024, 1)
+		if err != nil {
+			t.Fatalf("random.Image() = %v", err)
+		}
+		img, err = mutate.ConfigFile(img, &v1.ConfigFile{OS: "linux", Architecture: arch})
+		if err != nil {
+			t.Fatal(err)
+		}
+		platforms[arch] = img
+		linuxIndex = mutate.AppendManifests(linuxIndex, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: arch}},
+		})
+	}
+	windows, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image() = %v", err)
+	}
+	windows, err = mutate.ConfigFile(windows, &v1.ConfigFile{OS: "windows", Architecture: "amd64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	linuxBase, windowsBase := reg.Host()+"/linux:latest", reg.Host()+"/windows:latest"
+	if err := crane.Push(windows, windowsBase); err != nil {
+		t.Fatalf("crane.Push() = %v", err)
+	}
+	linuxTag, err := name.NewTag(linuxBase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(linuxTag, linuxIndex); err != nil {
+		t.Fatalf("remote.WriteIndex() = %v", err)
+	}
+
+	defer func(pd map[string]string) { defaultPlatformBaseImages = pd }(defaultPlatformBaseImages)
+	defaultPlatformBaseImages = map[string]string{
+		"linux/*":       linuxBase,
+		"windows/amd64": windowsBase,
+	}
+	const ip = "ko://example.com/helloworld"
+
+	_, res, err := getBaseImage("linux/amd64,windows/amd64", &options.BuildOptions{})(context.Background(), ip)
+	if err != nil {
+		t.Fatalf("getBase() = %v", err)
+	}
+	idx, ok := res.(v1.ImageIndex)
+	if !ok {
+		t.Fatalf("getBase() = %T, wanted an index", res)
+	}
+	im, err := idx.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, desc := range im.Manifests {
+		got[build.PlatformString(*desc.Platform)] = desc.Annotations[specsv1.AnnotationBaseImageName] + "@" + desc.Annotations[specsv1.AnnotationBaseImageDigest]
+	}
+	want := map[string]string{
+		"linux/amd64":   linuxBase + "@" + mustDigest(platforms["amd64"]).String(),
+		"windows/amd64": windowsBase + "@" + mustDigest(windows).String(),
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("getBase() bases (-want +got) = %s", diff)
+	}
+
+	// A single platform uses its base directly.
+	_, res, err = getBaseImage("windows/amd64", &options.BuildOptions{})(context.Background(), ip)
+	if err != nil {
+		t.Fatalf("getBase() = %v", err)
+	}
+	if got, want := mustDigest(res.(v1.Image)), mustDigest(windows); got != want {
+		t.Errorf("getBase(windows/amd64) = %s, wanted %s", got, want)
+	}
+
+	// Platforms without a base are an error.
+	for _, platform := range []string{"windows/arm64", "linux/amd64,windows/arm64"} {
+		if _, _, err := getBaseImage(platform, &options.BuildOptions{})(context.Background(), ip); err == nil || !strings.Contains(err.Error(), "no base image is configured") {
+			t.Errorf("getBase(%s) = %v, wanted an error about a missing base", platform, err)
+		}
+	}
+}
+
+func TestGetBaseImagePlatformPolicy(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+
+	// A base without linux/arm64.
+	idx := mutate.IndexMediaType(empty.Index, types.OCIImageIndex)
+	platforms := map[string]v1.Image{}
+	for _, arch := range []string{"s390x", "amd64"} {
+		img, err := random.Image(1024, 1)
+		if err != nil {
+			t.Fatalf("random.Image() = %v", err)
+		}
+		if img, err = mutate.ConfigFile(img, &v1.ConfigFile{OS: "linux", Architecture: arch}); err != nil {
+			t.Fatal(err)
+		}
+		platforms[arch] = img
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: arch}},
+		})
+	}
+	base := reg.Host() + "/base:latest"
+	tag, err := name.NewTag(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(tag, idx); err != nil {
+		t.Fatalf("remote.WriteIndex() = %v", err)
+	}
+	const ip = "ko://example.com/helloworld"
+
+	for _, policy := range []string{"", string(build.BasePlatformStrict)} {
+		bo := &options.BuildOptions{BaseImage: base, BasePlatformPolicy: policy, NoCacheBase: true}
+		if _, _, err := getBaseImage("linux/arm64", bo)(context.Background(), ip); err == nil {
+			t.Errorf("getBase(linux/arm64) with policy %q succeeded, wanted error", policy)
+		}
+	}
+
+	// With emulate, the amd64 image is the base, and the build warns.
+	bo := &options.BuildOptions{BaseImage: base, BasePlatformPolicy: string(build.BasePlatformEmulate), NoCacheBase: true}
+	for platform, want := range map[string]v1.Image{
+		"linux/arm64": platforms["amd64"],
+		"linux/s390x": platforms["s390x"],
+	} {
+		_, res, err := getBaseImage(platform, bo)(context.Background(), ip)
+		if err != nil {
+			t.Fatalf("getBase(%s) = %v", platform, err)
+		}
+		img, ok := res.(v1.Image)
+		if !ok {
+			t.Fatalf("getBase(%s) = %T, wanted an image", platform, res)
+		}
+		if got, want := mustDigest(img), mustDigest(want); got != want {
+			t.Errorf("getBase(%s) = %s, wanted %s", platform, got, want)
+		}
+	}
+}
+
+func TestDockerRepoMappings(t *testing.T) {
+	defer func(m []options.DockerRepoMapping) { dockerRepoMappings = m }(dockerRepoMappings)
+
+	if err := loadConfig("testdata/dockerrepos"); err != nil {
+		t.Fatal(err)
+	}
+	want := []options.DockerRepoMapping{{
+		Prefix: "example.com/mono/frontend/...",
+		Repo:   "registry.example.com/frontend",
+	}, {
+		Prefix:          "example.com/mono/backend",
+		Repo:            "registry.example.com/backend",
+		BaseImportPaths: true,
+	}}
+	if diff := cmp.Diff(want, dockerRepoMappings); diff != "" {
+		t.Errorf("dockerRepoMappings (-want +got): %s", diff)
+	}
+}
+
+func TestBuildEnvironment(t *testing.T) {
+	defer func(env []string) { buildEnvironment = env }(buildEnvironment)
+
+	if err := loadConfig("testdata/env"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"GOFLAGS=-mod=vendor -tags=netgo", "GOPRIVATE=example.com"}
+	if diff := cmp.Diff(want, buildEnvironment); diff != "" {
+		t.Errorf("buildEnvironment (-want +got): %s", diff)
+	}
+
+	// Env from the flag comes after .ko.yaml, so it wins. The builder
+	// uses the last value of each variable (see TestWithEnv).
+	bo := &options.BuildOptions{
+		WorkingDirectory: "testdata/env",
+		Env:              []string{"GOPRIVATE=example.org"},
+	}
+	if _, err := NewBuilder(context.Background(), bo); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"GOFLAGS=-mod=vendor -tags=netgo", "GOPRIVATE=example.com", "GOPRIVATE=example.org"}
+	if diff := cmp.Diff(want, buildEnvOverrides(bo)); diff != "" {
+		t.Errorf("buildEnvOverrides() (-want +got): %s", diff)
+	}
+
+	if _, err := NewBuilder(context.Background(), &options.BuildOptions{
+		WorkingDirectory: "testdata/env",
+		Env:              []string{"GOOS=windows"},
+	}); err == nil {
+		t.Error("NewBuilder() with GOOS in env succeeded, wanted error")
+	}
+}
+
+func TestKoDataCreationTime(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		sourceDate  string
+		kodataDate  string
+		want        int64
+	}{{
+		description: "neither",
+	}, {
+		description: "SOURCE_DATE_EPOCH",
+		sourceDate:  "1000",
+		want:        1000,
+	}, {
+		description: "KO_DATA_DATE_EPOCH wins",
+		sourceDate:  "1000",
+		kodataDate:  "2000",
+		want:        2000,
+	}} {
+		t.Run(test.description, func(t *testing.T) {
+			os.Setenv("SOURCE_DATE_EPOCH", test.sourceDate)
+			defer os.Unsetenv("SOURCE_DATE_EPOCH")
+			os.Setenv("KO_DATA_DATE_EPOCH", test.kodataDate)
+			defer os.Unsetenv("KO_DATA_DATE_EPOCH")
+
+			got, err := getKoDataCreationTime()
+			if err != nil {
+				t.Fatalf("getKoDataCreationTime() = %v", err)
+			}
+			if test.want == 0 {
+				if got != nil {
+					t.Errorf("getKoDataCreationTime() = %v, wanted nil", got)
+				}
+				return
+			}
+			if got == nil || got.Unix() != test.want {
+				t.Errorf("getKoDataCreationTime() = %v, wanted %d", got, test.want)
+			}
+		})
+	}
+}
+
 func TestBuildConfigWithWorkingDirectoryAndDirAndMain(t *testing.T) {
 	_, err := NewBuilder(context.Background(), &options.BuildOptions{
 		WorkingDirectory: "testdata/paths",
@@ -124,3 +766,445 @@ func TestCreateBuildConfigs(t *testing.T) {
 		}
 	}
 }
+
+func TestCreateBuildConfigsDefaultAndPatterns(t *testing.T) {
+	buildConfigMap, err := createBuildConfigMap("../..", []build.Config{
+		{ID: "fallback", Main: build.DefaultConfigKey, Ldflags: []string{"-X main.version=default"}},
+		{ID: "all-cmds", Main: "github.com/google/ko/cmd/..."},
+		{ID: "test", Main: "test"},
+		// An ID of "default" has no special meaning.
+		{ID: "default"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, id := range map[string]string{
+		build.DefaultConfigKey:         "fallback",
+		"github.com/google/ko/cmd/...": "all-cmds",
+		"github.com/google/ko/test":    "test",
+		"github.com/google/ko":         "default",
+	} {
+		if got := buildConfigMap[key].ID; got != id {
+			t.Errorf("buildConfigMap[%q].ID = %q, wanted %q", key, got, id)
+		}
+	}
+}
+
+func TestCreateBuildConfigsQualifiedImportPathAndWarnings(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	buildConfigMap, err := createBuildConfigMap("../..", []build.Config{
+		{ID: "qualified", Main: "github.com/google/ko/test", Flags: []string{"-tags", "netgo"}},
+		{ID: "library", Main: "pkg/build"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := buildConfigMap["github.com/google/ko/test"].ID; got != "qualified" {
+		t.Errorf("buildConfigMap[test].ID = %q, wanted %q", got, "qualified")
+	}
+	if got := buildConfigMap["github.com/google/ko/pkg/build"].ID; got != "library" {
+		t.Errorf("buildConfigMap[pkg/build].ID = %q, wanted %q", got, "library")
+	}
+	if !strings.Contains(logs.String(), "entry #1 (github.com/google/ko/pkg/build) is package build, not package main") {
+		t.Errorf("expected a warning about the library package, got: %q", logs.String())
+	}
+	if strings.Contains(logs.String(), "entry #0") {
+		t.Errorf("unexpected warning about the main package: %q", logs.String())
+	}
+}
+
+func TestWarnUnusedBuildConfigs(t *testing.T) {
+	defer func(configs map[string]build.Config) {
+		buildConfigs = configs
+		buildConfigTracker = nil
+	}(buildConfigs)
+	buildConfigs = map[string]build.Config{
+		build.DefaultConfigKey:       {},
+		"example.com/app/cmd/used":   {},
+		"example.com/app/cmd/unused": {},
+	}
+	if _, err := gobuildOptions(&options.BuildOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	buildConfigTracker.Resolve("example.com/app/cmd/used")
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	warnUnusedBuildConfigs()
+
+	if want := "'builds': entry for example.com/app/cmd/unused did not match any import path that was built"; !strings.Contains(logs.String(), want) {
+		t.Errorf("expected a warning about the unused entry, got: %q", logs.String())
+	}
+	if strings.Contains(logs.String(), "cmd/used ") || strings.Count(logs.String(), "WARNING") != 1 {
+		t.Errorf("expected exactly one warning, got: %q", logs.String())
+	}
+}
+
+func TestVerifyBaseSignatureFlags(t *testing.T) {
+	// Incomplete flags fail before anything is built, without reading the
+	// files they name.
+	for _, test := range []struct {
+		desc    string
+		bo      options.BuildOptions
+		wantErr string
+	}{{
+		desc:    "no roots",
+		bo:      options.BuildOptions{VerifyBaseSignature: "release@example.com", VerifyBaseSignatureRekorKeys: "rekor.pem", VerifyBaseSignatureCTLogKeys: "ctlog.pem"},
+		wantErr: "requires --verify-base-signature-roots",
+	}, {
+		desc:    "no rekor keys",
+		bo:      options.BuildOptions{VerifyBaseSignature: "release@example.com", VerifyBaseSignatureRoots: "roots.pem", VerifyBaseSignatureCTLogKeys: "ctlog.pem"},
+		wantErr: "requires --verify-base-signature-rekor-keys",
+	}, {
+		desc:    "no ctlog keys",
+		bo:      options.BuildOptions{VerifyBaseSignature: "release@example.com", VerifyBaseSignatureRoots: "roots.pem", VerifyBaseSignatureRekorKeys: "rekor.pem"},
+		wantErr: "requires --verify-base-signature-rekor-keys and --verify-base-signature-ctlog-keys",
+	}, {
+		desc:    "no identity",
+		bo:      options.BuildOptions{VerifyBaseSignatureRoots: "roots.pem"},
+		wantErr: "require --verify-base-signature",
+	}} {
+		t.Run(test.desc, func(t *testing.T) {
+			if _, err := gobuildOptions(&test.bo); err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("gobuildOptions() = %v, wanted error containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyBaseSignature(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+	now := time.Now()
+
+	// A CA, like Fulcio's, and the logs that the certificates it issues
+	// and the signatures made with them are logged in, like Rekor.
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             now.Add(-3 * time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rekorKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	writePEM := func(file, typ string, der []byte) string {
+		t.Helper()
+		path := filepath.Join(dir, file)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	// writeKey writes the public key of a log to file, and returns its
+	// path, and the ID of the log.
+	writeKey := func(file string, key *ecdsa.PrivateKey) (string, []byte) {
+		t.Helper()
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := sha256.Sum256(der)
+		return writePEM(file, "PUBLIC KEY", der), h[:]
+	}
+	ctKeys, ctLogID := writeKey("ctlog.pem", ctKey)
+	rekorKeys, rekorLogID := writeKey("rekor.pem", rekorKey)
+	roots := writePEM("roots.pem", "CERTIFICATE", caDER)
+
+	// certificate issues a certificate to the signer, valid between from
+	// and to, and, if withSCT, logged in the CT log, like Fulcio does.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := int64(1)
+	certificate := func(from, to time.Time, withSCT bool) []byte {
+		t.Helper()
+		serial++
+		tmpl := &x509.Certificate{
+			SerialNumber:   big.NewInt(serial),
+			NotBefore:      from,
+			NotAfter:       to,
+			KeyUsage:       x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+			EmailAddresses: []string{"release@example.com"},
+			ExtraExtensions: []pkix.Extension{{
+				Id:    []int{1, 3, 6, 1, 4, 1, 57264, 1, 1},
+				Value: []byte("https://accounts.example.com"),
+			}},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !withSCT {
+			return der
+		}
+		// The log signs the certificate without the SCT, with the
+		// hash of the issuer's key, and the SCT is embedded in it.
+		pre, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts := make([]byte, 8)
+		binary.BigEndian.PutUint64(ts, uint64(now.UnixNano()/int64(time.Millisecond)))
+		issuerKeyHash := sha256.Sum256(ca.RawSubjectPublicKeyInfo)
+		tbs := pre.RawTBSCertificate
+		var signed bytes.Buffer
+		signed.Write([]byte{0, 0})
+		signed.Write(ts)
+		signed.Write([]byte{0, 1})
+		signed.Write(issuerKeyHash[:])
+		signed.Write([]byte{byte(len(tbs) >> 16), byte(len(tbs) >> 8), byte(len(tbs))})
+		signed.Write(tbs)
+		signed.Write([]byte{0, 0})
+		h := sha256.Sum256(signed.Bytes())
+		sig, err := ecdsa.SignASN1(rand.Reader, ctKey, h[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sct := append([]byte{0}, ctLogID...)
+		sct = append(sct, ts...)
+		sct = append(sct, 0, 0, 4, 3, byte(len(sig)>>8), byte(len(sig)))
+		sct = append(sct, sig...)
+		list := []byte{byte((len(sct) + 2) >> 8), byte(len(sct) + 2), byte(len(sct) >> 8), byte(len(sct))}
+		ext, err := asn1.Marshal(append(list, sct...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl.ExtraExtensions = append(tmpl.ExtraExtensions, pkix.Extension{Id: []int{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}, Value: ext})
+		der, err = x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der
+	}
+
+	// push pushes a base to repo, signed like --sign signs images, and then
+	// given the certificate certDER, like keyless cosign signatures. If
+	// logged isn't zero, the signature was logged in Rekor then.
+	push := func(repo string, certDER []byte, logged time.Time) string {
+		t.Helper()
+		base := reg.Host() + "/" + repo
+		img, err := random.Image(1024, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := crane.Push(img, base); err != nil {
+			t.Fatal(err)
+		}
+		if certDER == nil {
+			return base
+		}
+		dig := mustRepository(base).Digest(mustDigest(img).String())
+		if err := publish.NewCosignSigner(key)(context.Background(), dig, nil); err != nil {
+			t.Fatal(err)
+		}
+		sigTag := mustTag(t, base+":"+strings.Replace(dig.DigestStr(), ":", "-", 1)+".sig")
+		sigImg, err := remote.Image(sigTag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := sigImg.Manifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := sigImg.LayerByDigest(m.Layers[0].Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		annotations := m.Layers[0].Annotations
+		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+		annotations["dev.sigstore.cosign/certificate"] = string(certPEM)
+		if !logged.IsZero() {
+			rc, err := l.Compressed()
+			if err != nil {
+				t.Fatal(err)
+			}
+			payload, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			ph := sha256.Sum256(payload)
+			body, err := json.Marshal(map[string]interface{}{
+				"apiVersion": "0.0.1",
+				"kind":       "hashedrekord",
+				"spec": map[string]interface{}{
+					"data": map[string]interface{}{
+						"hash": map[string]string{"algorithm": "sha256", "value": hex.EncodeToString(ph[:])},
+					},
+					"signature": map[string]interface{}{
+						"content":   annotations["dev.cosignproject.cosign/signature"],
+						"publicKey": map[string]string{"content": base64.StdEncoding.EncodeToString(certPEM)},
+					},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Rekor signs the canonical JSON of the entry, with its
+			// keys sorted, like json.Marshal sorts those of maps.
+			entry := map[string]interface{}{
+				"body":           base64.StdEncoding.EncodeToString(body),
+				"integratedTime": logged.Unix(),
+				"logID":          hex.EncodeToString(rekorLogID),
+				"logIndex":       serial,
+			}
+			signed, err := json.Marshal(entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := sha256.Sum256(signed)
+			set, err := ecdsa.SignASN1(rand.Reader, rekorKey, h[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			bundle, err := json.Marshal(map[string]interface{}{"SignedEntryTimestamp": set, "Payload": entry})
+			if err != nil {
+				t.Fatal(err)
+			}
+			annotations["dev.sigstore.cosign/bundle"] = string(bundle)
+		}
+		keyless, err := mutate.Append(mutate.MediaType(empty.Image, types.OCIManifestSchema1), mutate.Addendum{
+			Layer:       l,
+			MediaType:   m.Layers[0].MediaType,
+			Annotations: annotations,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := remote.Write(sigTag, keyless); err != nil {
+			t.Fatal(err)
+		}
+		return base
+	}
+
+	valid := certificate(now.Add(-time.Minute), now.Add(10*time.Minute), true)
+	signed := push("signed", valid, now)
+	expired := push("expired", certificate(now.Add(-2*time.Hour), now.Add(-2*time.Hour+10*time.Minute), true), now.Add(-2*time.Hour+time.Minute))
+	unlogged := push("unlogged", valid, time.Time{})
+	late := push("late", certificate(now.Add(-2*time.Hour), now.Add(-2*time.Hour+10*time.Minute), true), now)
+	noSCT := push("nosct", certificate(now.Add(-time.Minute), now.Add(10*time.Minute), false), now)
+	unsigned := push("unsigned", nil, time.Time{})
+
+	for _, test := range []struct {
+		desc      string
+		base      string
+		identity  string
+		issuer    string
+		rekorKeys string
+		ctKeys    string
+		wantErr   string
+	}{{
+		desc:     "signed",
+		base:     signed,
+		identity: "release@example.com",
+		issuer:   "https://accounts.example.com",
+	}, {
+		desc:     "certificate expired since it was logged",
+		base:     expired,
+		identity: "release@example.com",
+	}, {
+		desc:     "unsigned",
+		base:     unsigned,
+		identity: "release@example.com",
+		wantErr:  "has no signatures",
+	}, {
+		desc:     "not logged",
+		base:     unlogged,
+		identity: "release@example.com",
+		wantErr:  "no Rekor bundle",
+	}, {
+		desc:     "logged after the certificate expired",
+		base:     late,
+		identity: "release@example.com",
+		wantErr:  "when the certificate wasn't valid",
+	}, {
+		desc:     "certificate not logged",
+		base:     noSCT,
+		identity: "release@example.com",
+		wantErr:  "certificate has no SCTs",
+	}, {
+		desc:      "untrusted log",
+		base:      signed,
+		identity:  "release@example.com",
+		rekorKeys: ctKeys,
+		wantErr:   "which isn't trusted",
+	}, {
+		desc:     "untrusted CT log",
+		base:     signed,
+		identity: "release@example.com",
+		ctKeys:   rekorKeys,
+		wantErr:  "no SCT from a trusted CT log",
+	}, {
+		desc:     "other identity",
+		base:     signed,
+		identity: "someone@example.com",
+		wantErr:  "not someone@example.com",
+	}, {
+		desc:     "other issuer",
+		base:     signed,
+		identity: "release@example.com",
+		issuer:   "https://token.actions.githubusercontent.com",
+		wantErr:  "not \"https://token.actions.githubusercontent.com\"",
+	}} {
+		t.Run(test.desc, func(t *testing.T) {
+			bo := &options.BuildOptions{
+				BaseImage:                    test.base,
+				VerifyBaseSignature:          test.identity,
+				VerifyBaseSignatureIssuer:    test.issuer,
+				VerifyBaseSignatureRoots:     roots,
+				VerifyBaseSignatureRekorKeys: rekorKeys,
+				VerifyBaseSignatureCTLogKeys: ctKeys,
+			}
+			if test.rekorKeys != "" {
+				bo.VerifyBaseSignatureRekorKeys = test.rekorKeys
+			}
+			if test.ctKeys != "" {
+				bo.VerifyBaseSignatureCTLogKeys = test.ctKeys
+			}
+			_, _, err := getBaseImage("", bo)(context.Background(), "ko://example.com/app")
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Errorf("getBaseImage() = %v", err)
+			case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+				t.Errorf("getBaseImage() = %v, wanted error containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func mustTag(t *testing.T, s string) name.Tag {
+	t.Helper()
+	tag, err := name.NewTag(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tag
+}
@@ -24,6 +24,7 @@ import (
 
 	"github.com/google/ko/internal"
 	"github.com/google/ko/pkg/commands/options"
+	"github.com/google/ko/pkg/warnings"
 	"github.com/spf13/cobra"
 	"golang.org/x/sync/errgroup"
 )
@@ -35,6 +36,7 @@ func addCreate(topLevel *cobra.Command) {
 	fo := &options.FilenameOptions{}
 	so := &options.SelectorOptions{}
 	bo := &options.BuildOptions{}
+	wo := &options.WarningOptions{}
 	create := &cobra.Command{
 		Use:   "create -f FILENAME",
 		Short: "Create the input files with image references resolved to built/pushed image digests.",
@@ -67,6 +69,9 @@ func addCreate(topLevel *cobra.Command) {
   ko apply -f config -- --namespace=foo --kubeconfig=cfg.yaml
 `,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if fo.ExplainWatch != "" {
+				return explainWatch(os.Stdout, fo.ExplainWatch)
+			}
 			if !isKubectlAvailable() {
 				return errors.New("error: kubectl is not available. kubectl must be installed to use ko create")
 			}
@@ -75,10 +80,17 @@ func addCreate(topLevel *cobra.Command) {
 			ctx := createCancellableContext()
 
 			bo.InsecureRegistry = po.InsecureRegistry
+			shareSBOMs(bo, po)
 			builder, err := makeBuilder(ctx, bo)
 			if err != nil {
 				return fmt.Errorf("error creating builder: %v", err)
 			}
+			if ctx, err = watchContext(ctx, bo, fo); err != nil {
+				return err
+			}
+			if fo.BuildPlatform, err = targetPlatform(bo); err != nil {
+				return err
+			}
 			publisher, err := makePublisher(po)
 			if err != nil {
 				return fmt.Errorf("error creating publisher: %v", err)
@@ -94,6 +106,7 @@ func addCreate(topLevel *cobra.Command) {
 				log.Printf(kubectlFlagsWarningTemplate,
 					"create", skflags,
 					"create", skflags)
+				warnings.Record(warnings.Warning{Code: warnings.DeprecatedFlag, Message: "passing kubectl global flags to ko directly is deprecated, pass them after --"})
 				argv = append(argv, kflags...)
 			}
 			argv = append(argv, args...)
@@ -141,10 +154,20 @@ func addCreate(topLevel *cobra.Command) {
 	}
 	options.AddPublishArg(create, po)
 	options.AddFileArg(create, fo)
+	options.AddWatchDebugArg(create, fo)
 	options.AddSelectorArg(create, so)
+	options.AddNormalizeArg(create, &fo.Normalize)
+	options.AddStrictArg(create, &fo.Strict)
+	options.AddCommentDocumentsArg(create, fo)
+	options.AddMergeArg(create, fo)
+	options.AddHelmReleaseArg(create, fo)
+	options.AddImagesChecksumArg(create, fo)
+	options.AddBuildOutputArg(create, fo)
 	options.AddBuildOptions(create, bo)
+	options.AddWarningsArg(create, wo)
 	internal.AddFlags(&kf, create.Flags())
 
+	create.RunE = withGitHubErrors(po, withWarnings(wo, withTracing(create.RunE)))
 	topLevel.AddCommand(create)
 }
 
@@ -0,0 +1,113 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/daemon"
+	"github.com/google/ko/pkg/publish"
+	"github.com/google/ko/pkg/warnings"
+)
+
+// dockerDaemonScheme is the scheme of base images read from the local
+// docker daemon, e.g. docker-daemon://ubuntu:22.04, which are pulled from
+// their registry if the daemon can't provide them.
+const dockerDaemonScheme = "docker-daemon://"
+
+// baseDaemonClient is the client of the docker daemon that docker-daemon://
+// bases are read from. Nil means the default client from the environment,
+// e.g. DOCKER_HOST.
+var baseDaemonClient daemon.Client
+
+// daemonBases reads docker-daemon:// bases, once each, since the daemon
+// only provides whole images.
+type daemonBases struct {
+	m      sync.Mutex
+	bases  map[string]*daemonBase
+	pinged sync.Once
+	ping   error
+}
+
+type daemonBase struct {
+	once sync.Once
+	img  v1.Image
+}
+
+func newDaemonBases() *daemonBases {
+	return &daemonBases{bases: map[string]*daemonBase{}}
+}
+
+// parseDaemonBase returns the reference of baseImage in the daemon, if it's
+// a docker-daemon:// base.
+func parseDaemonBase(baseImage string, opt ...name.Option) (name.Reference, bool, error) {
+	if !strings.HasPrefix(baseImage, dockerDaemonScheme) {
+		return nil, false, nil
+	}
+	ref, err := name.ParseReference(strings.TrimPrefix(baseImage, dockerDaemonScheme), opt...)
+	return ref, true, err
+}
+
+// get returns the image ref in the daemon, with its digest computed, or
+// false, having warned, if the daemon can't provide it, so that it's
+// pulled from its registry instead.
+func (d *daemonBases) get(ctx context.Context, ref name.Reference, s string) (v1.Image, bool) {
+	d.pinged.Do(func() {
+		ctx, cancel := context.WithTimeout(ctx, daemonPingTimeout)
+		defer cancel()
+		d.ping = publish.PingDaemon(ctx, baseDaemonClient)
+	})
+	if d.ping != nil {
+		warnings.Warnf(warnings.DaemonBase, "the docker daemon isn't reachable (%v), so the base %s of %s is pulled from its registry", d.ping, ref, s)
+		return nil, false
+	}
+
+	d.m.Lock()
+	b, ok := d.bases[ref.String()]
+	if !ok {
+		b = &daemonBase{}
+		d.bases[ref.String()] = b
+	}
+	d.m.Unlock()
+	b.once.Do(func() {
+		opt := []daemon.Option{daemon.WithContext(ctx)}
+		if baseDaemonClient != nil {
+			opt = append(opt, daemon.WithClient(baseDaemonClient))
+		}
+		img, err := daemon.Image(ref, opt...)
+		if err == nil {
+			// Images in the daemon have no manifest until they're
+			// exported, so export it now for its digest, which the
+			// caching and annotations of builds need, like those of
+			// bases in registries.
+			_, err = img.Digest()
+		}
+		if err != nil {
+			warnings.Warnf(warnings.DaemonBase, "the base %s couldn't be read from the docker daemon (%v), so it's pulled from its registry", ref, err)
+			return
+		}
+		b.img = img
+	})
+	if b.img == nil {
+		return nil, false
+	}
+	log.Printf("Using base %s from the docker daemon for %s", ref, s)
+	return b.img, true
+}
@@ -0,0 +1,148 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/daemon"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/ko/pkg/commands/options"
+	"github.com/google/ko/pkg/registrytest"
+	"github.com/google/ko/pkg/warnings"
+)
+
+// fakeDaemon has a single image, which it saves as `docker save` does.
+type fakeDaemon struct {
+	daemon.Client
+	ref     name.Reference
+	img     v1.Image
+	pingErr error
+	saves   int32
+}
+
+func (f *fakeDaemon) NegotiateAPIVersion(context.Context) {}
+
+func (f *fakeDaemon) Ping(context.Context) (types.Ping, error) {
+	return types.Ping{}, f.pingErr
+}
+
+func (f *fakeDaemon) ImageSave(_ context.Context, refs []string) (io.ReadCloser, error) {
+	atomic.AddInt32(&f.saves, 1)
+	if len(refs) != 1 || refs[0] != f.ref.Name() {
+		return nil, errors.New("No such image")
+	}
+	var buf bytes.Buffer
+	if err := tarball.Write(f.ref, f.img, &buf); err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(&buf), nil
+}
+
+func TestDaemonBaseImage(t *testing.T) {
+	defer func(c daemon.Client) { baseDaemonClient = c }(baseDaemonClient)
+	defer setKOCACHE(t)()
+	const ip = "ko://example.com/app/cmd/app"
+
+	// The base in the registry, which the daemon's copy may differ from.
+	reg := registrytest.New()
+	defer reg.Close()
+	tag := mustTag(t, reg.Host()+"/base:22.04")
+	pushed, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(tag, pushed); err != nil {
+		t.Fatal(err)
+	}
+	local, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		desc     string
+		daemon   *fakeDaemon
+		want     v1.Hash
+		wantWarn string
+	}{{
+		desc:   "in the daemon",
+		daemon: &fakeDaemon{ref: tag, img: local},
+		want:   mustDigest(local),
+	}, {
+		desc:     "daemon unreachable",
+		daemon:   &fakeDaemon{ref: tag, img: local, pingErr: errors.New("Cannot connect to the Docker daemon")},
+		want:     mustDigest(pushed),
+		wantWarn: "the docker daemon isn't reachable",
+	}, {
+		desc:     "not in the daemon",
+		daemon:   &fakeDaemon{ref: mustTag(t, reg.Host()+"/other:latest"), img: local},
+		want:     mustDigest(pushed),
+		wantWarn: "couldn't be read from the docker daemon",
+	}} {
+		t.Run(test.desc, func(t *testing.T) {
+			c := &warnings.Collector{}
+			defer warnings.SetDefault(warnings.SetDefault(c))
+			baseDaemonClient = test.daemon
+
+			getBase := getBaseImage("linux/amd64", &options.BuildOptions{BaseImage: "docker-daemon://" + tag.String()})
+			// The daemon's image is exported once, however many
+			// importpaths are built on it.
+			for i := 0; i < 2; i++ {
+				ref, res, err := getBase(context.Background(), ip)
+				if err != nil {
+					t.Fatalf("getBaseImage() = %v", err)
+				}
+				if ref.String() != tag.String() {
+					t.Errorf("getBaseImage() ref = %s, wanted %s", ref, tag)
+				}
+				if got := mustDigest(res.(v1.Image)); got != test.want {
+					t.Errorf("getBaseImage() digest = %s, wanted %s", got, test.want)
+				}
+			}
+			if test.wantWarn == "" && test.daemon.saves != 1 {
+				t.Errorf("exported the base %d times, wanted once", test.daemon.saves)
+			}
+			ws := c.Warnings()
+			switch {
+			case test.wantWarn == "" && len(ws) != 0:
+				t.Errorf("warnings = %v, wanted none", ws)
+			case test.wantWarn != "" && (len(ws) != 1 || ws[0].Code != warnings.DaemonBase || !strings.Contains(ws[0].Message, test.wantWarn)):
+				t.Errorf("warnings = %v, wanted one %s warning containing %q", ws, warnings.DaemonBase, test.wantWarn)
+			}
+		})
+	}
+
+	// The daemon only has single-platform images.
+	baseDaemonClient = &fakeDaemon{ref: tag, img: local}
+	if _, _, err := getBaseImage("all", &options.BuildOptions{BaseImage: "docker-daemon://" + tag.String()})(context.Background(), ip); err == nil {
+		t.Error("getBaseImage(--platform=all) succeeded, wanted error")
+	}
+	if err := checkBaseImage("docker-daemon://UPPER:case"); err == nil {
+		t.Error("checkBaseImage() of an invalid reference succeeded, wanted error")
+	}
+}
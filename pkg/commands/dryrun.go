@@ -0,0 +1,125 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/commands/options"
+	"github.com/google/ko/pkg/publish"
+)
+
+// dryRunBuilder logs the importpaths it would build, without building them.
+// Which references are supported is still up to the wrapped builder.
+type dryRunBuilder struct {
+	build.Interface
+}
+
+// Build implements build.Interface
+func (dryRunBuilder) Build(_ context.Context, ip string) (build.Result, error) {
+	log.Printf("Would build %s", ip)
+	return empty.Image, nil
+}
+
+// dryRunPublisher logs the references it would publish to, without
+// publishing anything.
+type dryRunPublisher struct {
+	repoName string
+	namer    publish.Namer
+	tags     []string
+}
+
+// newDryRunPublisher returns a publisher that logs the tags that the
+// publisher for po would push.
+func newDryRunPublisher(po *options.PublishOptions) (publish.Interface, error) {
+	mappings := repoMappings(po)
+	if len(mappings) == 0 {
+		return newRepoDryRunPublisher(po)
+	}
+	var fallback publish.Interface
+	if po.DockerRepo != "" {
+		var err error
+		if fallback, err = newRepoDryRunPublisher(po); err != nil {
+			return nil, err
+		}
+	}
+	routes := make([]publish.Route, 0, len(mappings))
+	for _, m := range mappings {
+		pub, err := newRepoDryRunPublisher(po.ForMapping(m))
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, publish.Route{Prefix: m.Prefix, Publisher: pub})
+	}
+	return publish.NewRouter(fallback, routes...), nil
+}
+
+// newRepoDryRunPublisher returns a dry-run publisher for images named after
+// po.DockerRepo.
+func newRepoDryRunPublisher(po *options.PublishOptions) (publish.Interface, error) {
+	repoName := po.DockerRepo
+	if po.Local || repoName == publish.LocalDomain {
+		repoName = publish.LocalDomain
+		if po.LocalDomain != "" {
+			repoName = po.LocalDomain
+		}
+	} else if strings.HasPrefix(repoName, publish.ExternalScheme) {
+		// The plugin decides where images are published, so they're named
+		// as it's handed them.
+		repoName = publish.ExternalDomain
+	} else if repoName == "" {
+		return nil, errors.New("KO_DOCKER_REPO environment variable is unset")
+	}
+	tags, err := publishTags(po)
+	if err != nil {
+		return nil, err
+	}
+	if len(tags) == 0 {
+		tags = []string{"latest"}
+	}
+	return &dryRunPublisher{
+		repoName: repoName,
+		namer:    options.MakeNamer(po),
+		tags:     tags,
+	}, nil
+}
+
+// Publish implements publish.Interface
+func (d *dryRunPublisher) Publish(_ context.Context, _ build.Result, s string) (name.Reference, error) {
+	ip := strings.ToLower(strings.TrimPrefix(s, build.StrictScheme))
+	repo := d.namer(d.repoName, ip)
+	refs := make([]string, 0, len(d.tags))
+	for _, tag := range d.tags {
+		refs = append(refs, repo+":"+tag)
+	}
+	log.Printf("Would publish %s as %s", s, strings.Join(refs, ", "))
+	if tag, err := name.NewTag(refs[0]); err == nil {
+		return tag, nil
+	}
+	// Tags that are templates (e.g. {{.Module.Version}}) aren't expanded
+	// without a build, so fall back to the repository.
+	return name.NewTag(repo)
+}
+
+// Close implements publish.Interface
+func (d *dryRunPublisher) Close() error {
+	return nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/commands/options"
+	"github.com/google/ko/pkg/registrytest"
+)
+
+func TestResolveDryRun(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	reg := registrytest.New()
+	defer reg.Close()
+	repo := reg.Host() + "/repo"
+	pub, err := newDryRunPublisher(&options.PublishOptions{
+		DockerRepo:      repo,
+		BaseImportPaths: true,
+		Tags:            []string{"v1", "latest"},
+	})
+	if err != nil {
+		t.Fatalf("newDryRunPublisher() = %v", err)
+	}
+	builder, err := build.NewCaching(dryRunBuilder{testBuilder})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The documents are still decoded and encoded, so this is written in
+	// the encoder's style.
+	inputYAML := "image: " + build.StrictScheme + fooRef + "\n" +
+		"---\n" +
+		"images:\n  - " + build.StrictScheme + barRef + "\n  - " + build.StrictScheme + fooRef + "\n" +
+		"---\n" +
+		"image: busybox\n"
+	fo := &options.FilenameOptions{
+		Filenames: []string{yamlToTmpFile(t, []byte(inputYAML))},
+		DryRun:    true,
+	}
+	var out bytes.Buffer
+	if err := resolveFilesToWriter(context.Background(), builder, pub, fo, &options.SelectorOptions{}, nopWriteCloser{&out}); err != nil {
+		t.Fatalf("resolveFilesToWriter() = %v", err)
+	}
+
+	if got, want := out.String(), inputYAML+"\n---\n"; got != want {
+		t.Errorf("resolveFilesToWriter() = %q, wanted the input unchanged: %q", got, want)
+	}
+	if got := reg.Requests(); len(got) != 0 {
+		t.Errorf("dry run made requests to the registry: %v", got)
+	}
+	for _, want := range []string{
+		"Would build " + build.StrictScheme + fooRef,
+		"Would build " + build.StrictScheme + barRef,
+		"Would publish " + build.StrictScheme + fooRef + " as " + repo + "/foo:v1, " + repo + "/foo:latest",
+		"Would publish " + build.StrictScheme + barRef + " as " + repo + "/bar:v1, " + repo + "/bar:latest",
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("logs don't contain %q:\n%s", want, logs.String())
+		}
+	}
+	// Builds are cached, so each importpath is only listed once.
+	if got := strings.Count(logs.String(), "Would build "+build.StrictScheme+fooRef); got != 1 {
+		t.Errorf("logged building %s %d times, wanted 1", fooRef, got)
+	}
+}
+
+func TestNewDryRunPublisher(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		po          *options.PublishOptions
+		want        string
+		wantErr     bool
+	}{{
+		description: "registry",
+		po:          &options.PublishOptions{DockerRepo: "registry.example.com/repo", PreserveImportPaths: true},
+		want:        "registry.example.com/repo/" + fooRef + ":latest",
+	}, {
+		description: "local",
+		po:          &options.PublishOptions{Local: true, PreserveImportPaths: true, Tags: []string{"dev"}},
+		want:        "ko.local/" + fooRef + ":dev",
+	}, {
+		description: "template tag",
+		po:          &options.PublishOptions{DockerRepo: "registry.example.com/repo", Bare: true, Tags: []string{"{{.Module.Version}}"}},
+		want:        "registry.example.com/repo",
+	}, {
+		description: "no repo",
+		po:          &options.PublishOptions{},
+		wantErr:     true,
+	}} {
+		t.Run(test.description, func(t *testing.T) {
+			pub, err := newDryRunPublisher(test.po)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("newDryRunPublisher() = %v, wanted error: %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			ref, err := pub.Publish(context.Background(), foo, build.StrictScheme+fooRef)
+			if err != nil {
+				t.Fatalf("Publish() = %v", err)
+			}
+			if got := ref.String(); got != test.want {
+				t.Errorf("Publish() = %s, wanted %s", got, test.want)
+			}
+		})
+	}
+}
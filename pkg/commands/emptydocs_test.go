@@ -0,0 +1,68 @@
+/*
+Copyright 2021 Google LLC All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/ko/pkg/commands/options"
+	kotesting "github.com/google/ko/pkg/internal/testing"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files in testdata")
+
+// TestResolveEmptyDocuments resolves files with empty, null and comment-only
+// documents, and compares the results against golden files, which can be
+// regenerated with `go test ./pkg/commands -run TestResolveEmptyDocuments -update`.
+func TestResolveEmptyDocuments(t *testing.T) {
+	dir := filepath.Join("testdata", "emptydocs")
+	for _, input := range []string{"leading", "trailing", "interior", "comments"} {
+		for name, keep := range map[string]bool{
+			"default": false,
+			"keep":    true,
+		} {
+			t.Run(input+"/"+name, func(t *testing.T) {
+				fo := &options.FilenameOptions{KeepCommentDocuments: keep}
+				got, err := resolveFile(context.Background(), filepath.Join(dir, input+".yaml"), testBuilder,
+					kotesting.NewFixedPublish(mustRepository("gcr.io/multi-pass"), testHashes),
+					fo, &options.SelectorOptions{})
+				if err != nil {
+					t.Fatalf("resolveFile() = %v", err)
+				}
+
+				golden := filepath.Join(dir, input+"."+name+".golden.yaml")
+				if *updateGolden {
+					if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+				want, err := ioutil.ReadFile(golden)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(string(want), string(got)); diff != "" {
+					t.Errorf("resolveFile(%s) (-want +got): %s", input, diff)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/ko/pkg/build"
+)
+
+// The schemes of base images read from files rather than registries, e.g.
+// oci-layout:///path/to/layout or tarball:///path/to/base.tar.
+const (
+	ociLayoutScheme = "oci-layout://"
+	tarballScheme   = "tarball://"
+)
+
+// fileBaseRef is the reference of a base image read from an OCI layout or a
+// tarball. It has no repository.
+type fileBaseRef struct {
+	scheme, path string
+}
+
+var _ name.Reference = fileBaseRef{}
+
+// parseFileBase returns the reference of baseImage, if it's read from a file.
+func parseFileBase(baseImage string) (fileBaseRef, bool) {
+	for _, scheme := range []string{ociLayoutScheme, tarballScheme} {
+		if strings.HasPrefix(baseImage, scheme) {
+			return fileBaseRef{scheme: scheme, path: strings.TrimPrefix(baseImage, scheme)}, true
+		}
+	}
+	return fileBaseRef{}, false
+}
+
+func (r fileBaseRef) Context() name.Repository { return name.Repository{} }
+func (r fileBaseRef) Identifier() string       { return "" }
+func (r fileBaseRef) Name() string             { return r.String() }
+func (r fileBaseRef) String() string           { return r.scheme + r.path }
+func (r fileBaseRef) Scope(string) string      { return "" }
+
+// load reads the base image. Unless multiplatform, an OCI layout's image for
+// p is chosen, like remote.WithPlatform does, or if emulate and it has none,
+// the build.EmulationBase for p.
+func (r fileBaseRef) load(p v1.Platform, multiplatform, emulate bool) (build.Result, error) {
+	scheme := strings.TrimSuffix(r.scheme, "://")
+	if _, err := os.Stat(r.path); err != nil {
+		return nil, fmt.Errorf("%s base image %s: %v", scheme, r.path, err)
+	}
+	if r.scheme == tarballScheme {
+		img, err := tarball.ImageFromPath(r.path, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s base image %s: %v", scheme, r.path, err)
+		}
+		return img, nil
+	}
+
+	idx, err := layout.ImageIndexFromPath(r.path)
+	if err != nil {
+		return nil, fmt.Errorf("%s base image %s: %v", scheme, r.path, err)
+	}
+	res, err := layoutBase(idx, p, multiplatform, emulate)
+	if err != nil {
+		return nil, fmt.Errorf("%s base image %s: %v", scheme, r.path, err)
+	}
+	return res, nil
+}
+
+// layoutBase returns the base in the index of an OCI layout: its only
+// image, or else the index (or the index it holds), or unless multiplatform
+// the image in that for p (or, if emulate, the build.EmulationBase for p).
+func layoutBase(idx v1.ImageIndex, p v1.Platform, multiplatform, emulate bool) (build.Result, error) {
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	if len(im.Manifests) == 1 {
+		desc := im.Manifests[0]
+		if desc.MediaType.IsImage() {
+			return idx.Image(desc.Digest)
+		}
+		if desc.MediaType.IsIndex() {
+			if idx, err = idx.ImageIndex(desc.Digest); err != nil {
+				return nil, err
+			}
+			if im, err = idx.IndexManifest(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if multiplatform {
+		return idx, nil
+	}
+	if p.OS == "" {
+		// Like a registry's index without --platform.
+		p = v1.Platform{OS: "linux", Architecture: "amd64"}
+	}
+	for _, desc := range im.Manifests {
+		if desc.Platform != nil && desc.MediaType.IsImage() && platformRequested([]v1.Platform{p}, *desc.Platform) {
+			return idx.Image(desc.Digest)
+		}
+	}
+	if desc, ok := build.EmulationBase(p, im.Manifests); ok && emulate {
+		return idx.Image(desc.Digest)
+	}
+	return nil, fmt.Errorf("no image for %s", build.PlatformString(p))
+}
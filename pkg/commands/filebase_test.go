@@ -0,0 +1,157 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/google/ko/pkg/commands/options"
+)
+
+func TestFileBaseImages(t *testing.T) {
+	defer func(o map[string]string) { baseImageOverrides = o }(baseImageOverrides)
+
+	dir := t.TempDir()
+
+	// A multi-platform base in an OCI layout, like `crane pull --format=oci`
+	// writes.
+	platforms := []v1.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}}
+	adds := []mutate.IndexAddendum{}
+	digests := map[string]v1.Hash{}
+	for _, p := range platforms {
+		img, err := random.Image(1024, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := p
+		adds = append(adds, mutate.IndexAddendum{Add: img, Descriptor: v1.Descriptor{Platform: &p}})
+		digests[p.Architecture] = mustDigest(img)
+	}
+	idx := mutate.IndexMediaType(mutate.AppendManifests(empty.Index, adds...), types.OCIImageIndex)
+	layoutDir := filepath.Join(dir, "layout")
+	lp, err := layout.Write(layoutDir, empty.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lp.AppendIndex(idx); err != nil {
+		t.Fatal(err)
+	}
+	idxDigest, err := idx.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A single-platform base in a tarball, like `docker save` writes.
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarPath := filepath.Join(dir, "base.tar")
+	if err := tarball.WriteToFile(tarPath, name.MustParseReference("example.com/base:latest"), img); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		desc     string
+		base     string
+		override string
+		platform string
+		want     v1.Hash
+		wantErr  string
+	}{{
+		desc:     "layout for a platform",
+		base:     "oci-layout://" + layoutDir,
+		platform: "linux/arm64",
+		want:     digests["arm64"],
+	}, {
+		desc: "layout without a platform",
+		base: "oci-layout://" + layoutDir,
+		want: digests["amd64"],
+	}, {
+		desc:     "layout for all platforms",
+		base:     "oci-layout://" + layoutDir,
+		platform: "all",
+		want:     idxDigest,
+	}, {
+		desc:     "layout override",
+		override: "oci-layout://" + layoutDir,
+		platform: "linux/amd64",
+		want:     digests["amd64"],
+	}, {
+		desc:     "layout without the platform",
+		base:     "oci-layout://" + layoutDir,
+		platform: "linux/s390x",
+		wantErr:  "no image for linux/s390x",
+	}, {
+		desc: "tarball",
+		base: "tarball://" + tarPath,
+		want: mustDigest(img),
+	}, {
+		desc:    "missing layout",
+		base:    "oci-layout://" + filepath.Join(dir, "missing"),
+		wantErr: "oci-layout base image " + filepath.Join(dir, "missing"),
+	}, {
+		desc:    "missing tarball",
+		base:    "tarball://" + filepath.Join(dir, "missing.tar"),
+		wantErr: "tarball base image " + filepath.Join(dir, "missing.tar"),
+	}} {
+		t.Run(test.desc, func(t *testing.T) {
+			const ip = "example.com/app/cmd/app"
+			baseImageOverrides = map[string]string{}
+			if test.override != "" {
+				baseImageOverrides[ip] = test.override
+			}
+			ref, res, err := getBaseImage(test.platform, &options.BuildOptions{BaseImage: test.base})(context.Background(), "ko://"+ip)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("getBaseImage() = %v, wanted error containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getBaseImage() = %v", err)
+			}
+			if want := test.base + test.override; ref.String() != want {
+				t.Errorf("getBaseImage() ref = %s, wanted %s", ref, want)
+			}
+			got, err := res.Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("getBaseImage() digest = %s, wanted %s", got, test.want)
+			}
+		})
+	}
+
+	// The bases are checked when the config is loaded.
+	if err := checkBaseImage("oci-layout://"); err == nil {
+		t.Error("checkBaseImage(oci-layout://) succeeded, wanted error for the missing path")
+	}
+	if err := checkBaseImage("tarball:///base.tar"); err != nil {
+		t.Errorf("checkBaseImage(tarball:///base.tar) = %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/google/ko/pkg/commands/options"
+	"github.com/google/ko/pkg/resolve"
+	"github.com/spf13/cobra"
+)
+
+// withGitHubErrors wraps run to annotate the error it returns, if any, with
+// a GitHub Actions ::error workflow command, when running in GitHub Actions
+// with --github-output.
+func withGitHubErrors(po *options.PublishOptions, run func(*cobra.Command, []string) error) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		err := run(cmd, args)
+		if err != nil && po.GitHubOutput {
+			if v, _ := lookupEnv("GITHUB_ACTIONS"); v == "true" {
+				writeGitHubError(os.Stderr, err)
+			}
+		}
+		return err
+	}
+}
+
+// writeGitHubError writes err to w as an ::error workflow command, with the
+// file, line and column it's about, if known.
+func writeGitHubError(w io.Writer, err error) {
+	var props []string
+	var fe *fileError
+	if errors.As(err, &fe) {
+		props = append(props, "file="+escapeGitHubProperty(fe.file))
+		var re *resolve.ReferenceError
+		if errors.As(err, &re) && re.Line > 0 {
+			props = append(props, fmt.Sprintf("line=%d", re.Line), fmt.Sprintf("col=%d", re.Column))
+		}
+	}
+	cmd := "::error"
+	if len(props) > 0 {
+		cmd += " " + strings.Join(props, ",")
+	}
+	fmt.Fprintf(w, "%s::%s\n", cmd, escapeGitHubData(err.Error()))
+}
+
+// escapeGitHubData escapes the message of a workflow command.
+func escapeGitHubData(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// escapeGitHubProperty escapes a property value of a workflow command.
+func escapeGitHubProperty(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(s)
+}
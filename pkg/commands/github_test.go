@@ -0,0 +1,143 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/commands/options"
+	kotesting "github.com/google/ko/pkg/internal/testing"
+)
+
+func TestWriteGitHubError(t *testing.T) {
+	for _, c := range []struct {
+		desc string
+		err  error
+		want string
+	}{{
+		desc: "plain error",
+		err:  errors.New("no KO_DOCKER_REPO"),
+		want: "::error::no KO_DOCKER_REPO\n",
+	}, {
+		desc: "file error",
+		err:  &fileError{file: "config/app.yaml", err: errors.New("boom")},
+		want: "::error file=config/app.yaml::error processing import paths in \"config/app.yaml\": boom\n",
+	}, {
+		desc: "escaping",
+		err:  &fileError{file: "a,b:c.yaml", err: errors.New("100%\nfailed")},
+		want: "::error file=a%2Cb%3Ac.yaml::error processing import paths in \"a,b:c.yaml\": 100%25%0Afailed\n",
+	}} {
+		t.Run(c.desc, func(t *testing.T) {
+			var buf bytes.Buffer
+			writeGitHubError(&buf, c.err)
+			if got := buf.String(); got != c.want {
+				t.Errorf("writeGitHubError() = %q, wanted %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestResolveGitHubErrorPosition(t *testing.T) {
+	// The bad reference is in the second document, so its line must be
+	// relative to the file, not the document.
+	inputYAML := []byte(`apiVersion: v1
+kind: ConfigMap
+---
+apiVersion: v1
+kind: Pod
+spec:
+  containers:
+  - image: ko://not/a valid/import path
+`)
+	f := yamlToTmpFile(t, inputYAML)
+	defer os.Remove(f)
+
+	_, err := resolveFile(context.Background(), f, testBuilder,
+		kotesting.NewFixedPublish(mustRepository("gcr.io/multi-pass"), testHashes),
+		&options.FilenameOptions{}, &options.SelectorOptions{})
+	if err == nil {
+		t.Fatal("resolveFile() = nil, wanted error for invalid reference")
+	}
+
+	var buf bytes.Buffer
+	writeGitHubError(&buf, &fileError{file: f, err: err})
+	want := fmt.Sprintf("::error file=%s,line=8,col=12::", f)
+	if got := buf.String(); !bytes.HasPrefix([]byte(got), []byte(want)) {
+		t.Errorf("writeGitHubError() = %q, wanted prefix %q", got, want)
+	}
+}
+
+func TestGitHubOutputInert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "github")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outputFile := filepath.Join(dir, "output")
+
+	defer func() { lookupEnv = os.LookupEnv }()
+	for _, c := range []struct {
+		desc    string
+		flag    bool
+		env     map[string]string
+		wantOut bool
+	}{{
+		desc: "flag without Actions",
+		flag: true,
+	}, {
+		desc: "Actions without flag",
+		env:  map[string]string{"GITHUB_OUTPUT": outputFile},
+	}, {
+		desc:    "flag in Actions",
+		flag:    true,
+		env:     map[string]string{"GITHUB_OUTPUT": outputFile},
+		wantOut: true,
+	}} {
+		t.Run(c.desc, func(t *testing.T) {
+			os.Remove(outputFile)
+			lookupEnv = func(key string) (string, bool) {
+				v, ok := c.env[key]
+				return v, ok
+			}
+			pub, err := NewPublisher(&options.PublishOptions{
+				Local:        true,
+				LocalDomain:  "localdomain.example.com/repo",
+				DockerClient: &kotesting.MockDaemon{},
+				GitHubOutput: c.flag,
+			})
+			if err != nil {
+				t.Fatalf("NewPublisher() = %v", err)
+			}
+			defer pub.Close()
+			if _, err := pub.Publish(context.Background(), empty.Image, build.StrictScheme+"github.com/google/ko/test"); err != nil {
+				t.Fatalf("Publish() = %v", err)
+			}
+
+			_, err = os.Stat(outputFile)
+			if gotOut := err == nil; gotOut != c.wantOut {
+				t.Errorf("wrote %s = %t, wanted %t", outputFile, gotOut, c.wantOut)
+			}
+		})
+	}
+}
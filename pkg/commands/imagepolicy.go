@@ -0,0 +1,117 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"sort"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/ko/pkg/commands/options"
+	"github.com/google/ko/pkg/publish"
+	"gopkg.in/yaml.v3"
+)
+
+// The subset of the policy-controller ClusterImagePolicy schema that we
+// generate, see:
+// https://docs.sigstore.dev/policy-controller/overview/#configuring-image-patterns
+type clusterImagePolicy struct {
+	APIVersion string                 `yaml:"apiVersion"`
+	Kind       string                 `yaml:"kind"`
+	Metadata   imagePolicyMetadata    `yaml:"metadata"`
+	Spec       clusterImagePolicySpec `yaml:"spec"`
+}
+
+type imagePolicyMetadata struct {
+	Name string `yaml:"name"`
+}
+
+type clusterImagePolicySpec struct {
+	Images      []imagePolicyImage     `yaml:"images"`
+	Authorities []imagePolicyAuthority `yaml:"authorities"`
+}
+
+type imagePolicyImage struct {
+	Glob string `yaml:"glob"`
+}
+
+type imagePolicyAuthority struct {
+	Key imagePolicyKey `yaml:"key"`
+}
+
+type imagePolicyKey struct {
+	HashAlgorithm string `yaml:"hashAlgorithm"`
+	Data          string `yaml:"data"`
+}
+
+// imagePolicyYAML returns a ClusterImagePolicy skeleton that requires images
+// in each repository the references were pushed to to be signed by the
+// private key of pub. References to the local daemon, KinD or containerd are
+// skipped, since those aren't pulled from a registry.
+func imagePolicyYAML(ipo *options.ImagePolicyOptions, pub crypto.PublicKey, refs map[string]name.Reference) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	var images []imagePolicyImage
+	for _, ref := range refs {
+		repo := ref.Context()
+		if r := repo.RegistryStr(); r == publish.LocalDomain || r == publish.KindDomain || r == publish.ContainerdDomain {
+			continue
+		}
+		// "**" also matches the tag or digest that follows the repository.
+		glob := repo.Name() + "**"
+		if !seen[glob] {
+			seen[glob] = true
+			images = append(images, imagePolicyImage{Glob: glob})
+		}
+	}
+	if len(images) == 0 {
+		return nil, errors.New("no images were pushed to a registry")
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Glob < images[j].Glob })
+
+	policy := clusterImagePolicy{
+		APIVersion: "policy.sigstore.dev/v1beta1",
+		Kind:       "ClusterImagePolicy",
+		Metadata:   imagePolicyMetadata{Name: ipo.Name},
+		Spec: clusterImagePolicySpec{
+			Images: images,
+			Authorities: []imagePolicyAuthority{{
+				Key: imagePolicyKey{
+					HashAlgorithm: "sha256",
+					Data:          string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+				},
+			}},
+		},
+	}
+
+	buf := &bytes.Buffer{}
+	e := yaml.NewEncoder(buf)
+	e.SetIndent(2)
+	if err := e.Encode(policy); err != nil {
+		return nil, err
+	}
+	if err := e.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/commands/options"
+	kotesting "github.com/google/ko/pkg/internal/testing"
+	"github.com/google/ko/pkg/publish"
+	"gopkg.in/yaml.v3"
+)
+
+func TestImagePolicy(t *testing.T) {
+	base := mustRepository("registry.example.com/team")
+	rec := &publish.Recorder{Publisher: kotesting.NewFixedPublish(base, testHashes)}
+
+	inputYAML := []byte("image: " + build.StrictScheme + fooRef + "\n---\nimage: " + build.StrictScheme + barRef + "\n")
+	fo := &options.FilenameOptions{Filenames: []string{yamlToTmpFile(t, inputYAML)}}
+	builder, err := build.NewCaching(testBuilder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resolveFilesToWriter(context.Background(), builder, rec, fo, &options.SelectorOptions{}, nopWriteCloser{&bytes.Buffer{}}); err != nil {
+		t.Fatalf("resolveFilesToWriter() = %v", err)
+	}
+	refs := rec.References()
+	// Images loaded into the daemon aren't pulled, so aren't covered.
+	refs["ko://github.com/awesomesauce/local"] = name.MustParseReference("ko.local/local:latest")
+
+	key := mustECKey(t)
+	b, err := imagePolicyYAML(&options.ImagePolicyOptions{Name: "signed-by-ko"}, key.Public(), refs)
+	if err != nil {
+		t.Fatalf("imagePolicyYAML() = %v", err)
+	}
+
+	var policy clusterImagePolicy
+	if err := yaml.Unmarshal(b, &policy); err != nil {
+		t.Fatalf("yaml.Unmarshal() = %v", err)
+	}
+	if policy.APIVersion != "policy.sigstore.dev/v1beta1" || policy.Kind != "ClusterImagePolicy" || policy.Metadata.Name != "signed-by-ko" {
+		t.Errorf("unexpected ClusterImagePolicy: %s", b)
+	}
+	want := []imagePolicyImage{
+		{Glob: "registry.example.com/team/" + barRef + "**"},
+		{Glob: "registry.example.com/team/" + fooRef + "**"},
+	}
+	if diff := cmp.Diff(want, policy.Spec.Images); diff != "" {
+		t.Errorf("ClusterImagePolicy images (-want +got) = %s", diff)
+	}
+
+	if len(policy.Spec.Authorities) != 1 {
+		t.Fatalf("ClusterImagePolicy has %d authorities, wanted 1", len(policy.Spec.Authorities))
+	}
+	block, _ := pem.Decode([]byte(policy.Spec.Authorities[0].Key.Data))
+	if block == nil {
+		t.Fatalf("no PEM public key in %s", b)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatalf("x509.ParsePKIXPublicKey() = %v", err)
+	}
+	if !key.PublicKey.Equal(pub) {
+		t.Error("ClusterImagePolicy key isn't the signing key's public key")
+	}
+
+	// Nothing to require signatures on is a mistake, e.g. with --local.
+	if _, err := imagePolicyYAML(&options.ImagePolicyOptions{Name: "signed-by-ko"}, key.Public(), map[string]name.Reference{
+		"ko://github.com/awesomesauce/local": name.MustParseReference("ko.local/local:latest"),
+	}); err == nil {
+		t.Error("imagePolicyYAML() with only local images = nil, wanted error")
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"bytes"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/ko/pkg/commands/options"
+	"gopkg.in/yaml.v3"
+)
+
+// The subset of the Kubernetes Job schema that we generate, see:
+// https://kubernetes.io/docs/concepts/workloads/controllers/job/
+type job struct {
+	APIVersion string      `yaml:"apiVersion"`
+	Kind       string      `yaml:"kind"`
+	Metadata   jobMetadata `yaml:"metadata"`
+	Spec       jobSpec     `yaml:"spec"`
+}
+
+type jobMetadata struct {
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace,omitempty"`
+}
+
+type jobSpec struct {
+	// BackoffLimit is 0 so that a failed migration isn't retried.
+	BackoffLimit int         `yaml:"backoffLimit"`
+	Template     jobTemplate `yaml:"template"`
+}
+
+type jobTemplate struct {
+	Spec jobPodSpec `yaml:"spec"`
+}
+
+type jobPodSpec struct {
+	RestartPolicy string         `yaml:"restartPolicy"`
+	Containers    []jobContainer `yaml:"containers"`
+}
+
+type jobContainer struct {
+	Name    string   `yaml:"name"`
+	Image   string   `yaml:"image"`
+	Command []string `yaml:"command,omitempty"`
+	Args    []string `yaml:"args,omitempty"`
+}
+
+// jobYAML returns a Job that runs the command of jo once in the image ref.
+func jobYAML(jo *options.JobOptions, ref name.Reference) ([]byte, error) {
+	j := job{
+		APIVersion: "batch/v1",
+		Kind:       "Job",
+		Metadata: jobMetadata{
+			Name:      jo.Name,
+			Namespace: jo.Namespace,
+		},
+		Spec: jobSpec{
+			Template: jobTemplate{
+				Spec: jobPodSpec{
+					RestartPolicy: "Never",
+					Containers: []jobContainer{{
+						Name:    jo.Name,
+						Image:   ref.String(),
+						Command: jo.Command,
+						Args:    jo.Args,
+					}},
+				},
+			},
+		},
+	}
+
+	buf := &bytes.Buffer{}
+	e := yaml.NewEncoder(buf)
+	e.SetIndent(2)
+	if err := e.Encode(j); err != nil {
+		return nil, err
+	}
+	if err := e.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
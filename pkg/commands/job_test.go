@@ -0,0 +1,88 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/commands/options"
+	kotesting "github.com/google/ko/pkg/internal/testing"
+	"github.com/google/ko/pkg/publish"
+	"gopkg.in/yaml.v3"
+)
+
+func TestJob(t *testing.T) {
+	base := mustRepository("gcr.io/job")
+	rec := &publish.Recorder{Publisher: kotesting.NewFixedPublish(base, testHashes)}
+
+	inputYAML := []byte("image: " + build.StrictScheme + fooRef + "\n")
+	buf := bytes.NewBuffer(nil)
+	fo := &options.FilenameOptions{Filenames: []string{yamlToTmpFile(t, inputYAML)}}
+	builder, err := build.NewCaching(testBuilder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resolveFilesToWriter(context.Background(), builder, rec, fo, &options.SelectorOptions{}, nopWriteCloser{buf}); err != nil {
+		t.Fatalf("resolveFilesToWriter() = %v", err)
+	}
+
+	// The Job's image is published like the resolved documents', so it's
+	// the same one.
+	refs, err := publishImages(context.Background(), []string{build.StrictScheme + fooRef}, rec, builder)
+	if err != nil {
+		t.Fatalf("publishImages() = %v", err)
+	}
+	jo := &options.JobOptions{
+		ImportPath: build.StrictScheme + fooRef,
+		Name:       "migrate",
+		Namespace:  "prod",
+		Command:    []string{"/ko-app/foo"},
+		Args:       []string{"migrate", "--to=latest"},
+	}
+	b, err := jobYAML(jo, refs[build.StrictScheme+fooRef])
+	if err != nil {
+		t.Fatalf("jobYAML() = %v", err)
+	}
+
+	var got job
+	if err := yaml.Unmarshal(b, &got); err != nil {
+		t.Fatalf("yaml.Unmarshal() = %v", err)
+	}
+	img := kotesting.ComputeDigest(base, fooRef, fooHash)
+	want := job{
+		APIVersion: "batch/v1",
+		Kind:       "Job",
+		Metadata:   jobMetadata{Name: "migrate", Namespace: "prod"},
+		Spec: jobSpec{Template: jobTemplate{Spec: jobPodSpec{
+			RestartPolicy: "Never",
+			Containers: []jobContainer{{
+				Name:    "migrate",
+				Image:   img,
+				Command: []string{"/ko-app/foo"},
+				Args:    []string{"migrate", "--to=latest"},
+			}},
+		}}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Job (-want +got) = %s", diff)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte(img)) {
+		t.Errorf("resolved output does not contain %s", img)
+	}
+}
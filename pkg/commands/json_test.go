@@ -0,0 +1,125 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/ko/pkg/commands/options"
+	kotesting "github.com/google/ko/pkg/internal/testing"
+)
+
+func TestResolveJSON(t *testing.T) {
+	base := mustRepository("gcr.io/multi-pass")
+	digest := kotesting.ComputeDigest(base, fooRef, fooHash)
+
+	input := fmt.Sprintf(`{
+  "apiVersion": "v1",
+  "kind": "Pod",
+  "metadata": {"name": "foo", "creationTimestamp": null},
+  "spec": {
+    "containers": [{"image": "ko://%s", "ports": [{"containerPort": 8080}]}],
+    "hostNetwork": false,
+    "terminationGracePeriodSeconds": 1.5e1
+  },
+  "status": {"phase": "Running"}
+}
+`, fooRef)
+
+	for _, c := range []struct {
+		desc string
+		fo   *options.FilenameOptions
+		want string
+	}{{
+		// Only the reference changes, so the rest is kept as it is.
+		desc: "unchanged",
+		fo:   &options.FilenameOptions{},
+		want: fmt.Sprintf(`{
+  "apiVersion": "v1",
+  "kind": "Pod",
+  "metadata": {"name": "foo", "creationTimestamp": null},
+  "spec": {
+    "containers": [{"image": "%s", "ports": [{"containerPort": 8080}]}],
+    "hostNetwork": false,
+    "terminationGracePeriodSeconds": 1.5e1
+  },
+  "status": {"phase": "Running"}
+}
+`, digest),
+	}, {
+		// Normalizing re-encodes it, still as JSON, without turning numbers
+		// and booleans into strings.
+		desc: "normalized",
+		fo:   &options.FilenameOptions{Normalize: options.NormalizeOptions{Normalize: true}},
+		want: fmt.Sprintf(`{
+  "apiVersion": "v1",
+  "kind": "Pod",
+  "metadata": {
+    "name": "foo"
+  },
+  "spec": {
+    "containers": [
+      {
+        "image": "%s",
+        "ports": [
+          {
+            "containerPort": 8080
+          }
+        ]
+      }
+    ],
+    "hostNetwork": false,
+    "terminationGracePeriodSeconds": 1.5e1
+  }
+}
+`, digest),
+	}} {
+		t.Run(c.desc, func(t *testing.T) {
+			f := yamlToTmpFile(t, []byte(input))
+			defer os.Remove(f)
+
+			got, err := resolveFile(context.Background(), f, testBuilder,
+				kotesting.NewFixedPublish(base, testHashes), c.fo, &options.SelectorOptions{})
+			if err != nil {
+				t.Fatalf("resolveFile() = %v", err)
+			}
+			if diff := cmp.Diff(c.want, string(got)); diff != "" {
+				t.Errorf("resolveFile() (-want +got): %s", diff)
+			}
+		})
+	}
+}
+
+func TestIsJSON(t *testing.T) {
+	for _, c := range []struct {
+		f    string
+		b    string
+		want bool
+	}{
+		{"deploy.json", "", true},
+		{"deploy.JSON", "kind: Pod", true},
+		{"deploy.yaml", "\n  {\"kind\": \"Pod\"}", true},
+		{"deploy.yaml", "kind: Pod", false},
+		{"-", "# {\nkind: Pod", false},
+	} {
+		if got := isJSON(c.f, []byte(c.b)); got != c.want {
+			t.Errorf("isJSON(%q, %q) = %t, wanted %t", c.f, c.b, got, c.want)
+		}
+	}
+}
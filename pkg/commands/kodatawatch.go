@@ -0,0 +1,158 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	gb "go/build"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/mattmoor/dep-notify/pkg/graph"
+)
+
+// kodataWatcher watches the kodata directories of the importpaths added to
+// it, which dep-notify ignores, since they hold no Go files. A change there
+// only needs the data layer of the importpath's image rebuilt, see
+// build.Caching.InvalidateData.
+type kodataWatcher struct {
+	watcher *fsnotify.Watcher
+	// workdir is the directory importpaths are resolved in, like
+	// dep-notify does.
+	workdir  string
+	onChange func(graph.StringSet)
+
+	m sync.Mutex
+	// roots maps each watched kodata directory to the importpaths whose
+	// kodata it is.
+	roots map[string]graph.StringSet
+}
+
+// newKoDataWatcher returns a kodataWatcher that calls onChange with the
+// importpaths whose kodata changed.
+func newKoDataWatcher(onChange func(graph.StringSet)) (*kodataWatcher, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return &kodataWatcher{
+		watcher:  w,
+		workdir:  wd,
+		onChange: onChange,
+		roots:    map[string]graph.StringSet{},
+	}, nil
+}
+
+// Add watches the kodata directory of ip, if it has one.
+func (k *kodataWatcher) Add(ip string) error {
+	ctx := gb.Default
+	ctx.Dir = k.workdir
+	pkg, err := ctx.Import(ip, k.workdir, gb.FindOnly)
+	if err != nil {
+		return err
+	}
+	root := filepath.Join(pkg.Dir, "kodata")
+
+	k.m.Lock()
+	defer k.m.Unlock()
+	if ips, ok := k.roots[root]; ok {
+		ips.Add(ip)
+		return nil
+	}
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return nil
+	}
+	if err := k.watchTree(root); err != nil {
+		return err
+	}
+	k.roots[root] = graph.StringSet{ip: {}}
+	return nil
+}
+
+// watchTree watches root and the directories under it, since fsnotify only
+// reports changes to the direct children of a directory. Symlinked
+// directories aren't followed.
+func (k *kodataWatcher) watchTree(root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return k.watcher.Add(path)
+		}
+		return nil
+	})
+}
+
+// affected returns the importpaths whose kodata contains path.
+func (k *kodataWatcher) affected(path string) graph.StringSet {
+	k.m.Lock()
+	defer k.m.Unlock()
+	ss := graph.StringSet{}
+	for root, ips := range k.roots {
+		if path == root || strings.HasPrefix(path, root+string(filepath.Separator)) {
+			for ip := range ips {
+				ss.Add(ip)
+			}
+		}
+	}
+	return ss
+}
+
+// run relays changes until done is closed, and the watcher's errors to
+// errCh.
+func (k *kodataWatcher) run(errCh chan<- error, done <-chan struct{}) {
+	for {
+		select {
+		case event, ok := <-k.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&fsnotify.Create != 0 {
+				if fi, err := os.Stat(event.Name); err == nil && fi.IsDir() {
+					if err := k.watchTree(event.Name); err != nil {
+						log.Printf("watching %s: %v", event.Name, err)
+					}
+				}
+			}
+			if ss := k.affected(event.Name); len(ss) > 0 {
+				k.onChange(ss)
+			}
+		case err, ok := <-k.watcher.Errors:
+			if !ok {
+				return
+			}
+			select {
+			case errCh <- err:
+			case <-done:
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Close stops watching.
+func (k *kodataWatcher) Close() error {
+	return k.watcher.Close()
+}
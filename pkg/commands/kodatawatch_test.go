@@ -0,0 +1,69 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mattmoor/dep-notify/pkg/graph"
+)
+
+func TestKoDataWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ko-kodata-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "kodata")
+	if err := os.MkdirAll(filepath.Join(root, "static"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := make(chan graph.StringSet, 10)
+	kw, err := newKoDataWatcher(func(ss graph.StringSet) { changed <- ss })
+	if err != nil {
+		t.Fatalf("newKoDataWatcher() = %v", err)
+	}
+	defer kw.Close()
+	if err := kw.watchTree(root); err != nil {
+		t.Fatalf("watchTree() = %v", err)
+	}
+	kw.roots[root] = graph.StringSet{fooRef: {}}
+	done := make(chan struct{})
+	defer close(done)
+	go kw.run(make(chan error, 1), done)
+
+	// Changes in subdirectories count too.
+	if err := ioutil.WriteFile(filepath.Join(root, "static", "index.html"), []byte("hi"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ss := <-changed:
+		if diff := cmp.Diff([]string{fooRef}, ss.InOrder()); diff != "" {
+			t.Errorf("changed (-want +got): %s", diff)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no change after writing to kodata")
+	}
+
+	if got := kw.affected(filepath.Join(dir, "kodata2", "x")); len(got) != 0 {
+		t.Errorf("affected(sibling) = %v, wanted none", got.InOrder())
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/commands/options"
+)
+
+// confirm asks the user whether to go ahead with what summary describes,
+// or is nil if there's no one to ask.
+var confirm = terminalConfirm()
+
+// terminalConfirm returns a confirm that asks on stderr, and reads the
+// answer from stdin, if both are terminals.
+func terminalConfirm() func(summary string) (bool, error) {
+	for _, f := range []*os.File{os.Stdin, os.Stderr} {
+		fi, err := f.Stat()
+		if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+			return nil
+		}
+	}
+	return func(summary string) (bool, error) {
+		fmt.Fprintf(os.Stderr, "%s. Continue? [y/N] ", summary)
+		answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			return false, err
+		}
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		return answer == "y" || answer == "yes", nil
+	}
+}
+
+// preflight counts the files fo names, and the importpaths they reference,
+// before anything is built, and fails if they're more than fo.MaxFiles or
+// fo.MaxImportPaths. More than half as many are only built if confirmed.
+func preflight(ctx context.Context, builder build.Interface, fo *options.FilenameOptions, so *options.SelectorOptions) error {
+	if fo.MaxFiles <= 0 && fo.MaxImportPaths <= 0 {
+		return nil
+	}
+	// The files are resolved, without building anything, once, as they are
+	// to begin with.
+	pfo := *fo
+	pfo.Watch = false
+	pfo.BuildOutput = ""
+	pfo.MaxFiles, pfo.MaxImportPaths = 0, 0
+
+	var files []string
+	for f := range options.EnumerateFiles(&pfo) {
+		files = append(files, f)
+	}
+	if err := checkLimit(len(files), fo.MaxFiles, "files", "--max-files", files); err != nil {
+		return err
+	}
+	importpaths, err := warmImportPaths(ctx, builder, &pfo, so, nil)
+	if err != nil {
+		return err
+	}
+	summary := fmt.Sprintf("Resolving %d files (--max-files=%d), which reference %d import paths (--max-import-paths=%d)",
+		len(files), fo.MaxFiles, len(importpaths), fo.MaxImportPaths)
+	log.Print(summary)
+	if err := checkLimit(len(importpaths), fo.MaxImportPaths, "import paths", "--max-import-paths", importpaths); err != nil {
+		return err
+	}
+
+	soft := (fo.MaxFiles > 0 && 2*len(files) > fo.MaxFiles) ||
+		(fo.MaxImportPaths > 0 && 2*len(importpaths) > fo.MaxImportPaths)
+	if !soft || confirm == nil || fo.DryRun || readsStdin(fo) {
+		return nil
+	}
+	ok, err := confirm(summary)
+	if err != nil {
+		return fmt.Errorf("reading confirmation: %v", err)
+	}
+	if !ok {
+		return fmt.Errorf("not resolving %d files with %d import paths, which wasn't confirmed", len(files), len(importpaths))
+	}
+	return nil
+}
+
+// checkLimit fails if n, the number of what, listed in items, is more than
+// limit, with a summary of them and how to raise the limit.
+func checkLimit(n, limit int, what, flag string, items []string) error {
+	if limit <= 0 || n <= limit {
+		return nil
+	}
+	const shown = 10
+	summary := items
+	if len(summary) > shown {
+		summary = summary[:shown]
+	}
+	more := ""
+	if len(items) > shown {
+		more = fmt.Sprintf("\n  ... and %d more", len(items)-shown)
+	}
+	return fmt.Errorf("not building anything, since there are %d %s, more than %s=%d:\n  %s%s\n"+
+		"check that -f names the right files, or pass %s=%d (or 0 for no limit) if so many are intended",
+		n, what, flag, limit, strings.Join(summary, "\n  "), more, flag, n)
+}
+
+// readsStdin returns whether one of the files of fo is stdin, which can't
+// also be asked for a confirmation.
+func readsStdin(fo *options.FilenameOptions) bool {
+	for _, f := range fo.Filenames {
+		if f == "-" {
+			return true
+		}
+	}
+	return false
+}
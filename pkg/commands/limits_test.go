@@ -0,0 +1,200 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/commands/options"
+	kotesting "github.com/google/ko/pkg/internal/testing"
+	"github.com/google/ko/pkg/warnings"
+)
+
+func TestImportPathLimits(t *testing.T) {
+	defer func(c func(string) (bool, error)) { confirm = c }(confirm)
+
+	// Four files, each referencing its own importpath.
+	base := mustRepository("gcr.io/limits")
+	hashes := map[string]v1.Hash{}
+	var files []string
+	for i := 0; i < 4; i++ {
+		ip := fmt.Sprintf("%s/%d", fooRef, i)
+		hashes[ip] = fooHash
+		files = append(files, yamlToTmpFile(t, []byte("image: "+build.StrictScheme+ip+"\n")))
+	}
+
+	for _, test := range []struct {
+		desc           string
+		maxFiles       int
+		maxImportPaths int
+		dryRun         bool
+		// answer is the user's answer, or "" if there's no terminal.
+		answer    string
+		wantErr   string
+		wantAsked bool
+	}{{
+		desc: "no limits",
+	}, {
+		desc:           "under the limits",
+		maxFiles:       10,
+		maxImportPaths: 10,
+	}, {
+		desc:     "too many files",
+		maxFiles: 3,
+		wantErr:  "there are 4 files, more than --max-files=3",
+	}, {
+		desc:           "too many import paths",
+		maxImportPaths: 3,
+		wantErr:        "pass --max-import-paths=4 (or 0 for no limit)",
+	}, {
+		desc:           "confirmed",
+		maxImportPaths: 6,
+		answer:         "y",
+		wantAsked:      true,
+	}, {
+		desc:           "not confirmed",
+		maxImportPaths: 6,
+		answer:         "n",
+		wantAsked:      true,
+		wantErr:        "wasn't confirmed",
+	}, {
+		desc:           "dry run isn't confirmed",
+		maxImportPaths: 6,
+		dryRun:         true,
+		answer:         "n",
+	}, {
+		desc:           "not a terminal",
+		maxImportPaths: 6,
+	}} {
+		t.Run(test.desc, func(t *testing.T) {
+			asked := false
+			confirm = nil
+			if test.answer != "" {
+				confirm = func(summary string) (bool, error) {
+					asked = true
+					if !strings.Contains(summary, "4 import paths (--max-import-paths=6)") {
+						t.Errorf("confirm(%q) doesn't say how many import paths there are", summary)
+					}
+					return test.answer == "y", nil
+				}
+			}
+			cb := &countingBuilder{builds: map[string]int{}}
+			builder, err := build.NewCaching(cb)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fo := &options.FilenameOptions{
+				Filenames:      files,
+				MaxFiles:       test.maxFiles,
+				MaxImportPaths: test.maxImportPaths,
+				DryRun:         test.dryRun,
+			}
+			err = resolveFilesToWriter(context.Background(), builder, kotesting.NewFixedPublish(base, hashes), fo, &options.SelectorOptions{}, nopWriteCloser{ioutil.Discard})
+			if asked != test.wantAsked {
+				t.Errorf("asked for confirmation: %v, wanted %v", asked, test.wantAsked)
+			}
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("resolveFilesToWriter() = %v, wanted error containing %q", err, test.wantErr)
+				}
+				// Nothing is built.
+				if len(cb.builds) != 0 {
+					t.Errorf("built %v, wanted nothing", cb.builds)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveFilesToWriter() = %v", err)
+			}
+			if len(cb.builds) != 4 {
+				t.Errorf("built %v, wanted the 4 import paths", cb.builds)
+			}
+		})
+	}
+}
+
+func TestImportPathLimitsStdin(t *testing.T) {
+	base := mustRepository("gcr.io/limits")
+	ip := fooRef + "/stdin"
+	hashes := map[string]v1.Hash{ip: fooHash}
+	builder, err := build.NewCaching(&countingBuilder{builds: map[string]int{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stdin, which was read already, is counted by the preflight and then
+	// resolved from the same bytes.
+	fo := &options.FilenameOptions{
+		Filenames:      []string{"-"},
+		MaxImportPaths: 10,
+		Stdin:          []byte("image: " + build.StrictScheme + ip + "\n"),
+	}
+	buf := &bytes.Buffer{}
+	if err := resolveFilesToWriter(context.Background(), builder, kotesting.NewFixedPublish(base, hashes), fo, &options.SelectorOptions{}, nopWriteCloser{buf}); err != nil {
+		t.Fatalf("resolveFilesToWriter() = %v", err)
+	}
+	if want := "gcr.io/limits/" + ip + "@" + fooHash.String(); !strings.Contains(buf.String(), want) {
+		t.Errorf("resolved stdin to %q, wanted it to contain %q", buf.String(), want)
+	}
+}
+
+// configuredBuilder resolves the build config of each importpath it builds,
+// like the go builder does.
+type configuredBuilder struct {
+	countingBuilder
+}
+
+func (c *configuredBuilder) Build(ctx context.Context, ip string) (build.Result, error) {
+	buildConfigTracker.Resolve(strings.TrimPrefix(ip, build.StrictScheme))
+	return c.countingBuilder.Build(ctx, ip)
+}
+
+func TestPreflightDoesNotWarnAboutBuildConfigs(t *testing.T) {
+	defer func(configs map[string]build.Config) {
+		buildConfigs = configs
+		buildConfigTracker = nil
+	}(buildConfigs)
+	defer warnings.SetDefault(warnings.SetDefault(&warnings.Collector{}))
+
+	ip := fooRef + "/configured"
+	buildConfigs = map[string]build.Config{ip: {}}
+	if _, err := gobuildOptions(&options.BuildOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	builder, err := build.NewCaching(&configuredBuilder{countingBuilder{builds: map[string]int{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The preflight resolves the file without building anything, which
+	// mustn't count as the entry not matching what was built.
+	fo := &options.FilenameOptions{
+		Filenames:      []string{yamlToTmpFile(t, []byte("image: "+build.StrictScheme+ip+"\n"))},
+		MaxFiles:       options.DefaultMaxFiles,
+		MaxImportPaths: options.DefaultMaxImportPaths,
+	}
+	hashes := map[string]v1.Hash{ip: fooHash}
+	if err := resolveFilesToWriter(context.Background(), builder, kotesting.NewFixedPublish(mustRepository("gcr.io/limits"), hashes), fo, &options.SelectorOptions{}, nopWriteCloser{ioutil.Discard}); err != nil {
+		t.Fatalf("resolveFilesToWriter() = %v", err)
+	}
+	if ws := warnings.Default().Warnings(); len(ws) != 0 {
+		t.Errorf("warnings = %v, wanted none", ws)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/ko/pkg/commands/options"
+	"gopkg.in/yaml.v3"
+)
+
+// objectIdentity identifies an object across the files passed with --merge.
+// The apiVersion isn't part of it, so that an overlay can move an object to
+// a newer version.
+type objectIdentity struct {
+	kind, namespace, name string
+}
+
+// mergeFiles reads files, in order, and returns their documents as a single
+// multi-document yaml file, in which each object replaces any earlier one
+// with the same kind, namespace and name, in its place. Documents that
+// aren't objects with a kind and name, like lists, are all kept. The file
+// "-" is read from fo.Stdin, if it was read already.
+func mergeFiles(files []string, fo *options.FilenameOptions) ([]byte, error) {
+	stdin := 0
+	for _, f := range files {
+		if f == "-" {
+			stdin++
+		}
+	}
+	if stdin > 1 {
+		return nil, errors.New("--merge can only read - once")
+	}
+
+	var docs [][]byte
+	index := map[objectIdentity]int{}
+	for _, f := range files {
+		b, err := readInput(f, fo)
+		if err != nil {
+			return nil, err
+		}
+		for _, raw := range splitDocuments(b) {
+			if !hasContent(raw) {
+				continue
+			}
+			raw = trimDocumentSeparator(raw)
+			id, ok, err := identify(raw)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", f, err)
+			}
+			if !ok {
+				docs = append(docs, raw)
+				continue
+			}
+			if i, ok := index[id]; ok {
+				docs[i] = raw
+				continue
+			}
+			index[id] = len(docs)
+			docs = append(docs, raw)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	for i, raw := range docs {
+		if i > 0 {
+			buf.WriteString("---\n")
+		}
+		buf.Write(raw)
+		if !bytes.HasSuffix(raw, []byte("\n")) {
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// trimDocumentSeparator removes the "---" line starting raw, if any.
+func trimDocumentSeparator(raw []byte) []byte {
+	i := bytes.IndexByte(raw, '\n')
+	if i < 0 {
+		i = len(raw) - 1
+	}
+	if isDocumentSeparator(raw[:i+1]) {
+		return raw[i+1:]
+	}
+	return raw
+}
+
+// identify returns the identity of the object in raw, and whether it's a
+// single object with a kind and name.
+func identify(raw []byte) (objectIdentity, bool, error) {
+	var obj struct {
+		Kind     string `yaml:"kind"`
+		Metadata struct {
+			Name      string `yaml:"name"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"metadata"`
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(raw))
+	if err := decoder.Decode(&obj); err != nil {
+		if err == io.EOF {
+			return objectIdentity{}, false, nil
+		}
+		// Not every document is a mapping, so leave that to resolving.
+		var te *yaml.TypeError
+		if errors.As(err, &te) {
+			return objectIdentity{}, false, nil
+		}
+		return objectIdentity{}, false, err
+	}
+	// A document split by "..." markers is several, so keep it as it is.
+	var next yaml.Node
+	if err := decoder.Decode(&next); err != io.EOF {
+		return objectIdentity{}, false, nil
+	}
+	if obj.Kind == "" || obj.Kind == "List" || obj.Metadata.Name == "" {
+		return objectIdentity{}, false, nil
+	}
+	return objectIdentity{kind: obj.Kind, namespace: obj.Metadata.Namespace, name: obj.Metadata.Name}, true, nil
+}
+
+// mergedName names the input merged from files, in errors.
+func mergedName(files []string) string {
+	return strings.Join(files, " + ")
+}
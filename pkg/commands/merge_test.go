@@ -0,0 +1,160 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/commands/options"
+	kotesting "github.com/google/ko/pkg/internal/testing"
+)
+
+func TestResolveMerge(t *testing.T) {
+	base := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+      - image: ko://` + fooRef + `
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+`
+	overlay := `# The overlay's image wins.
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+      - image: ko://` + barRef + `
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+`
+	repo := mustRepository("gcr.io/multi-pass")
+	rec := &build.Recorder{Builder: testBuilder}
+	builder, err := build.NewCaching(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fo := &options.FilenameOptions{
+		Filenames: []string{yamlToTmpFile(t, []byte(base)), yamlToTmpFile(t, []byte(overlay))},
+		Merge:     true,
+	}
+	var out bytes.Buffer
+	if err := resolveFilesToWriter(context.Background(), builder, kotesting.NewFixedPublish(repo, testHashes), fo, &options.SelectorOptions{}, nopWriteCloser{&out}); err != nil {
+		t.Fatalf("resolveFilesToWriter() = %v", err)
+	}
+
+	want := fmt.Sprintf(`# The overlay's image wins.
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+      - image: %s/%s@%s
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+
+---
+`, repo, barRef, barHash)
+	if diff := cmp.Diff(want, out.String()); diff != "" {
+		t.Errorf("resolveFilesToWriter() (-want +got): %s", diff)
+	}
+	// The base's image isn't built.
+	if diff := cmp.Diff([]string{build.StrictScheme + barRef}, rec.ImportPaths); diff != "" {
+		t.Errorf("built (-want +got): %s", diff)
+	}
+}
+
+func TestMergeFiles(t *testing.T) {
+	for _, test := range []struct {
+		desc  string
+		files []string
+		want  string
+	}{{
+		desc: "namespaces tell objects apart",
+		files: []string{
+			"kind: Pod\nmetadata:\n  name: a\n  namespace: x\n",
+			"kind: Pod\nmetadata:\n  name: a\n  namespace: y\n",
+		},
+		want: "kind: Pod\nmetadata:\n  name: a\n  namespace: x\n---\nkind: Pod\nmetadata:\n  name: a\n  namespace: y\n",
+	}, {
+		desc: "kinds tell objects apart",
+		files: []string{
+			"kind: Pod\nmetadata:\n  name: a\n",
+			"kind: Service\nmetadata:\n  name: a\n",
+		},
+		want: "kind: Pod\nmetadata:\n  name: a\n---\nkind: Service\nmetadata:\n  name: a\n",
+	}, {
+		desc: "later files win, in place, even across apiVersions",
+		files: []string{
+			"apiVersion: v1beta1\nkind: Pod\nmetadata:\n  name: a\n---\nkind: Pod\nmetadata:\n  name: b\n",
+			"apiVersion: v1\nkind: Pod\nmetadata:\n  name: a\n",
+		},
+		want: "apiVersion: v1\nkind: Pod\nmetadata:\n  name: a\n---\nkind: Pod\nmetadata:\n  name: b\n",
+	}, {
+		desc: "documents without identity are all kept",
+		files: []string{
+			"image: a\n---\n- list\n",
+			"image: a\n---\n\n# just a comment\n",
+		},
+		want: "image: a\n---\n- list\n---\nimage: a\n",
+	}} {
+		t.Run(test.desc, func(t *testing.T) {
+			var files []string
+			for _, f := range test.files {
+				files = append(files, yamlToTmpFile(t, []byte(f)))
+			}
+			got, err := mergeFiles(files, &options.FilenameOptions{})
+			if err != nil {
+				t.Fatalf("mergeFiles() = %v", err)
+			}
+			if diff := cmp.Diff(test.want, string(got)); diff != "" {
+				t.Errorf("mergeFiles() (-want +got): %s", diff)
+			}
+		})
+	}
+
+	if _, err := mergeFiles([]string{"-", "-"}, &options.FilenameOptions{}); err == nil {
+		t.Error("mergeFiles(-, -) = nil, wanted error")
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package options
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// ArgoCDOptions configures generating an Argo CD Application manifest that
+// pins the resolved images.
+type ArgoCDOptions struct {
+	// Application is the name of the Application to generate.
+	// Empty string means no Application is generated.
+	Application string
+	// Namespace is the namespace Argo CD is installed in.
+	Namespace string
+	// RepoURL and Path locate the resolved manifests in source control.
+	RepoURL string
+	Path    string
+	// DestinationNamespace is the namespace to deploy the manifests to.
+	DestinationNamespace string
+}
+
+func AddArgoCDArg(cmd *cobra.Command, ao *ArgoCDOptions) {
+	cmd.Flags().StringVar(&ao.Application, "argocd-application", "",
+		"If set, append an Argo CD Application with this name that pins the resolved images to the output.")
+	cmd.Flags().StringVar(&ao.Namespace, "argocd-namespace", "argocd",
+		"Namespace of the generated Argo CD Application.")
+	cmd.Flags().StringVar(&ao.RepoURL, "argocd-repo-url", "",
+		"Repository URL containing the resolved manifests, for the generated Argo CD Application.")
+	cmd.Flags().StringVar(&ao.Path, "argocd-path", ".",
+		"Path within --argocd-repo-url containing the resolved manifests.")
+	cmd.Flags().StringVar(&ao.DestinationNamespace, "argocd-dest-namespace", "default",
+		"Namespace the generated Argo CD Application deploys to.")
+}
@@ -17,6 +17,9 @@ limitations under the License.
 package options
 
 import (
+	"strconv"
+	"time"
+
 	"github.com/google/ko/pkg/build"
 	"github.com/spf13/cobra"
 )
@@ -27,31 +30,269 @@ type BuildOptions struct {
 	// If non-empty, this takes precedence over the value in `.ko.yaml`.
 	BaseImage string
 
+	// BaseLock is the path to a file recording the content of each base
+	// image. Builds fail if a base image no longer matches it.
+	BaseLock string
+
+	// UpdateBaseLock (re)writes BaseLock with the current base images,
+	// instead of verifying them.
+	UpdateBaseLock bool
+
+	// VerifyBaseSignature is the identity (an email address or URI) whose
+	// keyless cosign signature base images must have, signed with a
+	// certificate from VerifyBaseSignatureIssuer (if set), issued by a CA
+	// in the PEM file VerifyBaseSignatureRoots, and logged in the
+	// transparency logs whose public keys are in the PEM files
+	// VerifyBaseSignatureRekorKeys and VerifyBaseSignatureCTLogKeys.
+	// Empty means base images aren't verified.
+	VerifyBaseSignature          string
+	VerifyBaseSignatureIssuer    string
+	VerifyBaseSignatureRoots     string
+	VerifyBaseSignatureRekorKeys string
+	VerifyBaseSignatureCTLogKeys string
+
 	// WorkingDirectory allows for setting the working directory for invocations of the `go` tool.
 	// Empty string means the current working directory.
 	WorkingDirectory string
 
+	// ConcurrentBasePulls is the maximum number of base images fetched
+	// from registries at once. Zero means no limit.
+	ConcurrentBasePulls int
+
 	ConcurrentBuilds     int
 	DisableOptimizations bool
 	Platform             string
 	Labels               []string
+
+	// ImageEnv is set in the config of built images (KEY=VALUE), winning
+	// over the base image's env and ko's PATH and KO_DATA_PATH.
+	ImageEnv []string
+
+	// Ldflags are passed to `go build -ldflags` for every importpath, after
+	// any ldflags configured in `.ko.yaml`. Go templates referencing
+	// environment variables (e.g. {{.Env.GIT_SHA}}) are expanded.
+	Ldflags []string
+
+	// Gcflags and Asmflags are passed to `go build` as separate -gcflags
+	// and -asmflags for every importpath, after any configured in
+	// `.ko.yaml`, e.g. "all=-N -l". Gcflags take precedence over
+	// DisableOptimizations.
+	Gcflags  []string
+	Asmflags []string
+
+	// GoFlags are passed to `go build` for every importpath, after any
+	// flags configured in `.ko.yaml`, e.g. "-mod=vendor".
+	GoFlags []string
+
+	// BuildTags are passed to `go build -tags` for every importpath, in
+	// addition to any configured in `.ko.yaml`.
+	BuildTags []string
+
+	// Env is set in the environment of every `go build` invocation, after
+	// any env configured at the top level of `.ko.yaml`, e.g.
+	// "GOFLAGS=-mod=vendor". Later values override earlier ones.
+	Env []string
+
+	// Modules configures where every `go build` downloads modules from,
+	// and how it authenticates them, instead of the inherited GOPROXY,
+	// GONOPROXY, GOPRIVATE, GOSUMDB and GONOSUMDB, if any of it is set.
+	Modules build.ModuleConfig
+
+	// SBOM is the format of the SBOM to generate for each image and
+	// attach to it when it's pushed: "spdx" or "cyclonedx". Empty
+	// generates none.
+	SBOM string
+
+	// SBOMs records the SBOMs generated for SBOM by the image's digest.
+	// Share it with PublishOptions.SBOMs to push them. If nil, one is
+	// created.
+	SBOMs *build.SBOMs
+
 	// UserAgent enables overriding the default value of the `User-Agent` HTTP
 	// request header used when retrieving the base image.
 	UserAgent string
 
 	InsecureRegistry bool
 
+	// BinaryCollision is what to do when two importpaths in a ko://multi:
+	// image would use the same binary name: "error" (default) or "suffix".
+	BinaryCollision string
+
+	// BasePlatformPolicy is what to do when the base image doesn't provide
+	// a platform being built for: "strict" (default) fails, "emulate"
+	// builds it on the base's image for another architecture, preferably
+	// amd64, with a warning.
+	BasePlatformPolicy string
+
+	// WasmPackaging is how modules built for --platform=wasip1/wasm are
+	// published: "artifact" (default), or "image" on scratch.
+	WasmPackaging string
+
+	// RestrictImports fails any reference to an importpath that matches none
+	// of allowedImportPaths in .ko.yaml, before anything is built.
+	RestrictImports bool
+
+	// AllowMutableVersions allows external importpaths like
+	// ko://example.com/cmd/foo@main, whose version can move.
+	AllowMutableVersions bool
+
+	// TrimPath builds with -trimpath, removing local file system paths from
+	// binaries. Nil means true; set it to false to keep the real paths for
+	// debugging.
+	TrimPath *bool
+
+	// BuildVCS is passed to `go build -buildvcs`: "true", "false" or
+	// "auto". Empty string leaves it to the go tool.
+	BuildVCS string
+
+	// Cgo builds with CGO_ENABLED=1, and defaults to a base image with glibc.
+	Cgo bool
+
+	// MinFreeSpace is the minimum amount of free disk space (e.g. "2GB")
+	// required in the temporary directory before each build and before
+	// tarring each layer.
+	// Empty string disables the check.
+	MinFreeSpace string
+
+	// Progress is how the steps of building each platform of an index are
+	// reported on stderr: "plain" (default), a line for each, or "none".
+	Progress string
+
+	// NoCacheBuild builds images without reading or writing the on-disk
+	// build cache, which later builds with the same inputs reuse.
+	NoCacheBuild bool
+
+	// BuildTimeout fails each build that takes longer. Zero means no
+	// timeout.
+	BuildTimeout time.Duration
+
+	// NoCacheBase fetches base images from their registries without
+	// reading or writing the on-disk base image cache.
+	NoCacheBase bool
+
+	// RequirePinnedBase fails builds on base images whose tag points at
+	// another digest than when it was cached, rather than warning.
+	RequirePinnedBase bool
+
 	// BuildConfigs enables programmatic overriding of build config set in `.ko.yaml`.
 	BuildConfigs map[string]build.Config
 }
 
 func AddBuildOptions(cmd *cobra.Command, bo *BuildOptions) {
 	cmd.Flags().IntVarP(&bo.ConcurrentBuilds, "jobs", "j", 0,
-		"The maximum number of concurrent builds (default GOMAXPROCS)")
+		"The maximum number of concurrent builds (default KO_CONCURRENT_BUILDS, or GOMAXPROCS if unset)")
+	cmd.Flags().IntVar(&bo.ConcurrentBasePulls, "base-pull-jobs", bo.ConcurrentBasePulls,
+		"The maximum number of base images to fetch from registries at once. 0 means no limit.")
+	cmd.Flags().BoolVar(&bo.NoCacheBase, "no-cache-base", bo.NoCacheBase,
+		"Fetch base images from their registries without reading or writing the base image cache, the base directory of KOCACHE (default $XDG_CACHE_HOME/ko, e.g. ~/.cache/ko).")
+	cmd.Flags().BoolVar(&bo.RequirePinnedBase, "require-pinned-base", bo.RequirePinnedBase,
+		"Fail, rather than warn, when a base image's tag points at another digest than when it was cached, until `ko update-base` accepts it.")
 	cmd.Flags().BoolVar(&bo.DisableOptimizations, "disable-optimizations", bo.DisableOptimizations,
 		"Disable optimizations when building Go code. Useful when you want to interactively debug the created container.")
 	cmd.Flags().StringVar(&bo.Platform, "platform", "",
-		"Which platform to use when pulling a multi-platform base. Format: all | <os>[/<arch>[/<variant>]][,platform]*")
+		"Which platform to use when pulling a multi-platform base. Format: all | <os>[/<arch>[/<variant>]][,platform]*. "+
+			"Multiple platforms produce an image index, and fail if the base doesn't provide all of them. "+
+			"Defaults to $KO_DEFAULTPLATFORMS, if set.")
 	cmd.Flags().StringSliceVar(&bo.Labels, "image-label", []string{},
-		"Which labels (key=value) to add to the image.")
+		"Which labels (key=value) to add to the image. Values may use {{.GitCommit}}, {{.ImportPath}} and {{.Env.NAME}}, e.g. org.opencontainers.image.revision={{.GitCommit}}.")
+	cmd.Flags().StringArrayVar(&bo.ImageEnv, "image-env", bo.ImageEnv,
+		"Set an environment variable (KEY=VALUE) in the image config, overriding the base image's env and ko's PATH and KO_DATA_PATH. May be repeated, but not for the same KEY.")
+	cmd.Flags().StringArrayVar(&bo.Ldflags, "ldflags", []string{},
+		"Flags to pass to the Go linker for every build, e.g. '-X main.version={{.Env.VERSION}}'. May be repeated.")
+	cmd.Flags().StringArrayVar(&bo.Gcflags, "gcflags", bo.Gcflags,
+		"Flags to pass to the Go compiler for every build, as [pattern=]args, e.g. 'all=-N -l'. May be repeated. Takes precedence over --disable-optimizations.")
+	cmd.Flags().StringArrayVar(&bo.Asmflags, "asmflags", bo.Asmflags,
+		"Flags to pass to the Go assembler for every build, as [pattern=]args. May be repeated.")
+	cmd.Flags().StringArrayVar(&bo.GoFlags, "go-flags", bo.GoFlags,
+		"A flag to pass to go build, e.g. --go-flags=-mod=vendor. May be repeated. -o and -C are not allowed, use --go-tags for -tags.")
+	cmd.Flags().StringSliceVar(&bo.BuildTags, "go-tags", bo.BuildTags,
+		"Build tags to pass to go build, e.g. netgo,osusergo. May be repeated.")
+	cmd.Flags().StringArrayVar(&bo.Env, "set-env", bo.Env,
+		"Set an environment variable (KEY=VALUE) for every go build, overriding the inherited environment and top-level env in .ko.yaml. May be repeated.")
+	cmd.Flags().StringVar(&bo.Modules.Proxy, "go-proxy", bo.Modules.Proxy,
+		"The GOPROXY for every go build, e.g. https://proxy.example.com,direct. Setting any of --go-proxy, --go-noproxy, --go-private, --go-sumdb and --go-nosumdb "+
+			"sets all of them, so none is inherited from the environment.")
+	cmd.Flags().StringVar(&bo.Modules.NoProxy, "go-noproxy", bo.Modules.NoProxy,
+		"The GONOPROXY for every go build: module path patterns to fetch directly, not through --go-proxy.")
+	cmd.Flags().StringVar(&bo.Modules.Private, "go-private", bo.Modules.Private,
+		"The GOPRIVATE for every go build: module path patterns, e.g. example.com/private/*, to fetch directly and not check against --go-sumdb.")
+	cmd.Flags().StringVar(&bo.Modules.SumDB, "go-sumdb", bo.Modules.SumDB,
+		"The GOSUMDB for every go build, e.g. sum.golang.org, or off.")
+	cmd.Flags().StringVar(&bo.Modules.NoSumDB, "go-nosumdb", bo.Modules.NoSumDB,
+		"The GONOSUMDB for every go build: module path patterns not to check against --go-sumdb.")
+	cmd.Flags().StringVar(&bo.SBOM, "sbom", bo.SBOM,
+		"Generate an SBOM of the Go modules in each image, in this format: spdx or cyclonedx, and push it to the sha256-<digest>.sbom tag "+
+			"next to the image, like `cosign attach sbom`. Default none.")
+	cmd.Flags().StringVar(&bo.BaseLock, "base-lock", bo.BaseLock,
+		"Path to a file recording the digests of each base image, e.g. base.lock.json. Builds fail if a base image has changed since it was written.")
+	cmd.Flags().BoolVar(&bo.UpdateBaseLock, "update-base-lock", bo.UpdateBaseLock,
+		"Write the current base images to --base-lock, instead of verifying them.")
+	cmd.Flags().StringVar(&bo.VerifyBaseSignature, "verify-base-signature", bo.VerifyBaseSignature,
+		"Fail unless each base image has a keyless cosign signature by this identity (an email address or URI), "+
+			"with a certificate issued by a CA in --verify-base-signature-roots, logged in the logs of --verify-base-signature-rekor-keys "+
+			"and --verify-base-signature-ctlog-keys.")
+	cmd.Flags().StringVar(&bo.VerifyBaseSignatureIssuer, "verify-base-signature-issuer", bo.VerifyBaseSignatureIssuer,
+		"The OIDC issuer that must have vouched for the --verify-base-signature identity, e.g. https://accounts.google.com. Default any.")
+	cmd.Flags().StringVar(&bo.VerifyBaseSignatureRoots, "verify-base-signature-roots", bo.VerifyBaseSignatureRoots,
+		"Path to a PEM file of the CAs (e.g. Fulcio's root) that must have issued the certificates of base image signatures.")
+	cmd.Flags().StringVar(&bo.VerifyBaseSignatureRekorKeys, "verify-base-signature-rekor-keys", bo.VerifyBaseSignatureRekorKeys,
+		"Path to a PEM file of the public keys of the transparency logs (e.g. Rekor's) one of which must have logged each base image signature "+
+			"while its certificate was valid.")
+	cmd.Flags().StringVar(&bo.VerifyBaseSignatureCTLogKeys, "verify-base-signature-ctlog-keys", bo.VerifyBaseSignatureCTLogKeys,
+		"Path to a PEM file of the public keys of the certificate transparency logs one of which must have logged "+
+			"the certificate of each base image signature.")
+	cmd.Flags().StringVar(&bo.BinaryCollision, "binary-collision", bo.BinaryCollision,
+		"What to do when two importpaths in a ko://multi: image have the same binary name: error, or suffix (append a hash of the importpath to each). Default error.")
+	cmd.Flags().StringVar(&bo.BasePlatformPolicy, "base-platform-policy", bo.BasePlatformPolicy,
+		"What to do when the base image doesn't provide a platform being built for: strict (fail), "+
+			"or emulate (build it on the base's image for another architecture of the same OS, preferably amd64, with a warning). Default strict.")
+	cmd.Flags().StringVar(&bo.WasmPackaging, "wasm-packaging", bo.WasmPackaging,
+		"How to publish modules built for --platform=wasip1/wasm: artifact, an OCI artifact with the wasm media types (e.g. for wasmCloud and Spin), "+
+			"or image, an image on scratch running the module (e.g. for containerd's runwasi). Default artifact.")
+	cmd.Flags().BoolVar(&bo.RestrictImports, "restrict-imports", bo.RestrictImports,
+		"Fail if any reference is to an importpath that matches none of allowedImportPaths in .ko.yaml (e.g. github.com/org/team/...), before building anything.")
+	cmd.Flags().BoolVar(&bo.AllowMutableVersions, "allow-mutable-versions", bo.AllowMutableVersions,
+		"Allow external importpaths (e.g. ko://example.com/cmd/foo@v1.2.3) at versions that can move, like branch names or latest.")
+	cmd.Flags().Var(trimPathValue{&bo.TrimPath}, "trimpath",
+		"Build with -trimpath, removing local file system paths from binaries. Use --trimpath=false to keep them for debugging.")
+	cmd.Flags().Lookup("trimpath").NoOptDefVal = "true"
+	cmd.Flags().StringVar(&bo.BuildVCS, "buildvcs", bo.BuildVCS,
+		"Whether to stamp binaries with version control information (go build -buildvcs): true, false or auto. Use false in shallow clones where stamping fails.")
+	cmd.Flags().BoolVar(&bo.Cgo, "cgo", bo.Cgo,
+		"Build with CGO_ENABLED=1, and default to a base image with glibc. Set CC and CXX to build for other platforms.")
+	cmd.Flags().StringVar(&bo.MinFreeSpace, "min-free-space", "",
+		"Minimum free disk space (e.g. 2GB) required in the temporary directory before building and before tarring each layer. Empty disables the check.")
+	cmd.Flags().StringVar(&bo.Progress, "progress", bo.Progress,
+		"How to report building each platform of a multi-platform image on stderr: plain, a line as each starts, is compiled and is built, and a table of the images once the index is built, or none. Default plain.")
+	cmd.Flags().BoolVar(&bo.NoCacheBuild, "no-cache-build", bo.NoCacheBuild,
+		"Build images without reading or writing the build cache, the builds directory of KOCACHE (default $XDG_CACHE_HOME/ko, e.g. ~/.cache/ko), "+
+			"from which later builds reuse images while their Go source, kodata, base image and build flags are unchanged.")
+	cmd.Flags().DurationVar(&bo.BuildTimeout, "build-timeout", bo.BuildTimeout,
+		"Fail any build of an importpath that takes longer than this, e.g. 10m, so a hung go build can't stall the rest. 0 means no timeout.")
+}
+
+// trimPathValue is a pflag.Value for TrimPath that leaves it nil unless the
+// flag is set.
+type trimPathValue struct {
+	p **bool
+}
+
+func (v trimPathValue) String() string {
+	if v.p == nil || *v.p == nil {
+		return "true"
+	}
+	return strconv.FormatBool(**v.p)
+}
+
+func (v trimPathValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*v.p = &b
+	return nil
+}
+
+func (v trimPathValue) Type() string {
+	return "bool"
 }
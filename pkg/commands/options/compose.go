@@ -0,0 +1,33 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package options
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// ComposeOptions configures generating a docker-compose file whose services
+// run the resolved images, for running them outside of Kubernetes.
+type ComposeOptions struct {
+	// File is where to write the compose file.
+	// Empty string means no compose file is generated.
+	File string
+}
+
+func AddComposeArg(cmd *cobra.Command, co *ComposeOptions) {
+	cmd.Flags().StringVar(&co.File, "compose-file", "",
+		"If set, write a docker-compose file to this path with a service for each resolved image, named after the last elements of its import path. "+
+			"Can't be used with --output-dir, --in-place, --dry-run or --watch.")
+}
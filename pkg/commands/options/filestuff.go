@@ -15,11 +15,18 @@
 package options
 
 import (
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
+	"github.com/google/ko/pkg/resolve"
+	"github.com/google/ko/pkg/warnings"
 	"github.com/spf13/cobra"
 )
 
@@ -38,6 +45,110 @@ type FilenameOptions struct {
 	Filenames []string
 	Recursive bool
 	Watch     bool
+
+	// WatchPlatform is the platform --watch builds for, when --platform
+	// has several. Empty means the host's architecture, on linux.
+	WatchPlatform string
+
+	// WatchSettle is how long --watch waits for changes to stop before
+	// rebuilding, so that a burst of them, e.g. from a code generator,
+	// triggers a single rebuild. Zero rebuilds on each change.
+	WatchSettle time.Duration
+
+	// BuildPlatform is the platforms images are built for, from --platform
+	// or its defaults, which is recorded in the --build-output file.
+	BuildPlatform string
+
+	// MaxDepth limits how many levels of subdirectories of the directories
+	// passed with -f are walked with --recursive. Zero means no limit.
+	MaxDepth int
+	// IgnoreFile is the name of the files in those directories that list
+	// files and subdirectories to skip. Empty means DefaultIgnoreFile.
+	IgnoreFile string
+
+	// WatchDump is a file to write what --watch watches to, as JSON, on
+	// SIGUSR1. Empty means stderr. ExplainWatch is an importpath to print
+	// the watch set of and exit. Their flags are added by AddWatchDebugArg.
+	WatchDump    string
+	ExplainWatch string
+
+	// MaxDocumentBytes caps the size of any single yaml document in the
+	// input files. Zero means no limit.
+	MaxDocumentBytes int64
+
+	// MaxFiles and MaxImportPaths fail resolving before anything is built
+	// if the files passed with -f, or the importpaths they reference, are
+	// more than this many, e.g. because -f names the wrong directory. On a
+	// terminal, more than half as many are only built once confirmed. Zero
+	// means no limit. Their flags default to DefaultMaxFiles and
+	// DefaultMaxImportPaths.
+	MaxFiles       int
+	MaxImportPaths int
+
+	// Stdin is what was read from stdin for the file "-", which can only
+	// be read once, but is resolved both to count its importpaths and then
+	// for real. If nil, it's read when resolving begins.
+	Stdin []byte
+
+	// DryRun prints the importpaths that would be built, and the
+	// references they'd be published to, and leaves the documents as
+	// they are. Its flag is added by AddDryRunArg.
+	DryRun bool
+
+	// ChangedSince is a git ref; only importpaths affected by changes
+	// since it are built, and the rest resolve to their references in
+	// PreviousRefs. Their flags are added by AddChangedSinceArg.
+	ChangedSince string
+	PreviousRefs string
+
+	// BuildOutput is a file to write the import path, digest, base image
+	// digest and build time of each published image to. Its flag is added
+	// by AddBuildOutputArg.
+	BuildOutput string
+
+	// Output is a file to write the resolved documents to, instead of
+	// stdout, and Gzip compresses it. OutputDir is a directory to write the
+	// documents of each file to instead, at the same path relative to the
+	// current directory, and InPlace overwrites each file with them. Their
+	// flags are added by AddOutputArg.
+	Output    string
+	Gzip      bool
+	OutputDir string
+	InPlace   bool
+
+	// FlushPerDocument flushes the output after each document, if it can be
+	// flushed (e.g. --gzip), so that whatever reads it, e.g. kubectl apply,
+	// gets each document as soon as it's resolved. Its flag, added by
+	// AddOutputArg, defaults to true.
+	FlushPerDocument bool
+
+	// KeepCommentDocuments writes documents that only have comments to the
+	// output verbatim, instead of dropping them. Its flag is added by
+	// AddCommentDocumentsArg.
+	KeepCommentDocuments bool
+
+	// Normalize configures removing fields from resolved objects for
+	// server-side apply. Its flags are added by AddNormalizeArg.
+	Normalize NormalizeOptions
+
+	// Strict configures checks on the resolved documents. Its flag is
+	// added by AddStrictArg.
+	Strict StrictOptions
+
+	// HelmReleaseImagePaths are the dotted paths within the values of
+	// Flux HelmReleases where images are split into a repository and a tag
+	// or digest. Its flag is added by AddHelmReleaseArg.
+	HelmReleaseImagePaths []string
+
+	// Merge resolves the files as one, in which each object replaces any
+	// earlier one with the same kind, namespace and name. Its flag is added
+	// by AddMergeArg.
+	Merge bool
+
+	// ImagesChecksum annotates pod templates with a hash of their images,
+	// see resolve.AnnotateImagesChecksum. Its flag is added by
+	// AddImagesChecksumArg.
+	ImagesChecksum bool
 }
 
 func AddFileArg(cmd *cobra.Command, fo *FilenameOptions) {
@@ -46,10 +157,115 @@ func AddFileArg(cmd *cobra.Command, fo *FilenameOptions) {
 		"Filename, directory, or URL to files to use to create the resource")
 	cmd.Flags().BoolVarP(&fo.Recursive, "recursive", "R", fo.Recursive,
 		"Process the directory used in -f, --filename recursively. Useful when you want to manage related manifests organized within the same directory.")
+	cmd.Flags().IntVar(&fo.MaxDepth, "max-depth", fo.MaxDepth,
+		"How many levels of subdirectories of the directories used in -f to process with --recursive. 0 means no limit.")
+	cmd.Flags().IntVar(&fo.MaxFiles, "max-files", DefaultMaxFiles,
+		"Fail before building anything if -f names more than this many files. On a terminal, more than half as many are only resolved once confirmed. 0 means no limit.")
+	cmd.Flags().IntVar(&fo.MaxImportPaths, "max-import-paths", DefaultMaxImportPaths,
+		"Fail before building anything if the files passed with -f reference more than this many import paths. On a terminal, more than half as many are only built once confirmed. 0 means no limit.")
+	cmd.Flags().StringVar(&fo.IgnoreFile, "ignore-file", DefaultIgnoreFile,
+		"Name of the files in the directories used in -f that list files and directories to skip, one path.Match pattern per line, "+
+			"matched against names, or against paths relative to the file if they contain '/'. Patterns ending in '/' only match directories.")
 	cmd.Flags().BoolVarP(&fo.Watch, "watch", "W", fo.Watch,
 		"Continuously monitor the transitive dependencies of the passed yaml files, and redeploy whenever anything changes. (DEPRECATED)")
+	cmd.Flags().StringVar(&fo.WatchPlatform, "watch-platform", fo.WatchPlatform,
+		"With --watch, the single platform to build for, to rebuild faster. Defaults to linux and the host's architecture when --platform has several platforms.")
+	cmd.Flags().DurationVar(&fo.WatchSettle, "watch-settle", 500*time.Millisecond,
+		"With --watch, how long no watched file must have changed before rebuilding, so that a burst of changes (e.g. from a code generator) triggers a single rebuild. "+
+			"A file being rebuilt is rebuilt again once, when it's done. 0 rebuilds on each change.")
+}
+
+// AddWatchDebugArg adds the --watch-dump and --explain-watch flags to cmd.
+func AddWatchDebugArg(cmd *cobra.Command, fo *FilenameOptions) {
+	cmd.Flags().StringVar(&fo.WatchDump, "watch-dump", fo.WatchDump,
+		"File to write the import paths --watch watches, their package directories and the files referencing them to, as JSON, on SIGUSR1. Defaults to stderr.")
+	cmd.Flags().StringVar(&fo.ExplainWatch, "explain-watch", fo.ExplainWatch,
+		"Print the packages and directories --watch would watch for this import path, as JSON, and exit.")
+}
+
+// AddDryRunArg adds the --dry-run flag to cmd.
+func AddDryRunArg(cmd *cobra.Command, fo *FilenameOptions) {
+	cmd.Flags().BoolVar(&fo.DryRun, "dry-run", fo.DryRun,
+		"Print the import paths that would be built and the references they would be published to on stderr, without building or publishing anything, and print the input files unchanged.")
 }
 
+// AddChangedSinceArg adds the --changed-since and --previous-refs flags to
+// cmd.
+func AddChangedSinceArg(cmd *cobra.Command, fo *FilenameOptions) {
+	cmd.Flags().StringVar(&fo.ChangedSince, "changed-since", fo.ChangedSince,
+		"Only build and publish import paths affected by changes since this git ref (e.g. the last release tag), and resolve the rest to their references in --previous-refs.")
+	cmd.Flags().StringVar(&fo.PreviousRefs, "previous-refs", fo.PreviousRefs,
+		"A JSON file mapping import paths to the references they were previously published as, for --changed-since.")
+}
+
+// AddBuildOutputArg adds the --build-output flag to cmd.
+func AddBuildOutputArg(cmd *cobra.Command, fo *FilenameOptions) {
+	cmd.Flags().StringVar(&fo.BuildOutput, "build-output", fo.BuildOutput,
+		"Write a JSON file listing each published import path with its image reference, digest, base image digest and build time, sorted by import path. Not written with --watch.")
+}
+
+// AddOutputArg adds the --output, --gzip, --output-dir, --in-place and
+// --flush-per-document flags to cmd.
+func AddOutputArg(cmd *cobra.Command, fo *FilenameOptions) {
+	cmd.Flags().StringVar(&fo.Output, "output", fo.Output,
+		"Write the resolved documents to this file instead of stdout.")
+	cmd.Flags().BoolVar(&fo.Gzip, "gzip", fo.Gzip,
+		"Gzip the file written by --output.")
+	cmd.Flags().StringVar(&fo.OutputDir, "output-dir", fo.OutputDir,
+		"Write the resolved documents of each file to its own file in this directory, at the same path relative to the current directory, instead of to stdout.")
+	cmd.Flags().BoolVar(&fo.InPlace, "in-place", fo.InPlace,
+		"Overwrite each file with its resolved documents, keeping its permissions and comment-only documents, instead of writing them to stdout. Files that don't change aren't written.")
+	cmd.Flags().BoolVar(&fo.FlushPerDocument, "flush-per-document", true,
+		"Flush the output after each resolved document, when it's buffered (e.g. with --gzip), so that it's read as soon as it's resolved.")
+}
+
+// AddCommentDocumentsArg adds the --keep-comment-documents flag to cmd.
+func AddCommentDocumentsArg(cmd *cobra.Command, fo *FilenameOptions) {
+	cmd.Flags().BoolVar(&fo.KeepCommentDocuments, "keep-comment-documents", fo.KeepCommentDocuments,
+		"Write documents that only have comments, e.g. section headers, to the output verbatim. By default they are dropped, like empty documents.")
+}
+
+// AddMergeArg adds the --merge flag to cmd.
+func AddMergeArg(cmd *cobra.Command, fo *FilenameOptions) {
+	cmd.Flags().BoolVar(&fo.Merge, "merge", fo.Merge,
+		"Resolve the files used in -f as one, in which objects replace those with the same kind, namespace and name in earlier files, e.g. a base and an overlay. Can't be used with --watch.")
+}
+
+// AddHelmReleaseArg adds the --helm-release-image-path flag to cmd.
+func AddHelmReleaseArg(cmd *cobra.Command, fo *FilenameOptions) {
+	if fo.HelmReleaseImagePaths == nil {
+		fo.HelmReleaseImagePaths = resolve.DefaultHelmReleaseImagePaths
+	}
+	cmd.Flags().StringSliceVar(&fo.HelmReleaseImagePaths, "helm-release-image-path", fo.HelmReleaseImagePaths,
+		"Dotted paths within the spec.values of Flux HelmReleases to images with a ko:// repository and a separate tag or digest, e.g. controller.image. The repository and digest are set to the published image's.")
+}
+
+// AddImagesChecksumArg adds the --images-checksum flag to cmd.
+func AddImagesChecksumArg(cmd *cobra.Command, fo *FilenameOptions) {
+	cmd.Flags().BoolVar(&fo.ImagesChecksum, "images-checksum", fo.ImagesChecksum,
+		"Annotate pod templates with "+resolve.ImagesChecksumAnnotation+", a hash of the images of their containers, so that any image changing rolls them out.")
+}
+
+// ignoreFile returns the name of the ignore files to read.
+func (fo *FilenameOptions) ignoreFile() string {
+	if fo.IgnoreFile == "" {
+		return DefaultIgnoreFile
+	}
+	return fo.IgnoreFile
+}
+
+// DefaultIgnoreFile is the name of the files listing what to skip in the
+// directories passed with -f, see FilenameOptions.IgnoreFile.
+const DefaultIgnoreFile = ".ko-ignore"
+
+// The defaults of --max-files and --max-import-paths, see
+// FilenameOptions.MaxFiles. They're generous, so that only a misconfigured
+// -f reaches them.
+const (
+	DefaultMaxFiles       = 1000
+	DefaultMaxImportPaths = 200
+)
+
 // Based heavily on pkg/kubectl
 func EnumerateFiles(fo *FilenameOptions) chan string {
 	files := make(chan string)
@@ -62,6 +278,7 @@ func EnumerateFiles(fo *FilenameOptions) chan string {
 		var watcher *fsnotify.Watcher
 		if fo.Watch {
 			log.Print(deprecation412)
+			warnings.Record(warnings.Warning{Code: warnings.DeprecatedFlag, Message: "--watch is deprecated, see https://github.com/google/ko/issues/412"})
 			var err error
 			watcher, err = fsnotify.NewWatcher()
 			if err != nil {
@@ -69,56 +286,17 @@ func EnumerateFiles(fo *FilenameOptions) chan string {
 			}
 			defer watcher.Close()
 		}
+		w := &fileWalker{fo: fo, files: files, watcher: watcher, dirs: map[string]*walkedDir{}}
 		for _, paths := range fo.Filenames {
 			// Just pass through '-' as it is indicative of stdin.
 			if paths == "-" {
 				files <- paths
 				continue
 			}
-			// For each of the "filenames" we are passed (file or directory) start a
-			// "Walk" to enumerate all of the contained files recursively.
-			err := filepath.Walk(paths, func(path string, fi os.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
-
-				// If this is a directory, skip it if it isn't the current directory we are
-				// processing (unless we are in recursive mode).  If we decide to process
-				// the directory, and we're in watch mode, then we set up a watch on the
-				// directory.
-				if fi.IsDir() {
-					if path != paths && !fo.Recursive {
-						return filepath.SkipDir
-					}
-					if watcher != nil {
-						watcher.Add(path)
-					}
-					// We don't stream back directories, we just decide to skip them, or not.
-					return nil
-				}
-
-				// Don't check extension if the filepath was passed explicitly
-				if path != paths {
-					switch filepath.Ext(path) {
-					case ".json", ".yaml":
-						// Process these.
-					default:
-						return nil
-					}
-					// We weren't passed this explicitly, so elide the watch as we
-					// are already watching the directory.
-				} else {
-					// We were passed this directly, and so we may not be watching the
-					// directory, so watch this file explicitly.
-					if watcher != nil {
-						watcher.Add(path)
-					}
-				}
-
-				files <- path
-				return nil
-			})
-			if err != nil {
+			// For each of the "filenames" we are passed (file or directory)
+			// enumerate all of the contained files, recursively with
+			// --recursive.
+			if err := w.walk(paths); err != nil {
 				log.Fatalf("Error enumerating files: %v", err)
 			}
 		}
@@ -130,10 +308,7 @@ func EnumerateFiles(fo *FilenameOptions) chan string {
 			for {
 				select {
 				case event := <-watcher.Events:
-					switch filepath.Ext(event.Name) {
-					case ".json", ".yaml":
-						files <- event.Name
-					}
+					w.changed(event)
 				case err := <-watcher.Errors:
 					log.Fatalf("Error watching: %v", err)
 				}
@@ -142,3 +317,218 @@ func EnumerateFiles(fo *FilenameOptions) chan string {
 	}()
 	return files
 }
+
+// fileWalker enumerates the files passed with -f, and those in the
+// directories passed with it.
+type fileWalker struct {
+	fo      *FilenameOptions
+	files   chan<- string
+	watcher *fsnotify.Watcher
+
+	// dirs are the directories walked, by path, to walk those created under
+	// them in watch mode the same way.
+	dirs map[string]*walkedDir
+	// seen are the real paths of the directories walked from the current
+	// root, to skip symlink loops.
+	seen map[string]bool
+}
+
+// walkedDir is a directory that was walked, depth levels below the one
+// passed with -f, skipping what ignores match.
+type walkedDir struct {
+	depth   int
+	ignores []ignoreRules
+}
+
+// isManifest reports whether files named path in directories passed with -f
+// are resolved.
+func isManifest(path string) bool {
+	switch filepath.Ext(path) {
+	case ".json", ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+// walk sends root, if it's a file, or the manifests in it, if it's a
+// directory.
+func (w *fileWalker) walk(root string) error {
+	fi, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		// We were passed this directly, and so we may not be watching the
+		// directory, so watch this file explicitly. Its extension isn't
+		// checked either.
+		if w.watcher != nil {
+			w.watcher.Add(root)
+		}
+		w.files <- root
+		return nil
+	}
+	w.seen = map[string]bool{}
+	return w.walkDir(root, &walkedDir{})
+}
+
+// walkDir sends the manifests in dir, and with --recursive walks its
+// subdirectories, up to --max-depth levels below the directory passed with
+// -f. Symlinks are followed, except to directories already walked from the
+// same root, which may be a loop.
+func (w *fileWalker) walkDir(dir string, parent *walkedDir) error {
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	if real, err = filepath.Abs(real); err != nil {
+		return err
+	}
+	if w.seen[real] {
+		warnings.Add(warnings.Warning{
+			Code:    warnings.SkippedFile,
+			Message: fmt.Sprintf("skipping %s, which links to %s, which was already walked", dir, real),
+			File:    dir,
+		})
+		return nil
+	}
+	w.seen[real] = true
+
+	d := &walkedDir{depth: parent.depth, ignores: parent.ignores}
+	rules, err := readIgnoreFile(dir, w.fo.ignoreFile())
+	if err != nil {
+		return err
+	}
+	if rules != nil {
+		d.ignores = append(append([]ignoreRules(nil), parent.ignores...), *rules)
+	}
+	w.dirs[dir] = d
+	if w.watcher != nil {
+		w.watcher.Add(dir)
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range entries {
+		path := filepath.Join(dir, fi.Name())
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if fi, err = os.Stat(path); err != nil {
+				warnings.Add(warnings.Warning{
+					Code:    warnings.SkippedFile,
+					Message: fmt.Sprintf("skipping %s: %v", path, err),
+					File:    path,
+				})
+				continue
+			}
+		}
+		if err := w.visit(path, fi, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// visit sends path, in the walked directory d, if it's a manifest, or walks
+// it if it's a directory to walk.
+func (w *fileWalker) visit(path string, fi os.FileInfo, d *walkedDir) error {
+	if fi.Name() == w.fo.ignoreFile() || ignored(d.ignores, path, fi.IsDir()) {
+		return nil
+	}
+	if fi.IsDir() {
+		if !w.fo.Recursive || (w.fo.MaxDepth > 0 && d.depth >= w.fo.MaxDepth) {
+			return nil
+		}
+		return w.walkDir(path, &walkedDir{depth: d.depth + 1, ignores: d.ignores})
+	}
+	if isManifest(path) {
+		w.files <- path
+	}
+	return nil
+}
+
+// changed resends the manifest that event is about, if it's in a walked
+// directory, or walks the directory that it created.
+func (w *fileWalker) changed(event fsnotify.Event) {
+	d, ok := w.dirs[filepath.Dir(event.Name)]
+	if !ok {
+		// A file passed explicitly.
+		w.files <- event.Name
+		return
+	}
+	if event.Op&fsnotify.Create != 0 {
+		if fi, err := os.Stat(event.Name); err == nil && fi.IsDir() {
+			if _, walked := w.dirs[event.Name]; walked {
+				return
+			}
+			w.seen = map[string]bool{}
+			if err := w.visit(event.Name, fi, d); err != nil {
+				log.Printf("Error enumerating files in %s: %v", event.Name, err)
+			}
+			return
+		}
+	}
+	if isManifest(event.Name) && !ignored(d.ignores, event.Name, false) {
+		w.files <- event.Name
+	}
+}
+
+// ignoreRules are the patterns in an ignore file in dir.
+type ignoreRules struct {
+	dir      string
+	patterns []string
+}
+
+// readIgnoreFile reads the patterns in the ignore file named name in dir,
+// if there is one: one per line, skipping blank lines and those starting
+// with #.
+func readIgnoreFile(dir, name string) (*ignoreRules, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	rules := &ignoreRules{dir: dir}
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := path.Match(strings.TrimSuffix(line, "/"), ""); err != nil {
+			return nil, fmt.Errorf("%s: invalid pattern %q: %v", filepath.Join(dir, name), line, err)
+		}
+		rules.patterns = append(rules.patterns, line)
+	}
+	return rules, nil
+}
+
+// ignored reports whether any of the rules match p, a directory if isDir.
+// Patterns use path.Match syntax, and are matched against the name of p,
+// or against its path relative to the directory of the ignore file if they
+// contain a "/". Patterns ending in "/" only match directories.
+func ignored(rules []ignoreRules, p string, isDir bool) bool {
+	for _, r := range rules {
+		rel, err := filepath.Rel(r.dir, p)
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		for _, pattern := range r.patterns {
+			if strings.HasSuffix(pattern, "/") {
+				if !isDir {
+					continue
+				}
+				pattern = strings.TrimSuffix(pattern, "/")
+			}
+			target := path.Base(rel)
+			if strings.Contains(pattern, "/") {
+				target = rel
+			}
+			if ok, _ := path.Match(pattern, target); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package options
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEnumerateFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ko-enumerate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for f, content := range map[string]string{
+		"a.yaml":                 "",
+		"b.yml":                  "",
+		"c.json":                 "",
+		"README.md":              "",
+		".ko-ignore":             "# comment\nskip.yaml\nvendor/\nsub/deep/*.json\n",
+		"skip.yaml":              "",
+		"vendor/v.yaml":          "",
+		"sub/s.yaml":             "",
+		"sub/skip.yaml":          "",
+		"sub/deep/d.yaml":        "",
+		"sub/deep/d.json":        "",
+		"sub/deep/deeper/x.yaml": "",
+	} {
+		p := filepath.Join(dir, f)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A loop, which is skipped rather than walked forever.
+	if err := os.Symlink(dir, filepath.Join(dir, "sub", "loop")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		desc string
+		fo   FilenameOptions
+		want []string
+	}{{
+		desc: "flat",
+		fo:   FilenameOptions{},
+		want: []string{"a.yaml", "b.yml", "c.json"},
+	}, {
+		desc: "recursive",
+		fo:   FilenameOptions{Recursive: true},
+		want: []string{"a.yaml", "b.yml", "c.json", "sub/deep/d.yaml", "sub/deep/deeper/x.yaml", "sub/s.yaml"},
+	}, {
+		desc: "max depth",
+		fo:   FilenameOptions{Recursive: true, MaxDepth: 2},
+		want: []string{"a.yaml", "b.yml", "c.json", "sub/deep/d.yaml", "sub/s.yaml"},
+	}, {
+		desc: "other ignore file",
+		fo:   FilenameOptions{Recursive: true, MaxDepth: 1, IgnoreFile: ".other-ignore"},
+		want: []string{"a.yaml", "b.yml", "c.json", "skip.yaml", "sub/s.yaml", "sub/skip.yaml", "vendor/v.yaml"},
+	}} {
+		t.Run(c.desc, func(t *testing.T) {
+			fo := c.fo
+			fo.Filenames = []string{dir, "-"}
+			var got []string
+			for f := range EnumerateFiles(&fo) {
+				if f == "-" {
+					continue
+				}
+				rel, err := filepath.Rel(dir, f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, filepath.ToSlash(rel))
+			}
+			sort.Strings(got)
+			if diff := cmp.Diff(c.want, got); diff != "" {
+				t.Errorf("EnumerateFiles() (-want +got): %s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+/*
+Copyright 2021 Google LLC All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// ImagePolicyOptions configures generating a Sigstore policy-controller
+// ClusterImagePolicy that requires the resolved images to be signed.
+type ImagePolicyOptions struct {
+	// Name is the name of the ClusterImagePolicy to generate.
+	// Empty string means no policy is generated.
+	Name string
+}
+
+// AddImagePolicyArg adds the --image-policy flag to cmd.
+func AddImagePolicyArg(cmd *cobra.Command, ipo *ImagePolicyOptions) {
+	cmd.Flags().StringVar(&ipo.Name, "image-policy", "",
+		"If set, with --sign, append a Sigstore policy-controller ClusterImagePolicy with this name to the output, "+
+			"requiring images in the repositories the resolved images were pushed to be signed with KO_SIGNING_KEY.")
+}
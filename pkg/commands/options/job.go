@@ -0,0 +1,49 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package options
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// JobOptions configures generating a Kubernetes Job that runs a command once
+// in one of the resolved images, e.g. to migrate a database.
+type JobOptions struct {
+	// ImportPath is the importpath of the image the Job runs.
+	// Empty string means no Job is generated.
+	ImportPath string
+	// Name and Namespace of the Job to generate.
+	Name      string
+	Namespace string
+	// Command and Args override the image's entrypoint and its arguments.
+	// Empty means the image's own.
+	Command []string
+	Args    []string
+}
+
+// AddJobArg adds the --job flags to cmd.
+func AddJobArg(cmd *cobra.Command, jo *JobOptions) {
+	cmd.Flags().StringVar(&jo.ImportPath, "job-importpath", "",
+		"If set, append a Kubernetes Job that runs the image of this importpath once, e.g. for database migrations, to the output. "+
+			"The image is the one the resolved documents use, if they do.")
+	cmd.Flags().StringVar(&jo.Name, "job-name", "migrate",
+		"Name of the generated Job.")
+	cmd.Flags().StringVar(&jo.Namespace, "job-namespace", "",
+		"Namespace of the generated Job. Empty means the namespace it's applied to.")
+	cmd.Flags().StringArrayVar(&jo.Command, "job-command", nil,
+		"Command the generated Job runs instead of the image's entrypoint. Repeat for each element, e.g. --job-command=/ko-app/migrate --job-command=up.")
+	cmd.Flags().StringArrayVar(&jo.Args, "job-args", nil,
+		"Arguments of the generated Job's command. Repeat for each argument.")
+}
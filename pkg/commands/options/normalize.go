@@ -0,0 +1,61 @@
+/*
+Copyright 2021 Google LLC All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"strings"
+
+	"github.com/google/ko/pkg/resolve"
+	"github.com/spf13/cobra"
+)
+
+// NormalizeOptions configures removing fields from resolved objects so that
+// they apply cleanly with `kubectl apply --server-side`.
+type NormalizeOptions struct {
+	// Normalize enables normalization with the default rules.
+	Normalize bool
+
+	// Rules overrides the default rules, and implies Normalize.
+	Rules []string
+}
+
+func AddNormalizeArg(cmd *cobra.Command, no *NormalizeOptions) {
+	cmd.Flags().BoolVar(&no.Normalize, "normalize", no.Normalize,
+		"Remove fields managed by controllers or the API server from resolved objects, for use with kubectl apply --server-side. "+
+			"Defaults to --normalize-rules="+strings.Join(resolve.DefaultNormalizeRules, ","))
+	cmd.Flags().StringSliceVar(&no.Rules, "normalize-rules", no.Rules,
+		"Normalization rules to apply, implies --normalize. One or more of: "+
+			strings.Join([]string{
+				resolve.NormalizeStatus,
+				resolve.NormalizeManagedFields,
+				resolve.NormalizeNullCreationTimestamp,
+				resolve.NormalizeServerMetadata,
+				resolve.NormalizeLastAppliedConfiguration,
+				resolve.NormalizeEmptyCollections,
+			}, ", "))
+}
+
+// EnabledRules returns the normalization rules to apply, if any.
+func (no *NormalizeOptions) EnabledRules() []string {
+	if len(no.Rules) > 0 {
+		return no.Rules
+	}
+	if no.Normalize {
+		return resolve.DefaultNormalizeRules
+	}
+	return nil
+}
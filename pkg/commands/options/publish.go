@@ -23,6 +23,7 @@ import (
 	"path"
 
 	"github.com/google/go-containerregistry/pkg/v1/daemon"
+	"github.com/google/ko/pkg/build"
 	"github.com/google/ko/pkg/publish"
 	"github.com/spf13/cobra"
 )
@@ -40,55 +41,201 @@ type PublishOptions struct {
 	// request header used when pushing the built image to an image registry.
 	UserAgent string
 
+	// RegistryTokenFile is a file holding a bearer token to push with,
+	// rather than credentials from the keychain. It's read again whenever it
+	// changes, e.g. as a sidecar rotates it.
+	RegistryTokenFile string
+
 	// DockerClient enables overriding the default docker client when embedding
 	// ko as a module in other tools.
 	// If left as the zero value, ko uses github.com/docker/docker/client.FromEnv
 	DockerClient daemon.Client
 
+	// SBOMs are the SBOMs to attach to the images pushed to a registry,
+	// from the BuildOptions.SBOMs of the builder. Pushing an image with no
+	// SBOM in it fails. If nil, no SBOMs are attached.
+	SBOMs *build.SBOMs
+
 	Tags []string
 	// TagOnly resolves images into tag-only references.
 	TagOnly bool
+	// ResolveStyle is what the references to images pushed to a registry
+	// include: digest, tag or tag-and-digest. See publish.ResolveStyle.
+	// Empty means digest, or tag-and-digest with a single tag other than
+	// latest.
+	ResolveStyle string
+	// AutoTagScheme tags images with the git commit when running in CI,
+	// and with "dev" otherwise, unless Tags are set to something other
+	// than the default.
+	AutoTagScheme bool
 
 	// Push publishes images to a registry.
 	Push bool
 
+	// Sign signs images pushed to a registry, like `cosign sign`, with the
+	// private key in the PEM file SigningKey. In normal ko usage,
+	// SigningKey is populated with the value of $KO_SIGNING_KEY.
+	Sign       bool
+	SigningKey string
+
+	// RequestsPerSecond limits the rate of requests to registries when
+	// pushing, for registries that enforce such limits. Zero means no
+	// limit.
+	RequestsPerSecond float64
+
 	// Local publishes images to a local docker daemon.
 	Local            bool
 	InsecureRegistry bool
+	// LocalFallbackTarball is a file to write images to instead when the
+	// local docker daemon isn't reachable.
+	LocalFallbackTarball string
+
+	// ContainerdAddress, ContainerdNamespace and ContainerdSnapshotter
+	// configure where images are loaded when DockerRepo is
+	// publish.ContainerdDomain: the address of containerd's socket, the
+	// namespace (default publish.DefaultContainerdNamespace), and the
+	// snapshotter to unpack them for.
+	ContainerdAddress     string
+	ContainerdNamespace   string
+	ContainerdSnapshotter string
 
 	OCILayoutPath string
 	TarballFile   string
 
+	// PublisherOrder is the order to publish in when several publishers
+	// are in use, by their YAMLRef* names, e.g. to push to the registry
+	// before writing the tarball. Publishers it doesn't list follow, in
+	// the default order: layout, tarball, registry. It doesn't change
+	// whose references are used; see YAMLRefSource.
+	PublisherOrder []string
+
+	// YAMLRefSource is the publisher whose references are used, when
+	// several publish each image: one of the YAMLRef* constants. It
+	// defaults to the registry when pushing.
+	YAMLRefSource string
+
+	// TektonResultsDir is a directory (e.g. /tekton/results) to write the
+	// repository and digest of each published image to, as Tekton results.
+	TektonResultsDir string
+
+	// GitHubOutput records published images as GitHub Actions step outputs
+	// and in the step summary, and annotates errors, when running in
+	// GitHub Actions.
+	GitHubOutput bool
+
 	// PreserveImportPaths preserves the full import path after KO_DOCKER_REPO.
 	PreserveImportPaths bool
 	// BaseImportPaths uses the base path without MD5 hash after KO_DOCKER_REPO.
 	BaseImportPaths bool
 	// Bare uses a tag on the KO_DOCKER_REPO without anything additional.
 	Bare bool
+	// NameSanitization is how the parts of image names derived from
+	// importpaths are made valid: one of NameSanitizationReplace (the
+	// default), NameSanitizationLowercase or NameSanitizationNone.
+	NameSanitization string
+
+	// DockerRepoMappings enables programmatic overriding of dockerRepos set
+	// in `.ko.yaml`.
+	DockerRepoMappings []DockerRepoMapping
+}
+
+// DockerRepoMapping publishes the importpaths under Prefix (e.g.
+// example.com/mono/frontend/...) to Repo instead of DockerRepo. Unless one of
+// its naming options is set, images are named as configured for DockerRepo.
+type DockerRepoMapping struct {
+	Prefix string
+	Repo   string
+
+	PreserveImportPaths bool
+	BaseImportPaths     bool
+	Bare                bool
+}
+
+// ForMapping returns a copy of po that publishes to m.Repo, named as
+// configured by m, if it sets any naming options.
+func (po *PublishOptions) ForMapping(m DockerRepoMapping) *PublishOptions {
+	mpo := *po
+	mpo.DockerRepo = m.Repo
+	if m.PreserveImportPaths || m.BaseImportPaths || m.Bare {
+		mpo.PreserveImportPaths = m.PreserveImportPaths
+		mpo.BaseImportPaths = m.BaseImportPaths
+		mpo.Bare = m.Bare
+	}
+	return &mpo
 }
 
+// Values of PublishOptions.YAMLRefSource.
+const (
+	YAMLRefRegistry = "registry"
+	YAMLRefLayout   = "layout"
+	YAMLRefTarball  = "tarball"
+	YAMLRefDaemon   = "daemon"
+)
+
 func AddPublishArg(cmd *cobra.Command, po *PublishOptions) {
 	// Set DockerRepo from the KO_DOCKER_REPO envionment variable.
 	// See https://github.com/google/ko/pull/351 for flag discussion.
 	if dockerRepo, exists := os.LookupEnv("KO_DOCKER_REPO"); exists {
 		po.DockerRepo = dockerRepo
 	}
+	if signingKey, exists := os.LookupEnv("KO_SIGNING_KEY"); exists {
+		po.SigningKey = signingKey
+	}
 
 	cmd.Flags().StringSliceVarP(&po.Tags, "tags", "t", []string{"latest"},
 		"Which tags to use for the produced image instead of the default 'latest' tag "+
-			"(may not work properly with --base-import-paths or --bare).")
+			"(may not work properly with --base-import-paths or --bare). "+
+			"Tags may use {{.Module.Version}}, the version of the module providing the image's main package; "+
+			"tags using it are skipped for modules without a version, falling back to 'latest' if no tags remain.")
 	cmd.Flags().BoolVar(&po.TagOnly, "tag-only", false,
 		"Include tags but not digests in resolved image references. Useful when digests are not preserved when images are repopulated.")
+	cmd.Flags().StringVar(&po.ResolveStyle, "resolve-style", po.ResolveStyle,
+		"What resolved references to images pushed to a registry include: digest (repo@digest), tag (repo:tag, with the first of --tags) "+
+			"or tag-and-digest (repo:tag@digest). Defaults to digest, or tag-and-digest when a single tag other than latest is set. "+
+			"tag is the same as --tag-only, and requires a tag other than latest.")
+
+	cmd.Flags().BoolVar(&po.AutoTagScheme, "auto-tag-scheme", po.AutoTagScheme,
+		"Unless --tags is set, tag images with the git commit SHA when running in CI (detected from variables like CI or GITHUB_ACTIONS), and with 'dev' otherwise.")
 
 	cmd.Flags().BoolVar(&po.Push, "push", true, "Push images to KO_DOCKER_REPO")
+	cmd.Flags().BoolVar(&po.Sign, "sign", po.Sign,
+		"Sign images pushed to a registry with the unencrypted PEM ECDSA or RSA private key in the file KO_SIGNING_KEY, "+
+			"pushing signatures that `cosign verify --key` checks.")
+
+	cmd.Flags().Float64Var(&po.RequestsPerSecond, "requests-per-second", po.RequestsPerSecond,
+		"Limit requests to registries when pushing to this many per second, spread evenly, for registries that answer bursts of requests with 429s. "+
+			"0 means no limit.")
 
 	cmd.Flags().BoolVarP(&po.Local, "local", "L", po.Local,
 		"Load into images to local docker daemon.")
+	cmd.Flags().StringVar(&po.LocalFallbackTarball, "local-fallback-tarball", po.LocalFallbackTarball,
+		"When loading images into the local docker daemon, and it isn't reachable, write them to this tarball instead, for `docker load` later.")
+	cmd.Flags().StringVar(&po.ContainerdAddress, "containerd-address", po.ContainerdAddress,
+		"With KO_DOCKER_REPO=containerd.local, the address of containerd's socket. Default CONTAINERD_ADDRESS, or /run/containerd/containerd.sock.")
+	cmd.Flags().StringVar(&po.ContainerdNamespace, "containerd-namespace", po.ContainerdNamespace,
+		"With KO_DOCKER_REPO=containerd.local, the containerd namespace to load images into. Default k8s.io, where the kubelet runs containers from.")
+	cmd.Flags().StringVar(&po.ContainerdSnapshotter, "containerd-snapshotter", po.ContainerdSnapshotter,
+		"With KO_DOCKER_REPO=containerd.local, the snapshotter to unpack images for, e.g. overlayfs. Default containerd's.")
 	cmd.Flags().BoolVar(&po.InsecureRegistry, "insecure-registry", po.InsecureRegistry,
 		"Whether to skip TLS verification on the registry")
+	cmd.Flags().StringVar(&po.RegistryTokenFile, "registry-token-file", po.RegistryTokenFile,
+		"Push with the bearer token in this file, read again whenever it changes, rather than credentials from the docker config and credential helpers.")
 
 	cmd.Flags().StringVar(&po.OCILayoutPath, "oci-layout-path", "", "Path to save the OCI image layout of the built images")
 	cmd.Flags().StringVar(&po.TarballFile, "tarball", "", "File to save images tarballs")
+	cmd.Flags().StringSliceVar(&po.PublisherOrder, "publisher-order", po.PublisherOrder,
+		"Order to publish each image in when several publishers are in use, e.g. registry,tarball to push before writing --tarball. "+
+			"Publishers not listed follow, in the default order: layout, tarball, registry. Doesn't change which references are used, see --yaml-ref-source.")
+	cmd.Flags().StringVar(&po.YAMLRefSource, "yaml-ref-source", po.YAMLRefSource,
+		"Which publisher's references to use for images when several publish them: registry, layout, tarball or daemon. "+
+			"Defaults to registry when pushing, otherwise the last of layout and tarball in use. Fails if that publisher isn't in use.")
+	cmd.Flags().StringVar(&po.TektonResultsDir, "tekton-results-dir", "",
+		"Directory to write Tekton results to, e.g. /tekton/results. For each image, <importpath>_IMAGE_URL and <importpath>_IMAGE_DIGEST "+
+			"are written, with the characters of the importpath that aren't allowed in result names replaced by '-'.")
+	cmd.Flags().BoolVar(&po.GitHubOutput, "github-output", po.GitHubOutput,
+		"When running in GitHub Actions, set a step output with the reference of each image, named after its importpath with the characters "+
+			"that aren't allowed in output names replaced by '_', and an 'images' output with all of them as JSON, add a table of images to the step summary, "+
+			"and annotate errors. Does nothing elsewhere.")
 
 	cmd.Flags().BoolVarP(&po.PreserveImportPaths, "preserve-import-paths", "P", po.PreserveImportPaths,
 		"Whether to preserve the full import path after KO_DOCKER_REPO.")
@@ -96,6 +243,9 @@ func AddPublishArg(cmd *cobra.Command, po *PublishOptions) {
 		"Whether to use the base path without MD5 hash after KO_DOCKER_REPO (may not work properly with --tags).")
 	cmd.Flags().BoolVar(&po.Bare, "bare", po.Bare,
 		"Whether to just use KO_DOCKER_REPO without additional context (may not work properly with --tags).")
+	cmd.Flags().StringVar(&po.NameSanitization, "name-sanitization", po.NameSanitization,
+		"How to make the parts of image names derived from importpaths valid repository names: replace (lowercase them, and replace other "+
+			"characters that aren't allowed with '-'), lowercase (only lowercase them) or none. Defaults to replace. Names that change are warned about.")
 }
 
 func packageWithMD5(base, importpath string) string {
@@ -116,13 +266,32 @@ func bareDockerRepo(base, _ string) string {
 	return base
 }
 
+// importPathNamer names combined images (see build.MultiPrefix) and
+// external importpaths (see build.ExternalImportPath) with n, as if they
+// were the importpath returned by build.MultiName or build.ExternalName.
+func importPathNamer(n publish.Namer) publish.Namer {
+	return func(base, importpath string) string {
+		if ips, ok := build.MultiImportPaths(importpath); ok {
+			importpath = build.MultiName(ips)
+		}
+		if ip, version, ok := build.ExternalImportPath(importpath); ok {
+			importpath = build.ExternalName(ip, version)
+		}
+		return n(base, importpath)
+	}
+}
+
 func MakeNamer(po *PublishOptions) publish.Namer {
+	strategy := po.NameSanitization
+	if strategy == "" {
+		strategy = NameSanitizationReplace
+	}
 	if po.PreserveImportPaths {
-		return preserveImportPath
+		return sanitizingNamer(importPathNamer(preserveImportPath), strategy)
 	} else if po.BaseImportPaths {
-		return baseImportPaths
+		return sanitizingNamer(importPathNamer(baseImportPaths), strategy)
 	} else if po.Bare {
 		return bareDockerRepo
 	}
-	return packageWithMD5
+	return sanitizingNamer(importPathNamer(packageWithMD5), strategy)
 }
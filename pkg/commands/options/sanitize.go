@@ -0,0 +1,136 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package options
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/google/ko/pkg/publish"
+	"github.com/google/ko/pkg/warnings"
+)
+
+// Values of PublishOptions.NameSanitization.
+const (
+	// NameSanitizationReplace lowercases the names derived from
+	// importpaths, and replaces the characters that aren't allowed in
+	// repository names with '-'.
+	NameSanitizationReplace = "replace"
+	// NameSanitizationLowercase only lowercases them.
+	NameSanitizationLowercase = "lowercase"
+	// NameSanitizationNone leaves them as they are.
+	NameSanitizationNone = "none"
+)
+
+// CheckNameSanitization checks that s is a value of
+// PublishOptions.NameSanitization, or empty for the default.
+func CheckNameSanitization(s string) error {
+	switch s {
+	case "", NameSanitizationReplace, NameSanitizationLowercase, NameSanitizationNone:
+		return nil
+	}
+	return fmt.Errorf("invalid --name-sanitization %q: must be replace, lowercase or none", s)
+}
+
+// sanitizingNamer sanitizes the part of the names from n that is derived
+// from the importpath, per strategy. The first time it changes the name of
+// an importpath, it warns, naming any other importpath it collides with.
+func sanitizingNamer(n publish.Namer, strategy string) publish.Namer {
+	if strategy == NameSanitizationNone {
+		return n
+	}
+	var m sync.Mutex
+	// names maps the sanitized names to the importpaths they are for, and
+	// warned the importpaths that were warned about.
+	names := map[string]string{}
+	warned := map[string]bool{}
+	return func(base, importpath string) string {
+		name := n(base, importpath)
+		sanitized := name
+		if strings.HasPrefix(name, base) {
+			sanitized = base + sanitizeName(strings.TrimPrefix(name, base), strategy)
+		}
+
+		m.Lock()
+		defer m.Unlock()
+		other, collides := names[sanitized]
+		collides = collides && other != importpath
+		if !collides {
+			names[sanitized] = importpath
+		}
+		if (sanitized != name || collides) && !warned[importpath] {
+			warned[importpath] = true
+			if collides {
+				warnings.Warnf(warnings.SanitizedName, "%s is published as %s, which %s is also published as", importpath, sanitized, other)
+			} else {
+				warnings.Warnf(warnings.SanitizedName, "%s is published as %s, sanitized from %s", importpath, sanitized, name)
+			}
+		}
+		return sanitized
+	}
+}
+
+// sanitizeName sanitizes s, a path of repository name components, per
+// strategy.
+func sanitizeName(s, strategy string) string {
+	s = strings.ToLower(s)
+	if strategy == NameSanitizationLowercase {
+		return s
+	}
+	prefix := ""
+	if strings.HasPrefix(s, "/") {
+		prefix, s = "/", s[1:]
+	}
+	var components []string
+	for _, c := range strings.Split(s, "/") {
+		if c = sanitizeComponent(c); c != "" {
+			components = append(components, c)
+		}
+	}
+	return prefix + strings.Join(components, "/")
+}
+
+// sanitizeComponent makes c a valid repository name component: runs of
+// lowercase letters and digits, separated by ".", "_", "__" or dashes.
+// Other characters, and other separators, are replaced by "-", and those at
+// either end are dropped.
+func sanitizeComponent(c string) string {
+	var b, sep strings.Builder
+	for _, r := range c {
+		switch {
+		case 'a' <= r && r <= 'z', '0' <= r && r <= '9':
+			if sep.Len() > 0 && b.Len() > 0 {
+				b.WriteString(validSeparator(sep.String()))
+			}
+			sep.Reset()
+			b.WriteRune(r)
+		case r == '.', r == '_', r == '-':
+			sep.WriteRune(r)
+		default:
+			sep.WriteRune('-')
+		}
+	}
+	return b.String()
+}
+
+// validSeparator returns sep if it separates repository name components'
+// runs of letters and digits, or else "-".
+func validSeparator(sep string) string {
+	if sep == "." || sep == "_" || sep == "__" || strings.Trim(sep, "-") == "" {
+		return sep
+	}
+	return "-"
+}
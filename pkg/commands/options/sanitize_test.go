@@ -0,0 +1,107 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package options
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/ko/pkg/warnings"
+)
+
+func TestMakeNamerSanitizes(t *testing.T) {
+	const base = "gcr.io/project/repo"
+	for _, test := range []struct {
+		desc       string
+		po         PublishOptions
+		importpath string
+		want       string
+	}{{
+		desc:       "replace",
+		po:         PublishOptions{PreserveImportPaths: true},
+		importpath: "github.com/My-Org/my~repo/cmd/Server..v2_",
+		want:       base + "/github.com/my-org/my-repo/cmd/server-v2",
+	}, {
+		desc:       "replace base",
+		po:         PublishOptions{BaseImportPaths: true, NameSanitization: NameSanitizationReplace},
+		importpath: "github.com/org/repo/cmd/__App__",
+		want:       base + "/app",
+	}, {
+		desc:       "lowercase",
+		po:         PublishOptions{PreserveImportPaths: true, NameSanitization: NameSanitizationLowercase},
+		importpath: "github.com/My-Org/repo/cmd/Server",
+		want:       base + "/github.com/my-org/repo/cmd/server",
+	}, {
+		desc:       "none",
+		po:         PublishOptions{PreserveImportPaths: true, NameSanitization: NameSanitizationNone},
+		importpath: "github.com/My-Org/repo/cmd/Server",
+		want:       base + "/github.com/My-Org/repo/cmd/Server",
+	}} {
+		t.Run(test.desc, func(t *testing.T) {
+			c := &warnings.Collector{}
+			defer warnings.SetDefault(warnings.SetDefault(c))
+
+			namer := MakeNamer(&test.po)
+			got := namer(base, test.importpath)
+			if got != test.want {
+				t.Errorf("namer(%q) = %q, wanted %q", test.importpath, got, test.want)
+			}
+			// The name is only warned about once.
+			namer(base, test.importpath)
+			ws := c.Warnings()
+			if test.po.NameSanitization == NameSanitizationNone {
+				if len(ws) != 0 {
+					t.Errorf("warnings = %v, wanted none", ws)
+				}
+				return
+			}
+			if _, err := name.NewRepository(got); err != nil {
+				t.Errorf("name.NewRepository(%q) = %v", got, err)
+			}
+			if len(ws) != 1 || ws[0].Code != warnings.SanitizedName {
+				t.Errorf("warnings = %v, wanted one %s warning", ws, warnings.SanitizedName)
+			}
+		})
+	}
+}
+
+func TestMakeNamerWarnsCollisions(t *testing.T) {
+	c := &warnings.Collector{}
+	defer warnings.SetDefault(warnings.SetDefault(c))
+
+	namer := MakeNamer(&PublishOptions{BaseImportPaths: true})
+	if got, want := namer("gcr.io/repo", "github.com/org/a/cmd/app"), "gcr.io/repo/app"; got != want {
+		t.Errorf("namer() = %q, wanted %q", got, want)
+	}
+	if got, want := namer("gcr.io/repo", "github.com/org/b/cmd/App!"), "gcr.io/repo/app"; got != want {
+		t.Errorf("namer() = %q, wanted %q", got, want)
+	}
+	ws := c.Warnings()
+	if len(ws) != 1 || !strings.Contains(ws[0].Message, "github.com/org/a/cmd/app") {
+		t.Errorf("warnings = %v, wanted one naming the colliding importpath", ws)
+	}
+}
+
+func TestCheckNameSanitization(t *testing.T) {
+	for _, s := range []string{"", "replace", "lowercase", "none"} {
+		if err := CheckNameSanitization(s); err != nil {
+			t.Errorf("CheckNameSanitization(%q) = %v", s, err)
+		}
+	}
+	if err := CheckNameSanitization("upper"); err == nil {
+		t.Error("CheckNameSanitization(upper) succeeded, wanted error")
+	}
+}
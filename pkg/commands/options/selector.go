@@ -20,10 +20,24 @@ import (
 
 // SelectorOptions allows selecting objects from the input manifests by label
 type SelectorOptions struct {
-	Selector string
+	// Selectors are label queries, that objects are selected if they match
+	// any of, or all of with SelectorMatch "all".
+	Selectors []string
+
+	// AnnotationSelectors are like Selectors, but match objects'
+	// annotations. Objects must match both.
+	AnnotationSelectors []string
+
+	// SelectorMatch is how Selectors, and AnnotationSelectors, combine:
+	// "any" (default) or "all".
+	SelectorMatch string
 }
 
 func AddSelectorArg(cmd *cobra.Command, so *SelectorOptions) {
-	cmd.Flags().StringVarP(&so.Selector, "selector", "l", "",
-		"Selector (label query) to filter on, supports '=', '==', and '!='.(e.g. -l key1=value1,key2=value2)")
+	cmd.Flags().StringArrayVarP(&so.Selectors, "selector", "l", nil,
+		"Selector (label query) to filter on, supports '=', '==', and '!='.(e.g. -l key1=value1,key2=value2). May be repeated, to select objects matching any of the selectors (see --selector-match).")
+	cmd.Flags().StringArrayVar(&so.AnnotationSelectors, "annotation-selector", nil,
+		"Like --selector, but matching annotations rather than labels. Objects must match both. May be repeated.")
+	cmd.Flags().StringVar(&so.SelectorMatch, "selector-match", "any",
+		"How repeated --selector (or --annotation-selector) flags combine: any, to select objects matching any of them, or all.")
 }
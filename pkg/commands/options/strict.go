@@ -0,0 +1,35 @@
+/*
+Copyright 2021 Google LLC All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// StrictOptions configures checks on the resolved documents.
+type StrictOptions struct {
+	// AssertFullyResolved fails if any ko:// reference is left in the
+	// resolved documents, e.g. one embedded in a longer string, which is
+	// never resolved.
+	AssertFullyResolved bool
+}
+
+// AddStrictArg adds the --assert-fully-resolved flag to cmd.
+func AddStrictArg(cmd *cobra.Command, so *StrictOptions) {
+	cmd.Flags().BoolVar(&so.AssertFullyResolved, "assert-fully-resolved", so.AssertFullyResolved,
+		"Fail, listing the files and fields, if any ko:// reference is left in the resolved documents, e.g. within a longer string.")
+}
@@ -0,0 +1,42 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package options
+
+import (
+	"strings"
+
+	"github.com/google/ko/pkg/warnings"
+	"github.com/spf13/cobra"
+)
+
+// WarningOptions configures when the warnings of a run fail it.
+type WarningOptions struct {
+	// MaxWarnings fails runs with more warnings. Negative means no limit.
+	MaxWarnings int
+
+	// WarningsAsErrors fails runs with any warning of these codes, or of
+	// any code with warnings.All.
+	WarningsAsErrors []string
+}
+
+// AddWarningsArg adds the --max-warnings and --warnings-as-errors flags to
+// cmd.
+func AddWarningsArg(cmd *cobra.Command, wo *WarningOptions) {
+	cmd.Flags().IntVar(&wo.MaxWarnings, "max-warnings", -1,
+		"Fail if there are more than this many warnings. Negative means no limit.")
+	cmd.Flags().StringSliceVar(&wo.WarningsAsErrors, "warnings-as-errors", wo.WarningsAsErrors,
+		"Fail if there are any warnings with these codes, or any warnings at all without a value. Codes: "+strings.Join(warnings.Codes, ", ")+".")
+	cmd.Flags().Lookup("warnings-as-errors").NoOptDefVal = warnings.All
+}
@@ -0,0 +1,344 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/commands/options"
+)
+
+// openOutput returns where to write resolved documents: stdout, or the
+// --output file, gzipped with --gzip. Closing it flushes and closes the file.
+// Without --watch, the file is written to a temporary file that replaces
+// --output on Close, so that it's never seen partially written; use
+// discardOutput to give up on it instead.
+func openOutput(fo *options.FilenameOptions) (io.WriteCloser, error) {
+	if fo.Output == "" {
+		if fo.Gzip {
+			return nil, fmt.Errorf("--gzip requires --output")
+		}
+		return os.Stdout, nil
+	}
+	if fo.Gzip && fo.Watch {
+		// Nothing would be readable until ko exits.
+		return nil, fmt.Errorf("--gzip can't be used with --watch")
+	}
+	var f io.WriteCloser
+	if fo.Watch {
+		// Documents are written as they're resolved, for tools tailing
+		// the file.
+		file, err := os.Create(fo.Output)
+		if err != nil {
+			return nil, fmt.Errorf("creating --output: %v", err)
+		}
+		f = file
+	} else {
+		if _, err := os.Stat(filepath.Dir(fo.Output)); err != nil {
+			return nil, fmt.Errorf("creating --output: %v", err)
+		}
+		f = createAtomically(fo.Output)
+	}
+	if !fo.Gzip {
+		return f, nil
+	}
+	return &gzipFile{Writer: gzip.NewWriter(f), f: f}, nil
+}
+
+// checkFileOutputs returns an error if fo can't be resolved with
+// --output-dir or --in-place, which write the documents of each file
+// separately.
+func checkFileOutputs(fo *options.FilenameOptions) error {
+	flag := "--output-dir"
+	if fo.InPlace {
+		if fo.OutputDir != "" {
+			return errors.New("--in-place can't be used with --output-dir")
+		}
+		if fo.DryRun || fo.Watch {
+			return errors.New("--in-place can't be used with --dry-run or --watch")
+		}
+		flag = "--in-place"
+	}
+	if fo.Output != "" || fo.Gzip {
+		return fmt.Errorf("%s can't be used with --output or --gzip", flag)
+	}
+	if fo.Merge {
+		return fmt.Errorf("%s can't be used with --merge, which resolves the files as one", flag)
+	}
+	for _, f := range fo.Filenames {
+		if f == "-" {
+			return fmt.Errorf("%s can't be used with -f -, which has no path to write to", flag)
+		}
+	}
+	return nil
+}
+
+// mirroredOutputs returns an outputFactory for --output-dir, which writes the
+// output of each input file to the same path under dir, relative to the
+// current directory, atomically.
+func mirroredOutputs(dir string) outputFactory {
+	return func(f string) (io.WriteCloser, error) {
+		rel := filepath.Clean(f)
+		if filepath.IsAbs(rel) {
+			wd, err := os.Getwd()
+			if err != nil {
+				return nil, err
+			}
+			if rel, err = filepath.Rel(wd, rel); err != nil {
+				return nil, err
+			}
+		}
+		if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("%s is outside the current directory, so it has no path in --output-dir", f)
+		}
+		path := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		return createAtomically(path), nil
+	}
+}
+
+// inPlaceOutputs is an outputFactory for --in-place, which overwrites each
+// input file with its output, atomically and with the same permissions,
+// unless it's unchanged.
+func inPlaceOutputs(f string) (io.WriteCloser, error) {
+	return &inPlaceFile{path: f}, nil
+}
+
+// inPlaceFile replaces path with what is written to it on Close, if that
+// differs from what path holds.
+type inPlaceFile struct {
+	bytes.Buffer
+	path string
+}
+
+// Close implements io.Closer
+func (f *inPlaceFile) Close() error {
+	old, err := ioutil.ReadFile(f.path)
+	if err == nil && bytes.Equal(old, f.Bytes()) {
+		return nil
+	}
+	if err := build.WriteFileAtomically(f.path, func(w io.Writer) error {
+		_, err := w.Write(f.Bytes())
+		return err
+	}); err != nil {
+		return err
+	}
+	log.Printf("Updated %s", f.path)
+	return nil
+}
+
+// discardOutput closes out, an output from openOutput, without replacing
+// the --output file if it hasn't been closed yet, e.g. when resolving fails.
+func discardOutput(out io.WriteCloser) {
+	switch o := out.(type) {
+	case *atomicFile:
+		o.finish(errDiscarded)
+	case *gzipFile:
+		discardOutput(o.f)
+	default:
+		out.Close()
+	}
+}
+
+// gzipFile gzips what is written to it into f.
+type gzipFile struct {
+	*gzip.Writer
+	f io.WriteCloser
+}
+
+// Close implements io.Closer
+func (g *gzipFile) Close() error {
+	if err := g.Writer.Close(); err != nil {
+		discardOutput(g.f)
+		return err
+	}
+	return g.f.Close()
+}
+
+var errDiscarded = errors.New("output discarded")
+
+// atomicFile streams what is written to it to a temporary file, which
+// replaces path on Close.
+type atomicFile struct {
+	pw   *io.PipeWriter
+	done chan error
+
+	once sync.Once
+	err  error
+}
+
+func createAtomically(path string) *atomicFile {
+	pr, pw := io.Pipe()
+	f := &atomicFile{pw: pw, done: make(chan error, 1)}
+	go func() {
+		err := build.WriteFileAtomically(path, func(w io.Writer) error {
+			_, err := io.Copy(w, pr)
+			return err
+		})
+		// Fail the writes that are left, e.g. if the temporary file can't
+		// be created.
+		pr.CloseWithError(err)
+		f.done <- err
+	}()
+	return f
+}
+
+// Write implements io.Writer
+func (f *atomicFile) Write(p []byte) (int, error) {
+	return f.pw.Write(p)
+}
+
+// Close implements io.Closer
+func (f *atomicFile) Close() error {
+	return f.finish(nil)
+}
+
+// finish ends the file: it replaces path if err is nil, and is removed
+// otherwise. Only the first call has an effect.
+func (f *atomicFile) finish(err error) error {
+	f.once.Do(func() {
+		f.pw.CloseWithError(err)
+		f.err = <-f.done
+	})
+	return f.err
+}
+
+// outputQueue owns w: what is written to it is queued, and written to w in
+// order by a single goroutine, so that each write reaches w whole, whichever
+// goroutine it comes from, and slow readers of w don't hold up resolving.
+// With flush, w is flushed after each document, if it can be.
+type outputQueue struct {
+	w     io.Writer
+	flush bool
+	queue chan []byte
+	done  chan struct{}
+
+	// m guards closed, and sending to queue, so that nothing is sent once
+	// it's closed.
+	m      sync.Mutex
+	closed bool
+
+	errMu sync.Mutex
+	err   error
+}
+
+func newOutputQueue(w io.Writer, flush bool) *outputQueue {
+	q := &outputQueue{
+		w:     w,
+		flush: flush,
+		queue: make(chan []byte, 64),
+		done:  make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+func (q *outputQueue) run() {
+	defer close(q.done)
+	for b := range q.queue {
+		// After a failed write, drop the rest rather than write a gap.
+		if q.writeErr() != nil {
+			continue
+		}
+		var err error
+		if q.flush {
+			err = writeDocuments(q.w, b)
+		} else {
+			_, err = q.w.Write(b)
+		}
+		if err != nil {
+			q.errMu.Lock()
+			q.err = err
+			q.errMu.Unlock()
+		}
+	}
+}
+
+// writeDocuments writes b, the documents of a file, to w, and flushes it
+// after each "---" line, so that whatever reads w gets each of them whole as
+// soon as it's written.
+func writeDocuments(w io.Writer, b []byte) error {
+	for _, doc := range bytes.SplitAfter(b, []byte("\n---\n")) {
+		if len(doc) == 0 {
+			continue
+		}
+		if _, err := w.Write(doc); err != nil {
+			return err
+		}
+		if err := flushOutput(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushOutput flushes w, if it's buffered, like a bufio.Writer or
+// gzip.Writer, or streamed, like an http.ResponseWriter.
+func flushOutput(w io.Writer) error {
+	switch f := w.(type) {
+	case interface{ Flush() error }:
+		return f.Flush()
+	case interface{ Flush() }:
+		f.Flush()
+	}
+	return nil
+}
+
+func (q *outputQueue) writeErr() error {
+	q.errMu.Lock()
+	defer q.errMu.Unlock()
+	return q.err
+}
+
+// Write queues a copy of p to be written, and returns the error of an
+// earlier write, if any.
+func (q *outputQueue) Write(p []byte) (int, error) {
+	if err := q.writeErr(); err != nil {
+		return 0, err
+	}
+	q.m.Lock()
+	defer q.m.Unlock()
+	if q.closed {
+		return 0, errors.New("write to closed output")
+	}
+	q.queue <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+// Close waits for the queued writes, and returns the error of the first
+// that failed, if any. It doesn't close w.
+func (q *outputQueue) Close() error {
+	q.m.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.queue)
+	}
+	q.m.Unlock()
+	<-q.done
+	return q.writeErr()
+}
@@ -0,0 +1,594 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/commands/options"
+	kotesting "github.com/google/ko/pkg/internal/testing"
+)
+
+func TestGzipOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ko-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	builder, err := build.NewCaching(testBuilder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := mustRepository("gcr.io/multi-pass")
+	inputYAML := "image: " + build.StrictScheme + fooRef + "\n---\n" +
+		"image: " + build.StrictScheme + barRef + "\n"
+	fo := &options.FilenameOptions{
+		Filenames: []string{yamlToTmpFile(t, []byte(inputYAML))},
+		Output:    filepath.Join(dir, "release.yaml.gz"),
+		Gzip:      true,
+	}
+	out, err := openOutput(fo)
+	if err != nil {
+		t.Fatalf("openOutput() = %v", err)
+	}
+	if err := resolveFilesToWriter(context.Background(), builder, kotesting.NewFixedPublish(base, testHashes), fo, &options.SelectorOptions{}, out); err != nil {
+		t.Fatalf("resolveFilesToWriter() = %v", err)
+	}
+
+	f, err := os.Open(fo.Output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("gzip.NewReader() = %v", err)
+	}
+	got, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("reading gzipped output: %v", err)
+	}
+	want := fmt.Sprintf("image: %s\n---\nimage: %s\n\n---\n",
+		kotesting.ComputeDigest(base, fooRef, fooHash),
+		kotesting.ComputeDigest(base, barRef, barHash))
+	if string(got) != want {
+		t.Errorf("gzipped output = %q, wanted %q", got, want)
+	}
+}
+
+func TestOpenOutputErrors(t *testing.T) {
+	for _, fo := range []*options.FilenameOptions{
+		{Gzip: true},
+		{Gzip: true, Watch: true, Output: "release.yaml.gz"},
+	} {
+		if out, err := openOutput(fo); err == nil {
+			out.Close()
+			t.Errorf("openOutput(%+v) = nil, wanted an error", fo)
+		}
+	}
+	// Without --output, documents still stream to stdout.
+	if out, err := openOutput(&options.FilenameOptions{}); err != nil || out != os.Stdout {
+		t.Errorf("openOutput() = %v, %v, wanted stdout", out, err)
+	}
+}
+
+// chunkWriter writes what is written to it to buf a few bytes at a time,
+// yielding in between, like a pipe that only takes partial writes.
+type chunkWriter struct {
+	buf bytes.Buffer
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	for i := 0; i < len(p); i += 7 {
+		end := i + 7
+		if end > len(p) {
+			end = len(p)
+		}
+		c.buf.Write(p[i:end])
+		runtime.Gosched()
+	}
+	return len(p), nil
+}
+
+// fakeResolution is the output of resolving file i, of a size that varies
+// with i, and that says which file it's for throughout.
+func fakeResolution(i int) string {
+	line := fmt.Sprintf("file: doc-%d.yaml\n", i)
+	return strings.Repeat(line, 1+(i*37)%200)
+}
+
+func TestOutputQueueConcurrent(t *testing.T) {
+	const n = 500
+	var w chunkWriter
+	q := newOutputQueue(&w, false)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			time.Sleep(time.Duration(rand.Intn(1000)) * time.Microsecond)
+			b := []byte(fakeResolution(i) + "---\n")
+			if _, err := q.Write(b); err != nil {
+				t.Errorf("Write() = %v", err)
+			}
+			// The queue has its own copy.
+			copy(b, strings.Repeat("x", len(b)))
+		}(i)
+	}
+	wg.Wait()
+	if err := q.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	docs := strings.Split(strings.TrimSuffix(w.buf.String(), "---\n"), "---\n")
+	if len(docs) != n {
+		t.Fatalf("got %d documents, wanted %d", len(docs), n)
+	}
+	seen := map[int]bool{}
+	for _, doc := range docs {
+		var i int
+		if _, err := fmt.Sscanf(doc, "file: doc-%d.yaml\n", &i); err != nil {
+			t.Fatalf("document %q isn't attributed to a file: %v", doc, err)
+		}
+		if doc != fakeResolution(i) {
+			t.Errorf("document for file %d is incomplete or mixed with another: %q", i, doc)
+		}
+		if seen[i] {
+			t.Errorf("document for file %d written twice", i)
+		}
+		seen[i] = true
+	}
+
+	if _, err := q.Write([]byte("late")); err == nil {
+		t.Error("Write() after Close() = nil, wanted an error")
+	}
+}
+
+type errWriter struct{ n int }
+
+func (e *errWriter) Write(p []byte) (int, error) {
+	if e.n++; e.n > 1 {
+		return 0, errors.New("broken pipe")
+	}
+	return len(p), nil
+}
+
+func TestOutputQueueError(t *testing.T) {
+	w := &errWriter{}
+	q := newOutputQueue(w, false)
+	for i := 0; i < 10; i++ {
+		q.Write([]byte("doc\n"))
+	}
+	if err := q.Close(); err == nil || err.Error() != "broken pipe" {
+		t.Errorf("Close() = %v, wanted broken pipe", err)
+	}
+	// Nothing is written after the failed write.
+	if w.n != 2 {
+		t.Errorf("%d writes, wanted 2", w.n)
+	}
+	if _, err := q.Write([]byte("doc\n")); err == nil {
+		t.Error("Write() after failure = nil, wanted an error")
+	}
+}
+
+func TestAtomicFilesConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ko-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const n = 200
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("doc-%d.yaml", i))
+		if err := ioutil.WriteFile(path, []byte("old\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(i int, path string) {
+			defer wg.Done()
+			f := createAtomically(path)
+			// Each file's output is written in pieces, from its own queue.
+			q := newOutputQueue(f, false)
+			for _, line := range strings.SplitAfter(fakeResolution(i), "\n") {
+				if _, err := q.Write([]byte(line)); err != nil {
+					t.Errorf("Write() = %v", err)
+				}
+				runtime.Gosched()
+			}
+			if err := q.Close(); err != nil {
+				t.Errorf("Close() = %v", err)
+			}
+			// Until it's closed, the old file is intact.
+			if b, err := ioutil.ReadFile(path); err != nil || string(b) != "old\n" {
+				t.Errorf("%s before Close() = %q, %v, wanted the old file", path, b, err)
+			}
+			if i%10 == 0 {
+				discardOutput(f)
+				return
+			}
+			if err := f.Close(); err != nil {
+				t.Errorf("Close() = %v", err)
+			}
+		}(i, path)
+	}
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("doc-%d.yaml", i))
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := fakeResolution(i)
+		if i%10 == 0 {
+			want = "old\n"
+		}
+		if string(b) != want {
+			t.Errorf("%s = %q, wanted %q", path, b, want)
+		}
+	}
+	// No temporary files are left behind.
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != n {
+		t.Errorf("%d files in %s, wanted %d", len(entries), dir, n)
+	}
+}
+
+// sleepyBuilder builds with Builder after a random delay, so that
+// resolutions complete in random order.
+type sleepyBuilder struct {
+	build.Interface
+}
+
+func (s sleepyBuilder) Build(ctx context.Context, ip string) (build.Result, error) {
+	time.Sleep(time.Duration(rand.Intn(2000)) * time.Microsecond)
+	return s.Interface.Build(ctx, ip)
+}
+
+func TestResolveFilesToWriterConcurrent(t *testing.T) {
+	const n = 200
+	base := mustRepository("gcr.io/multi-pass")
+	var files []string
+	var want strings.Builder
+	for i := 0; i < n; i++ {
+		// Each file has its own importpath, so that its build isn't cached.
+		ref := fmt.Sprintf("%s%s/%d", build.StrictScheme, fooRef, i)
+		files = append(files, yamlToTmpFile(t, []byte(fmt.Sprintf("# file %d\nimage: %s\n", i, ref))))
+		want.WriteString(fmt.Sprintf("# file %d\nimage: %s\n\n---\n", i, kotesting.ComputeDigest(base, fmt.Sprintf("%s/%d", fooRef, i), fooHash)))
+	}
+	results := map[string]build.Result{}
+	hashes := map[string]v1.Hash{}
+	for i := 0; i < n; i++ {
+		ip := fmt.Sprintf("%s/%d", fooRef, i)
+		results[ip] = foo
+		hashes[ip] = fooHash
+	}
+	builder, err := build.NewCaching(sleepyBuilder{kotesting.NewFixedBuild(results)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var w chunkWriter
+	fo := &options.FilenameOptions{Filenames: files}
+	if err := resolveFilesToWriter(context.Background(), builder, kotesting.NewFixedPublish(base, hashes), fo, &options.SelectorOptions{}, nopWriteCloser{&w}); err != nil {
+		t.Fatalf("resolveFilesToWriter() = %v", err)
+	}
+	// Every document is whole, and in the order of the files.
+	if diff := cmp.Diff(want.String(), w.buf.String()); diff != "" {
+		t.Errorf("resolveFilesToWriter() (-want +got): %s", diff)
+	}
+}
+
+// flushWriter buffers what's written to it, like a bufio.Writer, and
+// records what each Flush writes.
+type flushWriter struct {
+	pending bytes.Buffer
+	flushed []string
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) { return f.pending.Write(p) }
+func (f *flushWriter) Close() error                { return nil }
+
+func (f *flushWriter) Flush() error {
+	f.flushed = append(f.flushed, f.pending.String())
+	f.pending.Reset()
+	return nil
+}
+
+func TestResolveFilesToWriterFlush(t *testing.T) {
+	base := mustRepository("gcr.io/multi-pass")
+	var input, want []string
+	for i := 0; i < 3; i++ {
+		input = append(input, fmt.Sprintf("image: %s%s\nindex: %d\n", build.StrictScheme, fooRef, i))
+		want = append(want, fmt.Sprintf("image: %s\nindex: %d\n---\n", kotesting.ComputeDigest(base, fooRef, fooHash), i))
+	}
+	// The file's last document is followed by a blank line.
+	want[len(want)-1] = strings.Replace(want[len(want)-1], "---", "\n---", 1)
+	file := yamlToTmpFile(t, []byte(strings.Join(input, "---\n")))
+	builder, err := build.NewCaching(kotesting.NewFixedBuild(map[string]build.Result{fooRef: foo}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher := kotesting.NewFixedPublish(base, map[string]v1.Hash{fooRef: fooHash})
+
+	for _, flush := range []bool{true, false} {
+		t.Run(fmt.Sprintf("flush=%v", flush), func(t *testing.T) {
+			w := &flushWriter{}
+			fo := &options.FilenameOptions{Filenames: []string{file}, FlushPerDocument: flush}
+			if err := resolveFilesToWriter(context.Background(), builder, publisher, fo, &options.SelectorOptions{}, w); err != nil {
+				t.Fatalf("resolveFilesToWriter() = %v", err)
+			}
+			if !flush {
+				// Everything is left to whoever owns the writer to flush.
+				if len(w.flushed) != 0 {
+					t.Errorf("flushed %d times, wanted none", len(w.flushed))
+				}
+				if got, want := w.pending.String(), strings.Join(want, ""); got != want {
+					t.Errorf("resolveFilesToWriter() wrote %q, wanted %q", got, want)
+				}
+				return
+			}
+			// Each document is flushed whole, as soon as it's written.
+			if diff := cmp.Diff(want, w.flushed); diff != "" {
+				t.Errorf("flushed documents (-want +got): %s", diff)
+			}
+			if w.pending.Len() != 0 {
+				t.Errorf("%q left unflushed", w.pending.String())
+			}
+		})
+	}
+}
+
+// memoryOutputs is an outputFactory that keeps each output in memory.
+type memoryOutputs struct {
+	m       sync.Mutex
+	outputs map[string][]string
+}
+
+type memoryOutput struct {
+	bytes.Buffer
+	path string
+	mo   *memoryOutputs
+}
+
+func (o *memoryOutput) Close() error {
+	o.mo.m.Lock()
+	defer o.mo.m.Unlock()
+	o.mo.outputs[o.path] = append(o.mo.outputs[o.path], o.String())
+	return nil
+}
+
+func (mo *memoryOutputs) open(path string) (io.WriteCloser, error) {
+	return &memoryOutput{path: path, mo: mo}, nil
+}
+
+func TestResolveFilesToWriters(t *testing.T) {
+	const n = 50
+	base := mustRepository("gcr.io/multi-pass")
+	results := map[string]build.Result{}
+	hashes := map[string]v1.Hash{}
+	var files []string
+	want := map[string][]string{}
+	for i := 0; i < n; i++ {
+		ip := fmt.Sprintf("%s/%d", fooRef, i)
+		results[ip] = foo
+		hashes[ip] = fooHash
+		// Every other file has two documents.
+		input := fmt.Sprintf("image: %s%s\n", build.StrictScheme, ip)
+		output := fmt.Sprintf("image: %s\n", kotesting.ComputeDigest(base, ip, fooHash))
+		if i%2 == 0 {
+			input += "---\nname: " + ip + "\n"
+			output += "---\nname: " + ip + "\n"
+		}
+		f := yamlToTmpFile(t, []byte(input))
+		files = append(files, f)
+		want[f] = []string{output}
+	}
+	builder, err := build.NewCaching(sleepyBuilder{kotesting.NewFixedBuild(results)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mo := &memoryOutputs{outputs: map[string][]string{}}
+	fo := &options.FilenameOptions{Filenames: files}
+	if err := resolveFilesToWriters(context.Background(), builder, kotesting.NewFixedPublish(base, hashes), fo, &options.SelectorOptions{}, mo.open); err != nil {
+		t.Fatalf("resolveFilesToWriters() = %v", err)
+	}
+	if diff := cmp.Diff(want, mo.outputs); diff != "" {
+		t.Errorf("resolveFilesToWriters() (-want +got): %s", diff)
+	}
+
+	fo.Merge = true
+	if err := resolveFilesToWriters(context.Background(), builder, kotesting.NewFixedPublish(base, hashes), fo, &options.SelectorOptions{}, mo.open); err == nil {
+		t.Error("resolveFilesToWriters(--merge) = nil, wanted an error")
+	}
+}
+
+func TestWriteFileOutputOrder(t *testing.T) {
+	mo := &memoryOutputs{outputs: map[string][]string{}}
+	prev := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- writeFileOutput(mo.open, "a.yaml", []byte("second\n"), prev)
+	}()
+
+	// The output waits for the previous one.
+	time.Sleep(10 * time.Millisecond)
+	if err := writeFileOutput(mo.open, "a.yaml", []byte("first\n"), nil); err != nil {
+		t.Fatalf("writeFileOutput() = %v", err)
+	}
+	close(prev)
+	if err := <-done; err != nil {
+		t.Fatalf("writeFileOutput() = %v", err)
+	}
+	if diff := cmp.Diff(map[string][]string{"a.yaml": {"first\n", "second\n"}}, mo.outputs); diff != "" {
+		t.Errorf("outputs (-want +got): %s", diff)
+	}
+}
+
+func TestMirroredOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ko-output-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newOutput := mirroredOutputs(dir)
+	for _, test := range []struct {
+		input string
+		want  string
+	}{{
+		input: "config/app.yaml",
+		want:  "config/app.yaml",
+	}, {
+		input: "./config/../app.yaml",
+		want:  "app.yaml",
+	}, {
+		input: filepath.Join(wd, "config", "nested", "app.yaml"),
+		want:  "config/nested/app.yaml",
+	}} {
+		w, err := newOutput(test.input)
+		if err != nil {
+			t.Fatalf("newOutput(%s) = %v", test.input, err)
+		}
+		if _, err := w.Write([]byte(test.input)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(test.want)))
+		if err != nil || string(b) != test.input {
+			t.Errorf("output of %s = %q, %v, wanted it in %s", test.input, b, err, test.want)
+		}
+	}
+
+	for _, f := range []string{"../app.yaml", filepath.Dir(wd)} {
+		if w, err := newOutput(f); err == nil {
+			discardOutput(w)
+			t.Errorf("newOutput(%s) = nil, wanted an error", f)
+		}
+	}
+}
+
+func TestCheckFileOutputs(t *testing.T) {
+	for _, fo := range []*options.FilenameOptions{
+		{OutputDir: "out", Output: "release.yaml"},
+		{OutputDir: "out", Gzip: true},
+		{OutputDir: "out", Merge: true},
+		{OutputDir: "out", Filenames: []string{"config/", "-"}},
+		{InPlace: true, OutputDir: "out"},
+		{InPlace: true, Output: "release.yaml"},
+		{InPlace: true, DryRun: true},
+		{InPlace: true, Watch: true},
+		{InPlace: true, Filenames: []string{"-"}},
+	} {
+		if err := checkFileOutputs(fo); err == nil {
+			t.Errorf("checkFileOutputs(%+v) = nil, wanted an error", fo)
+		}
+	}
+	for _, fo := range []*options.FilenameOptions{
+		{OutputDir: "out", Filenames: []string{"config/"}},
+		{InPlace: true, Filenames: []string{"config/"}},
+	} {
+		if err := checkFileOutputs(fo); err != nil {
+			t.Errorf("checkFileOutputs(%+v) = %v", fo, err)
+		}
+	}
+}
+
+func TestResolveInPlace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ko-in-place")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := mustRepository("gcr.io/multi-pass")
+	resolved := filepath.Join(dir, "app.yaml")
+	input := "# Copyright 2021\n---\nimage: " + build.StrictScheme + fooRef + "\n"
+	if err := ioutil.WriteFile(resolved, []byte(input), 0600); err != nil {
+		t.Fatal(err)
+	}
+	unchanged := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(unchanged, []byte("name: config\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(unchanged, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	builder, err := build.NewCaching(testBuilder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fo := &options.FilenameOptions{
+		Filenames:            []string{resolved, unchanged},
+		InPlace:              true,
+		KeepCommentDocuments: true,
+	}
+	if err := resolveFilesToWriters(context.Background(), builder, kotesting.NewFixedPublish(base, testHashes), fo, &options.SelectorOptions{}, inPlaceOutputs); err != nil {
+		t.Fatalf("resolveFilesToWriters() = %v", err)
+	}
+
+	b, err := ioutil.ReadFile(resolved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# Copyright 2021\n---\nimage: " + kotesting.ComputeDigest(base, fooRef, fooHash) + "\n"
+	if diff := cmp.Diff(want, string(b)); diff != "" {
+		t.Errorf("%s (-want +got): %s", resolved, diff)
+	}
+	if fi, err := os.Stat(resolved); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("%s mode = %v, %v, wanted 0600", resolved, fi.Mode(), err)
+	}
+	// The file without references isn't written.
+	if fi, err := os.Stat(unchanged); err != nil || !fi.ModTime().Equal(past) {
+		t.Errorf("%s was modified at %v, %v, wanted it untouched", unchanged, fi.ModTime(), err)
+	}
+	// Nothing else is left in the directory.
+	if entries, err := ioutil.ReadDir(dir); err != nil || len(entries) != 2 {
+		t.Errorf("%s has %d files, %v, wanted 2", dir, len(entries), err)
+	}
+}
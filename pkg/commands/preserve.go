@@ -0,0 +1,161 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// copyNode returns a deep copy of n, except for the targets of aliases.
+func copyNode(n *yaml.Node) *yaml.Node {
+	c := *n
+	c.Content = make([]*yaml.Node, len(n.Content))
+	for i, child := range n.Content {
+		c.Content[i] = copyNode(child)
+	}
+	return &c
+}
+
+// scalarEdit replaces the bytes [start, end) of a document with value.
+type scalarEdit struct {
+	start, end int
+	value      string
+}
+
+// patchDocument returns src, the document that orig was decoded from, with
+// the scalar values that differ in node written in their place, so that
+// everything else in it (comments, indentation, quoting, key order) is kept
+// byte for byte. It reports false if node differs from orig in any other way,
+// or a value can't be patched in place, so that the document must be encoded
+// instead. offset is what was added to the lines of orig.
+func patchDocument(src []byte, orig, node *yaml.Node, offset int) ([]byte, bool) {
+	var edits []scalarEdit
+	if !diffNodes(src, orig, node, offset, &edits) {
+		return nil, false
+	}
+	if len(edits) == 0 {
+		return src, true
+	}
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+	var buf bytes.Buffer
+	last := 0
+	for _, e := range edits {
+		if e.start < last {
+			return nil, false
+		}
+		buf.Write(src[last:e.start])
+		buf.WriteString(e.value)
+		last = e.end
+	}
+	buf.Write(src[last:])
+	return buf.Bytes(), true
+}
+
+// diffNodes appends to edits the patches that turn orig into node within src,
+// and reports whether they are all that differ.
+func diffNodes(src []byte, orig, node *yaml.Node, offset int, edits *[]scalarEdit) bool {
+	if orig.Kind != node.Kind || orig.Tag != node.Tag || orig.Style != node.Style ||
+		orig.Anchor != node.Anchor || len(orig.Content) != len(node.Content) ||
+		orig.HeadComment != node.HeadComment || orig.LineComment != node.LineComment ||
+		orig.FootComment != node.FootComment {
+		return false
+	}
+	if orig.Value != node.Value {
+		if node.Kind != yaml.ScalarNode {
+			return false
+		}
+		e, ok := scalarPatch(src, orig, node, offset)
+		if !ok {
+			return false
+		}
+		*edits = append(*edits, e)
+	}
+	for i := range orig.Content {
+		if !diffNodes(src, orig.Content[i], node.Content[i], offset, edits) {
+			return false
+		}
+	}
+	return true
+}
+
+// scalarPatch returns the edit that replaces the single-line scalar orig in
+// src with the value of node, written in the same style where possible.
+func scalarPatch(src []byte, orig, node *yaml.Node, offset int) (scalarEdit, bool) {
+	var token string
+	switch orig.Style {
+	case 0:
+		token = orig.Value
+	case yaml.SingleQuotedStyle:
+		token = "'" + strings.ReplaceAll(orig.Value, "'", "''") + "'"
+	case yaml.DoubleQuotedStyle:
+		token = `"` + orig.Value + `"`
+	default:
+		// Tagged, literal and folded scalars don't start with their value.
+		return scalarEdit{}, false
+	}
+	if strings.ContainsAny(token, "\r\n") {
+		return scalarEdit{}, false
+	}
+	start, ok := position(src, orig.Line-offset, orig.Column)
+	if !ok || !bytes.HasPrefix(src[start:], []byte(token)) {
+		return scalarEdit{}, false
+	}
+
+	// Let the encoder pick the quoting, in case the new value would mean
+	// something else in the original style.
+	b, err := yaml.Marshal(&yaml.Node{
+		Kind:  yaml.ScalarNode,
+		Tag:   node.Tag,
+		Style: node.Style,
+		Value: node.Value,
+	})
+	if err != nil {
+		return scalarEdit{}, false
+	}
+	value := strings.TrimSuffix(string(b), "\n")
+	if strings.ContainsAny(value, "\r\n") {
+		return scalarEdit{}, false
+	}
+	return scalarEdit{start: start, end: start + len(token), value: value}, true
+}
+
+// position returns the byte offset in src of the 1-based line and column
+// (in characters) that yaml reports for a node.
+func position(src []byte, line, column int) (int, bool) {
+	if line < 1 || column < 1 {
+		return 0, false
+	}
+	off := 0
+	for l := 1; l < line; l++ {
+		i := bytes.IndexByte(src[off:], '\n')
+		if i < 0 {
+			return 0, false
+		}
+		off += i + 1
+	}
+	for c := 1; c < column; c++ {
+		if off >= len(src) || src[off] == '\n' {
+			return 0, false
+		}
+		_, size := utf8.DecodeRune(src[off:])
+		off += size
+	}
+	return off, true
+}
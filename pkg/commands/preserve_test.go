@@ -0,0 +1,154 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/ko/pkg/commands/options"
+	kotesting "github.com/google/ko/pkg/internal/testing"
+	"gopkg.in/yaml.v3"
+)
+
+func TestResolvePreservesFormatting(t *testing.T) {
+	base := mustRepository("gcr.io/multi-pass")
+	digest := kotesting.ComputeDigest(base, fooRef, fooHash)
+
+	// Everything but the references should come out byte for byte: the
+	// comments, the 4-space indentation, the key order, the flow mapping
+	// and the quoting.
+	input := `# The app.
+apiVersion: apps/v1
+kind: Deployment
+spec:
+    template:
+        spec:
+            containers:
+            -   name: app  # the main one
+                image: ko://%[1]s
+            -   name: sidecar
+                image: 'ko://%[1]s'
+                resources: {limits: {cpu: 1},   requests: {}}
+metadata:
+    name: app
+---   # Untouched.
+apiVersion: v1
+kind: ConfigMap
+data: {key:   "value"}
+`
+	want := `# The app.
+apiVersion: apps/v1
+kind: Deployment
+spec:
+    template:
+        spec:
+            containers:
+            -   name: app  # the main one
+                image: %[2]s
+            -   name: sidecar
+                image: '%[2]s'
+                resources: {limits: {cpu: 1},   requests: {}}
+metadata:
+    name: app
+---   # Untouched.
+apiVersion: v1
+kind: ConfigMap
+data: {key:   "value"}
+`
+	f := yamlToTmpFile(t, []byte(fmt.Sprintf(input, fooRef)))
+	defer os.Remove(f)
+
+	got, err := resolveFile(context.Background(), f, testBuilder,
+		kotesting.NewFixedPublish(base, testHashes),
+		&options.FilenameOptions{}, &options.SelectorOptions{})
+	if err != nil {
+		t.Fatalf("resolveFile() = %v", err)
+	}
+	if diff := cmp.Diff(fmt.Sprintf(want, fooRef, digest), string(got)); diff != "" {
+		t.Errorf("resolveFile() (-want +got): %s", diff)
+	}
+}
+
+func TestPatchDocument(t *testing.T) {
+	src := []byte(`a:   1   # one
+b: [x, 'y']
+c: "z"
+`)
+	for _, c := range []struct {
+		desc   string
+		mutate func(doc *yaml.Node)
+		want   string
+	}{{
+		desc:   "unchanged",
+		mutate: func(*yaml.Node) {},
+		want:   string(src),
+	}, {
+		desc: "values",
+		mutate: func(doc *yaml.Node) {
+			m := doc.Content[0]
+			m.Content[1].Value = "2"
+			m.Content[3].Content[1].Value = "it's"
+			m.Content[5].Value = "new"
+		},
+		want: `a:   2   # one
+b: [x, 'it''s']
+c: "new"
+`,
+	}, {
+		// A plain value that would read back as something else is quoted.
+		desc: "quoting",
+		mutate: func(doc *yaml.Node) {
+			doc.Content[0].Content[3].Content[0].Value = "true"
+		},
+		want: `a:   1   # one
+b: ["true", 'y']
+c: "z"
+`,
+	}, {
+		desc: "added key",
+		mutate: func(doc *yaml.Node) {
+			m := doc.Content[0]
+			m.Content = append(m.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "d"},
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "w"})
+		},
+	}, {
+		desc: "changed comment",
+		mutate: func(doc *yaml.Node) {
+			doc.Content[0].Content[1].LineComment = "# uno"
+		},
+	}} {
+		t.Run(c.desc, func(t *testing.T) {
+			var doc yaml.Node
+			if err := yaml.Unmarshal(src, &doc); err != nil {
+				t.Fatal(err)
+			}
+			orig := copyNode(&doc)
+			c.mutate(&doc)
+
+			got, ok := patchDocument(src, orig, &doc, 0)
+			if ok != (c.want != "") {
+				t.Fatalf("patchDocument() = %t, wanted %t", ok, c.want != "")
+			}
+			if diff := cmp.Diff(c.want, string(got)); ok && diff != "" {
+				t.Errorf("patchDocument() (-want +got): %s", diff)
+			}
+		})
+	}
+}
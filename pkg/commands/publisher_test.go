@@ -34,7 +34,7 @@ func TestPublishImages(t *testing.T) {
 	if err != nil {
 		t.Fatalf("could not create test registry server: %v", err)
 	}
-	repo := s.Listener.Addr().String()
+	repo := s.Host()
 	baseImage := fmt.Sprintf("%s/%s", repo, namespace)
 	sampleAppDir, err := sampleAppRelDir()
 	if err != nil {
@@ -15,10 +15,15 @@
 package commands
 
 import (
+	"crypto"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 
+	"github.com/google/ko/pkg/build"
 	"github.com/google/ko/pkg/commands/options"
+	"github.com/google/ko/pkg/publish"
 	"github.com/spf13/cobra"
 )
 
@@ -28,6 +33,11 @@ func addResolve(topLevel *cobra.Command) {
 	fo := &options.FilenameOptions{}
 	so := &options.SelectorOptions{}
 	bo := &options.BuildOptions{}
+	wo := &options.WarningOptions{}
+	ao := &options.ArgoCDOptions{}
+	ipo := &options.ImagePolicyOptions{}
+	jo := &options.JobOptions{}
+	co := &options.ComposeOptions{}
 
 	resolve := &cobra.Command{
 		Use:   "resolve -f FILENAME",
@@ -52,26 +62,209 @@ func addResolve(topLevel *cobra.Command) {
   # daemon as:
   #   ko.local/<import path>
   # This always preserves import paths.
-  ko resolve --local -f config/`,
+  ko resolve --local -f config/
+
+  # Print what would be built and published, without doing it.
+  ko resolve -f config/ --dry-run
+
+  # Only rebuild images affected by changes since the last release,
+  # reusing the references it published for the rest.
+  ko resolve -f config/ --changed-since=v1.2.0 --previous-refs=refs.json
+
+  # Write the resolved documents to a gzipped file.
+  ko resolve -f config/ --output=release.yaml.gz --gzip
+
+  # Also generate an Argo CD Application pinning the resolved images.
+  ko resolve -f config/ --argocd-application=my-app \
+    --argocd-repo-url=https://github.com/foo/bar-deploy.git
+
+  # Sign the images, and also generate a ClusterImagePolicy for
+  # Sigstore policy-controller that requires their signatures.
+  KO_SIGNING_KEY=cosign.key ko resolve -f config/ --sign \
+    --image-policy=signed-by-ko
+
+  # Also generate a Job that runs database migrations with the
+  # image of ./cmd/migrate.
+  ko resolve -f config/ --job-importpath=./cmd/migrate \
+    --job-args=up`,
 		Args: cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if fo.ExplainWatch != "" {
+				return explainWatch(os.Stdout, fo.ExplainWatch)
+			}
+			if err := checkComposeFile(co, fo); err != nil {
+				return err
+			}
+			if fo.OutputDir != "" || fo.InPlace {
+				if err := checkFileOutputs(fo); err != nil {
+					return err
+				}
+				if ao.Application != "" || ipo.Name != "" || jo.ImportPath != "" {
+					return errors.New("--output-dir and --in-place can't be used with --argocd-application, --image-policy or --job-importpath, which are appended to the output")
+				}
+				// Files are written whole, so keep their comments.
+				fo.KeepCommentDocuments = true
+			}
+			var policyKey crypto.Signer
+			if ipo.Name != "" && !fo.DryRun {
+				if !po.Sign {
+					return errors.New("--image-policy requires --sign")
+				}
+				key, err := signingKey(po)
+				if err != nil {
+					return err
+				}
+				policyKey = key
+			}
 			ctx := createCancellableContext()
 			bo.InsecureRegistry = po.InsecureRegistry
-			builder, err := makeBuilder(ctx, bo)
+			shareSBOMs(bo, po)
+			builder, lister, err := makeListingBuilder(ctx, bo)
 			if err != nil {
 				return fmt.Errorf("error creating builder: %v", err)
 			}
-			publisher, err := makePublisher(po)
+			if ctx, err = watchContext(ctx, bo, fo); err != nil {
+				return err
+			}
+			if fo.BuildPlatform, err = targetPlatform(bo); err != nil {
+				return err
+			}
+			var changes *changeSet
+			if fo.ChangedSince != "" {
+				if fo.DryRun || fo.Watch {
+					return fmt.Errorf("--changed-since can't be used with --dry-run or --watch")
+				}
+				changes, err = newChangeSet(ctx, bo.WorkingDirectory, fo.ChangedSince, fo.PreviousRefs, fo.BuildPlatform, lister)
+				if err != nil {
+					return err
+				}
+				builder, err = build.NewCaching(changedBuilder{builder, changes})
+				if err != nil {
+					return fmt.Errorf("error creating builder: %v", err)
+				}
+			}
+			var publisher publish.Interface
+			if fo.DryRun {
+				builder, err = build.NewCaching(dryRunBuilder{builder})
+				if err != nil {
+					return fmt.Errorf("error creating builder: %v", err)
+				}
+				publisher, err = newDryRunPublisher(po)
+			} else {
+				publisher, err = makePublisher(po)
+			}
 			if err != nil {
 				return fmt.Errorf("error creating publisher: %v", err)
 			}
 			defer publisher.Close()
-			return resolveFilesToWriter(ctx, builder, publisher, fo, so, os.Stdout)
+			if changes != nil {
+				publisher = changedPublisher{publisher, changes}
+				defer changes.report(os.Stderr)
+			}
+			if fo.OutputDir != "" {
+				return resolveFilesToWriters(ctx, builder, publisher, fo, so, mirroredOutputs(fo.OutputDir))
+			}
+			if fo.InPlace {
+				return resolveFilesToWriters(ctx, builder, publisher, fo, so, inPlaceOutputs)
+			}
+			out, err := openOutput(fo)
+			if err != nil {
+				return err
+			}
+			// Close the output here rather than in resolveFilesToWriter,
+			// so that errors flushing a --gzip file aren't lost, and so
+			// that a failed run doesn't replace the --output file.
+			defer discardOutput(out)
+			if (ao.Application == "" && ipo.Name == "" && jo.ImportPath == "" && co.File == "") || fo.DryRun {
+				if err := resolveFilesToWriter(ctx, builder, publisher, fo, so, nopWriteCloser{out}); err != nil {
+					return err
+				}
+				return out.Close()
+			}
+
+			// Record what we publish, for the compose file, and keep the
+			// output open after resolving so that we can append the Argo
+			// CD Application, ClusterImagePolicy and Job.
+			rec := &publish.Recorder{Publisher: publisher}
+			if err := resolveFilesToWriter(ctx, builder, rec, fo, so, nopWriteCloser{out}); err != nil {
+				return err
+			}
+			if co.File != "" {
+				compose, err := composeYAML(rec.References())
+				if err != nil {
+					return fmt.Errorf("error generating compose file: %v", err)
+				}
+				if err := build.WriteFileAtomically(co.File, func(w io.Writer) error {
+					_, err := w.Write(compose)
+					return err
+				}); err != nil {
+					return fmt.Errorf("writing --compose-file: %v", err)
+				}
+			}
+			if ao.Application != "" {
+				app, err := argoCDApplicationYAML(ao, rec.References())
+				if err != nil {
+					return fmt.Errorf("error generating Argo CD Application: %v", err)
+				}
+				if _, err := out.Write(app); err != nil {
+					return err
+				}
+			}
+			if ipo.Name != "" {
+				policy, err := imagePolicyYAML(ipo, policyKey.Public(), rec.References())
+				if err != nil {
+					return fmt.Errorf("error generating ClusterImagePolicy: %v", err)
+				}
+				if ao.Application != "" {
+					policy = append([]byte("---\n"), policy...)
+				}
+				if _, err := out.Write(policy); err != nil {
+					return err
+				}
+			}
+			if jo.ImportPath != "" {
+				// The builder and publisher cache, so this is the image
+				// the resolved documents use, if they use it.
+				refs, err := publishImages(ctx, []string{jo.ImportPath}, rec, builder)
+				if err != nil {
+					return err
+				}
+				for _, ref := range refs {
+					j, err := jobYAML(jo, ref)
+					if err != nil {
+						return fmt.Errorf("error generating Job: %v", err)
+					}
+					if ao.Application != "" || ipo.Name != "" {
+						j = append([]byte("---\n"), j...)
+					}
+					if _, err := out.Write(j); err != nil {
+						return err
+					}
+				}
+			}
+			return out.Close()
 		},
 	}
 	options.AddPublishArg(resolve, po)
 	options.AddFileArg(resolve, fo)
+	options.AddWatchDebugArg(resolve, fo)
 	options.AddSelectorArg(resolve, so)
+	options.AddNormalizeArg(resolve, &fo.Normalize)
+	options.AddStrictArg(resolve, &fo.Strict)
+	options.AddCommentDocumentsArg(resolve, fo)
+	options.AddMergeArg(resolve, fo)
+	options.AddHelmReleaseArg(resolve, fo)
+	options.AddImagesChecksumArg(resolve, fo)
+	options.AddBuildOutputArg(resolve, fo)
+	options.AddOutputArg(resolve, fo)
+	options.AddDryRunArg(resolve, fo)
+	options.AddChangedSinceArg(resolve, fo)
 	options.AddBuildOptions(resolve, bo)
+	options.AddWarningsArg(resolve, wo)
+	options.AddArgoCDArg(resolve, ao)
+	options.AddImagePolicyArg(resolve, ipo)
+	options.AddJobArg(resolve, jo)
+	options.AddComposeArg(resolve, co)
+	resolve.RunE = withGitHubErrors(po, withWarnings(wo, withTracing(resolve.RunE)))
 	topLevel.AddCommand(resolve)
 }
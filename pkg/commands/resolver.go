@@ -25,10 +25,14 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"path"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
@@ -36,20 +40,87 @@ import (
 	"github.com/google/ko/pkg/commands/options"
 	"github.com/google/ko/pkg/publish"
 	"github.com/google/ko/pkg/resolve"
+	"github.com/google/ko/pkg/trace"
+	"github.com/google/ko/pkg/warnings"
 	"github.com/mattmoor/dep-notify/pkg/graph"
 	"golang.org/x/sync/errgroup"
 	"gopkg.in/yaml.v3"
 	"k8s.io/apimachinery/pkg/labels"
 )
 
-// ua returns the ko user agent.
+// ua returns the ko user agent: KO_USER_AGENT, e.g. for proxies that only
+// let known agents through, or else ko and its version. go-containerregistry
+// appends its own version to it.
 func ua() string {
+	if v := strings.TrimSpace(os.Getenv("KO_USER_AGENT")); v != "" {
+		return v
+	}
 	if v := version(); v != "" {
 		return "ko/" + v
 	}
 	return "ko"
 }
 
+// targetPlatform returns the platforms to build for: --platform, or else
+// KO_DEFAULTPLATFORMS, or else GOOS and GOARCH (and GOARM), or else
+// linux/amd64.
+func targetPlatform(bo *options.BuildOptions) (string, error) {
+	platform, source := bo.Platform, "--platform"
+	if platform == "" {
+		platform, source = os.Getenv("KO_DEFAULTPLATFORMS"), "KO_DEFAULTPLATFORMS"
+		if platform != "" {
+			if err := validatePlatforms(platform); err != nil {
+				return "", fmt.Errorf("KO_DEFAULTPLATFORMS: %v", err)
+			}
+		}
+	}
+	if platform != "" {
+		// Make sure these are all unset
+		for _, env := range []string{"GOOS", "GOARCH", "GOARM"} {
+			if s, ok := os.LookupEnv(env); ok {
+				return "", fmt.Errorf("cannot use %s with %s=%q", source, env, s)
+			}
+		}
+		return platform, nil
+	}
+
+	platform = "linux/amd64"
+
+	goos, goarch, goarm := os.Getenv("GOOS"), os.Getenv("GOARCH"), os.Getenv("GOARM")
+
+	// Default to linux/amd64 unless GOOS and GOARCH are set.
+	if goos != "" && goarch != "" {
+		platform = path.Join(goos, goarch)
+	}
+
+	// Use GOARM for variant if it's set and GOARCH is arm.
+	if strings.Contains(goarch, "arm") && goarm != "" {
+		platform = path.Join(platform, "v"+goarm)
+	}
+	return platform, nil
+}
+
+// validatePlatforms returns an error naming the first platform in spec, a
+// comma-separated list like --platform, that isn't os[/arch[/variant]], or
+// "all" alone.
+func validatePlatforms(spec string) error {
+	if spec == "all" {
+		return nil
+	}
+	for _, p := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(p), "/")
+		if len(parts) > 3 || parts[0] == "all" {
+			return fmt.Errorf("invalid platform %q, expected os[/arch[/variant]] or all", p)
+		}
+		for _, part := range parts {
+			if part == "" {
+				return fmt.Errorf("invalid platform %q, expected os[/arch[/variant]] or all", p)
+			}
+		}
+	}
+	return nil
+}
+
 func gobuildOptions(bo *options.BuildOptions) ([]build.Option, error) {
 	creationTime, err := getCreationTime()
 	if err != nil {
@@ -61,32 +132,29 @@ func gobuildOptions(bo *options.BuildOptions) ([]build.Option, error) {
 		return nil, err
 	}
 
-	platform := bo.Platform
-	if platform == "" {
-		platform = "linux/amd64"
-
-		goos, goarch, goarm := os.Getenv("GOOS"), os.Getenv("GOARCH"), os.Getenv("GOARM")
-
-		// Default to linux/amd64 unless GOOS and GOARCH are set.
-		if goos != "" && goarch != "" {
-			platform = path.Join(goos, goarch)
-		}
+	platform, err := targetPlatform(bo)
+	if err != nil {
+		return nil, err
+	}
 
-		// Use GOARM for variant if it's set and GOARCH is arm.
-		if strings.Contains(goarch, "arm") && goarm != "" {
-			platform = path.Join(platform, "v"+goarm)
-		}
-	} else {
-		// Make sure these are all unset
-		for _, env := range []string{"GOOS", "GOARCH", "GOARM"} {
-			if s, ok := os.LookupEnv(env); ok {
-				return nil, fmt.Errorf("cannot use --platform with %s=%q", env, s)
-			}
+	if bo.ConcurrentBasePulls < 0 {
+		return nil, fmt.Errorf("--base-pull-jobs must not be negative, got %d", bo.ConcurrentBasePulls)
+	}
+	if err := checkBaseOptions(bo); err != nil {
+		return nil, err
+	}
+	getBase := getBaseImage(platform, bo)
+	if bo.BaseLock != "" {
+		getBase, err = lockedBase(getBase, bo.BaseLock, bo.UpdateBaseLock)
+		if err != nil {
+			return nil, err
 		}
+	} else if bo.UpdateBaseLock {
+		return nil, errors.New("--update-base-lock requires --base-lock")
 	}
 
 	opts := []build.Option{
-		build.WithBaseImages(getBaseImage(platform, bo)),
+		build.WithBaseImages(getBase),
 		build.WithPlatforms(platform),
 	}
 	if creationTime != nil {
@@ -98,46 +166,200 @@ func gobuildOptions(bo *options.BuildOptions) ([]build.Option, error) {
 	if bo.DisableOptimizations {
 		opts = append(opts, build.WithDisabledOptimizations())
 	}
-	for _, lf := range bo.Labels {
-		parts := strings.SplitN(lf, "=", 2)
-		if len(parts) != 2 {
-			return nil, fmt.Errorf("invalid label flag: %s", lf)
+	if bo.BinaryCollision != "" {
+		opts = append(opts, build.WithBinaryCollision(build.BinaryCollisionPolicy(bo.BinaryCollision)))
+	}
+	if bo.BasePlatformPolicy != "" {
+		opts = append(opts, build.WithBasePlatformPolicy(build.BasePlatformPolicy(bo.BasePlatformPolicy)))
+	}
+	if bo.WasmPackaging != "" {
+		opts = append(opts, build.WithWasmPackaging(build.WasmPackaging(bo.WasmPackaging)))
+	}
+	if bo.AllowMutableVersions {
+		opts = append(opts, build.WithMutableVersions(true))
+	}
+	if bo.TrimPath != nil {
+		opts = append(opts, build.WithTrimpath(*bo.TrimPath))
+	}
+	if bo.BuildVCS != "" {
+		opts = append(opts, build.WithBuildVCS(bo.BuildVCS))
+	}
+	if goBinary != "" {
+		opts = append(opts, build.WithGoBinary(goBinary))
+	}
+	if len(prebuildHook) > 0 {
+		opts = append(opts, build.WithPrebuild(prebuildHook))
+	}
+	if bo.Cgo {
+		opts = append(opts, build.WithCgo(true))
+	}
+	if env := buildEnvOverrides(bo); len(env) > 0 {
+		opts = append(opts, build.WithEnv(env))
+	}
+	if bo.SBOM != "" {
+		if bo.SBOMs == nil {
+			bo.SBOMs = build.NewSBOMs()
+		}
+		opts = append(opts, build.WithSBOM(build.SBOMFormat(bo.SBOM), bo.SBOMs))
+	}
+	if !bo.Modules.IsZero() {
+		opts = append(opts, build.WithModuleConfig(bo.Modules))
+	}
+	if len(bo.Gcflags) > 0 {
+		opts = append(opts, build.WithGcflags(bo.Gcflags))
+	}
+	if len(bo.Asmflags) > 0 {
+		opts = append(opts, build.WithAsmflags(bo.Asmflags))
+	}
+	if len(bo.GoFlags) > 0 {
+		opts = append(opts, build.WithGoFlags(bo.GoFlags))
+	}
+	if len(bo.BuildTags) > 0 {
+		opts = append(opts, build.WithTags(bo.BuildTags))
+	}
+	if len(bo.Ldflags) > 0 {
+		opts = append(opts, build.WithLdflags(bo.Ldflags))
+	}
+	if bo.BuildTimeout != 0 {
+		opts = append(opts, build.WithBuildTimeout(bo.BuildTimeout))
+	}
+	if bo.MinFreeSpace != "" {
+		min, err := build.ParseByteSize(bo.MinFreeSpace)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --min-free-space: %v", err)
+		}
+		opts = append(opts, build.WithMinFreeSpace(min))
+	}
+	if len(bo.Labels) > 0 {
+		labels := make(map[string]string, len(bo.Labels))
+		for _, lf := range bo.Labels {
+			parts := strings.SplitN(lf, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid label flag: %s", lf)
+			}
+			labels[parts[0]] = parts[1]
 		}
-		opts = append(opts, build.WithLabel(parts[0], parts[1]))
+		opts = append(opts, build.WithLabels(labels))
+	}
+	if maxBinarySize != "" {
+		opts = append(opts, build.WithMaxBinarySize(maxBinarySize))
+	}
+	if len(bo.ImageEnv) > 0 {
+		opts = append(opts, build.WithImageEnv(bo.ImageEnv))
 	}
 
 	// prefer buildConfigs from BuildOptions
+	buildConfigTracker = nil
 	if bo.BuildConfigs != nil {
 		opts = append(opts, build.WithConfig(bo.BuildConfigs))
 	} else if len(buildConfigs) > 0 {
-		opts = append(opts, build.WithConfig(buildConfigs))
+		// Track which entries we use, so that we can warn about those that
+		// don't apply to anything we build, see warnUnusedBuildConfigs.
+		buildConfigTracker = build.NewConfigTracker(buildConfigs)
+		opts = append(opts, build.WithConfigResolver(buildConfigTracker.Resolve))
 	}
 
 	return opts, nil
 }
 
+// buildEnvOverrides returns the environment to set for every build, from
+// .ko.yaml and then --set-env, so that the flag wins.
+func buildEnvOverrides(bo *options.BuildOptions) []string {
+	return append(append([]string(nil), buildEnvironment...), bo.Env...)
+}
+
+// concurrentBuilds returns the number of builds to run at once: jobs if it
+// was set with --jobs, otherwise KO_CONCURRENT_BUILDS, otherwise GOMAXPROCS.
+// Since zero or fewer builds would never finish, it is at least 1. Only a
+// value from the environment is logged, since it isn't on the command line.
+func concurrentBuilds(jobs int) (int, error) {
+	source := "--jobs"
+	if jobs == 0 {
+		jobs, source = runtime.GOMAXPROCS(0), "GOMAXPROCS"
+		if env := os.Getenv("KO_CONCURRENT_BUILDS"); env != "" {
+			n, err := strconv.Atoi(env)
+			if err != nil {
+				return 0, fmt.Errorf("the environment variable KO_CONCURRENT_BUILDS should be a number of builds, got: %v", err)
+			}
+			jobs, source = n, "KO_CONCURRENT_BUILDS"
+		}
+	}
+	if jobs < 1 {
+		warnings.Warnf(warnings.Concurrency, "%s is %d, running 1 build at a time", source, jobs)
+		return 1, nil
+	}
+	if source == "KO_CONCURRENT_BUILDS" {
+		log.Printf("Running at most %d builds at a time (from KO_CONCURRENT_BUILDS)", jobs)
+	}
+	return jobs, nil
+}
+
+// shareSBOMs makes the publisher created from po attach the SBOMs that the
+// builder created from bo generates for --sbom.
+func shareSBOMs(bo *options.BuildOptions, po *options.PublishOptions) {
+	if bo.SBOM == "" {
+		return
+	}
+	if bo.SBOMs == nil {
+		bo.SBOMs = build.NewSBOMs()
+	}
+	po.SBOMs = bo.SBOMs
+}
+
 // NewBuilder creates a ko builder
 func NewBuilder(ctx context.Context, bo *options.BuildOptions) (build.Interface, error) {
 	return makeBuilder(ctx, bo)
 }
 
 func makeBuilder(ctx context.Context, bo *options.BuildOptions) (*build.Caching, error) {
+	builder, _, err := makeListingBuilder(ctx, bo)
+	return builder, err
+}
+
+// makeListingBuilder is makeBuilder, and also returns the go builder it
+// wraps as a PackageLister, for --changed-since.
+func makeListingBuilder(ctx context.Context, bo *options.BuildOptions) (*build.Caching, build.PackageLister, error) {
 	if err := loadConfig(bo.WorkingDirectory); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	opt, err := gobuildOptions(bo)
 	if err != nil {
-		return nil, fmt.Errorf("error setting up builder options: %v", err)
+		return nil, nil, fmt.Errorf("error setting up builder options: %v", err)
+	}
+	progress, err := buildProgress(bo.Progress)
+	if err != nil {
+		return nil, nil, err
+	}
+	if progress != nil {
+		opt = append(opt, build.WithProgress(progress))
 	}
 	innerBuilder, err := build.NewGo(ctx, bo.WorkingDirectory, opt...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	lister, _ := innerBuilder.(build.PackageLister)
+	if dir := cacheDir(); dir != "" && !bo.NoCacheBuild {
+		if innerBuilder, err = build.NewDiskCache(innerBuilder, filepath.Join(dir, "builds")); err != nil {
+			return nil, nil, err
+		}
+	}
+	if bo.RestrictImports {
+		if len(allowedImportPaths) == 0 {
+			return nil, nil, errors.New("--restrict-imports needs allowedImportPaths in .ko.yaml")
+		}
+		if innerBuilder, err = build.NewRestricted(innerBuilder, allowedImportPaths); err != nil {
+			return nil, nil, err
+		}
 	}
 
-	if bo.ConcurrentBuilds == 0 {
-		bo.ConcurrentBuilds = runtime.GOMAXPROCS(0)
+	bo.ConcurrentBuilds, err = concurrentBuilds(bo.ConcurrentBuilds)
+	if err != nil {
+		return nil, nil, err
 	}
-	innerBuilder = build.NewLimiter(innerBuilder, bo.ConcurrentBuilds)
+	// Trace inside the limiter, so that spans don't include waiting for it.
+	limiter := build.NewLimiter(build.NewTraced(innerBuilder), bo.ConcurrentBuilds)
+	limiter.Progress = progress
+	innerBuilder = limiter
 
 	// tl;dr Wrap builder in a caching builder.
 	//
@@ -155,7 +377,21 @@ func makeBuilder(ctx context.Context, bo *options.BuildOptions) (*build.Caching,
 	//    we can elide subsequent builds by blocking on the same image future.
 	// 2. When an affected yaml file has multiple import paths (mostly unaffected)
 	//    we can elide the builds of unchanged import paths.
-	return build.NewCaching(innerBuilder)
+	builder, err := build.NewCaching(innerBuilder)
+	return builder, lister, err
+}
+
+// buildProgress returns how to report the steps of builds for --progress,
+// or nil to not report them.
+func buildProgress(mode string) (build.Progress, error) {
+	switch mode {
+	case "", "plain":
+		return build.NewPlainProgress(os.Stderr), nil
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("invalid --progress %q, expected plain or none", mode)
+	}
 }
 
 // NewPublisher creates a ko publisher
@@ -163,104 +399,294 @@ func NewPublisher(po *options.PublishOptions) (publish.Interface, error) {
 	return makePublisher(po)
 }
 
+// Pushes that fail with errors that may be transient (e.g. 429 or 5xx) are
+// retried this many times, after about 1s, 2s and 4s.
+const (
+	pushRetries      = 3
+	pushRetryBackoff = time.Second
+
+	// daemonPingTimeout limits how long we wait to learn whether the
+	// local docker daemon is reachable.
+	daemonPingTimeout = 10 * time.Second
+)
+
 func makePublisher(po *options.PublishOptions) (publish.Interface, error) {
+	if err := options.CheckNameSanitization(po.NameSanitization); err != nil {
+		return nil, err
+	}
 	// Create the publish.Interface that we will use to publish image references
 	// to either a docker daemon or a container image registry.
 	innerPublisher, err := func() (publish.Interface, error) {
-		repoName := po.DockerRepo
-		namer := options.MakeNamer(po)
-		if repoName == publish.LocalDomain || po.Local {
-			// TODO(jonjohnsonjr): I'm assuming that nobody will
-			// use local with other publishers, but that might
-			// not be true.
-			return publish.NewDaemon(namer, po.Tags,
-				publish.WithDockerClient(po.DockerClient),
-				publish.WithLocalDomain(po.LocalDomain),
-			)
+		tags, err := publishTags(po)
+		if err != nil {
+			return nil, err
 		}
-		if repoName == publish.KindDomain {
-			return publish.NewKindPublisher(namer, po.Tags), nil
+		sign, err := signer(po)
+		if err != nil {
+			return nil, err
 		}
-
-		if repoName == "" {
-			return nil, errors.New("KO_DOCKER_REPO environment variable is unset")
+		// A single limiter, so that the rate is shared by the publishers
+		// of all the repositories.
+		var limiter *publish.RateLimiter
+		if po.RequestsPerSecond != 0 {
+			if limiter, err = publish.NewRateLimiter(po.RequestsPerSecond); err != nil {
+				return nil, err
+			}
+		}
+		mappings := repoMappings(po)
+		if len(mappings) == 0 {
+			return makeRepoPublisher(po, tags, sign, limiter)
+		}
+		if po.TarballFile != "" {
+			return nil, errors.New("dockerRepos can't be used with --tarball, which holds a single repository")
+		}
+		// Importpaths that don't match a mapping go to KO_DOCKER_REPO, if
+		// it's set.
+		var fallback publish.Interface
+		if po.DockerRepo != "" {
+			if fallback, err = makeRepoPublisher(po, tags, sign, limiter); err != nil {
+				return nil, err
+			}
 		}
-		if _, err := name.NewRegistry(repoName); err != nil {
-			if _, err := name.NewRepository(repoName); err != nil {
-				return nil, fmt.Errorf("failed to parse %q as repository: %v", repoName, err)
+		routes := make([]publish.Route, 0, len(mappings))
+		for _, m := range mappings {
+			pub, err := makeRepoPublisher(po.ForMapping(m), tags, sign, limiter)
+			if err != nil {
+				return nil, fmt.Errorf("dockerRepos %s: %v", m.Prefix, err)
 			}
+			routes = append(routes, publish.Route{Prefix: m.Prefix, Publisher: pub})
 		}
+		return publish.NewRouter(fallback, routes...), nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	if po.TektonResultsDir != "" {
+		innerPublisher, err = publish.NewTektonResults(po.TektonResultsDir, innerPublisher)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Tekton results in %q: %v", po.TektonResultsDir, err)
+		}
+	}
+
+	if po.GitHubOutput {
+		outputFile, _ := lookupEnv("GITHUB_OUTPUT")
+		summaryFile, _ := lookupEnv("GITHUB_STEP_SUMMARY")
+		if outputFile != "" || summaryFile != "" {
+			innerPublisher = publish.NewGitHubActions(innerPublisher, outputFile, summaryFile)
+		}
+	}
 
-		publishers := []publish.Interface{}
-		if po.OCILayoutPath != "" {
+	// Wrap publisher in a memoizing publisher implementation.
+	return publish.NewCaching(publish.NewTraced(innerPublisher))
+}
+
+// repoMappings returns the dockerRepos mappings to publish with, from po or
+// else .ko.yaml. Publishing to a local daemon ignores them.
+func repoMappings(po *options.PublishOptions) []options.DockerRepoMapping {
+	if po.Local || po.DockerRepo == publish.LocalDomain {
+		return nil
+	}
+	if po.DockerRepoMappings != nil {
+		return po.DockerRepoMappings
+	}
+	return dockerRepoMappings
+}
+
+// makeRepoPublisher returns the publisher for images named after
+// po.DockerRepo. Images pushed to a registry are signed with sign, if set,
+// and the rate of requests to it is limited by limiter, if set.
+func makeRepoPublisher(po *options.PublishOptions, tags []string, sign publish.PostPublish, limiter *publish.RateLimiter) (publish.Interface, error) {
+	if f, ok, err := sentinelFactory(po); err != nil {
+		return nil, err
+	} else if ok {
+		return f(po, tags)
+	}
+
+	repoName := po.DockerRepo
+	namer := options.MakeNamer(po)
+	if repoName == "" {
+		return nil, errors.New("KO_DOCKER_REPO environment variable is unset")
+	}
+	if _, err := name.NewRegistry(repoName); err != nil {
+		if _, err := name.NewRepository(repoName); err != nil {
+			return nil, fmt.Errorf("failed to parse %q as repository: %v", repoName, err)
+		}
+	}
+
+	// Validate --publisher-order and --yaml-ref-source before anything is
+	// created.
+	active := []string{}
+	if po.OCILayoutPath != "" {
+		active = append(active, options.YAMLRefLayout)
+	}
+	if po.TarballFile != "" {
+		active = append(active, options.YAMLRefTarball)
+	}
+	if po.Push {
+		active = append(active, options.YAMLRefRegistry)
+	}
+	active, err := orderPublishers(po.PublisherOrder, active)
+	if err != nil {
+		return nil, err
+	}
+	authority, err := yamlRefAuthority(po.YAMLRefSource, active)
+	if err != nil {
+		return nil, err
+	}
+
+	style := publish.ResolveStyle(po.ResolveStyle)
+	if po.TagOnly {
+		if style != "" && style != publish.ResolveTag {
+			return nil, fmt.Errorf("--tag-only can't be used with --resolve-style=%s", style)
+		}
+		style = publish.ResolveTag
+	}
+
+	publishers := make([]publish.Interface, 0, len(active))
+	for _, a := range active {
+		switch a {
+		case options.YAMLRefLayout:
 			lp, err := publish.NewLayout(po.OCILayoutPath)
 			if err != nil {
 				return nil, fmt.Errorf("failed to create LayoutPublisher for %q: %v", po.OCILayoutPath, err)
 			}
 			publishers = append(publishers, lp)
-		}
-		if po.TarballFile != "" {
-			tp := publish.NewTarball(po.TarballFile, repoName, namer, po.Tags)
+		case options.YAMLRefTarball:
+			tp := publish.NewTarball(po.TarballFile, repoName, namer, tags)
 			publishers = append(publishers, tp)
-		}
-		userAgent := ua()
-		if po.UserAgent != "" {
-			userAgent = po.UserAgent
-		}
-		if po.Push {
+		case options.YAMLRefRegistry:
+			userAgent := ua()
+			if po.UserAgent != "" {
+				userAgent = po.UserAgent
+			}
+			auth := publish.WithAuthFromKeychain(authn.DefaultKeychain)
+			if po.RegistryTokenFile != "" {
+				auth = publish.WithAuthFromTokenFile(po.RegistryTokenFile)
+			}
 			dp, err := publish.NewDefault(repoName,
 				publish.WithUserAgent(userAgent),
-				publish.WithAuthFromKeychain(authn.DefaultKeychain),
+				auth,
 				publish.WithNamer(namer),
-				publish.WithTags(po.Tags),
-				publish.WithTagOnly(po.TagOnly),
+				publish.WithTags(tags),
+				publish.WithResolveStyle(style),
+				publish.WithRetry(pushRetries, pushRetryBackoff),
+				publish.WithPostPublish(sign),
+				publish.WithRateLimiter(limiter),
+				publish.WithSBOMs(po.SBOMs),
 				publish.Insecure(po.InsecureRegistry))
 			if err != nil {
 				return nil, err
 			}
 			publishers = append(publishers, dp)
 		}
+	}
 
-		// If not publishing, at least generate a digest to simulate
-		// publishing.
-		if len(publishers) == 0 {
-			publishers = append(publishers, nopPublisher{
-				repoName: repoName,
-				namer:    namer,
-			})
+	// If not publishing, at least generate a digest to simulate
+	// publishing.
+	if len(publishers) == 0 {
+		op, err := publish.NewOffline(repoName, namer)
+		if err != nil {
+			return nil, err
 		}
-
-		return publish.MultiPublisher(publishers...), nil
-	}()
-	if err != nil {
-		return nil, err
+		return publish.MultiPublisher(op), nil
 	}
 
-	// Wrap publisher in a memoizing publisher implementation.
-	return publish.NewCaching(innerPublisher)
+	return publish.MultiPublisherWithAuthority(authority, publishers...)
 }
 
-// nopPublisher simulates publishing without actually publishing anything, to
-// provide fallback behavior when the user configures no push destinations.
-type nopPublisher struct {
-	repoName string
-	namer    publish.Namer
+// orderPublishers returns the active publishers (by their --yaml-ref-source
+// names) in the order to publish in: those in order first, in that order,
+// then the rest as they are.
+func orderPublishers(order, active []string) ([]string, error) {
+	isActive := map[string]bool{}
+	for _, a := range active {
+		isActive[a] = true
+	}
+	seen := map[string]bool{}
+	ordered := make([]string, 0, len(active))
+	for _, o := range order {
+		switch o {
+		case options.YAMLRefLayout, options.YAMLRefTarball, options.YAMLRefRegistry:
+		default:
+			return nil, fmt.Errorf("unknown --publisher-order %q, expected %s, %s or %s", o,
+				options.YAMLRefLayout, options.YAMLRefTarball, options.YAMLRefRegistry)
+		}
+		if seen[o] {
+			return nil, fmt.Errorf("--publisher-order lists %s more than once", o)
+		}
+		seen[o] = true
+		// Publishers that aren't in use are skipped, so that the order can
+		// be set once, e.g. in CI, whatever is published.
+		if isActive[o] {
+			ordered = append(ordered, o)
+		}
+	}
+	for _, a := range active {
+		if !seen[a] {
+			ordered = append(ordered, a)
+		}
+	}
+	return ordered, nil
 }
 
-func (n nopPublisher) Publish(_ context.Context, br build.Result, s string) (name.Reference, error) {
-	s = strings.TrimPrefix(s, build.StrictScheme)
-	h, err := br.Digest()
-	if err != nil {
-		return nil, err
+// yamlRefAuthority returns the index in active, the names of the publishers
+// in use in the order they publish, of the one whose references are resolved
+// into YAML: source if set, otherwise the registry if pushing, otherwise the
+// last one. It fails if source isn't in use.
+func yamlRefAuthority(source string, active []string) (int, error) {
+	switch source {
+	case "", options.YAMLRefRegistry, options.YAMLRefLayout, options.YAMLRefTarball, options.YAMLRefDaemon:
+	default:
+		return -1, fmt.Errorf("unknown --yaml-ref-source %q, expected %s, %s, %s or %s", source,
+			options.YAMLRefRegistry, options.YAMLRefLayout, options.YAMLRefTarball, options.YAMLRefDaemon)
+	}
+	if source == "" {
+		if len(active) == 0 {
+			return -1, nil
+		}
+		source = active[len(active)-1]
+		for _, a := range active {
+			if a == options.YAMLRefRegistry {
+				source = a
+			}
+		}
+	}
+	for i, a := range active {
+		if a == source {
+			return i, nil
+		}
 	}
-	return name.NewDigest(fmt.Sprintf("%s@%s", n.namer(n.repoName, s), h))
+	return -1, fmt.Errorf("--yaml-ref-source=%s, but only %v are publishing", source, active)
 }
 
-func (n nopPublisher) Close() error { return nil }
+// nopWriteCloser wraps an io.Writer so that Close is a no-op, e.g. to keep
+// stdout open after resolveFilesToWriter returns.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// fileError is an error processing the input file.
+type fileError struct {
+	file string
+	err  error
+}
+
+func (e *fileError) Error() string {
+	return fmt.Sprintf("error processing import paths in %q: %v", e.file, e.err)
+}
+
+func (e *fileError) Unwrap() error { return e.err }
 
 // resolvedFuture represents a "future" for the bytes of a resolved file.
 type resolvedFuture chan []byte
 
+// outputFactory returns where to write the resolved documents of the input
+// file inputPath.
+type outputFactory func(inputPath string) (io.WriteCloser, error)
+
 func resolveFilesToWriter(
 	ctx context.Context,
 	builder *build.Caching,
@@ -269,46 +695,160 @@ func resolveFilesToWriter(
 	so *options.SelectorOptions,
 	out io.WriteCloser) error {
 	defer out.Close()
+	// Documents are written by the queue's goroutine, so that each is
+	// written whole and in order, however the resolutions race.
+	q := newOutputQueue(out, fo.FlushPerDocument)
+	defer q.Close()
+	if err := resolveFiles(ctx, builder, publisher, fo, so, q, nil); err != nil {
+		return err
+	}
+	warnUnusedBuildConfigs()
+	return nil
+}
+
+// resolveFilesToWriters is like resolveFilesToWriter, but writes the
+// documents of each file to its own output, from newOutput, rather than
+// concatenating them. Files are written as soon as they're resolved,
+// concurrently, but the outputs of each file (with --watch, one for each
+// time it's resolved) are written in the order they were resolved in.
+func resolveFilesToWriters(
+	ctx context.Context,
+	builder *build.Caching,
+	publisher publish.Interface,
+	fo *options.FilenameOptions,
+	so *options.SelectorOptions,
+	newOutput outputFactory) error {
+	if fo.Merge {
+		return errors.New("--merge resolves the files as one, so it can't write their outputs separately")
+	}
+	if err := resolveFiles(ctx, builder, publisher, fo, so, nil, newOutput); err != nil {
+		return err
+	}
+	warnUnusedBuildConfigs()
+	return nil
+}
+
+// resolveFiles resolves the files of fo, and writes their documents to q,
+// in order, or else to the outputs from newOutput. Unlike its callers, it
+// doesn't warn about 'builds' entries that weren't used, since it also
+// resolves the files without building anything, see warmImportPaths.
+func resolveFiles(
+	ctx context.Context,
+	builder *build.Caching,
+	publisher publish.Interface,
+	fo *options.FilenameOptions,
+	so *options.SelectorOptions,
+	q *outputQueue,
+	newOutput outputFactory) error {
+	if fo.Merge && fo.Watch {
+		return errors.New("--merge can't be used with --watch")
+	}
+	if err := readStdin(fo); err != nil {
+		return err
+	}
+	if err := preflight(ctx, builder, fo, so); err != nil {
+		return err
+	}
 
 	// By having this as a channel, we can hook this up to a filesystem
 	// watcher and leave `fs` open to stream the names of yaml files
 	// affected by code changes (including the modification of existing or
 	// creation of new yaml files).
 	fs := options.EnumerateFiles(fo)
+	// files is where files to resolve again are sent, since fs is dropped
+	// once it's drained, which with --watch it never is.
+	files := fs
+	// With --watch, a file being resolved isn't resolved again at once,
+	// but once it's done.
+	rebuilds := newRebuildQueue()
 
 	// This tracks filename -> []importpath
 	var sm sync.Map
 
 	var g graph.Interface
+	var kodata *kodataWatcher
 	var errCh chan error
-	var err error
 	if fo.Watch {
 		// Start a dep-notify process that on notifications scans the
 		// file-to-recorded-build map and for each affected file resends
 		// the filename along the channel.
-		g, errCh, err = graph.New(func(ss graph.StringSet) {
-			sm.Range(func(k, v interface{}) bool {
-				key := k.(string)
-				value := v.([]string)
-
-				for _, ip := range value {
-					// dep-notify doesn't understand the ko:// prefix
-					ip := strings.TrimPrefix(ip, build.StrictScheme)
-					if ss.Has(ip) {
-						// See the comment above about how "builder" works.
-						// Always use ko:// for the builder.
-						builder.Invalidate(build.StrictScheme + ip)
-						fs <- key
-					}
-				}
-				return true
-			})
+		// Changes are batched until they settle, so that a generator
+		// rewriting many files triggers a single rebuild.
+		notify := func(f string) { files <- f }
+		settler := newWatchSettler(fo.WatchSettle, func(ss graph.StringSet) {
+			invalidateAffected(&sm, ss, builder.Invalidate, notify)
 		})
+		defer settler.stop()
+		dg, dgErrCh, err := graph.New(settler.notify)
 		if err != nil {
 			return fmt.Errorf("creating dep-notify graph: %v", err)
 		}
 		// Cleanup the fsnotify hooks when we're done.
-		defer g.Shutdown()
+		defer dg.Shutdown()
+		wg, err := newWatchGraph(dg)
+		if err != nil {
+			return fmt.Errorf("creating dep-notify graph: %v", err)
+		}
+		g, errCh = wg, dgErrCh
+
+		// dep-notify only watches Go files, so watch kodata too. Changes
+		// there reuse the binaries already built and pushed.
+		dataSettler := newWatchSettler(fo.WatchSettle, func(ss graph.StringSet) {
+			invalidateAffected(&sm, ss, builder.InvalidateData, notify)
+		})
+		defer dataSettler.stop()
+		kw, err := newKoDataWatcher(dataSettler.notify)
+		if err != nil {
+			return fmt.Errorf("watching kodata: %v", err)
+		}
+		defer kw.Close()
+		kwDone := make(chan struct{})
+		defer close(kwDone)
+		go kw.run(errCh, kwDone)
+		kodata = kw
+
+		// Dump what is watched on SIGUSR1, to debug rebuilds.
+		dumps := make(chan os.Signal, 1)
+		notifyWatchDump(dumps)
+		defer signal.Stop(dumps)
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			for {
+				select {
+				case <-dumps:
+					if err := writeWatchDump(wg, &sm, fo.WatchDump); err != nil {
+						log.Printf("dumping the watch graph: %v", err)
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	var outputRec *buildOutputRecorder
+	if fo.BuildOutput != "" {
+		outputRec = newBuildOutputRecorder(publisher)
+		outputRec.platform = fo.BuildPlatform
+		publisher = outputRec
+	}
+
+	// With --merge, the files are resolved as one, once they've all been
+	// enumerated and merged.
+	var merged []byte
+	if fo.Merge {
+		var files []string
+		for f := range fs {
+			files = append(files, f)
+		}
+		var err error
+		if merged, err = mergeFiles(files, fo); err != nil {
+			return fmt.Errorf("merging %s: %v", mergedName(files), err)
+		}
+		fs = make(chan string, 1)
+		fs <- mergedName(files)
+		close(fs)
 	}
 
 	// This tracks resolution errors and ensures we cancel other builds if an
@@ -316,6 +856,9 @@ func resolveFilesToWriter(
 	errs, ctx := errgroup.WithContext(ctx)
 
 	var futures []resolvedFuture
+	// With newOutput, written tracks when the last output of each file
+	// started so far is written.
+	written := map[string]chan struct{}{}
 	for {
 		// Each iteration, if there is anything in the list of futures,
 		// listen to it in addition to the file enumerating channel.
@@ -341,26 +884,57 @@ func resolveFilesToWriter(
 				fs = nil
 				break
 			}
+			if fo.Watch && !rebuilds.begin(file) {
+				break
+			}
 
-			// Make a new future to use to ship the bytes back and append
-			// it to the list of futures (see comment below about ordering).
-			ch := make(resolvedFuture)
-			futures = append(futures, ch)
+			var ch resolvedFuture
+			var prev, done chan struct{}
+			if newOutput == nil {
+				// Make a new future to use to ship the bytes back and append
+				// it to the list of futures (see comment below about ordering).
+				ch = make(resolvedFuture)
+				futures = append(futures, ch)
+			} else {
+				// Write the file's output once its previous output is
+				// written, so that the latest resolution wins.
+				prev, done = written[file], make(chan struct{})
+				written[file] = done
+			}
 
 			// Kick off the resolution that will respond with its bytes on
-			// the future.
+			// the future, or write them.
 			f := file // defensive copy
 			errs.Go(func() error {
-				defer close(ch)
+				if ch != nil {
+					defer close(ch)
+				} else {
+					defer close(done)
+				}
+				if fo.Watch {
+					defer func() {
+						if rebuilds.end(f) {
+							go func() { files <- f }()
+						}
+					}()
+				}
 				// Record the builds we do via this builder.
 				recordingBuilder := &build.Recorder{
 					Builder: builder,
 				}
-				b, err := resolveFile(ctx, f, recordingBuilder, publisher, so)
+				ctx, span := trace.Start(ctx, "resolve-file", trace.String("ko.file", f))
+				var b []byte
+				var err error
+				if merged != nil {
+					b, err = resolveDocuments(ctx, f, merged, recordingBuilder, publisher, fo, so)
+				} else {
+					b, err = resolveFile(ctx, f, recordingBuilder, publisher, fo, so)
+				}
+				span.End(err)
 				if err != nil {
 					// This error is sometimes expected during watch mode, so this
 					// isn't fatal. Just print it and keep the watch open.
-					err := fmt.Errorf("error processing import paths in %q: %v", f, err)
+					err := &fileError{file: f, err: err}
 					if fo.Watch {
 						log.Print(err)
 						return nil
@@ -369,12 +943,18 @@ func resolveFilesToWriter(
 				}
 				// Associate with this file the collection of binary import paths.
 				sm.Store(f, recordingBuilder.ImportPaths)
-				ch <- b
+				if ch != nil {
+					ch <- b
+				} else if err := writeFileOutput(newOutput, f, b, prev); err != nil {
+					err := &fileError{file: f, err: err}
+					if fo.Watch {
+						log.Print(err)
+						return nil
+					}
+					return err
+				}
 				if fo.Watch {
-					for _, ip := range recordingBuilder.ImportPaths {
-						// dep-notify doesn't understand the ko:// prefix
-						ip := strings.TrimPrefix(ip, build.StrictScheme)
-
+					for _, ip := range watchedImportPaths(recordingBuilder.ImportPaths) {
 						// Technically we never remove binary targets from the graph,
 						// which will increase our graph's watch load, but the
 						// notifications that they change will result in no affected
@@ -385,6 +965,11 @@ func resolveFilesToWriter(
 							errCh <- err
 							return err
 						}
+						if err := kodata.Add(ip); err != nil {
+							err := fmt.Errorf("watching the kodata of importpath %q: %v", ip, err)
+							errCh <- err
+							return err
+						}
 					}
 				}
 				return nil
@@ -400,7 +985,9 @@ func resolveFilesToWriter(
 				// We write the delimeter LAST so that when streamed to
 				// kubectl it knows that the resource is complete and may
 				// be applied.
-				out.Write(append(b, []byte("\n---\n")...))
+				if _, err := q.Write(append(b, []byte("\n---\n")...)); err != nil {
+					return fmt.Errorf("writing output: %v", err)
+				}
 			}
 
 		case err := <-errCh:
@@ -410,7 +997,115 @@ func resolveFilesToWriter(
 
 	// Make sure we exit with an error.
 	// See https://github.com/google/ko/issues/84
-	return errs.Wait()
+	if err := errs.Wait(); err != nil {
+		return err
+	}
+	if q != nil {
+		if err := q.Close(); err != nil {
+			return fmt.Errorf("writing output: %v", err)
+		}
+	}
+	if outputRec != nil {
+		if err := outputRec.write(fo.BuildOutput); err != nil {
+			return fmt.Errorf("writing --build-output: %v", err)
+		}
+	}
+	return nil
+}
+
+// writeFileOutput writes b, the resolved documents of f, to its output from
+// newOutput, once prev, the output of its previous resolution, if any, is
+// written.
+func writeFileOutput(newOutput outputFactory, f string, b []byte, prev <-chan struct{}) error {
+	if prev != nil {
+		<-prev
+	}
+	w, err := newOutput(f)
+	if err != nil {
+		return fmt.Errorf("writing output: %v", err)
+	}
+	if _, err := w.Write(b); err != nil {
+		discardOutput(w)
+		return fmt.Errorf("writing output: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("writing output: %v", err)
+	}
+	return nil
+}
+
+// watchedImportPaths returns the importpaths that dep-notify should watch to
+// rebuild the given references, expanding combined images into their
+// importpaths, and skipping external importpaths, which are pinned to a
+// version. dep-notify doesn't understand the ko:// prefix, so it is removed.
+func watchedImportPaths(refs []string) []string {
+	var ips []string
+	for _, ref := range refs {
+		multi, ok := build.MultiImportPaths(ref)
+		if !ok {
+			multi = []string{strings.TrimPrefix(ref, build.StrictScheme)}
+		}
+		for _, ip := range multi {
+			if _, _, ok := build.ExternalImportPath(ip); !ok {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips
+}
+
+// invalidateAffected takes sm, which maps filenames to the references they
+// were resolved with, and the importpaths ss that changed. It invalidates the
+// builds of the affected references with invalidate, e.g.
+// build.Caching.Invalidate, and calls notify with each file that needs to be
+// resolved again.
+func invalidateAffected(sm *sync.Map, ss graph.StringSet, invalidate func(string), notify func(string)) {
+	sm.Range(func(k, v interface{}) bool {
+		key := k.(string)
+		value := v.([]string)
+
+		affected := false
+		for _, ref := range value {
+			for _, ip := range watchedImportPaths([]string{ref}) {
+				if ss.Has(ip) {
+					// See the comment above about how "builder" works.
+					// Always use ko:// for the builder.
+					invalidate(build.StrictScheme + strings.TrimPrefix(ref, build.StrictScheme))
+					affected = true
+					break
+				}
+			}
+		}
+		if affected {
+			notify(key)
+		}
+		return true
+	})
+}
+
+// parseSelectors returns the selector that selectors and match ask for, or
+// nil to select every object.
+func parseSelectors(selectors []string, match string) (resolve.Selector, error) {
+	var set resolve.SelectorSet
+	switch match {
+	case "", "any":
+	case "all":
+		set.MatchAll = true
+	default:
+		return nil, fmt.Errorf("invalid --selector-match %q: must be any or all", match)
+	}
+	for _, s := range selectors {
+		selector, err := labels.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse selector: %v", err)
+		}
+		set.Selectors = append(set.Selectors, selector)
+	}
+	if set.Empty() {
+		// Every object is selected, so documents needn't be objects.
+		return nil, nil
+	}
+	return set, nil
 }
 
 func resolveFile(
@@ -418,69 +1113,388 @@ func resolveFile(
 	f string,
 	builder build.Interface,
 	pub publish.Interface,
-	so *options.SelectorOptions) (b []byte, err error) {
+	fo *options.FilenameOptions,
+	so *options.SelectorOptions) ([]byte, error) {
+	b, err := readInput(f, fo)
+	if err != nil {
+		return nil, err
+	}
+	return resolveDocuments(ctx, f, b, builder, pub, fo, so)
+}
 
-	var selector labels.Selector
-	if so.Selector != "" {
-		var err error
-		selector, err = labels.Parse(so.Selector)
+// readStdin reads stdin into fo.Stdin, if one of the files of fo is "-" and
+// it hasn't been read yet, since it can only be read once but is resolved
+// by preflight, and then again for real.
+func readStdin(fo *options.FilenameOptions) error {
+	if fo.Stdin != nil || !readsStdin(fo) {
+		return nil
+	}
+	b, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("reading stdin: %v", err)
+	}
+	fo.Stdin = b
+	return nil
+}
 
-		if err != nil {
-			return nil, fmt.Errorf("unable to parse selector: %v", err)
-		}
+// readInput reads the file f, or stdin if f is "-", from fo.Stdin if it was
+// read already.
+func readInput(f string, fo *options.FilenameOptions) ([]byte, error) {
+	if f != "-" {
+		return ioutil.ReadFile(f)
 	}
+	if fo.Stdin != nil {
+		return append([]byte(nil), fo.Stdin...), nil
+	}
+	return ioutil.ReadAll(os.Stdin)
+}
 
-	if f == "-" {
-		b, err = ioutil.ReadAll(os.Stdin)
-	} else {
-		b, err = ioutil.ReadFile(f)
+// resolveDocuments resolves the documents b, read from f.
+func resolveDocuments(
+	ctx context.Context,
+	f string,
+	b []byte,
+	builder build.Interface,
+	pub publish.Interface,
+	fo *options.FilenameOptions,
+	so *options.SelectorOptions) ([]byte, error) {
+
+	selector, err := parseSelectors(so.Selectors, so.SelectorMatch)
+	if err != nil {
+		return nil, err
 	}
+	annotationSelector, err := parseSelectors(so.AnnotationSelectors, so.SelectorMatch)
 	if err != nil {
 		return nil, err
 	}
 
+	if fo.MaxDocumentBytes > 0 {
+		if err := checkDocumentSizes(f, b, fo.MaxDocumentBytes); err != nil {
+			return nil, err
+		}
+	}
+
+	// docNodes are the documents to resolve, and docs everything to write
+	// out, in order: docNodes, and comment-only documents kept verbatim.
 	var docNodes []*yaml.Node
+	var docs []outputDocument
+	asJSON := isJSON(f, b)
 
-	// The loop is to support multi-document yaml files.
-	// This is handled by using a yaml.Decoder and reading objects until io.EOF, see:
+	// Each document is decoded on its own, so that empty and comment-only
+	// documents can be told apart from the rest, and dropped (or kept
+	// verbatim) rather than attached to their neighbors or written as null.
+	// The inner loop is for a document with "..." end markers, which a
+	// yaml.Decoder reads as several; see:
 	// https://godoc.org/gopkg.in/yaml.v3#Decoder.Decode
-	decoder := yaml.NewDecoder(bytes.NewBuffer(b))
-	for {
-		var doc yaml.Node
-		if err := decoder.Decode(&doc); err != nil {
-			if err == io.EOF {
-				break
+	line := 0
+	for _, raw := range splitDocuments(b) {
+		// Lines are numbered within each document, so offset them to
+		// number them within the file, for errors.
+		offset := line
+		line += bytes.Count(raw, []byte("\n"))
+		if !hasContent(raw) {
+			if fo.KeepCommentDocuments && hasComments(raw) {
+				docs = append(docs, outputDocument{raw: raw})
 			}
-			return nil, err
+			continue
 		}
-
-		if selector != nil {
-			if match, err := resolve.MatchesSelector(&doc, selector); err != nil {
-				return nil, fmt.Errorf("error evaluating selector: %v", err)
-			} else if !match {
+		var decoded []*yaml.Node
+		decoder := yaml.NewDecoder(bytes.NewReader(raw))
+		for {
+			var doc yaml.Node
+			if err := decoder.Decode(&doc); err != nil {
+				if err == io.EOF {
+					break
+				}
+				return nil, err
+			}
+			if isNullDocument(&doc) {
 				continue
 			}
+			offsetLines(&doc, offset)
+			decoded = append(decoded, &doc)
 		}
+		for _, doc := range decoded {
+			if selector != nil {
+				if match, err := resolve.MatchesSelector(doc, selector); err != nil {
+					return nil, fmt.Errorf("error evaluating selector: %v", err)
+				} else if !match {
+					continue
+				}
+			}
+			if annotationSelector != nil {
+				if match, err := resolve.MatchesAnnotationSelector(doc, annotationSelector); err != nil {
+					return nil, fmt.Errorf("error evaluating annotation selector: %v", err)
+				} else if !match {
+					continue
+				}
+			}
 
-		docNodes = append(docNodes, &doc)
+			out := outputDocument{node: doc, json: asJSON}
+			if len(decoded) == 1 {
+				// Keep the source, to write it back as it is but for
+				// the references resolved in it.
+				out.src, out.orig, out.offset = raw, copyNode(doc), offset
+			}
+			docNodes = append(docNodes, doc)
+			docs = append(docs, out)
+		}
+	}
 
+	if fo.DryRun {
+		// Print the documents as they are, and only discover what they
+		// reference with the (dry-run) builder and publisher.
+		buf, err := encodeDocuments(docs)
+		if err != nil {
+			return nil, err
+		}
+		if err := resolve.ImageReferences(ctx, docNodes, builder, pub, resolve.WithHelmReleaseImagePaths(fo.HelmReleaseImagePaths)); err != nil {
+			return nil, fmt.Errorf("error resolving image references: %w", err)
+		}
+		return buf, nil
 	}
 
-	if err := resolve.ImageReferences(ctx, docNodes, builder, pub); err != nil {
-		return nil, fmt.Errorf("error resolving image references: %v", err)
+	if err := resolve.ImageReferences(ctx, docNodes, builder, pub, resolve.WithHelmReleaseImagePaths(fo.HelmReleaseImagePaths)); err != nil {
+		return nil, fmt.Errorf("error resolving image references: %w", err)
 	}
 
-	buf := &bytes.Buffer{}
-	e := yaml.NewEncoder(buf)
-	e.SetIndent(2)
+	if rules := fo.Normalize.EnabledRules(); len(rules) > 0 {
+		for _, doc := range docNodes {
+			if err := resolve.Normalize(doc, rules); err != nil {
+				return nil, fmt.Errorf("error normalizing: %v", err)
+			}
+		}
+	}
 
-	for _, doc := range docNodes {
-		err := e.Encode(doc)
-		if err != nil {
+	if fo.ImagesChecksum {
+		for _, doc := range docNodes {
+			if err := resolve.AnnotateImagesChecksum(doc); err != nil {
+				return nil, fmt.Errorf("error annotating images checksum: %v", err)
+			}
+		}
+	}
+
+	// Whether the documents must be fully resolved is up to the flag,
+	// unless the path of f is configured otherwise, unless a document's
+	// annotation says otherwise.
+	fileStrict, why, err := fileStrictness(f, fo.Strict.AssertFullyResolved)
+	if err != nil {
+		return nil, err
+	}
+	if why != "flag" {
+		log.Printf("%s: fully resolved required: %t, per %s", f, fileStrict, why)
+	}
+	var unresolved []string
+	for i, doc := range docNodes {
+		strict, docWhy := fileStrict, why
+		if s, ok, err := resolve.DocumentStrictness(doc); err != nil {
+			return nil, fmt.Errorf("%s: document %d: %v", f, i, err)
+		} else if ok {
+			strict, docWhy = s, "annotation "+resolve.StrictAnnotation
+			log.Printf("%s: document %d: fully resolved required: %t, per %s", f, i, strict, docWhy)
+		}
+		if !strict {
+			continue
+		}
+		for _, field := range resolve.UnresolvedReferences(doc) {
+			unresolved = append(unresolved, fmt.Sprintf("%s: document %d: %s (strict per %s)", f, i, field, docWhy))
+		}
+	}
+	if len(unresolved) > 0 {
+		return nil, fmt.Errorf("found %d unresolved %s references:\n  %s",
+			len(unresolved), build.StrictScheme, strings.Join(unresolved, "\n  "))
+	}
+
+	return encodeDocuments(docs)
+}
+
+// outputDocument is a document to write out: either a decoded node, or the
+// raw bytes of a comment-only document, including the "---" starting it, if
+// any.
+type outputDocument struct {
+	node *yaml.Node
+	raw  []byte
+
+	// src is the source that node was decoded from, if it was the only
+	// document in it, orig a copy of node as decoded, and offset what was
+	// added to its lines. See patchDocument.
+	src    []byte
+	orig   *yaml.Node
+	offset int
+
+	// json is whether node was decoded from JSON, to encode it as JSON.
+	json bool
+}
+
+// encodeDocuments encodes docs as a multi-document yaml file.
+func encodeDocuments(docs []outputDocument) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	for i, doc := range docs {
+		if doc.raw != nil {
+			buf.Write(doc.raw)
+			if !bytes.HasSuffix(doc.raw, []byte("\n")) {
+				buf.WriteByte('\n')
+			}
+			continue
+		}
+		if doc.src != nil {
+			if b, ok := patchDocument(doc.src, doc.orig, doc.node, doc.offset); ok {
+				writePatched(buf, b, i == 0)
+				continue
+			}
+		}
+		if i > 0 {
+			buf.WriteString("---\n")
+		}
+		if doc.json {
+			b, err := encodeJSON(doc.node)
+			if err != nil {
+				return nil, fmt.Errorf("failed to encode output: %v", err)
+			}
+			buf.Write(b)
+			continue
+		}
+		e := yaml.NewEncoder(buf)
+		e.SetIndent(2)
+		if err := e.Encode(doc.node); err != nil {
 			return nil, fmt.Errorf("failed to encode output: %v", err)
 		}
+		e.Close()
 	}
-	e.Close()
 
 	return buf.Bytes(), nil
 }
+
+// writePatched writes the patched source of a document to buf, starting it
+// with a "---" separator unless it's the first, like the encoded documents.
+func writePatched(buf *bytes.Buffer, b []byte, first bool) {
+	sep := len(b)
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		sep = i + 1
+	}
+	switch hasSep := isDocumentSeparator(b[:sep]); {
+	case first && hasSep:
+		b = b[sep:]
+	case !first && !hasSep:
+		buf.WriteString("---\n")
+	}
+	buf.Write(b)
+	if !bytes.HasSuffix(b, []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+}
+
+// splitDocuments splits the multi-document yaml b before each "---"
+// separator, so that each document but the first starts with its separator.
+func splitDocuments(b []byte) [][]byte {
+	var docs [][]byte
+	start, off := 0, 0
+	for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+		if isDocumentSeparator(line) && off > start {
+			docs = append(docs, b[start:off])
+			start = off
+		}
+		off += len(line)
+	}
+	if off > start {
+		docs = append(docs, b[start:off])
+	}
+	return docs
+}
+
+// hasContent reports whether the raw document has anything but blank lines,
+// comments and its separator.
+func hasContent(raw []byte) bool {
+	for _, line := range documentLines(raw) {
+		if len(line) > 0 && line[0] != '#' {
+			return true
+		}
+	}
+	return false
+}
+
+// hasComments reports whether the raw document has any comment lines.
+func hasComments(raw []byte) bool {
+	for _, line := range documentLines(raw) {
+		if len(line) > 0 && line[0] == '#' {
+			return true
+		}
+	}
+	return false
+}
+
+// documentLines returns the trimmed lines of the raw document, without the
+// "---" that starts a separator line.
+func documentLines(raw []byte) [][]byte {
+	var lines [][]byte
+	for _, line := range bytes.SplitAfter(raw, []byte("\n")) {
+		if isDocumentSeparator(line) {
+			line = line[len("---"):]
+		}
+		lines = append(lines, bytes.TrimSpace(line))
+	}
+	return lines
+}
+
+// offsetLines adds offset to the line of n and everything within it.
+func offsetLines(n *yaml.Node, offset int) {
+	n.Line += offset
+	for _, c := range n.Content {
+		offsetLines(c, offset)
+	}
+}
+
+// isNullDocument reports whether the decoded document is empty or null,
+// which kubectl fails to unmarshal.
+func isNullDocument(doc *yaml.Node) bool {
+	if len(doc.Content) == 0 {
+		return true
+	}
+	c := doc.Content[0]
+	return c.Kind == yaml.ScalarNode && c.ShortTag() == "!!null"
+}
+
+// checkDocumentSizes returns an error if any document in the multi-document
+// yaml b is larger than max bytes. This is checked on the raw bytes, before
+// decoding, so that we never build a node tree for an oversized document.
+// Note that the file as a whole has already been read into memory.
+//
+// Documents are numbered like yaml.Decoder returns them, so a "---" that is
+// only preceded by comments or blank lines doesn't start a new document.
+func checkDocumentSizes(f string, b []byte, max int64) error {
+	var index, size int64
+	content := false
+	check := func() error {
+		if size > max {
+			return fmt.Errorf("%s: document #%d is %d bytes, which exceeds the maximum of %d bytes", f, index, size, max)
+		}
+		return nil
+	}
+	for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+		if isDocumentSeparator(line) {
+			if err := check(); err != nil {
+				return err
+			}
+			if content {
+				index++
+			}
+			content = true
+			size = 0
+			continue
+		}
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 && trimmed[0] != '#' {
+			content = true
+		}
+		size += int64(len(line))
+	}
+	return check()
+}
+
+// isDocumentSeparator reports whether the line is a yaml "---" separator.
+func isDocumentSeparator(line []byte) bool {
+	line = bytes.TrimRight(line, "\r\n")
+	if !bytes.HasPrefix(line, []byte("---")) {
+		return false
+	}
+	return len(line) == 3 || line[3] == ' ' || line[3] == '\t'
+}
@@ -19,13 +19,17 @@ package commands
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"net/http/httptest"
+	"os"
 	"path"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/docker/docker/api/types"
@@ -33,14 +37,20 @@ import (
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/google/go-containerregistry/pkg/crane"
 	"github.com/google/go-containerregistry/pkg/name"
-	"github.com/google/go-containerregistry/pkg/registry"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/daemon"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/random"
+	ggcrtypes "github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/google/ko/pkg/build"
 	"github.com/google/ko/pkg/commands/options"
 	kotesting "github.com/google/ko/pkg/internal/testing"
+	"github.com/google/ko/pkg/publish"
+	"github.com/google/ko/pkg/registrytest"
+	"github.com/google/ko/pkg/resolve"
+	"github.com/google/ko/pkg/warnings"
+	"github.com/mattmoor/dep-notify/pkg/graph"
 	"gopkg.in/yaml.v3"
 )
 
@@ -96,6 +106,7 @@ func TestResolveMultiDocumentYAMLs(t *testing.T) {
 		yamlToTmpFile(t, buf.Bytes()),
 		testBuilder,
 		kotesting.NewFixedPublish(base, testHashes),
+		&options.FilenameOptions{},
 		&options.SelectorOptions{})
 
 	if err != nil {
@@ -149,8 +160,9 @@ kind: Bar
 		yamlToTmpFile(t, inputYAML),
 		testBuilder,
 		kotesting.NewFixedPublish(base, testHashes),
+		&options.FilenameOptions{},
 		&options.SelectorOptions{
-			Selector: "qux=baz",
+			Selectors: []string{"qux=baz"},
 		})
 	if err != nil {
 		t.Fatalf("ImageReferences(%v) = %v", string(inputYAML), err)
@@ -160,6 +172,222 @@ kind: Bar
 	}
 }
 
+func TestResolveMultiDocumentYAMLsWithSelectors(t *testing.T) {
+	web := `apiVersion: v1
+kind: Pod
+metadata:
+  labels:
+    app: web
+    tier: frontend
+`
+	db := `apiVersion: v1
+kind: Pod
+metadata:
+  annotations:
+    env: prod
+  labels:
+    app: db
+`
+	unlabeled := `apiVersion: v1
+kind: Pod
+`
+	inputYAML := []byte(web + "---\n" + db + "---\n" + unlabeled)
+	base := mustRepository("gcr.io/multi-pass")
+
+	tests := []struct {
+		desc string
+		so   options.SelectorOptions
+		want string
+	}{{
+		desc: "any",
+		so:   options.SelectorOptions{Selectors: []string{"app=web", "app=db"}},
+		want: web + "---\n" + db,
+	}, {
+		desc: "all",
+		so:   options.SelectorOptions{Selectors: []string{"app in (web,db)", "tier=frontend"}, SelectorMatch: "all"},
+		want: web,
+	}, {
+		desc: "labels and annotations",
+		so:   options.SelectorOptions{Selectors: []string{"app in (web,db)"}, AnnotationSelectors: []string{"env=prod"}},
+		want: db,
+	}, {
+		desc: "any with an empty selector",
+		so:   options.SelectorOptions{Selectors: []string{"app=web", ""}},
+		want: web + "---\n" + db + "---\n" + unlabeled,
+	}}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			outputYAML, err := resolveFile(
+				context.Background(),
+				yamlToTmpFile(t, inputYAML),
+				testBuilder,
+				kotesting.NewFixedPublish(base, testHashes),
+				&options.FilenameOptions{},
+				&test.so)
+			if err != nil {
+				t.Fatalf("resolveFile() = %v", err)
+			}
+			if diff := cmp.Diff(test.want, string(outputYAML)); diff != "" {
+				t.Errorf("resolveFile (-want +got) = %v", diff)
+			}
+		})
+	}
+
+	if _, err := resolveFile(context.Background(), yamlToTmpFile(t, inputYAML), testBuilder,
+		kotesting.NewFixedPublish(base, testHashes), &options.FilenameOptions{},
+		&options.SelectorOptions{Selectors: []string{"app=web"}, SelectorMatch: "both"}); err == nil {
+		t.Error("resolveFile() with --selector-match=both = nil, wanted error")
+	}
+}
+
+func TestResolveMaxDocumentBytes(t *testing.T) {
+	small := "apiVersion: v1\nkind: ConfigMap\n"
+	big := "apiVersion: v1\nkind: ConfigMap\ndata:\n  key: " + strings.Repeat("x", 1024) + "\n"
+	inputYAML := []byte(small + "---\n" + big)
+	f := yamlToTmpFile(t, inputYAML)
+
+	fo := &options.FilenameOptions{MaxDocumentBytes: 512}
+	_, err := resolveFile(context.Background(), f, testBuilder,
+		kotesting.NewFixedPublish(mustRepository("gcr.io/multi-pass"), testHashes),
+		fo, &options.SelectorOptions{})
+	if err == nil {
+		t.Fatal("resolveFile() = nil, wanted error for oversized document")
+	}
+	if want := fmt.Sprintf("%s: document #1 is %d bytes, which exceeds the maximum of 512 bytes", f, len(big)); err.Error() != want {
+		t.Errorf("resolveFile() = %q, wanted %q", err, want)
+	}
+
+	// A leading separator doesn't start a new document.
+	f = yamlToTmpFile(t, []byte("# comment\n---\n"+small+"---\n"+big))
+	_, err = resolveFile(context.Background(), f, testBuilder,
+		kotesting.NewFixedPublish(mustRepository("gcr.io/multi-pass"), testHashes),
+		fo, &options.SelectorOptions{})
+	if want := fmt.Sprintf("%s: document #1 is %d bytes, which exceeds the maximum of 512 bytes", f, len(big)); err == nil || err.Error() != want {
+		t.Errorf("resolveFile() = %v, wanted %q", err, want)
+	}
+
+	fo.MaxDocumentBytes = int64(len(big))
+	if _, err := resolveFile(context.Background(), f, testBuilder,
+		kotesting.NewFixedPublish(mustRepository("gcr.io/multi-pass"), testHashes),
+		fo, &options.SelectorOptions{}); err != nil {
+		t.Errorf("resolveFile() = %v", err)
+	}
+}
+
+func TestResolveNormalize(t *testing.T) {
+	inputYAML := []byte(`apiVersion: v1
+kind: Pod
+metadata:
+  creationTimestamp: null
+  name: foo
+spec:
+  containers:
+  - image: ko://github.com/awesomesauce/foo
+status:
+  phase: Running
+`)
+	f := yamlToTmpFile(t, inputYAML)
+
+	fo := &options.FilenameOptions{Normalize: options.NormalizeOptions{Normalize: true}}
+	got, err := resolveFile(context.Background(), f, testBuilder,
+		kotesting.NewFixedPublish(mustRepository("gcr.io/multi-pass"), testHashes),
+		fo, &options.SelectorOptions{})
+	if err != nil {
+		t.Fatalf("resolveFile() = %v", err)
+	}
+	want := fmt.Sprintf(`apiVersion: v1
+kind: Pod
+metadata:
+  name: foo
+spec:
+  containers:
+    - image: %s
+`, kotesting.ComputeDigest(mustRepository("gcr.io/multi-pass"), fooRef, fooHash))
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("resolveFile() (-want +got): %s", diff)
+	}
+}
+
+func TestResolveImagesChecksum(t *testing.T) {
+	f := yamlToTmpFile(t, []byte(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: foo
+spec:
+  template:
+    spec:
+      containers:
+      - image: ko://github.com/awesomesauce/foo
+`))
+	defer os.Remove(f)
+
+	checksum := func(hashes map[string]v1.Hash) string {
+		got, err := resolveFile(context.Background(), f, testBuilder,
+			kotesting.NewFixedPublish(mustRepository("gcr.io/multi-pass"), hashes),
+			&options.FilenameOptions{ImagesChecksum: true}, &options.SelectorOptions{})
+		if err != nil {
+			t.Fatalf("resolveFile() = %v", err)
+		}
+		var d struct {
+			Spec struct {
+				Template struct {
+					Metadata struct {
+						Annotations map[string]string
+					}
+				}
+			}
+		}
+		if err := yaml.Unmarshal(got, &d); err != nil {
+			t.Fatalf("yaml.Unmarshal(%s) = %v", got, err)
+		}
+		sum := d.Spec.Template.Metadata.Annotations[resolve.ImagesChecksumAnnotation]
+		if sum == "" {
+			t.Fatalf("resolveFile() = %s, wanted a %s annotation", got, resolve.ImagesChecksumAnnotation)
+		}
+		return sum
+	}
+
+	first := checksum(testHashes)
+	if again := checksum(testHashes); again != first {
+		t.Errorf("checksum = %s, then %s for the same image", first, again)
+	}
+	if changed := checksum(map[string]v1.Hash{fooRef: barHash}); changed == first {
+		t.Errorf("checksum = %s for a different image", changed)
+	}
+}
+
+func TestResolveAssertFullyResolved(t *testing.T) {
+	// The second reference is embedded in an argument, where it isn't
+	// resolved.
+	inputYAML := []byte(`apiVersion: v1
+kind: Pod
+metadata:
+  name: foo
+spec:
+  containers:
+  - image: ko://github.com/awesomesauce/foo
+    args:
+    - --sidecar=ko://github.com/awesomesauce/bar
+`)
+	f := yamlToTmpFile(t, inputYAML)
+	pub := kotesting.NewFixedPublish(mustRepository("gcr.io/multi-pass"), testHashes)
+
+	if _, err := resolveFile(context.Background(), f, testBuilder, pub,
+		&options.FilenameOptions{}, &options.SelectorOptions{}); err != nil {
+		t.Fatalf("resolveFile() without --assert-fully-resolved = %v", err)
+	}
+
+	fo := &options.FilenameOptions{Strict: options.StrictOptions{AssertFullyResolved: true}}
+	_, err := resolveFile(context.Background(), f, testBuilder, pub, fo, &options.SelectorOptions{})
+	if err == nil {
+		t.Fatal("resolveFile() with --assert-fully-resolved succeeded, wanted error")
+	}
+	want := f + ": document 0: spec.containers[0].args[0]: --sidecar=ko://github.com/awesomesauce/bar"
+	if !strings.Contains(err.Error(), want) {
+		t.Errorf("resolveFile() = %v, wanted it to contain %q", err, want)
+	}
+}
+
 func TestNewBuilder(t *testing.T) {
 	namespace := "base"
 	s, err := registryServerWithImage(namespace)
@@ -167,7 +395,7 @@ func TestNewBuilder(t *testing.T) {
 		t.Fatalf("could not create test registry server: %v", err)
 	}
 	defer s.Close()
-	baseImage := fmt.Sprintf("%s/%s", s.Listener.Addr().String(), namespace)
+	baseImage := fmt.Sprintf("%s/%s", s.Host(), namespace)
 
 	tests := []struct {
 		description             string
@@ -303,21 +531,68 @@ func TestNewPublisherCanPublish(t *testing.T) {
 	}
 }
 
+func TestResolveImageIndex(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+
+	idx, err := random.Index(1024, 1, 2)
+	if err != nil {
+		t.Fatalf("random.Index() = %v", err)
+	}
+	idx = mutate.IndexMediaType(idx, ggcrtypes.OCIImageIndex)
+	idxHash, err := idx.Digest()
+	if err != nil {
+		t.Fatalf("Digest() = %v", err)
+	}
+	builder := kotesting.NewFixedBuild(map[string]build.Result{fooRef: idx})
+
+	publisher, err := NewPublisher(&options.PublishOptions{
+		DockerRepo:      reg.Host() + "/repo",
+		BaseImportPaths: true,
+		Push:            true,
+		Tags:            []string{"latest"},
+	})
+	if err != nil {
+		t.Fatalf("NewPublisher(): %v", err)
+	}
+	defer publisher.Close()
+
+	outYAML, err := resolveFile(
+		context.Background(),
+		yamlToTmpFile(t, []byte(build.StrictScheme+fooRef)),
+		builder,
+		publisher,
+		&options.FilenameOptions{},
+		&options.SelectorOptions{})
+	if err != nil {
+		t.Fatalf("resolveFile() = %v", err)
+	}
+
+	want := fmt.Sprintf("%s/repo/%s@%s", reg.Host(), path.Base(fooRef), idxHash)
+	if got := strings.TrimSpace(string(outYAML)); got != want {
+		t.Errorf("resolveFile() = %s, want %s", got, want)
+	}
+	if _, err := reg.Manifest("repo/"+path.Base(fooRef), idxHash.String()); err != nil {
+		t.Errorf("index %s was not pushed: %v", idxHash, err)
+	}
+}
+
 // registryServerWithImage starts a local registry and pushes a random image.
 // Use this to speed up tests, by not having to reach out to gcr.io for the default base image.
-// The registry uses a NOP logger to avoid spamming test logs.
-// Remember to call `defer Close()` on the returned `httptest.Server`.
-func registryServerWithImage(namespace string) (*httptest.Server, error) {
-	nopLog := log.New(ioutil.Discard, "", 0)
-	r := registry.New(registry.Logger(nopLog))
-	s := httptest.NewServer(r)
-	imageName := fmt.Sprintf("%s/%s", s.Listener.Addr().String(), namespace)
+// Remember to call `defer Close()` on the returned registry.
+func registryServerWithImage(namespace string) (*registrytest.Registry, error) {
+	r := registrytest.New()
+	imageName := fmt.Sprintf("%s/%s", r.Host(), namespace)
 	image, err := random.Image(1024, 1)
 	if err != nil {
+		r.Close()
 		return nil, fmt.Errorf("random.Image(): %v", err)
 	}
-	crane.Push(image, imageName)
-	return s, nil
+	if err := crane.Push(image, imageName); err != nil {
+		r.Close()
+		return nil, fmt.Errorf("crane.Push(): %v", err)
+	}
+	return r, nil
 }
 
 func mustRepository(s string) name.Repository {
@@ -362,3 +637,589 @@ func yamlToTmpFile(t *testing.T, yaml []byte) string {
 
 	return tmpfile.Name()
 }
+
+// countingBuilder builds foo for every reference, and counts the builds.
+type countingBuilder struct {
+	m      sync.Mutex
+	builds map[string]int
+}
+
+func (*countingBuilder) QualifyImport(ip string) (string, error) { return ip, nil }
+
+func (*countingBuilder) IsSupportedReference(string) error { return nil }
+
+func (c *countingBuilder) Build(_ context.Context, ip string) (build.Result, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.builds[ip]++
+	return foo, nil
+}
+
+func TestWatchCombinedImages(t *testing.T) {
+	multi := build.StrictScheme + build.MultiPrefix + fooRef + "," + barRef
+	other := build.StrictScheme + "github.com/awesomesauce/baz"
+
+	got := watchedImportPaths([]string{multi, other})
+	want := []string{fooRef, barRef, "github.com/awesomesauce/baz"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("watchedImportPaths() (-want +got): %s", diff)
+	}
+
+	counter := &countingBuilder{builds: map[string]int{}}
+	builder, err := build.NewCaching(counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []string{multi, other} {
+		if _, err := builder.Build(context.Background(), ref); err != nil {
+			t.Fatalf("Build(%s) = %v", ref, err)
+		}
+	}
+
+	var sm sync.Map
+	sm.Store("multi.yaml", []string{multi})
+	sm.Store("other.yaml", []string{other})
+
+	// A change to the second importpath of the combined image affects it.
+	var notified []string
+	invalidateAffected(&sm, graph.StringSet{barRef: {}}, builder.Invalidate, func(f string) {
+		notified = append(notified, f)
+	})
+	if diff := cmp.Diff([]string{"multi.yaml"}, notified); diff != "" {
+		t.Errorf("notified (-want +got): %s", diff)
+	}
+
+	for _, ref := range []string{multi, other} {
+		if _, err := builder.Build(context.Background(), ref); err != nil {
+			t.Fatalf("Build(%s) = %v", ref, err)
+		}
+	}
+	if diff := cmp.Diff(map[string]int{multi: 2, other: 1}, counter.builds); diff != "" {
+		t.Errorf("builds (-want +got): %s", diff)
+	}
+}
+
+func TestWatchExternalImportPaths(t *testing.T) {
+	external := build.StrictScheme + "example.com/tools/cmd/gen@v1.4.2"
+	multi := build.StrictScheme + build.MultiPrefix + fooRef + ",example.com/tools/cmd/gen@v1.4.2"
+
+	got := watchedImportPaths([]string{external, multi})
+	if diff := cmp.Diff([]string{fooRef}, got); diff != "" {
+		t.Errorf("watchedImportPaths() (-want +got): %s", diff)
+	}
+}
+
+// unreachableDaemon is a docker client whose daemon isn't running.
+type unreachableDaemon struct {
+	kotesting.MockDaemon
+}
+
+func (*unreachableDaemon) Ping(context.Context) (types.Ping, error) {
+	return types.Ping{}, errors.New("Cannot connect to the Docker daemon at unix:///var/run/docker.sock")
+}
+
+func TestNewPublisherDaemonUnreachable(t *testing.T) {
+	po := &options.PublishOptions{
+		Local:        true,
+		DockerClient: &unreachableDaemon{},
+	}
+	if _, err := NewPublisher(po); err == nil || !strings.Contains(err.Error(), "isn't reachable") || !strings.Contains(err.Error(), "--local-fallback-tarball") {
+		t.Fatalf("NewPublisher() = %v, wanted an error suggesting --local-fallback-tarball", err)
+	}
+
+	// With a fallback, images go to the tarball instead, named as they
+	// would be in the daemon.
+	tmp, err := ioutil.TempDir("", "ko")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	po.LocalFallbackTarball = filepath.Join(tmp, "images.tar")
+	c := &warnings.Collector{}
+	defer warnings.SetDefault(warnings.SetDefault(c))
+	pub, err := NewPublisher(po)
+	if err != nil {
+		t.Fatalf("NewPublisher() = %v", err)
+	}
+	ref, err := pub.Publish(context.Background(), empty.Image, build.StrictScheme+"github.com/google/ko/test")
+	if err != nil {
+		t.Fatalf("Publish() = %v", err)
+	}
+	if got := ref.Context().RegistryStr(); got != publish.LocalDomain {
+		t.Errorf("Publish() = %s, wanted a %s reference", ref, publish.LocalDomain)
+	}
+	if err := pub.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if _, err := os.Stat(po.LocalFallbackTarball); err != nil {
+		t.Errorf("tarball wasn't written: %v", err)
+	}
+	if ws := c.Warnings(); len(ws) != 1 || ws[0].Code != warnings.DaemonFallback {
+		t.Errorf("warnings = %v, wanted a %s warning", ws, warnings.DaemonFallback)
+	}
+}
+
+func TestNewPublisherExternalImportPath(t *testing.T) {
+	importpath := build.StrictScheme + "example.com/tools/cmd/gen@v2.0.0+incompatible"
+	for _, test := range []struct {
+		description string
+		po          *options.PublishOptions
+		wantPrefix  string
+	}{{
+		description: "preserve import path",
+		po:          &options.PublishOptions{PreserveImportPaths: true},
+		wantPrefix:  "example.com/tools/cmd/gen-v2.0.0-incompatible",
+	}, {
+		description: "base import path",
+		po:          &options.PublishOptions{BaseImportPaths: true},
+		wantPrefix:  "gen-v2.0.0-incompatible",
+	}, {
+		description: "md5",
+		po:          &options.PublishOptions{},
+		wantPrefix:  "gen-v2.0.0-incompatible-",
+	}} {
+		t.Run(test.description, func(t *testing.T) {
+			test.po.Local = true
+			test.po.LocalDomain = "localdomain.example.com/repo"
+			test.po.DockerClient = &kotesting.MockDaemon{}
+			publisher, err := NewPublisher(test.po)
+			if err != nil {
+				t.Fatalf("NewPublisher(): %v", err)
+			}
+			defer publisher.Close()
+			ref, err := publisher.Publish(context.Background(), empty.Image, importpath)
+			if err != nil {
+				t.Fatalf("publisher.Publish(): %v", err)
+			}
+			if got, want := ref.Context().Name(), test.po.LocalDomain+"/"+test.wantPrefix; !strings.HasPrefix(got, want) {
+				t.Errorf("got %s, wanted prefix %s", got, want)
+			}
+		})
+	}
+}
+
+func TestNewPublisherDockerRepoMappings(t *testing.T) {
+	mappings := []options.DockerRepoMapping{{
+		Prefix: "example.com/mono/frontend/...",
+		Repo:   "registry.example.com/frontend",
+	}, {
+		Prefix: "example.com/mono/backend",
+		Repo:   "registry.example.com/backend",
+		Bare:   true,
+	}}
+	for _, test := range []struct {
+		description string
+		dockerRepo  string
+		want        map[string]string
+	}{{
+		description: "fall back to KO_DOCKER_REPO",
+		dockerRepo:  "registry.example.com/default",
+		want: map[string]string{
+			"example.com/mono/frontend/cmd/web": "registry.example.com/frontend/example.com/mono/frontend/cmd/web",
+			"example.com/mono/backend/cmd/api":  "registry.example.com/backend",
+			"example.com/mono/tools/cmd/lint":   "registry.example.com/default/example.com/mono/tools/cmd/lint",
+		},
+	}, {
+		description: "no KO_DOCKER_REPO",
+		want: map[string]string{
+			"example.com/mono/frontend/cmd/web": "registry.example.com/frontend/example.com/mono/frontend/cmd/web",
+			"example.com/mono/tools/cmd/lint":   "",
+		},
+	}} {
+		t.Run(test.description, func(t *testing.T) {
+			publisher, err := NewPublisher(&options.PublishOptions{
+				DockerRepo:          test.dockerRepo,
+				PreserveImportPaths: true,
+				DockerRepoMappings:  mappings,
+			})
+			if err != nil {
+				t.Fatalf("NewPublisher(): %v", err)
+			}
+			defer publisher.Close()
+			for ip, want := range test.want {
+				ref, err := publisher.Publish(context.Background(), empty.Image, build.StrictScheme+ip)
+				if want == "" {
+					if err == nil {
+						t.Errorf("Publish(%s) = %v, wanted an error", ip, ref)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("Publish(%s): %v", ip, err)
+				}
+				if got := ref.Context().Name(); got != want {
+					t.Errorf("Publish(%s) = %s, wanted %s", ip, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestConcurrentBuilds(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		jobs        int
+		env         string
+		want        int
+		wantErr     bool
+	}{{
+		description: "default",
+		want:        runtime.GOMAXPROCS(0),
+	}, {
+		description: "env",
+		env:         "3",
+		want:        3,
+	}, {
+		description: "flag wins",
+		jobs:        2,
+		env:         "3",
+		want:        2,
+	}, {
+		description: "env clamped",
+		env:         "-4",
+		want:        1,
+	}, {
+		description: "flag clamped",
+		jobs:        -1,
+		want:        1,
+	}, {
+		description: "bad env",
+		env:         "lots",
+		wantErr:     true,
+	}} {
+		t.Run(test.description, func(t *testing.T) {
+			os.Setenv("KO_CONCURRENT_BUILDS", test.env)
+			defer os.Unsetenv("KO_CONCURRENT_BUILDS")
+
+			got, err := concurrentBuilds(test.jobs)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("concurrentBuilds() = %v, wanted error: %t", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("concurrentBuilds() = %d, wanted %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTargetPlatform(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		flag        string
+		env         map[string]string
+		want        string
+		wantErr     string
+	}{{
+		description: "default",
+		want:        "linux/amd64",
+	}, {
+		description: "GOOS and GOARCH",
+		env:         map[string]string{"GOOS": "linux", "GOARCH": "arm", "GOARM": "7"},
+		want:        "linux/arm/v7",
+	}, {
+		description: "env",
+		env:         map[string]string{"KO_DEFAULTPLATFORMS": "linux/amd64,linux/arm64"},
+		want:        "linux/amd64,linux/arm64",
+	}, {
+		description: "env all",
+		env:         map[string]string{"KO_DEFAULTPLATFORMS": "all"},
+		want:        "all",
+	}, {
+		description: "flag wins",
+		flag:        "linux/s390x",
+		env:         map[string]string{"KO_DEFAULTPLATFORMS": "linux/arm64"},
+		want:        "linux/s390x",
+	}, {
+		description: "flag wins over a bad env",
+		flag:        "linux/s390x",
+		env:         map[string]string{"KO_DEFAULTPLATFORMS": "bogus"},
+		want:        "linux/s390x",
+	}, {
+		description: "bad env",
+		env:         map[string]string{"KO_DEFAULTPLATFORMS": "linux,linux/arm/v7/x"},
+		wantErr:     `KO_DEFAULTPLATFORMS: invalid platform "linux/arm/v7/x"`,
+	}, {
+		description: "empty token",
+		env:         map[string]string{"KO_DEFAULTPLATFORMS": "linux/amd64,,linux/arm64"},
+		wantErr:     `invalid platform ""`,
+	}, {
+		description: "empty part",
+		env:         map[string]string{"KO_DEFAULTPLATFORMS": "linux/"},
+		wantErr:     `invalid platform "linux/"`,
+	}, {
+		description: "all with others",
+		env:         map[string]string{"KO_DEFAULTPLATFORMS": "all,linux/amd64"},
+		wantErr:     `invalid platform "all"`,
+	}, {
+		description: "env with GOOS",
+		env:         map[string]string{"KO_DEFAULTPLATFORMS": "linux/arm64", "GOOS": "linux"},
+		wantErr:     "cannot use KO_DEFAULTPLATFORMS with GOOS",
+	}, {
+		description: "flag with GOARCH",
+		flag:        "linux/arm64",
+		env:         map[string]string{"GOARCH": "arm64"},
+		wantErr:     "cannot use --platform with GOARCH",
+	}} {
+		t.Run(test.description, func(t *testing.T) {
+			for _, env := range []string{"KO_DEFAULTPLATFORMS", "GOOS", "GOARCH", "GOARM"} {
+				if v, ok := os.LookupEnv(env); ok {
+					defer os.Setenv(env, v)
+				} else {
+					defer os.Unsetenv(env)
+				}
+				os.Unsetenv(env)
+			}
+			for k, v := range test.env {
+				os.Setenv(k, v)
+			}
+
+			got, err := targetPlatform(&options.BuildOptions{Platform: test.flag})
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("targetPlatform() = %v, wanted error containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("targetPlatform() = %v", err)
+			}
+			if got != test.want {
+				t.Errorf("targetPlatform() = %s, wanted %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	if v, ok := os.LookupEnv("KO_USER_AGENT"); ok {
+		defer os.Setenv("KO_USER_AGENT", v)
+	} else {
+		defer os.Unsetenv("KO_USER_AGENT")
+	}
+
+	os.Unsetenv("KO_USER_AGENT")
+	if got := ua(); got != "ko" && !strings.HasPrefix(got, "ko/") {
+		t.Errorf("ua() = %q, wanted ko and its version", got)
+	}
+	// KO_USER_AGENT replaces ko's user agent entirely.
+	os.Setenv("KO_USER_AGENT", " corp-builder/1.2 (ko) ")
+	if got, want := ua(), "corp-builder/1.2 (ko)"; got != want {
+		t.Errorf("ua() = %q, wanted %q", got, want)
+	}
+}
+
+func TestYAMLRefAuthority(t *testing.T) {
+	const (
+		layout   = options.YAMLRefLayout
+		tarball  = options.YAMLRefTarball
+		registry = options.YAMLRefRegistry
+		daemon   = options.YAMLRefDaemon
+	)
+	// Every combination of publishers, in the order makePublisher creates
+	// them, and the one whose references are used for each source; "" is an
+	// error.
+	for _, test := range []struct {
+		active []string
+		want   map[string]string
+	}{{
+		active: []string{daemon},
+		want:   map[string]string{"": daemon, daemon: daemon, registry: "", layout: "", tarball: ""},
+	}, {
+		active: []string{layout},
+		want:   map[string]string{"": layout, layout: layout, registry: "", tarball: "", daemon: ""},
+	}, {
+		active: []string{tarball},
+		want:   map[string]string{"": tarball, tarball: tarball, registry: "", layout: "", daemon: ""},
+	}, {
+		active: []string{registry},
+		want:   map[string]string{"": registry, registry: registry, layout: "", tarball: "", daemon: ""},
+	}, {
+		active: []string{layout, tarball},
+		want:   map[string]string{"": tarball, layout: layout, tarball: tarball, registry: "", daemon: ""},
+	}, {
+		active: []string{layout, registry},
+		want:   map[string]string{"": registry, layout: layout, registry: registry, tarball: "", daemon: ""},
+	}, {
+		active: []string{tarball, registry},
+		want:   map[string]string{"": registry, tarball: tarball, registry: registry, layout: "", daemon: ""},
+	}, {
+		active: []string{layout, tarball, registry},
+		want:   map[string]string{"": registry, layout: layout, tarball: tarball, registry: registry, daemon: ""},
+	}} {
+		for source, want := range test.want {
+			t.Run(strings.Join(test.active, "+")+"/"+source, func(t *testing.T) {
+				i, err := yamlRefAuthority(source, test.active)
+				if want == "" {
+					if err == nil {
+						t.Errorf("yamlRefAuthority() = %s, wanted error", test.active[i])
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("yamlRefAuthority() = %v", err)
+				}
+				if got := test.active[i]; got != want {
+					t.Errorf("yamlRefAuthority() = %s, wanted %s", got, want)
+				}
+			})
+		}
+	}
+
+	if _, err := yamlRefAuthority("kind", []string{registry}); err == nil {
+		t.Error("yamlRefAuthority(kind) succeeded, wanted error for unknown source")
+	}
+	if _, err := NewPublisher(&options.PublishOptions{DockerRepo: "example.com/repo", YAMLRefSource: layout}); err == nil {
+		t.Error("NewPublisher() with --yaml-ref-source=layout and no layout succeeded, wanted error")
+	}
+}
+
+func TestOrderPublishers(t *testing.T) {
+	const (
+		layout   = options.YAMLRefLayout
+		tarball  = options.YAMLRefTarball
+		registry = options.YAMLRefRegistry
+	)
+	all := []string{layout, tarball, registry}
+	for _, test := range []struct {
+		order  []string
+		active []string
+		want   []string
+	}{{
+		active: all,
+		want:   all,
+	}, {
+		order:  []string{registry, tarball, layout},
+		active: all,
+		want:   []string{registry, tarball, layout},
+	}, {
+		// Unlisted publishers follow, in the default order.
+		order:  []string{registry},
+		active: all,
+		want:   []string{registry, layout, tarball},
+	}, {
+		// Listed publishers that aren't in use are skipped.
+		order:  []string{registry, tarball},
+		active: []string{layout, tarball},
+		want:   []string{tarball, layout},
+	}} {
+		got, err := orderPublishers(test.order, test.active)
+		if err != nil {
+			t.Fatalf("orderPublishers(%v, %v) = %v", test.order, test.active, err)
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("orderPublishers(%v, %v) (-want +got): %s", test.order, test.active, diff)
+		}
+	}
+
+	for _, order := range [][]string{{"daemon"}, {"push"}, {registry, registry}} {
+		if _, err := orderPublishers(order, all); err == nil {
+			t.Errorf("orderPublishers(%v) succeeded, wanted error", order)
+		}
+	}
+}
+
+func TestNewPublisherOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ko-layout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tarballFile := filepath.Join(dir, "images.tar")
+	layoutPath := filepath.Join(dir, "layout")
+
+	for _, test := range []struct {
+		desc  string
+		order []string
+		want  []string
+	}{{
+		desc: "default",
+		want: []string{layoutPath, "example.com/repo"},
+	}, {
+		desc:  "tarball first",
+		order: []string{options.YAMLRefTarball, options.YAMLRefLayout},
+		want:  []string{"example.com/repo", layoutPath},
+	}} {
+		t.Run(test.desc, func(t *testing.T) {
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			pub, err := NewPublisher(&options.PublishOptions{
+				DockerRepo:     "example.com/repo",
+				OCILayoutPath:  layoutPath,
+				TarballFile:    tarballFile,
+				PublisherOrder: test.order,
+			})
+			if err != nil {
+				t.Fatalf("NewPublisher() = %v", err)
+			}
+			defer pub.Close()
+			img, err := random.Image(1024, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := pub.Publish(context.Background(), img, build.StrictScheme+fooRef); err != nil {
+				t.Fatalf("Publish() = %v", err)
+			}
+
+			// The references of every publisher are logged in the
+			// order they published in.
+			i := strings.Index(logs.String(), ", of [")
+			if i < 0 {
+				t.Fatalf("logs = %q, wanted the published references", logs.String())
+			}
+			published := logs.String()[i:]
+			first, second := strings.Index(published, test.want[0]), strings.Index(published, test.want[1])
+			if first < 0 || second < 0 || first > second {
+				t.Errorf("published %q, wanted %s before %s", published, test.want[0], test.want[1])
+			}
+		})
+	}
+}
+
+func TestNewPublisherResolveStyle(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := NewPublisher(&options.PublishOptions{
+		DockerRepo:          reg.Host() + "/repo",
+		PreserveImportPaths: true,
+		Push:                true,
+		Tags:                []string{"edge"},
+		ResolveStyle:        string(publish.ResolveTag),
+	})
+	if err != nil {
+		t.Fatalf("NewPublisher() = %v", err)
+	}
+	defer pub.Close()
+	rec := newBuildOutputRecorder(pub)
+	ref, err := rec.Publish(context.Background(), img, build.StrictScheme+fooRef)
+	if err != nil {
+		t.Fatalf("Publish() = %v", err)
+	}
+	if got, want := ref.String(), reg.Host()+"/repo/"+fooRef+":edge"; got != want {
+		t.Errorf("Publish() = %s, wanted %s", got, want)
+	}
+	// --build-output records the digest all the same.
+	if got := rec.images[fooRef].Digest; got != h.String() {
+		t.Errorf("--build-output digest = %q, wanted %s", got, h)
+	}
+
+	if _, err := NewPublisher(&options.PublishOptions{
+		DockerRepo:   reg.Host() + "/repo",
+		Push:         true,
+		Tags:         []string{"edge"},
+		TagOnly:      true,
+		ResolveStyle: string(publish.ResolveDigest),
+	}); err == nil {
+		t.Error("NewPublisher() with --tag-only and --resolve-style=digest = nil, wanted error")
+	}
+}
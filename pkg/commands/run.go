@@ -31,6 +31,7 @@ import (
 func addRun(topLevel *cobra.Command) {
 	po := &options.PublishOptions{}
 	bo := &options.BuildOptions{}
+	wo := &options.WarningOptions{}
 
 	run := &cobra.Command{
 		Use:   "run IMPORTPATH",
@@ -68,6 +69,7 @@ func addRun(topLevel *cobra.Command) {
 			}
 
 			bo.InsecureRegistry = po.InsecureRegistry
+			shareSBOMs(bo, po)
 			builder, err := makeBuilder(ctx, bo)
 			if err != nil {
 				return fmt.Errorf("error creating builder: %v", err)
@@ -143,6 +145,8 @@ func addRun(topLevel *cobra.Command) {
 	}
 	options.AddPublishArg(run, po)
 	options.AddBuildOptions(run, bo)
+	options.AddWarningsArg(run, wo)
+	run.RunE = withWarnings(wo, withTracing(run.RunE))
 
 	topLevel.AddCommand(run)
 }
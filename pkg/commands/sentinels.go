@@ -0,0 +1,169 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/ko/pkg/commands/options"
+	"github.com/google/ko/pkg/publish"
+	"github.com/google/ko/pkg/warnings"
+)
+
+// PublisherFactory creates the publisher for a KO_DOCKER_REPO sentinel,
+// from po, whose DockerRepo is the sentinel (or, for a scheme, starts with
+// it), and the tags to publish images with.
+type PublisherFactory func(po *options.PublishOptions, tags []string) (publish.Interface, error)
+
+var (
+	sentinelsMu sync.RWMutex
+	// sentinels are the registered factories, by the KO_DOCKER_REPO they
+	// own, e.g. "kind.local", or the scheme, e.g. "ext://".
+	sentinels = map[string]PublisherFactory{}
+)
+
+// RegisterSentinel registers f to create the publisher when KO_DOCKER_REPO
+// is sentinel, e.g. "kind.local", or, when sentinel is a URL scheme like
+// "ext://", when KO_DOCKER_REPO starts with it, rather than pushing to a
+// registry. It must be called before NewPublisher, and a sentinel can only be
+// registered once; ko registers ko.local, kind.local, containerd.local and
+// ext://.
+func RegisterSentinel(sentinel string, f PublisherFactory) error {
+	if sentinel == "" || f == nil {
+		return fmt.Errorf("invalid sentinel %q", sentinel)
+	}
+	if i := strings.Index(sentinel, "://"); i >= 0 && i+len("://") != len(sentinel) {
+		return fmt.Errorf("invalid sentinel %q, a scheme must end with ://", sentinel)
+	}
+	sentinelsMu.Lock()
+	defer sentinelsMu.Unlock()
+	if _, ok := sentinels[sentinel]; ok {
+		return fmt.Errorf("sentinel %q is already registered", sentinel)
+	}
+	sentinels[sentinel] = f
+	return nil
+}
+
+func init() {
+	for sentinel, f := range map[string]PublisherFactory{
+		publish.LocalDomain:      daemonPublisher,
+		publish.KindDomain:       kindPublisher,
+		publish.ContainerdDomain: containerdPublisher,
+		publish.ExternalScheme:   externalPublisher,
+	} {
+		if err := RegisterSentinel(sentinel, f); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// sentinelFactory returns the factory registered for po's KO_DOCKER_REPO,
+// or false if it's a registry. --local is ko.local. A KO_DOCKER_REPO with a
+// scheme that isn't registered is an error.
+func sentinelFactory(po *options.PublishOptions) (PublisherFactory, bool, error) {
+	repo := po.DockerRepo
+	if po.Local {
+		repo = publish.LocalDomain
+	}
+	sentinelsMu.RLock()
+	defer sentinelsMu.RUnlock()
+	if f, ok := sentinels[repo]; ok {
+		return f, true, nil
+	}
+	i := strings.Index(repo, "://")
+	if i < 0 {
+		return nil, false, nil
+	}
+	if f, ok := sentinels[repo[:i+len("://")]]; ok {
+		return f, true, nil
+	}
+	registered := make([]string, 0, len(sentinels))
+	for s := range sentinels {
+		registered = append(registered, s)
+	}
+	sort.Strings(registered)
+	return nil, false, fmt.Errorf("unknown KO_DOCKER_REPO %q, expected a repository or one of the registered sentinels: %s",
+		repo, strings.Join(registered, ", "))
+}
+
+// isSentinel returns whether po publishes to a registered sentinel rather
+// than a registry.
+func isSentinel(po *options.PublishOptions) bool {
+	_, ok, _ := sentinelFactory(po)
+	return ok
+}
+
+// daemonPublisher loads images into the local docker daemon, or if it's
+// unreachable, writes them to --local-fallback-tarball.
+func daemonPublisher(po *options.PublishOptions, tags []string) (publish.Interface, error) {
+	// TODO(jonjohnsonjr): I'm assuming that nobody will
+	// use local with other publishers, but that might
+	// not be true.
+	if _, err := yamlRefAuthority(po.YAMLRefSource, []string{options.YAMLRefDaemon}); err != nil {
+		return nil, err
+	}
+	namer := options.MakeNamer(po)
+	ctx, cancel := context.WithTimeout(context.Background(), daemonPingTimeout)
+	defer cancel()
+	if err := publish.PingDaemon(ctx, po.DockerClient); err != nil {
+		if po.LocalFallbackTarball == "" {
+			return nil, fmt.Errorf("the docker daemon isn't reachable to load images into: %v\n"+
+				"Start docker (or point DOCKER_HOST at a running daemon), set KO_DOCKER_REPO to push to a registry instead, "+
+				"or pass --local-fallback-tarball=FILE to write the images to a tarball for `docker load`", err)
+		}
+		warnings.Warnf(warnings.DaemonFallback, "the docker daemon isn't reachable (%v), so images are written to %s instead", err, po.LocalFallbackTarball)
+		base := po.LocalDomain
+		if base == "" {
+			base = publish.LocalDomain
+		}
+		return publish.NewTarball(po.LocalFallbackTarball, base, namer, tags), nil
+	}
+	return publish.NewDaemon(namer, tags,
+		publish.WithDockerClient(po.DockerClient),
+		publish.WithLocalDomain(po.LocalDomain),
+	)
+}
+
+// kindPublisher loads images into the nodes of a kind cluster.
+func kindPublisher(po *options.PublishOptions, tags []string) (publish.Interface, error) {
+	if _, err := yamlRefAuthority(po.YAMLRefSource, []string{"kind"}); err != nil {
+		return nil, err
+	}
+	return publish.NewKindPublisher(options.MakeNamer(po), tags), nil
+}
+
+// containerdPublisher loads images into a containerd namespace.
+func containerdPublisher(po *options.PublishOptions, tags []string) (publish.Interface, error) {
+	if _, err := yamlRefAuthority(po.YAMLRefSource, []string{"containerd"}); err != nil {
+		return nil, err
+	}
+	return publish.NewContainerd(options.MakeNamer(po), tags,
+		publish.WithContainerdAddress(po.ContainerdAddress),
+		publish.WithContainerdNamespace(po.ContainerdNamespace),
+		publish.WithContainerdSnapshotter(po.ContainerdSnapshotter),
+	)
+}
+
+// externalPublisher publishes images with the plugin ext://NAME names.
+func externalPublisher(po *options.PublishOptions, tags []string) (publish.Interface, error) {
+	if _, err := yamlRefAuthority(po.YAMLRefSource, []string{"ext"}); err != nil {
+		return nil, err
+	}
+	return publish.NewExternal(po.DockerRepo, options.MakeNamer(po), tags)
+}
@@ -0,0 +1,170 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/commands/options"
+	kotesting "github.com/google/ko/pkg/internal/testing"
+	"github.com/google/ko/pkg/publish"
+)
+
+func TestSentinels(t *testing.T) {
+	const importpath = build.StrictScheme + "github.com/google/ko/test"
+
+	// containerd.local needs a ctr on PATH, which isn't run here.
+	bin := t.TempDir()
+	ctr := filepath.Join(bin, "ctr")
+	if runtime.GOOS == "windows" {
+		ctr += ".exe"
+	}
+	if err := ioutil.WriteFile(ctr, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", bin+string(filepath.ListSeparator)+os.Getenv("PATH"))
+
+	// A sentinel registered by a library user is published to by its
+	// factory, e.g. the test.local images go to a fixed publisher.
+	var gotRepo string
+	var gotTags []string
+	factory := func(po *options.PublishOptions, tags []string) (publish.Interface, error) {
+		gotRepo, gotTags = po.DockerRepo, tags
+		return kotesting.NewFixedPublish(mustRepository("example.com/test"), map[string]v1.Hash{}), nil
+	}
+	for _, sentinel := range []string{"test.local", "test://"} {
+		if err := RegisterSentinel(sentinel, factory); err != nil {
+			t.Fatalf("RegisterSentinel(%s) = %v", sentinel, err)
+		}
+		defer func(sentinel string) {
+			sentinelsMu.Lock()
+			delete(sentinels, sentinel)
+			sentinelsMu.Unlock()
+		}(sentinel)
+	}
+	for _, repo := range []string{"test.local", "test://cluster"} {
+		pub, err := NewPublisher(&options.PublishOptions{DockerRepo: repo, Tags: []string{"v1"}})
+		if err != nil {
+			t.Fatalf("NewPublisher(%s) = %v", repo, err)
+		}
+		pub.Close()
+		if gotRepo != repo || len(gotTags) != 1 || gotTags[0] != "v1" {
+			t.Errorf("NewPublisher(%s) created the publisher for %s with tags %v, wanted %s with [v1]", repo, gotRepo, gotTags, repo)
+		}
+	}
+
+	for _, test := range []struct {
+		sentinel string
+		wantErr  string
+	}{{
+		sentinel: publish.KindDomain,
+		wantErr:  "already registered",
+	}, {
+		sentinel: publish.ExternalScheme,
+		wantErr:  "already registered",
+	}, {
+		sentinel: "test://cluster",
+		wantErr:  "must end with ://",
+	}, {
+		sentinel: "",
+		wantErr:  "invalid sentinel",
+	}} {
+		if err := RegisterSentinel(test.sentinel, factory); err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("RegisterSentinel(%q) = %v, wanted error containing %q", test.sentinel, err, test.wantErr)
+		}
+	}
+
+	// Schemes that aren't registered are listed.
+	_, err := NewPublisher(&options.PublishOptions{DockerRepo: "unknown://repo"})
+	if want := "registered sentinels: containerd.local, ext://, kind.local, ko.local, test.local, test://"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("NewPublisher(unknown://repo) = %v, wanted error containing %q", err, want)
+	}
+
+	// The built-ins are as they were before they were registered.
+	for _, test := range []struct {
+		desc    string
+		po      *options.PublishOptions
+		wantErr string
+	}{{
+		desc: "ko.local",
+		po:   &options.PublishOptions{DockerRepo: publish.LocalDomain, DockerClient: &kotesting.MockDaemon{}},
+	}, {
+		desc: "--local",
+		po:   &options.PublishOptions{DockerRepo: "example.com/repo", Local: true, DockerClient: &kotesting.MockDaemon{}},
+	}, {
+		desc:    "ko.local unreachable",
+		po:      &options.PublishOptions{DockerRepo: publish.LocalDomain, DockerClient: &unreachableDaemon{}},
+		wantErr: "isn't reachable",
+	}, {
+		desc: "kind.local",
+		po:   &options.PublishOptions{DockerRepo: publish.KindDomain},
+	}, {
+		desc:    "kind.local with --yaml-ref-source",
+		po:      &options.PublishOptions{DockerRepo: publish.KindDomain, YAMLRefSource: options.YAMLRefRegistry},
+		wantErr: "--yaml-ref-source=registry, but only [kind] are publishing",
+	}, {
+		desc: "containerd.local",
+		po:   &options.PublishOptions{DockerRepo: publish.ContainerdDomain},
+	}, {
+		desc: "ext://",
+		po:   &options.PublishOptions{DockerRepo: "ext://example"},
+	}, {
+		desc:    "ext:// without a plugin",
+		po:      &options.PublishOptions{DockerRepo: "ext://"},
+		wantErr: `invalid KO_DOCKER_REPO "ext://"`,
+	}, {
+		desc:    "unset",
+		po:      &options.PublishOptions{},
+		wantErr: "KO_DOCKER_REPO environment variable is unset",
+	}} {
+		t.Run(test.desc, func(t *testing.T) {
+			pub, err := NewPublisher(test.po)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("NewPublisher() = %v, wanted error containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewPublisher() = %v", err)
+			}
+			pub.Close()
+		})
+	}
+
+	// Images loaded into the daemon are still named after ko.local.
+	pub, err := NewPublisher(&options.PublishOptions{DockerRepo: publish.LocalDomain, DockerClient: &kotesting.MockDaemon{}, BaseImportPaths: true})
+	if err != nil {
+		t.Fatalf("NewPublisher() = %v", err)
+	}
+	defer pub.Close()
+	ref, err := pub.Publish(context.Background(), empty.Image, importpath)
+	if err != nil {
+		t.Fatalf("Publish() = %v", err)
+	}
+	if got, want := ref.Context().Name(), publish.LocalDomain+"/test"; got != want {
+		t.Errorf("Publish() = %s, wanted %s", got, want)
+	}
+}
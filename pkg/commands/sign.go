@@ -0,0 +1,96 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/google/ko/pkg/commands/options"
+	"github.com/google/ko/pkg/publish"
+	"github.com/google/ko/pkg/warnings"
+)
+
+// signer returns the hook that signs images pushed to a registry, or nil
+// without --sign.
+func signer(po *options.PublishOptions) (publish.PostPublish, error) {
+	if !po.Sign {
+		return nil, nil
+	}
+	if po.SigningKey == "" {
+		return nil, errors.New("--sign requires KO_SIGNING_KEY, the path to a PEM ECDSA or RSA private key")
+	}
+	if !po.Push || isSentinel(po) {
+		warnings.Warnf(warnings.Signing, "--sign only signs images pushed to a registry")
+	}
+	key, err := signingKey(po)
+	if err != nil {
+		return nil, err
+	}
+	return publish.NewCosignSigner(key), nil
+}
+
+// signingKey reads the private key in the file KO_SIGNING_KEY.
+func signingKey(po *options.PublishOptions) (crypto.Signer, error) {
+	b, err := ioutil.ReadFile(po.SigningKey)
+	if err != nil {
+		return nil, fmt.Errorf("reading KO_SIGNING_KEY: %v", err)
+	}
+	key, err := parseSigningKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("KO_SIGNING_KEY %s: %v", po.SigningKey, err)
+	}
+	return key, nil
+}
+
+// parseSigningKey parses an unencrypted PEM ECDSA or RSA private key, in
+// PKCS #8, SEC 1 (EC) or PKCS #1 (RSA) form. Other keys, e.g. Ed25519, are
+// rejected, since cosign's signatures are of the payload's SHA-256 digest,
+// which they can't sign.
+func parseSigningKey(b []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM private key found")
+	}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch key := key.(type) {
+		case *ecdsa.PrivateKey:
+			return key, nil
+		case *rsa.PrivateKey:
+			return key, nil
+		default:
+			return nil, fmt.Errorf("unsupported private key type %T, use an ECDSA or RSA key", key)
+		}
+	case "ENCRYPTED COSIGN PRIVATE KEY", "ENCRYPTED SIGSTORE PRIVATE KEY":
+		return nil, errors.New("encrypted cosign keys aren't supported, use an unencrypted PKCS #8 private key")
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+}
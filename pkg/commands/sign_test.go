@@ -0,0 +1,135 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/commands/options"
+	"github.com/google/ko/pkg/registrytest"
+)
+
+func mustECKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestResolveSign(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+
+	der, err := x509.MarshalPKCS8PrivateKey(mustECKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// yamlToTmpFile just writes the bytes it's given.
+	keyFile := yamlToTmpFile(t, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	defer os.Remove(keyFile)
+
+	publisher, err := NewPublisher(&options.PublishOptions{
+		DockerRepo:      reg.Host() + "/repo",
+		BaseImportPaths: true,
+		Push:            true,
+		Tags:            []string{"latest"},
+		Sign:            true,
+		SigningKey:      keyFile,
+	})
+	if err != nil {
+		t.Fatalf("NewPublisher(): %v", err)
+	}
+	defer publisher.Close()
+
+	if _, err := resolveFile(context.Background(),
+		yamlToTmpFile(t, []byte(build.StrictScheme+fooRef)),
+		testBuilder, publisher,
+		&options.FilenameOptions{}, &options.SelectorOptions{}); err != nil {
+		t.Fatalf("resolveFile() = %v", err)
+	}
+
+	sigTag := strings.Replace(fooHash.String(), ":", "-", 1) + ".sig"
+	if !reg.HasManifest("repo/"+path.Base(fooRef), sigTag) {
+		t.Errorf("no signature %s was pushed", sigTag)
+	}
+}
+
+func TestParseSigningKey(t *testing.T) {
+	key := mustECKey(t)
+	sec1, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		description string
+		pem         []byte
+		wantErr     bool
+	}{{
+		description: "PKCS #8",
+		pem:         pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}),
+	}, {
+		description: "SEC 1",
+		pem:         pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1}),
+	}, {
+		description: "Ed25519",
+		pem:         pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: ed}),
+		wantErr:     true,
+	}, {
+		description: "encrypted cosign key",
+		pem:         pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED COSIGN PRIVATE KEY", Bytes: []byte("ciphertext")}),
+		wantErr:     true,
+	}, {
+		description: "public key",
+		pem:         pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("key")}),
+		wantErr:     true,
+	}, {
+		description: "not PEM",
+		pem:         []byte("not a key"),
+		wantErr:     true,
+	}} {
+		t.Run(test.description, func(t *testing.T) {
+			_, err := parseSigningKey(test.pem)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Errorf("parseSigningKey() = %v, wanted error: %t", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// checkStrictPaths checks that the patterns of strictPaths and
+// nonStrictPaths are valid, and that no pattern is in both.
+func checkStrictPaths(strict, nonStrict []string) error {
+	seen := map[string]bool{}
+	for _, p := range strict {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("'strictPaths': invalid pattern %q: %v", p, err)
+		}
+		seen[path.Clean(p)] = true
+	}
+	for _, p := range nonStrict {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("'nonStrictPaths': invalid pattern %q: %v", p, err)
+		}
+		if seen[path.Clean(p)] {
+			return fmt.Errorf("%q is in both 'strictPaths' and 'nonStrictPaths'", p)
+		}
+	}
+	return nil
+}
+
+// fileStrictness returns whether the documents of file f must be fully
+// resolved, given the global flag, and what decided it: the flag, or the
+// pattern of strictPaths or nonStrictPaths that f matches. It fails if f
+// matches both.
+func fileStrictness(f string, flag bool) (bool, string, error) {
+	strict, strictOK := matchPathPatterns(strictPaths, f)
+	nonStrict, nonStrictOK := matchPathPatterns(nonStrictPaths, f)
+	switch {
+	case strictOK && nonStrictOK:
+		return false, "", fmt.Errorf("%s matches both strictPaths %q and nonStrictPaths %q", f, strict, nonStrict)
+	case strictOK:
+		return true, "strictPaths " + strict, nil
+	case nonStrictOK:
+		return false, "nonStrictPaths " + nonStrict, nil
+	default:
+		return flag, "flag", nil
+	}
+}
+
+// matchPathPatterns returns the first of patterns that matches f, and
+// whether there's one. Patterns use path.Match syntax, and are matched
+// against the name of f, or if they contain a "/", against its path relative
+// to the working directory, and each directory containing it, so that e.g.
+// "third_party/team-a" matches every file under that directory.
+func matchPathPatterns(patterns []string, f string) (string, bool) {
+	if len(patterns) == 0 {
+		return "", false
+	}
+	rel := f
+	if wd, err := os.Getwd(); err == nil {
+		if abs, err := filepath.Abs(f); err == nil {
+			if r, err := filepath.Rel(wd, abs); err == nil {
+				rel = r
+			}
+		}
+	}
+	rel = filepath.ToSlash(rel)
+	for _, pattern := range patterns {
+		pattern = strings.TrimPrefix(path.Clean(pattern), "./")
+		if !strings.Contains(pattern, "/") {
+			if ok, _ := path.Match(pattern, path.Base(rel)); ok {
+				return pattern, true
+			}
+			continue
+		}
+		for p := rel; p != "." && p != "/" && p != ".."; p = path.Dir(p) {
+			if ok, _ := path.Match(pattern, p); ok {
+				return pattern, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,151 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/ko/pkg/commands/options"
+	kotesting "github.com/google/ko/pkg/internal/testing"
+)
+
+func TestStrictPathsConfig(t *testing.T) {
+	defer func(s, n []string) { strictPaths, nonStrictPaths = s, n }(strictPaths, nonStrictPaths)
+
+	if err := loadConfig("testdata/strictpaths"); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		file     string
+		flag     bool
+		want     bool
+		wantWhy  string
+		wantFail bool
+	}{{
+		file:    "config/team-a/deploy.yaml",
+		want:    true,
+		wantWhy: "strictPaths config/team-a",
+	}, {
+		file:    "third_party/team-b/deploy.yaml",
+		flag:    true,
+		wantWhy: "nonStrictPaths third_party/*",
+	}, {
+		file:    "config/other/deploy.yaml",
+		flag:    true,
+		want:    true,
+		wantWhy: "flag",
+	}, {
+		file:    "config/other/deploy.yaml",
+		wantWhy: "flag",
+	}} {
+		t.Run(test.file, func(t *testing.T) {
+			got, why, err := fileStrictness(test.file, test.flag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want || why != test.wantWhy {
+				t.Errorf("fileStrictness(%q, %t) = %t, %q, wanted %t, %q", test.file, test.flag, got, why, test.want, test.wantWhy)
+			}
+		})
+	}
+
+	// A file can't be both strict and not.
+	strictPaths, nonStrictPaths = []string{"*.yaml"}, []string{"third_party/*"}
+	if _, _, err := fileStrictness("third_party/team-b/deploy.yaml", false); err == nil {
+		t.Error("fileStrictness() for a file matching both lists succeeded, wanted error")
+	}
+
+	// Nor can a pattern, which fails loading the config.
+	err := loadConfig("testdata/badstrictpaths")
+	if err == nil || !strings.Contains(err.Error(), "third_party/team-b") {
+		t.Errorf("loadConfig() = %v, wanted an error for the pattern in both lists", err)
+	}
+}
+
+func TestResolveStrictnessPrecedence(t *testing.T) {
+	defer func(s, n []string) { strictPaths, nonStrictPaths = s, n }(strictPaths, nonStrictPaths)
+
+	const unresolved = `apiVersion: v1
+kind: Pod
+metadata:
+  name: foo
+%s
+spec:
+  containers:
+  - image: ko://github.com/awesomesauce/foo
+    args:
+    - --sidecar=ko://github.com/awesomesauce/bar
+`
+	const strict = "  annotations:\n    ko.build/strict: \"true\""
+	const nonStrict = "  annotations:\n    ko.build/strict: \"false\""
+
+	dir := t.TempDir()
+	write := func(name, annotations string) string {
+		f := filepath.Join(dir, name)
+		if err := os.WriteFile(f, []byte(strings.Replace(unresolved, "%s\n", annotations+"\n", 1)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	pub := kotesting.NewFixedPublish(mustRepository("gcr.io/multi-pass"), testHashes)
+
+	for _, test := range []struct {
+		desc        string
+		flag        bool
+		strict      []string
+		nonStrict   []string
+		annotations string
+		wantErr     string
+	}{{
+		desc:    "flag",
+		flag:    true,
+		wantErr: "strict per flag",
+	}, {
+		desc:      "path overrides flag",
+		flag:      true,
+		nonStrict: []string{"*.yaml"},
+	}, {
+		desc:    "path overrides no flag",
+		strict:  []string{"*.yaml"},
+		wantErr: "strict per strictPaths *.yaml",
+	}, {
+		desc:        "annotation overrides path",
+		strict:      []string{"*.yaml"},
+		annotations: nonStrict,
+	}, {
+		desc:        "annotation overrides path and flag",
+		flag:        true,
+		nonStrict:   []string{"*.yaml"},
+		annotations: strict,
+		wantErr:     "strict per annotation ko.build/strict",
+	}} {
+		t.Run(test.desc, func(t *testing.T) {
+			strictPaths, nonStrictPaths = test.strict, test.nonStrict
+			f := write("pod.yaml", test.annotations)
+			fo := &options.FilenameOptions{Strict: options.StrictOptions{AssertFullyResolved: test.flag}}
+			_, err := resolveFile(context.Background(), f, testBuilder, pub, fo, &options.SelectorOptions{})
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Errorf("resolveFile() = %v, wanted success", err)
+			case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+				t.Errorf("resolveFile() = %v, wanted error containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/google/ko/pkg/commands/options"
+)
+
+// ciEnvVars are set by common CI systems, and ciCommitEnvVars to the commit
+// being built by them.
+var (
+	ciEnvVars       = []string{"CI", "GITHUB_ACTIONS", "GITLAB_CI", "BUILDKITE", "CIRCLECI", "TRAVIS", "JENKINS_URL"}
+	ciCommitEnvVars = []string{"GITHUB_SHA", "CI_COMMIT_SHA", "BUILDKITE_COMMIT", "CIRCLE_SHA1", "TRAVIS_COMMIT", "GIT_COMMIT"}
+)
+
+// devTag is the tag of images built outside CI with --auto-tag-scheme.
+const devTag = "dev"
+
+// lookupEnv is os.LookupEnv, replaced in tests.
+var lookupEnv = os.LookupEnv
+
+// publishTags returns the tags to publish images with: po.Tags, unless
+// --auto-tag-scheme is set and --tags is left as the default, in which
+// case the git commit in CI and devTag otherwise.
+func publishTags(po *options.PublishOptions) ([]string, error) {
+	if !po.AutoTagScheme || !(len(po.Tags) == 0 || len(po.Tags) == 1 && po.Tags[0] == "latest") {
+		return po.Tags, nil
+	}
+	ci := detectCI()
+	if ci == "" {
+		return []string{devTag}, nil
+	}
+	sha, err := ciCommit()
+	if err != nil {
+		return nil, fmt.Errorf("--auto-tag-scheme: running in CI (%s is set), but can't find the commit: %v", ci, err)
+	}
+	log.Printf("Running in CI (%s is set), tagging images with %s", ci, sha)
+	return []string{sha}, nil
+}
+
+// detectCI returns the first of ciEnvVars that is set, other than to
+// "false", or "" if none is.
+func detectCI() string {
+	for _, env := range ciEnvVars {
+		if v, ok := lookupEnv(env); ok && v != "" && v != "false" {
+			return env
+		}
+	}
+	return ""
+}
+
+// ciCommit returns the commit being built, from the CI system's variables,
+// or git.
+func ciCommit() (string, error) {
+	for _, env := range ciCommitEnvVars {
+		if v, ok := lookupEnv(env); ok && v != "" {
+			return v, nil
+		}
+	}
+	return git(context.Background(), "", "rev-parse", "HEAD")
+}
@@ -0,0 +1,78 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/ko/pkg/commands/options"
+)
+
+func TestPublishTags(t *testing.T) {
+	defer func() { lookupEnv = os.LookupEnv }()
+
+	sha := "0123456789abcdef0123456789abcdef01234567"
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+		po   options.PublishOptions
+		want []string
+	}{{
+		name: "off by default",
+		env:  map[string]string{"CI": "true", "GITHUB_SHA": sha},
+		po:   options.PublishOptions{Tags: []string{"latest"}},
+		want: []string{"latest"},
+	}, {
+		name: "local",
+		po:   options.PublishOptions{Tags: []string{"latest"}, AutoTagScheme: true},
+		want: []string{devTag},
+	}, {
+		name: "CI=false is local",
+		env:  map[string]string{"CI": "false", "GITHUB_SHA": sha},
+		po:   options.PublishOptions{Tags: []string{"latest"}, AutoTagScheme: true},
+		want: []string{devTag},
+	}, {
+		name: "github actions",
+		env:  map[string]string{"GITHUB_ACTIONS": "true", "GITHUB_SHA": sha},
+		po:   options.PublishOptions{Tags: []string{"latest"}, AutoTagScheme: true},
+		want: []string{sha},
+	}, {
+		name: "gitlab",
+		env:  map[string]string{"CI": "true", "CI_COMMIT_SHA": sha},
+		po:   options.PublishOptions{AutoTagScheme: true},
+		want: []string{sha},
+	}, {
+		name: "explicit tags win",
+		env:  map[string]string{"CI": "true", "GITHUB_SHA": sha},
+		po:   options.PublishOptions{Tags: []string{"v1.2.3"}, AutoTagScheme: true},
+		want: []string{"v1.2.3"},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			lookupEnv = func(key string) (string, bool) {
+				v, ok := tc.env[key]
+				return v, ok
+			}
+			got, err := publishTags(&tc.po)
+			if err != nil {
+				t.Fatalf("publishTags() = %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("publishTags() (-want +got): %s", diff)
+			}
+		})
+	}
+}
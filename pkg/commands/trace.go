@@ -0,0 +1,56 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/ko/pkg/trace"
+	"github.com/google/ko/pkg/warnings"
+	"github.com/spf13/cobra"
+)
+
+// runContext is the context that commands' contexts derive from, which
+// carries the span of the run when tracing.
+var runContext = context.Background()
+
+// withTracing wraps run to trace it, as a span named after the command that
+// the spans of its builds, publishes and resolved files are children of,
+// when an OpenTelemetry endpoint is configured with the standard
+// OTEL_EXPORTER_OTLP_* environment variables.
+func withTracing(run func(*cobra.Command, []string) error) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		exporter, err := trace.FromEnv(lookupEnv)
+		if err != nil {
+			return fmt.Errorf("error configuring tracing: %v", err)
+		}
+		if exporter == nil {
+			return run(cmd, args)
+		}
+		defer trace.SetExporter(trace.SetExporter(exporter))
+
+		ctx, span := trace.Start(context.Background(), cmd.CommandPath())
+		defer func(old context.Context) { runContext = old }(runContext)
+		runContext = ctx
+
+		err = run(cmd, args)
+		span.End(err)
+		if ferr := exporter.Flush(context.Background()); ferr != nil {
+			warnings.Warnf(warnings.Tracing, "error exporting traces: %v", ferr)
+		}
+		return err
+	}
+}
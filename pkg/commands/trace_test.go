@@ -0,0 +1,71 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"context"
+	"io/ioutil"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/commands/options"
+	kotesting "github.com/google/ko/pkg/internal/testing"
+	"github.com/google/ko/pkg/publish"
+	"github.com/google/ko/pkg/trace"
+)
+
+func TestResolveTracing(t *testing.T) {
+	rec := &trace.Recorder{}
+	defer trace.SetExporter(trace.SetExporter(rec))
+
+	builder, err := build.NewCaching(build.NewTraced(testBuilder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := publish.NewTraced(kotesting.NewFixedPublish(mustRepository("gcr.io/multi-pass"), testHashes))
+	inputYAML := "image: " + build.StrictScheme + fooRef + "\n"
+	file := yamlToTmpFile(t, []byte(inputYAML))
+	fo := &options.FilenameOptions{Filenames: []string{file}}
+	if err := resolveFilesToWriter(context.Background(), builder, pub, fo, &options.SelectorOptions{}, nopWriteCloser{ioutil.Discard}); err != nil {
+		t.Fatalf("resolveFilesToWriter() = %v", err)
+	}
+
+	spans := rec.Spans()
+	var names []string
+	byName := map[string]trace.SpanData{}
+	for _, s := range spans {
+		names = append(names, s.Name)
+		byName[s.Name] = s
+	}
+	sort.Strings(names)
+	if diff := cmp.Diff([]string{"build", "publish", "resolve-file"}, names); diff != "" {
+		t.Fatalf("spans (-want +got): %s", diff)
+	}
+	// Builds and publishes are children of the file they're resolved for.
+	file0 := byName["resolve-file"]
+	for _, name := range []string{"build", "publish"} {
+		if s := byName[name]; s.TraceID != file0.TraceID || s.ParentSpanID != file0.SpanID {
+			t.Errorf("%s span %+v isn't a child of %+v", name, s, file0)
+		}
+	}
+	if diff := cmp.Diff([]trace.Attribute{trace.String("ko.file", file)}, file0.Attributes); diff != "" {
+		t.Errorf("resolve-file attributes (-want +got): %s", diff)
+	}
+	if diff := cmp.Diff([]trace.Attribute{trace.String("ko.importpath", fooRef)}, byName["build"].Attributes); diff != "" {
+		t.Errorf("build attributes (-want +got): %s", diff)
+	}
+}
@@ -0,0 +1,378 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/commands/options"
+	"github.com/google/ko/pkg/publish"
+	"github.com/spf13/cobra"
+)
+
+// addWarm augments our CLI surface with warm.
+func addWarm(topLevel *cobra.Command) {
+	fo := &options.FilenameOptions{}
+	so := &options.SelectorOptions{}
+	bo := &options.BuildOptions{}
+	wo := &options.WarningOptions{}
+	warm := &cobra.Command{
+		Use:   "warm [IMPORTPATH...] [-f FILENAME]",
+		Short: "Download what building the given importpaths needs into the base image and module caches, without building them.",
+		Long: `This sub-command fetches the base images of the given importpaths, and of those referenced by the files passed with -f, with their layers, ` +
+			`into the base image cache, the base directory of KOCACHE (default $XDG_CACHE_HOME/ko), ` +
+			`and downloads the Go modules that building them needs, without building or publishing anything. ` +
+			`Later runs with the same cache use the cached base images while their references still point at them, or when their registry can't be reached.`,
+		Example: `
+  # Cache what resolving config/ needs, e.g. when building a CI
+  # runner's image.
+  KOCACHE=/var/cache/ko ko warm -f config/
+
+  # Cache what building some importpaths for two platforms needs.
+  KOCACHE=/var/cache/ko ko warm --platform=linux/amd64,linux/arm64 ./cmd/app ./cmd/tool`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir := baseCacheDir()
+			if dir == "" {
+				return errors.New("KOCACHE must be set to the directory to cache in")
+			}
+			if bo.NoCacheBase {
+				return errors.New("--no-cache-base can't be used with ko warm")
+			}
+			if fo.Watch {
+				return errors.New("--watch can't be used with ko warm")
+			}
+			if len(args) == 0 && len(fo.Filenames) == 0 {
+				return errors.New("ko warm needs importpaths, or files passed with -f")
+			}
+			ctx := createCancellableContext()
+			builder, err := makeBuilder(ctx, bo)
+			if err != nil {
+				return fmt.Errorf("error creating builder: %v", err)
+			}
+			importpaths, err := warmImportPaths(ctx, builder, fo, so, args)
+			if err != nil {
+				return err
+			}
+			stats, err := warmCache(ctx, bo, builder, importpaths)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(os.Stdout, "Cached %d base images (%d bytes) in %s, and %d Go modules (%d bytes)\n",
+				len(stats.bases), stats.baseBytes(), dir, stats.modules, stats.zipBytes)
+			return err
+		},
+	}
+	options.AddFileArg(warm, fo)
+	options.AddSelectorArg(warm, so)
+	options.AddBuildOptions(warm, bo)
+	options.AddWarningsArg(warm, wo)
+	warm.RunE = withWarnings(wo, withTracing(warm.RunE))
+	topLevel.AddCommand(warm)
+}
+
+// addUpdateBase augments our CLI surface with update-base.
+func addUpdateBase(topLevel *cobra.Command) {
+	fo := &options.FilenameOptions{}
+	so := &options.SelectorOptions{}
+	bo := &options.BuildOptions{}
+	wo := &options.WarningOptions{}
+	update := &cobra.Command{
+		Use:   "update-base [IMPORTPATH...] [-f FILENAME]",
+		Short: "Accept the digests that the tags of the given importpaths' base images point at now.",
+		Long: `This sub-command fetches the base images of the given importpaths, and of those referenced by the files passed with -f, ` +
+			`into the base image cache, like ko warm does without downloading Go modules. ` +
+			`Builds warn when a base image's tag points at another digest than when it was cached, or fail with --require-pinned-base, ` +
+			`until the base is updated. Base images referenced by digest can't move, so they are only cached.`,
+		Example: `
+  # Accept the bases that config/ is built on now, after a build warned
+  # that they moved.
+  ko update-base -f config/
+
+  # Accept the base of an importpath.
+  ko update-base ./cmd/app`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir := baseCacheDir()
+			if dir == "" {
+				return errors.New("there is no base image cache to update, set KOCACHE")
+			}
+			if bo.NoCacheBase {
+				return errors.New("--no-cache-base can't be used with ko update-base")
+			}
+			if fo.Watch {
+				return errors.New("--watch can't be used with ko update-base")
+			}
+			if len(args) == 0 && len(fo.Filenames) == 0 {
+				return errors.New("ko update-base needs importpaths, or files passed with -f")
+			}
+			ctx := createCancellableContext()
+			builder, err := makeBuilder(ctx, bo)
+			if err != nil {
+				return fmt.Errorf("error creating builder: %v", err)
+			}
+			importpaths, err := warmImportPaths(ctx, builder, fo, so, args)
+			if err != nil {
+				return err
+			}
+			platform, err := targetPlatform(bo)
+			if err != nil {
+				return err
+			}
+			stats := &warmStats{}
+			if _, err := warmBases(withWarming(ctx, stats), getBaseImage(platform, bo), importpaths); err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(os.Stdout, "Updated %d base images in %s\n", len(stats.bases), dir)
+			return err
+		},
+	}
+	options.AddFileArg(update, fo)
+	options.AddSelectorArg(update, so)
+	options.AddBuildOptions(update, bo)
+	options.AddWarningsArg(update, wo)
+	update.RunE = withWarnings(wo, withTracing(update.RunE))
+	topLevel.AddCommand(update)
+}
+
+// warmImportPaths returns the importpaths in args, and those referenced by
+// the files in fo, found by resolving them without building anything. They
+// are qualified, like builds qualify them.
+func warmImportPaths(ctx context.Context, builder build.Interface, fo *options.FilenameOptions, so *options.SelectorOptions, args []string) ([]string, error) {
+	found := map[string]bool{}
+	for _, arg := range args {
+		ip, err := builder.QualifyImport(arg)
+		if err != nil {
+			return nil, err
+		}
+		if err := builder.IsSupportedReference(ip); err != nil {
+			return nil, fmt.Errorf("importpath %q is not supported: %v", ip, err)
+		}
+		found[ip] = true
+	}
+	if len(fo.Filenames) > 0 {
+		rec, err := build.NewCaching(&warmRecorder{Interface: builder, found: found})
+		if err != nil {
+			return nil, err
+		}
+		// Nothing is built, so, unlike resolveFilesToWriter, this doesn't
+		// warn about the 'builds' entries that none of it used.
+		q := newOutputQueue(ioutil.Discard, false)
+		defer q.Close()
+		if err := resolveFiles(ctx, rec, discardPublisher{}, fo, so, q, nil); err != nil {
+			return nil, err
+		}
+	}
+	importpaths := make([]string, 0, len(found))
+	for ip := range found {
+		importpaths = append(importpaths, ip)
+	}
+	sort.Strings(importpaths)
+	return importpaths, nil
+}
+
+// warmRecorder records the importpaths it would build, without building
+// them.
+type warmRecorder struct {
+	build.Interface
+
+	m     sync.Mutex
+	found map[string]bool
+}
+
+// Build implements build.Interface
+func (r *warmRecorder) Build(_ context.Context, ip string) (build.Result, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.found[ip] = true
+	return empty.Image, nil
+}
+
+// discardPublisher publishes nothing, for resolving files only to find
+// their importpaths.
+type discardPublisher struct{}
+
+// Publish implements publish.Interface
+func (discardPublisher) Publish(_ context.Context, _ build.Result, s string) (name.Reference, error) {
+	s = strings.ToLower(strings.TrimPrefix(s, build.StrictScheme))
+	return name.NewTag(publish.LocalDomain + "/" + s)
+}
+
+// Close implements publish.Interface
+func (discardPublisher) Close() error {
+	return nil
+}
+
+// warmCache caches the base images of importpaths, which builds with bo use,
+// and downloads the Go modules that building them needs.
+func warmCache(ctx context.Context, bo *options.BuildOptions, builder build.Interface, importpaths []string) (*warmStats, error) {
+	platform, err := targetPlatform(bo)
+	if err != nil {
+		return nil, err
+	}
+	stats := &warmStats{}
+	local, err := warmBases(withWarming(ctx, stats), getBaseImage(platform, bo), importpaths)
+	if err != nil {
+		return nil, err
+	}
+
+	env := append(os.Environ(), buildEnvOverrides(bo)...)
+	if !bo.Modules.IsZero() {
+		env = append(env, bo.Modules.Env()...)
+	}
+	if p, ok := firstPlatform(platform); ok {
+		env = append(env, "GOOS="+p[0], "GOARCH="+p[1])
+	}
+	stats.modules, stats.zipBytes, err = warmModules(ctx, bo.WorkingDirectory, env, local)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// warmBases fetches the base images of importpaths with getBase, and returns
+// those of importpaths that are built from the local module.
+func warmBases(ctx context.Context, getBase build.GetBase, importpaths []string) ([]string, error) {
+	var local []string
+	for _, ip := range importpaths {
+		// Like builds, combined images use the base of their entrypoint,
+		// and external importpaths that of any version of them.
+		baseFor := ip
+		ips := []string{ip}
+		if multi, ok := build.MultiImportPaths(ip); ok && len(multi) > 0 {
+			baseFor = build.StrictScheme + multi[0]
+			ips = nil
+			for _, m := range multi {
+				ips = append(ips, build.StrictScheme+m)
+			}
+		}
+		if external, _, ok := build.ExternalImportPath(baseFor); ok {
+			baseFor = build.StrictScheme + external
+		}
+		if _, _, err := getBase(ctx, baseFor); err != nil {
+			return nil, fmt.Errorf("fetching the base of %s: %v", ip, err)
+		}
+		// External importpaths are fetched in their own temporary
+		// modules when they're built.
+		for _, ip := range ips {
+			if _, _, ok := build.ExternalImportPath(ip); !ok {
+				local = append(local, strings.TrimPrefix(ip, build.StrictScheme))
+			}
+		}
+	}
+	return local, nil
+}
+
+// firstPlatform returns the os and arch of the first platform in spec, and
+// false for "all", or a platform without both.
+func firstPlatform(spec string) ([]string, bool) {
+	if spec == "all" {
+		return nil, false
+	}
+	parts := strings.Split(strings.TrimSpace(strings.Split(spec, ",")[0]), "/")
+	if len(parts) < 2 {
+		return nil, false
+	}
+	return parts[:2], true
+}
+
+// moduleTemplate prints the module providing a package, unless it's the
+// main module, or vendored, so that there's nothing to download. Modules
+// replaced by other versions are printed as their replacements, which are
+// what's downloaded.
+const moduleTemplate = `{{with .Module}}{{if .Replace}}{{if and .Replace.Version .Dir}}{{.Replace.Path}}@{{.Replace.Version}}{{end}}` +
+	`{{else if and .Version .Dir}}{{.Path}}@{{.Version}}{{end}}{{end}}`
+
+// warmModules downloads the modules providing the packages that importpaths
+// depend on, with go list and go mod download in dir with env, and returns
+// how many there are and the size of their zips.
+func warmModules(ctx context.Context, dir string, env []string, importpaths []string) (int, int64, error) {
+	if len(importpaths) == 0 {
+		return 0, 0, nil
+	}
+	bin := goBinary
+	if bin == "" {
+		bin = "go"
+	}
+	goCmd := func(args ...string) ([]byte, error) {
+		cmd := exec.CommandContext(ctx, bin, args...)
+		cmd.Dir = dir
+		cmd.Env = env
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("go %s: %v\n%s", args[0], err, stderr.String())
+		}
+		return out, nil
+	}
+
+	// Listing the packages downloads the modules they're in.
+	out, err := goCmd(append([]string{"list", "-deps", "-f", moduleTemplate}, importpaths...)...)
+	if err != nil {
+		return 0, 0, err
+	}
+	seen := map[string]bool{}
+	var mods []string
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		if mod := strings.TrimSpace(s.Text()); mod != "" && !seen[mod] {
+			seen[mod] = true
+			mods = append(mods, mod)
+		}
+	}
+	if len(mods) == 0 {
+		return 0, 0, nil
+	}
+
+	// go mod download reports where the zips are, and also makes sure
+	// that they're there, which builds in other directories need.
+	out, err = goCmd(append([]string{"mod", "download", "-json"}, mods...)...)
+	if err != nil {
+		return 0, 0, err
+	}
+	var size int64
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for {
+		var m struct {
+			Path, Version, Zip, Error string
+		}
+		if err := dec.Decode(&m); err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, 0, fmt.Errorf("go mod download: %v", err)
+		}
+		if m.Error != "" {
+			return 0, 0, fmt.Errorf("go mod download %s@%s: %s", m.Path, m.Version, m.Error)
+		}
+		if fi, err := os.Stat(m.Zip); err == nil {
+			size += fi.Size()
+		}
+	}
+	return len(mods), size, nil
+}
@@ -0,0 +1,215 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/commands/options"
+	"github.com/google/ko/pkg/registrytest"
+	"github.com/google/ko/pkg/warnings"
+)
+
+// setKOCACHE points KOCACHE at a new directory, and returns a func that
+// removes it and restores KOCACHE.
+func setKOCACHE(t *testing.T) func() {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "kocache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, had := os.LookupEnv("KOCACHE")
+	os.Setenv("KOCACHE", dir)
+	return func() {
+		if had {
+			os.Setenv("KOCACHE", old)
+		} else {
+			os.Unsetenv("KOCACHE")
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+// publishedResult records what it's asked to publish.
+type publishedResult struct {
+	discardPublisher
+	res build.Result
+}
+
+func (p *publishedResult) Publish(ctx context.Context, res build.Result, s string) (name.Reference, error) {
+	p.res = res
+	return p.discardPublisher.Publish(ctx, res, s)
+}
+
+func TestWarmThenResolveOffline(t *testing.T) {
+	defer setKOCACHE(t)()
+	reg := registrytest.New()
+	closed := false
+	defer func() {
+		if !closed {
+			reg.Close()
+		}
+	}()
+
+	base, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatalf("random.Image() = %v", err)
+	}
+	cf, err := base.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf.OS, cf.Architecture = "linux", "amd64"
+	base, err = mutate.ConfigFile(base, cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseRef := reg.Host() + "/base:latest"
+	if err := crane.Push(base, baseRef); err != nil {
+		t.Fatalf("crane.Push() = %v", err)
+	}
+
+	ctx := context.Background()
+	ip := build.StrictScheme + "github.com/google/ko/test"
+	input := yamlToTmpFile(t, []byte("image: "+ip+"\n"))
+	defer os.Remove(input)
+	fo := &options.FilenameOptions{Filenames: []string{input}}
+	newOptions := func() *options.BuildOptions {
+		return &options.BuildOptions{BaseImage: baseRef, Platform: "linux/amd64", NoCacheBuild: true}
+	}
+
+	bo := newOptions()
+	builder, err := makeBuilder(ctx, bo)
+	if err != nil {
+		t.Fatalf("makeBuilder() = %v", err)
+	}
+	importpaths, err := warmImportPaths(ctx, builder, fo, &options.SelectorOptions{}, nil)
+	if err != nil {
+		t.Fatalf("warmImportPaths() = %v", err)
+	}
+	if len(importpaths) != 1 || importpaths[0] != ip {
+		t.Fatalf("warmImportPaths() = %v, wanted [%s]", importpaths, ip)
+	}
+	stats, err := warmCache(ctx, bo, builder, importpaths)
+	if err != nil {
+		t.Fatalf("warmCache() = %v", err)
+	}
+	if len(stats.bases) != 1 || stats.baseBytes() == 0 {
+		t.Errorf("warmCache() cached %v, wanted the base", stats.bases)
+	}
+
+	// With the registry unreachable, resolving uses the warmed base.
+	reg.Close()
+	closed = true
+	c := &warnings.Collector{}
+	defer warnings.SetDefault(warnings.SetDefault(c))
+	builder, err = makeBuilder(ctx, newOptions())
+	if err != nil {
+		t.Fatalf("makeBuilder() = %v", err)
+	}
+	pub := &publishedResult{}
+	var buf bytes.Buffer
+	if err := resolveFilesToWriter(ctx, builder, pub, fo, &options.SelectorOptions{}, nopWriteCloser{&buf}); err != nil {
+		t.Fatalf("resolveFilesToWriter() = %v", err)
+	}
+	if !strings.Contains(buf.String(), "ko.local/") {
+		t.Errorf("resolveFilesToWriter() wrote %q, wanted the published reference", buf.String())
+	}
+	img, ok := pub.res.(v1.Image)
+	if !ok {
+		t.Fatalf("published %T, wanted an image", pub.res)
+	}
+	baseLayers, err := base.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range baseLayers {
+		wantDigest, err := want.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := layers[i].Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != wantDigest {
+			t.Errorf("layer %d = %s, wanted the base's %s", i, got, wantDigest)
+		}
+		// The layers must be readable, from the cache.
+		rc, err := layers[i].Compressed()
+		if err != nil {
+			t.Fatalf("Compressed() = %v", err)
+		}
+		if _, err := ioutil.ReadAll(rc); err != nil {
+			t.Errorf("reading layer %d = %v", i, err)
+		}
+		rc.Close()
+	}
+	if ws := c.Warnings(); len(ws) != 1 || ws[0].Code != warnings.BaseCache {
+		t.Errorf("warnings = %v, wanted one %s warning", ws, warnings.BaseCache)
+	}
+}
+
+func TestWarmDigestBaseOffline(t *testing.T) {
+	defer setKOCACHE(t)()
+	reg := registrytest.New()
+	base, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image() = %v", err)
+	}
+	tag := reg.Host() + "/base:latest"
+	if err := crane.Push(base, tag); err != nil {
+		t.Fatalf("crane.Push() = %v", err)
+	}
+	baseRef := reg.Host() + "/base@" + mustDigest(base).String()
+	ip := build.StrictScheme + "example.com/helloworld"
+
+	stats := &warmStats{}
+	getBase := getBaseImage("linux/amd64", &options.BuildOptions{BaseImage: baseRef})
+	if _, _, err := getBase(withWarming(context.Background(), stats), ip); err != nil {
+		t.Fatalf("warming getBaseImage() = %v", err)
+	}
+	reg.Close()
+
+	// Bases pinned by digest are read from the cache without a warning,
+	// since they can't have changed.
+	c := &warnings.Collector{}
+	defer warnings.SetDefault(warnings.SetDefault(c))
+	_, res, err := getBaseImage("linux/amd64", &options.BuildOptions{BaseImage: baseRef})(context.Background(), ip)
+	if err != nil {
+		t.Fatalf("getBaseImage() = %v", err)
+	}
+	if got := mustDigest(res.(v1.Image)); got != mustDigest(base) {
+		t.Errorf("getBaseImage() = %s, wanted %s", got, mustDigest(base))
+	}
+	if ws := c.Warnings(); len(ws) != 0 {
+		t.Errorf("warnings = %v, wanted none", ws)
+	}
+}
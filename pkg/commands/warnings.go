@@ -0,0 +1,44 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/google/ko/pkg/commands/options"
+	"github.com/google/ko/pkg/warnings"
+	"github.com/spf13/cobra"
+)
+
+// withWarnings wraps run to collect the warnings of its run, report them
+// grouped at its end, and fail it if they're errors per wo.
+func withWarnings(wo *options.WarningOptions, run func(*cobra.Command, []string) error) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		// Validate the codes before building anything.
+		if err := warnings.Check(nil, -1, wo.WarningsAsErrors); err != nil {
+			return fmt.Errorf("invalid --warnings-as-errors: %v", err)
+		}
+		c := &warnings.Collector{}
+		defer warnings.SetDefault(warnings.SetDefault(c))
+
+		err := run(cmd, args)
+		warnings.Report(log.Writer(), c.Warnings())
+		if err != nil {
+			return err
+		}
+		return warnings.Check(c.Warnings(), wo.MaxWarnings, wo.WarningsAsErrors)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/ko/pkg/commands/options"
+	"github.com/google/ko/pkg/warnings"
+	"github.com/spf13/cobra"
+)
+
+func TestWithWarnings(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	before := len(warnings.Default().Warnings())
+	runErr := errors.New("run failed")
+	for _, test := range []struct {
+		desc    string
+		wo      options.WarningOptions
+		err     error
+		wantErr string
+	}{{
+		desc: "warnings aren't errors by default",
+		wo:   options.WarningOptions{MaxWarnings: -1},
+	}, {
+		desc:    "the run's error wins",
+		wo:      options.WarningOptions{MaxWarnings: 0},
+		err:     runErr,
+		wantErr: "run failed",
+	}, {
+		desc:    "too many warnings",
+		wo:      options.WarningOptions{MaxWarnings: 1},
+		wantErr: "2 warnings, more than the 1 allowed",
+	}, {
+		desc:    "selected code",
+		wo:      options.WarningOptions{MaxWarnings: -1, WarningsAsErrors: []string{warnings.SkippedFile}},
+		wantErr: "1 warnings are errors",
+	}, {
+		desc: "unselected code",
+		wo:   options.WarningOptions{MaxWarnings: -1, WarningsAsErrors: []string{warnings.DigestMismatch}},
+	}, {
+		desc:    "unknown code",
+		wo:      options.WarningOptions{MaxWarnings: -1, WarningsAsErrors: []string{"bogus"}},
+		wantErr: "invalid --warnings-as-errors",
+	}} {
+		t.Run(test.desc, func(t *testing.T) {
+			logs.Reset()
+			wo := test.wo
+			run := withWarnings(&wo, func(*cobra.Command, []string) error {
+				warnings.Warnf(warnings.FloatingTag, "foo:latest is a tag")
+				warnings.Record(warnings.Warning{Code: warnings.SkippedFile, Message: "skipping b.txt", File: "b.txt"})
+				return test.err
+			})
+			err := run(nil, nil)
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Errorf("run() = %v", err)
+			case test.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), test.wantErr)):
+				t.Errorf("run() = %v, wanted %q", err, test.wantErr)
+			}
+			if test.wantErr == "invalid --warnings-as-errors" {
+				return
+			}
+			// The warnings are reported at the end of the run, even if it fails.
+			if !strings.Contains(logs.String(), "2 warnings:\n") {
+				t.Errorf("logs don't report the warnings:\n%s", logs.String())
+			}
+		})
+	}
+
+	// Warnings of a run don't leak into the default collector.
+	if got := warnings.Default().Warnings(); len(got) != before {
+		t.Errorf("default collector has %v", got[before:])
+	}
+}
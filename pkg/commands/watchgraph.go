@@ -0,0 +1,183 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	gb "go/build"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/ko/pkg/build"
+	"github.com/mattmoor/dep-notify/pkg/graph"
+)
+
+// watchGraph wraps a dep-notify graph to remember the importpaths added to
+// it, so that what it watches can be enumerated, which dep-notify doesn't
+// expose.
+type watchGraph struct {
+	graph.Interface
+	// workdir is the directory dep-notify resolves importpaths in.
+	workdir string
+
+	m     sync.Mutex
+	roots map[string]bool
+}
+
+func newWatchGraph(g graph.Interface) (*watchGraph, error) {
+	// dep-notify uses the current directory, see graph.WithCurrentDirectory.
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	return &watchGraph{Interface: g, workdir: wd, roots: map[string]bool{}}, nil
+}
+
+// Add implements graph.Interface
+func (w *watchGraph) Add(ip string) error {
+	if err := w.Interface.Add(ip); err != nil {
+		return err
+	}
+	w.m.Lock()
+	defer w.m.Unlock()
+	w.roots[ip] = true
+	return nil
+}
+
+// watchDump is the JSON written when dumping the watch graph.
+type watchDump struct {
+	ImportPaths []watchedImportPath `json:"importPaths"`
+}
+
+// watchedImportPath is what is watched for a single importpath.
+type watchedImportPath struct {
+	ImportPath string `json:"importPath"`
+	// Packages maps the importpaths of the packages whose directories are
+	// watched to those directories, including ImportPath itself.
+	Packages map[string]string `json:"packages"`
+	// Files are the yaml files that reference ImportPath, which are
+	// resolved again when it changes.
+	Files []string `json:"files,omitempty"`
+	// Error is why Packages couldn't be determined, if they couldn't.
+	Error string `json:"error,omitempty"`
+}
+
+// dump writes the importpaths added to the graph, their watch sets and the
+// files in sm (see resolveFilesToWriter) that reference each to w as JSON.
+func (w *watchGraph) dump(out io.Writer, sm *sync.Map) error {
+	files := map[string][]string{}
+	sm.Range(func(k, v interface{}) bool {
+		for _, ip := range watchedImportPaths(v.([]string)) {
+			files[ip] = append(files[ip], k.(string))
+		}
+		return true
+	})
+
+	w.m.Lock()
+	roots := make([]string, 0, len(w.roots))
+	for ip := range w.roots {
+		roots = append(roots, ip)
+	}
+	w.m.Unlock()
+	sort.Strings(roots)
+
+	d := watchDump{ImportPaths: make([]watchedImportPath, 0, len(roots))}
+	for _, ip := range roots {
+		wip := watchedImportPath{ImportPath: ip, Files: files[ip]}
+		sort.Strings(wip.Files)
+		pkgs, err := watchSet(w.workdir, ip)
+		if err != nil {
+			wip.Error = err.Error()
+		}
+		wip.Packages = pkgs
+		d.ImportPaths = append(d.ImportPaths, wip)
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d)
+}
+
+// watchSet returns the packages whose directories dep-notify watches for
+// ip, mapped to those directories. It walks the imports the same way: with
+// go/build from workdir, leaving out vendored packages and those outside
+// workdir, whose changes therefore don't trigger rebuilds.
+func watchSet(workdir, ip string) (map[string]string, error) {
+	// In module mode, go/build finds the main module from Dir, which is
+	// the current directory by default, like dep-notify uses.
+	ctx := gb.Default
+	ctx.Dir = workdir
+	pkgs := map[string]string{}
+	var visit func(ip string, root bool) error
+	visit = func(ip string, root bool) error {
+		pkg, err := ctx.Import(ip, workdir, gb.ImportComment)
+		if err != nil {
+			return err
+		}
+		if !root && (strings.Contains(pkg.ImportPath, "/vendor/") || !strings.HasPrefix(pkg.Dir, workdir)) {
+			return nil
+		}
+		name := pkg.ImportPath
+		if root {
+			name = ip
+		}
+		if _, ok := pkgs[name]; ok {
+			return nil
+		}
+		pkgs[name] = pkg.Dir
+		for _, dep := range pkg.Imports {
+			if dep == "C" {
+				continue
+			}
+			if err := visit(dep, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := visit(ip, true); err != nil {
+		return pkgs, err
+	}
+	return pkgs, nil
+}
+
+// writeWatchDump dumps w to path, or stderr if path is empty.
+func writeWatchDump(w *watchGraph, sm *sync.Map, path string) error {
+	if path == "" {
+		return w.dump(os.Stderr, sm)
+	}
+	return build.WriteFileAtomically(path, func(out io.Writer) error {
+		return w.dump(out, sm)
+	})
+}
+
+// explainWatch writes the watch set of ip, as dumped for --watch, to w.
+func explainWatch(w io.Writer, ip string) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	ip = strings.TrimPrefix(ip, build.StrictScheme)
+	pkgs, err := watchSet(wd, ip)
+	if err != nil {
+		return fmt.Errorf("computing the watch set of %s: %v", ip, err)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(watchedImportPath{ImportPath: ip, Packages: pkgs})
+}
@@ -0,0 +1,143 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/ko/pkg/build"
+)
+
+// watchFixture creates a module where cmd/a imports lib, which imports
+// lib/internal, and cmd/b imports only the standard library.
+func watchFixture(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "ko-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	for file, content := range map[string]string{
+		"go.mod":                   "module example.com/mono\n\ngo 1.16\n",
+		"lib/lib.go":               "package lib\n\nimport _ \"example.com/mono/lib/internal\"\n",
+		"lib/internal/internal.go": "package internal\n",
+		"cmd/a/main.go":            "package main\n\nimport (\n\t\"fmt\"\n\n\t_ \"example.com/mono/lib\"\n)\n\nfunc main() { fmt.Println() }\n",
+		"cmd/b/main.go":            "package main\n\nimport \"os\"\n\nfunc main() { os.Exit(0) }\n",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// nopGraph is a graph.Interface that watches nothing.
+type nopGraph struct{}
+
+func (nopGraph) Add(string) error { return nil }
+func (nopGraph) Shutdown() error  { return nil }
+
+func TestWatchGraph(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping go list in short mode")
+	}
+	dir := watchFixture(t)
+	defer os.RemoveAll(dir)
+	// The fixture has no vendor directory.
+	defer os.Setenv("GOFLAGS", os.Getenv("GOFLAGS"))
+	os.Setenv("GOFLAGS", "-mod=mod")
+
+	a, b := "example.com/mono/cmd/a", "example.com/mono/cmd/b"
+	wantA := map[string]string{
+		a:                               filepath.Join(dir, "cmd", "a"),
+		"example.com/mono/lib":          filepath.Join(dir, "lib"),
+		"example.com/mono/lib/internal": filepath.Join(dir, "lib", "internal"),
+	}
+	got, err := watchSet(dir, a)
+	if err != nil {
+		t.Fatalf("watchSet(%s) = %v", a, err)
+	}
+	if diff := cmp.Diff(wantA, got); diff != "" {
+		t.Errorf("watchSet(%s) (-want +got): %s", a, diff)
+	}
+
+	wg := &watchGraph{Interface: nopGraph{}, workdir: dir, roots: map[string]bool{}}
+	for _, ip := range []string{b, a} {
+		if err := wg.Add(ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var sm sync.Map
+	sm.Store("config/a.yaml", []string{build.StrictScheme + a})
+	sm.Store("config/all.yaml", []string{build.StrictScheme + b, build.StrictScheme + a})
+
+	var buf bytes.Buffer
+	if err := wg.dump(&buf, &sm); err != nil {
+		t.Fatalf("dump() = %v", err)
+	}
+	var dump watchDump
+	if err := json.Unmarshal(buf.Bytes(), &dump); err != nil {
+		t.Fatalf("json.Unmarshal() = %v\n%s", err, buf.String())
+	}
+	want := watchDump{ImportPaths: []watchedImportPath{{
+		ImportPath: a,
+		Packages:   wantA,
+		Files:      []string{"config/a.yaml", "config/all.yaml"},
+	}, {
+		ImportPath: b,
+		Packages:   map[string]string{b: filepath.Join(dir, "cmd", "b")},
+		Files:      []string{"config/all.yaml"},
+	}}}
+	if diff := cmp.Diff(want, dump); diff != "" {
+		t.Errorf("dump() (-want +got): %s", diff)
+	}
+
+	// --explain-watch prints the same for a single importpath.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	buf.Reset()
+	if err := explainWatch(&buf, build.StrictScheme+a); err != nil {
+		t.Fatalf("explainWatch() = %v", err)
+	}
+	var explained watchedImportPath
+	if err := json.Unmarshal(buf.Bytes(), &explained); err != nil {
+		t.Fatalf("json.Unmarshal() = %v\n%s", err, buf.String())
+	}
+	if diff := cmp.Diff(watchedImportPath{ImportPath: a, Packages: wantA}, explained); diff != "" {
+		t.Errorf("explainWatch() (-want +got): %s", diff)
+	}
+	if err := explainWatch(&buf, "example.com/mono/cmd/missing"); err == nil {
+		t.Error("explainWatch() of a missing package succeeded, wanted error")
+	}
+}
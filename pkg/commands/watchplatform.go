@@ -0,0 +1,80 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/commands/options"
+	"github.com/google/ko/pkg/warnings"
+)
+
+// watchContext returns ctx to resolve with. With --watch and several
+// platforms in --platform, builds are only for one of them, see
+// watchPlatform, so that rebuilding on each change is fast.
+func watchContext(ctx context.Context, bo *options.BuildOptions, fo *options.FilenameOptions) (context.Context, error) {
+	if !fo.Watch {
+		if fo.WatchPlatform != "" {
+			return nil, errors.New("--watch-platform requires --watch")
+		}
+		return ctx, nil
+	}
+	spec, err := targetPlatform(bo)
+	if err != nil {
+		return nil, err
+	}
+	platform, ok := watchPlatform(spec, fo.WatchPlatform, runtime.GOARCH)
+	if !ok {
+		return ctx, nil
+	}
+	ctx, err = build.WithPlatform(ctx, platform)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --watch-platform: %v", err)
+	}
+	if platform != spec {
+		warnings.Warnf(warnings.SinglePlatform, "--watch only builds images for %s, not --platform=%s, so they are single-platform; use --watch-platform to choose another", platform, spec)
+	}
+	return ctx, nil
+}
+
+// watchPlatform returns the platform to build for with --watch, and false if
+// builds should be for all of spec, the --platform: chosen, with
+// --watch-platform, or else when spec has several platforms, the one of them
+// for linux on hostArch, or the first if there's none.
+func watchPlatform(spec, chosen, hostArch string) (string, bool) {
+	if chosen != "" {
+		return chosen, true
+	}
+	if spec != "all" && !strings.Contains(spec, ",") {
+		return "", false
+	}
+	host := "linux/" + hostArch
+	if spec == "all" {
+		return host, true
+	}
+	platforms := strings.Split(spec, ",")
+	for _, p := range platforms {
+		p = strings.TrimSpace(p)
+		if p == host || strings.HasPrefix(p, host+"/") {
+			return p, true
+		}
+	}
+	return strings.TrimSpace(platforms[0]), true
+}
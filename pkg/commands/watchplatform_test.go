@@ -0,0 +1,93 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/ko/pkg/commands/options"
+)
+
+func TestWatchPlatform(t *testing.T) {
+	for _, test := range []struct {
+		desc     string
+		spec     string
+		chosen   string
+		hostArch string
+		want     string
+		wantOK   bool
+	}{{
+		desc:     "single platform",
+		spec:     "linux/amd64",
+		hostArch: "arm64",
+	}, {
+		desc:     "chosen",
+		spec:     "linux/amd64,linux/arm64",
+		chosen:   "linux/amd64",
+		hostArch: "arm64",
+		want:     "linux/amd64",
+		wantOK:   true,
+	}, {
+		desc:     "chosen with a single platform",
+		spec:     "linux/amd64",
+		chosen:   "linux/s390x",
+		hostArch: "amd64",
+		want:     "linux/s390x",
+		wantOK:   true,
+	}, {
+		desc:     "all",
+		spec:     "all",
+		hostArch: "arm64",
+		want:     "linux/arm64",
+		wantOK:   true,
+	}, {
+		desc:     "host in the list",
+		spec:     "linux/amd64, linux/arm64",
+		hostArch: "arm64",
+		want:     "linux/arm64",
+		wantOK:   true,
+	}, {
+		desc:     "host variant in the list",
+		spec:     "linux/amd64,linux/arm/v7",
+		hostArch: "arm",
+		want:     "linux/arm/v7",
+		wantOK:   true,
+	}, {
+		desc:     "host not in the list",
+		spec:     "linux/s390x,linux/ppc64le",
+		hostArch: "amd64",
+		want:     "linux/s390x",
+		wantOK:   true,
+	}} {
+		t.Run(test.desc, func(t *testing.T) {
+			got, ok := watchPlatform(test.spec, test.chosen, test.hostArch)
+			if got != test.want || ok != test.wantOK {
+				t.Errorf("watchPlatform() = %q, %t, wanted %q, %t", got, ok, test.want, test.wantOK)
+			}
+		})
+	}
+}
+
+func TestWatchContextErrors(t *testing.T) {
+	for _, fo := range []*options.FilenameOptions{
+		{WatchPlatform: "linux/amd64"},
+		{Watch: true, WatchPlatform: "linux/amd64/v2/extra"},
+	} {
+		if _, err := watchContext(context.Background(), &options.BuildOptions{}, fo); err == nil {
+			t.Errorf("watchContext(%+v) = nil, wanted an error", fo)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mattmoor/dep-notify/pkg/graph"
+)
+
+// watchSettler batches the notifications of --watch: it calls onSettled with
+// the importpaths of all the notifications it's given, once none has come
+// for settle, e.g. when a code generator is done rewriting files, rather
+// than once for each of them.
+type watchSettler struct {
+	settle    time.Duration
+	onSettled func(graph.StringSet)
+
+	m       sync.Mutex
+	pending graph.StringSet
+	timer   *time.Timer
+	// gen counts the notifications, so that a timer that was stopped too
+	// late to keep it from firing knows it's stale.
+	gen int
+}
+
+// newWatchSettler returns a watchSettler that calls onSettled. With a settle
+// of zero, it calls onSettled with each notification right away.
+func newWatchSettler(settle time.Duration, onSettled func(graph.StringSet)) *watchSettler {
+	return &watchSettler{settle: settle, onSettled: onSettled}
+}
+
+// notify records that the importpaths ss changed, and restarts the wait for
+// them to settle.
+func (s *watchSettler) notify(ss graph.StringSet) {
+	if s.settle <= 0 {
+		s.onSettled(ss)
+		return
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.pending == nil {
+		s.pending = graph.StringSet{}
+	}
+	for ip := range ss {
+		s.pending.Add(ip)
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.gen++
+	gen := s.gen
+	s.timer = time.AfterFunc(s.settle, func() { s.fire(gen) })
+}
+
+// fire calls onSettled with the pending importpaths, unless more changed
+// since notification gen.
+func (s *watchSettler) fire(gen int) {
+	s.m.Lock()
+	if gen != s.gen || len(s.pending) == 0 {
+		s.m.Unlock()
+		return
+	}
+	ss := s.pending
+	s.pending, s.timer = nil, nil
+	s.m.Unlock()
+	s.onSettled(ss)
+}
+
+// stop drops the pending notifications.
+func (s *watchSettler) stop() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.gen++
+	s.pending, s.timer = nil, nil
+}
+
+// rebuildQueue keeps --watch from resolving a file again while it's being
+// resolved: instead, a single follow-up is queued for when it's done,
+// however many times it's asked for.
+type rebuildQueue struct {
+	m       sync.Mutex
+	running map[string]bool
+	again   map[string]bool
+}
+
+func newRebuildQueue() *rebuildQueue {
+	return &rebuildQueue{running: map[string]bool{}, again: map[string]bool{}}
+}
+
+// begin returns whether key can be resolved now. Otherwise it's being
+// resolved, and a follow-up is queued.
+func (q *rebuildQueue) begin(key string) bool {
+	q.m.Lock()
+	defer q.m.Unlock()
+	if q.running[key] {
+		q.again[key] = true
+		return false
+	}
+	q.running[key] = true
+	return true
+}
+
+// end records that key was resolved, and returns whether a follow-up was
+// queued meanwhile, which the caller must start.
+func (q *rebuildQueue) end(key string) bool {
+	q.m.Lock()
+	defer q.m.Unlock()
+	delete(q.running, key)
+	again := q.again[key]
+	delete(q.again, key)
+	return again
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mattmoor/dep-notify/pkg/graph"
+)
+
+func TestWatchSettleGenerator(t *testing.T) {
+	const ip = "example.com/generated/cmd/app"
+
+	// Builds of the file run until release is closed, so the first is in
+	// flight during the whole burst.
+	var builds int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	q := newRebuildQueue()
+	var request func()
+	request = func() {
+		if !q.begin("config.yaml") {
+			return
+		}
+		atomic.AddInt32(&builds, 1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-release
+			if q.end("config.yaml") {
+				request()
+			}
+		}()
+	}
+	request()
+
+	var settled int32
+	settledCh := make(chan struct{}, 10)
+	s := newWatchSettler(500*time.Millisecond, func(ss graph.StringSet) {
+		if !ss.Has(ip) {
+			t.Errorf("settled with %v, wanted %s", ss, ip)
+		}
+		atomic.AddInt32(&settled, 1)
+		request()
+		settledCh <- struct{}{}
+	})
+	defer s.stop()
+
+	// A generator writing 50 files over 2 seconds, each of which dep-notify
+	// reports.
+	for i := 0; i < 50; i++ {
+		s.notify(graph.StringSet{ip: {}})
+		time.Sleep(40 * time.Millisecond)
+	}
+	select {
+	case <-settledCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("changes never settled")
+	}
+	// Asking again while the build is in flight doesn't stack follow-ups.
+	request()
+	request()
+
+	close(release)
+	wg.Wait()
+	// Let any stray timer fire.
+	time.Sleep(600 * time.Millisecond)
+
+	if got := atomic.LoadInt32(&settled); got != 1 {
+		t.Errorf("settled %d times, wanted 1", got)
+	}
+	if got := atomic.LoadInt32(&builds); got != 2 {
+		t.Errorf("built %d times, wanted 2: the one in flight, and one follow-up", got)
+	}
+}
+
+func TestWatchSettleZero(t *testing.T) {
+	var calls int
+	s := newWatchSettler(0, func(graph.StringSet) { calls++ })
+	for i := 0; i < 3; i++ {
+		s.notify(graph.StringSet{"example.com/app": {}})
+	}
+	if calls != 3 {
+		t.Errorf("onSettled called %d times, wanted 3 without a settle period", calls)
+	}
+}
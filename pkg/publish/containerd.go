@@ -0,0 +1,262 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/ko/pkg/build"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// ContainerdDomain is a sentinel "registry" that represents side-loading
+	// images into a containerd namespace.
+	ContainerdDomain = "containerd.local"
+
+	// DefaultContainerdNamespace is the namespace the kubelet's CRI plugin
+	// runs containers from.
+	DefaultContainerdNamespace = "k8s.io"
+)
+
+// CtrRunner runs containerd's ctr with args, and stdin if it isn't nil, and
+// returns its combined output.
+type CtrRunner func(ctx context.Context, stdin io.Reader, args ...string) ([]byte, error)
+
+func runCtr(ctx context.Context, stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "ctr", args...)
+	cmd.Stdin = stdin
+	return cmd.CombinedOutput()
+}
+
+type containerdPublisher struct {
+	address     string
+	namespace   string
+	snapshotter string
+	ctr         CtrRunner
+	namer       Namer
+	tags        []string
+}
+
+// ContainerdOption is a functional option for NewContainerd.
+type ContainerdOption func(*containerdPublisher) error
+
+// WithContainerdAddress is a functional option for the address of
+// containerd's socket, rather than CONTAINERD_ADDRESS or
+// /run/containerd/containerd.sock.
+func WithContainerdAddress(address string) ContainerdOption {
+	return func(c *containerdPublisher) error {
+		c.address = address
+		return nil
+	}
+}
+
+// WithContainerdNamespace is a functional option for the containerd
+// namespace to load images into, rather than DefaultContainerdNamespace.
+func WithContainerdNamespace(namespace string) ContainerdOption {
+	return func(c *containerdPublisher) error {
+		if namespace != "" {
+			c.namespace = namespace
+		}
+		return nil
+	}
+}
+
+// WithContainerdSnapshotter is a functional option for the snapshotter to
+// unpack images for, rather than containerd's default.
+func WithContainerdSnapshotter(snapshotter string) ContainerdOption {
+	return func(c *containerdPublisher) error {
+		c.snapshotter = snapshotter
+		return nil
+	}
+}
+
+// WithCtrRunner is a functional option for overriding how ctr is run, e.g.
+// to run it on another machine, or to test without containerd.
+func WithCtrRunner(ctr CtrRunner) ContainerdOption {
+	return func(c *containerdPublisher) error {
+		if ctr != nil {
+			c.ctr = ctr
+		}
+		return nil
+	}
+}
+
+// NewContainerd returns a new publish.Interface that loads images into a
+// containerd namespace, with ctr, and unpacks them so that containers can
+// run from them without pulling. The references it returns are to those
+// images, by tag, since containerd.local isn't a registry.
+//
+// ctr is used rather than containerd's Go client, which would add containerd
+// and its gRPC API to ko's dependencies, and since the node's own ctr speaks
+// the API of the containerd it's installed with. Unless WithCtrRunner is
+// passed, it's an error if ctr isn't on PATH.
+func NewContainerd(namer Namer, tags []string, opts ...ContainerdOption) (Interface, error) {
+	c := &containerdPublisher{
+		namespace: DefaultContainerdNamespace,
+		namer:     namer,
+		tags:      tags,
+	}
+	for _, option := range opts {
+		if err := option(c); err != nil {
+			return nil, err
+		}
+	}
+	if c.ctr == nil {
+		if _, err := exec.LookPath("ctr"); err != nil {
+			return nil, errors.New("loading images into containerd needs its ctr command, which isn't on PATH: " +
+				"install containerd's ctr, or set KO_DOCKER_REPO to publish elsewhere")
+		}
+		c.ctr = runCtr
+	}
+	return c, nil
+}
+
+// globalArgs returns the ctr flags that select the containerd instance and
+// namespace.
+func (c *containerdPublisher) globalArgs() []string {
+	args := []string{"--namespace=" + c.namespace}
+	if c.address != "" {
+		args = append([]string{"--address=" + c.address}, args...)
+	}
+	return args
+}
+
+// run runs ctr, and explains the errors that are down to reaching
+// containerd.
+func (c *containerdPublisher) run(ctx context.Context, stdin io.Reader, args ...string) error {
+	out, err := c.ctr(ctx, stdin, append(c.globalArgs(), args...)...)
+	if err == nil {
+		return nil
+	}
+	address := c.address
+	if address == "" {
+		address = "containerd's socket"
+	}
+	msg := strings.TrimSpace(string(out))
+	switch {
+	case strings.Contains(msg, "permission denied"):
+		return fmt.Errorf("permission denied connecting to %s: run ko as a user that can access it "+
+			"(e.g. root, or a member of the group that owns it), or pass --containerd-address\n%s", address, msg)
+	case strings.Contains(msg, "no such file or directory") && strings.Contains(msg, "dial"):
+		return fmt.Errorf("containerd isn't running at %s, start it or pass --containerd-address\n%s", address, msg)
+	}
+	return fmt.Errorf("ctr %s: %v\n%s", strings.Join(args, " "), err, msg)
+}
+
+// Publish implements publish.Interface
+func (c *containerdPublisher) Publish(ctx context.Context, br build.Result, s string) (name.Reference, error) {
+	s = strings.TrimPrefix(s, build.StrictScheme)
+	// https://github.com/google/go-containerregistry/issues/212
+	s = strings.ToLower(s)
+
+	// Images are imported from a tarball, which can't hold an index, so
+	// attempt to downcast it to an image.
+	var img v1.Image
+	switch i := br.(type) {
+	case v1.Image:
+		img = i
+	case v1.ImageIndex:
+		im, err := i.IndexManifest()
+		if err != nil {
+			return nil, err
+		}
+		goos, goarch := os.Getenv("GOOS"), os.Getenv("GOARCH")
+		if goos == "" {
+			goos = "linux"
+		}
+		if goarch == "" {
+			goarch = "amd64"
+		}
+		for _, manifest := range im.Manifests {
+			if manifest.Platform == nil || manifest.Platform.OS != goos || manifest.Platform.Architecture != goarch {
+				continue
+			}
+			if img, err = i.Image(manifest.Digest); err != nil {
+				return nil, err
+			}
+			break
+		}
+		if img == nil {
+			return nil, fmt.Errorf("failed to find %s/%s image in index for image: %v", goos, goarch, s)
+		}
+	default:
+		return nil, fmt.Errorf("failed to interpret %s result as image: %v", s, br)
+	}
+
+	h, err := img.Digest()
+	if err != nil {
+		return nil, err
+	}
+	digestTag, err := name.NewTag(fmt.Sprintf("%s:%s", c.namer(ContainerdDomain, s), h.Hex))
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Loading %v into containerd namespace %s", digestTag, c.namespace)
+	pr, pw := io.Pipe()
+	var grp errgroup.Group
+	grp.Go(func() error {
+		return pw.CloseWithError(tarball.Write(digestTag, img, pw))
+	})
+	args := []string{"images", "import"}
+	if c.snapshotter != "" {
+		args = append(args, "--snapshotter="+c.snapshotter)
+	}
+	err = c.run(ctx, pr, append(args, "-")...)
+	// Stop the tarball from being written if ctr didn't read all of it.
+	pr.Close()
+	if err != nil {
+		grp.Wait()
+		return nil, fmt.Errorf("failed to load %v into containerd: %w", digestTag, err)
+	}
+	if err := grp.Wait(); err != nil {
+		return nil, fmt.Errorf("failed to write intermediate tarball representation: %w", err)
+	}
+	log.Printf("Loaded %v", digestTag)
+
+	tags, err := expandTags(c.tags, br)
+	if err != nil {
+		return nil, err
+	}
+	for _, tagName := range tags {
+		log.Printf("Adding tag %v", tagName)
+		tag, err := name.NewTag(fmt.Sprintf("%s:%s", c.namer(ContainerdDomain, s), tagName))
+		if err != nil {
+			return nil, err
+		}
+		if err := c.run(ctx, nil, "images", "tag", "--force", digestTag.String(), tag.String()); err != nil {
+			return nil, fmt.Errorf("failed to tag %v as %v: %w", digestTag, tag, err)
+		}
+		log.Printf("Added tag %v", tagName)
+	}
+
+	return &digestTag, nil
+}
+
+// Close implements publish.Interface
+func (c *containerdPublisher) Close() error {
+	return nil
+}
@@ -0,0 +1,163 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/ko/pkg/publish"
+)
+
+// fakeContainerd records what's imported and tagged with ctr.
+type fakeContainerd struct {
+	images map[string][]byte
+	calls  [][]string
+}
+
+func (f *fakeContainerd) ctr(ctx context.Context, stdin io.Reader, args ...string) ([]byte, error) {
+	f.calls = append(f.calls, args)
+	i := 0
+	for i < len(args) && strings.HasPrefix(args[i], "--") {
+		i++
+	}
+	switch cmd := args[i : i+2]; strings.Join(cmd, " ") {
+	case "images import":
+		b, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			return nil, err
+		}
+		m, err := tarball.LoadManifest(func() (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(b)), nil })
+		if err != nil {
+			return []byte(err.Error()), errors.New("exit status 1")
+		}
+		for _, tag := range m[0].RepoTags {
+			f.images[tag] = b
+		}
+	case "images tag":
+		src, dst := args[len(args)-2], args[len(args)-1]
+		f.images[dst] = f.images[src]
+	}
+	return nil, nil
+}
+
+func TestContainerd(t *testing.T) {
+	importpath := "github.com/google/ko"
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image() = %v", err)
+	}
+	h, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := &fakeContainerd{images: map[string][]byte{}}
+	def, err := publish.NewContainerd(md5Hash, []string{"latest"},
+		publish.WithContainerdAddress("/run/k3s/containerd/containerd.sock"),
+		publish.WithContainerdSnapshotter("native"),
+		publish.WithCtrRunner(fake.ctr))
+	if err != nil {
+		t.Fatalf("NewContainerd() = %v", err)
+	}
+
+	ref, err := def.Publish(context.Background(), img, importpath)
+	if err != nil {
+		t.Fatalf("Publish() = %v", err)
+	}
+	want := md5Hash(publish.ContainerdDomain, importpath) + ":" + h.Hex
+	if ref.String() != want {
+		t.Errorf("Publish() = %v, wanted %v", ref, want)
+	}
+
+	wantImport := []string{"--address=/run/k3s/containerd/containerd.sock", "--namespace=k8s.io", "images", "import", "--snapshotter=native", "-"}
+	if got := strings.Join(fake.calls[0], " "); got != strings.Join(wantImport, " ") {
+		t.Errorf("ctr %s, wanted ctr %s", got, strings.Join(wantImport, " "))
+	}
+
+	// The reference in the yaml names the image containerd has, as does the
+	// tag.
+	for _, tag := range []string{ref.String(), md5Hash(publish.ContainerdDomain, importpath) + ":latest"} {
+		b, ok := fake.images[tag]
+		if !ok {
+			t.Fatalf("containerd has no image %s, has %v", tag, fake.images)
+		}
+		loaded, err := tarball.Image(func() (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(b)), nil }, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := loaded.Digest(); err != nil || got != h {
+			t.Errorf("containerd image %s digest = %v, %v, wanted %v", tag, got, err, h)
+		}
+	}
+	if _, err := name.ParseReference(ref.String()); err != nil {
+		t.Errorf("ParseReference(%s) = %v", ref, err)
+	}
+}
+
+func TestContainerdErrors(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image() = %v", err)
+	}
+	for _, test := range []struct {
+		desc    string
+		out     string
+		wantErr string
+	}{{
+		desc:    "socket permission",
+		out:     `ctr: failed to dial "/run/containerd/containerd.sock": connection error: desc = "transport: error while dialing: dial unix /run/containerd/containerd.sock: connect: permission denied"`,
+		wantErr: "permission denied connecting to /run/containerd/containerd.sock: run ko as a user that can access it",
+	}, {
+		desc:    "not running",
+		out:     `ctr: failed to dial "/run/containerd/containerd.sock": connection error: desc = "transport: error while dialing: dial unix /run/containerd/containerd.sock: connect: no such file or directory"`,
+		wantErr: "containerd isn't running at /run/containerd/containerd.sock",
+	}, {
+		desc:    "other",
+		out:     "ctr: unrecognized image format",
+		wantErr: "ctr images import -: exit status 1\nctr: unrecognized image format",
+	}} {
+		t.Run(test.desc, func(t *testing.T) {
+			def, err := publish.NewContainerd(md5Hash, nil,
+				publish.WithContainerdAddress("/run/containerd/containerd.sock"),
+				publish.WithCtrRunner(func(context.Context, io.Reader, ...string) ([]byte, error) {
+					return []byte(test.out), errors.New("exit status 1")
+				}))
+			if err != nil {
+				t.Fatalf("NewContainerd() = %v", err)
+			}
+			if _, err := def.Publish(context.Background(), img, "github.com/google/ko"); err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("Publish() = %v, wanted error containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestContainerdWithoutCtr(t *testing.T) {
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", t.TempDir())
+	if _, err := publish.NewContainerd(md5Hash, nil); err == nil || !strings.Contains(err.Error(), "needs its ctr command") {
+		t.Errorf("NewContainerd() without ctr = %v, wanted an error about ctr", err)
+	}
+}
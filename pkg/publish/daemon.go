@@ -23,6 +23,8 @@ import (
 	"os"
 	"strings"
 
+	"github.com/docker/docker/api/types"
+	dockerclient "github.com/docker/docker/client"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/daemon"
@@ -88,6 +90,32 @@ func (d *demon) getOpts(ctx context.Context) []daemon.Option {
 	}
 }
 
+// pinger is implemented by daemon clients that can check that the daemon is
+// reachable, like the default one.
+type pinger interface {
+	Ping(ctx context.Context) (types.Ping, error)
+}
+
+// PingDaemon checks that the daemon that client talks to, or else the default
+// client from the environment (e.g. DOCKER_HOST), is reachable, so that we can
+// fail before building anything. Clients that can't ping are assumed to be.
+func PingDaemon(ctx context.Context, client daemon.Client) error {
+	if client == nil {
+		c, err := dockerclient.NewClientWithOpts(dockerclient.FromEnv)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		client = c
+	}
+	p, ok := client.(pinger)
+	if !ok {
+		return nil
+	}
+	_, err := p.Ping(ctx)
+	return err
+}
+
 // Publish implements publish.Interface
 func (d *demon) Publish(ctx context.Context, br build.Result, s string) (name.Reference, error) {
 	s = strings.TrimPrefix(s, build.StrictScheme)
@@ -151,7 +179,11 @@ func (d *demon) Publish(ctx context.Context, br build.Result, s string) (name.Re
 	}
 	log.Printf("Loaded %v", digestTag)
 
-	for _, tagName := range d.tags {
+	tags, err := expandTags(d.tags, br)
+	if err != nil {
+		return nil, err
+	}
+	for _, tagName := range tags {
 		log.Printf("Adding tag %v", tagName)
 		tag, err := name.NewTag(fmt.Sprintf("%s:%s", d.namer(d.base, s), tagName))
 		if err != nil {
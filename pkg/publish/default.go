@@ -29,6 +29,7 @@ import (
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/warnings"
 )
 
 // defalt is intentionally misspelled to avoid keyword collision (and drive Jon nuts).
@@ -39,8 +40,11 @@ type defalt struct {
 	auth      authn.Authenticator
 	namer     Namer
 	tags      []string
-	tagOnly   bool
+	style     ResolveStyle
 	insecure  bool
+	retry     retryPolicy
+	post      PostPublish
+	sboms     *build.SBOMs
 }
 
 // Option is a functional option for NewDefault.
@@ -53,8 +57,12 @@ type defaultOpener struct {
 	auth      authn.Authenticator
 	namer     Namer
 	tags      []string
-	tagOnly   bool
+	style     ResolveStyle
 	insecure  bool
+	retry     retryPolicy
+	post      PostPublish
+	limiter   *RateLimiter
+	sboms     *build.SBOMs
 }
 
 // Namer is a function from a supported import path to the portion of the resulting
@@ -71,25 +79,49 @@ func identity(base, in string) string { return path.Join(base, in) }
 // is the 'latest' tag.
 var defaultTags = []string{"latest"}
 
+// ResolveStyle is what the references returned by Publish include.
+type ResolveStyle string
+
+const (
+	// ResolveDigest references are repo@digest.
+	ResolveDigest ResolveStyle = "digest"
+	// ResolveTag references are repo:tag, with the first tag, e.g. for
+	// pull-through caches that can only serve by tag.
+	ResolveTag ResolveStyle = "tag"
+	// ResolveTagAndDigest references are repo:tag@digest, with the first
+	// tag.
+	ResolveTagAndDigest ResolveStyle = "tag-and-digest"
+)
+
 func (do *defaultOpener) Open() (Interface, error) {
-	if do.tagOnly {
-		if len(do.tags) != 1 {
-			return nil, errors.New("must specify exactly one tag to resolve images into tag-only references")
-		}
-		if do.tags[0] == defaultTags[0] {
-			return nil, errors.New("latest tag cannot be used in tag-only references")
+	switch do.style {
+	case "", ResolveDigest, ResolveTagAndDigest:
+	case ResolveTag:
+		if len(do.tags) == 0 || do.tags[0] == defaultTags[0] {
+			return nil, errors.New("must specify a tag other than latest to resolve images into tag-only references")
 		}
+		warnings.Warnf(warnings.FloatingTag, "resolving images into tag-only references to %q, which can be moved to other images after they're deployed", do.tags[0])
+	default:
+		return nil, fmt.Errorf("unknown resolve style %q, expected %s, %s or %s", do.style, ResolveDigest, ResolveTag, ResolveTagAndDigest)
+	}
+
+	t := do.t
+	if do.limiter != nil {
+		t = &rateLimitedTransport{inner: t, limiter: do.limiter}
 	}
 
 	return &defalt{
 		base:      do.base,
-		t:         do.t,
+		t:         t,
 		userAgent: do.userAgent,
 		auth:      do.auth,
 		namer:     do.namer,
 		tags:      do.tags,
-		tagOnly:   do.tagOnly,
+		style:     do.style,
 		insecure:  do.insecure,
+		retry:     do.retry,
+		post:      do.post,
+		sboms:     do.sboms,
 	}, nil
 }
 
@@ -150,7 +182,11 @@ func (d *defalt) Publish(ctx context.Context, br build.Result, s string) (name.R
 		no = append(no, name.Insecure)
 	}
 
-	for i, tagName := range d.tags {
+	tags, err := expandTags(d.tags, br)
+	if err != nil {
+		return nil, err
+	}
+	for i, tagName := range tags {
 		tag, err := name.NewTag(fmt.Sprintf("%s:%s", d.namer(d.base, s), tagName), no...)
 		if err != nil {
 			return nil, err
@@ -158,24 +194,34 @@ func (d *defalt) Publish(ctx context.Context, br build.Result, s string) (name.R
 
 		if i == 0 {
 			log.Printf("Publishing %v", tag)
-			if err := pushResult(tag, br, ro); err != nil {
+			if err := d.retry.do(ctx, "Publishing "+tag.String(), func() error {
+				return pushResult(tag, br, ro)
+			}); err != nil {
 				return nil, err
 			}
 		} else {
 			log.Printf("Tagging %v", tag)
-			if err := remote.Tag(tag, br, ro...); err != nil {
+			if err := d.retry.do(ctx, "Tagging "+tag.String(), func() error {
+				return remote.Tag(tag, br, ro...)
+			}); err != nil {
 				return nil, err
 			}
 		}
 	}
 
-	if d.tagOnly {
-		// We have already validated that there is a single tag (not latest).
-		tag, err := name.NewTag(fmt.Sprintf("%s:%s", d.namer(d.base, s), d.tags[0]))
-		if err != nil {
-			return nil, err
+	style := d.style
+	if style == "" {
+		// If a single tag is explicitly set (not latest), then this
+		// is probably a release, so include the tag in the reference.
+		style = ResolveDigest
+		if len(tags) == 1 && tags[0] != defaultTags[0] {
+			style = ResolveTagAndDigest
 		}
-		return &tag, nil
+	}
+	// We have already validated that the first tag isn't latest, but a
+	// template may have fallen back to it.
+	if style == ResolveTag && tags[0] == defaultTags[0] {
+		return nil, fmt.Errorf("cannot resolve %s into a tag-only reference with tag %q", s, d.tags[0])
 	}
 
 	h, err := br.Digest()
@@ -183,16 +229,36 @@ func (d *defalt) Publish(ctx context.Context, br build.Result, s string) (name.R
 		return nil, err
 	}
 	ref := fmt.Sprintf("%s@%s", d.namer(d.base, s), h)
-	if len(d.tags) == 1 && d.tags[0] != defaultTags[0] {
-		// If a single tag is explicitly set (not latest), then this
-		// is probably a release, so include the tag in the reference.
-		ref = fmt.Sprintf("%s:%s@%s", d.namer(d.base, s), d.tags[0], h)
+	if style != ResolveDigest {
+		ref = fmt.Sprintf("%s:%s@%s", d.namer(d.base, s), tags[0], h)
 	}
-	dig, err := name.NewDigest(ref)
+	dig, err := name.NewDigest(ref, no...)
 	if err != nil {
 		return nil, err
 	}
+	if d.sboms != nil {
+		if err := d.retry.do(ctx, "Attaching SBOMs to "+dig.String(), func() error {
+			return pushSBOMs(dig.Context(), br, d.sboms, ro)
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if d.post != nil {
+		if err := d.retry.do(ctx, "Post-processing "+dig.String(), func() error {
+			return d.post(ctx, dig, ro)
+		}); err != nil {
+			return nil, err
+		}
+	}
 	log.Printf("Published %v", dig)
+
+	if style == ResolveTag {
+		tag, err := name.NewTag(fmt.Sprintf("%s:%s", d.namer(d.base, s), tags[0]), no...)
+		if err != nil {
+			return nil, err
+		}
+		return &tag, nil
+	}
 	return &dig, nil
 }
 
@@ -19,19 +19,22 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
-	"net/http"
-	"net/http/httptest"
-	"net/url"
 	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-containerregistry/pkg/crane"
 	"github.com/google/go-containerregistry/pkg/name"
-	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/random"
 	"github.com/google/ko/pkg/build"
 	"github.com/google/ko/pkg/publish"
+	"github.com/google/ko/pkg/registrytest"
+	specsv1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 var (
@@ -45,18 +48,14 @@ func TestDefault(t *testing.T) {
 		importpath := "github.com/Google/go-containerregistry/cmd/crane"
 		expectedRepo := fmt.Sprintf("%s/%s", base, strings.ToLower(importpath))
 
-		server := httptest.NewServer(registry.New())
-		defer server.Close()
-		u, err := url.Parse(server.URL)
-		if err != nil {
-			t.Fatalf("url.Parse(%v) = %v", server.URL, err)
-		}
-		tag, err := name.NewTag(fmt.Sprintf("%s/%s:latest", u.Host, expectedRepo))
+		reg := registrytest.New()
+		defer reg.Close()
+		tag, err := name.NewTag(fmt.Sprintf("%s/%s:latest", reg.Host(), expectedRepo))
 		if err != nil {
 			t.Fatalf("NewTag() = %v", err)
 		}
 
-		repoName := fmt.Sprintf("%s/%s", u.Host, base)
+		repoName := fmt.Sprintf("%s/%s", reg.Host(), base)
 		def, err := publish.NewDefault(repoName)
 		if err != nil {
 			t.Errorf("NewDefault() = %v", err)
@@ -82,18 +81,14 @@ func TestDefaultWithCustomNamer(t *testing.T) {
 		importpath := "github.com/Google/go-containerregistry/cmd/crane"
 		expectedRepo := fmt.Sprintf("%s/%s", base, strings.ToLower(importpath))
 
-		server := httptest.NewServer(registry.New())
-		defer server.Close()
-		u, err := url.Parse(server.URL)
-		if err != nil {
-			t.Fatalf("url.Parse(%v) = %v", server.URL, err)
-		}
-		tag, err := name.NewTag(fmt.Sprintf("%s/%s:latest", u.Host, expectedRepo))
+		reg := registrytest.New()
+		defer reg.Close()
+		tag, err := name.NewTag(fmt.Sprintf("%s/%s:latest", reg.Host(), expectedRepo))
 		if err != nil {
 			t.Fatalf("NewTag() = %v", err)
 		}
 
-		repoName := fmt.Sprintf("%s/%s", u.Host, base)
+		repoName := fmt.Sprintf("%s/%s", reg.Host(), base)
 
 		def, err := publish.NewDefault(repoName, publish.WithNamer(md5Hash))
 		if err != nil {
@@ -114,18 +109,14 @@ func TestDefaultWithTags(t *testing.T) {
 		importpath := "github.com/Google/go-containerregistry/cmd/crane"
 		expectedRepo := fmt.Sprintf("%s/%s", base, strings.ToLower(importpath))
 
-		server := httptest.NewServer(registry.New())
-		defer server.Close()
-		u, err := url.Parse(server.URL)
-		if err != nil {
-			t.Fatalf("url.Parse(%v) = %v", server.URL, err)
-		}
-		tag, err := name.NewTag(fmt.Sprintf("%s/%s:notLatest", u.Host, expectedRepo))
+		reg := registrytest.New()
+		defer reg.Close()
+		tag, err := name.NewTag(fmt.Sprintf("%s/%s:notLatest", reg.Host(), expectedRepo))
 		if err != nil {
 			t.Fatalf("NewTag() = %v", err)
 		}
 
-		repoName := fmt.Sprintf("%s/%s", u.Host, base)
+		repoName := fmt.Sprintf("%s/%s", reg.Host(), base)
 
 		def, err := publish.NewDefault(repoName, publish.WithTags([]string{"notLatest", "v1.2.3"}))
 		if err != nil {
@@ -139,7 +130,7 @@ func TestDefaultWithTags(t *testing.T) {
 			t.Errorf("Publish() = %v, wanted suffix %v", d.Context(), md5Hash("", importpath))
 		}
 
-		otherTag := fmt.Sprintf("%s/%s:v1.2.3", u.Host, expectedRepo)
+		otherTag := fmt.Sprintf("%s/%s:v1.2.3", reg.Host(), expectedRepo)
 
 		first, err := crane.Digest(tag.String())
 		if err != nil {
@@ -156,6 +147,61 @@ func TestDefaultWithTags(t *testing.T) {
 	}
 }
 
+func TestDefaultWithModuleVersionTag(t *testing.T) {
+	withVersion := func(t *testing.T, version string) v1.Image {
+		t.Helper()
+		img, err := random.Image(1024, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		labeled, err := mutate.Config(img, v1.Config{Labels: map[string]string{specsv1.AnnotationVersion: version}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return labeled
+	}
+
+	for _, test := range []struct {
+		description string
+		br          build.Result
+		wantTags    []string
+	}{{
+		description: "module version",
+		br:          withVersion(t, "v1.4.2"),
+		wantTags:    []string{"v1.4.2", "v1.4.2-linux"},
+	}, {
+		description: "build metadata",
+		br:          withVersion(t, "v2.0.0+incompatible"),
+		wantTags:    []string{"v2.0.0-incompatible", "v2.0.0-incompatible-linux"},
+	}, {
+		description: "no module version",
+		br:          withVersion(t, ""),
+		wantTags:    []string{"latest"},
+	}} {
+		t.Run(test.description, func(t *testing.T) {
+			reg := registrytest.New()
+			defer reg.Close()
+			repoName := fmt.Sprintf("%s/%s", reg.Host(), "blah")
+
+			def, err := publish.NewDefault(repoName, publish.WithTags([]string{"{{.Module.Version}}", "{{.Module.Version}}-linux"}))
+			if err != nil {
+				t.Fatalf("NewDefault() = %v", err)
+			}
+			if _, err := def.Publish(context.Background(), test.br, build.StrictScheme+"github.com/google/ko/cmd/app"); err != nil {
+				t.Fatalf("Publish() = %v", err)
+			}
+			got, err := crane.ListTags(repoName + "/github.com/google/ko/cmd/app")
+			if err != nil {
+				t.Fatalf("ListTags() = %v", err)
+			}
+			sort.Strings(got)
+			if diff := cmp.Diff(test.wantTags, got); diff != "" {
+				t.Errorf("tags (-want +got): %s", diff)
+			}
+		})
+	}
+}
+
 func TestDefaultWithReleaseTag(t *testing.T) {
 	img, err := random.Image(1024, 1)
 	if err != nil {
@@ -165,48 +211,14 @@ func TestDefaultWithReleaseTag(t *testing.T) {
 	releaseTag := "v1.2.3"
 	importpath := "github.com/Google/go-containerregistry/cmd/crane"
 	expectedRepo := fmt.Sprintf("%s/%s", base, strings.ToLower(importpath))
-	headPathPrefix := fmt.Sprintf("/v2/%s/blobs/", expectedRepo)
-	initiatePath := fmt.Sprintf("/v2/%s/blobs/uploads/", expectedRepo)
-	manifestPath := fmt.Sprintf("/v2/%s/manifests/", expectedRepo)
-
-	createdTags := make(map[string]struct{})
-
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodHead && strings.HasPrefix(r.URL.Path, headPathPrefix) && r.URL.Path != initiatePath {
-			http.Error(w, "NotFound", http.StatusNotFound)
-			return
-		}
-		switch {
-		case r.URL.Path == "/v2/":
-			w.WriteHeader(http.StatusOK)
-		case r.URL.Path == initiatePath:
-			if r.Method != http.MethodPost {
-				t.Errorf("Method; got %v, want %v", r.Method, http.MethodPost)
-			}
-			http.Error(w, "Mounted", http.StatusCreated)
-		case strings.HasPrefix(r.URL.Path, manifestPath):
-			if r.Method != http.MethodPut {
-				t.Errorf("Method; got %v, want %v", r.Method, http.MethodPut)
-			}
-
-			createdTags[strings.TrimPrefix(r.URL.Path, manifestPath)] = struct{}{}
-
-			http.Error(w, "Created", http.StatusCreated)
-		default:
-			t.Fatalf("Unexpected path: %v", r.URL.Path)
-		}
-	}))
-	defer server.Close()
-	u, err := url.Parse(server.URL)
-	if err != nil {
-		t.Fatalf("url.Parse(%v) = %v", server.URL, err)
-	}
-	tag, err := name.NewTag(fmt.Sprintf("%s/%s:notLatest", u.Host, expectedRepo))
+	reg := registrytest.New()
+	defer reg.Close()
+	tag, err := name.NewTag(fmt.Sprintf("%s/%s:notLatest", reg.Host(), expectedRepo))
 	if err != nil {
 		t.Fatalf("NewTag() = %v", err)
 	}
 
-	repoName := fmt.Sprintf("%s/%s", u.Host, base)
+	repoName := fmt.Sprintf("%s/%s", reg.Host(), base)
 
 	def, err := publish.NewDefault(repoName, publish.WithTags([]string{releaseTag}))
 	if err != nil {
@@ -222,8 +234,8 @@ func TestDefaultWithReleaseTag(t *testing.T) {
 		t.Errorf("Publish() = %v, wanted tag included: %v", d.String(), releaseTag)
 	}
 
-	if _, ok := createdTags["v1.2.3"]; !ok {
-		t.Errorf("Tag v1.2.3 was not created.")
+	if !reg.HasManifest(expectedRepo, releaseTag) {
+		t.Errorf("Tag %s was not created.", releaseTag)
 	}
 
 	def, err = publish.NewDefault(repoName, publish.WithTags([]string{releaseTag}), publish.WithTagOnly(true))
@@ -243,3 +255,224 @@ func TestDefaultWithReleaseTag(t *testing.T) {
 	}
 
 }
+
+func TestDefaultResolveStyle(t *testing.T) {
+	const importpath = "github.com/google/ko/cmd/app"
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image() = %v", err)
+	}
+	h, err := img.Digest()
+	if err != nil {
+		t.Fatalf("Digest() = %v", err)
+	}
+	reg := registrytest.New()
+	defer reg.Close()
+	repoName := reg.Host() + "/blah"
+	repo := repoName + "/" + importpath
+
+	for _, test := range []struct {
+		description string
+		style       publish.ResolveStyle
+		tags        []string
+		want        string
+		wantErr     bool
+	}{{
+		description: "default",
+		want:        repo + "@" + h.String(),
+	}, {
+		description: "default with a release tag",
+		tags:        []string{"v1.2.3"},
+		want:        repo + ":v1.2.3@" + h.String(),
+	}, {
+		description: "digest",
+		style:       publish.ResolveDigest,
+		tags:        []string{"v1.2.3"},
+		want:        repo + "@" + h.String(),
+	}, {
+		description: "tag",
+		style:       publish.ResolveTag,
+		tags:        []string{"v1.2.3", "stable"},
+		want:        repo + ":v1.2.3",
+	}, {
+		description: "tag-and-digest",
+		style:       publish.ResolveTagAndDigest,
+		tags:        []string{"stable", "v1.2.3"},
+		want:        repo + ":stable@" + h.String(),
+	}, {
+		description: "tag-and-digest with latest",
+		style:       publish.ResolveTagAndDigest,
+		want:        repo + ":latest@" + h.String(),
+	}, {
+		description: "tag without tags",
+		style:       publish.ResolveTag,
+		wantErr:     true,
+	}, {
+		description: "tag with latest",
+		style:       publish.ResolveTag,
+		tags:        []string{"latest"},
+		wantErr:     true,
+	}, {
+		description: "unknown",
+		style:       "tagged",
+		wantErr:     true,
+	}} {
+		t.Run(test.description, func(t *testing.T) {
+			opts := []publish.Option{publish.WithResolveStyle(test.style)}
+			if test.tags != nil {
+				opts = append(opts, publish.WithTags(test.tags))
+			}
+			def, err := publish.NewDefault(repoName, opts...)
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("NewDefault() = nil, wanted error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewDefault() = %v", err)
+			}
+			ref, err := def.Publish(context.Background(), img, build.StrictScheme+importpath)
+			if err != nil {
+				t.Fatalf("Publish() = %v", err)
+			}
+			if got := ref.String(); got != test.want {
+				t.Errorf("Publish() = %s, wanted %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDefaultWithRetry(t *testing.T) {
+	const importpath = "github.com/google/ko/cmd/app"
+
+	for _, test := range []struct {
+		description string
+		opts        []registrytest.Option
+		retries     int
+		wantErr     bool
+	}{{
+		description: "rate limited",
+		opts:        []registrytest.Option{registrytest.WithRateLimit(2)},
+		retries:     3,
+	}, {
+		description: "too many retries",
+		opts:        []registrytest.Option{registrytest.WithRateLimit(100)},
+		retries:     2,
+		wantErr:     true,
+	}, {
+		description: "no retries",
+		opts:        []registrytest.Option{registrytest.WithRateLimit(1)},
+		wantErr:     true,
+	}, {
+		description: "unauthorized",
+		opts:        []registrytest.Option{registrytest.WithAuth("user", "pass")},
+		retries:     3,
+		wantErr:     true,
+	}} {
+		t.Run(test.description, func(t *testing.T) {
+			reg := registrytest.New(test.opts...)
+			defer reg.Close()
+			repoName := reg.Host() + "/blah"
+
+			def, err := publish.NewDefault(repoName, publish.WithRetry(test.retries, time.Millisecond))
+			if err != nil {
+				t.Fatalf("NewDefault() = %v", err)
+			}
+			_, err = def.Publish(context.Background(), img, build.StrictScheme+importpath)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Publish() = %v, wanted error: %v", err, test.wantErr)
+			}
+			if !test.wantErr && !reg.HasManifest("blah/"+importpath, "latest") {
+				t.Error("Publish() didn't push latest")
+			}
+		})
+	}
+}
+
+func TestDefaultWithRetryNotRetryable(t *testing.T) {
+	// Pushing without credentials fails the same way with and without
+	// retries, and makes the same requests.
+	var requests []int
+	for _, retries := range []int{0, 3} {
+		reg := registrytest.New(registrytest.WithAuth("user", "pass"))
+		def, err := publish.NewDefault(reg.Host()+"/blah", publish.WithRetry(retries, time.Hour))
+		if err != nil {
+			t.Fatalf("NewDefault() = %v", err)
+		}
+		if _, err := def.Publish(context.Background(), img, build.StrictScheme+"github.com/google/ko/cmd/app"); err == nil {
+			t.Error("Publish() without credentials succeeded, wanted error")
+		}
+		requests = append(requests, len(reg.Requests()))
+		reg.Close()
+	}
+	if requests[0] != requests[1] {
+		t.Errorf("Publish() made %d requests with retries, and %d without", requests[1], requests[0])
+	}
+}
+
+func TestWithRetryValidation(t *testing.T) {
+	for _, test := range []struct {
+		max  int
+		base time.Duration
+	}{
+		{max: -1, base: time.Second},
+		{max: 3, base: 0},
+	} {
+		if _, err := publish.NewDefault("example.com/blah", publish.WithRetry(test.max, test.base)); err == nil {
+			t.Errorf("WithRetry(%d, %v) succeeded, wanted error", test.max, test.base)
+		}
+	}
+}
+
+func TestDefaultWithRateLimiter(t *testing.T) {
+	const rps = 50
+	reg := registrytest.New()
+	defer reg.Close()
+
+	// The publishers of both repositories share the limiter, so their
+	// requests are throttled together.
+	limiter, err := publish.NewRateLimiter(rps)
+	if err != nil {
+		t.Fatalf("NewRateLimiter() = %v", err)
+	}
+	var pubs []publish.Interface
+	for _, repo := range []string{"blah", "other"} {
+		def, err := publish.NewDefault(reg.Host()+"/"+repo, publish.WithRateLimiter(limiter))
+		if err != nil {
+			t.Fatalf("NewDefault() = %v", err)
+		}
+		pubs = append(pubs, def)
+	}
+
+	start := time.Now()
+	errs := make(chan error, len(pubs))
+	for _, def := range pubs {
+		def := def
+		go func() {
+			_, err := def.Publish(context.Background(), img, build.StrictScheme+"github.com/google/ko/cmd/app")
+			errs <- err
+		}()
+	}
+	for range pubs {
+		if err := <-errs; err != nil {
+			t.Fatalf("Publish() = %v", err)
+		}
+	}
+	elapsed := time.Since(start)
+
+	// The first request is sent right away, and each of the rest 1/rps
+	// after the previous one.
+	requests := len(reg.Requests())
+	if want := time.Duration(requests-1) * time.Second / rps; elapsed < want {
+		t.Errorf("Publish() made %d requests in %v, wanted at least %v at %d per second", requests, elapsed, want, rps)
+	}
+}
+
+func TestNewRateLimiterValidation(t *testing.T) {
+	for _, rps := range []float64{0, -1} {
+		if _, err := publish.NewRateLimiter(rps); err == nil {
+			t.Errorf("NewRateLimiter(%v) succeeded, wanted error", rps)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/ko/pkg/build"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// ExternalScheme is the scheme of KO_DOCKER_REPOs that publish images
+	// with a plugin: ext://NAME runs ExternalCommandPrefix+NAME.
+	ExternalScheme = "ext://"
+
+	// ExternalCommandPrefix is the prefix of the commands on PATH that
+	// ext:// publishes with.
+	ExternalCommandPrefix = "ko-publish-"
+
+	// ExternalDomain is a sentinel "registry" that names the images
+	// handed to plugins.
+	ExternalDomain = "ext.local"
+)
+
+// ExternalRunner runs the plugin command with args, and stdin, and returns
+// its standard output. Its standard error is left to the runner.
+type ExternalRunner func(ctx context.Context, stdin io.Reader, command string, args ...string) ([]byte, error)
+
+func runExternal(ctx context.Context, stdin io.Reader, command string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Stdin = stdin
+	cmd.Stderr = os.Stderr
+	return cmd.Output()
+}
+
+type externalPublisher struct {
+	command string
+	run     ExternalRunner
+	namer   Namer
+	tags    []string
+}
+
+// ExternalOption is a functional option for NewExternal.
+type ExternalOption func(*externalPublisher) error
+
+// WithExternalRunner is a functional option for overriding how the plugin
+// is run, e.g. to test without it.
+func WithExternalRunner(run ExternalRunner) ExternalOption {
+	return func(e *externalPublisher) error {
+		if run != nil {
+			e.run = run
+		}
+		return nil
+	}
+}
+
+// NewExternal returns a new publish.Interface that publishes images with
+// the plugin named by repo, ext://NAME, which is the command
+// ko-publish-NAME on PATH. For each image, the plugin is run with the
+// image's name in ext.local, by digest, and the tags to publish it with as
+// its arguments, and the image as a `docker save` tarball on its standard
+// input. It prints the reference it published the image to, which is what
+// Publish returns.
+func NewExternal(repo string, namer Namer, tags []string, opts ...ExternalOption) (Interface, error) {
+	plugin := strings.TrimPrefix(repo, ExternalScheme)
+	if plugin == repo || plugin == "" || strings.ContainsAny(plugin, `/\`) {
+		return nil, fmt.Errorf("invalid KO_DOCKER_REPO %q, expected %sNAME to publish with %sNAME", repo, ExternalScheme, ExternalCommandPrefix)
+	}
+	e := &externalPublisher{
+		command: ExternalCommandPrefix + plugin,
+		run:     runExternal,
+		namer:   namer,
+		tags:    tags,
+	}
+	for _, option := range opts {
+		if err := option(e); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// Publish implements publish.Interface
+func (e *externalPublisher) Publish(ctx context.Context, br build.Result, s string) (name.Reference, error) {
+	s = strings.TrimPrefix(s, build.StrictScheme)
+	// https://github.com/google/go-containerregistry/issues/212
+	s = strings.ToLower(s)
+
+	// The image is handed over as a tarball, which can't hold an index, so
+	// attempt to downcast it to an image.
+	var img v1.Image
+	switch i := br.(type) {
+	case v1.Image:
+		img = i
+	case v1.ImageIndex:
+		im, err := i.IndexManifest()
+		if err != nil {
+			return nil, err
+		}
+		goos, goarch := os.Getenv("GOOS"), os.Getenv("GOARCH")
+		if goos == "" {
+			goos = "linux"
+		}
+		if goarch == "" {
+			goarch = "amd64"
+		}
+		for _, manifest := range im.Manifests {
+			if manifest.Platform == nil || manifest.Platform.OS != goos || manifest.Platform.Architecture != goarch {
+				continue
+			}
+			if img, err = i.Image(manifest.Digest); err != nil {
+				return nil, err
+			}
+			break
+		}
+		if img == nil {
+			return nil, fmt.Errorf("failed to find %s/%s image in index for image: %v", goos, goarch, s)
+		}
+	default:
+		return nil, fmt.Errorf("failed to interpret %s result as image: %v", s, br)
+	}
+
+	h, err := img.Digest()
+	if err != nil {
+		return nil, err
+	}
+	digestTag, err := name.NewTag(fmt.Sprintf("%s:%s", e.namer(ExternalDomain, s), h.Hex))
+	if err != nil {
+		return nil, err
+	}
+	tags, err := expandTags(e.tags, br)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Publishing %v with %s", digestTag, e.command)
+	pr, pw := io.Pipe()
+	var grp errgroup.Group
+	grp.Go(func() error {
+		return pw.CloseWithError(tarball.Write(digestTag, img, pw))
+	})
+	out, err := e.run(ctx, pr, e.command, append([]string{digestTag.String()}, tags...)...)
+	// Stop the tarball from being written if the plugin didn't read all of
+	// it.
+	pr.Close()
+	if err != nil {
+		grp.Wait()
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, fmt.Errorf("publishing with %s, which isn't on PATH", e.command)
+		}
+		return nil, fmt.Errorf("%s %v: %w", e.command, digestTag, err)
+	}
+	if err := grp.Wait(); err != nil {
+		return nil, fmt.Errorf("failed to write intermediate tarball representation: %w", err)
+	}
+
+	// The reference is the last line the plugin printed, so that it can
+	// print progress before it.
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	published := strings.TrimSpace(lines[len(lines)-1])
+	if published == "" {
+		return nil, fmt.Errorf("%s published %v, but printed no reference to it", e.command, digestTag)
+	}
+	ref, err := name.ParseReference(published)
+	if err != nil {
+		return nil, fmt.Errorf("%s published %v to %q, which isn't a reference: %v", e.command, digestTag, published, err)
+	}
+	log.Printf("Published %v", ref)
+	return ref, nil
+}
+
+// Close implements publish.Interface
+func (e *externalPublisher) Close() error {
+	return nil
+}
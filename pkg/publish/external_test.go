@@ -0,0 +1,120 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/ko/pkg/publish"
+)
+
+func TestExternal(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	namer := func(base, importpath string) string { return path.Join(base, path.Base(importpath)) }
+	const importpath = "ko://github.com/Google/go-containerregistry/cmd/crane"
+
+	var gotCommand string
+	var gotArgs []string
+	var gotTags []string
+	run := func(ctx context.Context, stdin io.Reader, command string, args ...string) ([]byte, error) {
+		gotCommand, gotArgs = command, args
+		b, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			return nil, err
+		}
+		m, err := tarball.LoadManifest(func() (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(b)), nil })
+		if err != nil {
+			return nil, err
+		}
+		gotTags = m[0].RepoTags
+		return []byte("uploading...\nexample.com/published/crane@" + h.String() + "\n"), nil
+	}
+
+	pub, err := publish.NewExternal("ext://example", namer, []string{"latest", "v1"}, publish.WithExternalRunner(run))
+	if err != nil {
+		t.Fatalf("NewExternal() = %v", err)
+	}
+	ref, err := pub.Publish(context.Background(), img, importpath)
+	if err != nil {
+		t.Fatalf("Publish() = %v", err)
+	}
+	if want := "example.com/published/crane@" + h.String(); ref.String() != want {
+		t.Errorf("Publish() = %s, wanted %s", ref, want)
+	}
+	if want := "ko-publish-example"; gotCommand != want {
+		t.Errorf("command = %s, wanted %s", gotCommand, want)
+	}
+	digestTag := "ext.local/crane:" + h.Hex
+	if want := []string{digestTag, "latest", "v1"}; strings.Join(gotArgs, " ") != strings.Join(want, " ") {
+		t.Errorf("args = %v, wanted %v", gotArgs, want)
+	}
+	if len(gotTags) != 1 || gotTags[0] != digestTag {
+		t.Errorf("tarball tags = %v, wanted [%s]", gotTags, digestTag)
+	}
+
+	for _, test := range []struct {
+		desc    string
+		out     string
+		err     error
+		wantErr string
+	}{{
+		desc:    "no reference",
+		out:     "\n",
+		wantErr: "printed no reference",
+	}, {
+		desc:    "not a reference",
+		out:     "done!\n",
+		wantErr: "isn't a reference",
+	}, {
+		desc:    "failed",
+		err:     errors.New("exit status 1"),
+		wantErr: "ko-publish-example " + digestTag + ": exit status 1",
+	}} {
+		t.Run(test.desc, func(t *testing.T) {
+			run := func(ctx context.Context, stdin io.Reader, command string, args ...string) ([]byte, error) {
+				return []byte(test.out), test.err
+			}
+			pub, err := publish.NewExternal("ext://example", namer, nil, publish.WithExternalRunner(run))
+			if err != nil {
+				t.Fatalf("NewExternal() = %v", err)
+			}
+			if _, err := pub.Publish(context.Background(), img, importpath); err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("Publish() = %v, wanted error containing %q", err, test.wantErr)
+			}
+		})
+	}
+
+	for _, repo := range []string{"ext://", "ext://a/b", "example.com/repo"} {
+		if _, err := publish.NewExternal(repo, namer, nil); err == nil {
+			t.Errorf("NewExternal(%q) succeeded, wanted error", repo)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/ko/pkg/build"
+)
+
+// gitHubActions composes with another Interface to record each image it
+// publishes for GitHub Actions.
+type gitHubActions struct {
+	inner       Interface
+	outputFile  string
+	summaryFile string
+	now         func() time.Time
+
+	m      sync.Mutex
+	images map[string]string
+}
+
+// gitHubActions implements Interface
+var _ Interface = (*gitHubActions)(nil)
+
+// NewGitHubActions returns a publisher that publishes with inner, and then
+// records each image for GitHub Actions, in the files that the
+// GITHUB_OUTPUT and GITHUB_STEP_SUMMARY environment variables name. Either
+// may be empty, to skip it.
+//
+// The reference of each image is set as a step output named after its import
+// path with GitHubOutputName, and the output "images" is a JSON object of all
+// of them so far, keyed by import path. A row with the import path, digest,
+// size and time taken to publish each image is appended to a table in the
+// step summary.
+func NewGitHubActions(inner Interface, outputFile, summaryFile string) Interface {
+	return &gitHubActions{
+		inner:       inner,
+		outputFile:  outputFile,
+		summaryFile: summaryFile,
+		now:         time.Now,
+		images:      map[string]string{},
+	}
+}
+
+// invalidOutputChars are those not allowed in step output names.
+var invalidOutputChars = regexp.MustCompile("[^A-Za-z0-9_-]+")
+
+// GitHubOutputName returns the name of the step output for the image of an
+// import path: the import path, without ko://, with any characters that
+// aren't allowed in output names (e.g. "/" and ".") replaced by "_".
+func GitHubOutputName(importpath string) string {
+	importpath = strings.TrimPrefix(importpath, build.StrictScheme)
+	n := strings.Trim(invalidOutputChars.ReplaceAllString(importpath, "_"), "_-")
+	if n == "" || (n[0] >= '0' && n[0] <= '9') {
+		n = "_" + n
+	}
+	return n
+}
+
+// Publish implements Interface
+func (g *gitHubActions) Publish(ctx context.Context, br build.Result, s string) (name.Reference, error) {
+	start := g.now()
+	ref, err := g.inner.Publish(ctx, br, s)
+	if err != nil {
+		return nil, err
+	}
+	took := g.now().Sub(start)
+
+	// Publishers that publish by tag (e.g. to the daemon) don't tell us the
+	// digest, so take it from the build result instead.
+	var digest string
+	if d, ok := ref.(name.Digest); ok {
+		digest = d.DigestStr()
+	} else if d, ok := ref.(*name.Digest); ok {
+		digest = d.DigestStr()
+	} else {
+		h, err := br.Digest()
+		if err != nil {
+			return nil, err
+		}
+		digest = h.String()
+	}
+	size, err := resultSize(br)
+	if err != nil {
+		return nil, err
+	}
+	ip := strings.TrimPrefix(s, build.StrictScheme)
+
+	g.m.Lock()
+	defer g.m.Unlock()
+	first := len(g.images) == 0
+	g.images[ip] = ref.String()
+
+	if g.outputFile != "" {
+		all, err := json.Marshal(g.images)
+		if err != nil {
+			return nil, err
+		}
+		// Later values of an output replace earlier ones, so "images"
+		// ends up with every image.
+		if err := appendFile(g.outputFile, fmt.Sprintf("%s=%s\nimages=%s\n", GitHubOutputName(ip), ref, all)); err != nil {
+			return nil, fmt.Errorf("writing GitHub Actions outputs for %s: %v", s, err)
+		}
+	}
+	if g.summaryFile != "" {
+		var row string
+		if first {
+			row = "### Images published by ko\n\n| Import path | Digest | Size | Publish time |\n| --- | --- | --- | --- |\n"
+		}
+		row += fmt.Sprintf("| `%s` | `%s` | %s | %s |\n", ip, digest, formatSize(size), took.Round(time.Millisecond))
+		if err := appendFile(g.summaryFile, row); err != nil {
+			return nil, fmt.Errorf("writing GitHub Actions step summary for %s: %v", s, err)
+		}
+	}
+	return ref, nil
+}
+
+// Close implements Interface
+func (g *gitHubActions) Close() error {
+	return g.inner.Close()
+}
+
+// appendFile appends s to the file at path, which GitHub Actions creates
+// for each step.
+func appendFile(path, s string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return build.WrapNoSpace(err, path)
+	}
+	if _, err := f.WriteString(s); err != nil {
+		f.Close()
+		return build.WrapNoSpace(err, path)
+	}
+	return f.Close()
+}
+
+// resultSize returns the size of the blobs of the image, or of every image in
+// the index: what pulling all of it would download.
+func resultSize(br build.Result) (int64, error) {
+	switch r := br.(type) {
+	case v1.ImageIndex:
+		im, err := r.IndexManifest()
+		if err != nil {
+			return 0, err
+		}
+		var total int64
+		for _, desc := range im.Manifests {
+			var child build.Result
+			if desc.MediaType.IsIndex() {
+				child, err = r.ImageIndex(desc.Digest)
+			} else {
+				child, err = r.Image(desc.Digest)
+			}
+			if err != nil {
+				return 0, err
+			}
+			size, err := resultSize(child)
+			if err != nil {
+				return 0, err
+			}
+			total += size
+		}
+		return total, nil
+	case v1.Image:
+		m, err := r.Manifest()
+		if err != nil {
+			return 0, err
+		}
+		total := m.Config.Size
+		for _, l := range m.Layers {
+			total += l.Size
+		}
+		return total, nil
+	}
+	return 0, fmt.Errorf("unsupported result type %T", br)
+}
+
+// formatSize formats n bytes with a binary unit, e.g. "12.3 MiB".
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
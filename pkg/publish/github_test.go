@@ -0,0 +1,144 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/ko/pkg/build"
+)
+
+// refsPublisher publishes each import path to its reference.
+type refsPublisher map[string]name.Reference
+
+func (p refsPublisher) Publish(_ context.Context, _ build.Result, s string) (name.Reference, error) {
+	return p[s], nil
+}
+
+func (refsPublisher) Close() error { return nil }
+
+func TestGitHubActions(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image() = %v", err)
+	}
+	h, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := resultSize(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "github")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outputFile := filepath.Join(dir, "output")
+	summaryFile := filepath.Join(dir, "summary")
+
+	// Each step gets its own files, which may already have content.
+	if err := ioutil.WriteFile(outputFile, []byte("before=1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	app, err := name.ParseReference("gcr.io/foo/app@" + h.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := name.ParseReference("ko.local/bar:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := NewGitHubActions(refsPublisher{
+		"ko://github.com/foo/cmd/app": app,
+		"ko://github.com/foo/cmd/bar": local,
+	}, outputFile, summaryFile).(*gitHubActions)
+	now := time.Unix(0, 0)
+	pub.now = func() time.Time {
+		now = now.Add(1500 * time.Millisecond)
+		return now
+	}
+	for _, ip := range []string{"ko://github.com/foo/cmd/app", "ko://github.com/foo/cmd/bar"} {
+		if _, err := pub.Publish(context.Background(), img, ip); err != nil {
+			t.Fatalf("Publish(%s) = %v", ip, err)
+		}
+	}
+
+	gotOutput, err := ioutil.ReadFile(outputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantOutput := fmt.Sprintf(`before=1
+github_com_foo_cmd_app=%[1]s
+images={"github.com/foo/cmd/app":"%[1]s"}
+github_com_foo_cmd_bar=ko.local/bar:latest
+images={"github.com/foo/cmd/app":"%[1]s","github.com/foo/cmd/bar":"ko.local/bar:latest"}
+`, app)
+	if diff := cmp.Diff(wantOutput, string(gotOutput)); diff != "" {
+		t.Errorf("outputs (-want +got): %s", diff)
+	}
+
+	gotSummary, err := ioutil.ReadFile(summaryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSummary := fmt.Sprintf("### Images published by ko\n\n"+
+		"| Import path | Digest | Size | Publish time |\n"+
+		"| --- | --- | --- | --- |\n"+
+		"| `github.com/foo/cmd/app` | `%[1]s` | %[2]s | 1.5s |\n"+
+		"| `github.com/foo/cmd/bar` | `%[1]s` | %[2]s | 1.5s |\n", h, formatSize(size))
+	if diff := cmp.Diff(wantSummary, string(gotSummary)); diff != "" {
+		t.Errorf("step summary (-want +got): %s", diff)
+	}
+}
+
+func TestGitHubOutputName(t *testing.T) {
+	for importpath, want := range map[string]string{
+		"ko://github.com/foo/cmd/app":   "github_com_foo_cmd_app",
+		"example.com/cmd/my-app@v1.2.3": "example_com_cmd_my-app_v1_2_3",
+		"ko://multi:a.com/x,a.com/y":    "multi_a_com_x_a_com_y",
+		"1password.com/cmd/op":          "_1password_com_cmd_op",
+	} {
+		if got := GitHubOutputName(importpath); got != want {
+			t.Errorf("GitHubOutputName(%q) = %q, wanted %q", importpath, got, want)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	for n, want := range map[int64]string{
+		0:                  "0 B",
+		1023:               "1023 B",
+		1024:               "1.0 KiB",
+		1536:               "1.5 KiB",
+		12*1024*1024 + 300: "12.0 MiB",
+		3 << 30:            "3.0 GiB",
+	} {
+		if got := formatSize(n); got != want {
+			t.Errorf("formatSize(%d) = %q, wanted %q", n, got, want)
+		}
+	}
+}
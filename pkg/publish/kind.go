@@ -107,7 +107,11 @@ func (t *kindPublisher) Publish(ctx context.Context, br build.Result, s string)
 	}
 	log.Printf("Loaded %v", digestTag)
 
-	for _, tagName := range t.tags {
+	tags, err := expandTags(t.tags, br)
+	if err != nil {
+		return nil, err
+	}
+	for _, tagName := range tags {
 		log.Printf("Adding tag %v", tagName)
 		tag, err := name.NewTag(fmt.Sprintf("%s:%s", t.namer(KindDomain, s), tagName))
 		if err != nil {
@@ -71,7 +71,7 @@ func (l *LayoutPublisher) writeResult(br build.Result) error {
 func (l *LayoutPublisher) Publish(_ context.Context, br build.Result, s string) (name.Reference, error) {
 	log.Printf("Saving %v", s)
 	if err := l.writeResult(br); err != nil {
-		return nil, err
+		return nil, build.WrapNoSpace(err, string(l.p))
 	}
 	log.Printf("Saved %v", s)
 
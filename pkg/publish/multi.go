@@ -17,9 +17,12 @@ package publish
 import (
 	"context"
 	"errors"
+	"fmt"
+	"log"
 
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/warnings"
 )
 
 // MultiPublisher creates a publisher that publishes to all
@@ -28,26 +31,62 @@ import (
 // When calling Publish, the name.Reference returned will be the return value
 // of the last publisher passed to MultiPublisher (last one wins).
 func MultiPublisher(publishers ...Interface) Interface {
-	return &multiPublisher{publishers}
+	return &multiPublisher{publishers: publishers, authority: len(publishers) - 1}
+}
+
+// MultiPublisherWithAuthority creates a publisher that publishes to all the
+// provided publishers, like MultiPublisher, but returns the reference from
+// publishers[authority], whatever the order. The references from every
+// publisher are logged, with a warning if any is for a different digest.
+func MultiPublisherWithAuthority(authority int, publishers ...Interface) (Interface, error) {
+	if authority < 0 || authority >= len(publishers) {
+		return nil, fmt.Errorf("authority %d is not one of the %d publishers", authority, len(publishers))
+	}
+	return &multiPublisher{publishers: publishers, authority: authority, compare: true}, nil
 }
 
 type multiPublisher struct {
 	publishers []Interface
+	authority  int
+	compare    bool
 }
 
 // Publish implements publish.Interface.
-func (p *multiPublisher) Publish(ctx context.Context, br build.Result, s string) (ref name.Reference, err error) {
+func (p *multiPublisher) Publish(ctx context.Context, br build.Result, s string) (name.Reference, error) {
 	if len(p.publishers) == 0 {
 		return nil, errors.New("MultiPublisher configured with zero publishers")
 	}
 
+	refs := make([]name.Reference, 0, len(p.publishers))
 	for _, pub := range p.publishers {
-		ref, err = pub.Publish(ctx, br, s)
+		ref, err := pub.Publish(ctx, br, s)
 		if err != nil {
-			return
+			return nil, err
 		}
+		refs = append(refs, ref)
 	}
-	return
+	ref := refs[p.authority]
+	if p.compare && len(refs) > 1 {
+		log.Printf("Resolving %s to %s, of %v", s, ref, refs)
+		want, ok := digestOf(ref)
+		for _, other := range refs {
+			if got, hasDigest := digestOf(other); ok && hasDigest && got != want {
+				warnings.Warnf(warnings.DigestMismatch, "%s was published as %s, but resolves to %s", s, other, ref)
+			}
+		}
+	}
+	return ref, nil
+}
+
+// digestOf returns the digest of ref, if it has one.
+func digestOf(ref name.Reference) (string, bool) {
+	switch r := ref.(type) {
+	case name.Digest:
+		return r.DigestStr(), true
+	case *name.Digest:
+		return r.DigestStr(), true
+	}
+	return "", false
 }
 
 func (p *multiPublisher) Close() (err error) {
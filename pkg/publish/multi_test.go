@@ -15,13 +15,18 @@
 package publish_test
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
+	"strings"
 	"testing"
 
+	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/ko/pkg/build"
 	"github.com/google/ko/pkg/publish"
 )
 
@@ -75,3 +80,85 @@ func TestMulti_Zero(t *testing.T) {
 		t.Errorf("Publish() got nil error")
 	}
 }
+
+// refPublisher publishes everything to ref.
+type refPublisher string
+
+func (p refPublisher) Publish(context.Context, build.Result, string) (name.Reference, error) {
+	return name.ParseReference(string(p))
+}
+
+func (refPublisher) Close() error { return nil }
+
+func TestMultiWithAuthority(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image() = %v", err)
+	}
+	h, err := img.Digest()
+	if err != nil {
+		t.Fatalf("Digest() = %v", err)
+	}
+	publishers := []publish.Interface{
+		refPublisher("example.com/layout@" + h.String()),
+		refPublisher("example.com/tarball@" + h.String()),
+		refPublisher("example.com/registry@" + h.String()),
+	}
+
+	for authority, want := range publishers {
+		p, err := publish.MultiPublisherWithAuthority(authority, publishers...)
+		if err != nil {
+			t.Fatalf("MultiPublisherWithAuthority(%d) = %v", authority, err)
+		}
+		ref, err := p.Publish(context.Background(), img, "ko://example.com/app")
+		if err != nil {
+			t.Fatalf("Publish() = %v", err)
+		}
+		if got := ref.String(); got != string(want.(refPublisher)) {
+			t.Errorf("Publish() with authority %d = %s, wanted %s", authority, got, want)
+		}
+	}
+
+	for _, authority := range []int{-1, len(publishers)} {
+		if _, err := publish.MultiPublisherWithAuthority(authority, publishers...); err == nil {
+			t.Errorf("MultiPublisherWithAuthority(%d) succeeded, wanted error", authority)
+		}
+	}
+}
+
+func TestMultiWithAuthorityDigestMismatch(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image() = %v", err)
+	}
+	other, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image() = %v", err)
+	}
+	h, err := img.Digest()
+	if err != nil {
+		t.Fatalf("Digest() = %v", err)
+	}
+	oh, err := other.Digest()
+	if err != nil {
+		t.Fatalf("Digest() = %v", err)
+	}
+
+	p, err := publish.MultiPublisherWithAuthority(0,
+		refPublisher("example.com/registry@"+h.String()),
+		refPublisher("example.com/tarball@"+oh.String()),
+		refPublisher("ko.local/daemon:latest"))
+	if err != nil {
+		t.Fatalf("MultiPublisherWithAuthority() = %v", err)
+	}
+	if _, err := p.Publish(context.Background(), img, "ko://example.com/app"); err != nil {
+		t.Fatalf("Publish() = %v", err)
+	}
+	if got := strings.Count(buf.String(), "WARNING"); got != 1 {
+		t.Errorf("logged %d warnings, wanted 1 for the tarball: %s", got, buf.String())
+	}
+}
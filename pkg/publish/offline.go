@@ -0,0 +1,104 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/ko/pkg/build"
+)
+
+// DigestFunc computes the digest that a build result is referenced by.
+type DigestFunc func(build.Result) (v1.Hash, error)
+
+// offline references results by the digest they would be pushed with,
+// without pushing them anywhere.
+type offline struct {
+	base   string
+	namer  Namer
+	digest DigestFunc
+	layout Interface
+}
+
+// OfflineOption is a functional option for NewOffline.
+type OfflineOption func(*offline) error
+
+// WithDigestFunc is a functional option for computing the digests of results
+// with f, instead of with their own Digest method.
+func WithDigestFunc(f DigestFunc) OfflineOption {
+	return func(o *offline) error {
+		o.digest = f
+		return nil
+	}
+}
+
+// WithLayoutPath is a functional option for also writing results to the OCI
+// image layout at path, which is created if it doesn't exist.
+func WithLayoutPath(path string) OfflineOption {
+	return func(o *offline) error {
+		lp, err := NewLayout(path)
+		if err != nil {
+			return err
+		}
+		o.layout = lp
+		return nil
+	}
+}
+
+// NewOffline returns a publish.Interface that doesn't need a registry: it
+// references results as if they had been pushed under base, named by namer,
+// by their locally computed digest, e.g. to preview resolved YAML.
+func NewOffline(base string, namer Namer, opts ...OfflineOption) (Interface, error) {
+	o := &offline{
+		base:  base,
+		namer: namer,
+		digest: func(br build.Result) (v1.Hash, error) {
+			return br.Digest()
+		},
+	}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// Publish implements publish.Interface.
+func (o *offline) Publish(ctx context.Context, br build.Result, s string) (name.Reference, error) {
+	if o.layout != nil {
+		if _, err := o.layout.Publish(ctx, br, s); err != nil {
+			return nil, err
+		}
+	}
+	s = strings.TrimPrefix(s, build.StrictScheme)
+	h, err := o.digest(br)
+	if err != nil {
+		return nil, err
+	}
+	return name.NewDigest(fmt.Sprintf("%s@%s", o.namer(o.base, s), h))
+}
+
+// Close implements publish.Interface.
+func (o *offline) Close() error {
+	if o.layout != nil {
+		return o.layout.Close()
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/ko/pkg/build"
+)
+
+func TestOfflineMatchesLayout(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image() = %v", err)
+	}
+	importpath := "github.com/google/ko/cmd/app"
+
+	tmp, err := ioutil.TempDir("", "ko")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	op, err := NewOffline("registry.example.com/repo", identity, WithLayoutPath(tmp))
+	if err != nil {
+		t.Fatalf("NewOffline() = %v", err)
+	}
+	defer op.Close()
+	ref, err := op.Publish(context.Background(), img, build.StrictScheme+importpath)
+	if err != nil {
+		t.Fatalf("Publish() = %v", err)
+	}
+
+	idx, err := layout.ImageIndexFromPath(tmp)
+	if err != nil {
+		t.Fatalf("ImageIndexFromPath() = %v", err)
+	}
+	im, err := idx.IndexManifest()
+	if err != nil {
+		t.Fatalf("IndexManifest() = %v", err)
+	}
+	if len(im.Manifests) != 1 {
+		t.Fatalf("layout has %d manifests, wanted 1", len(im.Manifests))
+	}
+	want := "registry.example.com/repo/" + importpath + "@" + im.Manifests[0].Digest.String()
+	if got := ref.String(); got != want {
+		t.Errorf("Publish() = %s, wanted %s", got, want)
+	}
+}
+
+func TestOfflineDigestFunc(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image() = %v", err)
+	}
+	fixed := v1.Hash{Algorithm: "sha256", Hex: "deadbeefdeadbeefdeadbeefdeadbeefdeadbeefdeadbeefdeadbeefdeadbeef"}
+	op, err := NewOffline("registry.example.com/repo", identity, WithDigestFunc(func(build.Result) (v1.Hash, error) {
+		return fixed, nil
+	}))
+	if err != nil {
+		t.Fatalf("NewOffline() = %v", err)
+	}
+	ref, err := op.Publish(context.Background(), img, "github.com/google/ko/cmd/app")
+	if err != nil {
+		t.Fatalf("Publish() = %v", err)
+	}
+	if got, want := ref.(name.Digest).DigestStr(), fixed.String(); got != want {
+		t.Errorf("Publish() digest = %s, wanted %s", got, want)
+	}
+}
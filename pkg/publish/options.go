@@ -16,12 +16,15 @@ package publish
 
 import (
 	"crypto/tls"
+	"fmt"
 	"log"
 	"net/http"
 	"path"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/ko/pkg/build"
 )
 
 // WithTransport is a functional option for overriding the default transport
@@ -78,6 +81,21 @@ func WithAuthFromKeychain(keys authn.Keychain) Option {
 	}
 }
 
+// WithAuthFromTokenFile is a functional option for overriding the default
+// authenticator on a default publisher with the bearer token in the file at
+// path, which is read again whenever it changes, e.g. as it's rotated.
+func WithAuthFromTokenFile(path string) Option {
+	return func(i *defaultOpener) error {
+		auth := NewTokenFileAuthenticator(path)
+		// Fail before anything is built if there's no token yet.
+		if _, err := auth.Authorization(); err != nil {
+			return err
+		}
+		i.auth = auth
+		return nil
+	}
+}
+
 // WithNamer is a functional option for overriding the image naming behavior
 // in our default publisher.
 func WithNamer(n Namer) Option {
@@ -98,7 +116,65 @@ func WithTags(tags []string) Option {
 // WithTagOnly is a functional option for resolving images into tag-only references
 func WithTagOnly(tagOnly bool) Option {
 	return func(i *defaultOpener) error {
-		i.tagOnly = tagOnly
+		if tagOnly {
+			i.style = ResolveTag
+		}
+		return nil
+	}
+}
+
+// WithResolveStyle is a functional option for choosing what the references
+// returned by Publish include. By default, they're ResolveDigest references,
+// or ResolveTagAndDigest ones if a single tag other than latest is set.
+func WithResolveStyle(style ResolveStyle) Option {
+	return func(i *defaultOpener) error {
+		i.style = style
+		return nil
+	}
+}
+
+// WithRetry is a functional option for retrying failed pushes up to max
+// times, with exponential backoff from base and jitter. Only failures that
+// may be transient are retried: network errors, and 429 and 5xx responses.
+func WithRetry(max int, base time.Duration) Option {
+	return func(i *defaultOpener) error {
+		if max < 0 {
+			return fmt.Errorf("invalid number of retries %d", max)
+		}
+		if max > 0 && base <= 0 {
+			return fmt.Errorf("invalid retry backoff %v", base)
+		}
+		i.retry = retryPolicy{max: max, base: base}
+		return nil
+	}
+}
+
+// WithPostPublish is a functional option for calling f with the digest
+// reference of each result once it has been pushed, e.g. to sign it with
+// NewCosignSigner. An error from f fails the publish.
+func WithPostPublish(f PostPublish) Option {
+	return func(i *defaultOpener) error {
+		i.post = f
+		return nil
+	}
+}
+
+// WithRateLimiter is a functional option for limiting the rate of the
+// registry requests of a default publisher with l, which may be shared by
+// several publishers to limit their requests together.
+func WithRateLimiter(l *RateLimiter) Option {
+	return func(i *defaultOpener) error {
+		i.limiter = l
+		return nil
+	}
+}
+
+// WithSBOMs is a functional option for attaching to each image pushed the
+// SBOM generated for it by a builder created with build.WithSBOM(format,
+// sboms). Publishing an image without an SBOM in sboms fails.
+func WithSBOMs(sboms *build.SBOMs) Option {
+	return func(i *defaultOpener) error {
+		i.sboms = sboms
 		return nil
 	}
 }
@@ -0,0 +1,75 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the rate of the registry requests of the publishers
+// sharing it, see WithRateLimiter. It's a token bucket holding a single
+// token, so that requests are spread evenly rather than sent in bursts,
+// which registries enforcing requests-per-second limits answer with 429s.
+type RateLimiter struct {
+	interval time.Duration
+
+	m sync.Mutex
+	// next is when the next request may be sent.
+	next time.Time
+}
+
+// NewRateLimiter returns a RateLimiter allowing rps requests per second.
+func NewRateLimiter(rps float64) (*RateLimiter, error) {
+	if rps <= 0 {
+		return nil, fmt.Errorf("invalid requests per second %v", rps)
+	}
+	return &RateLimiter{interval: time.Duration(float64(time.Second) / rps)}, nil
+}
+
+// reserve returns when the caller may send its request.
+func (l *RateLimiter) reserve() time.Time {
+	l.m.Lock()
+	defer l.m.Unlock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = at.Add(l.interval)
+	return at
+}
+
+// rateLimitedTransport waits for its limiter before each request.
+type rateLimitedTransport struct {
+	inner   http.RoundTripper
+	limiter *RateLimiter
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if wait := time.Until(t.limiter.reserve()); wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+	return t.inner.RoundTrip(req)
+}
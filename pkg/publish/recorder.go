@@ -0,0 +1,79 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/ko/pkg/build"
+)
+
+// Recorder composes with another Interface to record the references that
+// each import path was published to.
+type Recorder struct {
+	m          sync.Mutex
+	references map[string]name.Reference
+	Publisher  Interface
+}
+
+// Recorder implements Interface
+var _ Interface = (*Recorder)(nil)
+
+// Publish implements Interface
+func (r *Recorder) Publish(ctx context.Context, br build.Result, ip string) (name.Reference, error) {
+	ref, err := r.Publisher.Publish(ctx, br, ip)
+	if err != nil {
+		return nil, err
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.references == nil {
+		r.references = make(map[string]name.Reference)
+	}
+	r.references[ip] = ref
+	return ref, nil
+}
+
+// Close implements Interface
+func (r *Recorder) Close() error {
+	return r.Publisher.Close()
+}
+
+// References returns a copy of the recorded import path to reference mapping.
+// When an import path is published more than once, the last reference wins.
+func (r *Recorder) References() map[string]name.Reference {
+	r.m.Lock()
+	defer r.m.Unlock()
+	refs := make(map[string]name.Reference, len(r.references))
+	for ip, ref := range r.references {
+		refs[ip] = ref
+	}
+	return refs
+}
+
+// ImportPaths returns the recorded import paths in sorted order.
+func (r *Recorder) ImportPaths() []string {
+	r.m.Lock()
+	defer r.m.Unlock()
+	ips := make([]string, 0, len(r.references))
+	for ip := range r.references {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	return ips
+}
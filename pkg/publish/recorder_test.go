@@ -0,0 +1,71 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/ko/pkg/build"
+)
+
+func TestRecorder(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image() = %v", err)
+	}
+	repoName := "gcr.io/foo/bar"
+
+	rec := &Recorder{
+		Publisher: &slowpublish{},
+	}
+	for _, ip := range []string{"ko://github.com/foo/b", "ko://github.com/foo/a"} {
+		if _, err := rec.Publish(context.Background(), img, ip); err != nil {
+			t.Fatalf("Publish() = %v", err)
+		}
+	}
+
+	if diff := cmp.Diff([]string{"ko://github.com/foo/a", "ko://github.com/foo/b"}, rec.ImportPaths()); diff != "" {
+		t.Errorf("ImportPaths() (-want +got) = %s", diff)
+	}
+	refs := rec.References()
+	if got, want := refs["ko://github.com/foo/a"].Context().String(), repoName; got != want {
+		t.Errorf("References()[a] = %v, wanted %v", got, want)
+	}
+}
+
+func TestRecorderSkipsErrors(t *testing.T) {
+	rec := &Recorder{
+		Publisher: erroringPublisher{},
+	}
+	if _, err := rec.Publish(context.Background(), nil, "ko://github.com/foo/a"); err == nil {
+		t.Error("Publish() = nil, wanted error")
+	}
+	if got := len(rec.References()); got != 0 {
+		t.Errorf("len(References()) = %d, wanted 0", got)
+	}
+}
+
+type erroringPublisher struct{}
+
+func (erroringPublisher) Publish(context.Context, build.Result, string) (name.Reference, error) {
+	return nil, errors.New("nope")
+}
+
+func (erroringPublisher) Close() error { return nil }
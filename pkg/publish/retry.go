@@ -0,0 +1,87 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// retryPolicy is how many times, and how quickly, a push is retried.
+type retryPolicy struct {
+	max  int
+	base time.Duration
+}
+
+// do runs push, and retries it up to p.max times while it fails with errors
+// that may be transient, waiting about base, 2*base, 4*base, etc. in between.
+func (p retryPolicy) do(ctx context.Context, what string, push func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := push()
+		if err == nil {
+			if attempt > 0 {
+				log.Printf("%s succeeded after %d retries", what, attempt)
+			}
+			return nil
+		}
+		if !isRetryable(err) {
+			return err
+		}
+		if attempt >= p.max {
+			if attempt > 0 {
+				return fmt.Errorf("%s failed after %d retries: %w", what, attempt, err)
+			}
+			return err
+		}
+
+		// Wait between half and all of base * 2^attempt, so that pushes
+		// that failed together don't retry together.
+		delay := p.base << uint(attempt)
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		log.Printf("%s failed, retrying in %v (retry %d of %d): %v", what, delay, attempt+1, p.max, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// isRetryable reports whether err may be transient: a network error, or a
+// 429 or 5xx response from the registry. Authentication failures (401 and
+// 403) and other client errors aren't retried, since they'd fail again.
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var terr *transport.Error
+	if errors.As(err, &terr) {
+		return terr.StatusCode == http.StatusTooManyRequests || terr.StatusCode >= http.StatusInternalServerError
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,99 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/ko/pkg/build"
+)
+
+// Route publishes the importpaths under Prefix, e.g.
+// example.com/mono/frontend or example.com/mono/frontend/..., with
+// Publisher.
+type Route struct {
+	Prefix    string
+	Publisher Interface
+}
+
+// NewRouter creates a publisher that publishes each importpath with the
+// Publisher of the Route with the longest matching Prefix, or with fallback
+// if none matches. Combined images (see build.MultiPrefix) are routed by
+// their entrypoint, and external importpaths by their importpath without
+// the version. If fallback is nil, publishing an importpath that matches no
+// Route fails.
+func NewRouter(fallback Interface, routes ...Route) Interface {
+	r := &router{fallback: fallback}
+	for _, route := range routes {
+		route.Prefix = strings.TrimSuffix(strings.TrimSuffix(route.Prefix, "/..."), "/")
+		r.routes = append(r.routes, route)
+	}
+	return r
+}
+
+type router struct {
+	fallback Interface
+	routes   []Route
+}
+
+// Publish implements publish.Interface
+func (r *router) Publish(ctx context.Context, br build.Result, s string) (name.Reference, error) {
+	pub := r.route(s)
+	if pub == nil {
+		return nil, fmt.Errorf("no destination for %s: it matches none of %v, and there is no default", s, r.prefixes())
+	}
+	return pub.Publish(ctx, br, s)
+}
+
+// route returns the publisher for s, or nil.
+func (r *router) route(s string) Interface {
+	ip := strings.TrimPrefix(s, build.StrictScheme)
+	if ips, ok := build.MultiImportPaths(s); ok && len(ips) > 0 {
+		ip = ips[0]
+	}
+	ip, _, _ = build.ExternalImportPath(ip)
+
+	pub, longest := r.fallback, -1
+	for _, route := range r.routes {
+		if (ip == route.Prefix || strings.HasPrefix(ip, route.Prefix+"/")) && len(route.Prefix) > longest {
+			pub, longest = route.Publisher, len(route.Prefix)
+		}
+	}
+	return pub
+}
+
+func (r *router) prefixes() []string {
+	prefixes := make([]string, 0, len(r.routes))
+	for _, route := range r.routes {
+		prefixes = append(prefixes, route.Prefix)
+	}
+	return prefixes
+}
+
+// Close implements publish.Interface
+func (r *router) Close() (err error) {
+	if r.fallback != nil {
+		err = r.fallback.Close()
+	}
+	for _, route := range r.routes {
+		if rerr := route.Publisher.Close(); rerr != nil {
+			err = rerr
+		}
+	}
+	return
+}
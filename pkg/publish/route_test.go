@@ -0,0 +1,91 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/publish"
+)
+
+// repoPublisher publishes everything to repo.
+type repoPublisher struct {
+	repo   string
+	closed bool
+}
+
+func (p *repoPublisher) Publish(context.Context, build.Result, string) (name.Reference, error) {
+	return name.ParseReference(p.repo)
+}
+
+func (p *repoPublisher) Close() error {
+	p.closed = true
+	return nil
+}
+
+func TestRouter(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image() = %v", err)
+	}
+	fallback := &repoPublisher{repo: "gcr.io/default"}
+	frontend := &repoPublisher{repo: "gcr.io/frontend"}
+	backend := &repoPublisher{repo: "gcr.io/backend"}
+	admin := &repoPublisher{repo: "gcr.io/admin"}
+	p := publish.NewRouter(fallback,
+		publish.Route{Prefix: "example.com/mono/frontend/...", Publisher: frontend},
+		publish.Route{Prefix: "example.com/mono/backend", Publisher: backend},
+		publish.Route{Prefix: "example.com/mono/backend/admin", Publisher: admin},
+	)
+
+	for s, want := range map[string]string{
+		build.StrictScheme + "example.com/mono/frontend":                     "gcr.io/frontend",
+		build.StrictScheme + "example.com/mono/frontend/cmd/web":             "gcr.io/frontend",
+		"example.com/mono/backend/cmd/api":                                   "gcr.io/backend",
+		build.StrictScheme + "example.com/mono/backend/admin/cmd/console":    "gcr.io/admin",
+		build.StrictScheme + "example.com/mono/backendless":                  "gcr.io/default",
+		build.StrictScheme + "example.com/other/cmd/tool":                    "gcr.io/default",
+		build.StrictScheme + "multi:example.com/mono/frontend/cmd/web,other": "gcr.io/frontend",
+		build.StrictScheme + "example.com/mono/backend/cmd/api@v1.2.3":       "gcr.io/backend",
+	} {
+		ref, err := p.Publish(context.Background(), img, s)
+		if err != nil {
+			t.Errorf("Publish(%s) = %v", s, err)
+			continue
+		}
+		if got := ref.Context().String(); got != want {
+			t.Errorf("Publish(%s) = %s, wanted %s", s, got, want)
+		}
+	}
+
+	if err := p.Close(); err != nil {
+		t.Errorf("Close() = %v", err)
+	}
+	for _, pub := range []*repoPublisher{fallback, frontend, backend, admin} {
+		if !pub.closed {
+			t.Errorf("%s wasn't closed", pub.repo)
+		}
+	}
+
+	// Without a fallback, importpaths that match no route fail.
+	p = publish.NewRouter(nil, publish.Route{Prefix: "example.com/mono/frontend", Publisher: frontend})
+	if _, err := p.Publish(context.Background(), img, build.StrictScheme+"example.com/other"); err == nil {
+		t.Error("Publish() = nil, wanted an error without a fallback")
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/google/ko/pkg/build"
+)
+
+// sbomTag returns the tag `cosign attach sbom` pushes the SBOM of the image
+// with digest h in repo to, sha256-<hex>.sbom.
+func sbomTag(repo name.Repository, h v1.Hash) name.Tag {
+	return repo.Tag(strings.Replace(h.String(), ":", "-", 1) + ".sbom")
+}
+
+// pushSBOMs pushes the SBOM in sboms of each image in br to its sbomTag in
+// repo, like `cosign attach sbom`. It fails if an image has none, rather
+// than publish it without the SBOM that was asked for.
+func pushSBOMs(repo name.Repository, br build.Result, sboms *build.SBOMs, opt []remote.Option) error {
+	var imgs []v1.Image
+	switch r := br.(type) {
+	case v1.Image:
+		imgs = append(imgs, r)
+	case v1.ImageIndex:
+		im, err := r.IndexManifest()
+		if err != nil {
+			return err
+		}
+		for _, desc := range im.Manifests {
+			if !desc.MediaType.IsImage() {
+				continue
+			}
+			img, err := r.Image(desc.Digest)
+			if err != nil {
+				return err
+			}
+			imgs = append(imgs, img)
+		}
+	}
+	for _, img := range imgs {
+		h, err := img.Digest()
+		if err != nil {
+			return err
+		}
+		sbom, mt, ok := sboms.SBOM(h)
+		if !ok {
+			return fmt.Errorf("no SBOM was generated for %s", repo.Digest(h.String()))
+		}
+		att, err := mutate.Append(mutate.MediaType(empty.Image, types.OCIManifestSchema1), mutate.Addendum{
+			Layer:     &payloadLayer{payload: sbom},
+			MediaType: mt,
+		})
+		if err != nil {
+			return err
+		}
+		tag := sbomTag(repo, h)
+		log.Printf("Attaching SBOM %v", tag)
+		if err := remote.Write(tag, att, opt...); err != nil {
+			return fmt.Errorf("attaching the SBOM of %s: %v", repo.Digest(h.String()), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish_test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/publish"
+	"github.com/google/ko/pkg/registrytest"
+)
+
+func TestPublishSBOM(t *testing.T) {
+	// A module with a main package, built for real, since the SBOM is
+	// read from the binary.
+	dir := t.TempDir()
+	for file, content := range map[string]string{
+		"go.mod":  "module example.com/sbom\n\ngo 1.16\n",
+		"main.go": "package main\n\nfunc main() {}\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	base, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := base.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf = cf.DeepCopy()
+	cf.OS, cf.Architecture = "linux", "amd64"
+	if base, err = mutate.ConfigFile(base, cf); err != nil {
+		t.Fatal(err)
+	}
+	baseRef := name.MustParseReference("example.com/base:latest")
+
+	for _, format := range []build.SBOMFormat{build.SBOMSPDX, build.SBOMCycloneDX} {
+		t.Run(string(format), func(t *testing.T) {
+			sboms := build.NewSBOMs()
+			b, err := build.NewGo(context.Background(), dir,
+				build.WithSBOM(format, sboms),
+				// The module has nothing to download, whatever the
+				// environment says.
+				build.WithEnv([]string{"GOFLAGS=-mod=mod", "GOWORK=off"}),
+				build.WithBaseImages(func(context.Context, string) (name.Reference, build.Result, error) { return baseRef, base, nil }))
+			if err != nil {
+				t.Fatalf("NewGo() = %v", err)
+			}
+			res, err := b.Build(context.Background(), build.StrictScheme+"example.com/sbom")
+			if err != nil {
+				t.Fatalf("Build() = %v", err)
+			}
+
+			reg := registrytest.New()
+			defer reg.Close()
+			def, err := publish.NewDefault(reg.Host()+"/sbom", publish.WithSBOMs(sboms))
+			if err != nil {
+				t.Fatalf("NewDefault() = %v", err)
+			}
+			// The SBOM is found by digest, so wrapping the result on
+			// its way to the publisher doesn't lose it.
+			ref, err := def.Publish(context.Background(), wrappedImage{res.(v1.Image)}, build.StrictScheme+"example.com/sbom")
+			if err != nil {
+				t.Fatalf("Publish() = %v", err)
+			}
+			dig := ref.(*name.Digest)
+
+			tag := dig.Context().Tag(strings.Replace(dig.DigestStr(), ":", "-", 1) + ".sbom")
+			att, err := remote.Image(tag)
+			if err != nil {
+				t.Fatalf("fetching the SBOM at %s: %v", tag, err)
+			}
+			m, err := att.Manifest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(m.Layers) != 1 || m.Layers[0].MediaType != format.MediaType() {
+				t.Fatalf("SBOM layers = %v, wanted one %s", m.Layers, format.MediaType())
+			}
+			l, err := att.LayerByDigest(m.Layers[0].Digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rc, err := l.Compressed()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rc.Close()
+			sbom, err := ioutil.ReadAll(rc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "pkg:golang/example.com/sbom@(devel)"; !strings.Contains(string(sbom), want) {
+				t.Errorf("SBOM doesn't contain %q:\n%s", want, sbom)
+			}
+
+			// An image that wasn't built with it has no SBOM to attach.
+			img, err := random.Image(1024, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := def.Publish(context.Background(), img, build.StrictScheme+"example.com/other"); err == nil {
+				t.Error("Publish() of an image without an SBOM succeeded, wanted error")
+			}
+		})
+	}
+}
+
+// wrappedImage is an image wrapped in another type, as other builders and
+// publishers may.
+type wrappedImage struct {
+	v1.Image
+}
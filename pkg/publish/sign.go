@@ -0,0 +1,170 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// PostPublish is called with the digest reference of each result pushed to a
+// registry, and the remote options it was pushed with.
+type PostPublish func(ctx context.Context, ref name.Digest, opt []remote.Option) error
+
+// Cosign's simple signing format, which `cosign verify --key` checks.
+const (
+	cosignPayloadType         = "cosign container image signature"
+	cosignSignatureMediaType  = types.MediaType("application/vnd.dev.cosign.simplesigning.v1+json")
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+)
+
+type cosignPayload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]interface{} `json:"optional"`
+}
+
+// NewCosignSigner returns a PostPublish that signs each result with key, like
+// `cosign sign --key`, and pushes the signature to the tag cosign looks for,
+// sha256-<hex>.sig in the same repository. Signatures already there are kept,
+// and a result that key already signed isn't signed again. key must be an
+// ECDSA or RSA key, which sign the payload's SHA-256 digest, as cosign
+// expects.
+func NewCosignSigner(key crypto.Signer) PostPublish {
+	return func(ctx context.Context, ref name.Digest, opt []remote.Option) error {
+		p := cosignPayload{}
+		p.Critical.Identity.DockerReference = ref.Context().Name()
+		p.Critical.Image.DockerManifestDigest = ref.DigestStr()
+		p.Critical.Type = cosignPayloadType
+		payload, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		h := sha256.Sum256(payload)
+
+		tag := ref.Context().Tag(strings.Replace(ref.DigestStr(), ":", "-", 1) + ".sig")
+		base, err := remote.Image(tag, opt...)
+		if err != nil {
+			var terr *transport.Error
+			if !errors.As(err, &terr) || terr.StatusCode != http.StatusNotFound {
+				return fmt.Errorf("fetching %s: %v", tag, err)
+			}
+			base = mutate.MediaType(empty.Image, types.OCIManifestSchema1)
+		} else if signed, err := signedBy(base, h[:], key.Public()); err != nil {
+			return fmt.Errorf("fetching %s: %v", tag, err)
+		} else if signed {
+			log.Printf("Not signing %v again, %s already has its signature", ref, tag)
+			return nil
+		}
+
+		sig, err := key.Sign(rand.Reader, h[:], crypto.SHA256)
+		if err != nil {
+			return fmt.Errorf("signing %s: %v", ref, err)
+		}
+		img, err := mutate.Append(base, mutate.Addendum{
+			Layer:     &payloadLayer{payload: payload},
+			MediaType: cosignSignatureMediaType,
+			Annotations: map[string]string{
+				cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(sig),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("Signing %v", ref)
+		return remote.Write(tag, img, opt...)
+	}
+}
+
+// signedBy reports whether the signature image sigs already has a signature
+// by key of the payload whose SHA-256 digest is h. Signatures by ECDSA keys
+// differ each time, so they're verified rather than compared.
+func signedBy(sigs v1.Image, h []byte, key crypto.PublicKey) (bool, error) {
+	m, err := sigs.Manifest()
+	if err != nil {
+		return false, err
+	}
+	for _, desc := range m.Layers {
+		if desc.Digest.Algorithm != "sha256" || desc.Digest.Hex != fmt.Sprintf("%x", h) {
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(desc.Annotations[cosignSignatureAnnotation])
+		if err != nil {
+			continue
+		}
+		if verifyDigest(key, h, sig) == nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// payloadLayer is a layer whose blob is payload itself, uncompressed, as
+// cosign stores signature payloads.
+type payloadLayer struct {
+	payload []byte
+}
+
+func (l *payloadLayer) Digest() (v1.Hash, error) {
+	h, _, err := v1.SHA256(bytes.NewReader(l.payload))
+	return h, err
+}
+
+func (l *payloadLayer) DiffID() (v1.Hash, error) {
+	return l.Digest()
+}
+
+func (l *payloadLayer) Compressed() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(l.payload)), nil
+}
+
+func (l *payloadLayer) Uncompressed() (io.ReadCloser, error) {
+	return l.Compressed()
+}
+
+func (l *payloadLayer) Size() (int64, error) {
+	return int64(len(l.payload)), nil
+}
+
+func (l *payloadLayer) MediaType() (types.MediaType, error) {
+	return cosignSignatureMediaType, nil
+}
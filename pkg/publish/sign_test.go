@@ -0,0 +1,126 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/publish"
+	"github.com/google/ko/pkg/registrytest"
+)
+
+func TestCosignSigner(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+
+	var keys []*ecdsa.PrivateKey
+	for i := 0; i < 2; i++ {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	sign := func(key *ecdsa.PrivateKey) name.Reference {
+		t.Helper()
+		def, err := publish.NewDefault(reg.Host()+"/blah", publish.WithPostPublish(publish.NewCosignSigner(key)))
+		if err != nil {
+			t.Fatalf("NewDefault() = %v", err)
+		}
+		ref, err := def.Publish(context.Background(), img, build.StrictScheme+"github.com/google/ko/cmd/app")
+		if err != nil {
+			t.Fatalf("Publish() = %v", err)
+		}
+		return ref
+	}
+
+	// Publishing again with the same key doesn't sign again, but another
+	// key's signature is added to those there, like cosign does.
+	sign(keys[0])
+	sign(keys[0])
+	dig := sign(keys[1]).(*name.Digest)
+
+	tag := dig.Context().Tag(strings.Replace(dig.DigestStr(), ":", "-", 1) + ".sig")
+	sigImg, err := remote.Image(tag)
+	if err != nil {
+		t.Fatalf("remote.Image(%s) = %v", tag, err)
+	}
+	m, err := sigImg.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Layers) != 2 {
+		t.Fatalf("%s has %d signatures, wanted 2", tag, len(m.Layers))
+	}
+	for i, desc := range m.Layers {
+		if got, want := string(desc.MediaType), "application/vnd.dev.cosign.simplesigning.v1+json"; got != want {
+			t.Errorf("signature media type = %s, wanted %s", got, want)
+		}
+		l, err := sigImg.LayerByDigest(desc.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc, err := l.Compressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var p struct {
+			Critical struct {
+				Identity struct {
+					DockerReference string `json:"docker-reference"`
+				} `json:"identity"`
+				Image struct {
+					DockerManifestDigest string `json:"docker-manifest-digest"`
+				} `json:"image"`
+			} `json:"critical"`
+		}
+		if err := json.Unmarshal(payload, &p); err != nil {
+			t.Fatalf("json.Unmarshal(%s) = %v", payload, err)
+		}
+		if got, want := p.Critical.Identity.DockerReference, dig.Context().Name(); got != want {
+			t.Errorf("docker-reference = %s, wanted %s", got, want)
+		}
+		if got, want := p.Critical.Image.DockerManifestDigest, dig.DigestStr(); got != want {
+			t.Errorf("docker-manifest-digest = %s, wanted %s", got, want)
+		}
+
+		sig, err := base64.StdEncoding.DecodeString(desc.Annotations["dev.cosignproject.cosign/signature"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := sha256.Sum256(payload)
+		if !ecdsa.VerifyASN1(&keys[i].PublicKey, h[:], sig) {
+			t.Errorf("signature %d doesn't verify with its signing key", i)
+		}
+	}
+}
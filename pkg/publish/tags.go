@@ -0,0 +1,107 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/warnings"
+	specsv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// TagData is the data available to tags that are Go templates, e.g.
+// "{{.Module.Version}}".
+type TagData struct {
+	Module struct {
+		// Version is the version of the module providing the image's
+		// main package, or build.DevelVersion if it has none.
+		Version string
+	}
+}
+
+// expandTags executes the tags that are templates with the TagData of br.
+// Tags that use the version of a module that has none are skipped, and if
+// that skips every tag, the default tag is used instead.
+func expandTags(tags []string, br build.Result) ([]string, error) {
+	var data *TagData
+	expanded := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if !strings.Contains(tag, "{{") {
+			expanded = append(expanded, tag)
+			continue
+		}
+		if data == nil {
+			var err error
+			if data, err = tagData(br); err != nil {
+				return nil, err
+			}
+		}
+		tmpl, err := template.New("tag").Option("missingkey=error").Parse(tag)
+		if err != nil {
+			return nil, fmt.Errorf("parsing tag %q: %v", tag, err)
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("executing tag %q: %v", tag, err)
+		}
+		if strings.Contains(buf.String(), build.DevelVersion) {
+			warnings.Warnf(warnings.SkippedTag, "skipping tag %q, the module has no version", tag)
+			continue
+		}
+		// Build metadata (e.g. "+incompatible") can't be in tags.
+		expanded = append(expanded, strings.ReplaceAll(buf.String(), "+", "-"))
+	}
+	if len(expanded) == 0 && len(tags) > 0 {
+		return defaultTags, nil
+	}
+	return expanded, nil
+}
+
+// tagData reads the TagData of br from the labels of its image, or the first
+// image of an index.
+func tagData(br build.Result) (*TagData, error) {
+	img, ok := br.(v1.Image)
+	if idx, isIndex := br.(v1.ImageIndex); isIndex {
+		im, err := idx.IndexManifest()
+		if err != nil {
+			return nil, err
+		}
+		if len(im.Manifests) == 0 {
+			return nil, errors.New("index has no images")
+		}
+		if img, err = idx.Image(im.Manifests[0].Digest); err != nil {
+			return nil, err
+		}
+	} else if !ok {
+		return nil, fmt.Errorf("failed to interpret result as image: %v", br)
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	data := &TagData{}
+	data.Module.Version = build.DevelVersion
+	if v := cf.Config.Labels[specsv1.AnnotationVersion]; v != "" {
+		data.Module.Version = v
+	}
+	return data, nil
+}
@@ -17,6 +17,7 @@ package publish
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"strings"
 
@@ -57,7 +58,11 @@ func (t *tar) Publish(_ context.Context, br build.Result, s string) (name.Refere
 		return nil, fmt.Errorf("failed to interpret %s result as image: %v", s, br)
 	}
 
-	for _, tagName := range t.tags {
+	tags, err := expandTags(t.tags, br)
+	if err != nil {
+		return nil, err
+	}
+	for _, tagName := range tags {
 		tag, err := name.ParseReference(fmt.Sprintf("%s:%s", t.namer(t.base, s), tagName))
 		if err != nil {
 			return nil, err
@@ -70,7 +75,7 @@ func (t *tar) Publish(_ context.Context, br build.Result, s string) (name.Refere
 		return nil, err
 	}
 
-	if len(t.tags) == 0 {
+	if len(tags) == 0 {
 		ref, err := name.ParseReference(fmt.Sprintf("%s@%s", t.namer(t.base, s), h))
 		if err != nil {
 			return nil, err
@@ -79,10 +84,10 @@ func (t *tar) Publish(_ context.Context, br build.Result, s string) (name.Refere
 	}
 
 	ref := fmt.Sprintf("%s@%s", t.namer(t.base, s), h)
-	if len(t.tags) == 1 && t.tags[0] != defaultTags[0] {
+	if len(tags) == 1 && tags[0] != defaultTags[0] {
 		// If a single tag is explicitly set (not latest), then this
 		// is probably a release, so include the tag in the reference.
-		ref = fmt.Sprintf("%s:%s@%s", t.namer(t.base, s), t.tags[0], h)
+		ref = fmt.Sprintf("%s:%s@%s", t.namer(t.base, s), tags[0], h)
 	}
 	dig, err := name.NewDigest(ref)
 	if err != nil {
@@ -94,7 +99,11 @@ func (t *tar) Publish(_ context.Context, br build.Result, s string) (name.Refere
 
 func (t *tar) Close() error {
 	log.Printf("Saving %v", t.file)
-	if err := tarball.MultiRefWriteToFile(t.file, t.refs); err != nil {
+	// Write to a temporary file and rename it into place, so that running
+	// out of disk space never leaves a truncated tarball behind.
+	if err := build.WriteFileAtomically(t.file, func(w io.Writer) error {
+		return tarball.MultiRefWrite(t.refs, w)
+	}); err != nil {
 		// Bad practice, but we log  this here because right now we just defer the Close.
 		log.Printf("failed to save %q: %v", t.file, err)
 		return err
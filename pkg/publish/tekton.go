@@ -0,0 +1,102 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/ko/pkg/build"
+)
+
+// tektonResults composes with another Interface to write the reference each
+// import path was published to as Tekton results.
+type tektonResults struct {
+	dir   string
+	inner Interface
+}
+
+// tektonResults implements Interface
+var _ Interface = (*tektonResults)(nil)
+
+// NewTektonResults returns a publisher that publishes with inner, and then
+// writes the repository and digest of each image to <name>_IMAGE_URL and
+// <name>_IMAGE_DIGEST in dir (e.g. /tekton/results), where <name> is derived
+// from the import path with TektonResultName. Tekton Chains recognizes
+// results named like this as images built by the task.
+func NewTektonResults(dir string, inner Interface) (Interface, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, build.WrapNoSpace(err, dir)
+	}
+	return &tektonResults{dir: dir, inner: inner}, nil
+}
+
+// invalidResultChars are those not allowed in Tekton result names.
+var invalidResultChars = regexp.MustCompile("[^A-Za-z0-9_.-]+")
+
+// TektonResultName returns the prefix of the Tekton results for the image
+// of an import path: the import path, without ko://, with any characters
+// that aren't allowed in result names (e.g. "/") replaced by "-".
+func TektonResultName(importpath string) string {
+	importpath = strings.TrimPrefix(importpath, build.StrictScheme)
+	return strings.Trim(invalidResultChars.ReplaceAllString(importpath, "-"), "-_.")
+}
+
+// Publish implements Interface
+func (t *tektonResults) Publish(ctx context.Context, br build.Result, s string) (name.Reference, error) {
+	ref, err := t.inner.Publish(ctx, br, s)
+	if err != nil {
+		return nil, err
+	}
+
+	// Publishers that publish by tag (e.g. to the daemon) don't tell us the
+	// digest, so take it from the build result instead.
+	var digest string
+	if d, ok := ref.(name.Digest); ok {
+		digest = d.DigestStr()
+	} else {
+		h, err := br.Digest()
+		if err != nil {
+			return nil, err
+		}
+		digest = h.String()
+	}
+
+	prefix := filepath.Join(t.dir, TektonResultName(s))
+	for file, value := range map[string]string{
+		prefix + "_IMAGE_URL":    ref.Context().String(),
+		prefix + "_IMAGE_DIGEST": digest,
+	} {
+		value := value
+		if err := build.WriteFileAtomically(file, func(w io.Writer) error {
+			_, err := io.WriteString(w, value)
+			return err
+		}); err != nil {
+			return nil, fmt.Errorf("writing Tekton result for %s: %v", s, err)
+		}
+	}
+	return ref, nil
+}
+
+// Close implements Interface
+func (t *tektonResults) Close() error {
+	return t.inner.Close()
+}
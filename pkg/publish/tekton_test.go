@@ -0,0 +1,129 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/ko/pkg/build"
+)
+
+// refPublisher publishes everything to ref.
+type refPublisher struct {
+	ref name.Reference
+}
+
+func (p refPublisher) Publish(context.Context, build.Result, string) (name.Reference, error) {
+	return p.ref, nil
+}
+
+func (refPublisher) Close() error { return nil }
+
+func TestTektonResults(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image() = %v", err)
+	}
+	h, err := img.Digest()
+	if err != nil {
+		t.Fatalf("Digest() = %v", err)
+	}
+	dir, err := ioutil.TempDir("", "tekton")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		description string
+		ref         string
+		importpath  string
+		wantName    string
+	}{{
+		description: "by digest",
+		ref:         "gcr.io/foo/app@" + h.String(),
+		importpath:  "ko://github.com/foo/cmd/app",
+		wantName:    "github.com-foo-cmd-app",
+	}, {
+		description: "by tag",
+		ref:         "ko.local/bar:latest",
+		importpath:  "ko://multi:github.com/foo/cmd/bar,github.com/foo/cmd/baz@v1.2.3",
+		wantName:    "multi-github.com-foo-cmd-bar-github.com-foo-cmd-baz-v1.2.3",
+	}} {
+		t.Run(test.description, func(t *testing.T) {
+			ref, err := name.ParseReference(test.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pub, err := NewTektonResults(dir, refPublisher{ref})
+			if err != nil {
+				t.Fatalf("NewTektonResults() = %v", err)
+			}
+			defer pub.Close()
+			if _, err := pub.Publish(context.Background(), img, test.importpath); err != nil {
+				t.Fatalf("Publish() = %v", err)
+			}
+
+			if got := TektonResultName(test.importpath); got != test.wantName {
+				t.Errorf("TektonResultName() = %s, wanted %s", got, test.wantName)
+			}
+			got := map[string]string{}
+			for _, result := range []string{"_IMAGE_URL", "_IMAGE_DIGEST"} {
+				b, err := ioutil.ReadFile(filepath.Join(dir, test.wantName+result))
+				if err != nil {
+					t.Fatalf("ReadFile() = %v", err)
+				}
+				got[result] = string(b)
+			}
+			want := map[string]string{
+				"_IMAGE_URL":    ref.Context().String(),
+				"_IMAGE_DIGEST": h.String(),
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("results (-want +got): %s", diff)
+			}
+		})
+	}
+}
+
+func TestTektonResultsSkipsErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tekton")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pub, err := NewTektonResults(dir, erroringPublisher{})
+	if err != nil {
+		t.Fatalf("NewTektonResults() = %v", err)
+	}
+	if _, err := pub.Publish(context.Background(), nil, "ko://github.com/foo/a"); err == nil {
+		t.Error("Publish() = nil, wanted error")
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("wrote %d results for a failed publish, wanted none", len(files))
+	}
+}
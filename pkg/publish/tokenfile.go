@@ -0,0 +1,69 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+// tokenFile is an authn.Authenticator whose bearer token is read from a
+// file, e.g. one a sidecar rewrites as the token rotates. The file is read
+// again whenever it changes.
+type tokenFile struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	token   string
+}
+
+var _ authn.Authenticator = (*tokenFile)(nil)
+
+// NewTokenFileAuthenticator returns an authn.Authenticator that sends the
+// bearer token in the file at path, as it is when each request is
+// authorized.
+func NewTokenFileAuthenticator(path string) authn.Authenticator {
+	return &tokenFile{path: path}
+}
+
+// Authorization implements authn.Authenticator.
+func (t *tokenFile) Authorization() (*authn.AuthConfig, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fi, err := os.Stat(t.path)
+	if err != nil {
+		return nil, fmt.Errorf("reading the registry token: %v", err)
+	}
+	if t.token == "" || !fi.ModTime().Equal(t.modTime) || fi.Size() != t.size {
+		b, err := ioutil.ReadFile(t.path)
+		if err != nil {
+			return nil, fmt.Errorf("reading the registry token: %v", err)
+		}
+		token := strings.TrimSpace(string(b))
+		if token == "" {
+			return nil, fmt.Errorf("reading the registry token: %s is empty", t.path)
+		}
+		t.token, t.modTime, t.size = token, fi.ModTime(), fi.Size()
+	}
+	return &authn.AuthConfig{RegistryToken: t.token}, nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish_test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/publish"
+	"github.com/google/ko/pkg/registrytest"
+)
+
+func TestWithAuthFromTokenFile(t *testing.T) {
+	const importpath = "github.com/google/ko/cmd/app"
+	tokenFile := filepath.Join(t.TempDir(), "token")
+
+	if _, err := publish.NewDefault("example.com/blah", publish.WithAuthFromTokenFile(tokenFile)); err == nil {
+		t.Error("NewDefault() without the token file succeeded, wanted error")
+	}
+
+	if err := ioutil.WriteFile(tokenFile, []byte("first-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reg := registrytest.New(registrytest.WithBearerToken("first-token"))
+	defer reg.Close()
+	repoName := reg.Host() + "/blah"
+
+	anon, err := publish.NewDefault(repoName)
+	if err != nil {
+		t.Fatalf("NewDefault() = %v", err)
+	}
+	if _, err := anon.Publish(context.Background(), img, build.StrictScheme+importpath); err == nil {
+		t.Error("Publish() without the token succeeded, wanted error")
+	}
+
+	def, err := publish.NewDefault(repoName, publish.WithAuthFromTokenFile(tokenFile))
+	if err != nil {
+		t.Fatalf("NewDefault() = %v", err)
+	}
+	if _, err := def.Publish(context.Background(), img, build.StrictScheme+importpath); err != nil {
+		t.Fatalf("Publish() = %v", err)
+	}
+
+	// The token rotates, and the file is rewritten.
+	reg.SetBearerToken("second-token-rotated")
+	if err := ioutil.WriteFile(tokenFile, []byte("second-token-rotated\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := def.Publish(context.Background(), rotated, build.StrictScheme+importpath+"/rotated"); err != nil {
+		t.Fatalf("Publish() after rotating the token = %v", err)
+	}
+	if !reg.HasManifest("blah/"+importpath+"/rotated", "latest") {
+		t.Error("Publish() after rotating the token didn't push latest")
+	}
+}
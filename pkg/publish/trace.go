@@ -0,0 +1,54 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"context"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/ko/pkg/build"
+	"github.com/google/ko/pkg/trace"
+)
+
+// Traced composes with another Interface to record a "publish" span for
+// each publish, when tracing is enabled.
+type Traced struct {
+	Publisher Interface
+}
+
+// Traced implements Interface
+var _ Interface = (*Traced)(nil)
+
+// Publish implements Interface
+func (t *Traced) Publish(ctx context.Context, br build.Result, s string) (name.Reference, error) {
+	ctx, span := trace.Start(ctx, "publish", trace.String("ko.importpath", strings.TrimPrefix(s, build.StrictScheme)))
+	ref, err := t.Publisher.Publish(ctx, br, s)
+	if err == nil {
+		span.SetAttributes(trace.String("ko.reference", ref.String()))
+	}
+	span.End(err)
+	return ref, err
+}
+
+// Close implements Interface
+func (t *Traced) Close() error {
+	return t.Publisher.Close()
+}
+
+// NewTraced returns a new publisher that traces the publishes of p.
+func NewTraced(p Interface) *Traced {
+	return &Traced{Publisher: p}
+}
@@ -0,0 +1,300 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The annotation with which keyless cosign signatures carry their Rekor
+// bundle: the transparency log entry of the signature, and the log's
+// signed promise to include it, the SignedEntryTimestamp.
+const cosignBundleAnnotation = "dev.sigstore.cosign/bundle"
+
+// sctListOID is the certificate extension in which Fulcio embeds the signed
+// certificate timestamps of the CT logs it logged the certificate to.
+var sctListOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+type rekorBundle struct {
+	SignedEntryTimestamp []byte
+	Payload              rekorPayload
+}
+
+// rekorPayload is what the SignedEntryTimestamp signs, as canonical JSON.
+// The fields are in the order canonical JSON sorts them in, and none of
+// their values need escaping, so json.Marshal writes it canonically.
+type rekorPayload struct {
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogID          string `json:"logID"`
+	LogIndex       int64  `json:"logIndex"`
+}
+
+// hashedRekord is the body of the Rekor entry of a signature.
+type hashedRekord struct {
+	Kind string `json:"kind"`
+	Spec struct {
+		Data struct {
+			Hash struct {
+				Algorithm string `json:"algorithm"`
+				Value     string `json:"value"`
+			} `json:"hash"`
+		} `json:"data"`
+		Signature struct {
+			Content   []byte `json:"content"`
+			PublicKey struct {
+				Content []byte `json:"content"`
+			} `json:"publicKey"`
+		} `json:"signature"`
+	} `json:"spec"`
+}
+
+// verifyBundle checks that the bundle in annotations is signed by one of
+// rekorKeys, and logs sig of payload by cert, and returns when it was
+// logged.
+func verifyBundle(annotations map[string]string, cert *x509.Certificate, sig, payload []byte, rekorKeys []crypto.PublicKey) (time.Time, error) {
+	raw, ok := annotations[cosignBundleAnnotation]
+	if !ok {
+		return time.Time{}, errors.New("not in a transparency log, there's no Rekor bundle")
+	}
+	var b rekorBundle
+	if err := json.Unmarshal([]byte(raw), &b); err != nil {
+		return time.Time{}, fmt.Errorf("decoding Rekor bundle: %v", err)
+	}
+	key, ok := logKey(rekorKeys, b.Payload.LogID)
+	if !ok {
+		return time.Time{}, fmt.Errorf("Rekor bundle is from log %s, which isn't trusted", b.Payload.LogID)
+	}
+	signed, err := json.Marshal(b.Payload)
+	if err != nil {
+		return time.Time{}, err
+	}
+	h := sha256.Sum256(signed)
+	if err := verifyDigest(key, h[:], b.SignedEntryTimestamp); err != nil {
+		return time.Time{}, fmt.Errorf("Rekor bundle: %v", err)
+	}
+
+	body, err := base64.StdEncoding.DecodeString(b.Payload.Body)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("decoding Rekor entry: %v", err)
+	}
+	var entry hashedRekord
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return time.Time{}, fmt.Errorf("decoding Rekor entry: %v", err)
+	}
+	if entry.Kind != "hashedrekord" {
+		return time.Time{}, fmt.Errorf("Rekor entry is a %q, not a hashedrekord", entry.Kind)
+	}
+	ph := sha256.Sum256(payload)
+	if entry.Spec.Data.Hash.Algorithm != "sha256" || entry.Spec.Data.Hash.Value != hex.EncodeToString(ph[:]) {
+		return time.Time{}, errors.New("Rekor entry is for another payload")
+	}
+	if !bytes.Equal(entry.Spec.Signature.Content, sig) {
+		return time.Time{}, errors.New("Rekor entry is for another signature")
+	}
+	logged, err := parseCertificate(entry.Spec.Signature.PublicKey.Content)
+	if err != nil || !logged.Equal(cert) {
+		return time.Time{}, errors.New("Rekor entry is for another certificate")
+	}
+
+	t := time.Unix(b.Payload.IntegratedTime, 0)
+	if t.Before(cert.NotBefore) || t.After(cert.NotAfter) {
+		return time.Time{}, fmt.Errorf("logged at %s, when the certificate wasn't valid", t.UTC().Format(time.RFC3339))
+	}
+	return t, nil
+}
+
+// verifySCT checks that cert, issued by issuer, embeds a signed certificate
+// timestamp from one of ctKeys, which promises that the certificate was
+// logged, so that its owner can find out that it was issued.
+func verifySCT(cert, issuer *x509.Certificate, ctKeys []crypto.PublicKey) error {
+	var list []byte
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(sctListOID) {
+			if _, err := asn1.Unmarshal(ext.Value, &list); err != nil {
+				return fmt.Errorf("decoding SCTs: %v", err)
+			}
+		}
+	}
+	if list == nil {
+		return errors.New("certificate has no SCTs")
+	}
+	scts, r, err := readTLSVector(list, 2)
+	if err == nil && len(r) != 0 {
+		err = errors.New("trailing data")
+	}
+	if err != nil {
+		return fmt.Errorf("decoding SCTs: %v", err)
+	}
+	tbs, err := tbsWithoutExtension(cert.RawTBSCertificate, sctListOID)
+	if err != nil {
+		return fmt.Errorf("decoding certificate: %v", err)
+	}
+	issuerKeyHash := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+
+	for rest := scts; len(rest) > 0; {
+		sct, r, err := readTLSVector(rest, 2)
+		if err != nil {
+			return fmt.Errorf("decoding SCTs: %v", err)
+		}
+		rest = r
+		// An SCT v1 is the version, the log's ID, the timestamp, the
+		// extensions, and the hash and signature algorithms and
+		// signature over what's below.
+		if len(sct) < 1+32+8+2 || sct[0] != 0 {
+			continue
+		}
+		logID, timestamp := sct[1:33], sct[33:41]
+		exts, r, err := readTLSVector(sct[41:], 2)
+		if err != nil || len(r) < 2 {
+			continue
+		}
+		sig, r, err := readTLSVector(r[2:], 2)
+		if err != nil || len(r) != 0 {
+			continue
+		}
+		key, ok := logKey(ctKeys, hex.EncodeToString(logID))
+		if !ok {
+			continue
+		}
+
+		// The log signed the certificate as it was before the SCTs were
+		// added, with the hash of the issuer's key.
+		var signed bytes.Buffer
+		signed.Write([]byte{0, 0}) // v1, certificate_timestamp
+		signed.Write(timestamp)
+		signed.Write([]byte{0, 1}) // precert_entry
+		signed.Write(issuerKeyHash[:])
+		signed.Write([]byte{byte(len(tbs) >> 16), byte(len(tbs) >> 8), byte(len(tbs))})
+		signed.Write(tbs)
+		signed.Write([]byte{byte(len(exts) >> 8), byte(len(exts))})
+		signed.Write(exts)
+		h := sha256.Sum256(signed.Bytes())
+		if verifyDigest(key, h[:], sig) == nil {
+			return nil
+		}
+	}
+	return errors.New("certificate has no SCT from a trusted CT log")
+}
+
+// readTLSVector reads a TLS vector, its length in n bytes, from the start of
+// b, and returns it and the rest of b.
+func readTLSVector(b []byte, n int) ([]byte, []byte, error) {
+	if len(b) < n {
+		return nil, nil, errors.New("truncated")
+	}
+	var l int
+	for _, c := range b[:n] {
+		l = l<<8 | int(c)
+	}
+	if len(b) < n+l {
+		return nil, nil, errors.New("truncated")
+	}
+	return b[n : n+l], b[n+l:], nil
+}
+
+// tbsWithoutExtension returns the DER TBSCertificate tbs, without its
+// extension oid.
+func tbsWithoutExtension(tbs []byte, oid asn1.ObjectIdentifier) ([]byte, error) {
+	var seq asn1.RawValue
+	if rest, err := asn1.Unmarshal(tbs, &seq); err != nil {
+		return nil, err
+	} else if len(rest) > 0 {
+		return nil, errors.New("trailing data")
+	}
+	var fields []byte
+	for rest := seq.Bytes; len(rest) > 0; {
+		var f asn1.RawValue
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &f); err != nil {
+			return nil, err
+		}
+		// The extensions are the [3] EXPLICIT field.
+		if f.Class != asn1.ClassContextSpecific || f.Tag != 3 {
+			fields = append(fields, f.FullBytes...)
+			continue
+		}
+		var exts asn1.RawValue
+		if _, err := asn1.Unmarshal(f.Bytes, &exts); err != nil {
+			return nil, err
+		}
+		var kept []byte
+		for e := exts.Bytes; len(e) > 0; {
+			var ext pkix.Extension
+			before := e
+			if e, err = asn1.Unmarshal(e, &ext); err != nil {
+				return nil, err
+			}
+			if !ext.Id.Equal(oid) {
+				kept = append(kept, before[:len(before)-len(e)]...)
+			}
+		}
+		inner, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: kept})
+		if err != nil {
+			return nil, err
+		}
+		outer, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 3, IsCompound: true, Bytes: inner})
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, outer...)
+	}
+	return asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: fields})
+}
+
+// logKey returns the key in keys whose log ID, the hex SHA-256 of its DER
+// public key, is id.
+func logKey(keys []crypto.PublicKey, id string) (crypto.PublicKey, bool) {
+	for _, key := range keys {
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			continue
+		}
+		if h := sha256.Sum256(der); hex.EncodeToString(h[:]) == id {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// verifyDigest checks sig, by key, of the SHA-256 digest h.
+func verifyDigest(key crypto.PublicKey, h, sig []byte) error {
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, h, sig) {
+			return errors.New("invalid signature")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, h, sig); err != nil {
+			return errors.New("invalid signature")
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", key)
+	}
+	return nil
+}
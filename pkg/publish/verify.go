@@ -0,0 +1,245 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// The annotations with which keyless cosign signatures carry the signing
+// certificate, issued for the signer's identity, and its chain.
+const (
+	cosignCertificateAnnotation = "dev.sigstore.cosign/certificate"
+	cosignChainAnnotation       = "dev.sigstore.cosign/chain"
+)
+
+// The extensions of certificates issued by Fulcio that record the OIDC
+// issuer of the identity: the original one, with the raw issuer, and its
+// replacement, with a DER-encoded UTF8String.
+var (
+	fulcioIssuerOID   = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	fulcioIssuerV2OID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// CosignVerifier verifies the keyless cosign signatures of images, like
+// `cosign verify --certificate-identity --certificate-oidc-issuer`.
+type CosignVerifier struct {
+	// Identity is the email address or URI the signing certificate must
+	// be issued for.
+	Identity string
+	// Issuer is the OIDC issuer that must have vouched for Identity.
+	// Empty matches any issuer.
+	Issuer string
+	// Roots are the certificate authorities (e.g. Fulcio's) that must
+	// have issued the signing certificate.
+	Roots *x509.CertPool
+	// RekorKeys are the keys of the transparency logs (e.g. Rekor's) one
+	// of which must have logged the signature while its certificate was
+	// valid.
+	RekorKeys []crypto.PublicKey
+	// CTLogKeys are the keys of the certificate transparency logs one of
+	// which must have logged the signing certificate.
+	CTLogKeys []crypto.PublicKey
+}
+
+// Verify checks that ref has a signature, at the tag cosign pushes them to,
+// by a certificate for v.Identity and v.Issuer, chaining to v.Roots. Signing
+// certificates are short-lived, so the signature must also have been logged
+// by one of v.RekorKeys while its certificate was valid, and the certificate
+// by one of v.CTLogKeys.
+func (v *CosignVerifier) Verify(ref name.Digest, opt ...remote.Option) error {
+	tag := ref.Context().Tag(strings.Replace(ref.DigestStr(), ":", "-", 1) + ".sig")
+	img, err := remote.Image(tag, opt...)
+	if err != nil {
+		var terr *transport.Error
+		if errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("%s has no signatures", ref)
+		}
+		return fmt.Errorf("fetching the signatures of %s: %v", ref, err)
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		return fmt.Errorf("fetching the signatures of %s: %v", ref, err)
+	}
+	var reasons []string
+	for i, desc := range m.Layers {
+		if desc.MediaType != cosignSignatureMediaType {
+			continue
+		}
+		l, err := img.LayerByDigest(desc.Digest)
+		if err != nil {
+			return fmt.Errorf("fetching signature %d of %s: %v", i, ref, err)
+		}
+		rc, err := l.Compressed()
+		if err != nil {
+			return fmt.Errorf("fetching signature %d of %s: %v", i, ref, err)
+		}
+		payload, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("fetching signature %d of %s: %v", i, ref, err)
+		}
+		if err := v.verifySignature(ref, desc.Annotations, payload); err != nil {
+			reasons = append(reasons, fmt.Sprintf("signature %d: %v", i, err))
+			continue
+		}
+		return nil
+	}
+	if len(reasons) == 0 {
+		return fmt.Errorf("%s has no signatures", ref)
+	}
+	return fmt.Errorf("%s has no signature by %s:\n  %s", ref, v.signer(), strings.Join(reasons, "\n  "))
+}
+
+func (v *CosignVerifier) signer() string {
+	if v.Issuer == "" {
+		return v.Identity
+	}
+	return v.Identity + " from " + v.Issuer
+}
+
+// verifySignature verifies a single signature of ref, with the annotations
+// of its layer, and its payload.
+func (v *CosignVerifier) verifySignature(ref name.Digest, annotations map[string]string, payload []byte) error {
+	certPEM, ok := annotations[cosignCertificateAnnotation]
+	if !ok {
+		return errors.New("not signed with a certificate")
+	}
+	cert, err := parseCertificate([]byte(certPEM))
+	if err != nil {
+		return fmt.Errorf("certificate: %v", err)
+	}
+	intermediates := x509.NewCertPool()
+	for rest := []byte(annotations[cosignChainAnnotation]); ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("certificate chain: %v", err)
+		}
+		intermediates.AddCert(c)
+	}
+	sig, err := base64.StdEncoding.DecodeString(annotations[cosignSignatureAnnotation])
+	if err != nil {
+		return fmt.Errorf("decoding signature: %v", err)
+	}
+	h := sha256.Sum256(payload)
+	if err := verifyDigest(cert.PublicKey, h[:], sig); err != nil {
+		return err
+	}
+
+	// Anyone with the key of a certificate, which isn't secret after it
+	// expires, can sign with it, so it's checked as of when the log says
+	// that the signature was made.
+	signedAt, err := verifyBundle(annotations, cert, sig, payload, v.RekorKeys)
+	if err != nil {
+		return err
+	}
+	chains, err := cert.Verify(x509.VerifyOptions{
+		Roots:         v.Roots,
+		Intermediates: intermediates,
+		CurrentTime:   signedAt,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	if err != nil {
+		return fmt.Errorf("certificate: %v", err)
+	}
+	if len(chains[0]) < 2 {
+		return errors.New("certificate is a root, not issued by one")
+	}
+	if err := verifySCT(cert, chains[0][1], v.CTLogKeys); err != nil {
+		return err
+	}
+	if !hasIdentity(cert, v.Identity) {
+		return fmt.Errorf("certificate is for %s, not %s", identities(cert), v.Identity)
+	}
+	if v.Issuer != "" {
+		if issuer := certIssuer(cert); issuer != v.Issuer {
+			return fmt.Errorf("certificate is from issuer %q, not %q", issuer, v.Issuer)
+		}
+	}
+
+	var p cosignPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return fmt.Errorf("decoding payload: %v", err)
+	}
+	if p.Critical.Type != cosignPayloadType {
+		return fmt.Errorf("payload type is %q, not %q", p.Critical.Type, cosignPayloadType)
+	}
+	if p.Critical.Image.DockerManifestDigest != ref.DigestStr() {
+		return fmt.Errorf("signs %s, not %s", p.Critical.Image.DockerManifestDigest, ref.DigestStr())
+	}
+	return nil
+}
+
+func parseCertificate(b []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// hasIdentity returns whether cert is issued for identity, as one of its
+// email addresses or URIs.
+func hasIdentity(cert *x509.Certificate, identity string) bool {
+	for _, id := range identities(cert) {
+		if id == identity {
+			return true
+		}
+	}
+	return false
+}
+
+func identities(cert *x509.Certificate) []string {
+	ids := append([]string{}, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		ids = append(ids, u.String())
+	}
+	return ids
+}
+
+// certIssuer returns the OIDC issuer recorded in cert by Fulcio, if any.
+func certIssuer(cert *x509.Certificate) string {
+	for _, ext := range cert.Extensions {
+		switch {
+		case ext.Id.Equal(fulcioIssuerV2OID):
+			var issuer string
+			if _, err := asn1.UnmarshalWithParams(ext.Value, &issuer, "utf8"); err == nil {
+				return issuer
+			}
+		case ext.Id.Equal(fulcioIssuerOID):
+			return string(ext.Value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,441 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package registrytest provides an in-memory container registry, served over
+// HTTP in the test process, with knobs for injecting the failures real
+// registries produce (authentication, rate limits, broken uploads and
+// latency), and helpers for asserting what was pushed to it.
+//
+// A typical test publishes to it like this:
+//
+//	reg := registrytest.New(registrytest.WithRateLimit(1))
+//	defer reg.Close()
+//	p, err := publish.NewDefault(reg.Host() + "/repo")
+//	...
+//	if !reg.HasManifest("repo/app", "latest") {
+//		t.Error("app wasn't pushed")
+//	}
+package registrytest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Registry is an in-memory registry served by an httptest.Server. Close it
+// when done, like an httptest.Server.
+type Registry struct {
+	*httptest.Server
+
+	inner     http.Handler
+	logger    *log.Logger
+	username  string
+	password  string
+	token     string
+	latency   time.Duration
+	referrers bool
+
+	mu             sync.Mutex
+	requests       []string
+	inFlight       int
+	maxInFlight    int
+	rateLimited    int
+	uploadFailures int
+	uploadOffset   int64
+	manifests      map[string][]manifest
+}
+
+// manifest is a manifest pushed to the registry, kept for the referrers API.
+type manifest struct {
+	digest    v1.Hash
+	mediaType string
+	body      []byte
+}
+
+// Option configures a Registry.
+type Option func(*Registry)
+
+// WithAuth requires every request to use HTTP basic authentication with
+// username and password. Authenticator returns credentials that pass.
+func WithAuth(username, password string) Option {
+	return func(r *Registry) {
+		r.username = username
+		r.password = password
+	}
+}
+
+// WithBearerToken requires every request to send token as a bearer token,
+// until SetBearerToken changes it, e.g. as if it were rotated.
+func WithBearerToken(token string) Option {
+	return func(r *Registry) {
+		r.token = token
+	}
+}
+
+// WithRateLimit answers the next n requests, other than the /v2/ version
+// check, with 429 Too Many Requests, as RateLimit does.
+func WithRateLimit(n int) Option {
+	return func(r *Registry) {
+		r.rateLimited = n
+	}
+}
+
+// WithUploadFailures fails the next n blob uploads that send more than
+// offset bytes in one request, as FailUploads does.
+func WithUploadFailures(offset int64, n int) Option {
+	return func(r *Registry) {
+		r.uploadOffset = offset
+		r.uploadFailures = n
+	}
+}
+
+// WithReferrers serves the OCI referrers API (GET /v2/<name>/referrers/<digest>)
+// for manifests pushed with a subject. Without it, the registry answers such
+// requests with 404, like registries that predate the API, so clients fall
+// back to the referrers tag schema.
+func WithReferrers(enabled bool) Option {
+	return func(r *Registry) {
+		r.referrers = enabled
+	}
+}
+
+// WithLatency delays every response by d.
+func WithLatency(d time.Duration) Option {
+	return func(r *Registry) {
+		r.latency = d
+	}
+}
+
+// WithLogger logs every request to l. By default, requests aren't logged.
+func WithLogger(l *log.Logger) Option {
+	return func(r *Registry) {
+		r.logger = l
+	}
+}
+
+// New starts a Registry configured with opts.
+func New(opts ...Option) *Registry {
+	r := &Registry{
+		logger:    log.New(ioutil.Discard, "", 0),
+		manifests: map[string][]manifest{},
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	r.inner = registry.New(registry.Logger(r.logger))
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serveHTTP))
+	return r
+}
+
+// Host returns the host (and port) of the registry, to prefix repositories
+// with, e.g. as KO_DOCKER_REPO.
+func (r *Registry) Host() string {
+	return r.Listener.Addr().String()
+}
+
+// Authenticator returns credentials for the registry, which are anonymous
+// unless WithAuth is used.
+func (r *Registry) Authenticator() authn.Authenticator {
+	if r.username == "" {
+		return authn.Anonymous
+	}
+	return &authn.Basic{Username: r.username, Password: r.password}
+}
+
+// SetBearerToken changes the bearer token that requests must send, as
+// WithBearerToken does.
+func (r *Registry) SetBearerToken(token string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.token = token
+}
+
+// RateLimit answers the next n requests, other than the /v2/ version check,
+// with 429 Too Many Requests.
+func (r *Registry) RateLimit(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rateLimited = n
+}
+
+// FailUploads fails the next n blob uploads that send more than offset bytes
+// in one request, after reading offset bytes of it, with 500 Internal Server
+// Error.
+func (r *Registry) FailUploads(offset int64, n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.uploadOffset = offset
+	r.uploadFailures = n
+}
+
+// Requests returns every request the registry has received, as
+// "METHOD /path", in order.
+func (r *Registry) Requests() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.requests...)
+}
+
+// MaxConcurrentRequests returns the largest number of requests the registry
+// has been serving at once, e.g. to check that a client limits itself.
+func (r *Registry) MaxConcurrentRequests() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.maxInFlight
+}
+
+// Manifest returns the manifest in repo (without the host) for ref, a tag or
+// digest, or an error if there is none.
+func (r *Registry) Manifest(repo, ref string) ([]byte, error) {
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/v2/%s/manifests/%s", repo, ref), nil)
+	resp := httptest.NewRecorder()
+	r.inner.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		return nil, fmt.Errorf("no manifest %s in %s: %d %s", ref, repo, resp.Code, resp.Body.String())
+	}
+	return resp.Body.Bytes(), nil
+}
+
+// HasManifest reports whether repo (without the host) has a manifest for
+// ref, a tag or digest.
+func (r *Registry) HasManifest(repo, ref string) bool {
+	_, err := r.Manifest(repo, ref)
+	return err == nil
+}
+
+// HasBlob reports whether repo (without the host) has the blob with digest.
+func (r *Registry) HasBlob(repo string, digest v1.Hash) bool {
+	req := httptest.NewRequest(http.MethodHead, fmt.Sprintf("/v2/%s/blobs/%s", repo, digest), nil)
+	resp := httptest.NewRecorder()
+	r.inner.ServeHTTP(resp, req)
+	return resp.Code == http.StatusOK
+}
+
+func (r *Registry) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	r.requests = append(r.requests, req.Method+" "+req.URL.Path)
+	token := r.token
+	r.inFlight++
+	if r.inFlight > r.maxInFlight {
+		r.maxInFlight = r.inFlight
+	}
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.inFlight--
+		r.mu.Unlock()
+	}()
+
+	if r.latency > 0 {
+		select {
+		case <-time.After(r.latency):
+		case <-req.Context().Done():
+			return
+		}
+	}
+
+	if r.username != "" {
+		if u, p, ok := req.BasicAuth(); !ok || u != r.username || p != r.password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registrytest"`)
+			writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+			return
+		}
+	}
+
+	if token != "" && req.Header.Get("Authorization") != "Bearer "+token {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registrytest"`, r.URL))
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+		return
+	}
+
+	if req.URL.Path != "/v2/" && r.takeRateLimit() {
+		writeError(w, http.StatusTooManyRequests, "TOOMANYREQUESTS", "rate limit exceeded")
+		return
+	}
+
+	if strings.Contains(req.URL.Path, "/blobs/uploads/") && (req.Method == http.MethodPatch || req.Method == http.MethodPut) {
+		if failed := r.failUpload(w, req); failed {
+			return
+		}
+	}
+
+	if i := strings.Index(req.URL.Path, "/referrers/"); r.referrers && i >= 0 && req.Method == http.MethodGet {
+		r.serveReferrers(w, strings.TrimPrefix(req.URL.Path[:i], "/v2/"), req.URL.Path[i+len("/referrers/"):])
+		return
+	}
+
+	if i := strings.Index(req.URL.Path, "/manifests/"); i >= 0 && req.Method == http.MethodPut {
+		r.putManifest(w, req, strings.TrimPrefix(req.URL.Path[:i], "/v2/"))
+		return
+	}
+
+	r.inner.ServeHTTP(w, req)
+}
+
+// takeRateLimit reports whether a request should be rate limited, and counts
+// it if so.
+func (r *Registry) takeRateLimit() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rateLimited <= 0 {
+		return false
+	}
+	r.rateLimited--
+	return true
+}
+
+// failUpload reads up to the configured offset of an upload, and either
+// fails it, or restores what it read so that the upload can proceed.
+func (r *Registry) failUpload(w http.ResponseWriter, req *http.Request) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.uploadFailures <= 0 {
+		return false
+	}
+	head, err := ioutil.ReadAll(io.LimitReader(req.Body, r.uploadOffset+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "BLOB_UPLOAD_INVALID", err.Error())
+		return true
+	}
+	if int64(len(head)) <= r.uploadOffset {
+		req.Body = ioutil.NopCloser(bytes.NewReader(head))
+		return false
+	}
+	r.uploadFailures--
+	writeError(w, http.StatusInternalServerError, "BLOB_UPLOAD_INVALID",
+		fmt.Sprintf("upload failed after %d bytes", r.uploadOffset))
+	return true
+}
+
+// putManifest passes a manifest on to the registry, and keeps it for the
+// referrers API if it was accepted.
+func (r *Registry) putManifest(w http.ResponseWriter, req *http.Request, repo string) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+		return
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	r.inner.ServeHTTP(sw, req)
+	if sw.status != http.StatusCreated {
+		return
+	}
+	digest, _, err := v1.SHA256(bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range r.manifests[repo] {
+		if m.digest == digest {
+			return
+		}
+	}
+	r.manifests[repo] = append(r.manifests[repo], manifest{
+		digest:    digest,
+		mediaType: req.Header.Get("Content-Type"),
+		body:      body,
+	})
+}
+
+// referrersDescriptor is a descriptor in a referrers response, which (unlike
+// v1.Descriptor) has an artifactType.
+type referrersDescriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       v1.Hash           `json:"digest"`
+	Size         int64             `json:"size"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// serveReferrers responds with an index of the manifests in repo whose
+// subject is digest.
+func (r *Registry) serveReferrers(w http.ResponseWriter, repo, digest string) {
+	if _, err := v1.NewHash(digest); err != nil {
+		writeError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+		return
+	}
+
+	r.mu.Lock()
+	descs := []referrersDescriptor{}
+	for _, m := range r.manifests[repo] {
+		var parsed struct {
+			ArtifactType string `json:"artifactType"`
+			Config       struct {
+				MediaType string `json:"mediaType"`
+			} `json:"config"`
+			Subject *struct {
+				Digest string `json:"digest"`
+			} `json:"subject"`
+			Annotations map[string]string `json:"annotations"`
+		}
+		if err := json.Unmarshal(m.body, &parsed); err != nil || parsed.Subject == nil || parsed.Subject.Digest != digest {
+			continue
+		}
+		artifactType := parsed.ArtifactType
+		if artifactType == "" {
+			artifactType = parsed.Config.MediaType
+		}
+		descs = append(descs, referrersDescriptor{
+			MediaType:    m.mediaType,
+			Digest:       m.digest,
+			Size:         int64(len(m.body)),
+			ArtifactType: artifactType,
+			Annotations:  parsed.Annotations,
+		})
+	}
+	r.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.index.v1+json",
+		"manifests":     descs,
+	})
+}
+
+// statusWriter records the status of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// writeError writes an error response in the format of the distribution spec.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
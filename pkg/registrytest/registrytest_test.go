@@ -0,0 +1,290 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registrytest_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/ko/pkg/registrytest"
+)
+
+func push(t *testing.T, reg *registrytest.Registry, ref string, img v1.Image, auth authn.Authenticator) error {
+	t.Helper()
+	tag, err := name.NewTag(reg.Host() + "/" + ref)
+	if err != nil {
+		t.Fatalf("NewTag() = %v", err)
+	}
+	return remote.Write(tag, img, remote.WithAuth(auth))
+}
+
+func TestPush(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatalf("random.Image() = %v", err)
+	}
+	if err := push(t, reg, "foo/bar:v1", img, reg.Authenticator()); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+
+	h, err := img.Digest()
+	if err != nil {
+		t.Fatalf("Digest() = %v", err)
+	}
+	for _, ref := range []string{"v1", h.String()} {
+		if !reg.HasManifest("foo/bar", ref) {
+			t.Errorf("HasManifest(%s) = false, wanted true", ref)
+		}
+	}
+	if reg.HasManifest("foo/bar", "v2") {
+		t.Error("HasManifest(v2) = true, wanted false")
+	}
+	if reg.HasManifest("foo/baz", "v1") {
+		t.Error("HasManifest(foo/baz) = true, wanted false")
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatalf("Layers() = %v", err)
+	}
+	for _, l := range layers {
+		d, err := l.Digest()
+		if err != nil {
+			t.Fatalf("Digest() = %v", err)
+		}
+		if !reg.HasBlob("foo/bar", d) {
+			t.Errorf("HasBlob(%s) = false, wanted true", d)
+		}
+	}
+
+	raw, err := img.RawManifest()
+	if err != nil {
+		t.Fatalf("RawManifest() = %v", err)
+	}
+	if got, err := reg.Manifest("foo/bar", "v1"); err != nil {
+		t.Errorf("Manifest() = %v", err)
+	} else if string(got) != string(raw) {
+		t.Errorf("Manifest() = %s, wanted %s", got, raw)
+	}
+
+	if len(reg.Requests()) == 0 {
+		t.Error("Requests() is empty")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	reg := registrytest.New(registrytest.WithAuth("user", "pass"))
+	defer reg.Close()
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image() = %v", err)
+	}
+	if err := push(t, reg, "foo:v1", img, authn.Anonymous); err == nil {
+		t.Error("Write() without credentials succeeded, wanted error")
+	}
+	if err := push(t, reg, "foo:v1", img, &authn.Basic{Username: "user", Password: "wrong"}); err == nil {
+		t.Error("Write() with the wrong password succeeded, wanted error")
+	}
+	if err := push(t, reg, "foo:v1", img, reg.Authenticator()); err != nil {
+		t.Errorf("Write() = %v", err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	reg := registrytest.New(registrytest.WithRateLimit(1))
+	defer reg.Close()
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image() = %v", err)
+	}
+	err = push(t, reg, "foo:v1", img, authn.Anonymous)
+	if err == nil || !strings.Contains(err.Error(), "429") {
+		t.Errorf("Write() = %v, wanted 429", err)
+	}
+	if err := push(t, reg, "foo:v1", img, authn.Anonymous); err != nil {
+		t.Errorf("Write() after the rate limit = %v", err)
+	}
+
+	reg.RateLimit(1)
+	if err := push(t, reg, "foo:v2", img, authn.Anonymous); err == nil {
+		t.Error("Write() after RateLimit() succeeded, wanted error")
+	}
+}
+
+func TestUploadFailures(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image() = %v", err)
+	}
+
+	for _, test := range []struct {
+		description string
+		offset      int64
+		n           int
+		wantErr     bool
+	}{{
+		// remote.Write retries failed uploads, so fail every attempt.
+		description: "fails",
+		offset:      100,
+		n:           100,
+		wantErr:     true,
+	}, {
+		description: "retried",
+		offset:      100,
+		n:           1,
+	}, {
+		description: "smaller than offset",
+		offset:      1 << 20,
+		n:           100,
+	}} {
+		t.Run(test.description, func(t *testing.T) {
+			reg := registrytest.New(registrytest.WithUploadFailures(test.offset, test.n))
+			defer reg.Close()
+
+			err := push(t, reg, "foo:v1", img, authn.Anonymous)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Write() = %v, wanted error: %v", err, test.wantErr)
+			}
+
+			reg.FailUploads(0, 0)
+			if err := push(t, reg, "foo:v1", img, authn.Anonymous); err != nil {
+				t.Errorf("Write() without failures = %v", err)
+			}
+			if !reg.HasManifest("foo", "v1") {
+				t.Error("HasManifest(v1) = false, wanted true")
+			}
+		})
+	}
+}
+
+func TestLatency(t *testing.T) {
+	const latency = 50 * time.Millisecond
+	reg := registrytest.New(registrytest.WithLatency(latency))
+	defer reg.Close()
+
+	start := time.Now()
+	resp, err := http.Get(reg.URL + "/v2/")
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	resp.Body.Close()
+	if got := time.Since(start); got < latency {
+		t.Errorf("request took %v, wanted at least %v", got, latency)
+	}
+}
+
+func TestReferrers(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image() = %v", err)
+	}
+	h, err := img.Digest()
+	if err != nil {
+		t.Fatalf("Digest() = %v", err)
+	}
+	// A manifest that refers to img, like a signature or SBOM.
+	referrer := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json",`+
+		`"artifactType":"application/vnd.example.sbom",`+
+		`"config":{"mediaType":"application/vnd.oci.empty.v1+json","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2},`+
+		`"layers":[],"subject":{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":%q,"size":1}}`, h))
+
+	for _, enabled := range []bool{true, false} {
+		t.Run(fmt.Sprint(enabled), func(t *testing.T) {
+			reg := registrytest.New(registrytest.WithReferrers(enabled))
+			defer reg.Close()
+
+			if err := push(t, reg, "foo:v1", img, authn.Anonymous); err != nil {
+				t.Fatalf("Write() = %v", err)
+			}
+			put, err := http.NewRequest(http.MethodPut, reg.URL+"/v2/foo/manifests/sbom", strings.NewReader(string(referrer)))
+			if err != nil {
+				t.Fatalf("NewRequest() = %v", err)
+			}
+			put.Header.Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			resp, err := http.DefaultClient.Do(put)
+			if err != nil {
+				t.Fatalf("PUT = %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusCreated {
+				t.Fatalf("PUT = %d, wanted %d", resp.StatusCode, http.StatusCreated)
+			}
+
+			resp, err = http.Get(reg.URL + "/v2/foo/referrers/" + h.String())
+			if err != nil {
+				t.Fatalf("GET = %v", err)
+			}
+			defer resp.Body.Close()
+			if !enabled {
+				if resp.StatusCode != http.StatusNotFound {
+					t.Errorf("GET = %d, wanted %d", resp.StatusCode, http.StatusNotFound)
+				}
+				return
+			}
+			var index struct {
+				Manifests []struct {
+					Digest       string `json:"digest"`
+					ArtifactType string `json:"artifactType"`
+				} `json:"manifests"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+				t.Fatalf("Decode() = %v", err)
+			}
+			if len(index.Manifests) != 1 || index.Manifests[0].ArtifactType != "application/vnd.example.sbom" {
+				t.Errorf("referrers = %+v, wanted the sbom", index.Manifests)
+			}
+		})
+	}
+}
+
+func TestIndex(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+
+	idx, err := random.Index(1024, 1, 2)
+	if err != nil {
+		t.Fatalf("random.Index() = %v", err)
+	}
+	idx = mutate.IndexMediaType(idx, "application/vnd.oci.image.index.v1+json")
+	tag, err := name.NewTag(reg.Host() + "/foo:v1")
+	if err != nil {
+		t.Fatalf("NewTag() = %v", err)
+	}
+	if err := remote.WriteIndex(tag, idx); err != nil {
+		t.Fatalf("WriteIndex() = %v", err)
+	}
+	h, err := idx.Digest()
+	if err != nil {
+		t.Fatalf("Digest() = %v", err)
+	}
+	if !reg.HasManifest("foo", h.String()) {
+		t.Errorf("HasManifest(%s) = false, wanted true", h)
+	}
+}
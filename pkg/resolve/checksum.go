@@ -0,0 +1,107 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ImagesChecksumAnnotation is the annotation AnnotateImagesChecksum sets on
+// pod templates.
+const ImagesChecksumAnnotation = "ko.build/images-checksum"
+
+// AnnotateImagesChecksum sets ImagesChecksumAnnotation on the pod templates
+// in the Kubernetes object (represented as a yaml.Node) to a hash of the
+// images of their containers, so that an image changing changes the
+// template, and rolls out e.g. a Deployment even if it's referenced by a tag.
+// Pod templates are the "template" fields whose spec has containers, as in
+// Deployments, StatefulSets, DaemonSets, Jobs, CronJobs and Knative
+// Services. If the document is a list, each of its items is annotated.
+func AnnotateImagesChecksum(doc *yaml.Node) error {
+	// ignore the document node
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 {
+		doc = doc.Content[0]
+	}
+	kind, err := docKind(doc)
+	if err != nil {
+		return err
+	}
+	if kind == "" {
+		return nil
+	}
+	annotatePodTemplates(doc)
+	return nil
+}
+
+func annotatePodTemplates(n *yaml.Node) {
+	if template := mapValue(n, "template"); template != nil {
+		if images := podImages(mapValue(template, "spec")); images != nil {
+			sum := sha256.Sum256([]byte(strings.Join(images, "\n")))
+			metadata := ensureMapValue(template, "metadata")
+			annotations := ensureMapValue(metadata, "annotations")
+			setMapString(annotations, ImagesChecksumAnnotation, "sha256:"+hex.EncodeToString(sum[:]))
+			return
+		}
+	}
+	for _, c := range n.Content {
+		annotatePodTemplates(c)
+	}
+}
+
+// podImages returns the images of the containers in the pod spec n, in
+// order, or nil if it has none.
+func podImages(n *yaml.Node) []string {
+	var images []string
+	for _, field := range []string{"initContainers", "containers", "ephemeralContainers"} {
+		containers := mapValue(n, field)
+		if containers == nil || containers.Kind != yaml.SequenceNode {
+			continue
+		}
+		for _, c := range containers.Content {
+			if image := mapValue(c, "image"); image != nil && image.Kind == yaml.ScalarNode {
+				images = append(images, field+"/"+image.Value)
+			}
+		}
+	}
+	return images
+}
+
+// ensureMapValue returns the value for key in the mapping node n, adding an
+// empty mapping for it if it's missing or null.
+func ensureMapValue(n *yaml.Node, key string) *yaml.Node {
+	if v := mapValue(n, key); v != nil && v.Kind == yaml.MappingNode {
+		return v
+	}
+	deleteMapKey(n, key)
+	v := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, v)
+	return v
+}
+
+// setMapString sets key in the mapping node n to the string value.
+func setMapString(n *yaml.Node, key, value string) {
+	if v := mapValue(n, key); v != nil && v.Kind == yaml.ScalarNode {
+		v.Tag, v.Value = "!!str", value
+		return
+	}
+	deleteMapKey(n, key)
+	n.Content = append(n.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value})
+}
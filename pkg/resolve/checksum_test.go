@@ -0,0 +1,127 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"gopkg.in/yaml.v3"
+)
+
+const checksumDeployment = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  replicas: %d
+  template:
+    metadata:
+      labels:
+        app: app
+    spec:
+      containers:
+      - name: app
+        image: %s
+`
+
+const checksumCronJob = `apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: job
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          initContainers:
+          - image: %s
+          containers:
+          - image: busybox
+`
+
+// imagesChecksum returns the annotation AnnotateImagesChecksum sets on the
+// pod template at path in doc.
+func imagesChecksum(t *testing.T, doc string, path ...string) string {
+	t.Helper()
+	var n yaml.Node
+	if err := yaml.Unmarshal([]byte(doc), &n); err != nil {
+		t.Fatal(err)
+	}
+	if err := AnnotateImagesChecksum(&n); err != nil {
+		t.Fatalf("AnnotateImagesChecksum() = %v", err)
+	}
+	v := n.Content[0]
+	for _, key := range append(path, "metadata", "annotations", ImagesChecksumAnnotation) {
+		if v = mapValue(v, key); v == nil {
+			t.Fatalf("no %s in %s", key, doc)
+		}
+	}
+	return v.Value
+}
+
+func TestAnnotateImagesChecksum(t *testing.T) {
+	deployment := func(replicas int, image string) string {
+		return imagesChecksum(t, fmt.Sprintf(checksumDeployment, replicas, image), "spec", "template")
+	}
+	if got, want := deployment(1, "gcr.io/app@sha256:1"), deployment(1, "gcr.io/app@sha256:1"); got != want {
+		t.Errorf("checksum of the same images = %s, then %s", got, want)
+	}
+	if got, want := deployment(3, "gcr.io/app@sha256:1"), deployment(1, "gcr.io/app@sha256:1"); got != want {
+		t.Errorf("checksum changed with replicas: %s, was %s", got, want)
+	}
+	if got, was := deployment(1, "gcr.io/app@sha256:2"), deployment(1, "gcr.io/app@sha256:1"); got == was {
+		t.Errorf("checksum didn't change with the image: %s", got)
+	}
+
+	cronJob := func(image string) string {
+		return imagesChecksum(t, fmt.Sprintf(checksumCronJob, image), "spec", "jobTemplate", "spec", "template")
+	}
+	if got, was := cronJob("gcr.io/init:2"), cronJob("gcr.io/init:1"); got == was {
+		t.Errorf("checksum didn't change with the init container's image: %s", got)
+	}
+}
+
+func TestAnnotateImagesChecksumNoPodTemplate(t *testing.T) {
+	in := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: template
+data:
+  template: "{}"
+`
+	var n, orig yaml.Node
+	if err := yaml.Unmarshal([]byte(in), &n); err != nil {
+		t.Fatal(err)
+	}
+	if err := yaml.Unmarshal([]byte(in), &orig); err != nil {
+		t.Fatal(err)
+	}
+	if err := AnnotateImagesChecksum(&n); err != nil {
+		t.Fatalf("AnnotateImagesChecksum() = %v", err)
+	}
+	got, err := yaml.Marshal(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := yaml.Marshal(&orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(string(want), string(got)); diff != "" {
+		t.Errorf("AnnotateImagesChecksum() (-want +got): %s", diff)
+	}
+}
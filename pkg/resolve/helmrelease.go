@@ -0,0 +1,97 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"strings"
+
+	"github.com/google/ko/pkg/build"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultHelmReleaseImagePaths are where images are found in the values of
+// most Helm charts.
+var DefaultHelmReleaseImagePaths = []string{"image"}
+
+// helmReleaseImages returns the repository nodes of the images at paths
+// within the spec.values of Flux HelmReleases in docs, which are split into
+// a repository and a tag or digest, e.g.
+//
+//	image:
+//	  repository: ko://github.com/my-user/my-repo/cmd/app
+//	  tag: dev
+//
+// mapped to the image's mapping node. Paths are dotted, e.g.
+// "controller.image". Only repositories that are ko:// references are
+// returned.
+func helmReleaseImages(docs []*yaml.Node, paths []string) map[*yaml.Node]*yaml.Node {
+	images := map[*yaml.Node]*yaml.Node{}
+	for _, doc := range docs {
+		obj := doc
+		if obj.Kind == yaml.DocumentNode && len(obj.Content) > 0 {
+			obj = obj.Content[0]
+		}
+		apiVersion := mapValue(obj, "apiVersion")
+		kind := mapValue(obj, "kind")
+		if apiVersion == nil || kind == nil || kind.Value != "HelmRelease" ||
+			!strings.HasPrefix(apiVersion.Value, "helm.toolkit.fluxcd.io/") {
+			continue
+		}
+		values := mapValue(mapValue(obj, "spec"), "values")
+		for _, path := range paths {
+			image := values
+			for _, key := range strings.Split(path, ".") {
+				image = mapValue(image, key)
+			}
+			repository := mapValue(image, "repository")
+			if repository != nil && repository.Kind == yaml.ScalarNode &&
+				strings.HasPrefix(strings.TrimSpace(repository.Value), build.StrictScheme) {
+				images[repository] = image
+			}
+		}
+	}
+	return images
+}
+
+// splitHelmReleaseImage splits the resolved reference in repository back into
+// the repository, and the digest (and tag, if it has one) of image.
+func splitHelmReleaseImage(repository, image *yaml.Node) {
+	ref := repository.Value
+	var tag, digest string
+	if i := strings.LastIndex(ref, "@"); i >= 0 {
+		ref, digest = ref[:i], ref[i+1:]
+	}
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		ref, tag = ref[:i], ref[i+1:]
+	}
+	repository.Value = ref
+	if digest != "" {
+		setMapValue(image, "digest", digest)
+	}
+	if tag != "" {
+		setMapValue(image, "tag", tag)
+	}
+}
+
+// setMapValue sets key in the mapping node m to the string value.
+func setMapValue(m *yaml.Node, key, value string) {
+	if v := mapValue(m, key); v != nil {
+		*v = yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+		return
+	}
+	m.Content = append(m.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value})
+}
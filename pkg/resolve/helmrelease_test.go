@@ -0,0 +1,152 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/ko/pkg/build"
+	kotesting "github.com/google/ko/pkg/internal/testing"
+	"gopkg.in/yaml.v3"
+)
+
+func TestHelmReleaseImages(t *testing.T) {
+	base := mustRepository("gcr.io/mattmoor")
+	repo := base.String() + "/" + fooRef
+
+	tests := []struct {
+		desc  string
+		paths []string
+		input string
+		want  interface{}
+	}{{
+		desc:  "scalar image",
+		paths: DefaultHelmReleaseImagePaths,
+		input: `
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+spec:
+  values:
+    image: ko://` + fooRef,
+		want: map[string]interface{}{"image": kotesting.ComputeDigest(base, fooRef, fooHash)},
+	}, {
+		desc:  "split image",
+		paths: DefaultHelmReleaseImagePaths,
+		input: `
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+spec:
+  values:
+    image:
+      repository: ko://` + fooRef + `
+      tag: dev
+      pullPolicy: IfNotPresent`,
+		want: map[string]interface{}{
+			"image": map[string]interface{}{
+				"repository": repo,
+				"tag":        "dev",
+				"pullPolicy": "IfNotPresent",
+				"digest":     fooHash.String(),
+			},
+		},
+	}, {
+		desc:  "nested path",
+		paths: []string{"image", "controller.image"},
+		input: `
+apiVersion: helm.toolkit.fluxcd.io/v2
+kind: HelmRelease
+spec:
+  values:
+    controller:
+      image:
+        repository: ko://` + fooRef,
+		want: map[string]interface{}{
+			"controller": map[string]interface{}{
+				"image": map[string]interface{}{
+					"repository": repo,
+					"digest":     fooHash.String(),
+				},
+			},
+		},
+	}, {
+		desc:  "path not configured",
+		paths: DefaultHelmReleaseImagePaths,
+		input: `
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+spec:
+  values:
+    controller:
+      image:
+        repository: ko://` + fooRef,
+		want: map[string]interface{}{
+			"controller": map[string]interface{}{
+				"image": map[string]interface{}{
+					"repository": kotesting.ComputeDigest(base, fooRef, fooHash),
+				},
+			},
+		},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			doc := strToYAML(t, test.input)
+			err := ImageReferences(context.Background(), []*yaml.Node{doc}, testBuilder,
+				kotesting.NewFixedPublish(base, testHashes), WithHelmReleaseImagePaths(test.paths))
+			if err != nil {
+				t.Fatalf("ImageReferences(%v) = %v", test.input, err)
+			}
+
+			var out struct {
+				Spec struct {
+					Values interface{} `yaml:"values"`
+				} `yaml:"spec"`
+			}
+			if err := doc.Decode(&out); err != nil {
+				t.Fatalf("doc.Decode(%v) = %v", yamlToStr(t, doc), err)
+			}
+			if diff := cmp.Diff(test.want, out.Spec.Values); diff != "" {
+				t.Errorf("ImageReferences(%v); (-want +got) = %v", test.input, diff)
+			}
+		})
+	}
+}
+
+func TestHelmReleaseImagesOtherKinds(t *testing.T) {
+	base := mustRepository("gcr.io/mattmoor")
+	input := `
+apiVersion: apps/v1
+kind: Deployment
+spec:
+  values:
+    image:
+      repository: ` + build.StrictScheme + fooRef
+
+	doc := strToYAML(t, input)
+	err := ImageReferences(context.Background(), []*yaml.Node{doc}, testBuilder,
+		kotesting.NewFixedPublish(base, testHashes), WithHelmReleaseImagePaths(DefaultHelmReleaseImagePaths))
+	if err != nil {
+		t.Fatalf("ImageReferences(%v) = %v", input, err)
+	}
+	image := mapValue(mapValue(mapValue(doc.Content[0], "spec"), "values"), "image")
+	if got, want := mapValue(image, "repository").Value, kotesting.ComputeDigest(base, fooRef, fooHash); got != want {
+		t.Errorf("repository = %s, want %s", got, want)
+	}
+	if got := mapValue(image, "digest"); got != nil {
+		t.Errorf("digest = %v, wanted it unset outside of a HelmRelease", got.Value)
+	}
+}
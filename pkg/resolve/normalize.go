@@ -0,0 +1,183 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Rules for Normalize.
+const (
+	// NormalizeStatus removes the status of objects, which is owned by
+	// their controllers.
+	NormalizeStatus = "status"
+	// NormalizeManagedFields removes metadata.managedFields, which is
+	// owned by the API server.
+	NormalizeManagedFields = "managedFields"
+	// NormalizeNullCreationTimestamp removes "creationTimestamp: null"
+	// anywhere in objects (e.g. in pod templates), which is introduced by
+	// round-tripping objects through Go structs.
+	NormalizeNullCreationTimestamp = "nullCreationTimestamp"
+	// NormalizeServerMetadata removes metadata set by the API server: uid,
+	// resourceVersion, generation, selfLink and creationTimestamp.
+	NormalizeServerMetadata = "serverMetadata"
+	// NormalizeLastAppliedConfiguration removes the annotation that
+	// client-side `kubectl apply` uses to track the applied configuration.
+	NormalizeLastAppliedConfiguration = "lastAppliedConfiguration"
+	// NormalizeEmptyCollections removes fields whose value is an empty map
+	// or list, e.g. "resources: {}".
+	NormalizeEmptyCollections = "emptyCollections"
+)
+
+// DefaultNormalizeRules are the rules applied by default, which only remove
+// fields that are never set by users.
+var DefaultNormalizeRules = []string{
+	NormalizeStatus,
+	NormalizeManagedFields,
+	NormalizeNullCreationTimestamp,
+}
+
+var allNormalizeRules = map[string]bool{
+	NormalizeStatus:                   true,
+	NormalizeManagedFields:            true,
+	NormalizeNullCreationTimestamp:    true,
+	NormalizeServerMetadata:           true,
+	NormalizeLastAppliedConfiguration: true,
+	NormalizeEmptyCollections:         true,
+}
+
+const lastAppliedConfigurationAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// Normalize removes fields from the Kubernetes object (represented as a
+// yaml.Node) according to rules, so that it applies cleanly with
+// `kubectl apply --server-side`, without claiming ownership of fields that
+// are managed by controllers or the API server. If the document is a list,
+// each of its items is normalized.
+func Normalize(doc *yaml.Node, rules []string) error {
+	enabled := map[string]bool{}
+	for _, r := range rules {
+		if !allNormalizeRules[r] {
+			return fmt.Errorf("unknown normalization rule %q", r)
+		}
+		enabled[r] = true
+	}
+
+	// ignore the document node
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 {
+		doc = doc.Content[0]
+	}
+	kind, err := docKind(doc)
+	if err != nil {
+		return err
+	}
+	if kind == "" {
+		return nil
+	}
+
+	if kind == "List" {
+		if items := mapValue(doc, "items"); items != nil && items.Kind == yaml.SequenceNode {
+			for _, item := range items.Content {
+				normalizeObject(item, enabled)
+			}
+		}
+		return nil
+	}
+	normalizeObject(doc, enabled)
+	return nil
+}
+
+func normalizeObject(obj *yaml.Node, enabled map[string]bool) {
+	if enabled[NormalizeStatus] {
+		deleteMapKey(obj, "status")
+	}
+	if metadata := mapValue(obj, "metadata"); metadata != nil {
+		if enabled[NormalizeManagedFields] {
+			deleteMapKey(metadata, "managedFields")
+		}
+		if enabled[NormalizeServerMetadata] {
+			for _, k := range []string{"uid", "resourceVersion", "generation", "selfLink", "creationTimestamp"} {
+				deleteMapKey(metadata, k)
+			}
+		}
+		if enabled[NormalizeLastAppliedConfiguration] {
+			if annotations := mapValue(metadata, "annotations"); annotations != nil {
+				deleteMapKey(annotations, lastAppliedConfigurationAnnotation)
+				if len(annotations.Content) == 0 {
+					deleteMapKey(metadata, "annotations")
+				}
+			}
+		}
+	}
+	if enabled[NormalizeNullCreationTimestamp] {
+		deleteNullCreationTimestamps(obj)
+	}
+	if enabled[NormalizeEmptyCollections] {
+		deleteEmptyCollections(obj)
+	}
+}
+
+// mapValue returns the value for key in the mapping node n, or nil.
+func mapValue(n *yaml.Node, key string) *yaml.Node {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// deleteMapKey removes key from the mapping node n, if present.
+func deleteMapKey(n *yaml.Node, key string) {
+	deleteMapEntries(n, func(k, _ *yaml.Node) bool { return k.Value == key })
+}
+
+func deleteMapEntries(n *yaml.Node, drop func(k, v *yaml.Node) bool) {
+	if n.Kind != yaml.MappingNode {
+		return
+	}
+	content := n.Content[:0]
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if !drop(n.Content[i], n.Content[i+1]) {
+			content = append(content, n.Content[i], n.Content[i+1])
+		}
+	}
+	n.Content = content
+}
+
+func deleteNullCreationTimestamps(n *yaml.Node) {
+	deleteMapEntries(n, func(k, v *yaml.Node) bool {
+		return k.Value == "creationTimestamp" && v.Kind == yaml.ScalarNode && v.Tag == "!!null"
+	})
+	for _, c := range n.Content {
+		deleteNullCreationTimestamps(c)
+	}
+}
+
+// deleteEmptyCollections removes empty maps and lists. Maps and lists that
+// only become empty because of this are kept, so that we never remove more
+// than one level of structure the user wrote.
+func deleteEmptyCollections(n *yaml.Node) {
+	deleteMapEntries(n, func(_, v *yaml.Node) bool {
+		return (v.Kind == yaml.MappingNode || v.Kind == yaml.SequenceNode) && len(v.Content) == 0
+	})
+	for _, c := range n.Content {
+		deleteEmptyCollections(c)
+	}
+}
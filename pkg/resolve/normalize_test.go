@@ -0,0 +1,110 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"gopkg.in/yaml.v3"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files in testdata")
+
+func normalizeFile(t *testing.T, path string, rules []string) []byte {
+	t.Helper()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		t.Fatalf("yaml.Unmarshal(%s) = %v", path, err)
+	}
+	if err := Normalize(&doc, rules); err != nil {
+		t.Fatalf("Normalize(%s) = %v", path, err)
+	}
+	buf := &bytes.Buffer{}
+	e := yaml.NewEncoder(buf)
+	e.SetIndent(2)
+	if err := e.Encode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	e.Close()
+	return buf.Bytes()
+}
+
+// TestNormalizeGolden normalizes objects exported with `kubectl get -o yaml`,
+// and compares the results against golden files, which can be regenerated
+// with `go test ./pkg/resolve -run TestNormalizeGolden -update`.
+func TestNormalizeGolden(t *testing.T) {
+	all := []string{
+		NormalizeStatus,
+		NormalizeManagedFields,
+		NormalizeNullCreationTimestamp,
+		NormalizeServerMetadata,
+		NormalizeLastAppliedConfiguration,
+		NormalizeEmptyCollections,
+	}
+	for _, input := range []string{"deployment", "list"} {
+		for name, rules := range map[string][]string{
+			"default": DefaultNormalizeRules,
+			"all":     all,
+		} {
+			t.Run(input+"/"+name, func(t *testing.T) {
+				dir := filepath.Join("testdata", "normalize")
+				got := normalizeFile(t, filepath.Join(dir, input+".yaml"), rules)
+
+				golden := filepath.Join(dir, input+"."+name+".golden.yaml")
+				if *updateGolden {
+					if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+				want, err := ioutil.ReadFile(golden)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(string(want), string(got)); diff != "" {
+					t.Errorf("Normalize(%s) (-want +got): %s", input, diff)
+				}
+			})
+		}
+	}
+}
+
+func TestNormalizeUnknownRule(t *testing.T) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(webPod), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if err := Normalize(&doc, []string{"spec"}); err == nil {
+		t.Error("Normalize() with unknown rule succeeded, wanted error")
+	}
+}
+
+func TestNormalizeNotAnObject(t *testing.T) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte("foo: bar\n"), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if err := Normalize(&doc, DefaultNormalizeRules); err == nil {
+		t.Error("Normalize() of non-object succeeded, wanted error")
+	}
+}
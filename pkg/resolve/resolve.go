@@ -17,6 +17,7 @@ package resolve
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -27,24 +28,82 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
+// Option is a functional option for ImageReferences.
+type Option func(*resolveOptions)
+
+type resolveOptions struct {
+	helmReleaseImagePaths []string
+}
+
+// WithHelmReleaseImagePaths is a functional option for resolving images in
+// the spec.values of Flux HelmReleases that are split into a repository and
+// a tag or digest, at the given dotted paths (e.g. "image" or
+// "controller.image"). The repository is resolved, and split back into the
+// repository and digest (or tag, when publishing tag-only references).
+// References elsewhere in values are resolved like any other.
+func WithHelmReleaseImagePaths(paths []string) Option {
+	return func(o *resolveOptions) {
+		o.helmReleaseImagePaths = paths
+	}
+}
+
+// ReferenceError is an error resolving the reference Ref, at Line and Column
+// of the input yaml, and at Path within its document (its first occurrence,
+// if there are several). Its message is Err's, prefixed with Path if known.
+type ReferenceError struct {
+	Ref    string
+	Path   string
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *ReferenceError) Error() string {
+	if e.Path == "" {
+		return e.Err.Error()
+	}
+	return e.Path + ": " + e.Err.Error()
+}
+
+func (e *ReferenceError) Unwrap() error { return e.Err }
+
 // ImageReferences resolves supported references to images within the input yaml
 // to published image digests.
 //
 // If a reference can be built and pushed, its yaml.Node will be mutated.
-func ImageReferences(ctx context.Context, docs []*yaml.Node, builder build.Interface, publisher publish.Interface) error {
+func ImageReferences(ctx context.Context, docs []*yaml.Node, builder build.Interface, publisher publish.Interface, opts ...Option) error {
+	o := &resolveOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	helmImages := helmReleaseImages(docs, o.helmReleaseImagePaths)
+
 	// First, walk the input objects and collect a list of supported references
+	// (so that nothing is built if any of them isn't).
 	refs := make(map[string][]*yaml.Node)
+	paths := make(map[string]string)
 
 	for _, doc := range docs {
-		it := refsFromDoc(doc)
+		var found []docRef
+		refsFromDoc(doc, "", &found)
 
-		for node, ok := it(); ok; node, ok = it() {
+		for _, r := range found {
+			node := r.node
 			ref := strings.TrimSpace(node.Value)
 
 			if err := builder.IsSupportedReference(ref); err != nil {
-				return fmt.Errorf("found strict reference but %s is not a valid import path: %v", ref, err)
+				return &ReferenceError{
+					Ref:    ref,
+					Path:   r.path,
+					Line:   node.Line,
+					Column: node.Column,
+					Err:    fmt.Errorf("found strict reference but %s is not a valid import path: %w", ref, err),
+				}
 			}
 
+			if _, ok := refs[ref]; !ok {
+				paths[ref] = r.path
+			}
 			refs[ref] = append(refs[ref], node)
 		}
 	}
@@ -52,16 +111,16 @@ func ImageReferences(ctx context.Context, docs []*yaml.Node, builder build.Inter
 	// Next, perform parallel builds for each of the supported references.
 	var sm sync.Map
 	var errg errgroup.Group
-	for ref := range refs {
-		ref := ref
+	for ref, nodes := range refs {
+		ref, first, path := ref, nodes[0], paths[ref]
 		errg.Go(func() error {
 			img, err := builder.Build(ctx, ref)
 			if err != nil {
-				return err
+				return &ReferenceError{Ref: ref, Path: path, Line: first.Line, Column: first.Column, Err: err}
 			}
 			digest, err := publisher.Publish(ctx, img, ref)
 			if err != nil {
-				return err
+				return &ReferenceError{Ref: ref, Path: path, Line: first.Line, Column: first.Column, Err: err}
 			}
 			sm.Store(ref, digest.String())
 			return nil
@@ -83,14 +142,48 @@ func ImageReferences(ctx context.Context, docs []*yaml.Node, builder build.Inter
 			node.Value = digest.(string)
 		}
 	}
+	for repository, image := range helmImages {
+		splitHelmReleaseImage(repository, image)
+	}
 
 	return nil
 }
 
-func refsFromDoc(doc *yaml.Node) yit.Iterator {
-	it := yit.FromNode(doc).
-		RecurseNodes().
-		Filter(yit.StringValue)
+// docRef is a strict reference found in a document, at path.
+type docRef struct {
+	node *yaml.Node
+	path string
+}
 
-	return it.Filter(yit.WithPrefix(build.StrictScheme))
+// refsFromDoc appends the string scalars of n that are strict references to
+// found, with their paths, in the same notation as UnresolvedReferences.
+func refsFromDoc(n *yaml.Node, path string, found *[]docRef) {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		for _, c := range n.Content {
+			refsFromDoc(c, path, found)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			p := k.Value
+			if path != "" {
+				p = path + "." + k.Value
+			}
+			refsFromDoc(k, p+" (key)", found)
+			refsFromDoc(v, p, found)
+		}
+	case yaml.SequenceNode:
+		for i, c := range n.Content {
+			refsFromDoc(c, path+"["+strconv.Itoa(i)+"]", found)
+		}
+	case yaml.ScalarNode:
+		if yit.StringValue(n) && strings.HasPrefix(n.Value, build.StrictScheme) {
+			if path == "" {
+				path = "."
+			}
+			*found = append(*found, docRef{node: n, path: path})
+		}
+	}
+	// Aliases are resolved, and reported, where their anchor is defined.
 }
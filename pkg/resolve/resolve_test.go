@@ -17,6 +17,8 @@ package resolve
 import (
 	"bytes"
 	"context"
+	"errors"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -315,3 +317,52 @@ func mustDigest(img build.Result) v1.Hash {
 	}
 	return d
 }
+
+func TestRestrictedReferenceError(t *testing.T) {
+	input := `
+spec:
+  template:
+    spec:
+      containers:
+      - name: foo
+        image: ko://github.com/awesomesauce/foo
+      - name: bar
+        image: &bar ko://github.com/awesomesauce/bar
+      initContainers:
+      - name: bar
+        image: *bar
+`
+	base := mustRepository("gcr.io/multi-pass")
+	doc := strToYAML(t, input)
+
+	recorder := &build.Recorder{Builder: testBuilder}
+	restricted, err := build.NewRestricted(recorder, []string{"github.com/awesomesauce/foo/..."})
+	if err != nil {
+		t.Fatalf("NewRestricted() = %v", err)
+	}
+
+	err = ImageReferences(context.Background(), []*yaml.Node{doc}, restricted, kotesting.NewFixedPublish(base, testHashes))
+	var re *ReferenceError
+	if !errors.As(err, &re) {
+		t.Fatalf("ImageReferences() = %v, wanted ReferenceError", err)
+	}
+	// The alias is reported where its anchor is defined.
+	if got, want := re.Path, "spec.template.spec.containers[1].image"; got != want {
+		t.Errorf("Path = %s, wanted %s", got, want)
+	}
+	if got, want := re.Line, 9; got != want {
+		t.Errorf("Line = %d, wanted %d", got, want)
+	}
+	var nae *build.NotAllowedError
+	if !errors.As(err, &nae) || nae.ImportPath != barRef {
+		t.Errorf("ImageReferences() = %v, wanted NotAllowedError for %s", err, barRef)
+	}
+	for _, want := range []string{re.Path, barRef, "github.com/awesomesauce/foo/..."} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("ImageReferences() = %v, wanted it to contain %q", err, want)
+		}
+	}
+	if len(recorder.ImportPaths) != 0 {
+		t.Errorf("built %v, wanted nothing", recorder.ImportPaths)
+	}
+}
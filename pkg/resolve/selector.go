@@ -22,13 +22,72 @@ import (
 	"k8s.io/apimachinery/pkg/labels"
 )
 
+// Selector selects objects by their labels. Both labels.Selector and
+// SelectorSet implement it.
+type Selector interface {
+	// Matches returns true if the labels match.
+	Matches(labels.Labels) bool
+	// Empty returns true if every object matches, even without labels.
+	Empty() bool
+}
+
+var (
+	_ Selector = labels.Selector(nil)
+	_ Selector = SelectorSet{}
+)
+
+// SelectorSet is a set of selectors, that labels match if they match any of
+// them, or all of them with MatchAll.
+type SelectorSet struct {
+	Selectors []labels.Selector
+	MatchAll  bool
+}
+
+// Matches implements Selector
+func (s SelectorSet) Matches(l labels.Labels) bool {
+	if len(s.Selectors) == 0 {
+		return true
+	}
+	for _, selector := range s.Selectors {
+		if m := selector.Matches(l); m != s.MatchAll {
+			return m
+		}
+	}
+	return s.MatchAll
+}
+
+// Empty implements Selector
+func (s SelectorSet) Empty() bool {
+	if len(s.Selectors) == 0 {
+		return true
+	}
+	for _, selector := range s.Selectors {
+		if m := selector.Empty(); m != s.MatchAll {
+			return m
+		}
+	}
+	return s.MatchAll
+}
+
 // MatchesSelector returns true if the Kubernetes object (represented as a
 // yaml.Node) matches the selector. An error is returned if the yaml.Node is
-// not an K8s object or list.
+// not an K8s object or list. Objects without labels only match empty
+// selectors, and null nodes none.
 //
 // If the document is a list, the yaml.Node will be mutated to only include
 // items that match the selector.
-func MatchesSelector(doc *yaml.Node, selector labels.Selector) (bool, error) {
+func MatchesSelector(doc *yaml.Node, selector Selector) (bool, error) {
+	return matchesSelector(doc, selector, "labels")
+}
+
+// MatchesAnnotationSelector is like MatchesSelector, but matches the selector
+// with the object's annotations rather than its labels.
+func MatchesAnnotationSelector(doc *yaml.Node, selector Selector) (bool, error) {
+	return matchesSelector(doc, selector, "annotations")
+}
+
+// matchesSelector matches selector with the map at metadata.<field>.
+func matchesSelector(doc *yaml.Node, selector Selector, field string) (bool, error) {
 	// ignore the document node
 	if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 {
 		doc = doc.Content[0]
@@ -39,11 +98,14 @@ func MatchesSelector(doc *yaml.Node, selector labels.Selector) (bool, error) {
 		return false, err
 	}
 
+	if kind == "" {
+		return false, nil
+	}
 	if kind == "List" {
-		return listMatchesSelector(doc, selector)
+		return listMatchesSelector(doc, selector, field)
 	}
 
-	return objMatchesSelector(doc, selector), nil
+	return objMatchesSelector(doc, selector, field), nil
 }
 
 func docKind(doc *yaml.Node) (string, error) {
@@ -76,7 +138,7 @@ func docKind(doc *yaml.Node) (string, error) {
 	return node.Value, nil
 }
 
-func objMatchesSelector(doc *yaml.Node, selector labels.Selector) bool {
+func objMatchesSelector(doc *yaml.Node, selector Selector, field string) bool {
 	it := FromNode(doc).
 		Filter(WithKind(yaml.MappingNode)).
 		// Return the metadata map
@@ -86,24 +148,22 @@ func objMatchesSelector(doc *yaml.Node, selector labels.Selector) bool {
 			// Value Predicate
 			WithKind(yaml.MappingNode),
 		).
-		// Return the labels map
+		// Return the labels (or annotations) map
 		ValuesForMap(
 			// Key Predicate
-			WithStringValue("labels"),
+			WithStringValue(field),
 			// Value Predicate
 			WithKind(yaml.MappingNode),
 		)
 
 	node, ok := it()
-
-	if ok && selector.Matches(labelsNode{node}) {
-		return true
+	if !ok {
+		return selector.Empty()
 	}
-
-	return false
+	return selector.Matches(labelsNode{node})
 }
 
-func listMatchesSelector(doc *yaml.Node, selector labels.Selector) (bool, error) {
+func listMatchesSelector(doc *yaml.Node, selector Selector, field string) (bool, error) {
 	it := FromNode(doc).ValuesForMap(
 		// Key Predicate
 		WithStringValue("items"),
@@ -121,11 +181,13 @@ func listMatchesSelector(doc *yaml.Node, selector labels.Selector) (bool, error)
 	var matches []*yaml.Node
 	for _, content := range node.Content {
 
-		if _, err := docKind(content); err != nil {
+		if kind, err := docKind(content); err != nil {
 			return false, err
+		} else if kind == "" {
+			continue
 		}
 
-		if objMatchesSelector(content, selector) {
+		if objMatchesSelector(content, selector, field) {
 			matches = append(matches, content)
 		}
 	}
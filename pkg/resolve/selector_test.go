@@ -26,6 +26,8 @@ var (
 	webSelector    = selector(`app=web`)
 	notWebSelector = selector(`app!=web`)
 	nopSelector    = selector(`foo!=bark`)
+	dbSelector     = selector(`app=db`)
+	notDBSelector  = selector(`app!=db`)
 )
 
 const (
@@ -76,6 +78,11 @@ items:
     labels:
       app: web
     name: rss-site
+`
+	unlabeledPod = `apiVersion: v1
+kind: Pod
+metadata:
+  name: rss-cache
 `
 	dbPodList = `apiVersion: v1
 kind: List
@@ -96,7 +103,7 @@ func TestMatchesSelector(t *testing.T) {
 	tests := []struct {
 		desc     string
 		input    string
-		selector labels.Selector
+		selector Selector
 		output   string
 		matches  bool
 	}{{
@@ -144,6 +151,56 @@ func TestMatchesSelector(t *testing.T) {
 		input:    "!!null",
 		selector: labels.Everything(),
 		matches:  false,
+	}, {
+		desc:     "object without labels with empty selector",
+		input:    unlabeledPod,
+		selector: labels.Everything(),
+		output:   unlabeledPod,
+		matches:  true,
+	}, {
+		desc:     "object without labels with non-empty selector",
+		input:    unlabeledPod,
+		selector: notWebSelector,
+		matches:  false,
+	}, {
+		desc:     "any of selectors matching each element of list object",
+		input:    podList,
+		selector: SelectorSet{Selectors: []labels.Selector{webSelector, dbSelector}},
+		output:   podList,
+		matches:  true,
+	}, {
+		desc:     "any of selectors matching no element of list object",
+		input:    podList,
+		selector: SelectorSet{Selectors: []labels.Selector{labels.Nothing(), selector(`app=cache`)}},
+		matches:  false,
+	}, {
+		desc:     "all of selectors matching element of list object",
+		input:    podList,
+		selector: SelectorSet{Selectors: []labels.Selector{notDBSelector, nopSelector}, MatchAll: true},
+		output:   webPodList,
+		matches:  true,
+	}, {
+		desc:     "all of selectors matching no element of list object",
+		input:    podList,
+		selector: SelectorSet{Selectors: []labels.Selector{webSelector, dbSelector}, MatchAll: true},
+		matches:  false,
+	}, {
+		desc:     "object without labels with any of selectors, one empty",
+		input:    unlabeledPod,
+		selector: SelectorSet{Selectors: []labels.Selector{webSelector, labels.Everything()}},
+		output:   unlabeledPod,
+		matches:  true,
+	}, {
+		desc:     "object without labels with all of selectors, one empty",
+		input:    unlabeledPod,
+		selector: SelectorSet{Selectors: []labels.Selector{webSelector, labels.Everything()}, MatchAll: true},
+		matches:  false,
+	}, {
+		desc:     "empty set of selectors",
+		input:    dbPod,
+		selector: SelectorSet{},
+		output:   dbPod,
+		matches:  true,
 	}}
 
 	for _, test := range tests {
@@ -172,6 +229,102 @@ func TestMatchesSelector(t *testing.T) {
 	}
 }
 
+func TestMatchesAnnotationSelector(t *testing.T) {
+	prodPod := `apiVersion: v1
+kind: Pod
+metadata:
+  annotations:
+    env: prod
+  labels:
+    app: web
+  name: rss-site
+`
+	annotatedList := `apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Pod
+  metadata:
+    annotations:
+      env: prod
+    name: rss-site
+- apiVersion: v1
+  kind: Pod
+  metadata:
+    annotations:
+      env: staging
+    name: rss-db
+`
+	prodList := `apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Pod
+  metadata:
+    annotations:
+      env: prod
+    name: rss-site
+`
+	tests := []struct {
+		desc     string
+		input    string
+		selector Selector
+		output   string
+		matches  bool
+	}{{
+		desc:     "single object with matching annotation",
+		input:    prodPod,
+		selector: selector(`env=prod`),
+		output:   prodPod,
+		matches:  true,
+	}, {
+		desc:     "single object with non-matching annotation",
+		input:    prodPod,
+		selector: selector(`env=staging`),
+		matches:  false,
+	}, {
+		desc:     "labels aren't matched",
+		input:    prodPod,
+		selector: webSelector,
+		matches:  false,
+	}, {
+		desc:     "object without annotations",
+		input:    webPod,
+		selector: selector(`env=prod`),
+		matches:  false,
+	}, {
+		desc:     "selector matching elements of list object",
+		input:    annotatedList,
+		selector: selector(`env=prod`),
+		output:   prodList,
+		matches:  true,
+	}, {
+		desc:     "any of selectors",
+		input:    annotatedList,
+		selector: SelectorSet{Selectors: []labels.Selector{selector(`env=prod`), selector(`env=staging`)}},
+		output:   annotatedList,
+		matches:  true,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			doc := strToYAML(t, test.input)
+			matches, err := MatchesAnnotationSelector(doc, test.selector)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if matches != test.matches {
+				t.Errorf("unexpected result: got %v - want %v", matches, test.matches)
+			}
+			if test.output != "" {
+				if diff := cmp.Diff(normalizeYAML(t, test.output), yamlToStr(t, doc)); diff != "" {
+					t.Errorf("unexpected diff (-want, +got) %v", diff)
+				}
+			}
+		})
+	}
+}
+
 func TestSelectorFailure(t *testing.T) {
 	tests := []struct {
 		desc  string
@@ -0,0 +1,90 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/ko/pkg/build"
+	"gopkg.in/yaml.v3"
+)
+
+// UnresolvedReferences returns the fields of doc, as dotted paths followed
+// by their value (e.g. "spec.containers[0].args[1]: --image=ko://foo"),
+// whose keys or values still contain a ko:// reference after
+// ImageReferences, which only resolves values that start with one. Comments
+// are not checked.
+func UnresolvedReferences(doc *yaml.Node) []string {
+	var found []string
+	findUnresolved(doc, "", &found)
+	return found
+}
+
+func findUnresolved(n *yaml.Node, path string, found *[]string) {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		for _, c := range n.Content {
+			findUnresolved(c, path, found)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			p := k.Value
+			if path != "" {
+				p = path + "." + k.Value
+			}
+			if strings.Contains(k.Value, build.StrictScheme) {
+				*found = append(*found, fmt.Sprintf("%s (key)", p))
+			}
+			findUnresolved(v, p, found)
+		}
+	case yaml.SequenceNode:
+		for i, c := range n.Content {
+			findUnresolved(c, path+"["+strconv.Itoa(i)+"]", found)
+		}
+	case yaml.ScalarNode:
+		if strings.Contains(n.Value, build.StrictScheme) {
+			if path == "" {
+				path = "."
+			}
+			*found = append(*found, fmt.Sprintf("%s: %s", path, n.Value))
+		}
+	}
+	// Aliases are reported where their anchor is defined.
+}
+
+// StrictAnnotation is the annotation with which a document overrides
+// whether it must be fully resolved: "true" or "false".
+const StrictAnnotation = "ko.build/strict"
+
+// DocumentStrictness returns whether doc must be fully resolved, from its
+// StrictAnnotation, and whether it has one. Documents that aren't objects
+// have none.
+func DocumentStrictness(doc *yaml.Node) (strict, ok bool, err error) {
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 {
+		doc = doc.Content[0]
+	}
+	v := mapValue(mapValue(mapValue(doc, "metadata"), "annotations"), StrictAnnotation)
+	if v == nil {
+		return false, false, nil
+	}
+	strict, err = strconv.ParseBool(v.Value)
+	if err != nil || v.Kind != yaml.ScalarNode {
+		return false, false, fmt.Errorf("annotation %s: expected true or false, got %q", StrictAnnotation, v.Value)
+	}
+	return strict, true, nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"gopkg.in/yaml.v3"
+)
+
+func TestUnresolvedReferences(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		input       string
+		want        []string
+	}{{
+		description: "fully resolved",
+		input: `
+spec:
+  containers:
+  - image: gcr.io/foo/bar@sha256:deadbeef
+`,
+	}, {
+		description: "reference inside a value",
+		input: `
+spec:
+  containers:
+  - image: gcr.io/foo/bar@sha256:deadbeef
+    args:
+    - --verbose
+    - --sidecar=ko://github.com/foo/sidecar
+`,
+		want: []string{"spec.containers[0].args[1]: --sidecar=ko://github.com/foo/sidecar"},
+	}, {
+		description: "reference in a key",
+		input: `
+data:
+  ko://github.com/foo/bar: image
+`,
+		want: []string{"data.ko://github.com/foo/bar (key)"},
+	}, {
+		description: "whole document",
+		input:       `ko://github.com/foo/bar`,
+		want:        []string{".: ko://github.com/foo/bar"},
+	}, {
+		description: "comments are ignored",
+		input: `
+# Built from ko://github.com/foo/bar
+image: gcr.io/foo/bar@sha256:deadbeef
+`,
+	}} {
+		t.Run(test.description, func(t *testing.T) {
+			var doc yaml.Node
+			if err := yaml.Unmarshal([]byte(test.input), &doc); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.want, UnresolvedReferences(&doc)); diff != "" {
+				t.Errorf("UnresolvedReferences() (-want +got): %s", diff)
+			}
+		})
+	}
+}
+
+func TestDocumentStrictness(t *testing.T) {
+	for _, test := range []struct {
+		input      string
+		wantStrict bool
+		wantOK     bool
+		wantErr    bool
+	}{{
+		input: "apiVersion: v1\nkind: ConfigMap\n",
+	}, {
+		input:      "metadata:\n  annotations:\n    ko.build/strict: \"true\"\n",
+		wantStrict: true,
+		wantOK:     true,
+	}, {
+		input:  "metadata:\n  annotations:\n    ko.build/strict: \"false\"\n",
+		wantOK: true,
+	}, {
+		input:   "metadata:\n  annotations:\n    ko.build/strict: sometimes\n",
+		wantErr: true,
+	}, {
+		input: "- not an object\n",
+	}} {
+		t.Run(test.input, func(t *testing.T) {
+			var doc yaml.Node
+			if err := yaml.Unmarshal([]byte(test.input), &doc); err != nil {
+				t.Fatal(err)
+			}
+			strict, ok, err := DocumentStrictness(&doc)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("DocumentStrictness() = %v, wanted error %v", err, test.wantErr)
+			}
+			if strict != test.wantStrict || ok != test.wantOK {
+				t.Errorf("DocumentStrictness() = %v, %v, wanted %v, %v", strict, ok, test.wantStrict, test.wantOK)
+			}
+		})
+	}
+}
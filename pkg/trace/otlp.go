@@ -0,0 +1,210 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// OTLP is an Exporter that sends spans to an OpenTelemetry collector, with
+// the OTLP/HTTP protocol, JSON encoded. Spans are buffered until Flush.
+type OTLP struct {
+	// Endpoint is the URL spans are POSTed to, e.g.
+	// http://localhost:4318/v1/traces.
+	Endpoint string
+	// Headers are added to the requests, e.g. for authentication.
+	Headers map[string]string
+	// ServiceName is the service.name of the spans' resource.
+	ServiceName string
+	// Client sends the requests, or http.DefaultClient if nil.
+	Client *http.Client
+
+	m     sync.Mutex
+	spans []SpanData
+}
+
+// OTLP implements Exporter
+var _ Exporter = (*OTLP)(nil)
+
+// ExportSpan implements Exporter
+func (o *OTLP) ExportSpan(s SpanData) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	o.spans = append(o.spans, s)
+}
+
+// Flush sends the spans buffered so far.
+func (o *OTLP) Flush(ctx context.Context) error {
+	o.m.Lock()
+	spans := o.spans
+	o.spans = nil
+	o.m.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(otlpRequest(o.ServiceName, spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range o.Headers {
+		req.Header.Set(k, v)
+	}
+	client := o.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("exporting %d spans to %s: %s: %s", len(spans), o.Endpoint, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// FromEnv returns an OTLP exporter configured by the standard
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT (or OTEL_EXPORTER_OTLP_ENDPOINT, with
+// /v1/traces appended), OTEL_EXPORTER_OTLP_HEADERS and OTEL_SERVICE_NAME
+// variables, looked up with lookupEnv, or nil if no endpoint is set.
+func FromEnv(lookupEnv func(string) (string, bool)) (*OTLP, error) {
+	endpoint, _ := lookupEnv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		base, _ := lookupEnv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			return nil, nil
+		}
+		endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+	if protocol, _ := lookupEnv("OTEL_EXPORTER_OTLP_PROTOCOL"); protocol != "" && protocol != "http/json" {
+		return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_PROTOCOL is %q, but ko only exports traces with http/json", protocol)
+	}
+	o := &OTLP{Endpoint: endpoint, ServiceName: "ko"}
+	if name, _ := lookupEnv("OTEL_SERVICE_NAME"); name != "" {
+		o.ServiceName = name
+	}
+	if headers, _ := lookupEnv("OTEL_EXPORTER_OTLP_HEADERS"); headers != "" {
+		o.Headers = map[string]string{}
+		for _, h := range strings.Split(headers, ",") {
+			kv := strings.SplitN(h, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_HEADERS: %q isn't key=value", h)
+			}
+			o.Headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	return o, nil
+}
+
+// The OTLP/JSON encoding of ExportTraceServiceRequest, for the fields ko
+// sets. See https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding.
+type (
+	otlpTraces struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            *otlpStatus     `json:"status,omitempty"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue string `json:"stringValue"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+const (
+	spanKindInternal = 1
+	statusCodeError  = 2
+)
+
+func otlpRequest(service string, spans []SpanData) otlpTraces {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentSpanID,
+			Name:              s.Name,
+			Kind:              spanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attributes),
+		}
+		if s.Error != "" {
+			span.Status = &otlpStatus{Code: statusCodeError, Message: s.Error}
+		}
+		out = append(out, span)
+	}
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttributes([]Attribute{String("service.name", service)})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "github.com/google/ko"}, Spans: out}},
+	}}}
+}
+
+func otlpAttributes(attrs []Attribute) []otlpAttribute {
+	if len(attrs) == 0 {
+		return nil
+	}
+	out := make([]otlpAttribute, 0, len(attrs))
+	for _, a := range attrs {
+		out = append(out, otlpAttribute{Key: a.Key, Value: otlpValue{StringValue: a.Value}})
+	}
+	return out
+}
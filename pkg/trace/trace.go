@@ -0,0 +1,172 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package trace records spans of the work ko does, like builds and
+// publishes, in the OpenTelemetry model, and exports them.
+//
+// Spans are only recorded while an Exporter is set with SetExporter, so by
+// default tracing does nothing.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Attribute is a key and value describing a span.
+type Attribute struct {
+	Key   string
+	Value string
+}
+
+// String returns an Attribute.
+func String(key, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// SpanData is a finished span. IDs are hex encoded, like in OTLP.
+type SpanData struct {
+	Name         string
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Start        time.Time
+	End          time.Time
+	Attributes   []Attribute
+	// Error is the message of the error the span ended with, if any.
+	Error string
+}
+
+// Exporter receives spans as they end.
+type Exporter interface {
+	ExportSpan(SpanData)
+}
+
+var (
+	exporter   Exporter
+	exporterMu sync.Mutex
+)
+
+// SetExporter sets the Exporter spans are exported to, or nil to not record
+// them, and returns the one it replaced, e.g. to restore it.
+func SetExporter(e Exporter) Exporter {
+	exporterMu.Lock()
+	defer exporterMu.Unlock()
+	old := exporter
+	exporter = e
+	return old
+}
+
+func currentExporter() Exporter {
+	exporterMu.Lock()
+	defer exporterMu.Unlock()
+	return exporter
+}
+
+// Span is a span being recorded. A nil *Span records nothing, so callers
+// don't need to check whether tracing is enabled.
+type Span struct {
+	m        sync.Mutex
+	data     SpanData
+	exporter Exporter
+}
+
+type spanKey struct{}
+
+// Start starts a span named name, as a child of the span in ctx, if any, and
+// returns a context with the new span. When no Exporter is set, it returns
+// ctx and a nil *Span.
+func Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, *Span) {
+	e := currentExporter()
+	if e == nil {
+		return ctx, nil
+	}
+	s := &Span{
+		exporter: e,
+		data: SpanData{
+			Name:       name,
+			SpanID:     newID(8),
+			Start:      time.Now(),
+			Attributes: attrs,
+		},
+	}
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok && parent != nil {
+		s.data.TraceID = parent.data.TraceID
+		s.data.ParentSpanID = parent.data.SpanID
+	} else {
+		s.data.TraceID = newID(16)
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// SetAttributes adds attrs to s.
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.data.Attributes = append(s.data.Attributes, attrs...)
+}
+
+// End ends s, as failed with err if it isn't nil, and exports it.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.m.Lock()
+	s.data.End = time.Now()
+	if err != nil {
+		s.data.Error = err.Error()
+	}
+	data := s.data
+	data.Attributes = append([]Attribute(nil), s.data.Attributes...)
+	s.m.Unlock()
+	s.exporter.ExportSpan(data)
+}
+
+// newID returns a random hex encoded ID of n bytes.
+func newID(n int) string {
+	b := make([]byte, n)
+	// crypto/rand doesn't fail on the platforms ko runs on.
+	rand.Read(b) //nolint: errcheck
+	return hex.EncodeToString(b)
+}
+
+// Recorder is an Exporter that keeps the spans it receives in memory,
+// e.g. for tests.
+type Recorder struct {
+	m     sync.Mutex
+	spans []SpanData
+}
+
+// Recorder implements Exporter
+var _ Exporter = (*Recorder)(nil)
+
+// ExportSpan implements Exporter
+func (r *Recorder) ExportSpan(s SpanData) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.spans = append(r.spans, s)
+}
+
+// Spans returns the spans received so far, in the order they ended.
+func (r *Recorder) Spans() []SpanData {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return append([]SpanData(nil), r.spans...)
+}
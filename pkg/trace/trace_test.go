@@ -0,0 +1,188 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStartWithoutExporter(t *testing.T) {
+	ctx := context.Background()
+	got, span := Start(ctx, "build")
+	if span != nil || got != ctx {
+		t.Errorf("Start() = %v, %v, wanted ctx and nil", got, span)
+	}
+	// A nil span does nothing.
+	span.SetAttributes(String("k", "v"))
+	span.End(errors.New("boom"))
+}
+
+func TestStart(t *testing.T) {
+	rec := &Recorder{}
+	defer SetExporter(SetExporter(rec))
+
+	ctx, parent := Start(context.Background(), "resolve-file", String("ko.file", "a.yaml"))
+	_, child := Start(ctx, "build")
+	child.SetAttributes(String("ko.importpath", "example.com/app"))
+	child.End(errors.New("boom"))
+	parent.End(nil)
+
+	spans := rec.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("Spans() = %v, wanted 2", spans)
+	}
+	c, p := spans[0], spans[1]
+	if c.TraceID != p.TraceID || c.ParentSpanID != p.SpanID || p.ParentSpanID != "" {
+		t.Errorf("child %+v isn't a child of %+v", c, p)
+	}
+	if len(p.TraceID) != 32 || len(p.SpanID) != 16 {
+		t.Errorf("IDs %q, %q aren't 16 and 8 hex encoded bytes", p.TraceID, p.SpanID)
+	}
+	if c.Error != "boom" || p.Error != "" {
+		t.Errorf("errors = %q, %q, wanted boom and none", c.Error, p.Error)
+	}
+	if p.End.Before(p.Start) || p.End.Before(c.End) {
+		t.Errorf("parent %v-%v doesn't end after child %v-%v", p.Start, p.End, c.Start, c.End)
+	}
+	if diff := cmp.Diff([]Attribute{{"ko.importpath", "example.com/app"}}, c.Attributes); diff != "" {
+		t.Errorf("attributes (-want +got): %s", diff)
+	}
+}
+
+func TestOTLP(t *testing.T) {
+	var got otlpTraces
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Errorf("json.Unmarshal() = %v\n%s", err, b)
+		}
+	}))
+	defer server.Close()
+
+	env := map[string]string{
+		"OTEL_EXPORTER_OTLP_ENDPOINT": server.URL + "/",
+		"OTEL_EXPORTER_OTLP_HEADERS":  "Authorization=Bearer xyz, X-Team = ko",
+		"OTEL_SERVICE_NAME":           "ci",
+	}
+	o, err := FromEnv(func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	})
+	if err != nil {
+		t.Fatalf("FromEnv() = %v", err)
+	}
+	if want := server.URL + "/v1/traces"; o.Endpoint != want {
+		t.Errorf("Endpoint = %s, wanted %s", o.Endpoint, want)
+	}
+
+	// Nothing is sent without spans.
+	if err := o.Flush(context.Background()); err != nil || header != nil {
+		t.Fatalf("Flush() = %v, sent %v", err, header)
+	}
+
+	defer SetExporter(SetExporter(o))
+	_, span := Start(context.Background(), "publish", String("ko.importpath", "example.com/app"))
+	span.End(errors.New("denied"))
+	if err := o.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() = %v", err)
+	}
+
+	if got, want := header.Get("Authorization"), "Bearer xyz"; got != want {
+		t.Errorf("Authorization = %q, wanted %q", got, want)
+	}
+	if got, want := header.Get("X-Team"), "ko"; got != want {
+		t.Errorf("X-Team = %q, wanted %q", got, want)
+	}
+	if len(got.ResourceSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans[0].Spans) != 1 {
+		t.Fatalf("got %+v, wanted a single span", got)
+	}
+	rs := got.ResourceSpans[0]
+	if diff := cmp.Diff([]otlpAttribute{{Key: "service.name", Value: otlpValue{StringValue: "ci"}}}, rs.Resource.Attributes); diff != "" {
+		t.Errorf("resource (-want +got): %s", diff)
+	}
+	s := rs.ScopeSpans[0].Spans[0]
+	if s.Name != "publish" || s.Status == nil || s.Status.Code != statusCodeError || s.Status.Message != "denied" {
+		t.Errorf("span = %+v, wanted a failed publish", s)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	for _, test := range []struct {
+		desc    string
+		env     map[string]string
+		want    string
+		wantErr bool
+	}{{
+		desc: "not configured",
+	}, {
+		desc: "traces endpoint is used as is",
+		env: map[string]string{
+			"OTEL_EXPORTER_OTLP_ENDPOINT":        "http://collector:4318",
+			"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": "http://traces:4318/custom",
+		},
+		want: "http://traces:4318/custom",
+	}, {
+		desc: "json is supported",
+		env: map[string]string{
+			"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318",
+			"OTEL_EXPORTER_OTLP_PROTOCOL": "http/json",
+		},
+		want: "http://collector:4318/v1/traces",
+	}, {
+		desc: "grpc isn't",
+		env: map[string]string{
+			"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4317",
+			"OTEL_EXPORTER_OTLP_PROTOCOL": "grpc",
+		},
+		wantErr: true,
+	}, {
+		desc: "invalid headers",
+		env: map[string]string{
+			"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318",
+			"OTEL_EXPORTER_OTLP_HEADERS":  "token",
+		},
+		wantErr: true,
+	}} {
+		t.Run(test.desc, func(t *testing.T) {
+			o, err := FromEnv(func(k string) (string, bool) {
+				v, ok := test.env[k]
+				return v, ok
+			})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("FromEnv() = %v, wanted error: %t", err, test.wantErr)
+			}
+			var got string
+			if o != nil {
+				got = o.Endpoint
+			}
+			if got != test.want {
+				t.Errorf("Endpoint = %q, wanted %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package warnings collects the warnings of a run, so that they can be
+// reported together at its end, and fail it.
+//
+// Like the standard logger of package log, there's a default Collector that
+// the package-level functions use, which a command can replace with
+// SetDefault.
+package warnings
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Codes of the warnings ko emits, to select them with Check.
+const (
+	// DeprecatedFlag is for flags (or ways of passing them) that will be
+	// removed.
+	DeprecatedFlag = "deprecated-flag"
+	// FloatingTag is for references that can be moved to other images
+	// after they're deployed.
+	FloatingTag = "floating-tag"
+	// SkippedTag is for tags that couldn't be expanded.
+	SkippedTag = "skipped-tag"
+	// DigestMismatch is for images published with different digests.
+	DigestMismatch = "digest-mismatch"
+	// CgoBase is for cgo binaries on base images without a C library.
+	CgoBase = "cgo-base"
+	// PlatformFallback is for platforms built on a base image of another
+	// variant.
+	PlatformFallback = "platform-fallback"
+	// SkippedFile is for files and directories passed with -f that aren't
+	// read.
+	SkippedFile = "skipped-file"
+	// BuildConfig is for 'builds' entries in .ko.yaml that don't apply.
+	BuildConfig = "build-config"
+	// Signing is for images that --sign doesn't sign.
+	Signing = "signing"
+	// Concurrency is for invalid numbers of concurrent builds.
+	Concurrency = "concurrency"
+	// Tracing is for traces that couldn't be exported.
+	Tracing = "tracing"
+	// SinglePlatform is for images built for fewer platforms than
+	// --platform asks for, e.g. by --watch.
+	SinglePlatform = "single-platform"
+	// DaemonFallback is for images written to a tarball because the
+	// local docker daemon isn't reachable.
+	DaemonFallback = "daemon-fallback"
+	// BaseCache is for base images used from the base image cache
+	// because their registry couldn't be reached.
+	BaseCache = "base-cache"
+	// SanitizedName is for image names changed to be valid, or that
+	// collide with another's.
+	SanitizedName = "sanitized-name"
+	// DaemonBase is for docker-daemon:// base images pulled from their
+	// registry, because the daemon couldn't provide them.
+	DaemonBase = "daemon-base"
+	// BaseMoved is for base images whose tag points at another digest
+	// than when it was cached.
+	BaseMoved = "base-moved"
+)
+
+// All selects every code in Check.
+const All = "all"
+
+// Codes are the codes of the warnings ko emits.
+var Codes = []string{
+	DeprecatedFlag, FloatingTag, SkippedTag, DigestMismatch, CgoBase,
+	PlatformFallback, SkippedFile, BuildConfig, Signing, Concurrency, Tracing,
+	SinglePlatform, DaemonFallback, BaseCache, SanitizedName, DaemonBase,
+	BaseMoved,
+}
+
+// Warning is a single warning, with the file and line it's about, if any.
+type Warning struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+}
+
+func (w Warning) String() string {
+	switch {
+	case w.File != "" && w.Line > 0:
+		return fmt.Sprintf("%s:%d: %s", w.File, w.Line, w.Message)
+	case w.File != "" && !strings.Contains(w.Message, w.File):
+		return fmt.Sprintf("%s: %s", w.File, w.Message)
+	}
+	return w.Message
+}
+
+// Collector collects warnings. Identical warnings are only collected once.
+// The zero value is ready to use.
+type Collector struct {
+	m        sync.Mutex
+	warnings []Warning
+	seen     map[Warning]bool
+}
+
+// Add logs w, like ko always has, and collects it.
+func (c *Collector) Add(w Warning) {
+	log.Printf("WARNING: %s", w.Message)
+	c.Record(w)
+}
+
+// Warnf adds a warning with code, and a message formatted like fmt.Sprintf.
+func (c *Collector) Warnf(code, format string, args ...interface{}) {
+	c.Add(Warning{Code: code, Message: fmt.Sprintf(format, args...)})
+}
+
+// Record collects w without logging it, e.g. for notices that were logged
+// in another form.
+func (c *Collector) Record(w Warning) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.seen == nil {
+		c.seen = map[Warning]bool{}
+	}
+	if c.seen[w] {
+		return
+	}
+	c.seen[w] = true
+	c.warnings = append(c.warnings, w)
+}
+
+// Warnings returns the collected warnings, in the order they were added.
+func (c *Collector) Warnings() []Warning {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return append([]Warning(nil), c.warnings...)
+}
+
+var (
+	std   = &Collector{}
+	stdMu sync.Mutex
+)
+
+// Default returns the default Collector.
+func Default() *Collector {
+	stdMu.Lock()
+	defer stdMu.Unlock()
+	return std
+}
+
+// SetDefault replaces the default Collector with c, and returns the one it
+// replaced, e.g. to restore it.
+func SetDefault(c *Collector) *Collector {
+	stdMu.Lock()
+	defer stdMu.Unlock()
+	old := std
+	std = c
+	return old
+}
+
+// Add adds w to the default Collector.
+func Add(w Warning) { Default().Add(w) }
+
+// Warnf adds a warning to the default Collector.
+func Warnf(code, format string, args ...interface{}) { Default().Warnf(code, format, args...) }
+
+// Record records w in the default Collector, without logging it.
+func Record(w Warning) { Default().Record(w) }
+
+// Report writes warnings to w, grouped by code, or nothing if there are none.
+func Report(w io.Writer, warnings []Warning) {
+	if len(warnings) == 0 {
+		return
+	}
+	byCode := map[string][]Warning{}
+	var codes []string
+	for _, warning := range warnings {
+		if _, ok := byCode[warning.Code]; !ok {
+			codes = append(codes, warning.Code)
+		}
+		byCode[warning.Code] = append(byCode[warning.Code], warning)
+	}
+	sort.Strings(codes)
+	noun := "warnings"
+	if len(warnings) == 1 {
+		noun = "warning"
+	}
+	fmt.Fprintf(w, "%d %s:\n", len(warnings), noun)
+	for _, code := range codes {
+		fmt.Fprintf(w, "  %s (%d):\n", code, len(byCode[code]))
+		for _, warning := range byCode[code] {
+			fmt.Fprintf(w, "    %s\n", warning)
+		}
+	}
+}
+
+// Check returns an error if there are more than max warnings (unless max is
+// negative), or any with one of the codes in asErrors, or any at all if
+// asErrors has All.
+func Check(warnings []Warning, max int, asErrors []string) error {
+	errorCodes := map[string]bool{}
+	for _, code := range asErrors {
+		if !isCode(code) {
+			return fmt.Errorf("unknown warning code %q, expected %s or one of: %s", code, All, strings.Join(Codes, ", "))
+		}
+		errorCodes[code] = true
+	}
+	var failed []string
+	for _, w := range warnings {
+		if errorCodes[All] || errorCodes[w.Code] {
+			failed = append(failed, fmt.Sprintf("[%s] %s", w.Code, w))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d warnings are errors:\n  %s", len(failed), strings.Join(failed, "\n  "))
+	}
+	if max >= 0 && len(warnings) > max {
+		return fmt.Errorf("%d warnings, more than the %d allowed", len(warnings), max)
+	}
+	return nil
+}
+
+func isCode(code string) bool {
+	if code == All {
+		return true
+	}
+	for _, c := range Codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+// Copyright 2021 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package warnings
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCollector(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	c := &Collector{}
+	c.Warnf(FloatingTag, "%s is a tag", "foo:latest")
+	c.Warnf(FloatingTag, "%s is a tag", "foo:latest")
+	c.Record(Warning{Code: SkippedFile, Message: "skipped", File: "a.txt"})
+
+	want := []Warning{
+		{Code: FloatingTag, Message: "foo:latest is a tag"},
+		{Code: SkippedFile, Message: "skipped", File: "a.txt"},
+	}
+	if diff := cmp.Diff(want, c.Warnings()); diff != "" {
+		t.Errorf("Warnings() (-want +got): %s", diff)
+	}
+	// Add logs every time, like ko always has, but Record doesn't.
+	if got := strings.Count(logs.String(), "WARNING: foo:latest is a tag"); got != 2 {
+		t.Errorf("logged %d warnings, wanted 2:\n%s", got, logs.String())
+	}
+	if strings.Contains(logs.String(), "skipped") {
+		t.Errorf("Record() logged:\n%s", logs.String())
+	}
+}
+
+func TestDefault(t *testing.T) {
+	c := &Collector{}
+	old := SetDefault(c)
+	Record(Warning{Code: Signing, Message: "unsigned"})
+	if got := SetDefault(old); got != c {
+		t.Errorf("SetDefault() = %p, wanted %p", got, c)
+	}
+	Record(Warning{Code: Signing, Message: "elsewhere"})
+	if diff := cmp.Diff([]Warning{{Code: Signing, Message: "unsigned"}}, c.Warnings()); diff != "" {
+		t.Errorf("Warnings() (-want +got): %s", diff)
+	}
+}
+
+func TestReport(t *testing.T) {
+	var buf bytes.Buffer
+	Report(&buf, nil)
+	if buf.Len() != 0 {
+		t.Errorf("Report(nil) = %q, wanted nothing", buf.String())
+	}
+
+	Report(&buf, []Warning{
+		{Code: SkippedFile, Message: "skipping b.txt", File: "b.txt"},
+		{Code: FloatingTag, Message: "foo:latest is a tag"},
+		{Code: SkippedFile, Message: "not yaml", File: "c.txt"},
+		{Code: BuildConfig, Message: "unused", File: ".ko.yaml", Line: 3},
+	})
+	want := `4 warnings:
+  build-config (1):
+    .ko.yaml:3: unused
+  floating-tag (1):
+    foo:latest is a tag
+  skipped-file (2):
+    skipping b.txt
+    c.txt: not yaml
+`
+	if diff := cmp.Diff(want, buf.String()); diff != "" {
+		t.Errorf("Report() (-want +got): %s", diff)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	ws := []Warning{
+		{Code: FloatingTag, Message: "foo:latest is a tag"},
+		{Code: SkippedFile, Message: "skipping b.txt", File: "b.txt"},
+		{Code: SkippedFile, Message: "skipping c.txt", File: "c.txt"},
+	}
+	for _, test := range []struct {
+		desc     string
+		warnings []Warning
+		max      int
+		asErrors []string
+		wantErr  string
+	}{{
+		desc:     "no limits",
+		warnings: ws,
+		max:      -1,
+	}, {
+		desc:     "under max",
+		warnings: ws,
+		max:      3,
+	}, {
+		desc:     "over max",
+		warnings: ws,
+		max:      2,
+		wantErr:  "3 warnings, more than the 2 allowed",
+	}, {
+		desc:     "zero max",
+		warnings: ws[:1],
+		max:      0,
+		wantErr:  "1 warnings, more than the 0 allowed",
+	}, {
+		desc:     "selected code",
+		warnings: ws,
+		max:      -1,
+		asErrors: []string{FloatingTag},
+		wantErr:  "1 warnings are errors:\n  [floating-tag] foo:latest is a tag",
+	}, {
+		desc:     "selected codes",
+		warnings: ws,
+		max:      -1,
+		asErrors: []string{SkippedFile, CgoBase},
+		wantErr:  "2 warnings are errors:\n  [skipped-file] skipping b.txt\n  [skipped-file] skipping c.txt",
+	}, {
+		desc:     "unselected codes",
+		warnings: ws,
+		max:      -1,
+		asErrors: []string{CgoBase, DigestMismatch},
+	}, {
+		desc:     "all",
+		warnings: ws[:2],
+		max:      -1,
+		asErrors: []string{All},
+		wantErr:  "2 warnings are errors:\n  [floating-tag] foo:latest is a tag\n  [skipped-file] skipping b.txt",
+	}, {
+		desc:     "all without warnings",
+		max:      0,
+		asErrors: []string{All},
+	}, {
+		desc:     "unknown code",
+		max:      -1,
+		asErrors: []string{"floating-tags"},
+		wantErr:  `unknown warning code "floating-tags"`,
+	}} {
+		t.Run(test.desc, func(t *testing.T) {
+			err := Check(test.warnings, test.max, test.asErrors)
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Errorf("Check() = %v", err)
+			case test.wantErr != "" && err == nil:
+				t.Errorf("Check() = nil, wanted %q", test.wantErr)
+			case test.wantErr != "" && !strings.HasPrefix(err.Error(), test.wantErr):
+				t.Errorf("Check() = %q, wanted %q", err, test.wantErr)
+			}
+		})
+	}
+}